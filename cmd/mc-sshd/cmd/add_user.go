@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// addUserCmd adds a user to a database that mc-sshd owns.
+var addUserCmd = &cobra.Command{
+	Use:   "add-user slug email",
+	Short: "Add a user to a SQLite database.",
+	Long: `add-user adds a user who logs in with slug, for a deployment that runs on its own database (see
+MCSSHD_DB_DRIVER) rather than the Materials Commons database, whose users are added through the web
+app. The password is read from the MCSSHD_ADD_USER_PASSWORD environment variable. With
+MCSSHD_ALLOW_PROJECT_CREATION=true users create their projects by making a directory at the root.`,
+	Args: cobra.ExactArgs(2),
+	Run:  addUserMain,
+}
+
+var addUserName string
+
+func init() {
+	rootCmd.AddCommand(addUserCmd)
+	addUserCmd.Flags().StringVar(&addUserName, "name", "", "the user's name, by default their slug")
+}
+
+func addUserMain(cmd *cobra.Command, args []string) {
+	slug, email := args[0], args[1]
+
+	loadServerConfig()
+
+	if mcsshdDB.Driver == "mysql" {
+		log.Fatalf("Users of the Materials Commons database are added through the web app")
+	}
+
+	password := os.Getenv("MCSSHD_ADD_USER_PASSWORD")
+	if password == "" {
+		log.Fatalf("MCSSHD_ADD_USER_PASSWORD not set or blank")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("Unable to hash the password: %s", err)
+	}
+
+	if addUserName == "" {
+		addUserName = slug
+	}
+
+	user, err := mc.AddUser(mustOpenDatabase(), slug, addUserName, email, string(hash))
+	if err != nil {
+		log.Fatalf("Unable to add user %s: %s", slug, err)
+	}
+
+	log.Infof("Added user %s (%d)", user.Slug, user.ID)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+)
+
+// aliasSlugCmd records the old slug of a renamed project.
+var aliasSlugCmd = &cobra.Command{
+	Use:   "alias-slug old-slug project-slug",
+	Short: "Keep an old slug of a renamed project working.",
+	Long: `alias-slug makes old-slug an alias of the project whose slug is now project-slug, so that
+bookmarks and scripts that use the old slug keep working after the project is renamed. Paths that
+start with the old slug resolve to the project over both SCP and SFTP, and each use of the old slug
+is logged as a deprecation warning. An old slug can't be one that a project currently uses.`,
+	Args: cobra.ExactArgs(2),
+	Run:  aliasSlugMain,
+}
+
+func init() {
+	rootCmd.AddCommand(aliasSlugCmd)
+}
+
+func aliasSlugMain(cmd *cobra.Command, args []string) {
+	oldSlug, projectSlug := args[0], args[1]
+
+	loadServerConfig()
+
+	stores := mustSetupStores()
+
+	project, err := stores.ProjectStore.GetProjectBySlug(projectSlug)
+	if err != nil {
+		log.Fatalf("Unable to find project %s: %s", projectSlug, err)
+	}
+
+	if err := stores.ProjectSlugAliasStore.AddProjectSlugAlias(oldSlug, project.ID); err != nil {
+		log.Fatalf("Unable to alias %s to project %s: %s", oldSlug, projectSlug, err)
+	}
+
+	log.Infof("%s is now an alias of project %s (%d)", oldSlug, projectSlug, project.ID)
+}
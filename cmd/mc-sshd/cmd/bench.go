@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mcbench"
+	"github.com/spf13/cobra"
+)
+
+// benchCmd drives a running mc-sshd server with a synthetic SFTP workload and reports the throughput.
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Run a synthetic SFTP upload workload against a mc-sshd server and report throughput.",
+	Long: `bench uploads generated files to a project on a running mc-sshd server and reports the throughput.
+The files are uploaded into a new mc-bench-<timestamp> directory in the project. The password is read
+from the MCSSHD_BENCH_PASSWORD environment variable.
+
+Workloads:
+    small - many small files in a single directory
+    large - a few large files
+    deep  - files spread across a deeply nested directory tree`,
+	Run: benchMain,
+}
+
+var benchOptions mcbench.Options
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+	benchCmd.Flags().StringVar(&benchOptions.Addr, "addr", "localhost:2222", "host:port of the mc-sshd server")
+	benchCmd.Flags().StringVar(&benchOptions.User, "user", "", "user slug to log in as")
+	benchCmd.Flags().StringVar(&benchOptions.ProjectSlug, "project", "", "slug of the project to upload into")
+	benchCmd.Flags().StringVar(&benchOptions.Workload, "workload", mcbench.WorkloadSmallFiles, "workload to run: small, large or deep")
+	benchCmd.Flags().IntVar(&benchOptions.Files, "files", 0, "number of files to upload (defaults depend on the workload)")
+	benchCmd.Flags().Int64Var(&benchOptions.FileSize, "size", 0, "size of each file in bytes (defaults depend on the workload)")
+	benchCmd.Flags().IntVar(&benchOptions.Depth, "depth", 20, "depth of the directory tree for the deep workload")
+	benchCmd.Flags().IntVar(&benchOptions.Concurrency, "concurrency", 4, "number of parallel SFTP sessions")
+}
+
+func benchMain(cmd *cobra.Command, args []string) {
+	if benchOptions.User == "" || benchOptions.ProjectSlug == "" {
+		log.Fatalf("Both --user and --project must be specified")
+	}
+
+	if benchOptions.Password = os.Getenv("MCSSHD_BENCH_PASSWORD"); benchOptions.Password == "" {
+		log.Fatalf("MCSSHD_BENCH_PASSWORD not set or blank")
+	}
+
+	setBenchDefaults(&benchOptions)
+
+	result, err := mcbench.Run(benchOptions)
+	if err != nil {
+		log.Errorf("Benchmark had failures: %s", err)
+	}
+
+	if result != nil {
+		fmt.Printf("%s workload: %s\n", benchOptions.Workload, result)
+	}
+}
+
+// setBenchDefaults fills in the number of files and file size when they weren't given on the
+// command line, based on the workload.
+func setBenchDefaults(opts *mcbench.Options) {
+	files, size := 1000, int64(4*1024)
+	switch opts.Workload {
+	case mcbench.WorkloadLargeFiles:
+		files, size = 4, 256*1024*1024
+	case mcbench.WorkloadDeepTree:
+		files, size = 500, 4*1024
+	}
+
+	if opts.Files == 0 {
+		opts.Files = files
+	}
+
+	if opts.FileSize == 0 {
+		opts.FileSize = size
+	}
+}
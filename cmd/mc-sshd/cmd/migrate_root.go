@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/spf13/cobra"
+)
+
+// migrateRootCmd copies the stored files from one mcfs root to another.
+var migrateRootCmd = &cobra.Command{
+	Use:   "migrate-root",
+	Short: "Copy the stored files to a new mcfs root, for example to move onto new storage hardware.",
+	Long: `migrate-root copies the data for each finalized file from the old root (by default MCFS_DIR)
+to the new root, checking each copy against the checksum in the database. Files already in the new
+root with the right checksum are skipped. With --state the progress is saved, and an interrupted
+migration resumes where it stopped.
+
+To move to new storage without downtime, run migrate-root while the server is running, restart the
+server with MCFS_DIR set to the new root, and run migrate-root again with the same --state to copy
+the files written in between. Then run it once more with --delete to remove the data from the old root.
+The progress saved by a run without --delete isn't used by a run with it, so the --delete run goes
+through every file again, deleting those that were copied earlier and copying any that are missing;
+an interrupted --delete run resumes with --delete and the same --state. Where a file is stored is
+derived from MCFS_DIR, so --delete can't be used with --project.`,
+	Run: migrateRootMain,
+}
+
+var migrateRootFrom string
+var migrateRootTo string
+var migrateRootProjects []string
+var migrateRootState string
+var migrateRootDelete bool
+
+func init() {
+	rootCmd.AddCommand(migrateRootCmd)
+	migrateRootCmd.Flags().StringVar(&migrateRootFrom, "from", "", "root to copy the files from (default MCFS_DIR)")
+	migrateRootCmd.Flags().StringVar(&migrateRootTo, "to", "", "root to copy the files to")
+	migrateRootCmd.Flags().StringSliceVar(&migrateRootProjects, "project", nil, "slug of a project to migrate, can be repeated (default all projects)")
+	migrateRootCmd.Flags().StringVar(&migrateRootState, "state", "", "file to save the progress to, so that the migration can be resumed")
+	migrateRootCmd.Flags().BoolVar(&migrateRootDelete, "delete", false, "delete the data from the old root once it has been copied and checked")
+}
+
+func migrateRootMain(cmd *cobra.Command, args []string) {
+	loadServerConfig()
+
+	if migrateRootTo == "" {
+		log.Fatalf("--to must be specified")
+	}
+
+	if migrateRootFrom == "" {
+		migrateRootFrom = mcfsRoot
+	}
+
+	stores := mustSetupStores()
+
+	migrator := mc.NewRootMigrator(stores, migrateRootFrom, migrateRootTo)
+	migrator.StatePath = migrateRootState
+	migrator.DeleteSource = migrateRootDelete
+	for _, slug := range migrateRootProjects {
+		project, err := stores.ProjectStore.GetProjectBySlug(slug)
+		if err != nil {
+			log.Fatalf("Unable to find project %s: %s", slug, err)
+		}
+		migrator.ProjectIDs = append(migrator.ProjectIDs, project.ID)
+	}
+
+	result, err := migrator.Run(context.Background())
+	if err != nil {
+		log.Errorf("Migration stopped early: %s", err)
+	}
+
+	fmt.Printf("Migrated files: %s\n", result)
+	if err != nil || result.Failed != 0 {
+		os.Exit(1)
+	}
+}
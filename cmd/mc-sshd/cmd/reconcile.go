@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/spf13/cobra"
+)
+
+// reconcileCmd runs a single pass of the reconciler that cleans up interrupted uploads.
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Complete or remove uploads that were interrupted before they were finalized.",
+	Long: `reconcile finds files that were created but never finalized, for example because the server
+crashed during an upload. Files whose data was completely written are finalized. Files with no data,
+or that have since been replaced by a newer version, are removed. It uses the same configuration as
+the server. When running mc-sshd with MCSSHD_RECONCILE_INTERVAL set this is done periodically.`,
+	Run: reconcileMain,
+}
+
+var reconcileMinAge time.Duration
+var reconcileDryRun bool
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+	reconcileCmd.Flags().DurationVar(&reconcileMinAge, "min-age", mc.DefaultReconcileMinAge, "only reconcile files created at least this long ago")
+	reconcileCmd.Flags().BoolVar(&reconcileDryRun, "dry-run", false, "report what would be done without changing anything")
+}
+
+func reconcileMain(cmd *cobra.Command, args []string) {
+	loadServerConfig()
+
+	stores := mustSetupStores()
+
+	reconciler := mc.NewReconciler(stores, coordinator, mcfsRoot)
+	reconciler.MinAge = reconcileMinAge
+	reconciler.DryRun = reconcileDryRun
+
+	result, err := reconciler.Run(context.Background())
+	if err != nil {
+		log.Errorf("Reconciliation stopped early: %s", err)
+	}
+
+	fmt.Printf("Pending files: %s\n", result)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+)
+
+// repairCmd restores the data of damaged files.
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Restore the data of damaged files from other files with the same checksum, or from a replica site.",
+	Long: `repair restores the data of the files flagged as damaged, because their data was missing when
+they were downloaded. With --all every finalized file is checked, and the files whose data is
+missing or doesn't match its checksum are repaired. The data is copied from another file with the
+same checksum whose data is intact, or fetched from the site at MCSSHD_REPLICA_URL. Restored data
+is checked against the checksum before it replaces anything. Files whose data is intact have their
+damaged flag cleared, and with --all the files that couldn't be restored are flagged.
+
+Each file that was restored or couldn't be restored is written to the report as a line of JSON with
+an "outcome" of restored or failed. A summary is printed when the repair finishes, and repair exits
+with status 1 if any files couldn't be restored.`,
+	Run: repairMain,
+}
+
+var repairProjects []string
+var repairReportPath string
+var repairAll bool
+
+func init() {
+	rootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().StringSliceVar(&repairProjects, "project", nil, "slug of a project to repair, can be repeated (default all projects)")
+	repairCmd.Flags().StringVar(&repairReportPath, "report", "-", "file to write the report to, - for stdout")
+	repairCmd.Flags().BoolVar(&repairAll, "all", false, "check every file, not only the files flagged as damaged")
+}
+
+func repairMain(cmd *cobra.Command, args []string) {
+	loadServerConfig()
+
+	stores := mustSetupStores()
+
+	repairer := newFileRepairer(stores)
+	repairer.All = repairAll
+	for _, slug := range repairProjects {
+		project, err := stores.ProjectStore.GetProjectBySlug(slug)
+		if err != nil {
+			log.Fatalf("Unable to find project %s: %s", slug, err)
+		}
+		repairer.ProjectIDs = append(repairer.ProjectIDs, project.ID)
+	}
+
+	var report io.WriteCloser = os.Stdout
+	if repairReportPath != "-" {
+		var err error
+		if report, err = os.Create(repairReportPath); err != nil {
+			log.Fatalf("Unable to create report %s: %s", repairReportPath, err)
+		}
+	}
+	repairer.Report = report
+
+	result, err := repairer.Run(context.Background())
+	if err != nil {
+		log.Errorf("Repair stopped early: %s", err)
+	}
+
+	if closeErr := report.Close(); closeErr != nil && err == nil {
+		log.Errorf("Unable to write report %s: %s", repairReportPath, closeErr)
+		err = closeErr
+	}
+
+	fmt.Fprintf(os.Stderr, "Repaired files: %s\n", result)
+	if err != nil || result.Failed != 0 {
+		os.Exit(1)
+	}
+}
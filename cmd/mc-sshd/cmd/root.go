@@ -3,10 +3,15 @@ package cmd
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,16 +19,21 @@ import (
 	"github.com/charmbracelet/wish"
 	"github.com/charmbracelet/wish/scp"
 	"github.com/gliderlabs/ssh"
+	"github.com/go-redis/redis/v8"
 	mcdb "github.com/materials-commons/gomcdb"
 	"github.com/materials-commons/gomcdb/mcmodel"
 	"github.com/materials-commons/gomcdb/store"
 	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/materials-commons/mc-ssh/pkg/mclock"
+	"github.com/materials-commons/mc-ssh/pkg/mcproject"
+	"github.com/materials-commons/mc-ssh/pkg/mcredis"
 	"github.com/materials-commons/mc-ssh/pkg/mcscp"
 	"github.com/materials-commons/mc-ssh/pkg/mcsftp"
 	"github.com/pkg/sftp"
 	"github.com/spf13/cobra"
 	"github.com/subosito/gotenv"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -46,13 +56,45 @@ func Execute() {
 
 var mcfsRoot string
 var userStore store.UserStore
-var mcsshdHost string
-var mcsshdPort string
-var mcsshdHostkeyPath string
 
-func init() {
-	incompleteConfiguration := false
+// The server's settings, loaded from the environment by loadServerConfig. See the loaders in pkg/mc for
+// the variables each one is loaded from.
+var mcsshdServer mc.ServerConfig
+var mcsshdRedis mc.RedisConfig
+var mcsshdCache mc.CacheConfig
+var mcsshdDB mc.DatabaseConfig
+var mcsshdGeoIP mc.GeoIPConfig
+var mcsshdTarpit mc.TarpitConfig
+var mcsshdUploads mc.UploadProcessingConfig
+var mcsshdVersioning mc.VersioningConfig
+var mcsshdIngest mc.IngestConfig
+var mcsshdFaults mc.FaultInjectionConfig
+var mcsshdMetrics mc.MetricsConfig
+var mcsshdFileServer mc.FileServerConfig
+var mcsshdStandby mc.StandbyConfig
+var mcsshdAuthz mc.AuthzConfig
+var mcsshdFeatures mc.FeatureFlagConfig
+var mcsshdSFTPTrace *mcsftp.TraceOptions
+var mcsshdPull mc.PullConfig
+var mcsshdScratch mc.ScratchConfig
+var mcsshdConfig = mc.DefaultConfig()
 
+var keepalive *mc.Keepalive
+var geoIP *mc.GeoIP
+var loginsByCountry *expvar.Map
+var tarpit *mc.Tarpit
+
+// authStores are the stores passwordHandler uses to authenticate guests and tokens.
+var authStores *mc.Stores
+var faultInjector *mc.FaultInjector
+var userUsage *mc.UserUsageStats
+var leaderElector mc.LeaderElector
+var coordinator *mc.Coordinator
+
+// loadServerConfig loads the server configuration from the environment. It is called by the commands
+// that need it, rather than from init(), so that commands such as bench, which run against a remote
+// server, don't require the server configuration.
+func loadServerConfig() {
 	dotenvFilePath := os.Getenv("MC_DOTENV_PATH")
 	if dotenvFilePath == "" {
 		log.Fatalf("MC_DOTENV_PATH not set or blank")
@@ -62,84 +104,261 @@ func init() {
 		log.Fatalf("Failed loading configuration file %s: %s", dotenvFilePath, err)
 	}
 
-	mcfsRoot = os.Getenv("MCFS_DIR")
-	if mcfsRoot == "" {
-		log.Errorf("MCFS_DIR is not set or blank")
-		incompleteConfiguration = true
+	env := mc.NewEnv(os.LookupEnv)
+	mcfsRoot = env.Required("MCFS_DIR")
+	mcsshdServer = mc.LoadServerConfig(env)
+	mcsshdRedis = mc.LoadRedisConfig(env)
+	mcsshdCache = mc.LoadCacheConfig(env)
+	mcsshdDB = mc.LoadDatabaseConfig(env)
+	mcsshdGeoIP = mc.LoadGeoIPConfig(env)
+	mcsshdTarpit = mc.LoadTarpitConfig(env)
+	mcsshdUploads = mc.LoadUploadProcessingConfig(env)
+	mcsshdVersioning = mc.LoadVersioningConfig(env)
+	mcsshdIngest = mc.LoadIngestConfig(env)
+	mcsshdFaults = mc.LoadFaultInjectionConfig(env)
+	mcsshdMetrics = mc.LoadMetricsConfig(env)
+	mcsshdFileServer = mc.LoadFileServerConfig(env)
+	mcsshdStandby = mc.LoadStandbyConfig(env, mcsshdRedis)
+	mcsshdAuthz = mc.LoadAuthzConfig(env)
+	mcsshdFeatures = mc.LoadFeatureFlagConfig(env)
+	mcsshdPull = mc.LoadPullConfig(env)
+	mcsshdScratch = mc.LoadScratchConfig(env)
+	mcsshdConfig.LoadEnv(env)
+
+	// A satellite site doesn't have the file data, so it is always read-only.
+	if mcsshdFileServer.PrimaryURL != "" {
+		mcsshdConfig.ReadOnly = true
 	}
 
-	if mcsshdPort = os.Getenv("MCSSHD_PORT"); mcsshdPort == "" {
-		log.Errorf("MCSSHD_PORT is not set or blank")
-		incompleteConfiguration = true
+	// MCSSHD_SFTP_TRACE logs the SFTP requests of some users or sessions, such as user=alice,sample=10,rate=20.
+	// See mcsftp.ParseTraceOptions for the format.
+	env.Parse("MCSSHD_SFTP_TRACE", func(value string) (err error) {
+		mcsshdSFTPTrace, err = mcsftp.ParseTraceOptions(value)
+		return err
+	})
+
+	if errs := env.Errors(); len(errs) != 0 {
+		for _, err := range errs {
+			log.Errorf("%s", err)
+		}
+		log.Fatalf("One or more required variables not configured, exiting.")
 	}
 
-	if mcsshdHost = os.Getenv("MCSSHD_HOST"); mcsshdHost == "" {
-		log.Errorf("MCSSHD_HOST is not set or blank")
-		incompleteConfiguration = true
+	log.Infof("MCFS Root: %s", mcfsRoot)
+}
+
+func mcsshdMain(cmd *cobra.Command, args []string) {
+	loadServerConfig()
+
+	stores := mustSetupStores()
+	authStores = stores
+
+	// Connections can stage files in a scratch area on local disk that never becomes part of a project.
+	if mcsshdScratch.Dir != "" {
+		var err error
+		if coordinator.Scratch, err = mc.NewScratchAreas(mcsshdScratch.Dir, mcsshdScratch.Limit); err != nil {
+			log.Fatalf("Unable to set up the scratch areas in MCSSHD_SCRATCH_DIR (%s): %s", mcsshdScratch.Dir, err)
+		}
 	}
 
-	mcsshdHostkeyPath = os.Getenv("MCSSHD_HOST_KEY_PATH")
+	// Hosts that keep trying users that don't exist, such as SSH scanners, are slowed down.
+	if mcsshdTarpit.Threshold > 0 {
+		tarpit = mc.NewTarpit(mcsshdTarpit.Threshold)
+		tarpit.Delay = mcsshdTarpit.Delay
+		tarpit.MaxDelay = mcsshdTarpit.MaxDelay
+		if mcsshdTarpit.Feed != "" {
+			feed, err := os.OpenFile(mcsshdTarpit.Feed, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+			if err != nil {
+				log.Fatalf("Unable to open tarpit feed %s: %s", mcsshdTarpit.Feed, err)
+			}
+			tarpit.Feed = feed
+		}
+		expvar.Publish("tarpit", tarpit)
+		go tarpit.Run(context.Background())
+	}
 
-	switch {
-	case mcsshdHostkeyPath == "":
-		log.Errorf("MCSSHD_HOST_KEY_PATH is not set or blank")
-		incompleteConfiguration = true
-	default:
-		if _, err := os.Stat(mcsshdHostkeyPath); err != nil {
-			log.Errorf("MCSSHD_HOST_KEY_PATH file (%s) does not exist: %s", mcsshdHostkeyPath, err)
-			incompleteConfiguration = true
+	// Metrics and file serving also run on a standby, so that it can be monitored.
+	if mcsshdMetrics.Addr != "" {
+		go coordinator.Activity.Run(context.Background(), mcsshdMetrics.ActivityInterval)
+		go serveMetrics()
+	}
+
+	if mcsshdFileServer.Addr != "" {
+		go serveFiles()
+	}
+
+	// A standby waits here until it becomes the active instance. The background jobs below only run on
+	// the active instance.
+	if leaderElector != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		log.Infof("Standing by until this instance holds the %s lock", mcsshdStandby.Lock)
+		err := mc.WaitForLeadership(ctx, leaderElector, mcsshdStandby.LeaseTTL/3)
+		stop()
+		if err != nil {
+			log.Info("Stopping standby")
+			return
 		}
+
+		log.Infof("This instance is now the active instance")
+		defer leaderElector.Release()
 	}
 
-	if incompleteConfiguration {
-		log.Fatalf("One or more required variables not configured, exiting.")
+	// Conversions are queued in the background, so that the conversion policy and the projects' feature
+	// flags can be applied without slowing down uploads. The limiter is set up before the upload hooks so
+	// that it applies to their conversions too.
+	if !mcsshdConfig.ReadOnly {
+		conversionLimiter := mc.NewConversionLimiter(stores, mcsshdUploads.Conversions, mcsshdConfig)
+		go conversionLimiter.Run(context.Background())
+		stores = stores.Use(conversionLimiter.Middleware())
 	}
 
-	log.Infof("MCFS Root: %s", mcfsRoot)
-}
+	// Old versions are pruned in the background after a new version is written. A read-only server
+	// never writes, so it neither prunes nor reconciles.
+	if len(mcsshdVersioning.PrunePolicies) != 0 && !mcsshdConfig.ReadOnly {
+		pruner := mc.NewVersionPruner(stores, mcsshdVersioning.PrunePolicies, coordinator.Events)
+		go pruner.Run(context.Background())
+		stores = stores.Use(pruner.Middleware())
+	}
 
-func mcsshdMain(cmd *cobra.Command, args []string) {
-	db := mcdb.MustConnectToDB()
-	stores := mc.NewGormStores(db, mcfsRoot)
-	userStore = store.NewGormUserStore(db)
+	// The upload hooks, including the extraction of metadata, are run in the background after each file
+	// is written. The runner also extracts the archives uploaded into each project's extract paths, which
+	// project admins can set at any time, so it runs even without any hooks.
+	uploadHooks := mcsshdUploads.Hooks
+	if mcsshdUploads.ExtractMetadata {
+		uploadHooks = append(uploadHooks, mc.MetadataExtractorHook())
+	}
+	if !mcsshdConfig.ReadOnly {
+		hookRunner := mc.NewUploadHookRunner(stores, uploadHooks, mcsshdConfig, coordinator.Events, coordinator.QuotaCounter, mcfsRoot)
+		hookRunner.Workers = mcsshdUploads.HookWorkers
+		go hookRunner.Run(context.Background())
+		stores = stores.Use(hookRunner.Middleware())
+	}
+
+	// Repeated uploads are recognized before anything else sees the file finished, so that they don't
+	// prune, convert or run hooks.
+	if len(mcsshdVersioning.IdempotencyWindows) != 0 && !mcsshdConfig.ReadOnly {
+		stores = stores.Use(mc.IdempotentUploads(stores, mcsshdVersioning.IdempotencyWindows, mcsshdConfig))
+	}
+
+	// Finish or clean up uploads that were interrupted, for example by a crash, in the background.
+	if mcsshdDB.ReconcileInterval > 0 && !mcsshdConfig.ReadOnly {
+		reconciler := mc.NewReconciler(stores, coordinator, mcfsRoot)
+		go reconciler.RunPeriodically(context.Background(), mcsshdDB.ReconcileInterval)
+	}
 
-	// Setup SSH server and SCP Middleware handler
-	handler := mcscp.NewMCFSHandler(stores, mcfsRoot)
+	// Dead client connections are closed, so that their sessions end and release their files and locks.
+	if mcsshdServer.KeepaliveInterval > 0 {
+		keepalive = mc.NewKeepalive(mcsshdServer.KeepaliveInterval)
+		keepalive.MaxMissed = mcsshdServer.KeepaliveMaxMissed
+		expvar.Publish("keepalive_closed_connections", expvar.Func(func() interface{} { return keepalive.Closed() }))
+	}
+
+	// Logins are annotated with where the client is, and connections from countries that aren't
+	// allowed are closed before authentication.
+	if len(mcsshdGeoIP.DBs) != 0 {
+		var err error
+		if geoIP, err = mc.NewGeoIP(mcsshdGeoIP.DBs); err != nil {
+			log.Fatalf("Unable to load GeoIP databases: %s", err)
+		}
+		loginsByCountry = expvar.NewMap("logins_by_country")
+	}
+
+	// Setup SSH server and SCP Middleware handler. Commands that aren't scp are passed on by the
+	// scp middleware to the mc-lock/mc-unlock, mc project and mc quota commands.
+	handler := mcscp.NewMCFSHandler(stores, coordinator, mcsshdConfig, mcfsRoot)
 	s, err := wish.NewServer(
-		wish.WithAddress(fmt.Sprintf("%s:%s", mcsshdHost, mcsshdPort)),
+		wish.WithAddress(fmt.Sprintf("%s:%s", mcsshdServer.Host, mcsshdServer.Port)),
 		wish.WithPasswordAuth(passwordHandler),
-		wish.WithHostKeyPath(mcsshdHostkeyPath),
-		wish.WithMiddleware(scp.Middleware(handler, handler)),
+		wish.WithHostKeyPath(mcsshdServer.HostKeyPath),
+		wish.WithMiddleware(mclock.Middleware(stores, coordinator), mcproject.Middleware(stores, userStore, coordinator, mcsshdConfig, mcfsRoot), scp.Middleware(handler, handler), mcscp.ErrorsMiddleware, mcscp.WindowsPathsMiddleware, mcscp.VerifyManifestsMiddleware, mcscp.ActivityMiddleware(coordinator), scopedCredentialMiddleware, sessionLimitMiddleware, keepaliveMiddleware),
 	)
 
 	if err != nil {
 		log.Fatalf("Failed creating SSH Server: %s", err)
 	}
 
+	if !mcsshdGeoIP.CountryFilter.IsEmpty() {
+		s.ConnCallback = countryFilterCallback
+	}
+
 	// SFTP is a subsystem, so rather than being handled as middleware we have to set
 	// the subsystem handler.
 	s.SubsystemHandlers = make(map[string]ssh.SubsystemHandler)
 	s.SubsystemHandlers["sftp"] = func(s ssh.Session) {
+		watchConnection(s)
+
 		user := s.Context().Value("mcuser").(*mcmodel.User)
-		h := mcsftp.NewMCFSHandler(user, stores, mcfsRoot)
-		server := sftp.NewRequestServer(s, h)
+		if err := startSession(user); err != nil {
+			log.Errorf("Refusing sftp session for user %d: %s", user.ID, err)
+			_ = s.Exit(1)
+			return
+		}
+		defer coordinator.SessionCounter.Decrement(user.ID)
+
+		session := coordinator.Sessions.Register(user.Slug, func() { _ = s.Close() })
+		defer coordinator.Sessions.Unregister(session)
+
+		env := mc.ParseSessionEnv(s.Environ())
+		if mcsshdServer.WelcomeSkeleton != nil && !mcsshdConfig.ReadOnly {
+			if project, err := mcsshdServer.WelcomeSkeleton.Create(stores, user, env.Project, mcfsRoot); err != nil {
+				log.Errorf("Unable to create the welcome skeleton for user %d: %s", user.ID, err)
+			} else if project != nil {
+				log.Infof("Created the welcome skeleton in project %d for user %d", project.ID, user.ID)
+			}
+		}
+
+		h := mcsftp.NewMCFSHandler(user, env, stores, coordinator, mcsshdConfig, mcfsRoot)
+		mcsftp.TrackSession(h, session)
+		mcsftp.SetRemoteAddr(h, s.RemoteAddr())
+		authDuration, _ := s.Context().Value("mcAuthDuration").(time.Duration)
+		mcsftp.SetAuthDuration(h, authDuration)
+		sessionID, _ := s.Context().Value(ssh.ContextKeySessionID).(string)
+		clientVersion, _ := s.Context().Value(ssh.ContextKeyClientVersion).(string)
+		mcsftp.SetUploadSource(h, mc.NewUploadSource(clientVersion, s.RemoteAddr(), sessionID))
+		if coordinator.Scratch != nil {
+			mcsftp.SetScratchArea(h, func() (*mc.ScratchArea, error) {
+				return coordinator.Scratch.ForConnection(sessionID, s.Context().Done())
+			})
+		}
+		defer mcsftp.FinishSession(h)
+
+		channel := mcsftp.TracePackets(h, sessionID, session.Track(s), mcsshdSFTPTrace)
+		server := sftp.NewRequestServer(mcsftp.ServeExtensions(h, mcsftp.TrackAccessTimes(h, mcsftp.WatchSymlinks(h, channel))), h)
 		if err := server.Serve(); err == io.EOF {
 			_ = server.Close()
 		} else if err != nil {
 			log.Errorf("sftp server completed with error: %s", err)
 		}
+
+		// The summary is written to stderr, which OpenSSH clients show once the session has ended.
+		if summary := mcsftp.SessionSummary(h); !summary.Empty() {
+			summary.Log("sftp", user.Slug)
+			if mcsshdConfig.PrintSessionSummary {
+				_, _ = fmt.Fprint(s.Stderr(), summary)
+			}
+		}
 	}
 
 	// Run server
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	log.Infof("Starting SSH server on %s:%s", mcsshdHost, mcsshdPort)
+	log.Infof("Starting SSH server on %s:%s", mcsshdServer.Host, mcsshdServer.Port)
 	go func() {
 		if err := s.ListenAndServe(); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
 			log.Fatalf("%s", err)
 		}
 	}()
 
+	// The active instance stops if it loses the lock, so that it can't keep serving alongside the
+	// standby that took over.
+	if leaderElector != nil {
+		go func() {
+			err := mc.MaintainLeadership(context.Background(), leaderElector, mcsshdStandby.LeaseTTL/3, mcsshdStandby.LeaseTTL*2/3)
+			log.Errorf("Stopping, this instance is no longer the active instance: %s", err)
+			done <- syscall.SIGTERM
+		}()
+	}
+
 	<-done
 	log.Info("Stopping SSH server")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -147,28 +366,499 @@ func mcsshdMain(cmd *cobra.Command, args []string) {
 	if err := s.Shutdown(ctx); err != nil {
 		log.Fatalf("Error shutting down SSH Server: %s", err)
 	}
+
+	// Downloads counted since the last flush would otherwise be lost.
+	_ = coordinator.FileAccess.Flush()
+}
+
+// mustCheckSchema checks that db has the tables and columns that this build expects, and exits, or
+// switches to read-only, when it doesn't, according to MCSSHD_SCHEMA_MISMATCH.
+func mustCheckSchema(db *gorm.DB) {
+	if mcsshdDB.SchemaMismatch == mc.SchemaMismatchIgnore {
+		return
+	}
+
+	mismatches, err := mc.CheckSchema(db, mc.SchemaModels...)
+	if err != nil {
+		log.Fatalf("Unable to check the database schema: %s", err)
+	}
+
+	if len(mismatches) == 0 {
+		return
+	}
+
+	for _, mismatch := range mismatches {
+		log.Errorf("The database doesn't have %s, which this build expects", mismatch)
+	}
+
+	if mcsshdDB.SchemaMismatch != mc.SchemaMismatchReadOnly {
+		log.Fatalf("The database schema doesn't match this build, exiting. Set MCSSHD_SCHEMA_MISMATCH=read-only to run read-only.")
+	}
+
+	log.Errorf("The database schema doesn't match this build, running read-only")
+	mcsshdConfig.ReadOnly = true
+}
+
+// mustOpenDatabase opens the database selected by MCSSHD_DB_DRIVER. The Materials Commons database is
+// connected to with gomcdb, which retries while the database is starting up.
+func mustOpenDatabase() *gorm.DB {
+	if mcsshdDB.Driver == "mysql" && mcsshdDB.DSN == "" {
+		return mcdb.MustConnectToDB()
+	}
+
+	db, err := mc.OpenDatabase(mcsshdDB.Driver, mcsshdDB.DSN)
+	if err != nil {
+		log.Fatalf("Failed to open %s database: %s", mcsshdDB.Driver, err)
+	}
+
+	return db
+}
+
+// mustConnectStores connects to the database, and returns the stores for it. It also sets up the userStore.
+func mustConnectStores() *mc.Stores {
+	db := mustOpenDatabase()
+	mustCheckSchema(db)
+
+	userStore = store.NewGormUserStore(db)
+
+	if mcsshdDB.ReadDSN == "" {
+		return mc.NewGormStores(db, mcfsRoot)
+	}
+
+	readDB, err := mc.OpenDatabase(mcsshdDB.Driver, mcsshdDB.ReadDSN)
+	if err != nil {
+		log.Fatalf("Failed to open read replica db: %s", err)
+	}
+	log.Infof("Using read replica for listings, stats and project lookups")
+	return mc.NewGormStoresWithReadReplica(db, readDB, mcfsRoot)
+}
+
+// mustSetupOfflineStores returns the in memory stores for MCSSHD_OFFLINE_USERS and MCSSHD_OFFLINE_PROJECTS,
+// and sets up the userStore with the users.
+func mustSetupOfflineStores() *mc.Stores {
+	var users []mcmodel.User
+	for i, slug := range mcsshdDB.OfflineUsers {
+		hash, err := bcrypt.GenerateFromPassword([]byte(mcsshdDB.OfflinePasswords[i]), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Unable to hash the password of offline user %s: %s", slug, err)
+		}
+		users = append(users, mcmodel.User{ID: i + 1, Slug: slug, Name: slug, Password: string(hash)})
+	}
+
+	stores, err := mc.NewOfflineStores(mcfsRoot, users[0].ID, mcsshdDB.OfflineProjects...)
+	if err != nil {
+		log.Fatalf("Unable to set up the offline stores: %s", err)
+	}
+
+	log.Warnf("Running offline, without a database, with users %s and projects %s. Uploaded files are lost when mc-sshd stops.",
+		strings.Join(mcsshdDB.OfflineUsers, ", "), strings.Join(mcsshdDB.OfflineProjects, ", "))
+	userStore = mc.NewMemoryUserStore(users...)
+	return stores
+}
+
+// mustSetupStores connects to the database, and to redis when it is configured, and returns the stores. It
+// also sets up the userStore and coordinator.
+func mustSetupStores() *mc.Stores {
+	var stores *mc.Stores
+	if len(mcsshdDB.OfflineUsers) != 0 {
+		stores = mustSetupOfflineStores()
+	} else {
+		stores = mustConnectStores()
+	}
+
+	// Projects with FeatureDedup turned off keep the data of every upload, which isn't counted as
+	// deduplicated.
+	stores = stores.Use(mc.VerbatimUploads(stores, mcsshdConfig))
+
+	dedupStats := mc.NewDedupStats()
+	expvar.Publish("dedup", dedupStats)
+	stores = stores.Use(mc.DedupStatsMiddleware(dedupStats))
+
+	// The coordinator is shared between SCP and SFTP so that state such as write locks apply
+	// regardless of the protocol used. When Redis is configured the state is also shared with
+	// other mc-sshd instances.
+	var fileRelay *mcredis.FileRelay
+	if mcsshdRedis.Addr != "" {
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     mcsshdRedis.Addr,
+			Password: mcsshdRedis.Password,
+			DB:       mcsshdRedis.DB,
+		})
+
+		if err := redisClient.Ping(context.Background()).Err(); err != nil {
+			log.Fatalf("Unable to connect to redis at %s: %s", mcsshdRedis.Addr, err)
+		}
+
+		log.Infof("Using redis at %s for coordination", mcsshdRedis.Addr)
+		var (
+			heartbeat *mcredis.Heartbeat
+			err       error
+		)
+		if coordinator, heartbeat, err = mcredis.NewCoordinator(redisClient); err != nil {
+			log.Fatalf("Unable to set up the redis coordinator: %s", err)
+		}
+		go heartbeat.Run(context.Background())
+		fileRelay = mcredis.NewFileRelay(redisClient)
+
+		if mcsshdStandby.Lock == "redis" {
+			if leaderElector, err = mcredis.NewLeaderElector(redisClient, mcsshdStandby.LeaseTTL); err != nil {
+				log.Fatalf("Unable to set up the standby lease: %s", err)
+			}
+		}
+		stores = stores.Use(mcredis.ProjectCacheMiddleware(redisClient, mcsshdCache.ProjectTTL))
+	} else {
+		coordinator = mc.NewInMemoryCoordinator()
+	}
+
+	// Clients can wait for new files when watching is turned on. With redis the files uploaded to each
+	// instance are relayed to the clients waiting on every instance.
+	if mcsshdServer.FileWatchBuffer > 0 {
+		coordinator.FileWatcher = mc.NewFileWatcher(stores, mcsshdServer.FileWatchBuffer)
+		if fileRelay != nil {
+			coordinator.FileWatcher.Relay = fileRelay
+			go fileRelay.Run(context.Background(), coordinator.FileWatcher)
+		}
+		go coordinator.FileWatcher.Run(context.Background())
+		stores = stores.Use(coordinator.FileWatcher.Middleware())
+	}
+
+	// Users can have the server pull files from the allowed sources into their projects.
+	if len(mcsshdPull.Sources) != 0 && !mcsshdConfig.ReadOnly {
+		coordinator.Puller = mc.NewPuller(mcsshdPull.Sources, coordinator.PathLocker)
+		coordinator.Puller.S3Endpoint = mcsshdPull.S3Endpoint
+	}
+
+	// Without redis the project lookups are cached in memory, so that the sessions on this instance share
+	// them rather than each looking them up. Listings are only cached when MCSSHD_LISTING_CACHE_TTL is set.
+	if mcsshdRedis.Addr == "" && mcsshdCache.ProjectTTL > 0 {
+		projectCache := mc.NewSharedCache(mcsshdCache.ProjectTTL)
+		go projectCache.Run(context.Background())
+		stores = stores.Use(projectCache.Middleware(true, false))
+	}
+
+	if mcsshdCache.ListingTTL > 0 {
+		listingCache := mc.NewSharedCache(mcsshdCache.ListingTTL)
+		go listingCache.Run(context.Background())
+		stores = stores.Use(listingCache.Middleware(false, true))
+	}
+
+	coordinator.Sessions = mc.NewSessionRegistry()
+	expvar.Publish("sessions", coordinator.Sessions)
+	if mcsshdServer.IdleSessionTimeout > 0 {
+		go coordinator.Sessions.RunReaper(context.Background(), mcsshdServer.IdleSessionTimeout)
+	}
+
+	if mcsshdMetrics.EventWebhookURL != "" {
+		coordinator.Events = mc.MultiEventSink{coordinator.Events, mc.NewWebhookEventSink(mcsshdMetrics.EventWebhookURL)}
+	}
+
+	coordinator.Transfers = mc.NewTransferStats(coordinator.Events)
+	coordinator.Transfers.SlowRate = mcsshdMetrics.SlowTransferRate
+	coordinator.Transfers.TraceTimings = mcsshdMetrics.TraceTransferTimings
+	expvar.Publish("transfers", coordinator.Transfers)
+
+	if mcsshdMetrics.FileAccessFlushInterval > 0 {
+		coordinator.FileAccess = mc.NewFileAccessRecorder(stores.FileAccessStore)
+		expvar.Publish("file_access", coordinator.FileAccess)
+		go coordinator.FileAccess.Run(context.Background(), mcsshdMetrics.FileAccessFlushInterval)
+	}
+
+	if strings.HasPrefix(mcsshdStandby.Lock, "file:") {
+		leaderElector = mc.NewFileLeaderElector(strings.TrimPrefix(mcsshdStandby.Lock, "file:"))
+	}
+
+	if mcsshdMetrics.Addr != "" {
+		coordinator.Activity = mc.NewActivityStats(mcsshdMetrics.ActivityMaxSeries)
+		expvar.Publish("activity", coordinator.Activity)
+	}
+
+	// Only one instance needs to total up the usage, but it is cheap enough compared to the interval that
+	// each instance serving metrics does.
+	if mcsshdMetrics.Addr != "" && mcsshdMetrics.UserUsageInterval > 0 {
+		userUsage = mc.NewUserUsageStats(stores.UserUsageStore)
+		expvar.Publish("user_usage", userUsage)
+		go userUsage.Run(context.Background(), mcsshdMetrics.UserUsageInterval)
+	}
+
+	if mcsshdFeatures.Refresh > 0 {
+		mcsshdConfig.Features = mc.NewFeatureFlags(mcsshdFeatures.Flags, stores.FeatureFlagStore)
+		go mcsshdConfig.Features.Run(context.Background(), mcsshdFeatures.Refresh)
+	} else if len(mcsshdFeatures.Flags) != 0 {
+		mcsshdConfig.Features = mc.NewFeatureFlags(mcsshdFeatures.Flags, nil)
+	}
+
+	if mcsshdFileServer.PrimaryURL != "" {
+		remoteFiles, err := mc.NewRemoteFileCache(mcsshdFileServer.PrimaryURL, mcsshdFileServer.Token, mcfsRoot, mcsshdFileServer.CAs)
+		if err != nil {
+			log.Fatalf("Unable to use the primary at MCSSHD_PRIMARY_URL (%s): %s", mcsshdFileServer.PrimaryURL, err)
+		}
+
+		remoteFiles.RangeReadLimit = mcsshdFileServer.RangeReadLimit
+		coordinator.RemoteFiles = remoteFiles
+	}
+
+	// A satellite doesn't repair files, since it doesn't hold the primary's data.
+	if mcsshdFileServer.AutoRepair && mcsshdFileServer.PrimaryURL == "" {
+		coordinator.Repairer = newFileRepairer(stores)
+		go coordinator.Repairer.RunQueue(context.Background())
+	}
+
+	if mcsshdAuthz.URL != "" {
+		authorizer := mc.NewHTTPAuthorizer(mcsshdAuthz.URL, mcsshdAuthz.Timeout)
+		authorizer.FailOpen = mcsshdAuthz.FailOpen
+		authorizer.CacheTTL = mcsshdAuthz.CacheTTL
+		coordinator.Authorizer = authorizer
+	}
+
+	if len(mcsshdIngest.RateWindows) != 0 {
+		coordinator.IngestLimiter = mc.NewWindowedRateLimiter(mcsshdIngest.RateWindows)
+	}
+
+	if mcsshdFaults.Store != nil || mcsshdFaults.Storage != nil {
+		var storeFaults, storageFaults mc.FaultConfig
+		if mcsshdFaults.Store != nil {
+			storeFaults = *mcsshdFaults.Store
+		}
+		if mcsshdFaults.Storage != nil {
+			storageFaults = *mcsshdFaults.Storage
+		}
+
+		log.Warnf("Injecting faults, store: %+v, storage: %+v", storeFaults, storageFaults)
+		faultInjector = mc.NewFaultInjector(storeFaults, storageFaults)
+		expvar.Publish("faults", faultInjector)
+		mc.InjectStorageFaults(faultInjector)
+		stores = stores.Use(faultInjector.Middleware())
+	}
+
+	if mcsshdIngest.FinalizeHighWater > 0 {
+		coordinator.WriteBackpressure = mc.NewWriteBackpressure(mcsshdIngest.FinalizeHighWater)
+		expvar.Publish("write_backpressure", coordinator.WriteBackpressure)
+		stores = stores.Use(coordinator.WriteBackpressure.Middleware())
+	}
+
+	return stores
+}
+
+// newFileRepairer creates a FileRepairer that restores files from the MCSSHD_REPLICA_URL site, if set.
+func newFileRepairer(stores *mc.Stores) *mc.FileRepairer {
+	repairer := mc.NewFileRepairer(stores, mcfsRoot)
+	repairer.Events = coordinator.Events
+	if mcsshdFileServer.ReplicaURL != "" {
+		replica, err := mc.NewRemoteFileCache(mcsshdFileServer.ReplicaURL, mcsshdFileServer.Token, mcfsRoot, mcsshdFileServer.CAs)
+		if err != nil {
+			log.Fatalf("Unable to use the replica at MCSSHD_REPLICA_URL (%s): %s", mcsshdFileServer.ReplicaURL, err)
+		}
+
+		repairer.Replica = replica
+	}
+
+	return repairer
+}
+
+// serveFiles serves file data to satellite sites on mcsshdFileServer.Addr, over TLS.
+func serveFiles() {
+	log.Infof("Serving files to satellites on https://%s/files/", mcsshdFileServer.Addr)
+	mux := http.NewServeMux()
+	mux.Handle("/files/", mc.NewFileServer(mcsshdFileServer.Token, mcfsRoot))
+	if err := http.ListenAndServeTLS(mcsshdFileServer.Addr, mcsshdFileServer.Cert, mcsshdFileServer.Key, mux); err != nil {
+		log.Errorf("File server on %s stopped: %s", mcsshdFileServer.Addr, err)
+	}
+}
+
+// serveMetrics serves the metrics published with expvar on mcsshdMetrics.Addr, the per project
+// activity and per user storage usage in the Prometheus text format, and the hosts caught in the tarpit.
+func serveMetrics() {
+	log.Infof("Serving metrics on %s/debug/vars and %s/metrics", mcsshdMetrics.Addr, mcsshdMetrics.Addr)
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if tarpit != nil {
+		mux.Handle("/tarpit", tarpit)
+	}
+	if faultInjector != nil {
+		mux.Handle("/faults", faultInjector)
+	}
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := coordinator.Activity.WritePrometheus(w); err != nil {
+			log.Errorf("Unable to write activity metrics: %s", err)
+		}
+		if userUsage != nil {
+			if err := userUsage.WritePrometheus(w); err != nil {
+				log.Errorf("Unable to write user usage metrics: %s", err)
+			}
+		}
+	})
+	if err := http.ListenAndServe(mcsshdMetrics.Addr, mux); err != nil {
+		log.Errorf("Metrics server stopped: %s", err)
+	}
+}
+
+// scopedCredentialMiddleware only lets users logged in with a scoped credential, such as a guest or a
+// token, run scp, so that they can't use the mc commands with the full access of the user the credential
+// belongs to. SFTP is a subsystem and doesn't go through the middleware, but is limited to the
+// credential's scope.
+func scopedCredentialMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		cmd := s.Command()
+		if mcsshdConfig.Scopes.IsScoped(s.User()) && (len(cmd) == 0 || cmd[0] != "scp") {
+			_, _ = fmt.Fprintf(s.Stderr(), "guests and tokens can only transfer files with scp or sftp\n")
+			_ = s.Exit(1)
+			return
+		}
+
+		next(s)
+	}
+}
+
+// sessionLimitMiddleware enforces the per-user session limit for SCP. SFTP is a subsystem and doesn't
+// go through the middleware, so the SFTP subsystem handler does its own call to startSession.
+func sessionLimitMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		user := s.Context().Value("mcuser").(*mcmodel.User)
+		if err := startSession(user); err != nil {
+			log.Errorf("Refusing scp session for user %d: %s", user.ID, err)
+			_, _ = fmt.Fprintln(s.Stderr(), mc.Localize(err, mc.ParseSessionEnv(s.Environ()).Language))
+			_ = s.Exit(1)
+			return
+		}
+		defer coordinator.SessionCounter.Decrement(user.ID)
+
+		next(s)
+	}
+}
+
+// keepaliveMiddleware watches the connections of the SCP sessions, and the mc commands, for dead clients.
+// SFTP is a subsystem and doesn't go through the middleware, so the SFTP subsystem handler does its own
+// call to watchConnection.
+func keepaliveMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		watchConnection(s)
+		next(s)
+	}
+}
+
+// watchConnection starts sending keepalives on the session's connection when keepalives are configured.
+func watchConnection(s ssh.Session) {
+	if conn, ok := s.Context().Value(ssh.ContextKeyConn).(mc.KeepaliveConn); ok {
+		keepalive.Watch(s.Context(), conn)
+	}
+}
+
+// startSession counts a new session for the user. If the user already has the maximum number of
+// sessions open then the session isn't counted and ErrTooManySessions is returned. Each successful
+// call must be paired with a call to coordinator.SessionCounter.Decrement.
+func startSession(user *mcmodel.User) error {
+	count, err := coordinator.SessionCounter.Increment(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if mcsshdServer.MaxSessionsPerUser > 0 && count > mcsshdServer.MaxSessionsPerUser {
+		coordinator.SessionCounter.Decrement(user.ID)
+		return mc.ErrTooManySessions
+	}
+
+	return nil
 }
 
 func passwordHandler(context ssh.Context, password string) bool {
+	started := time.Now()
 	userSlug := context.User()
 	user, err := userStore.GetUserBySlug(userSlug)
-	if err != nil {
-		log.Errorf("Invalid user slug %q: %s", userSlug, err)
-		return false
-	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound) && strings.HasPrefix(userSlug, mc.GuestSlugPrefix):
+		if !mcsshdConfig.Features.Enabled(mc.FeatureGuestAccess, userSlug, "") {
+			log.Infof("Guest %s denied login, guest access is turned off", userSlug)
+			return false
+		}
 
-	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if user, err = mc.AuthenticateGuest(authStores, mcsshdConfig.Scopes, userSlug, password); err != nil {
+			if errors.Is(err, mc.ErrGuestNotFound) {
+				time.Sleep(tarpit.InvalidUser(context.RemoteAddr(), userSlug))
+			}
+			return false
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound) && strings.HasPrefix(userSlug, mc.TokenSlugPrefix):
+		if user, err = mc.AuthenticateToken(authStores, mcsshdConfig.Scopes, userSlug, password); err != nil {
+			if errors.Is(err, mc.ErrTokenNotFound) {
+				time.Sleep(tarpit.InvalidUser(context.RemoteAddr(), userSlug))
+			}
+			return false
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		time.Sleep(tarpit.InvalidUser(context.RemoteAddr(), userSlug))
 		return false
+	case err != nil:
+		log.Errorf("Invalid user slug %q: %s", userSlug, err)
+		return false
+	default:
+		if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+			return false
+		}
 	}
 
 	// Set up the context that will be used in SCP.
+	authDuration := time.Since(started)
 	sessionContext := mcscp.NewSessionContext(user)
+	sessionContext.SetAuthDuration(authDuration)
 	context.SetValue("mcSessionContext", sessionContext)
 
 	// mcuser is used by SFTP. It could also have used the scp session context, but
 	// since that is specifically needed by the mcscp handler, a separate value
 	// is set for the sftp handler. This prevents mixing of concerns and dependencies.
 	context.SetValue("mcuser", user)
+	context.SetValue("mcAuthDuration", authDuration)
+
+	emitLogin(user, context.RemoteAddr())
 
 	return true
 }
+
+// emitLogin emits an event for a user logging in, with the country and autonomous system of the
+// client when a GeoIP database is configured.
+func emitLogin(user *mcmodel.User, remoteAddr net.Addr) {
+	details := map[string]string{
+		"user_id":     strconv.Itoa(user.ID),
+		"remote_addr": remoteAddr.String(),
+	}
+
+	if mcsshdConfig.Scopes.IsScoped(user.Slug) {
+		details["credential"] = user.Slug
+	}
+
+	if geoIP != nil {
+		geo := geoIP.LookupAddr(remoteAddr)
+		geo.AddTo(details)
+
+		country := geo.Country
+		if country == "" {
+			country = "unknown"
+		}
+		loginsByCountry.Add(country, 1)
+	}
+
+	coordinator.Events.Emit(mc.Event{
+		Type:    mc.EventLogin,
+		Time:    time.Now(),
+		Details: details,
+	})
+}
+
+// countryFilterCallback closes connections from countries that aren't allowed.
+func countryFilterCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	geo := geoIP.LookupAddr(conn.RemoteAddr())
+	if mcsshdGeoIP.CountryFilter.Allowed(geo.Country) {
+		return conn
+	}
+
+	log.Infof("Rejecting connection from %s, country %q is not allowed", conn.RemoteAddr(), geo.Country)
+	details := map[string]string{"remote_addr": conn.RemoteAddr().String()}
+	geo.AddTo(details)
+	coordinator.Events.Emit(mc.Event{
+		Type:    mc.EventConnectionRejected,
+		Time:    time.Now(),
+		Details: details,
+	})
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mcselftest"
+	"github.com/spf13/cobra"
+)
+
+// selftestCmd runs a short end-to-end check against a running mc-sshd server, for verifying a deployment.
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Check that a running mc-sshd server can log in, list, create directories, upload and download.",
+	Long: `selftest logs in to a running mc-sshd server over SFTP and runs a scripted set of steps: list the
+root, create a directory in the project, upload a file, download it and compare its checksum, and clean
+up. It prints the outcome of each step and exits with a non-zero status if any step fails, so that it can
+be run after a deploy. The password is read from the MCSSHD_SELFTEST_PASSWORD environment variable.
+
+The file is uploaded to ` + mcselftest.Dir + `/selftest.dat in the project. mc-sshd doesn't delete files
+over SFTP, so a failed cleanup is only a warning, and later runs add versions of the same file.`,
+	Run: selftestMain,
+}
+
+var selftestOptions mcselftest.Options
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+	selftestCmd.Flags().StringVar(&selftestOptions.Addr, "target", "localhost:2222", "host:port of the mc-sshd server")
+	selftestCmd.Flags().StringVar(&selftestOptions.User, "user", "", "user slug to log in as")
+	selftestCmd.Flags().StringVar(&selftestOptions.ProjectSlug, "project", "", "slug of the project to upload into")
+	selftestCmd.Flags().Int64Var(&selftestOptions.FileSize, "size", 1024*1024, "size of the test file in bytes")
+	selftestCmd.Flags().DurationVar(&selftestOptions.Timeout, "timeout", 30*time.Second, "how long to wait to connect and log in")
+}
+
+func selftestMain(cmd *cobra.Command, args []string) {
+	if selftestOptions.User == "" || selftestOptions.ProjectSlug == "" {
+		log.Fatalf("Both --user and --project must be specified")
+	}
+
+	if selftestOptions.Password = os.Getenv("MCSSHD_SELFTEST_PASSWORD"); selftestOptions.Password == "" {
+		log.Fatalf("MCSSHD_SELFTEST_PASSWORD not set or blank")
+	}
+
+	steps, err := mcselftest.Run(selftestOptions)
+	for _, step := range steps {
+		fmt.Println(step)
+	}
+
+	if err != nil {
+		log.Errorf("Self test of %s failed: %s", selftestOptions.Addr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Self test of %s passed\n", selftestOptions.Addr)
+}
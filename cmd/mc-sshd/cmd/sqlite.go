@@ -0,0 +1,28 @@
+//go:build sqlite
+// +build sqlite
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Building with -tags sqlite adds the sqlite MCSSHD_DB_DRIVER, so that a small deployment can run on a
+// SQLite file instead of MySQL. The driver uses cgo, so the build needs a C compiler (see make server-sqlite).
+func init() {
+	mc.RegisterDatabaseDriver("sqlite", mc.DatabaseDriver{Open: openSQLite, OwnsSchema: true})
+}
+
+// openSQLite opens the database file at dsn. Unless the dsn has its own options, writers wait for each
+// other rather than failing with "database is locked", and readers don't block the writer.
+func openSQLite(dsn string) gorm.Dialector {
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000&_journal_mode=WAL"
+	}
+
+	return sqlite.Open(dsn)
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd audits the integrity of the stored files.
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Re-hash the stored files and report those that are corrupted, missing or orphaned.",
+	Long: `verify re-hashes the data for each finalized file and reports the files whose data doesn't
+match the checksum and size recorded in the database, or is missing. When every project is audited
+it also reports orphans, data under the mcfs root that no file uses. Nothing is changed, other than
+the flags cleared by --damaged. It uses the same configuration as the server, and doesn't need the
+server to be running.
+
+With --damaged only the files flagged as damaged, by the server when their data was missing as they
+were downloaded or by repair --all, are checked. The flags of the files found to be intact are
+cleared.
+
+Each problem is written to the report as a line of JSON with a "kind" of mismatch, missing,
+unreadable or orphan. A summary is printed when the audit finishes, and verify exits with status 1
+if any problems were found.`,
+	Run: verifyMain,
+}
+
+var verifyProjects []string
+var verifyReportPath string
+var verifyDamaged bool
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringSliceVar(&verifyProjects, "project", nil, "slug of a project to verify, can be repeated (default all projects)")
+	verifyCmd.Flags().StringVar(&verifyReportPath, "report", "-", "file to write the report to, - for stdout")
+	verifyCmd.Flags().BoolVar(&verifyDamaged, "damaged", false, "only verify the files flagged as damaged, clearing the flags of intact files")
+}
+
+func verifyMain(cmd *cobra.Command, args []string) {
+	loadServerConfig()
+
+	stores := mustSetupStores()
+
+	verifier := mc.NewStorageVerifier(stores, mcfsRoot)
+	verifier.DamagedOnly = verifyDamaged
+	for _, slug := range verifyProjects {
+		project, err := stores.ProjectStore.GetProjectBySlug(slug)
+		if err != nil {
+			log.Fatalf("Unable to find project %s: %s", slug, err)
+		}
+		verifier.ProjectIDs = append(verifier.ProjectIDs, project.ID)
+	}
+
+	var report io.WriteCloser = os.Stdout
+	if verifyReportPath != "-" {
+		var err error
+		if report, err = os.Create(verifyReportPath); err != nil {
+			log.Fatalf("Unable to create report %s: %s", verifyReportPath, err)
+		}
+	}
+	verifier.Report = report
+
+	result, err := verifier.Run(context.Background())
+	if err != nil {
+		log.Errorf("Verification stopped early: %s", err)
+	}
+
+	if closeErr := report.Close(); closeErr != nil && err == nil {
+		log.Errorf("Unable to write report %s: %s", verifyReportPath, closeErr)
+		err = closeErr
+	}
+
+	fmt.Fprintf(os.Stderr, "Verified files: %s\n", result)
+	if err != nil || result.Problems() != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// AccessCheckWorkers is the number of projects AccessibleProjects checks with the Authorizer at once.
+const AccessCheckWorkers = 16
+
+// AccessibleProjects returns the projects, in the same order, that a client connected from remoteAddr
+// can open, for listings of the user's projects such as the SFTP root. The projects restricted to
+// networks the client isn't on are found with one lookup for all of them, rather than one per project.
+// The rest are each checked with authorizer, which may be a remote policy engine, by up to
+// AccessCheckWorkers at once, so that the listing for a user in hundreds of projects isn't held up by
+// checking them one after another. req is the listing's request, which is asked about the root of each
+// project.
+func AccessibleProjects(ctx context.Context, stores *Stores, authorizer Authorizer, req AuthorizationRequest, remoteAddr net.Addr, projects []mcmodel.Project) ([]mcmodel.Project, error) {
+	projects, err := projectsInNetwork(stores, remoteAddr, projects)
+	if err != nil || authorizer == nil || len(projects) == 0 {
+		return projects, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		allowed = make([]bool, len(projects))
+		work    = make(chan int)
+	)
+
+	workers := AccessCheckWorkers
+	if len(projects) < workers {
+		workers = len(projects)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				projectReq := req
+				projectReq.ProjectSlug, projectReq.Path = projects[i].Slug, "/"
+				err := authorizer.Authorize(ctx, projectReq)
+				if err != nil && !errors.Is(err, ErrNotAuthorized) {
+					log.Errorf("Unable to check access to project %d for user %d: %s", projects[i].ID, req.UserID, err)
+				}
+				allowed[i] = err == nil
+			}
+		}()
+	}
+
+	for i := range projects {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var accessible []mcmodel.Project
+	for i, project := range projects {
+		if allowed[i] {
+			accessible = append(accessible, project)
+		}
+	}
+
+	return accessible, nil
+}
+
+// projectsInNetwork returns the projects that aren't restricted to networks remoteAddr isn't in.
+func projectsInNetwork(stores *Stores, remoteAddr net.Addr, projects []mcmodel.Project) ([]mcmodel.Project, error) {
+	if stores.ProjectNetworkStore == nil || len(projects) == 0 {
+		return projects, nil
+	}
+
+	projectIDs := make([]int, 0, len(projects))
+	for _, project := range projects {
+		projectIDs = append(projectIDs, project.ID)
+	}
+
+	networks, err := stores.ProjectNetworkStore.GetNetworksForProjects(projectIDs)
+	if err != nil {
+		log.Errorf("Unable to get the networks for %d projects: %s", len(projectIDs), err)
+		return nil, err
+	}
+
+	var inNetwork []mcmodel.Project
+	for _, project := range projects {
+		if n, restricted := networks[project.ID]; !restricted || NetworksContain(n, remoteAddr) {
+			inNetwork = append(inNetwork, project)
+		}
+	}
+
+	return inNetwork, nil
+}
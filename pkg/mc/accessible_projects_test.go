@@ -0,0 +1,78 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+// slowAuthorizer denies the projects in denied, and takes delay to decide, like a remote policy engine.
+type slowAuthorizer struct {
+	denied    map[string]bool
+	delay     time.Duration
+	checking  int32
+	maxAtOnce int32
+}
+
+func (a *slowAuthorizer) Authorize(ctx context.Context, req AuthorizationRequest) error {
+	n := atomic.AddInt32(&a.checking, 1)
+	defer atomic.AddInt32(&a.checking, -1)
+	for {
+		max := atomic.LoadInt32(&a.maxAtOnce)
+		if n <= max || atomic.CompareAndSwapInt32(&a.maxAtOnce, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(a.delay)
+	switch {
+	case req.Path != "/":
+		return errors.New("unexpected path " + req.Path)
+	case a.denied[req.ProjectSlug]:
+		return ErrNotAuthorized
+	default:
+		return nil
+	}
+}
+
+func TestAccessibleProjects(t *testing.T) {
+	var projects []mcmodel.Project
+	for i := 1; i <= 200; i++ {
+		projects = append(projects, mcmodel.Project{ID: i, Slug: fmt.Sprintf("project-%d", i)})
+	}
+
+	networks := NewFakeProjectNetworkStore()
+	restricted, err := ParseNetworks([]string{"10.1.0.0/16"})
+	require.NoError(t, err)
+	require.NoError(t, networks.SetProjectNetworks(1, restricted))
+	require.NoError(t, networks.SetProjectNetworks(2, restricted))
+	stores := &Stores{ProjectNetworkStore: networks}
+
+	authorizer := &slowAuthorizer{denied: map[string]bool{projects[2].Slug: true}, delay: 5 * time.Millisecond}
+	req := AuthorizationRequest{Operation: OperationList, Protocol: "sftp", UserID: 1}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 22}
+
+	start := time.Now()
+	accessible, err := AccessibleProjects(context.Background(), stores, authorizer, req, client, projects)
+	require.NoError(t, err)
+
+	// The two restricted projects and the denied one are dropped, and the rest keep their order.
+	require.Len(t, accessible, 197)
+	require.Equal(t, projects[3:], accessible)
+
+	// Checked one at a time the 198 projects would take about a second.
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.LessOrEqual(t, atomic.LoadInt32(&authorizer.maxAtOnce), int32(AccessCheckWorkers))
+
+	// From the restricted network, and without an authorizer, every project is accessible.
+	accessible, err = AccessibleProjects(context.Background(), stores, nil, req, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, projects)
+	require.NoError(t, err)
+	require.Equal(t, projects, accessible)
+}
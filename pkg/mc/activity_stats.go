@@ -0,0 +1,272 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otherLabel is the project and user label used for activity once ActivityStats.MaxSeries is reached.
+const otherLabel = "other"
+
+// activityKey identifies an activity series. The labels are the project and user slugs.
+type activityKey struct {
+	project string
+	user    string
+}
+
+// activitySeries is the activity of one user in one project.
+type activitySeries struct {
+	sessions int64
+
+	// bytesIn and bytesOut are the bytes uploaded and downloaded since the last export.
+	bytesIn  int64
+	bytesOut int64
+
+	// rateIn and rateOut are the bytes per second uploaded and downloaded over the last interval.
+	rateIn  float64
+	rateOut float64
+}
+
+// ActivityStats tracks live activity in each project, by user: the number of active sessions, and the
+// upload (ingest) and download (egress) rates. Unlike TransferStats, which records transfers when they
+// finish, the bytes are counted as they are transferred and turned into rates by Export, which Run
+// calls every interval. This lets facility dashboards show live ingest by instrument. The number of
+// project and user pairs tracked is capped by MaxSeries to keep the cardinality of the time series
+// down. Once the cap is reached new pairs are counted under a project and user of "other". Pairs that
+// have been idle for an interval are dropped, freeing up room under the cap.
+//
+// ActivityStats implements expvar.Var so that it can be published with expvar.Publish, and WritePrometheus
+// writes it in the Prometheus text format so that it can be scraped for Grafana.
+type ActivityStats struct {
+	// MaxSeries is the maximum number of project and user pairs tracked. 0 means no limit.
+	MaxSeries int
+
+	mu         sync.Mutex
+	series     map[activityKey]*activitySeries
+	lastExport time.Time
+}
+
+func NewActivityStats(maxSeries int) *ActivityStats {
+	return &ActivityStats{
+		MaxSeries:  maxSeries,
+		series:     make(map[activityKey]*activitySeries),
+		lastExport: time.Now(),
+	}
+}
+
+// seriesFor returns the series for the project and user, creating it if needed. It must be called
+// with mu held.
+func (a *ActivityStats) seriesFor(project, user string) *activitySeries {
+	key := activityKey{project: project, user: user}
+	if s, ok := a.series[key]; ok {
+		return s
+	}
+
+	if a.MaxSeries > 0 && len(a.series) >= a.MaxSeries {
+		key = activityKey{project: otherLabel, user: otherLabel}
+		if s, ok := a.series[key]; ok {
+			return s
+		}
+	}
+
+	s := &activitySeries{}
+	a.series[key] = s
+	return s
+}
+
+// SessionStarted counts a session for user that has started using project. A nil ActivityStats
+// ignores the session.
+func (a *ActivityStats) SessionStarted(project, user string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seriesFor(project, user).sessions++
+}
+
+// SessionEnded removes a session counted by SessionStarted. A nil ActivityStats ignores the session.
+func (a *ActivityStats) SessionEnded(project, user string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The session was counted under "other" if it didn't get its own series.
+	s, ok := a.series[activityKey{project: project, user: user}]
+	if !ok {
+		s, ok = a.series[activityKey{project: otherLabel, user: otherLabel}]
+	}
+
+	if ok && s.sessions > 0 {
+		s.sessions--
+	}
+}
+
+// AddBytes counts n bytes transferred by user in project. The direction is TransferUpload or
+// TransferDownload. A nil ActivityStats ignores the bytes.
+func (a *ActivityStats) AddBytes(direction, project, user string, n int64) {
+	if a == nil || n <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.seriesFor(project, user)
+	if direction == TransferUpload {
+		s.bytesIn += n
+	} else {
+		s.bytesOut += n
+	}
+}
+
+// NewReader returns a reader that counts the bytes read from r with AddBytes. A nil ActivityStats
+// returns r.
+func (a *ActivityStats) NewReader(r io.Reader, direction, project, user string) io.Reader {
+	if a == nil {
+		return r
+	}
+
+	return &activityReader{Reader: r, activity: a, direction: direction, project: project, user: user}
+}
+
+type activityReader struct {
+	io.Reader
+	activity  *ActivityStats
+	direction string
+	project   string
+	user      string
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.activity.AddBytes(r.direction, r.project, r.user, int64(n))
+	return n, err
+}
+
+// Export turns the bytes counted since the last Export into rates, and drops the series that have
+// no sessions and no transfers.
+func (a *ActivityStats) Export(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seconds := now.Sub(a.lastExport).Seconds()
+	a.lastExport = now
+	if seconds <= 0 {
+		return
+	}
+
+	for key, s := range a.series {
+		s.rateIn = float64(s.bytesIn) / seconds
+		s.rateOut = float64(s.bytesOut) / seconds
+		s.bytesIn, s.bytesOut = 0, 0
+
+		if s.sessions == 0 && s.rateIn == 0 && s.rateOut == 0 {
+			delete(a.series, key)
+		}
+	}
+}
+
+// Run calls Export every interval until ctx is done.
+func (a *ActivityStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.Export(now)
+		}
+	}
+}
+
+// ProjectActivity is the exported activity of one user in one project.
+type ProjectActivity struct {
+	Project        string  `json:"project"`
+	User           string  `json:"user"`
+	ActiveSessions int64   `json:"active_sessions"`
+	BytesInPerSec  float64 `json:"bytes_in_per_second"`
+	BytesOutPerSec float64 `json:"bytes_out_per_second"`
+}
+
+// Snapshot returns the activity as of the last Export, ordered by project and user.
+func (a *ActivityStats) Snapshot() []ProjectActivity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	activity := make([]ProjectActivity, 0, len(a.series))
+	for key, s := range a.series {
+		activity = append(activity, ProjectActivity{
+			Project:        key.project,
+			User:           key.user,
+			ActiveSessions: s.sessions,
+			BytesInPerSec:  s.rateIn,
+			BytesOutPerSec: s.rateOut,
+		})
+	}
+
+	sort.Slice(activity, func(i, j int) bool {
+		if activity[i].Project != activity[j].Project {
+			return activity[i].Project < activity[j].Project
+		}
+		return activity[i].User < activity[j].User
+	})
+
+	return activity
+}
+
+// String returns the activity as a JSON array.
+func (a *ActivityStats) String() string {
+	b, _ := json.Marshal(a.Snapshot())
+	return string(b)
+}
+
+// WritePrometheus writes the activity as gauges in the Prometheus text exposition format.
+func (a *ActivityStats) WritePrometheus(w io.Writer) error {
+	activity := a.Snapshot()
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(pa ProjectActivity) float64
+	}{
+		{"mcsshd_project_active_sessions", "Sessions using the project.",
+			func(pa ProjectActivity) float64 { return float64(pa.ActiveSessions) }},
+		{"mcsshd_project_ingest_bytes_per_second", "Upload rate into the project over the last interval.",
+			func(pa ProjectActivity) float64 { return pa.BytesInPerSec }},
+		{"mcsshd_project_egress_bytes_per_second", "Download rate from the project over the last interval.",
+			func(pa ProjectActivity) float64 { return pa.BytesOutPerSec }},
+	}
+
+	for _, g := range gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name); err != nil {
+			return err
+		}
+
+		for _, pa := range activity {
+			_, err := fmt.Fprintf(w, "%s{project=\"%s\",user=\"%s\"} %g\n", g.name, escapeLabel(pa.Project), escapeLabel(pa.User), g.value(pa))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
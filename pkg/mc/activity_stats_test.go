@@ -0,0 +1,52 @@
+package mc
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivityStats(t *testing.T) {
+	activity := NewActivityStats(2)
+	start := activity.lastExport
+
+	activity.SessionStarted("proj", "alice")
+	activity.AddBytes(TransferUpload, "proj", "alice", 20*1024*1024)
+	_, err := io.Copy(io.Discard, activity.NewReader(bytes.NewReader(make([]byte, 1024)), TransferDownload, "proj2", "bob"))
+	require.NoError(t, err)
+
+	// The cap is reached, so carol is counted as other.
+	activity.SessionStarted("proj3", "carol")
+
+	activity.Export(start.Add(10 * time.Second))
+	require.Equal(t, []ProjectActivity{
+		{Project: "other", User: "other", ActiveSessions: 1},
+		{Project: "proj", User: "alice", ActiveSessions: 1, BytesInPerSec: 2 * 1024 * 1024},
+		{Project: "proj2", User: "bob", BytesOutPerSec: 102.4},
+	}, activity.Snapshot())
+
+	var metrics strings.Builder
+	require.NoError(t, activity.WritePrometheus(&metrics))
+	require.Contains(t, metrics.String(), "# TYPE mcsshd_project_ingest_bytes_per_second gauge\n")
+	require.Contains(t, metrics.String(), `mcsshd_project_ingest_bytes_per_second{project="proj",user="alice"} 2.097152e+06`)
+
+	// Idle series are dropped on the next export, and the sessions ended.
+	activity.SessionEnded("proj", "alice")
+	activity.SessionEnded("proj3", "carol")
+	activity.Export(start.Add(20 * time.Second))
+	require.Empty(t, activity.Snapshot())
+}
+
+func TestActivityStats_Nil(t *testing.T) {
+	var activity *ActivityStats
+	activity.SessionStarted("proj", "alice")
+	activity.AddBytes(TransferUpload, "proj", "alice", 10)
+	activity.SessionEnded("proj", "alice")
+
+	r := strings.NewReader("data")
+	require.Same(t, r, activity.NewReader(r, TransferUpload, "proj", "alice"))
+}
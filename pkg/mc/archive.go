@@ -0,0 +1,314 @@
+package mc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// archiveExtensions are the extensions of the archives that ExtractArchive can extract.
+var archiveExtensions = []string{".zip", ".tar.gz", ".tgz", ".tar"}
+
+// DefaultMaxArchiveSize is the default Config.MaxArchiveSize.
+const DefaultMaxArchiveSize = 100 * 1024 * 1024 * 1024
+
+// DefaultMaxArchiveEntries is the default Config.MaxArchiveEntries.
+const DefaultMaxArchiveEntries = 100000
+
+// ErrArchiveTooLarge is returned when an archive being extracted has more data or entries than
+// Config.MaxArchiveSize or Config.MaxArchiveEntries allow. It wraps syscall.EFBIG.
+var ErrArchiveTooLarge = fmt.Errorf("%w: the archive is too large to extract", syscall.EFBIG)
+
+// IsArchive returns true if name is an archive that ExtractArchive can extract.
+func IsArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// archiveEntry is a single file or directory in an archive. Reader is only valid until the next entry is read.
+type archiveEntry struct {
+	name    string
+	isDir   bool
+	regular bool
+	size    int64
+	reader  io.Reader
+}
+
+// archiveReader reads the entries in an archive in order. Next returns io.EOF after the last entry.
+type archiveReader interface {
+	Next() (*archiveEntry, error)
+	Close() error
+}
+
+// openArchive opens the archive at path, choosing the format from name.
+func openArchive(path, name string) (archiveReader, error) {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &zipArchiveReader{zr: zr}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(name, ".tar") {
+		return &tarArchiveReader{tr: tar.NewReader(f), closers: []io.Closer{f}}, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &tarArchiveReader{tr: tar.NewReader(gz), closers: []io.Closer{gz, f}}, nil
+}
+
+type zipArchiveReader struct {
+	zr      *zip.ReadCloser
+	next    int
+	current io.ReadCloser
+}
+
+func (r *zipArchiveReader) Next() (*archiveEntry, error) {
+	if r.current != nil {
+		_ = r.current.Close()
+		r.current = nil
+	}
+
+	if r.next >= len(r.zr.File) {
+		return nil, io.EOF
+	}
+
+	f := r.zr.File[r.next]
+	r.next++
+
+	entry := &archiveEntry{name: f.Name, isDir: f.FileInfo().IsDir(), regular: f.Mode().IsRegular(), size: int64(f.UncompressedSize64)}
+	if entry.regular {
+		var err error
+		if r.current, err = f.Open(); err != nil {
+			return nil, err
+		}
+		entry.reader = r.current
+	}
+
+	return entry, nil
+}
+
+func (r *zipArchiveReader) Close() error {
+	if r.current != nil {
+		_ = r.current.Close()
+	}
+
+	return r.zr.Close()
+}
+
+type tarArchiveReader struct {
+	tr      *tar.Reader
+	closers []io.Closer
+}
+
+func (r *tarArchiveReader) Next() (*archiveEntry, error) {
+	hdr, err := r.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveEntry{
+		name:    hdr.Name,
+		isDir:   hdr.Typeflag == tar.TypeDir,
+		regular: hdr.Typeflag == tar.TypeReg,
+		size:    hdr.Size,
+		reader:  r.tr,
+	}, nil
+}
+
+func (r *tarArchiveReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// ExtractArchive extracts the zip, tar or gzipped tar archive in file into the directory at dir in the
+// project. The entries are streamed out of the archive one at a time. The extracted files and directories
+// are owned by the archive's owner. Each entry goes through the same checks as an upload: its path is
+// sanitized with config.SanitizePolicy and checked against the path limits, ignored entries are skipped,
+// and so are entries that can't be overwritten (see CheckOverwrite). Entry names can't escape dir.
+// Symbolic links and other special entries are skipped. Like an upload, each file reserves room in the
+// project's quota in counter as it is extracted (see QuotaReservation), and extraction stops with
+// ErrQuotaExceeded at the entry that would take the project over its quota. Extraction stops with
+// ErrArchiveTooLarge when the archive has more data or entries than config allows. It returns the
+// number of files extracted.
+func ExtractArchive(stores *Stores, counter QuotaCounter, config *Config, project *mcmodel.Project, file *mcmodel.File, dir, mcfsRoot string) (int, error) {
+	return ExtractArchiveFile(stores, counter, config, project, file.OwnerID, file.ToUnderlyingFilePath(mcfsRoot), file.Name, dir, mcfsRoot)
+}
+
+// ExtractArchiveFile is ExtractArchive for the archive named name at archivePath on local disk, such as
+// in a ScratchArea, rather than in the project. The extracted files and directories are owned by ownerID.
+func ExtractArchiveFile(stores *Stores, counter QuotaCounter, config *Config, project *mcmodel.Project, ownerID int, archivePath, name, dir, mcfsRoot string) (int, error) {
+	ar, err := openArchive(archivePath, name)
+	if err != nil {
+		return 0, err
+	}
+	defer ar.Close()
+
+	ignoreList := NewIgnoreList(config.IgnorePatterns)
+	limits := &archiveLimits{maxSize: config.MaxArchiveSize, maxEntries: config.MaxArchiveEntries}
+
+	extracted := 0
+	for {
+		entry, err := ar.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return extracted, nil
+		case err != nil:
+			return extracted, err
+		}
+
+		if err := limits.addEntry(entry); err != nil {
+			return extracted, fmt.Errorf("unable to extract '%s': %w", entry.name, err)
+		}
+
+		// Cleaning the entry name as an absolute path keeps ".." from going above dir.
+		path, err := SanitizePath(filepath.Join(dir, cleanClientPath(entry.name)), config.SanitizePolicy)
+		if err != nil {
+			return extracted, fmt.Errorf("invalid entry '%s': %w", entry.name, err)
+		}
+
+		if ignoreList.IsIgnored(path) {
+			continue
+		}
+
+		if err := ValidatePathLimits(path, config); err != nil {
+			return extracted, fmt.Errorf("invalid entry '%s': %w", entry.name, err)
+		}
+
+		if entry.isDir {
+			if _, err := stores.FileStore.GetOrCreateDirPath(project.ID, ownerID, path); err != nil {
+				return extracted, err
+			}
+			continue
+		}
+
+		if !entry.regular {
+			continue
+		}
+
+		switch err := CheckOverwrite(stores.FileStore, project, path, config); {
+		case errors.Is(err, ErrFileExists), errors.Is(err, ErrWriteOnce):
+			log.Errorf("Skipping %s in archive %s, project %d: %s", path, name, project.ID, err)
+			continue
+		case err != nil:
+			return extracted, fmt.Errorf("unable to extract '%s': %w", entry.name, err)
+		}
+
+		if err := extractEntry(stores, counter, config, project, ownerID, path, entry, limits, mcfsRoot); err != nil {
+			return extracted, fmt.Errorf("unable to extract '%s': %w", entry.name, err)
+		}
+		extracted++
+	}
+}
+
+// extractEntry extracts the file in entry to path in the project. Room for the file is reserved in the
+// project's quota until it has been committed, and so counts in the project's size.
+func extractEntry(stores *Stores, counter QuotaCounter, config *Config, project *mcmodel.Project, ownerID int, path string, entry *archiveEntry, limits *archiveLimits, mcfsRoot string) error {
+	quota := NewQuotaReservation(counter, stores, config, project)
+	defer quota.Release()
+
+	if err := quota.Reserve(entry.size); err != nil {
+		return err
+	}
+
+	if _, err := stores.FileStore.GetOrCreateDirPath(project.ID, ownerID, filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	// The size in the archive can't be trusted, so the limits and the quota are also applied to the data read.
+	r := &entryReader{r: entry.reader, quota: quota, limits: limits}
+	_, err := CreateFileFromReader(stores, project.ID, ownerID, path, r, mcfsRoot)
+	return err
+}
+
+// archiveLimits counts an archive's entries, and the data extracted from it, against Config.MaxArchiveEntries
+// and Config.MaxArchiveSize. A limit of 0 is no limit.
+type archiveLimits struct {
+	maxSize    int64
+	maxEntries int
+	size       int64
+	entries    int
+}
+
+// addEntry counts entry, and returns ErrArchiveTooLarge if the archive has too many entries, or if the
+// size recorded for entry would take the archive over its size limit.
+func (l *archiveLimits) addEntry(entry *archiveEntry) error {
+	l.entries++
+	switch {
+	case l.maxEntries > 0 && l.entries > l.maxEntries:
+		return ErrArchiveTooLarge
+	case l.maxSize > 0 && l.size+entry.size > l.maxSize:
+		return ErrArchiveTooLarge
+	default:
+		return nil
+	}
+}
+
+// addData counts n bytes extracted from the archive, and returns ErrArchiveTooLarge once more than the
+// size limit has been extracted.
+func (l *archiveLimits) addData(n int64) error {
+	l.size += n
+	if l.maxSize > 0 && l.size > l.maxSize {
+		return ErrArchiveTooLarge
+	}
+
+	return nil
+}
+
+// entryReader reads the data of an archive entry, counting it against the archive's limits and reserving
+// room for it in the project's quota.
+type entryReader struct {
+	r      io.Reader
+	quota  *QuotaReservation
+	limits *archiveLimits
+	read   int64
+}
+
+func (e *entryReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.read += int64(n)
+	if limitErr := e.limits.addData(int64(n)); limitErr != nil {
+		return n, limitErr
+	}
+
+	if quotaErr := e.quota.Reserve(e.read); quotaErr != nil {
+		return n, quotaErr
+	}
+
+	return n, err
+}
@@ -0,0 +1,154 @@
+package mc
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractArchive_TarGz(t *testing.T) {
+	mcfsRoot := t.TempDir()
+
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "incoming", Path: "/incoming", MimeType: "directory", DirectoryID: 1},
+	}
+
+	archive := &mcmodel.File{ID: 10, ProjectID: 1, OwnerID: 3, Name: "run1.tar.gz", DirectoryID: 2}
+	archive.UUID, _ = uuid.GenerateUUID()
+	require.NoError(t, os.MkdirAll(archive.ToUnderlyingDirPath(mcfsRoot), 0777))
+	writeTarGz(t, archive.ToUnderlyingFilePath(mcfsRoot), []tarEntry{
+		{"run1/", tar.TypeDir, ""},
+		{"run1/a.dat", tar.TypeReg, "0123456789"},
+		{"run1/link.dat", tar.TypeSymlink, ""},
+		{"run1/b.dat", tar.TypeReg, "0123456789"},
+	})
+
+	fileStore := uuidFileStore{FakeFileStore: store.NewFakeFileStore(files)}
+	project := &mcmodel.Project{ID: 1, Slug: "proj", Size: 100}
+	stores := &Stores{
+		FileStore:        fileStore,
+		ProjectStore:     store.NewFakeProjectStore([]mcmodel.Project{*project}),
+		PendingFileStore: NewFakePendingFileStore(),
+	}
+
+	config := DefaultConfig()
+	counter := NewInMemoryQuotaCounter()
+	extracted, err := ExtractArchive(stores, counter, config, project, archive, "/incoming", mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, 2, extracted)
+
+	for _, path := range []string{"/incoming/run1/a.dat", "/incoming/run1/b.dat"} {
+		_, err := fileStore.GetFileByPath(1, path)
+		require.NoError(t, err, "%s should have been extracted", path)
+	}
+
+	_, err = fileStore.GetFileByPath(1, "/incoming/run1/link.dat")
+	require.Error(t, err, "Links aren't extracted")
+
+	// The room held by the uploads in progress counts against the quota, so with less than a
+	// reservation left extraction stops at the first file.
+	config.ProjectQuota = project.Size + QuotaReservationSize + 5
+	_, err = counter.AddBytes(project.ID, 10)
+	require.NoError(t, err)
+	extracted, err = ExtractArchive(stores, counter, config, project, archive, "/incoming", mcfsRoot)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.Equal(t, 0, extracted)
+
+	// Once the upload in progress is done there is room again, and the extracted files give back what
+	// they reserved.
+	_, err = counter.AddBytes(project.ID, -10)
+	require.NoError(t, err)
+	extracted, err = ExtractArchive(stores, counter, config, project, archive, "/incoming", mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, 2, extracted)
+
+	reserved, err := counter.Bytes(project.ID)
+	require.NoError(t, err)
+	require.Zero(t, reserved)
+}
+
+func TestExtractArchive_Limits(t *testing.T) {
+	mcfsRoot := t.TempDir()
+
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+	}
+
+	archive := &mcmodel.File{ID: 10, ProjectID: 1, OwnerID: 3, Name: "run1.tar.gz", DirectoryID: 1}
+	archive.UUID, _ = uuid.GenerateUUID()
+	require.NoError(t, os.MkdirAll(archive.ToUnderlyingDirPath(mcfsRoot), 0777))
+	writeTarGz(t, archive.ToUnderlyingFilePath(mcfsRoot), []tarEntry{
+		{"run1/", tar.TypeDir, ""},
+		{"run1/a.dat", tar.TypeReg, "0123456789"},
+		{"run1/link.dat", tar.TypeSymlink, ""},
+		{"run1/b.dat", tar.TypeReg, "0123456789"},
+	})
+
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxEntries int
+		extracted  int
+		err        error
+	}{
+		{"No limits", 0, 0, 2, nil},
+		{"Within the limits", 20, 4, 2, nil},
+		{"Too many entries", 0, 3, 1, ErrArchiveTooLarge},
+		{"Too much data", 15, 0, 1, ErrArchiveTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stores := &Stores{
+				FileStore:        uuidFileStore{FakeFileStore: store.NewFakeFileStore(files)},
+				PendingFileStore: NewFakePendingFileStore(),
+			}
+
+			config := DefaultConfig()
+			config.MaxArchiveSize, config.MaxArchiveEntries = test.maxSize, test.maxEntries
+			project := &mcmodel.Project{ID: 1, Slug: "proj"}
+
+			extracted, err := ExtractArchive(stores, NewInMemoryQuotaCounter(), config, project, archive, "/", mcfsRoot)
+			if test.err != nil {
+				require.ErrorIs(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.extracted, extracted)
+		})
+	}
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	contents string
+}
+
+func writeTarGz(t *testing.T, path string, entries []tarEntry) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Mode: 0644, Size: int64(len(entry.contents))}
+		if entry.typeflag == tar.TypeSymlink {
+			hdr.Linkname = "/etc/passwd"
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(entry.contents))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+}
@@ -0,0 +1,235 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// The operations an Authorizer is asked about.
+const (
+	// OperationRead is downloading a file.
+	OperationRead = "read"
+
+	// OperationWrite is uploading a file, creating a directory, or any change other than a delete.
+	OperationWrite = "write"
+
+	// OperationDelete is removing a file or directory.
+	OperationDelete = "delete"
+
+	// OperationList is listing a directory, or getting the attributes of a file or directory.
+	OperationList = "list"
+)
+
+// ErrNotAuthorized is returned when an Authorizer denies an operation. It wraps os.ErrPermission.
+var ErrNotAuthorized = fmt.Errorf("%w: denied by the data governance policy", os.ErrPermission)
+
+// AuthorizationRequest is an operation that an Authorizer is asked to allow. Path is the project path,
+// without the project slug. ProjectSlug is blank for the paths above the projects, such as a listing of
+// the user's projects. UserSlug and UserID are the user whose access is used, and Credential is the slug
+// of the guest or token the session logged in with, if any. See NewAuthorizationRequest.
+type AuthorizationRequest struct {
+	Operation   string `json:"operation"`
+	Protocol    string `json:"protocol"`
+	UserSlug    string `json:"user"`
+	UserID      int    `json:"user_id"`
+	Credential  string `json:"credential,omitempty"`
+	ProjectSlug string `json:"project"`
+	Path        string `json:"path"`
+}
+
+// NewAuthorizationRequest returns the request for operation over protocol by user, the user a session
+// runs as. For a session logged in with a scoped credential, such as a guest or a token, UserSlug is the
+// slug of the user the credential belongs to and Credential is the credential's slug, so that policies
+// apply to the user whose data is reached.
+func NewAuthorizationRequest(scopes *ScopeRegistry, user *mcmodel.User, protocol, operation string) AuthorizationRequest {
+	req := AuthorizationRequest{Operation: operation, Protocol: protocol, UserSlug: user.Slug, UserID: user.ID}
+	if scopes.IsScoped(user.Slug) {
+		req.UserSlug = scopes.Owner(user.Slug)
+		req.Credential = user.Slug
+	}
+
+	return req
+}
+
+// Authorizer decides whether an operation is allowed, on top of the project access and drop box checks,
+// so that institutions can enforce their own data governance rules without changing the handlers. It is
+// consulted on each read, write, delete and list.
+type Authorizer interface {
+	// Authorize returns nil if the operation is allowed, and ErrNotAuthorized, or an error wrapping it,
+	// if it isn't. Other errors mean the decision couldn't be made.
+	Authorize(ctx context.Context, req AuthorizationRequest) error
+}
+
+// Authorize asks authorizer whether req is allowed, and logs the operations that aren't. A nil authorizer
+// allows everything.
+func Authorize(ctx context.Context, authorizer Authorizer, req AuthorizationRequest) error {
+	if authorizer == nil {
+		return nil
+	}
+
+	err := authorizer.Authorize(ctx, req)
+	if err != nil {
+		log.Errorf("User %d denied %s of %s in project '%s' over %s: %s", req.UserID, req.Operation, req.Path, req.ProjectSlug, req.Protocol, err)
+	}
+
+	return err
+}
+
+// HTTPAuthorizer asks a policy engine over HTTP, in the format of Open Policy Agent's data API. The
+// request is POSTed as {"input": {...}} to URL, such as http://opa:8181/v1/data/mcsshd/allow, and the
+// response must be {"result": true} or {"result": {"allow": true}}, with an optional "reason" alongside
+// allow that is added to the error for a denied operation. A missing result denies the operation.
+//
+// Decisions are cached for CacheTTL, since clients make many requests for the same paths. When the policy
+// engine can't be reached the operation is denied, unless FailOpen is set.
+type HTTPAuthorizer struct {
+	url    string
+	client *http.Client
+
+	// FailOpen allows operations when the policy engine can't be reached or returns an error.
+	FailOpen bool
+
+	// CacheTTL is how long a decision is cached for. 0 turns off caching.
+	CacheTTL time.Duration
+
+	mu        sync.Mutex
+	decisions map[AuthorizationRequest]cachedDecision
+}
+
+type cachedDecision struct {
+	err     error
+	expires time.Time
+}
+
+// maxCachedDecisions is the number of decisions an HTTPAuthorizer caches. The cache is cleared when it
+// fills up.
+const maxCachedDecisions = 10000
+
+// NewHTTPAuthorizer creates an HTTPAuthorizer that asks the policy engine at url, waiting up to timeout
+// for each decision.
+func NewHTTPAuthorizer(url string, timeout time.Duration) *HTTPAuthorizer {
+	return &HTTPAuthorizer{
+		url:       url,
+		client:    &http.Client{Timeout: timeout},
+		decisions: make(map[AuthorizationRequest]cachedDecision),
+	}
+}
+
+func (a *HTTPAuthorizer) Authorize(ctx context.Context, req AuthorizationRequest) error {
+	if decision, ok := a.cached(req); ok {
+		return decision.err
+	}
+
+	err := a.ask(ctx, req)
+	if err != nil && !errors.Is(err, ErrNotAuthorized) {
+		log.Errorf("Unable to get an authorization decision from %s: %s", a.url, err)
+		if a.FailOpen {
+			return nil
+		}
+
+		// Failures aren't cached, so the policy engine is asked again once it is back.
+		return fmt.Errorf("%w: the policy engine is unavailable", ErrNotAuthorized)
+	}
+
+	a.cache(req, err)
+	return err
+}
+
+// ask POSTs req to the policy engine and returns its decision.
+func (a *HTTPAuthorizer) ask(ctx context.Context, req AuthorizationRequest) error {
+	body, err := json.Marshal(map[string]AuthorizationRequest{"input": req})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("policy engine returned %s", resp.Status)
+	}
+
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return fmt.Errorf("invalid decision: %s", err)
+	}
+
+	var allow bool
+	if err := json.Unmarshal(decision.Result, &allow); err == nil {
+		if allow {
+			return nil
+		}
+		return ErrNotAuthorized
+	}
+
+	var result struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+
+	switch {
+	case len(decision.Result) == 0:
+		return ErrNotAuthorized
+	case json.Unmarshal(decision.Result, &result) != nil:
+		return fmt.Errorf("invalid decision result: %s", decision.Result)
+	case result.Allow:
+		return nil
+	case result.Reason != "":
+		return fmt.Errorf("%w: %s", ErrNotAuthorized, result.Reason)
+	default:
+		return ErrNotAuthorized
+	}
+}
+
+func (a *HTTPAuthorizer) cached(req AuthorizationRequest) (cachedDecision, bool) {
+	if a.CacheTTL <= 0 {
+		return cachedDecision{}, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	decision, ok := a.decisions[req]
+	if !ok || time.Now().After(decision.expires) {
+		return cachedDecision{}, false
+	}
+
+	return decision, true
+}
+
+func (a *HTTPAuthorizer) cache(req AuthorizationRequest, err error) {
+	if a.CacheTTL <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.decisions) >= maxCachedDecisions {
+		a.decisions = make(map[AuthorizationRequest]cachedDecision)
+	}
+
+	a.decisions[req] = cachedDecision{err: err, expires: time.Now().Add(a.CacheTTL)}
+}
@@ -0,0 +1,113 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPAuthorizer_Authorize(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		status   int
+		failOpen bool
+		allowed  bool
+		reason   string
+	}{
+		{name: "Allowed by a boolean result", response: `{"result": true}`, allowed: true},
+		{name: "Denied by a boolean result", response: `{"result": false}`},
+		{name: "Allowed by an object result", response: `{"result": {"allow": true}}`, allowed: true},
+		{name: "Denied with a reason", response: `{"result": {"allow": false, "reason": "embargoed"}}`, reason: "embargoed"},
+		{name: "Missing result is denied", response: `{}`},
+		{name: "Unavailable policy engine is denied", status: http.StatusInternalServerError},
+		{name: "Unavailable policy engine with fail open", status: http.StatusInternalServerError, failOpen: true, allowed: true},
+		{name: "Invalid result is denied", response: `{"result": "yes"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+					return
+				}
+				_, _ = w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			authorizer := NewHTTPAuthorizer(server.URL, time.Second)
+			authorizer.FailOpen = test.failOpen
+			err := authorizer.Authorize(context.Background(), AuthorizationRequest{Operation: OperationRead, Path: "/file.txt"})
+			if test.allowed {
+				require.NoError(t, err)
+				return
+			}
+
+			require.True(t, errors.Is(err, ErrNotAuthorized))
+			require.True(t, errors.Is(err, os.ErrPermission))
+			require.Contains(t, err.Error(), test.reason)
+		})
+	}
+}
+
+func TestHTTPAuthorizer_Input(t *testing.T) {
+	var input map[string]AuthorizationRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		_, _ = w.Write([]byte(`{"result": true}`))
+	}))
+	defer server.Close()
+
+	req := AuthorizationRequest{
+		Operation:   OperationDelete,
+		Protocol:    "sftp",
+		UserSlug:    "alice",
+		UserID:      1,
+		ProjectSlug: "proj",
+		Path:        "/dir/file.txt",
+	}
+	require.NoError(t, NewHTTPAuthorizer(server.URL, time.Second).Authorize(context.Background(), req))
+	require.Equal(t, req, input["input"])
+}
+
+func TestHTTPAuthorizer_CacheTTL(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`{"result": false}`))
+	}))
+	defer server.Close()
+
+	authorizer := NewHTTPAuthorizer(server.URL, time.Second)
+	authorizer.CacheTTL = time.Hour
+	req := AuthorizationRequest{Operation: OperationList, Path: "/"}
+
+	// Denials are cached like any other decision.
+	for i := 0; i < 3; i++ {
+		require.Error(t, authorizer.Authorize(context.Background(), req))
+	}
+	require.Equal(t, 1, requests)
+
+	req.Path = "/dir"
+	require.Error(t, authorizer.Authorize(context.Background(), req))
+	require.Equal(t, 2, requests)
+
+	// Decisions aren't cached when the policy engine can't be reached.
+	server.Close()
+	req.Path = "/other"
+	require.Error(t, authorizer.Authorize(context.Background(), req))
+	require.Error(t, authorizer.Authorize(context.Background(), req))
+	require.Len(t, authorizer.decisions, 2)
+}
+
+func TestAuthorize_NilAuthorizer(t *testing.T) {
+	require.NoError(t, Authorize(context.Background(), nil, AuthorizationRequest{Operation: OperationWrite}))
+}
@@ -0,0 +1,128 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// ErrWritesThrottled is returned when a write waited too long for the finalization queue to drain.
+var ErrWritesThrottled = errors.New("server is busy finalizing uploads, try again later")
+
+// WriteBackpressure throttles new writes when finalizing uploads backs up, for example because the
+// database is slow. The finalization queue is the set of files that are in FileStore.DoneWritingToFile.
+// When it reaches HighWater new writes wait, in Wait, until it drains. Without this a slow database
+// lets every session pile more finalizations onto it. WriteBackpressure implements expvar.Var so that
+// the queue depth and the number of throttled writes can be published with expvar.Publish.
+type WriteBackpressure struct {
+	// HighWater is the queue depth at which new writes are throttled. 0 turns off throttling.
+	HighWater int
+
+	mu    sync.Mutex
+	depth int
+
+	// changed is closed, and replaced, each time a finalization finishes.
+	changed chan struct{}
+
+	// throttled counts the writes that had to wait, and rejected the writes that gave up waiting.
+	throttled int64
+	rejected  int64
+}
+
+func NewWriteBackpressure(highWater int) *WriteBackpressure {
+	return &WriteBackpressure{HighWater: highWater, changed: make(chan struct{})}
+}
+
+// Wait blocks while the finalization queue is at or above HighWater. It returns ErrWritesThrottled if
+// ctx is done before the queue drains. A nil WriteBackpressure never blocks.
+func (b *WriteBackpressure) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	throttled := false
+	for {
+		b.mu.Lock()
+		if b.HighWater <= 0 || b.depth < b.HighWater {
+			b.mu.Unlock()
+			return nil
+		}
+
+		if !throttled {
+			throttled = true
+			b.throttled++
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.rejected++
+			b.mu.Unlock()
+			return ErrWritesThrottled
+		}
+	}
+}
+
+// Depth returns the number of files being finalized.
+func (b *WriteBackpressure) Depth() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.depth
+}
+
+func (b *WriteBackpressure) begin() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.depth++
+}
+
+func (b *WriteBackpressure) done() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.depth--
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// String returns the queue depth, high water mark and throttling counts as JSON.
+func (b *WriteBackpressure) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bytes, _ := json.Marshal(struct {
+		Depth     int   `json:"depth"`
+		HighWater int   `json:"high_water"`
+		Throttled int64 `json:"throttled"`
+		Rejected  int64 `json:"rejected"`
+	}{b.depth, b.HighWater, b.throttled, b.rejected})
+
+	return string(bytes)
+}
+
+// Middleware returns a StoreMiddleware that counts each call to FileStore.DoneWritingToFile in the
+// finalization queue while it runs.
+func (b *WriteBackpressure) Middleware() StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &backpressureFileStore{FileStore: fileStore, backpressure: b}
+		},
+	}
+}
+
+type backpressureFileStore struct {
+	store.FileStore
+	backpressure *WriteBackpressure
+}
+
+func (s *backpressureFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	s.backpressure.begin()
+	defer s.backpressure.done()
+	return s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+}
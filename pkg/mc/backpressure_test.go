@@ -0,0 +1,37 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBackpressure_Wait(t *testing.T) {
+	b := NewWriteBackpressure(2)
+
+	require.NoError(t, b.Wait(context.Background()), "Empty queue shouldn't throttle")
+
+	b.begin()
+	b.begin()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, b.Wait(ctx), ErrWritesThrottled, "Queue at the high water mark should throttle")
+
+	waited := make(chan error)
+	go func() { waited <- b.Wait(context.Background()) }()
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.throttled == 2
+	}, time.Second, time.Millisecond, "Write should be waiting")
+	b.done()
+	require.NoError(t, <-waited, "Write should continue once the queue drains")
+
+	require.Equal(t, 1, b.Depth())
+	require.JSONEq(t, `{"depth": 1, "high_water": 2, "throttled": 2, "rejected": 1}`, b.String())
+
+	var nilBackpressure *WriteBackpressure
+	require.NoError(t, nilBackpressure.Wait(context.Background()), "Nil backpressure shouldn't throttle")
+}
@@ -0,0 +1,186 @@
+package mc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// BagExportsDir is the directory in a project that CreateBag creates bags in.
+const BagExportsDir = "/exports"
+
+// bagItVersion is the version of the BagIt specification (RFC 8493) the bags follow.
+const bagItVersion = "1.0"
+
+// Bag is a BagIt bag created by CreateBag. Path is the bag's directory in the project, and Files and
+// Bytes are the size of its payload.
+type Bag struct {
+	Path  string
+	Files int
+	Bytes uint64
+}
+
+// PayloadOxum returns the bag's Payload-Oxum, its payload's size in bytes and number of files.
+func (b *Bag) PayloadOxum() string {
+	return fmt.Sprintf("%d.%d", b.Bytes, b.Files)
+}
+
+// CreateBag assembles a BagIt bag of the directory tree at dirPath, for depositing it in a repository. The
+// bag is created in BagExportsDir, in a directory named after dirPath and now, and is owned by user. The
+// payload files in its data directory are hard links (see LinkFile), so no data is copied, and the
+// checksums in its MD5 manifest are the ones stored for the files rather than computed again. The bag-info
+// is filled in from the project and user. Files that are still being uploaded are left out. The tag files
+// are created last, with bagit.txt after the others, so a bag that failed part way doesn't have a
+// bagit.txt and isn't mistaken for a complete one.
+func CreateBag(stores *Stores, project *mcmodel.Project, user *mcmodel.User, dirPath string, now time.Time, mcfsRoot string) (*Bag, error) {
+	dirPath = filepath.Clean(dirPath)
+	if dirPath == BagExportsDir || strings.HasPrefix(dirPath, BagExportsDir+"/") {
+		return nil, fmt.Errorf("%w: '%s' is in %s", os.ErrInvalid, dirPath, BagExportsDir)
+	}
+
+	if dir, err := stores.FileStore.GetDirByPath(project.ID, dirPath); err != nil || !dir.IsDir() {
+		return nil, fmt.Errorf("'%s': %w", dirPath, os.ErrNotExist)
+	}
+
+	name := filepath.Base(dirPath)
+	if dirPath == "/" {
+		name = project.Slug
+	}
+
+	bag := &Bag{Path: filepath.Join(BagExportsDir, fmt.Sprintf("%s-bag-%s", name, now.UTC().Format("20060102T150405Z")))}
+	if _, err := stores.FileStore.GetDirByPath(project.ID, bag.Path); err == nil {
+		return nil, fmt.Errorf("'%s': %w", bag.Path, os.ErrExist)
+	}
+
+	// The files are listed before any links are created, so that the walk doesn't have to skip them.
+	var files []mcmodel.File
+	err := walkTree(stores, project.ID, dirPath, func(file *mcmodel.File) error {
+		p := findPath(file)
+		if !file.IsDir() && file.Checksum != "" && !strings.HasPrefix(p, BagExportsDir+"/") {
+			files = append(files, *file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := &bagDirs{stores: stores, projectID: project.ID, ownerID: user.ID, dirs: make(map[string]*mcmodel.File)}
+
+	var manifest bytes.Buffer
+	for i := range files {
+		file := &files[i]
+		rel := relativeTreePath(dirPath, findPath(file))
+		linkPath := filepath.Join(bag.Path, "data", rel)
+
+		dir, err := dirs.get(filepath.Dir(linkPath))
+		if err != nil {
+			log.Errorf("Unable to create directory %s in project %d for bag: %s", filepath.Dir(linkPath), project.ID, err)
+			return nil, err
+		}
+
+		if _, err := LinkFile(stores, file, dir, filepath.Base(linkPath), user.ID, mcfsRoot); err != nil {
+			return nil, fmt.Errorf("unable to add '%s' to the bag: %w", rel, err)
+		}
+
+		fmt.Fprintf(&manifest, "%s  data/%s\n", file.Checksum, encodeBagPath(rel))
+		bag.Files++
+		bag.Bytes += file.Size
+	}
+
+	if _, err := dirs.get(bag.Path); err != nil {
+		return nil, err
+	}
+
+	manifestFile := bagTagFile{"manifest-md5.txt", manifest.Bytes()}
+	infoFile := bagTagFile{"bag-info.txt", bagInfo(bag, project, user, dirPath, now)}
+	bagItFile := bagTagFile{"bagit.txt", []byte(fmt.Sprintf("BagIt-Version: %s\nTag-File-Character-Encoding: UTF-8\n", bagItVersion))}
+
+	var tagManifest bytes.Buffer
+	for _, tagFile := range []bagTagFile{bagItFile, infoFile, manifestFile} {
+		fmt.Fprintf(&tagManifest, "%x  %s\n", md5.Sum(tagFile.contents), tagFile.name)
+	}
+	tagManifestFile := bagTagFile{"tagmanifest-md5.txt", tagManifest.Bytes()}
+
+	for _, tagFile := range []bagTagFile{manifestFile, infoFile, tagManifestFile, bagItFile} {
+		if err := CreateFileWithContents(stores, project.ID, user.ID, filepath.Join(bag.Path, tagFile.name), tagFile.contents, mcfsRoot); err != nil {
+			log.Errorf("Unable to create %s for bag %s in project %d: %s", tagFile.name, bag.Path, project.ID, err)
+			return nil, err
+		}
+	}
+
+	return bag, nil
+}
+
+// bagInfo returns the contents of the bag's bag-info.txt.
+func bagInfo(bag *Bag, project *mcmodel.Project, user *mcmodel.User, dirPath string, now time.Time) []byte {
+	var b bytes.Buffer
+	write := func(label, value string) {
+		// Values are written on one line, since a line that starts with whitespace continues the value
+		// before it.
+		value = strings.Join(strings.Fields(value), " ")
+		if value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", label, value)
+		}
+	}
+
+	write("Source-Organization", "Materials Commons")
+	write("Contact-Name", user.Name)
+	write("Contact-Email", user.Email)
+	write("External-Description", fmt.Sprintf("%s from project %s", dirPath, project.Name))
+	write("External-Identifier", project.UUID)
+	write("Internal-Sender-Identifier", filepath.Join("/", project.Slug, dirPath))
+	write("Bagging-Date", now.UTC().Format("2006-01-02"))
+	write("Bag-Software-Agent", "mc-sshd")
+	write("Payload-Oxum", bag.PayloadOxum())
+	return b.Bytes()
+}
+
+// bagTagFile is a tag file of a bag, such as its manifest.
+type bagTagFile struct {
+	name     string
+	contents []byte
+}
+
+// bagPathEncoder percent-encodes the characters that can't appear in a manifest's paths.
+var bagPathEncoder = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+
+func encodeBagPath(p string) string {
+	return bagPathEncoder.Replace(p)
+}
+
+// bagDirs creates the directories in a bag, creating each directory's parents before it, and remembers
+// them so that each is only looked up once.
+type bagDirs struct {
+	stores    *Stores
+	projectID int
+	ownerID   int
+	dirs      map[string]*mcmodel.File
+}
+
+func (d *bagDirs) get(path string) (*mcmodel.File, error) {
+	if dir, ok := d.dirs[path]; ok {
+		return dir, nil
+	}
+
+	if path != "/" {
+		if _, err := d.get(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := d.stores.FileStore.GetOrCreateDirPath(d.projectID, d.ownerID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	d.dirs[path] = dir
+	return dir, nil
+}
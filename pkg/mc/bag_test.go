@@ -0,0 +1,84 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateBag(t *testing.T) {
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "dataset1", Path: "/dataset1", DirectoryID: 1, MimeType: "directory"},
+		{ID: 3, ProjectID: 1, Name: "sub", Path: "/dataset1/sub", DirectoryID: 2, MimeType: "directory"},
+		{ID: 4, ProjectID: 1, UUID: "aaaaaaaa-bbbb-cccc-dddd-000000000004", Name: "a.txt", DirectoryID: 2, MimeType: "text/plain", Checksum: "0cc175b9c0f1b6a831c399e269772661", Size: 1},
+		{ID: 5, ProjectID: 1, UUID: "aaaaaaaa-bbbb-cccc-dddd-000000000005", Name: "b.txt", DirectoryID: 3, MimeType: "text/plain", Checksum: "92eb5ffee6ae2fec3ad71c777531578f", Size: 2},
+
+		// Still being uploaded, so it isn't bagged.
+		{ID: 6, ProjectID: 1, Name: "c.txt", DirectoryID: 2, MimeType: "text/plain"},
+	}
+
+	mcfsRoot := t.TempDir()
+	stores := &Stores{
+		FileStore:        uuidFileStore{FakeFileStore: store.NewFakeFileStore(files)},
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: NewFakePendingFileStore(),
+		ListingStore:     NewFakeListingStore(files...),
+	}
+
+	project := &mcmodel.Project{ID: 1, Slug: "proj", Name: "My Project", UUID: "project-uuid"}
+	user := &mcmodel.User{ID: 7, Name: "Alice", Email: "alice@example.com"}
+	now := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	bag, err := CreateBag(stores, project, user, "/dataset1", now, mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, "/exports/dataset1-bag-20240601T123000Z", bag.Path)
+	require.Equal(t, 2, bag.Files)
+	require.Equal(t, "3.2", bag.PayloadOxum())
+
+	for _, p := range []string{"data/a.txt", "data/sub/b.txt"} {
+		link, err := stores.FileStore.GetFileByPath(1, filepath.Join(bag.Path, p))
+		require.NoError(t, err, p)
+		require.Equal(t, 7, link.OwnerID)
+	}
+
+	// The fake file store doesn't keep the UUIDs of the files it creates, so the tag files are found by
+	// their contents.
+	var written []string
+	err = filepath.Walk(mcfsRoot, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			contents, err := os.ReadFile(p)
+			written = append(written, string(contents))
+			return err
+		}
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, written, 4)
+
+	require.Contains(t, written, "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")
+	require.Contains(t, written, "0cc175b9c0f1b6a831c399e269772661  data/a.txt\n92eb5ffee6ae2fec3ad71c777531578f  data/sub/b.txt\n")
+	require.Contains(t, written, "Source-Organization: Materials Commons\nContact-Name: Alice\nContact-Email: alice@example.com\n"+
+		"External-Description: /dataset1 from project My Project\nExternal-Identifier: project-uuid\n"+
+		"Internal-Sender-Identifier: /proj/dataset1\nBagging-Date: 2024-06-01\nBag-Software-Agent: mc-sshd\nPayload-Oxum: 3.2\n")
+
+	// A bag made at the same time would overwrite the first.
+	_, err = CreateBag(stores, project, user, "/dataset1", now, mcfsRoot)
+	require.True(t, errors.Is(err, os.ErrExist))
+
+	_, err = CreateBag(stores, project, user, "/exports", now, mcfsRoot)
+	require.True(t, errors.Is(err, os.ErrInvalid))
+
+	_, err = CreateBag(stores, project, user, "/missing", now, mcfsRoot)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestEncodeBagPath(t *testing.T) {
+	require.Equal(t, "a%25b%0Ac%0Dd", encodeBagPath("a%b\nc\rd"))
+}
@@ -0,0 +1,88 @@
+package mc
+
+// CapabilitiesVersion is the version of the Capabilities document. It changes when a field changes meaning,
+// new fields and features are added without changing it.
+const CapabilitiesVersion = 1
+
+// The features advertised in Capabilities, so that clients such as the mc CLI can adapt to the server they
+// are talking to.
+const (
+	// CapabilityTags is tagging uploads through a TaggedDirName path, and with EnvUploadTag.
+	CapabilityTags = "tags"
+
+	// CapabilityDedup is storing an upload whose data is already stored as a pointer to the existing data.
+	CapabilityDedup = "dedup"
+
+	// CapabilitySessionEnv is the session hints in SessionEnv, such as EnvProject.
+	CapabilitySessionEnv = "session-env"
+
+	// CapabilityHardLinks is creating hard links with the hardlink@openssh.com extension (see LinkFile).
+	CapabilityHardLinks = "hard-links"
+
+	// CapabilitySymlinks is creating symbolic links (see CreateSymlink).
+	CapabilitySymlinks = "symlinks"
+
+	// CapabilityProjectCreation is creating a project with mkdir at the root.
+	CapabilityProjectCreation = "project-creation"
+
+	// CapabilitySCPResume is continuing an interrupted SCP upload when the same file is uploaded again (see
+	// ResumableUpload).
+	CapabilitySCPResume = "scp-resume"
+)
+
+// Capabilities describes what the server supports for a user. It is returned, as JSON, by the SFTP
+// capabilities extension.
+type Capabilities struct {
+	Version  int      `json:"version"`
+	Server   string   `json:"server"`
+	ReadOnly bool     `json:"read_only"`
+	Features []string `json:"features"`
+
+	// The limits on the paths that can be created. 0 means no limit.
+	MaxPathDepth  int `json:"max_path_depth,omitempty"`
+	MaxNameLength int `json:"max_name_length,omitempty"`
+	MaxPathLength int `json:"max_path_length,omitempty"`
+
+	// ProjectQuota is the number of bytes each project may use. 0 means no quota.
+	ProjectQuota int64 `json:"project_quota,omitempty"`
+}
+
+// Capabilities returns the capabilities of the server for the user with userSlug. The features that can
+// be turned off per project (see FeatureFlags) are advertised if they are enabled for the user, they can
+// still be refused in a project they are turned off in.
+func (c *Config) Capabilities(userSlug string) Capabilities {
+	capabilities := Capabilities{
+		Version:       CapabilitiesVersion,
+		Server:        "mc-sshd",
+		ReadOnly:      c.ReadOnly,
+		Features:      []string{CapabilitySessionEnv},
+		MaxPathDepth:  c.MaxPathDepth,
+		MaxNameLength: c.MaxNameLength,
+		MaxPathLength: c.MaxPathLength,
+		ProjectQuota:  c.ProjectQuota,
+	}
+
+	if c.ReadOnly {
+		return capabilities
+	}
+
+	capabilities.Features = append(capabilities.Features, CapabilityTags, CapabilityDedup)
+
+	if c.Features.Enabled(FeatureHardLinks, userSlug, "") {
+		capabilities.Features = append(capabilities.Features, CapabilityHardLinks)
+	}
+
+	if c.Features.Enabled(FeatureSymlinks, userSlug, "") {
+		capabilities.Features = append(capabilities.Features, CapabilitySymlinks)
+	}
+
+	if c.CanCreateProjects(userSlug) {
+		capabilities.Features = append(capabilities.Features, CapabilityProjectCreation)
+	}
+
+	if c.SCPResumeMinSize > 0 {
+		capabilities.Features = append(capabilities.Features, CapabilitySCPResume)
+	}
+
+	return capabilities
+}
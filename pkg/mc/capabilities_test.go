@@ -0,0 +1,28 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Capabilities(t *testing.T) {
+	config := DefaultConfig()
+	config.AllowProjectCreation = true
+	config.SCPResumeMinSize = 1024
+	config.Features = NewFeatureFlags([]FeatureFlag{{Name: FeatureSymlinks, UserSlug: "bob", Enabled: false}}, nil)
+
+	capabilities := config.Capabilities("alice")
+	require.Equal(t, CapabilitiesVersion, capabilities.Version)
+	require.False(t, capabilities.ReadOnly)
+	require.Equal(t, []string{CapabilitySessionEnv, CapabilityTags, CapabilityDedup, CapabilityHardLinks, CapabilitySymlinks,
+		CapabilityProjectCreation, CapabilitySCPResume}, capabilities.Features)
+	require.Equal(t, 4096, capabilities.MaxPathLength)
+
+	require.NotContains(t, config.Capabilities("bob").Features, CapabilitySymlinks)
+
+	config.ReadOnly = true
+	capabilities = config.Capabilities("alice")
+	require.True(t, capabilities.ReadOnly)
+	require.Equal(t, []string{CapabilitySessionEnv}, capabilities.Features)
+}
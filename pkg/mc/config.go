@@ -0,0 +1,201 @@
+package mc
+
+import "time"
+
+// Config consolidates the deployment configurable settings used by the handlers. Like Stores, it
+// cleans up the number of parameters that need to be passed in to create a mcscp.Handler or
+// mcsftp.Handler.
+type Config struct {
+	// DBTimeout is how long a single operation (such as an SFTP Stat, or an SCP Write) may spend
+	// in the database before it is canceled.
+	DBTimeout time.Duration
+
+	// FSTimeout is how long a single filesystem call (open, mkdir, a read or write of one
+	// chunk, etc...) may take before the session gives up on it. This keeps a hung NFS mount
+	// from wedging a session forever.
+	FSTimeout time.Duration
+
+	// MaxPathDepth is the maximum number of directories, including the file name, in a path
+	// that can be created. 0 means no limit.
+	MaxPathDepth int
+
+	// MaxNameLength is the maximum length of a single file or directory name. 0 means no limit.
+	MaxNameLength int
+
+	// MaxPathLength is the maximum length of a complete path, not including the project
+	// slug. 0 means no limit.
+	MaxPathLength int
+
+	// IgnorePatterns are the server wide patterns for uploaded files and directories that are
+	// silently skipped. See IgnoreList.
+	IgnorePatterns []string
+
+	// SanitizePolicy determines how names that are invalid in Materials Commons or on other
+	// platforms are handled when files and directories are created. It defaults to SanitizeReject.
+	SanitizePolicy SanitizePolicy
+
+	// NoOverwritePaths are the paths where writing to an existing file fails with ErrFileExists
+	// instead of creating a new version of the file.
+	NoOverwritePaths []PathRule
+
+	// WriteOncePaths are the write-once (WORM) paths, for areas such as raw data that must stay as
+	// they were uploaded. Files can be created in them, but never overwritten, renamed or removed.
+	WriteOncePaths []PathRule
+
+	// ProjectQuota is the number of bytes each project may use. It is reported by the SFTP statvfs
+	// extension so that df on sshfs mounts shows the project's usage. 0 means no quota, in which
+	// case the free space on the filesystem is reported instead. It is the quota of the projects
+	// without one in ProjectQuotas (see QuotaFor).
+	ProjectQuota int64
+
+	// ProjectQuotas are the quotas of individual projects, overriding ProjectQuota.
+	ProjectQuotas ProjectQuotas
+
+	// MaxArchiveSize is the most data, in bytes, that can be extracted from a single archive, whatever
+	// the sizes recorded in it. 0 means no limit. See ExtractArchive.
+	MaxArchiveSize int64
+
+	// MaxArchiveEntries is the most entries, including directories and skipped entries, that a single
+	// archive can have for it to be extracted. 0 means no limit. See ExtractArchive.
+	MaxArchiveEntries int
+
+	// AllowProjectCreation allows users to create a project by creating a directory at the root,
+	// for example with mkdir /new-project over SFTP.
+	AllowProjectCreation bool
+
+	// ProjectCreators are the slugs of the users who may create projects when AllowProjectCreation
+	// is set. If it is empty then any user may create projects.
+	ProjectCreators []string
+
+	// ProtectedDirSize is the size, in bytes, above which deleting a top level directory of a project
+	// has to be confirmed (see GuardDestructiveOperation). 0 turns off the confirmation.
+	ProtectedDirSize int64
+
+	// WriteCoalesceSize is the size, in bytes, up to which sequential SFTP writes are buffered before
+	// being written to storage. Clients typically write 32KB at a time, which is slow on high latency
+	// network storage. A buffered write that fails is only reported on a later write, or on close, so
+	// buffering is off by default: 0 writes each SFTP write as it arrives.
+	WriteCoalesceSize int
+
+	// SessionWriteBudget is the number of bytes the writes of an SFTP session can hold in memory, in
+	// coalescing buffers and being written to storage, before its writes wait (see WriteBudget). It keeps
+	// memory use predictable when clients upload many large files in parallel. 0 means no limit.
+	SessionWriteBudget int64
+
+	// PrintSessionSummary writes a summary of the files transferred, and of the failures, to the stderr of
+	// SFTP clients when their session ends. See SessionSummary.
+	PrintSessionSummary bool
+
+	// VerifyReads checks the data of files against their checksums as they are downloaded. See
+	// ChecksumVerifier.
+	VerifyReads ReadVerification
+
+	// SCPResumeMinSize is the amount of data, in bytes, an interrupted SCP upload must have received for
+	// the data to be staged, so that uploading the same file again continues from it (see ResumeWriter),
+	// or the rest of the file can be sent with mc upload-append (see ContinueUpload). 0 turns off staging.
+	SCPResumeMinSize int64
+
+	// SCPUnchangedCheckLimit is the largest SCP upload, in bytes, that is compared with the current version
+	// of its file before anything is written. An upload the same as the current version is skipped (see
+	// PrecheckUnchanged). 0 turns off the check. Uploads to projects with FeatureDedup turned off are never
+	// skipped.
+	SCPUnchangedCheckLimit int64
+
+	// ReadAheadSize is the size, in bytes, of the chunks SCP downloads are read from storage in. The next
+	// chunk is read while the current one is sent to the client (see PrefetchReader). 0 reads the file
+	// as the data is sent.
+	ReadAheadSize int
+
+	// ReadAheadFiles is the number of files, after the one being sent, that are read ahead during
+	// recursive SCP downloads (see PrefetchPipeline). It only applies when ReadAheadSize is set.
+	ReadAheadFiles int
+
+	// ReadOnly refuses all writes, such as uploads and directory creation. It is set for satellite
+	// servers that serve files fetched from the primary site (see RemoteFileCache).
+	ReadOnly bool
+
+	// DropBoxes are the drop boxes of instrument accounts, keyed by the user's slug. An instrument
+	// account can only upload into its drop boxes, and can't read or list anything. See
+	// CheckDropBoxAccess.
+	DropBoxes map[string][]PathRule
+
+	// Scopes holds the scopes of the users logged in with a scoped credential, such as a guest (see
+	// CreateGuest) or a token (see CreateToken). They are checked by CheckDropBoxAccess.
+	Scopes *ScopeRegistry
+
+	// ModeRules set the permissions reported for files and directories in listings, stats and SCP
+	// downloads, per project or per user. See Config.FileModes.
+	ModeRules []ModeRule
+
+	// ListDotEntries starts SFTP directory listings with "." and ".." entries, as OpenSSH's sftp-server
+	// does. Some clients expect them. See ArrangeListing.
+	ListDotEntries bool
+
+	// MaxListEntries is the number of entries above which an SFTP directory listing is read from the
+	// database MaxListEntries at a time, rather than all at once, so that huge directories can't exhaust
+	// the server's memory. See PagedListing. 0 always reads listings all at once.
+	MaxListEntries int
+
+	// HideInternalFiles leaves the InternalFileNames, such as .mcignore files, out of SFTP directory
+	// listings. The files can still be read and written by name.
+	HideInternalFiles bool
+
+	// Features turns capabilities, such as symbolic links and project creation, on and off per user or
+	// project, so that they can be rolled out gradually. It is nil when everything is enabled.
+	Features *FeatureFlags
+
+	// TrackAccessTimes records when files are read, and reports it as their access time, instead of their
+	// modification time, in SFTP and SCP attributes. The reads are written to the database in batches by
+	// the FileAccessRecorder, so they need it, and reads made through other instances only show up once they
+	// have been flushed.
+	TrackAccessTimes bool
+}
+
+// CanCreateProjects returns true if the user with userSlug is allowed to create projects. Instrument
+// accounts never are, nor are users that FeatureProjectCreation is turned off for.
+func (c *Config) CanCreateProjects(userSlug string) bool {
+	if !c.AllowProjectCreation || c.IsInstrumentAccount(userSlug) || !c.Features.Enabled(FeatureProjectCreation, userSlug, "") {
+		return false
+	}
+
+	if len(c.ProjectCreators) == 0 {
+		return true
+	}
+
+	for _, creator := range c.ProjectCreators {
+		if creator == userSlug {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DedupEnabled returns true unless FeatureDedup is turned off for the project with projectSlug. A nil
+// Config dedups everything.
+func (c *Config) DedupEnabled(projectSlug string) bool {
+	return c == nil || c.Features.Enabled(FeatureDedup, "", projectSlug)
+}
+
+// DefaultConfig returns a Config with the default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		DBTimeout:      30 * time.Second,
+		FSTimeout:      60 * time.Second,
+		MaxPathDepth:   64,
+		MaxNameLength:  255,
+		MaxPathLength:  4096,
+		IgnorePatterns: DefaultIgnorePatterns,
+		SanitizePolicy: SanitizeReject,
+		Scopes:         NewScopeRegistry(),
+
+		MaxArchiveSize:    DefaultMaxArchiveSize,
+		MaxArchiveEntries: DefaultMaxArchiveEntries,
+
+		ProtectedDirSize:   1024 * 1024 * 1024,
+		SessionWriteBudget: 64 * 1024 * 1024,
+		MaxListEntries:     10000,
+		ReadAheadSize:      1024 * 1024,
+		ReadAheadFiles:     4,
+	}
+}
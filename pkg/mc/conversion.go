@@ -0,0 +1,184 @@
+package mc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// DefaultConversionBacklog is the default ConversionPolicy.MaxBacklog.
+const DefaultConversionBacklog = 100000
+
+// ConversionPolicy limits the files that are queued for conversion to web viewable versions, and how fast
+// they are queued. The conversions themselves are run by the Materials Commons web application's queue
+// workers, which pick them up from the conversions table, so the number of converters running at once and
+// their CPU and memory limits are set there. The policy keeps a burst of uploads from flooding those
+// workers.
+type ConversionPolicy struct {
+	// MimeTypes are the mime types that are converted, such as "image/tiff". A type ending in "/*", such
+	// as "image/*", matches every subtype. Empty converts every type Materials Commons can convert.
+	MimeTypes []string
+
+	// MaxSize is the size, in bytes, above which files aren't converted. 0 means no limit.
+	MaxSize int64
+
+	// PerMinute is the number of conversions queued per minute. The files above the rate wait in the
+	// server's backlog. 0 means no limit.
+	PerMinute int
+
+	// MaxBacklog is the number of files that can wait to be queued. Files that arrive when the backlog is
+	// full aren't converted.
+	MaxBacklog int
+}
+
+// ParseMimeTypes parses a comma separated list of mime types, such as "image/tiff,application/msword".
+func ParseMimeTypes(mimeTypes string) []string {
+	var parsed []string
+	for _, mimeType := range strings.Split(mimeTypes, ",") {
+		if mimeType = strings.ToLower(strings.TrimSpace(mimeType)); mimeType != "" {
+			parsed = append(parsed, mimeType)
+		}
+	}
+
+	return parsed
+}
+
+// Allows returns true if the policy lets file be converted.
+func (p ConversionPolicy) Allows(file *mcmodel.File) bool {
+	if p.MaxSize > 0 && int64(file.Size) > p.MaxSize {
+		return false
+	}
+
+	if len(p.MimeTypes) == 0 {
+		return true
+	}
+
+	mimeType := strings.ToLower(file.MimeType)
+	for _, allowed := range p.MimeTypes {
+		if allowed == mimeType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, allowed[:len(allowed)-1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConversionLimiter applies a ConversionPolicy to the files queued for conversion, both by uploads and by
+// the HookConvert upload hook. Projects can opt out of conversions by turning off FeatureConversions. Like
+// the VersionPruner, files are taken from the ConversionStore calls by its Middleware and queued for
+// conversion in the background, by Run, at the policy's rate.
+type ConversionLimiter struct {
+	stores *Stores
+	policy ConversionPolicy
+	config *Config
+
+	// backlog holds the files waiting to be queued for conversion.
+	backlog chan mcmodel.File
+}
+
+// NewConversionLimiter creates a ConversionLimiter that queues conversions with stores. The feature flags
+// are taken from config when each file is queued, so that they can be set up after the limiter.
+func NewConversionLimiter(stores *Stores, policy ConversionPolicy, config *Config) *ConversionLimiter {
+	if policy.MaxBacklog <= 0 {
+		policy.MaxBacklog = DefaultConversionBacklog
+	}
+
+	return &ConversionLimiter{
+		stores:  stores,
+		policy:  policy,
+		config:  config,
+		backlog: make(chan mcmodel.File, policy.MaxBacklog),
+	}
+}
+
+// Middleware returns a StoreMiddleware that moves each file passed to ConversionStore.AddFileToConvert to
+// the backlog. A file added in a transaction that is then rolled back is skipped by Queue.
+func (l *ConversionLimiter) Middleware() StoreMiddleware {
+	return StoreMiddleware{
+		ConversionStore: func(conversionStore store.ConversionStore) store.ConversionStore {
+			return &limitedConversionStore{limiter: l}
+		},
+	}
+}
+
+// Run queues the files in the backlog for conversion until ctx is done.
+func (l *ConversionLimiter) Run(ctx context.Context) {
+	var interval time.Duration
+	if l.policy.PerMinute > 0 {
+		interval = time.Minute / time.Duration(l.policy.PerMinute)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-l.backlog:
+			queued, err := l.Queue(&file)
+			if err != nil {
+				log.Errorf("Unable to queue file %d in project %d for conversion: %s", file.ID, file.ProjectID, err)
+			}
+
+			if queued && interval > 0 {
+				if err := sleepContext(ctx, interval); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Queue queues file for conversion if the policy allows it and conversions are enabled for its project.
+// It returns true if the file was queued.
+func (l *ConversionLimiter) Queue(file *mcmodel.File) (bool, error) {
+	project, err := l.stores.ProjectStore.GetProjectByID(file.ProjectID)
+	if err != nil {
+		return false, err
+	}
+
+	if !l.config.Features.Enabled(FeatureConversions, "", project.Slug) {
+		return false, nil
+	}
+
+	versions, err := l.stores.VersionStore.ListVersions(file)
+	if err != nil {
+		return false, err
+	}
+
+	// Use the stored version of the file, which has its size and is missing if the upload was rolled back.
+	var current *mcmodel.File
+	for i := range versions {
+		if versions[i].ID == file.ID {
+			current = &versions[i]
+			break
+		}
+	}
+
+	if current == nil || !l.policy.Allows(current) {
+		return false, nil
+	}
+
+	if _, err := l.stores.ConversionStore.AddFileToConvert(current); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// limitedConversionStore moves files to the limiter's backlog instead of queuing them for conversion.
+type limitedConversionStore struct {
+	limiter *ConversionLimiter
+}
+
+func (s *limitedConversionStore) AddFileToConvert(file *mcmodel.File) (*mcmodel.Conversion, error) {
+	select {
+	case s.limiter.backlog <- *file:
+	default:
+		log.Errorf("Conversion backlog is full, not converting file %d in project %d", file.ID, file.ProjectID)
+	}
+
+	return nil, nil
+}
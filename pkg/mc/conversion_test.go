@@ -0,0 +1,91 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConversionStore is a ConversionStore that keeps the IDs of the files queued for conversion.
+type recordingConversionStore struct {
+	fileIDs []int
+}
+
+func (s *recordingConversionStore) AddFileToConvert(file *mcmodel.File) (*mcmodel.Conversion, error) {
+	s.fileIDs = append(s.fileIDs, file.ID)
+	return &mcmodel.Conversion{FileID: file.ID}, nil
+}
+
+func TestConversionPolicy_Allows(t *testing.T) {
+	policy := ConversionPolicy{MimeTypes: ParseMimeTypes("image/*, application/msword"), MaxSize: 100}
+
+	tests := []struct {
+		mimeType string
+		size     uint64
+		allowed  bool
+	}{
+		{mimeType: "image/tiff", size: 10, allowed: true},
+		{mimeType: "Image/BMP", size: 10, allowed: true},
+		{mimeType: "application/msword", size: 100, allowed: true},
+		{mimeType: "application/vnd.ms-powerpoint", size: 10, allowed: false},
+		{mimeType: "imagefoo/tiff", size: 10, allowed: false},
+		{mimeType: "image/tiff", size: 101, allowed: false},
+	}
+
+	for _, test := range tests {
+		file := &mcmodel.File{MimeType: test.mimeType, Size: test.size}
+		require.Equal(t, test.allowed, policy.Allows(file), "%s of %d bytes", test.mimeType, test.size)
+	}
+
+	require.True(t, ConversionPolicy{}.Allows(&mcmodel.File{MimeType: "image/tiff", Size: 1 << 40}))
+}
+
+func TestConversionLimiter(t *testing.T) {
+	conversions := &recordingConversionStore{}
+	stores := &Stores{
+		ProjectStore:    store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}, {ID: 2, Slug: "opted-out"}}),
+		ConversionStore: conversions,
+		VersionStore: NewFakeVersionStore(
+			mcmodel.File{ID: 10, ProjectID: 1, DirectoryID: 1, Name: "a.tif", MimeType: "image/tiff", Size: 10},
+			mcmodel.File{ID: 11, ProjectID: 1, DirectoryID: 1, Name: "big.tif", MimeType: "image/tiff", Size: 1000},
+			mcmodel.File{ID: 20, ProjectID: 2, DirectoryID: 2, Name: "b.tif", MimeType: "image/tiff", Size: 10},
+		),
+	}
+
+	flags, err := ParseFeatureFlags("conversions@project:opted-out=off")
+	require.NoError(t, err)
+	config := &Config{Features: NewFeatureFlags(flags, nil)}
+
+	limiter := NewConversionLimiter(stores, ConversionPolicy{MaxSize: 100, MaxBacklog: 2}, config)
+
+	// Files are moved to the backlog instead of being queued, and are dropped when it is full.
+	wrapped := stores.Use(limiter.Middleware())
+	for _, id := range []int{10, 11, 20} {
+		_, err := wrapped.ConversionStore.AddFileToConvert(&mcmodel.File{ID: id})
+		require.NoError(t, err)
+	}
+	require.Empty(t, conversions.fileIDs)
+	require.Len(t, limiter.backlog, 2)
+
+	tests := []struct {
+		file   mcmodel.File
+		queued bool
+	}{
+		{file: mcmodel.File{ID: 10, ProjectID: 1, DirectoryID: 1, Name: "a.tif"}, queued: true},
+		{file: mcmodel.File{ID: 11, ProjectID: 1, DirectoryID: 1, Name: "big.tif"}, queued: false},
+		{file: mcmodel.File{ID: 20, ProjectID: 2, DirectoryID: 2, Name: "b.tif"}, queued: false},
+
+		// Rolled back, so it isn't stored.
+		{file: mcmodel.File{ID: 12, ProjectID: 1, DirectoryID: 1, Name: "a.tif"}, queued: false},
+	}
+
+	for _, test := range tests {
+		queued, err := limiter.Queue(&test.file)
+		require.NoError(t, err)
+		require.Equal(t, test.queued, queued, "file %d", test.file.ID)
+	}
+
+	require.Equal(t, []int{10}, conversions.fileIDs)
+}
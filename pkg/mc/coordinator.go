@@ -0,0 +1,141 @@
+package mc
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrFileBusy is returned when a session attempts to write to a path that another session
+// is already writing to.
+var ErrFileBusy = errors.New("file busy: another session is currently writing to this file")
+
+// ErrFileLocked is returned when a user attempts to write to, or lock, a path that another user holds
+// an advisory lock on.
+var ErrFileLocked = errors.New("file locked: another user holds an advisory lock on this file")
+
+// ErrNotLocked is returned when a user attempts to release an advisory lock that they don't hold.
+var ErrNotLocked = errors.New("file is not locked by this user")
+
+// ErrTooManySessions is returned when a user attempts to open more sessions than they are allowed.
+var ErrTooManySessions = errors.New("too many open sessions for user")
+
+// PathLocker tracks which project paths are currently being written to. Without it two sessions
+// writing the same path would both create new versions and whichever called DoneWritingToFile
+// last would silently win. Lock doesn't wait for the lock to be released, instead it returns
+// ErrFileBusy if another writer holds the lock.
+type PathLocker interface {
+	Lock(projectID int, path string) error
+	Unlock(projectID int, path string)
+}
+
+// SessionCounter tracks the number of open sessions for each user. Increment returns the number
+// of sessions the user has open, including the one just added.
+type SessionCounter interface {
+	Increment(userID int) (int64, error)
+	Decrement(userID int)
+}
+
+// QuotaCounter tracks the number of bytes reserved by the uploads in progress to each project (see
+// QuotaReservation). AddBytes returns the new total for the project, a negative n gives bytes back.
+type QuotaCounter interface {
+	AddBytes(projectID int, n int64) (int64, error)
+	Bytes(projectID int) (int64, error)
+}
+
+// AdvisoryLocker holds the advisory locks that users take on paths, for example so that a pipeline
+// can keep other users from writing to a result file while it is post-processing it. Unlike the
+// PathLocker locks, which only last while a file is being written, advisory locks are taken and
+// released explicitly by the user and last until they are released or their ttl expires. Taking a
+// lock that the user already holds extends it.
+type AdvisoryLocker interface {
+	Lock(projectID int, path string, userID int, ttl time.Duration) error
+	Unlock(projectID int, path string, userID int) error
+
+	// LockHolder returns the user holding the lock on path, and false if path isn't locked.
+	LockHolder(projectID int, path string) (int, bool, error)
+}
+
+// CheckAdvisoryLock returns ErrFileLocked if a user other than userID holds an advisory lock on path.
+func CheckAdvisoryLock(locker AdvisoryLocker, projectID int, path string, userID int) error {
+	holder, locked, err := locker.LockHolder(projectID, path)
+	switch {
+	case err != nil:
+		return err
+	case locked && holder != userID:
+		return ErrFileLocked
+	default:
+		return nil
+	}
+}
+
+// Coordinator consolidates the state that has to be shared across sessions. When a single mc-sshd
+// instance is running this state can be kept in memory (see NewInMemoryCoordinator). When multiple
+// instances are running behind a load balancer the state has to be shared between instances (see
+// the mcredis package).
+type Coordinator struct {
+	PathLocker     PathLocker
+	SessionCounter SessionCounter
+	QuotaCounter   QuotaCounter
+	AdvisoryLocker AdvisoryLocker
+
+	// Events receives the events, such as audit events, emitted by the sessions.
+	Events EventSink
+
+	// WriteBackpressure throttles new writes when finalizing uploads backs up. It is per instance, since
+	// it tracks this instance's finalizations. It is nil when throttling isn't configured.
+	WriteBackpressure *WriteBackpressure
+
+	// Transfers records the throughput of the transfers made by this instance. It is nil when transfer
+	// stats aren't being kept.
+	Transfers *TransferStats
+
+	// FileAccess counts the downloads of each file. It is nil when downloads aren't being counted.
+	FileAccess *FileAccessRecorder
+
+	// Activity tracks the live sessions and transfer rates in each project. It is nil when the activity
+	// isn't being exported.
+	Activity *ActivityStats
+
+	// RemoteFiles fetches file data from the primary site on a read-only satellite server. It is nil
+	// when the file data is local.
+	RemoteFiles *RemoteFileCache
+
+	// IngestLimiter caps the combined rate of the uploads to this instance by time of day. It is nil
+	// when uploads aren't capped.
+	IngestLimiter *WindowedRateLimiter
+
+	// Repairer restores the data of files found to be damaged when they are downloaded. It is nil when
+	// damaged files aren't repaired automatically.
+	Repairer *FileRepairer
+
+	// Sessions tracks this instance's SFTP sessions, so that idle sessions can be reaped. It is nil when
+	// sessions aren't being tracked.
+	Sessions *SessionRegistry
+
+	// Authorizer is consulted on each read, write, delete and list. It is nil when there is no policy
+	// beyond project access.
+	Authorizer Authorizer
+
+	// FileWatcher lets clients wait for new files in a directory tree. It is nil when watching isn't
+	// enabled.
+	FileWatcher *FileWatcher
+
+	// Puller fetches data from URLs into projects for mc pull. It is nil when pulling isn't enabled.
+	Puller *Puller
+
+	// Scratch holds each connection's ScratchArea, the ScratchDirName beside the projects. It is nil when
+	// scratch areas aren't turned on.
+	Scratch *ScratchAreas
+}
+
+// NewInMemoryCoordinator creates a Coordinator whose state is only shared by the sessions within
+// this process.
+func NewInMemoryCoordinator() *Coordinator {
+	return &Coordinator{
+		PathLocker:     NewInMemoryPathLocker(),
+		SessionCounter: NewInMemorySessionCounter(),
+		QuotaCounter:   NewInMemoryQuotaCounter(),
+		AdvisoryLocker: NewInMemoryAdvisoryLocker(),
+		Events:         NewLogEventSink(),
+	}
+}
@@ -0,0 +1,118 @@
+package mc
+
+import (
+	"sort"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DamagedFile flags a file whose data was found to be damaged while it was being used. Reason is the kind
+// of problem found, one of the StorageVerifier kinds such as VerifyMissing. Path is the project path of
+// the file when the problem was found.
+type DamagedFile struct {
+	FileID     int `gorm:"primaryKey"`
+	ProjectID  int
+	Path       string
+	Reason     string
+	DetectedAt time.Time
+}
+
+// DamagedFileStore holds the files flagged as damaged, so that they can be checked and repaired (see
+// StorageVerifier.DamagedOnly). The flags are kept in the damaged_files table, which mc-sshd adds to the
+// Materials Commons database:
+//
+//	CREATE TABLE damaged_files (
+//	    file_id INT UNSIGNED PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    path VARCHAR(4096) NOT NULL,
+//	    reason VARCHAR(32) NOT NULL,
+//	    detected_at TIMESTAMP NOT NULL,
+//	    INDEX (project_id)
+//	);
+type DamagedFileStore interface {
+	// MarkFileDamaged flags a file as damaged. A file that is already flagged has its flag replaced.
+	MarkFileDamaged(damaged DamagedFile) error
+
+	// ClearFileDamaged removes the flag from a file. It isn't an error if the file isn't flagged.
+	ClearFileDamaged(fileID int) error
+
+	// ListDamagedFiles returns up to limit of the files that are flagged as damaged, in the projects in
+	// projectIDs or in every project when projectIDs is empty. It pages through the files in the same way
+	// as FileAuditStore.ListStoredFiles, and the files have their Directory loaded.
+	ListDamagedFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error)
+}
+
+func (DamagedFile) TableName() string {
+	return "damaged_files"
+}
+
+type GormDamagedFileStore struct {
+	db *gorm.DB
+}
+
+func NewGormDamagedFileStore(db *gorm.DB) *GormDamagedFileStore {
+	return &GormDamagedFileStore{db: db}
+}
+
+func (s *GormDamagedFileStore) MarkFileDamaged(damaged DamagedFile) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&damaged).Error
+}
+
+func (s *GormDamagedFileStore) ClearFileDamaged(fileID int) error {
+	return s.db.Where("file_id = ?", fileID).Delete(&DamagedFile{}).Error
+}
+
+func (s *GormDamagedFileStore) ListDamagedFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	query := s.db.Preload("Directory").
+		Where("id IN (?)", s.db.Model(&DamagedFile{}).Select("file_id")).
+		Where("id > ?", afterID)
+
+	if len(projectIDs) != 0 {
+		query = query.Where("project_id IN ?", projectIDs)
+	}
+
+	err := query.Order("id").Limit(limit).Find(&files).Error
+	return files, err
+}
+
+// FakeDamagedFileStore is a DamagedFileStore for testing. The flags are kept in Damaged, keyed by file
+// id, and ListDamagedFiles returns the flagged files out of Files.
+type FakeDamagedFileStore struct {
+	Files   []mcmodel.File
+	Damaged map[int]DamagedFile
+}
+
+func NewFakeDamagedFileStore(files ...mcmodel.File) *FakeDamagedFileStore {
+	return &FakeDamagedFileStore{Files: files, Damaged: make(map[int]DamagedFile)}
+}
+
+func (s *FakeDamagedFileStore) MarkFileDamaged(damaged DamagedFile) error {
+	s.Damaged[damaged.FileID] = damaged
+	return nil
+}
+
+func (s *FakeDamagedFileStore) ClearFileDamaged(fileID int) error {
+	delete(s.Damaged, fileID)
+	return nil
+}
+
+func (s *FakeDamagedFileStore) ListDamagedFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error) {
+	inProjects := make(map[int]bool)
+	for _, id := range projectIDs {
+		inProjects[id] = true
+	}
+
+	var files []mcmodel.File
+	for _, f := range s.Files {
+		if _, ok := s.Damaged[f.ID]; ok && f.ID > afterID && (len(projectIDs) == 0 || inProjects[f.ProjectID]) {
+			files = append(files, f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files[:minInt(limit, len(files))], nil
+}
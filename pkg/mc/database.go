@@ -0,0 +1,152 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DatabaseDriver opens a database that the Gorm stores can run on.
+type DatabaseDriver struct {
+	// Open returns the dialector for the database at dsn.
+	Open func(dsn string) gorm.Dialector
+
+	// OwnsSchema is true when mc-sshd creates the tables itself (see MigrateDatabase) rather than the
+	// Materials Commons web app's migrations creating them. This is the case for a database that only
+	// mc-sshd uses, such as a SQLite file in a small deployment.
+	OwnsSchema bool
+}
+
+var databaseDrivers = map[string]DatabaseDriver{
+	"mysql": {Open: mysql.Open},
+}
+
+// RegisterDatabaseDriver makes a driver available to OpenDatabase under name. It is called from the init
+// function of the file that adds the driver, so that only builds that include it depend on its package.
+func RegisterDatabaseDriver(name string, driver DatabaseDriver) {
+	databaseDrivers[name] = driver
+}
+
+// DatabaseDrivers returns the names of the registered drivers, sorted.
+func DatabaseDrivers() []string {
+	var names []string
+	for name := range databaseDrivers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// OpenDatabase opens the database at dsn with the named driver. When the driver owns its schema the
+// tables are created, or brought up to date, before the database is returned.
+func OpenDatabase(driverName, dsn string) (*gorm.DB, error) {
+	driver, ok := databaseDrivers[driverName]
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver %q, this build supports %s", driverName, strings.Join(DatabaseDrivers(), ", "))
+	}
+
+	db, err := gorm.Open(driver.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, err
+	}
+
+	if driver.OwnsSchema {
+		if err := MigrateDatabase(db); err != nil {
+			return nil, fmt.Errorf("unable to create the database tables: %w", err)
+		}
+	}
+
+	return db, nil
+}
+
+// DatabaseModels are the models of every table the Gorm stores use: the gomcdb models in SchemaModels
+// and the tables mc-sshd adds to the Materials Commons database.
+var DatabaseModels = append(append([]interface{}{}, SchemaModels...),
+	&team{}, &tag{}, &attribute{}, &attributeValue{}, &Token{}, &Symlink{}, &FileLink{}, &FileAccess{}, &ProjectSlugAlias{},
+	&projectNetwork{}, &FeatureFlag{}, &ResumableUpload{}, &DamagedFile{}, &Guest{}, &projectExtractPath{})
+
+// joinTables are the tables without a model that the stores, and gomcdb's stores, write with raw SQL.
+var joinTables = []string{
+	"CREATE TABLE IF NOT EXISTS team2admin (team_id INTEGER NOT NULL, user_id INTEGER NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS team2member (team_id INTEGER NOT NULL, user_id INTEGER NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS taggables (tag_id INTEGER NOT NULL, taggable_type VARCHAR(255) NOT NULL, taggable_id INTEGER NOT NULL)",
+}
+
+// extraColumns are the columns of the Materials Commons tables that the stores query and the models don't
+// have.
+var extraColumns = []struct{ table, column, definition string }{
+	{"files", "dataset_id", "INTEGER"},
+	{"files", "deleted_at", "DATETIME"},
+	{"tags", "type", "VARCHAR(255)"},
+}
+
+// MigrateDatabase creates the tables in DatabaseModels, and the join tables, that db doesn't have, and adds
+// any missing columns to those it has. It is only for a database mc-sshd owns. The Materials Commons
+// database is changed only by the web app's migrations.
+func MigrateDatabase(db *gorm.DB) error {
+	if err := db.AutoMigrate(DatabaseModels...); err != nil {
+		return err
+	}
+
+	for _, stmt := range joinTables {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, c := range extraColumns {
+		if db.Migrator().HasColumn(c.table, c.column) {
+			continue
+		}
+
+		if err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isSQLite returns true when db is a SQLite database, for the few queries whose SQL differs from MySQL's.
+func isSQLite(db *gorm.DB) bool {
+	return db.Dialector.Name() == "sqlite"
+}
+
+// ErrUserExists is returned when adding a user whose slug or email is already taken.
+var ErrUserExists = errors.New("user already exists")
+
+// AddUser adds a user, who logs in with their slug and the password whose bcrypt hash is passwordHash, to
+// a database mc-sshd owns. The users of the Materials Commons database are added through the web app.
+func AddUser(db *gorm.DB, slug, name, email, passwordHash string) (*mcmodel.User, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	user := mcmodel.User{UUID: id, Slug: slug, Name: name, Email: email, Password: passwordHash}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&mcmodel.User{}).Where("slug = ? OR email = ?", slug, email).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count != 0 {
+			return ErrUserExists
+		}
+
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,36 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestDatabase(t *testing.T) {
+	tables, err := ExpectedSchema(DatabaseModels...)
+	require.NoError(t, err)
+	require.Len(t, tables, len(DatabaseModels))
+	require.Contains(t, tables["resumable_uploads"], "partial_checksum")
+
+	_, err = OpenDatabase("postgres", "")
+	require.EqualError(t, err, `unknown database driver "postgres", this build supports mysql`)
+
+	// The upserts against MySQL keep using ON DUPLICATE KEY UPDATE with VALUES().
+	db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	require.NoError(t, err)
+
+	var sql string
+	require.NoError(t, db.Callback().Create().After("gorm:create").Register("test:sql", func(tx *gorm.DB) {
+		sql = tx.Statement.SQL.String()
+	}))
+
+	require.NoError(t, NewGormFileAccessStore(db).AddFileAccesses([]FileAccess{{FileID: 1, ProjectID: 2, Downloads: 1, LastAccessedAt: time.Now()}}))
+	require.Contains(t, sql, "ON DUPLICATE KEY UPDATE")
+	require.Contains(t, sql, "`last_accessed_at`=GREATEST(last_accessed_at, VALUES(last_accessed_at))")
+
+	require.NoError(t, NewGormResumableUploadStore(db).SaveResumableUpload(&ResumableUpload{ProjectID: 2, Path: "/a.txt"}))
+	require.Contains(t, sql, "ON DUPLICATE KEY UPDATE `size`=VALUES(`size`)")
+}
@@ -0,0 +1,115 @@
+package mc
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// DedupStats tracks how often FileStore.DoneWritingToFile found an existing file with the same checksum,
+// so that the bytes just written were discarded, and how many bytes that saved. The stats are kept per
+// project. DedupStats implements expvar.Var so that it can be published with expvar.Publish.
+type DedupStats struct {
+	mu       sync.Mutex
+	projects map[int]*ProjectDedupStats
+}
+
+// ProjectDedupStats are the deduplication stats for a single project.
+type ProjectDedupStats struct {
+	// Files is the number of files whose bytes were discarded.
+	Files int64 `json:"files"`
+
+	// BytesSaved is the total size of the discarded files.
+	BytesSaved int64 `json:"bytes_saved"`
+}
+
+func NewDedupStats() *DedupStats {
+	return &DedupStats{projects: make(map[int]*ProjectDedupStats)}
+}
+
+// Record counts a file of size bytes in the project that was discarded.
+func (s *DedupStats) Record(projectID int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.projects[projectID]
+	if !ok {
+		stats = &ProjectDedupStats{}
+		s.projects[projectID] = stats
+	}
+
+	stats.Files++
+	stats.BytesSaved += size
+}
+
+// Totals returns the stats summed across all projects.
+func (s *DedupStats) Totals() ProjectDedupStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var totals ProjectDedupStats
+	for _, stats := range s.projects {
+		totals.Files += stats.Files
+		totals.BytesSaved += stats.BytesSaved
+	}
+
+	return totals
+}
+
+// ForProject returns the stats for a single project.
+func (s *DedupStats) ForProject(projectID int) ProjectDedupStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stats, ok := s.projects[projectID]; ok {
+		return *stats
+	}
+
+	return ProjectDedupStats{}
+}
+
+// String returns the stats as JSON, with the totals and the stats for each project keyed by project id.
+func (s *DedupStats) String() string {
+	totals := s.Totals()
+
+	s.mu.Lock()
+	projects := make(map[string]ProjectDedupStats, len(s.projects))
+	for projectID, stats := range s.projects {
+		projects[strconv.Itoa(projectID)] = *stats
+	}
+	s.mu.Unlock()
+
+	b, _ := json.Marshal(struct {
+		ProjectDedupStats
+		Projects map[string]ProjectDedupStats `json:"projects"`
+	}{totals, projects})
+
+	return string(b)
+}
+
+// DedupStatsMiddleware returns a StoreMiddleware that records each file that FileStore.DoneWritingToFile
+// switched to an existing file in stats.
+func DedupStatsMiddleware(stats *DedupStats) StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &dedupStatsFileStore{FileStore: fileStore, stats: stats}
+		},
+	}
+}
+
+type dedupStatsFileStore struct {
+	store.FileStore
+	stats *DedupStats
+}
+
+func (s *dedupStatsFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	switched, err := s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+	if switched && err == nil {
+		s.stats.Record(file.ProjectID, size)
+	}
+
+	return switched, err
+}
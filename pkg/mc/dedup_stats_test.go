@@ -0,0 +1,32 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// switchingFileStore always finds an existing file with the same checksum.
+type switchingFileStore struct {
+	store.FileStore
+}
+
+func (s *switchingFileStore) DoneWritingToFile(_ *mcmodel.File, _ string, _ int64, _ store.ConversionStore) (bool, error) {
+	return true, nil
+}
+
+func TestDedupStatsMiddleware(t *testing.T) {
+	stats := NewDedupStats()
+	stores := (&Stores{FileStore: &switchingFileStore{}}).Use(DedupStatsMiddleware(stats))
+
+	for _, f := range []mcmodel.File{{ID: 1, ProjectID: 1}, {ID: 2, ProjectID: 1}, {ID: 3, ProjectID: 2}} {
+		_, err := stores.FileStore.DoneWritingToFile(&f, "checksum", 100, nil)
+		require.Nil(t, err)
+	}
+
+	require.Equal(t, ProjectDedupStats{Files: 2, BytesSaved: 200}, stats.ForProject(1))
+	require.Equal(t, ProjectDedupStats{Files: 3, BytesSaved: 300}, stats.Totals())
+	require.JSONEq(t, `{"files": 3, "bytes_saved": 300, "projects": {"1": {"files": 2, "bytes_saved": 200}, "2": {"files": 1, "bytes_saved": 100}}}`, stats.String())
+}
@@ -0,0 +1,154 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// EventDestructiveOperation is the Event.Type for an attempt to remove or rename a project's root or one of
+// its top level directories. It is emitted by AuditDestructiveOperation with the operation's final outcome.
+const EventDestructiveOperation = "destructive_operation"
+
+// DeleteConfirmationFileName is the name of the file that confirms a large top level directory may be
+// deleted. It must be uploaded into the directory before the directory is deleted.
+const DeleteConfirmationFileName = ".mc-confirm-delete"
+
+// ErrProjectRootProtected is returned when attempting to remove or rename a project's root directory.
+var ErrProjectRootProtected = errors.New("the project root directory can't be removed or renamed")
+
+// ErrDeleteNotConfirmed is returned when attempting to delete a large top level directory that doesn't
+// contain a DeleteConfirmationFileName file.
+var ErrDeleteNotConfirmed = fmt.Errorf("deleting a large top level directory must be confirmed by uploading a %s file into it", DeleteConfirmationFileName)
+
+// guardMaxDirs is the most directories GuardDestructiveOperation looks through to size a top level
+// directory. A directory tree bigger than this is treated as holding more than config.ProtectedDirSize,
+// so that sizing it can't turn into an unbounded number of queries.
+const guardMaxDirs = 500
+
+// Operations checked by GuardDestructiveOperation.
+const (
+	OpRemove = "remove"
+	OpRmdir  = "rmdir"
+	OpRename = "rename"
+)
+
+// GuardDestructiveOperation checks whether user may perform op (one of OpRemove, OpRmdir or OpRename) on path
+// in the project. The project root can never be removed or renamed. Deleting a top level directory holding
+// more than config.ProtectedDirSize bytes requires either that the user owns the project, or that the directory
+// contains a DeleteConfirmationFileName file. Nothing in, or containing, one of config.WriteOncePaths can be
+// removed or renamed (see CheckWriteOnce). Once the operation has been carried out, or has failed, its outcome
+// should be given to AuditDestructiveOperation.
+func GuardDestructiveOperation(fileStore store.FileStore, config *Config, user *mcmodel.User, project *mcmodel.Project, op, path string) error {
+	path = filepath.Clean("/" + path)
+	if !isGuardedPath(path) {
+		// Only the root and top level directories are guarded, apart from write-once paths.
+		return CheckWriteOnce(config, project.Slug, path)
+	}
+
+	return checkDestructiveOperation(fileStore, config, user, project, op, path)
+}
+
+// AuditDestructiveOperation emits an EventDestructiveOperation to events for op on path, when path is the
+// project's root or a top level directory, so that there is an audit trail of the attempts. err is the
+// outcome of the operation, whether it was rejected by GuardDestructiveOperation or failed afterwards; nil
+// is recorded as "allowed".
+func AuditDestructiveOperation(events EventSink, user *mcmodel.User, project *mcmodel.Project, op, path string, err error) {
+	path = filepath.Clean("/" + path)
+	if !isGuardedPath(path) {
+		return
+	}
+
+	outcome := "allowed"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	events.Emit(Event{
+		Type:      EventDestructiveOperation,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Path:      path,
+		Details: map[string]string{
+			"operation": op,
+			"user_id":   strconv.Itoa(user.ID),
+			"outcome":   outcome,
+		},
+	})
+}
+
+// isGuardedPath returns true for the project root and its top level directories.
+func isGuardedPath(path string) bool {
+	return filepath.Dir(path) == "/"
+}
+
+func checkDestructiveOperation(fileStore store.FileStore, config *Config, user *mcmodel.User, project *mcmodel.Project, op, path string) error {
+	switch {
+	case path == "/":
+		return ErrProjectRootProtected
+	case CheckWriteOnce(config, project.Slug, path) != nil:
+		return ErrWriteOnce
+	case op == OpRename || config.ProtectedDirSize <= 0 || project.OwnerID == user.ID:
+		return nil
+	}
+
+	dir, err := fileStore.GetFileByPath(project.ID, path)
+	if err != nil || !dir.IsDir() {
+		// Removing a missing directory, or a file, isn't guarded.
+		return nil
+	}
+
+	if _, err := fileStore.GetFileByPath(project.ID, filepath.Join(path, DeleteConfirmationFileName)); err == nil {
+		return nil
+	}
+
+	size, err := dirSizeUpTo(fileStore, project.ID, path, config.ProtectedDirSize)
+	switch {
+	case err != nil:
+		return err
+	case size > config.ProtectedDirSize:
+		return ErrDeleteNotConfirmed
+	default:
+		return nil
+	}
+}
+
+// dirSizeUpTo returns the total size of the files under the directory at path. It stops counting once
+// the size is over limit, or once guardMaxDirs directories have been listed, in which case a size over
+// limit is returned.
+func dirSizeUpTo(fileStore store.FileStore, projectID int, path string, limit int64) (int64, error) {
+	var size int64
+	dirs := []string{path}
+	for listed := 0; len(dirs) != 0; listed++ {
+		if listed == guardMaxDirs {
+			return limit + 1, nil
+		}
+
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		files, err := fileStore.ListDirectoryByPath(projectID, dir)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, f := range files {
+			if f.IsDir() {
+				dirs = append(dirs, filepath.Join(dir, f.Name))
+				continue
+			}
+
+			size += int64(f.Size)
+			if size > limit {
+				return size, nil
+			}
+		}
+	}
+
+	return size, nil
+}
@@ -0,0 +1,99 @@
+package mc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardDestructiveOperation(t *testing.T) {
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "big", Path: "/big", MimeType: "directory", DirectoryID: 1},
+		{ID: 3, ProjectID: 1, Name: "data.bin", MimeType: "application/octet-stream", DirectoryID: 2, Size: 2000},
+		{ID: 4, ProjectID: 1, Name: "small", Path: "/small", MimeType: "directory", DirectoryID: 1},
+		{ID: 5, ProjectID: 1, Name: "sub", Path: "/small/sub", MimeType: "directory", DirectoryID: 4},
+		{ID: 6, ProjectID: 1, Name: "a.txt", MimeType: "text/plain", DirectoryID: 5, Size: 10},
+		{ID: 7, ProjectID: 1, Name: "confirmed", Path: "/confirmed", MimeType: "directory", DirectoryID: 1},
+		{ID: 8, ProjectID: 1, Name: "data.bin", MimeType: "application/octet-stream", DirectoryID: 7, Size: 2000},
+		{ID: 9, ProjectID: 1, Name: DeleteConfirmationFileName, MimeType: "text/plain", DirectoryID: 7},
+	}
+
+	owner := &mcmodel.User{ID: 1}
+	member := &mcmodel.User{ID: 2}
+	project := &mcmodel.Project{ID: 1, OwnerID: owner.ID}
+	config := &Config{ProtectedDirSize: 1000}
+
+	tests := []struct {
+		user        *mcmodel.User
+		op          string
+		path        string
+		expectedErr error
+	}{
+		{member, OpRmdir, "/", ErrProjectRootProtected},
+		{owner, OpRename, "/", ErrProjectRootProtected},
+		{member, OpRmdir, "/big", ErrDeleteNotConfirmed},
+		{owner, OpRmdir, "/big", nil},
+		{member, OpRename, "/big", nil},
+		{member, OpRmdir, "/small", nil},
+		{member, OpRmdir, "/confirmed", nil},
+		{member, OpRmdir, "/big/nested", nil},
+	}
+
+	for _, test := range tests {
+		err := GuardDestructiveOperation(store.NewFakeFileStore(files), config, test.user, project, test.op, test.path)
+		if test.expectedErr == nil {
+			require.NoError(t, err, "%s of %s by user %d", test.op, test.path, test.user.ID)
+		} else {
+			require.ErrorIs(t, err, test.expectedErr, "%s of %s by user %d", test.op, test.path, test.user.ID)
+		}
+	}
+}
+
+func TestAuditDestructiveOperation(t *testing.T) {
+	user := &mcmodel.User{ID: 2}
+	project := &mcmodel.Project{ID: 1}
+
+	// The audit records the outcome the operation actually had, not just whether the guard allowed it.
+	events := &eventCollector{}
+	AuditDestructiveOperation(events, user, project, OpRmdir, "/big", errors.New("unsupported command: 'Rmdir'"))
+	AuditDestructiveOperation(events, user, project, OpRename, "/small", nil)
+	AuditDestructiveOperation(events, user, project, OpRmdir, "/big/nested", nil)
+
+	require.Len(t, events.events, 2)
+	require.Equal(t, EventDestructiveOperation, events.events[0].Type)
+	require.Equal(t, "/big", events.events[0].Path)
+	require.Equal(t, "unsupported command: 'Rmdir'", events.events[0].Details["outcome"])
+	require.Equal(t, "allowed", events.events[1].Details["outcome"])
+}
+
+func TestDirSizeUpToIsBounded(t *testing.T) {
+	// A chain of directories deeper than guardMaxDirs, with a single small file at the bottom.
+	files := []mcmodel.File{{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}}
+	path := ""
+	for i := 2; i <= guardMaxDirs+2; i++ {
+		path += "/d"
+		files = append(files, mcmodel.File{ID: i, ProjectID: 1, Name: "d", Path: path, MimeType: "directory", DirectoryID: i - 1})
+	}
+	files = append(files, mcmodel.File{ID: len(files) + 1, ProjectID: 1, Name: "a.txt", MimeType: "text/plain", DirectoryID: len(files), Size: 1})
+
+	fileStore := &countingListStore{FakeFileStore: store.NewFakeFileStore(files)}
+	size, err := dirSizeUpTo(fileStore, 1, "/d", 1000)
+	require.NoError(t, err)
+	require.Greater(t, size, int64(1000), "A tree too big to size is treated as over the limit")
+	require.Equal(t, guardMaxDirs, fileStore.lists)
+}
+
+// countingListStore counts the directories listed.
+type countingListStore struct {
+	*store.FakeFileStore
+	lists int
+}
+
+func (s *countingListStore) ListDirectoryByPath(projectID int, path string) ([]mcmodel.File, error) {
+	s.lists++
+	return s.FakeFileStore.ListDirectoryByPath(projectID, path)
+}
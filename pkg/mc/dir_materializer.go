@@ -0,0 +1,119 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// dirMemoTTL is how long a DirMaterializer remembers that a directory exists. It only needs to outlast a
+// burst of uploads, and keeping it short limits how long a directory removed by another session, such
+// as in the web application, is still used.
+const dirMemoTTL = time.Minute
+
+// DirMaterializer creates the directories that a session's uploads are written to, each only once. A
+// recursive upload writes many files at once into the same few directories, and without it each file
+// would find or create every directory in its path in the project, with GetOrCreateDirPath, and in the
+// storage under the mcfs root, with os.MkdirAll. Concurrent requests for the same directory wait for the
+// one creating it, and later requests use the directory it created. Failures aren't remembered, so the
+// next request tries again.
+type DirMaterializer struct {
+	mu    sync.Mutex
+	calls map[string]*dirCall
+}
+
+// dirCall is the creation of a directory, which is done once done is closed.
+type dirCall struct {
+	done    chan struct{}
+	dir     *mcmodel.File
+	err     error
+	created time.Time
+}
+
+func NewDirMaterializer() *DirMaterializer {
+	return &DirMaterializer{calls: make(map[string]*dirCall)}
+}
+
+// ProjectDir returns the directory at path in the project, creating it, and the directories above it,
+// when they don't exist. Each directory in the path is created in turn, so that uploads to different
+// directories below the same parent don't both create the parent.
+func (m *DirMaterializer) ProjectDir(fileStore store.FileStore, projectID, ownerID int, path string) (*mcmodel.File, error) {
+	path = filepath.Join("/", path)
+	prefixes := []string{"/"}
+	if path != "/" {
+		parts := strings.Split(path[1:], "/")
+		for i := range parts {
+			prefixes = append(prefixes, "/"+strings.Join(parts[:i+1], "/"))
+		}
+	}
+
+	var dir *mcmodel.File
+	for _, prefix := range prefixes {
+		var err error
+		dir, err = m.do(fmt.Sprintf("project:%d:%s", projectID, prefix), func() (*mcmodel.File, error) {
+			return fileStore.GetOrCreateDirPath(projectID, ownerID, prefix)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each caller gets its own copy of the directory.
+	d := *dir
+	return &d, nil
+}
+
+// StorageDir creates dir, a directory under the mcfs root that file data is written to, with
+// os.MkdirAll, giving up after timeout.
+func (m *DirMaterializer) StorageDir(ctx context.Context, timeout time.Duration, dir string) error {
+	_, err := m.do("storage:"+dir, func() (*mcmodel.File, error) {
+		return nil, RunWithTimeout(ctx, timeout, func() error {
+			return os.MkdirAll(dir, 0777)
+		})
+	})
+
+	return err
+}
+
+// do runs create for key, unless it has already succeeded within the dirMemoTTL, or is running, in
+// which case it waits for it to finish.
+func (m *DirMaterializer) do(key string, create func() (*mcmodel.File, error)) (*mcmodel.File, error) {
+	m.mu.Lock()
+	if call, ok := m.calls[key]; ok {
+		select {
+		case <-call.done:
+			if time.Since(call.created) < dirMemoTTL {
+				m.mu.Unlock()
+				return call.dir, nil
+			}
+		default:
+			m.mu.Unlock()
+			<-call.done
+			return call.dir, call.err
+		}
+	}
+
+	call := &dirCall{done: make(chan struct{})}
+	m.calls[key] = call
+	m.mu.Unlock()
+
+	call.dir, call.err = create()
+	call.created = time.Now()
+
+	m.mu.Lock()
+	if call.err != nil {
+		delete(m.calls, key)
+	}
+	m.mu.Unlock()
+	close(call.done)
+
+	return call.dir, call.err
+}
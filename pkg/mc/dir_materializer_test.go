@@ -0,0 +1,105 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// dirCountingFileStore counts the calls to GetOrCreateDirPath for each path, and fails those in fail.
+type dirCountingFileStore struct {
+	store.FileStore
+	mu    sync.Mutex
+	calls map[string]int
+	fail  map[string]bool
+}
+
+func (s *dirCountingFileStore) GetOrCreateDirPath(projectID, ownerID int, path string) (*mcmodel.File, error) {
+	s.mu.Lock()
+	s.calls[path]++
+	fail := s.fail[path]
+	s.mu.Unlock()
+
+	// Give concurrent callers time to pile up.
+	time.Sleep(5 * time.Millisecond)
+	if fail {
+		return nil, errors.New("unable to create " + path)
+	}
+
+	return s.FileStore.GetOrCreateDirPath(projectID, ownerID, path)
+}
+
+func TestDirMaterializer_ProjectDir(t *testing.T) {
+	stores, err := NewOfflineStores(t.TempDir(), 1, "demo")
+	require.NoError(t, err)
+	project, err := stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+
+	fileStore := &dirCountingFileStore{FileStore: stores.FileStore, calls: make(map[string]int), fail: map[string]bool{"/bad": true}}
+	dirs := NewDirMaterializer()
+
+	// A recursive upload writing many files at once into overlapping directories.
+	paths := []string{"/a/b/c", "/a/b/d", "/a/b", "/a/e", "/a/b/c", "/a/b/d"}
+	var wg sync.WaitGroup
+	created := make(chan string, 10*len(paths))
+	for i := 0; i < 10; i++ {
+		for _, path := range paths {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				if dir, err := dirs.ProjectDir(fileStore, project.ID, 1, path); err == nil {
+					created <- dir.Path
+				}
+			}(path)
+		}
+	}
+	wg.Wait()
+	close(created)
+
+	var createdPaths, expected []string
+	for path := range created {
+		createdPaths = append(createdPaths, path)
+	}
+	for i := 0; i < 10; i++ {
+		expected = append(expected, paths...)
+	}
+	require.ElementsMatch(t, expected, createdPaths)
+
+	require.Equal(t, map[string]int{"/": 1, "/a": 1, "/a/b": 1, "/a/b/c": 1, "/a/b/d": 1, "/a/e": 1}, fileStore.calls)
+
+	// Failures aren't remembered.
+	_, err = dirs.ProjectDir(fileStore, project.ID, 1, "/bad/x")
+	require.Error(t, err)
+	_, err = dirs.ProjectDir(fileStore, project.ID, 1, "/bad/x")
+	require.Error(t, err)
+	require.Equal(t, 2, fileStore.calls["/bad"])
+	require.Zero(t, fileStore.calls["/bad/x"])
+}
+
+func TestDirMaterializer_StorageDir(t *testing.T) {
+	root := t.TempDir()
+	dirs := NewDirMaterializer()
+
+	dir := filepath.Join(root, "ab", "cd")
+	for i := 0; i < 5; i++ {
+		require.NoError(t, dirs.StorageDir(context.Background(), time.Second, dir))
+	}
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	// Once created the directory isn't created again, even if it has been removed.
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, dirs.StorageDir(context.Background(), time.Second, dir))
+	_, err = os.Stat(dir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
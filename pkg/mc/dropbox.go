@@ -0,0 +1,101 @@
+package mc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrDropBoxOnly is returned when an instrument account tries to do anything other than upload into its
+// drop boxes. It wraps os.ErrPermission.
+var ErrDropBoxOnly = fmt.Errorf("%w: instrument accounts can only upload into their drop boxes", os.ErrPermission)
+
+// DropBoxAccess is the kind of access an operation needs, for CheckDropBoxAccess.
+type DropBoxAccess int
+
+const (
+	// DropBoxRead is reading a file, or listing a directory.
+	DropBoxRead DropBoxAccess = iota
+
+	// DropBoxStat is getting the attributes of a single file or directory.
+	DropBoxStat
+
+	// DropBoxWrite is uploading a file or creating a directory, or any other change.
+	DropBoxWrite
+)
+
+// ParseDropBoxes parses a comma separated list of drop boxes of the form user-slug:project-slug:/path,
+// for example "xrd-instrument:my-project:/incoming/xrd". A user with drop boxes is an instrument account.
+// A user can have more than one drop box.
+func ParseDropBoxes(dropBoxes string) (map[string][]PathRule, error) {
+	rules := make(map[string][]PathRule)
+	for _, dropBox := range strings.Split(dropBoxes, ",") {
+		dropBox = strings.TrimSpace(dropBox)
+		if dropBox == "" {
+			continue
+		}
+
+		i := strings.Index(dropBox, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid drop box '%s', expected user-slug:project-slug:/path", dropBox)
+		}
+
+		pathRules, err := ParsePathRules(dropBox[i+1:])
+		if err != nil || len(pathRules) != 1 || pathRules[0].ProjectSlug == "*" {
+			return nil, fmt.Errorf("invalid drop box '%s', expected user-slug:project-slug:/path", dropBox)
+		}
+
+		rules[dropBox[:i]] = append(rules[dropBox[:i]], pathRules[0])
+	}
+
+	return rules, nil
+}
+
+// IsInstrumentAccount returns true if the user with userSlug is restricted to its drop boxes. Users
+// logged in with a scoped credential, such as a guest or a token, are restricted too.
+func (c *Config) IsInstrumentAccount(userSlug string) bool {
+	_, ok := c.DropBoxes[userSlug]
+	return ok || c.Scopes.IsScoped(userSlug)
+}
+
+// CheckDropBoxAccess returns ErrDropBoxOnly if the user with userSlug is an instrument account and isn't
+// allowed the access to path in the project with projectSlug. Instrument accounts can write anywhere in
+// their drop boxes, but can't read or list anything, so that a compromised instrument PC can't be used
+// to get at a project's data. They can get the attributes of the paths in their drop boxes, and of the
+// directories leading to them, including the server root (a blank projectSlug), since clients such as
+// sftp check the upload directory exists first. Users logged in with a scoped credential are checked
+// against its scope instead (see Scope.Check). Other users are always allowed.
+func (c *Config) CheckDropBoxAccess(userSlug, projectSlug, path string, access DropBoxAccess) error {
+	if scope, ok := c.Scopes.Scope(userSlug); ok {
+		return scope.Check(projectSlug, path, access)
+	}
+
+	rules, ok := c.DropBoxes[userSlug]
+	if !ok {
+		return nil
+	}
+
+	if projectSlug == "" && access == DropBoxStat {
+		// The server root leads to every drop box.
+		return nil
+	}
+
+	path = filepath.Clean("/" + path)
+	for _, rule := range rules {
+		switch {
+		case access == DropBoxRead:
+		case rule.Matches(projectSlug, path):
+			return nil
+		case access == DropBoxStat && leadsTo(rule, projectSlug, path):
+			return nil
+		}
+	}
+
+	return ErrDropBoxOnly
+}
+
+// leadsTo returns true if path in the project with projectSlug is a directory leading to rule's Prefix.
+func leadsTo(rule PathRule, projectSlug, path string) bool {
+	return rule.ProjectSlug == projectSlug && (path == "/" || strings.HasPrefix(rule.Prefix, path+"/"))
+}
@@ -0,0 +1,68 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDropBoxes(t *testing.T) {
+	dropBoxes, err := ParseDropBoxes("xrd:proj:/incoming/xrd, xrd:other:/raw/, sem:proj:/incoming/sem")
+	require.Nil(t, err)
+	require.Equal(t, map[string][]PathRule{
+		"xrd": {{"proj", "/incoming/xrd"}, {"other", "/raw"}},
+		"sem": {{"proj", "/incoming/sem"}},
+	}, dropBoxes)
+
+	for _, invalid := range []string{"xrd", ":proj:/raw", "xrd:proj", "xrd:*:/raw", "xrd:proj:raw"} {
+		_, err := ParseDropBoxes(invalid)
+		require.NotNil(t, err, "ParseDropBoxes should have failed for '%s'", invalid)
+	}
+}
+
+func TestConfig_CheckDropBoxAccess(t *testing.T) {
+	config := &Config{
+		DropBoxes: map[string][]PathRule{"xrd": {{"proj", "/incoming/xrd"}}},
+	}
+
+	tests := []struct {
+		user        string
+		projectSlug string
+		path        string
+		access      DropBoxAccess
+		allowed     bool
+	}{
+		{"xrd", "proj", "/incoming/xrd/run1/data.raw", DropBoxWrite, true},
+		{"xrd", "proj", "/incoming/xrd", DropBoxWrite, true},
+		{"xrd", "proj", "/incoming/xrd/../other.raw", DropBoxWrite, false},
+		{"xrd", "proj", "/incoming/xrd2/data.raw", DropBoxWrite, false},
+		{"xrd", "other", "/incoming/xrd/data.raw", DropBoxWrite, false},
+		{"xrd", "proj", "/incoming/xrd/data.raw", DropBoxRead, false},
+		{"xrd", "proj", "/incoming/xrd", DropBoxRead, false},
+		{"xrd", "proj", "/incoming/xrd/data.raw", DropBoxStat, true},
+		{"xrd", "proj", "/incoming", DropBoxStat, true},
+		{"xrd", "proj", "/", DropBoxStat, true},
+		{"xrd", "", "/", DropBoxStat, true},
+		{"xrd", "", "/", DropBoxRead, false},
+		{"xrd", "proj", "/raw", DropBoxStat, false},
+		{"xrd", "other", "/", DropBoxStat, false},
+		{"xrd", "proj", "/incoming", DropBoxWrite, false},
+		{"alice", "proj", "/raw/data.raw", DropBoxRead, true},
+		{"alice", "proj", "/raw/data.raw", DropBoxWrite, true},
+	}
+
+	for _, test := range tests {
+		err := config.CheckDropBoxAccess(test.user, test.projectSlug, test.path, test.access)
+		if test.allowed {
+			require.Nil(t, err, "%s should be allowed access %d to %s:%s", test.user, test.access, test.projectSlug, test.path)
+		} else {
+			require.True(t, errors.Is(err, os.ErrPermission), "%s should be denied access %d to %s:%s", test.user, test.access, test.projectSlug, test.path)
+		}
+	}
+
+	config.AllowProjectCreation = true
+	require.False(t, config.CanCreateProjects("xrd"))
+	require.True(t, config.CanCreateProjects("alice"))
+}
@@ -0,0 +1,851 @@
+package mc
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Env reads mc-sshd's settings from environment variables. A setting that isn't set keeps its default.
+// The problems with the settings that are set are collected rather than stopping at the first one, so
+// that they can all be reported at once. See Errors.
+type Env struct {
+	lookup func(name string) (string, bool)
+	errors []error
+}
+
+// NewEnv returns an Env that reads the settings with lookup, which is os.LookupEnv for the server.
+func NewEnv(lookup func(name string) (string, bool)) *Env {
+	return &Env{lookup: lookup}
+}
+
+// Errors returns the problems with the settings read so far.
+func (e *Env) Errors() []error {
+	return e.errors
+}
+
+// Errorf records a problem with the settings.
+func (e *Env) Errorf(format string, args ...interface{}) {
+	e.errors = append(e.errors, fmt.Errorf(format, args...))
+}
+
+// Lookup returns the value of the setting name, and whether it is set, even if it is blank.
+func (e *Env) Lookup(name string) (string, bool) {
+	return e.lookup(name)
+}
+
+// String returns the value of the setting name, or "" when it isn't set.
+func (e *Env) String(name string) string {
+	value, _ := e.lookup(name)
+	return value
+}
+
+// Required returns the value of the setting name, and records a problem when it isn't set or is blank.
+func (e *Env) Required(name string) string {
+	value := e.String(name)
+	if value == "" {
+		e.Errorf("%s is not set or blank", name)
+	}
+
+	return value
+}
+
+// List returns the comma separated values of the setting name, leaving out blank values. It returns nil
+// when the setting isn't set.
+func (e *Env) List(name string) []string {
+	var list []string
+	for _, value := range strings.Split(e.String(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
+
+// Int sets value to the setting name when it is set. A value that isn't a number, or is less than min,
+// is a problem.
+func (e *Env) Int(name string, value *int, min int) {
+	s := e.String(name)
+	if s == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(s)
+	switch {
+	case err != nil:
+		e.Errorf("%s (%s) is not a valid number: %s", name, s, err)
+	case n < min:
+		e.Errorf("%s (%s) is not a valid number, it must be at least %d", name, s, min)
+	default:
+		*value = n
+	}
+}
+
+// Int64 sets value to the setting name when it is set. A value that isn't a number, or is less than
+// min, is a problem.
+func (e *Env) Int64(name string, value *int64, min int64) {
+	s := e.String(name)
+	if s == "" {
+		return
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	switch {
+	case err != nil:
+		e.Errorf("%s (%s) is not a valid number: %s", name, s, err)
+	case n < min:
+		e.Errorf("%s (%s) is not a valid number, it must be at least %d", name, s, min)
+	default:
+		*value = n
+	}
+}
+
+// Duration sets value to the setting name, such as 90s, when it is set. A value that isn't a duration, or
+// is less than min, is a problem.
+func (e *Env) Duration(name string, value *time.Duration, min time.Duration) {
+	s := e.String(name)
+	if s == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(s)
+	switch {
+	case err != nil:
+		e.Errorf("%s (%s) is not a valid duration: %s", name, s, err)
+	case d < min:
+		e.Errorf("%s (%s) is not a valid duration, it must be at least %s", name, s, min)
+	default:
+		*value = d
+	}
+}
+
+// Bool sets value to the setting name, such as true, when it is set. A value that isn't a boolean is a
+// problem.
+func (e *Env) Bool(name string, value *bool) {
+	s := e.String(name)
+	if s == "" {
+		return
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		e.Errorf("%s (%s) is not a valid boolean: %s", name, s, err)
+		return
+	}
+
+	*value = b
+}
+
+// Parse calls parse with the value of the setting name when it is set. The error parse returns is a
+// problem.
+func (e *Env) Parse(name string, parse func(value string) error) {
+	s := e.String(name)
+	if s == "" {
+		return
+	}
+
+	if err := parse(s); err != nil {
+		e.Errorf("%s (%s) is invalid: %s", name, s, err)
+	}
+}
+
+// ParseFile reads the file named by the setting name when it is set, and calls parse with its contents.
+// A file that can't be read, or that parse returns an error for, is a problem.
+func (e *Env) ParseFile(name string, parse func(data []byte) error) {
+	e.Parse(name, func(path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return parse(data)
+	})
+}
+
+// LoadEnv sets the settings of c from env, the MCSSHD_* settings of the handlers. The settings that
+// aren't set keep their values, usually those from DefaultConfig.
+func (c *Config) LoadEnv(env *Env) {
+	env.Duration("MCSSHD_DB_TIMEOUT", &c.DBTimeout, 0)
+	env.Duration("MCSSHD_FS_TIMEOUT", &c.FSTimeout, 0)
+	env.Int("MCSSHD_MAX_PATH_DEPTH", &c.MaxPathDepth, 0)
+	env.Int("MCSSHD_MAX_NAME_LENGTH", &c.MaxNameLength, 0)
+	env.Int("MCSSHD_MAX_PATH_LENGTH", &c.MaxPathLength, 0)
+
+	// MCSSHD_IGNORE_PATTERNS is a comma separated list of patterns that replaces the default ignore
+	// patterns.
+	if ignorePatterns := env.List("MCSSHD_IGNORE_PATTERNS"); len(ignorePatterns) != 0 {
+		c.IgnorePatterns = ignorePatterns
+	}
+
+	// MCSSHD_SANITIZE_POLICY is how invalid file and directory names are handled: off, reject (the
+	// default) or transliterate.
+	if sanitizePolicy := env.String("MCSSHD_SANITIZE_POLICY"); sanitizePolicy != "" {
+		switch policy := SanitizePolicy(sanitizePolicy); policy {
+		case SanitizeOff, SanitizeReject, SanitizeTransliterate:
+			c.SanitizePolicy = policy
+		default:
+			env.Errorf("MCSSHD_SANITIZE_POLICY (%s) must be one of off, reject or transliterate", sanitizePolicy)
+		}
+	}
+
+	// MCSSHD_NO_OVERWRITE_PATHS and MCSSHD_WRITE_ONCE_PATHS are comma separated lists of
+	// project-slug:/path rules, where a project slug of * matches every project.
+	env.Parse("MCSSHD_NO_OVERWRITE_PATHS", func(value string) (err error) {
+		c.NoOverwritePaths, err = ParsePathRules(value)
+		return err
+	})
+
+	env.Parse("MCSSHD_WRITE_ONCE_PATHS", func(value string) (err error) {
+		c.WriteOncePaths, err = ParsePathRules(value)
+		return err
+	})
+
+	// MCSSHD_FILE_MODES is a comma separated list of project:slug=mode, user:slug=mode and *=mode rules
+	// for the permissions reported for files and directories, which are otherwise reported as 0777.
+	env.Parse("MCSSHD_FILE_MODES", func(value string) (err error) {
+		c.ModeRules, err = ParseModeRules(value)
+		return err
+	})
+
+	// MCSSHD_DROPBOXES is a comma separated list of user-slug:project-slug:/path drop boxes. Each user
+	// listed is an instrument account that can only upload into its drop boxes.
+	env.Parse("MCSSHD_DROPBOXES", func(value string) (err error) {
+		c.DropBoxes, err = ParseDropBoxes(value)
+		return err
+	})
+
+	// MCSSHD_PROJECT_QUOTA is the size, in bytes, each project may use, and MCSSHD_PROJECT_QUOTAS
+	// overrides it for individual projects.
+	env.Int64("MCSSHD_PROJECT_QUOTA", &c.ProjectQuota, 0)
+	env.Parse("MCSSHD_PROJECT_QUOTAS", func(value string) (err error) {
+		c.ProjectQuotas, err = ParseProjectQuotas(value)
+		return err
+	})
+
+	// MCSSHD_ALLOW_PROJECT_CREATION=true lets users create projects with mkdir at the root. It can be
+	// limited to the users in MCSSHD_PROJECT_CREATORS, a comma separated list of user slugs.
+	env.Bool("MCSSHD_ALLOW_PROJECT_CREATION", &c.AllowProjectCreation)
+	if projectCreators := env.List("MCSSHD_PROJECT_CREATORS"); len(projectCreators) != 0 {
+		c.ProjectCreators = projectCreators
+	}
+
+	env.Bool("MCSSHD_LIST_DOT_ENTRIES", &c.ListDotEntries)
+	env.Bool("MCSSHD_HIDE_INTERNAL_FILES", &c.HideInternalFiles)
+	env.Bool("MCSSHD_SESSION_SUMMARY", &c.PrintSessionSummary)
+	env.Int64("MCSSHD_SCP_RESUME_MIN_SIZE", &c.SCPResumeMinSize, 0)
+	env.Int64("MCSSHD_SCP_UNCHANGED_CHECK_LIMIT", &c.SCPUnchangedCheckLimit, 0)
+
+	// MCSSHD_VERIFY_READS checks downloads against the checksums of their files: off, log or fail.
+	if verifyReads := env.String("MCSSHD_VERIFY_READS"); verifyReads != "" {
+		switch mode := ReadVerification(verifyReads); mode {
+		case ReadVerifyOff, ReadVerifyLog, ReadVerifyFail:
+			c.VerifyReads = mode
+		default:
+			env.Errorf("MCSSHD_VERIFY_READS (%s) must be one of off, log or fail", verifyReads)
+		}
+	}
+
+	env.Int("MCSSHD_READ_AHEAD_SIZE", &c.ReadAheadSize, 0)
+	env.Int("MCSSHD_READ_AHEAD_FILES", &c.ReadAheadFiles, 0)
+	env.Int("MCSSHD_MAX_LIST_ENTRIES", &c.MaxListEntries, 0)
+	env.Int64("MCSSHD_PROTECTED_DIR_SIZE", &c.ProtectedDirSize, 0)
+	env.Int("MCSSHD_WRITE_COALESCE_SIZE", &c.WriteCoalesceSize, 0)
+	env.Int64("MCSSHD_SESSION_WRITE_BUDGET", &c.SessionWriteBudget, 0)
+	env.Bool("MCSSHD_READ_ONLY", &c.ReadOnly)
+
+	// The directories that uploaded archives are extracted in are set by each project's admins with mc
+	// project set-extract-paths. These limit what a single archive can extract.
+	env.Int64("MCSSHD_MAX_ARCHIVE_SIZE", &c.MaxArchiveSize, 0)
+	env.Int("MCSSHD_MAX_ARCHIVE_ENTRIES", &c.MaxArchiveEntries, 0)
+
+	// MCSSHD_TRACK_ACCESS_TIMES=true records when files are read, and reports it as their access time. It
+	// needs the download counts (see MetricsConfig.FileAccessFlushInterval).
+	env.Bool("MCSSHD_TRACK_ACCESS_TIMES", &c.TrackAccessTimes)
+}
+
+// ServerConfig is where the server listens, and how it treats the connections made to it.
+type ServerConfig struct {
+	// Host, Port and HostKeyPath are MCSSHD_HOST, MCSSHD_PORT and MCSSHD_HOST_KEY_PATH, which are required.
+	Host        string
+	Port        string
+	HostKeyPath string
+
+	// IdleSessionTimeout, MCSSHD_IDLE_SESSION_TIMEOUT, closes SFTP sessions, such as idle sshfs mounts,
+	// that haven't made a request for this long. 0 leaves idle sessions open.
+	IdleSessionTimeout time.Duration
+
+	// KeepaliveInterval, MCSSHD_KEEPALIVE_INTERVAL, sends a keepalive request to each client this often,
+	// and closes the connections that miss KeepaliveMaxMissed, MCSSHD_KEEPALIVE_MAX_MISSED, requests in a
+	// row. 0 sends no keepalives.
+	KeepaliveInterval  time.Duration
+	KeepaliveMaxMissed int
+
+	// MaxSessionsPerUser, MCSSHD_MAX_SESSIONS_PER_USER, is the number of sessions each user can have at
+	// once. 0 means unlimited.
+	MaxSessionsPerUser int64
+
+	// FileWatchBuffer, MCSSHD_FILE_WATCH_BUFFER, lets clients wait for new files, keeping this many recently
+	// uploaded files for them. 0 turns off watching.
+	FileWatchBuffer int
+
+	// WelcomeSkeleton, loaded from the directory MCSSHD_WELCOME_SKELETON, is created in a user's default
+	// project the first time they log in with SFTP. See WelcomeSkeleton.
+	WelcomeSkeleton *WelcomeSkeleton
+}
+
+// LoadServerConfig loads the ServerConfig from env.
+func LoadServerConfig(env *Env) ServerConfig {
+	c := ServerConfig{
+		Port:               env.Required("MCSSHD_PORT"),
+		Host:               env.Required("MCSSHD_HOST"),
+		HostKeyPath:        env.Required("MCSSHD_HOST_KEY_PATH"),
+		KeepaliveMaxMissed: DefaultKeepaliveMaxMissed,
+	}
+
+	if c.HostKeyPath != "" {
+		if _, err := os.Stat(c.HostKeyPath); err != nil {
+			env.Errorf("MCSSHD_HOST_KEY_PATH file (%s) does not exist: %s", c.HostKeyPath, err)
+		}
+	}
+
+	env.Duration("MCSSHD_IDLE_SESSION_TIMEOUT", &c.IdleSessionTimeout, 0)
+	env.Duration("MCSSHD_KEEPALIVE_INTERVAL", &c.KeepaliveInterval, 0)
+	env.Int("MCSSHD_KEEPALIVE_MAX_MISSED", &c.KeepaliveMaxMissed, 1)
+	env.Int64("MCSSHD_MAX_SESSIONS_PER_USER", &c.MaxSessionsPerUser, 0)
+	env.Int("MCSSHD_FILE_WATCH_BUFFER", &c.FileWatchBuffer, 0)
+	env.Parse("MCSSHD_WELCOME_SKELETON", func(value string) (err error) {
+		c.WelcomeSkeleton, err = LoadWelcomeSkeleton(value)
+		return err
+	})
+
+	return c
+}
+
+// RedisConfig is the Redis server that the instances running together share state, such as write locks
+// and session counts, through. Redis is optional, and only needed to run more than one instance.
+type RedisConfig struct {
+	// Addr, Password and DB are MCSSHD_REDIS_ADDR, MCSSHD_REDIS_PASSWORD and MCSSHD_REDIS_DB. Redis isn't
+	// used when Addr is blank.
+	Addr     string
+	Password string
+	DB       int
+}
+
+// LoadRedisConfig loads the RedisConfig from env.
+func LoadRedisConfig(env *Env) RedisConfig {
+	c := RedisConfig{
+		Addr:     env.String("MCSSHD_REDIS_ADDR"),
+		Password: env.String("MCSSHD_REDIS_PASSWORD"),
+	}
+
+	env.Int("MCSSHD_REDIS_DB", &c.DB, 0)
+	return c
+}
+
+// CacheConfig is how long lookups are cached in memory, or in Redis when it is configured.
+type CacheConfig struct {
+	// ProjectTTL, MCSSHD_PROJECT_CACHE_TTL, is how long projects are cached. It defaults to 5 minutes.
+	ProjectTTL time.Duration
+
+	// ListingTTL, MCSSHD_LISTING_CACHE_TTL, caches directory listings and file lookups, so that the many
+	// sshfs mounts of a project share them. Changes made outside of this instance can take this long to
+	// show up. 0, the default, turns off caching listings.
+	ListingTTL time.Duration
+}
+
+// LoadCacheConfig loads the CacheConfig from env.
+func LoadCacheConfig(env *Env) CacheConfig {
+	c := CacheConfig{ProjectTTL: 5 * time.Minute}
+	env.Duration("MCSSHD_PROJECT_CACHE_TTL", &c.ProjectTTL, 0)
+	env.Duration("MCSSHD_LISTING_CACHE_TTL", &c.ListingTTL, 0)
+	return c
+}
+
+// The values of DatabaseConfig.SchemaMismatch.
+const (
+	SchemaMismatchRefuse   = "refuse"
+	SchemaMismatchReadOnly = "read-only"
+	SchemaMismatchIgnore   = "ignore"
+)
+
+// DatabaseConfig is the database mc-sshd uses, or the users and projects it keeps in memory instead.
+type DatabaseConfig struct {
+	// Driver, MCSSHD_DB_DRIVER, selects the database, by default mysql, the Materials Commons database
+	// described by the MCDB_* settings. A small deployment can instead use sqlite, in a build made with
+	// -tags sqlite, with DSN, MCSSHD_DB_DSN, the path of the database file. mc-sshd creates the tables of
+	// a SQLite database itself, and add-user adds its users.
+	Driver string
+	DSN    string
+
+	// ReadDSN, MCSSHD_DB_READ_DSN, is an optional read replica that read heavy queries are sent to.
+	ReadDSN string
+
+	// SchemaMismatch, MCSSHD_SCHEMA_MISMATCH, is what to do when the database is missing tables or columns
+	// this build expects: SchemaMismatchRefuse (the default) to exit, SchemaMismatchReadOnly to run
+	// read-only, or SchemaMismatchIgnore to not check. Read-only only applies to the server, the
+	// maintenance commands such as repair write regardless. See CheckSchema.
+	SchemaMismatch string
+
+	// ReconcileInterval, MCSSHD_RECONCILE_INTERVAL, turns on the periodic cleanup of interrupted uploads.
+	// When running multiple instances it only needs to be set on one of them.
+	ReconcileInterval time.Duration
+
+	// OfflineUsers and OfflinePasswords, from MCSSHD_OFFLINE_USERS, a comma separated list of user:password
+	// pairs, run the server without a database, with the users that can log in. OfflineProjects,
+	// MCSSHD_OFFLINE_PROJECTS, are the slugs of the projects, by default demo. The projects are owned by
+	// the first user, but every user can use them. See NewOfflineStores.
+	OfflineUsers     []string
+	OfflinePasswords []string
+	OfflineProjects  []string
+}
+
+// LoadDatabaseConfig loads the DatabaseConfig from env.
+func LoadDatabaseConfig(env *Env) DatabaseConfig {
+	c := DatabaseConfig{
+		Driver:          "mysql",
+		DSN:             env.String("MCSSHD_DB_DSN"),
+		ReadDSN:         env.String("MCSSHD_DB_READ_DSN"),
+		SchemaMismatch:  SchemaMismatchRefuse,
+		OfflineProjects: []string{"demo"},
+	}
+
+	if driver := env.String("MCSSHD_DB_DRIVER"); driver != "" {
+		c.Driver = driver
+	}
+
+	if c.Driver != "mysql" && c.DSN == "" {
+		env.Errorf("MCSSHD_DB_DSN must be set when MCSSHD_DB_DRIVER is %s", c.Driver)
+	}
+
+	if schemaMismatch := env.String("MCSSHD_SCHEMA_MISMATCH"); schemaMismatch != "" {
+		switch schemaMismatch {
+		case SchemaMismatchRefuse, SchemaMismatchReadOnly, SchemaMismatchIgnore:
+			c.SchemaMismatch = schemaMismatch
+		default:
+			env.Errorf("MCSSHD_SCHEMA_MISMATCH (%s) must be refuse, read-only or ignore", schemaMismatch)
+		}
+	}
+
+	env.Duration("MCSSHD_RECONCILE_INTERVAL", &c.ReconcileInterval, 0)
+
+	for _, pair := range env.List("MCSSHD_OFFLINE_USERS") {
+		i := strings.Index(pair, ":")
+		if i <= 0 || i == len(pair)-1 {
+			env.Errorf("MCSSHD_OFFLINE_USERS entry (%s) must be user:password", pair)
+			continue
+		}
+		c.OfflineUsers = append(c.OfflineUsers, strings.TrimSpace(pair[:i]))
+		c.OfflinePasswords = append(c.OfflinePasswords, pair[i+1:])
+	}
+
+	if offlineProjects := env.List("MCSSHD_OFFLINE_PROJECTS"); len(offlineProjects) != 0 {
+		c.OfflineProjects = offlineProjects
+	}
+
+	return c
+}
+
+// GeoIPConfig is how connections are located, and which countries they are accepted from.
+type GeoIPConfig struct {
+	// DBs, MCSSHD_GEOIP_DBS, are MaxMind DB files, such as GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb,
+	// used to add the country and autonomous system of the client to login events.
+	DBs []string
+
+	// CountryFilter is MCSSHD_GEOIP_ALLOW_COUNTRIES and MCSSHD_GEOIP_DENY_COUNTRIES, the countries to
+	// accept or reject connections from. It needs DBs.
+	CountryFilter CountryFilter
+}
+
+// LoadGeoIPConfig loads the GeoIPConfig from env.
+func LoadGeoIPConfig(env *Env) GeoIPConfig {
+	c := GeoIPConfig{
+		DBs: env.List("MCSSHD_GEOIP_DBS"),
+		CountryFilter: CountryFilter{
+			Allow: ParseCountryList(env.String("MCSSHD_GEOIP_ALLOW_COUNTRIES")),
+			Deny:  ParseCountryList(env.String("MCSSHD_GEOIP_DENY_COUNTRIES")),
+		},
+	}
+
+	if !c.CountryFilter.IsEmpty() && len(c.DBs) == 0 {
+		env.Errorf("MCSSHD_GEOIP_ALLOW_COUNTRIES and MCSSHD_GEOIP_DENY_COUNTRIES need MCSSHD_GEOIP_DBS to be set")
+	}
+
+	return c
+}
+
+// TarpitConfig is MCSSHD_TARPIT_THRESHOLD, MCSSHD_TARPIT_DELAY, MCSSHD_TARPIT_MAX_DELAY and
+// MCSSHD_TARPIT_FEED. Once a host has tried Threshold user slugs that don't exist, its further attempts
+// are answered after Delay, growing with each attempt up to MaxDelay. Each attempt is appended as a line
+// of JSON to Feed if it is set. A Threshold of 0 turns off the tarpit. See Tarpit.
+type TarpitConfig struct {
+	Threshold int
+	Delay     time.Duration
+	MaxDelay  time.Duration
+	Feed      string
+}
+
+// LoadTarpitConfig loads the TarpitConfig from env.
+func LoadTarpitConfig(env *Env) TarpitConfig {
+	c := TarpitConfig{
+		Delay:    DefaultTarpitDelay,
+		MaxDelay: DefaultTarpitMaxDelay,
+		Feed:     env.String("MCSSHD_TARPIT_FEED"),
+	}
+
+	env.Int("MCSSHD_TARPIT_THRESHOLD", &c.Threshold, 1)
+	env.Duration("MCSSHD_TARPIT_DELAY", &c.Delay, 0)
+	env.Duration("MCSSHD_TARPIT_MAX_DELAY", &c.MaxDelay, 0)
+	return c
+}
+
+// UploadProcessingConfig is what is done with files in the background once they are uploaded.
+type UploadProcessingConfig struct {
+	// Hooks are read from MCSSHD_UPLOAD_HOOKS_FILE, a JSON file (see ParseUploadHooks), and HookWorkers,
+	// MCSSHD_UPLOAD_HOOK_WORKERS, is the number of files whose hooks are run at the same time.
+	Hooks       []UploadHook
+	HookWorkers int
+
+	// ExtractMetadata, MCSSHD_EXTRACT_METADATA=true, extracts the metadata embedded in the formats that
+	// have a built-in extractor, such as TIFF, EDF, CIF, EC-Lab .mpt and HDF5.
+	ExtractMetadata bool
+
+	// Conversions are MCSSHD_CONVERT_MIME_TYPES, the comma separated mime types converted to web viewable
+	// versions, where image/* matches every image type, MCSSHD_CONVERT_MAX_SIZE, the size above which
+	// files aren't converted, MCSSHD_CONVERT_PER_MINUTE, the conversions queued per minute, and
+	// MCSSHD_CONVERT_BACKLOG, the files that can wait for their turn. See ConversionPolicy.
+	Conversions ConversionPolicy
+}
+
+// LoadUploadProcessingConfig loads the UploadProcessingConfig from env.
+func LoadUploadProcessingConfig(env *Env) UploadProcessingConfig {
+	c := UploadProcessingConfig{HookWorkers: DefaultUploadHookWorkers}
+
+	env.ParseFile("MCSSHD_UPLOAD_HOOKS_FILE", func(data []byte) (err error) {
+		c.Hooks, err = ParseUploadHooks(data)
+		return err
+	})
+
+	env.Int("MCSSHD_UPLOAD_HOOK_WORKERS", &c.HookWorkers, 1)
+	env.Bool("MCSSHD_EXTRACT_METADATA", &c.ExtractMetadata)
+
+	if mimeTypes := env.String("MCSSHD_CONVERT_MIME_TYPES"); mimeTypes != "" {
+		c.Conversions.MimeTypes = ParseMimeTypes(mimeTypes)
+	}
+	env.Int64("MCSSHD_CONVERT_MAX_SIZE", &c.Conversions.MaxSize, 0)
+	env.Int("MCSSHD_CONVERT_PER_MINUTE", &c.Conversions.PerMinute, 0)
+	env.Int("MCSSHD_CONVERT_BACKLOG", &c.Conversions.MaxBacklog, 1)
+	return c
+}
+
+// VersioningConfig is how new versions of files are treated.
+type VersioningConfig struct {
+	// PrunePolicies, MCSSHD_PRUNE_POLICIES, limit the number of versions kept for files in high churn
+	// paths. See ParsePrunePolicies.
+	PrunePolicies []PrunePolicy
+
+	// IdempotencyWindows, MCSSHD_IDEMPOTENCY_WINDOWS, is how long after a file is uploaded an upload of the
+	// same data to the same path, by the same user, is treated as a retry. See ParseIdempotencyWindows.
+	IdempotencyWindows IdempotencyWindows
+}
+
+// LoadVersioningConfig loads the VersioningConfig from env.
+func LoadVersioningConfig(env *Env) VersioningConfig {
+	var c VersioningConfig
+	env.Parse("MCSSHD_PRUNE_POLICIES", func(value string) (err error) {
+		c.PrunePolicies, err = ParsePrunePolicies(value)
+		return err
+	})
+
+	env.Parse("MCSSHD_IDEMPOTENCY_WINDOWS", func(value string) (err error) {
+		c.IdempotencyWindows, err = ParseIdempotencyWindows(value)
+		return err
+	})
+
+	return c
+}
+
+// IngestConfig is how uploads are throttled.
+type IngestConfig struct {
+	// FinalizeHighWater, MCSSHD_FINALIZE_HIGH_WATER, is the number of uploads being finalized at which new
+	// writes are throttled until the backlog drains. 0 turns off throttling.
+	FinalizeHighWater int
+
+	// RateWindows, MCSSHD_INGEST_RATE_WINDOWS, cap the combined upload rate by time of day, such as
+	// "mon-fri 08:00-18:00=50M". See ParseRateWindows.
+	RateWindows []RateWindow
+}
+
+// LoadIngestConfig loads the IngestConfig from env.
+func LoadIngestConfig(env *Env) IngestConfig {
+	var c IngestConfig
+	env.Int("MCSSHD_FINALIZE_HIGH_WATER", &c.FinalizeHighWater, 0)
+	env.Parse("MCSSHD_INGEST_RATE_WINDOWS", func(value string) (err error) {
+		c.RateWindows, err = ParseRateWindows(value)
+		return err
+	})
+
+	return c
+}
+
+// FaultInjectionConfig is MCSSHD_FAULTS_STORE and MCSSHD_FAULTS_STORAGE, the latency and errors injected
+// into the store and storage calls, for testing a staging deployment, such as
+// "latency=50ms,jitter=20ms,errors=0.05". Setting either one, even to "", also lets the faults be changed
+// at /faults on the metrics address. They are nil when they aren't set, and must never be set in
+// production.
+type FaultInjectionConfig struct {
+	Store   *FaultConfig
+	Storage *FaultConfig
+}
+
+// LoadFaultInjectionConfig loads the FaultInjectionConfig from env.
+func LoadFaultInjectionConfig(env *Env) FaultInjectionConfig {
+	var c FaultInjectionConfig
+	for name, faults := range map[string]**FaultConfig{"MCSSHD_FAULTS_STORE": &c.Store, "MCSSHD_FAULTS_STORAGE": &c.Storage} {
+		spec, ok := env.Lookup(name)
+		if !ok {
+			continue
+		}
+
+		config, err := ParseFaultConfig(spec)
+		if err != nil {
+			env.Errorf("%s (%s) is not valid: %s", name, spec, err)
+		}
+		*faults = &config
+	}
+
+	return c
+}
+
+// MetricsConfig is what is measured and reported about the server.
+type MetricsConfig struct {
+	// Addr, MCSSHD_METRICS_ADDR, serves the metrics as JSON at /debug/vars, and the per project activity
+	// for Prometheus at /metrics. The metrics aren't served when it is blank.
+	Addr string
+
+	// ActivityInterval, MCSSHD_ACTIVITY_INTERVAL, is how often the per project activity rates are
+	// computed, and ActivityMaxSeries, MCSSHD_ACTIVITY_MAX_SERIES, caps the number of project and user
+	// pairs they are exported for.
+	ActivityInterval  time.Duration
+	ActivityMaxSeries int
+
+	// FileAccessFlushInterval, MCSSHD_FILE_ACCESS_FLUSH_INTERVAL, is how often the download counts of
+	// files are written to the database. 0 turns off counting downloads.
+	FileAccessFlushInterval time.Duration
+
+	// UserUsageInterval, MCSSHD_USER_USAGE_INTERVAL, is how often the storage used by each user is totaled
+	// up. 0 turns off the per-user usage metrics.
+	UserUsageInterval time.Duration
+
+	// SlowTransferRate, MCSSHD_SLOW_TRANSFER_RATE, is the throughput, in bytes per second, below which a
+	// transfer is reported as slow.
+	SlowTransferRate int64
+
+	// TraceTransferTimings, MCSSHD_TRACE_TRANSFER_TIMINGS=true, emits an event for every completed
+	// transfer with a breakdown of where its time went (see TransferTiming).
+	TraceTransferTimings bool
+
+	// EventWebhookURL, MCSSHD_EVENT_WEBHOOK_URL, is sent the events, such as slow transfers.
+	EventWebhookURL string
+}
+
+// LoadMetricsConfig loads the MetricsConfig from env.
+func LoadMetricsConfig(env *Env) MetricsConfig {
+	c := MetricsConfig{
+		Addr:                    env.String("MCSSHD_METRICS_ADDR"),
+		ActivityInterval:        10 * time.Second,
+		ActivityMaxSeries:       200,
+		FileAccessFlushInterval: time.Minute,
+		UserUsageInterval:       15 * time.Minute,
+		EventWebhookURL:         env.String("MCSSHD_EVENT_WEBHOOK_URL"),
+	}
+
+	env.Duration("MCSSHD_ACTIVITY_INTERVAL", &c.ActivityInterval, time.Nanosecond)
+	env.Int("MCSSHD_ACTIVITY_MAX_SERIES", &c.ActivityMaxSeries, 0)
+	env.Duration("MCSSHD_FILE_ACCESS_FLUSH_INTERVAL", &c.FileAccessFlushInterval, 0)
+	env.Duration("MCSSHD_USER_USAGE_INTERVAL", &c.UserUsageInterval, 0)
+	env.Int64("MCSSHD_SLOW_TRANSFER_RATE", &c.SlowTransferRate, 0)
+	env.Bool("MCSSHD_TRACE_TRANSFER_TIMINGS", &c.TraceTransferTimings)
+	return c
+}
+
+// FileServerConfig is how the file data is shared with other sites. The file server is served at Addr,
+// MCSSHD_FILE_SERVER_ADDR, over TLS with the certificate and key in Cert and Key, MCSSHD_FILE_SERVER_CERT
+// and MCSSHD_FILE_SERVER_KEY. A satellite site, one that shares the primary's database but not its
+// storage, sets PrimaryURL, MCSSHD_PRIMARY_URL, to the primary's file server, and is always read-only.
+// Damaged files are restored from ReplicaURL, MCSSHD_REPLICA_URL, by mc-sshd repair, and by the server
+// when AutoRepair, MCSSHD_AUTO_REPAIR, is true. Every site must set the same Token,
+// MCSSHD_FILE_SERVER_TOKEN.
+type FileServerConfig struct {
+	Addr       string
+	Cert       string
+	Key        string
+	Token      string
+	PrimaryURL string
+	ReplicaURL string
+	AutoRepair bool
+
+	// CAs, loaded from the PEM file MCSSHD_FILE_SERVER_CA, are the certificate authorities that file
+	// servers are trusted to be signed by, when it isn't one the system trusts.
+	CAs *x509.CertPool
+
+	// RangeReadLimit, MCSSHD_RANGE_READ_LIMIT, is how many bytes of a file a satellite reads from the
+	// primary with ranged requests, for previews such as head, before it fetches the whole file.
+	RangeReadLimit int64
+}
+
+// LoadFileServerConfig loads the FileServerConfig from env.
+func LoadFileServerConfig(env *Env) FileServerConfig {
+	c := FileServerConfig{
+		Addr:           env.String("MCSSHD_FILE_SERVER_ADDR"),
+		Cert:           env.String("MCSSHD_FILE_SERVER_CERT"),
+		Key:            env.String("MCSSHD_FILE_SERVER_KEY"),
+		Token:          env.String("MCSSHD_FILE_SERVER_TOKEN"),
+		PrimaryURL:     env.String("MCSSHD_PRIMARY_URL"),
+		ReplicaURL:     env.String("MCSSHD_REPLICA_URL"),
+		RangeReadLimit: DefaultRangeReadLimit,
+	}
+
+	// The token and the file data must not be sent in the clear.
+	if c.Addr != "" && (c.Cert == "" || c.Key == "") {
+		env.Errorf("MCSSHD_FILE_SERVER_CERT and MCSSHD_FILE_SERVER_KEY must be set when MCSSHD_FILE_SERVER_ADDR is set")
+	}
+
+	if (c.PrimaryURL != "" || c.Addr != "" || c.ReplicaURL != "") && c.Token == "" {
+		env.Errorf("MCSSHD_FILE_SERVER_TOKEN must be set when MCSSHD_PRIMARY_URL, MCSSHD_FILE_SERVER_ADDR or MCSSHD_REPLICA_URL is set")
+	}
+
+	for name, fileServerURL := range map[string]string{"MCSSHD_PRIMARY_URL": c.PrimaryURL, "MCSSHD_REPLICA_URL": c.ReplicaURL} {
+		if fileServerURL != "" && !strings.HasPrefix(fileServerURL, "https://") {
+			env.Errorf("%s (%s) must be an https URL", name, fileServerURL)
+		}
+	}
+
+	env.ParseFile("MCSSHD_FILE_SERVER_CA", func(pem []byte) error {
+		c.CAs = x509.NewCertPool()
+		if !c.CAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificates")
+		}
+		return nil
+	})
+
+	env.Bool("MCSSHD_AUTO_REPAIR", &c.AutoRepair)
+	env.Int64("MCSSHD_RANGE_READ_LIMIT", &c.RangeReadLimit, 0)
+	return c
+}
+
+// StandbyConfig runs the instance as one of a primary and its warm standbys, where only the instance
+// holding Lock, MCSSHD_STANDBY_LOCK, opens the SSH listener. Lock is file:<path> to use a lock file, or
+// redis to use a lease in Redis that lasts LeaseTTL, MCSSHD_STANDBY_LEASE_TTL. The active instance exits
+// if it loses the lock, so it should be run under a supervisor that restarts it as a standby.
+type StandbyConfig struct {
+	Lock     string
+	LeaseTTL time.Duration
+}
+
+// LoadStandbyConfig loads the StandbyConfig from env. A Lock of redis needs redis to be configured.
+func LoadStandbyConfig(env *Env, redis RedisConfig) StandbyConfig {
+	c := StandbyConfig{Lock: env.String("MCSSHD_STANDBY_LOCK"), LeaseTTL: 15 * time.Second}
+
+	switch {
+	case c.Lock == "":
+	case c.Lock == "redis" && redis.Addr == "":
+		env.Errorf("MCSSHD_STANDBY_LOCK is redis but MCSSHD_REDIS_ADDR is not set")
+	case c.Lock != "redis" && (!strings.HasPrefix(c.Lock, "file:") || c.Lock == "file:"):
+		env.Errorf("MCSSHD_STANDBY_LOCK (%s) must be file:<path> or redis", c.Lock)
+	}
+
+	env.Duration("MCSSHD_STANDBY_LEASE_TTL", &c.LeaseTTL, time.Nanosecond)
+	return c
+}
+
+// AuthzConfig is the policy engine, such as Open Policy Agent, at URL, MCSSHD_AUTHZ_URL, that is asked to
+// allow each operation, with MCSSHD_AUTHZ_TIMEOUT, MCSSHD_AUTHZ_FAIL_OPEN and MCSSHD_AUTHZ_CACHE_TTL. No
+// policy engine is asked when URL is blank. See HTTPAuthorizer.
+type AuthzConfig struct {
+	URL      string
+	Timeout  time.Duration
+	FailOpen bool
+	CacheTTL time.Duration
+}
+
+// LoadAuthzConfig loads the AuthzConfig from env.
+func LoadAuthzConfig(env *Env) AuthzConfig {
+	c := AuthzConfig{URL: env.String("MCSSHD_AUTHZ_URL"), Timeout: 5 * time.Second}
+	env.Duration("MCSSHD_AUTHZ_TIMEOUT", &c.Timeout, time.Nanosecond)
+	env.Bool("MCSSHD_AUTHZ_FAIL_OPEN", &c.FailOpen)
+	env.Duration("MCSSHD_AUTHZ_CACHE_TTL", &c.CacheTTL, 0)
+	return c
+}
+
+// FeatureFlagConfig is the feature flags set for the server.
+type FeatureFlagConfig struct {
+	// Flags are those in MCSSHD_FEATURES, such as symlinks=off,symlinks@project:beta=on (see
+	// ParseFeatureFlags), followed by those in the JSON file MCSSHD_FEATURES_FILE (see
+	// ParseFeatureFlagsFile).
+	Flags []FeatureFlag
+
+	// Refresh, MCSSHD_FEATURES_REFRESH, is how often the flags in the feature_flags table are reloaded.
+	// The table is only used when it is set.
+	Refresh time.Duration
+}
+
+// LoadFeatureFlagConfig loads the FeatureFlagConfig from env.
+func LoadFeatureFlagConfig(env *Env) FeatureFlagConfig {
+	var c FeatureFlagConfig
+	env.Parse("MCSSHD_FEATURES", func(value string) error {
+		flags, err := ParseFeatureFlags(value)
+		c.Flags = append(c.Flags, flags...)
+		return err
+	})
+
+	env.ParseFile("MCSSHD_FEATURES_FILE", func(data []byte) error {
+		flags, err := ParseFeatureFlagsFile(data)
+		c.Flags = append(c.Flags, flags...)
+		return err
+	})
+
+	env.Duration("MCSSHD_FEATURES_REFRESH", &c.Refresh, time.Nanosecond)
+	return c
+}
+
+// PullConfig is where users can pull files into projects from with mc pull: the URLs under Sources,
+// MCSSHD_PULL_SOURCES, such as https://scratch.hpc.example.edu/,s3://beamline-data. s3:// URLs are fetched
+// from S3Endpoint, MCSSHD_PULL_S3_ENDPOINT. See Puller.
+type PullConfig struct {
+	Sources    []PullSource
+	S3Endpoint string
+}
+
+// LoadPullConfig loads the PullConfig from env.
+func LoadPullConfig(env *Env) PullConfig {
+	c := PullConfig{S3Endpoint: DefaultS3Endpoint}
+	env.Parse("MCSSHD_PULL_SOURCES", func(value string) (err error) {
+		c.Sources, err = ParsePullSources(value)
+		return err
+	})
+
+	if s3Endpoint := env.String("MCSSHD_PULL_S3_ENDPOINT"); s3Endpoint != "" {
+		c.S3Endpoint = s3Endpoint
+	}
+
+	return c
+}
+
+// ScratchConfig is the local directory, Dir, MCSSHD_SCRATCH_DIR, that each connection gets a scratch area
+// under, served as /tmp beside the projects. Each area can hold at most Limit, MCSSHD_SCRATCH_LIMIT,
+// bytes, by default DefaultScratchLimit. A Limit of 0 means unlimited. See ScratchArea.
+type ScratchConfig struct {
+	Dir   string
+	Limit int64
+}
+
+// LoadScratchConfig loads the ScratchConfig from env.
+func LoadScratchConfig(env *Env) ScratchConfig {
+	c := ScratchConfig{Dir: env.String("MCSSHD_SCRATCH_DIR"), Limit: DefaultScratchLimit}
+	env.Int64("MCSSHD_SCRATCH_LIMIT", &c.Limit, 0)
+	return c
+}
@@ -0,0 +1,201 @@
+package mc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testEnv returns an Env that reads the settings in vars.
+func testEnv(vars map[string]string) *Env {
+	return NewEnv(func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	})
+}
+
+func TestEnvValues(t *testing.T) {
+	env := testEnv(map[string]string{
+		"NUMBER":    "12",
+		"NEGATIVE":  "-1",
+		"DURATION":  "90s",
+		"BOOLEAN":   "true",
+		"LIST":      " a, ,b ,",
+		"NOT_VALID": "x",
+	})
+
+	n := 3
+	env.Int("NUMBER", &n, 0)
+	require.Equal(t, 12, n)
+	env.Int("UNSET", &n, 0)
+	require.Equal(t, 12, n, "Unset settings keep their default")
+
+	var d time.Duration
+	env.Duration("DURATION", &d, 0)
+	require.Equal(t, 90*time.Second, d)
+
+	var b bool
+	env.Bool("BOOLEAN", &b)
+	require.True(t, b)
+
+	require.Equal(t, []string{"a", "b"}, env.List("LIST"))
+	require.Nil(t, env.List("UNSET"))
+	require.Empty(t, env.Errors())
+
+	// Every problem is collected, and the values are left alone.
+	env.Int("NEGATIVE", &n, 0)
+	env.Int("NOT_VALID", &n, 0)
+	env.Duration("NOT_VALID", &d, 0)
+	env.Bool("NOT_VALID", &b)
+	env.Required("UNSET")
+	require.Len(t, env.Errors(), 5)
+	require.Equal(t, 12, n)
+	require.Equal(t, 90*time.Second, d)
+	require.True(t, b)
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	hostKey := filepath.Join(t.TempDir(), "host_key")
+	require.NoError(t, os.WriteFile(hostKey, []byte("key"), 0600))
+
+	env := testEnv(map[string]string{
+		"MCSSHD_HOST":                 "localhost",
+		"MCSSHD_PORT":                 "2222",
+		"MCSSHD_HOST_KEY_PATH":        hostKey,
+		"MCSSHD_KEEPALIVE_INTERVAL":   "30s",
+		"MCSSHD_IDLE_SESSION_TIMEOUT": "1h",
+	})
+	c := LoadServerConfig(env)
+	require.Empty(t, env.Errors())
+	require.Equal(t, "localhost", c.Host)
+	require.Equal(t, "2222", c.Port)
+	require.Equal(t, 30*time.Second, c.KeepaliveInterval)
+	require.Equal(t, DefaultKeepaliveMaxMissed, c.KeepaliveMaxMissed)
+	require.Equal(t, time.Hour, c.IdleSessionTimeout)
+
+	// The host, port and host key are required, and the host key must exist.
+	env = testEnv(map[string]string{"MCSSHD_HOST_KEY_PATH": filepath.Join(t.TempDir(), "missing")})
+	LoadServerConfig(env)
+	require.Len(t, env.Errors(), 3)
+
+	env = testEnv(map[string]string{
+		"MCSSHD_HOST":                 "localhost",
+		"MCSSHD_PORT":                 "2222",
+		"MCSSHD_HOST_KEY_PATH":        hostKey,
+		"MCSSHD_KEEPALIVE_MAX_MISSED": "0",
+	})
+	LoadServerConfig(env)
+	require.Len(t, env.Errors(), 1)
+}
+
+func TestLoadDatabaseConfig(t *testing.T) {
+	env := testEnv(nil)
+	c := LoadDatabaseConfig(env)
+	require.Empty(t, env.Errors())
+	require.Equal(t, "mysql", c.Driver)
+	require.Equal(t, SchemaMismatchRefuse, c.SchemaMismatch)
+	require.Equal(t, []string{"demo"}, c.OfflineProjects)
+
+	env = testEnv(map[string]string{
+		"MCSSHD_OFFLINE_USERS":    "alice:secret, bob:pa:ss",
+		"MCSSHD_OFFLINE_PROJECTS": "demo,beta",
+		"MCSSHD_SCHEMA_MISMATCH":  "read-only",
+	})
+	c = LoadDatabaseConfig(env)
+	require.Empty(t, env.Errors())
+	require.Equal(t, []string{"alice", "bob"}, c.OfflineUsers)
+	require.Equal(t, []string{"secret", "pa:ss"}, c.OfflinePasswords)
+	require.Equal(t, []string{"demo", "beta"}, c.OfflineProjects)
+	require.Equal(t, SchemaMismatchReadOnly, c.SchemaMismatch)
+
+	env = testEnv(map[string]string{
+		"MCSSHD_DB_DRIVER":       "sqlite",
+		"MCSSHD_OFFLINE_USERS":   "alice",
+		"MCSSHD_SCHEMA_MISMATCH": "sometimes",
+	})
+	LoadDatabaseConfig(env)
+	require.Len(t, env.Errors(), 3, "A DSN is needed for sqlite, and the user and schema mismatch are invalid")
+}
+
+func TestLoadFileServerConfig(t *testing.T) {
+	env := testEnv(map[string]string{
+		"MCSSHD_PRIMARY_URL":       "https://primary.example.edu:8443",
+		"MCSSHD_FILE_SERVER_TOKEN": "token",
+	})
+	c := LoadFileServerConfig(env)
+	require.Empty(t, env.Errors())
+	require.Equal(t, "https://primary.example.edu:8443", c.PrimaryURL)
+	require.Equal(t, int64(DefaultRangeReadLimit), c.RangeReadLimit)
+
+	// The file server needs a token and TLS, and its URLs must be https.
+	env = testEnv(map[string]string{
+		"MCSSHD_REPLICA_URL":      "http://replica.example.edu:8443",
+		"MCSSHD_FILE_SERVER_ADDR": ":8443",
+	})
+	LoadFileServerConfig(env)
+	require.Len(t, env.Errors(), 3)
+}
+
+func TestLoadFaultInjectionConfig(t *testing.T) {
+	c := LoadFaultInjectionConfig(testEnv(nil))
+	require.Nil(t, c.Store)
+	require.Nil(t, c.Storage)
+
+	// Setting the faults to "" turns on changing them at runtime without injecting any.
+	env := testEnv(map[string]string{"MCSSHD_FAULTS_STORE": "", "MCSSHD_FAULTS_STORAGE": "latency=50ms"})
+	c = LoadFaultInjectionConfig(env)
+	require.Empty(t, env.Errors())
+	require.Equal(t, &FaultConfig{}, c.Store)
+	require.Equal(t, &FaultConfig{Latency: 50 * time.Millisecond}, c.Storage)
+}
+
+func TestLoadStandbyConfig(t *testing.T) {
+	env := testEnv(map[string]string{"MCSSHD_STANDBY_LOCK": "file:/var/run/mc-sshd.lock"})
+	c := LoadStandbyConfig(env, RedisConfig{})
+	require.Empty(t, env.Errors())
+	require.Equal(t, 15*time.Second, c.LeaseTTL)
+
+	env = testEnv(map[string]string{"MCSSHD_STANDBY_LOCK": "redis"})
+	LoadStandbyConfig(env, RedisConfig{})
+	require.Len(t, env.Errors(), 1, "A redis lock needs redis")
+	LoadStandbyConfig(env, RedisConfig{Addr: "localhost:6379"})
+	require.Len(t, env.Errors(), 1)
+
+	env = testEnv(map[string]string{"MCSSHD_STANDBY_LOCK": "file:", "MCSSHD_STANDBY_LEASE_TTL": "0s"})
+	LoadStandbyConfig(env, RedisConfig{})
+	require.Len(t, env.Errors(), 2)
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	env := testEnv(map[string]string{
+		"MCSSHD_DB_TIMEOUT":         "10s",
+		"MCSSHD_IGNORE_PATTERNS":    ".DS_Store, *.swp",
+		"MCSSHD_SANITIZE_POLICY":    "transliterate",
+		"MCSSHD_NO_OVERWRITE_PATHS": "*:/raw",
+		"MCSSHD_PROJECT_QUOTA":      "1000",
+		"MCSSHD_READ_ONLY":          "true",
+	})
+	c := DefaultConfig()
+	c.LoadEnv(env)
+	require.Empty(t, env.Errors())
+	require.Equal(t, 10*time.Second, c.DBTimeout)
+	require.Equal(t, DefaultConfig().FSTimeout, c.FSTimeout)
+	require.Equal(t, []string{".DS_Store", "*.swp"}, c.IgnorePatterns)
+	require.Equal(t, SanitizeTransliterate, c.SanitizePolicy)
+	require.Equal(t, []PathRule{{ProjectSlug: "*", Prefix: "/raw"}}, c.NoOverwritePaths)
+	require.Equal(t, int64(1000), c.ProjectQuota)
+	require.True(t, c.ReadOnly)
+
+	env = testEnv(map[string]string{
+		"MCSSHD_SANITIZE_POLICY":  "maybe",
+		"MCSSHD_VERIFY_READS":     "sometimes",
+		"MCSSHD_WRITE_ONCE_PATHS": "raw",
+		"MCSSHD_MAX_ARCHIVE_SIZE": "-1",
+	})
+	c = DefaultConfig()
+	c.LoadEnv(env)
+	require.Len(t, env.Errors(), 4)
+}
@@ -0,0 +1,89 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// EventVersionPruned is the Event.Type for a file version that was removed by a VersionPruner.
+const EventVersionPruned = "version.pruned"
+
+// Event describes something the server did to a project that other systems may want to know about.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	ProjectID int       `json:"project_id"`
+	FileID    int       `json:"file_id,omitempty"`
+	Path      string    `json:"path,omitempty"`
+
+	// Details holds information specific to the event type.
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// EventSink receives the events emitted by the server. Emit must not block for long since it may be
+// called while a file is being processed.
+type EventSink interface {
+	Emit(event Event)
+}
+
+// LogEventSink is an EventSink that logs each event as JSON.
+type LogEventSink struct{}
+
+func NewLogEventSink() *LogEventSink {
+	return &LogEventSink{}
+}
+
+func (s *LogEventSink) Emit(event Event) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Unable to marshal %s event: %s", event.Type, err)
+		return
+	}
+
+	log.Infof("event: %s", b)
+}
+
+// MultiEventSink sends each event to all of its sinks.
+type MultiEventSink []EventSink
+
+func (s MultiEventSink) Emit(event Event) {
+	for _, sink := range s {
+		sink.Emit(event)
+	}
+}
+
+// WebhookEventSink POSTs each event as JSON to a URL. The events are sent in the background, and
+// failures are logged, so that Emit never waits on the webhook.
+type WebhookEventSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookEventSink(url string) *WebhookEventSink {
+	return &WebhookEventSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *WebhookEventSink) Emit(event Event) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Unable to marshal %s event: %s", event.Type, err)
+		return
+	}
+
+	go func() {
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+		if err != nil {
+			log.Errorf("Unable to send %s event to webhook: %s", event.Type, err)
+			return
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			log.Errorf("Webhook rejected %s event: %s", event.Type, resp.Status)
+		}
+	}()
+}
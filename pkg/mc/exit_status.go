@@ -0,0 +1,50 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// The exit statuses of the commands run over SSH, such as scp, so that scripts can tell the common
+// failures apart. Any other failure exits with ExitFailure.
+const (
+	ExitFailure          = 1
+	ExitNoSuchProject    = 2
+	ExitNotFound         = 3
+	ExitPermissionDenied = 4
+	ExitQuotaExceeded    = 5
+	ExitBusy             = 6
+)
+
+// exitStatuses maps errors onto exit statuses. As with the message catalog the first entry that matches,
+// with errors.Is, is used, so ErrProjectNotFound comes before the more general errors.
+var exitStatuses = []struct {
+	err    error
+	status int
+}{
+	{ErrProjectNotFound, ExitNoSuchProject},
+	{os.ErrNotExist, ExitNotFound},
+	{os.ErrPermission, ExitPermissionDenied},
+	{syscall.EDQUOT, ExitQuotaExceeded},
+	{syscall.ENOSPC, ExitQuotaExceeded},
+	{ErrFileBusy, ExitBusy},
+	{ErrFileLocked, ExitBusy},
+	{ErrTooManySessions, ExitBusy},
+	{ErrWritesThrottled, ExitBusy},
+}
+
+// ExitStatus returns the exit status for a command that failed with err, or 0 if err is nil.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	for _, entry := range exitStatuses {
+		if errors.Is(err, entry.err) {
+			return entry.status
+		}
+	}
+
+	return ExitFailure
+}
@@ -0,0 +1,30 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{err: nil, status: 0},
+		{err: fmt.Errorf("%w %s", ErrProjectNotFound, "proj"), status: ExitNoSuchProject},
+		{err: fmt.Errorf("unable to find file '/a.csv' in project 1: %w", os.ErrNotExist), status: ExitNotFound},
+		{err: ErrWriteOnce, status: ExitPermissionDenied},
+		{err: Localize(ErrReadOnly, "de"), status: ExitPermissionDenied},
+		{err: fmt.Errorf("unable to write '/a.csv': %w", ErrQuotaExceeded), status: ExitQuotaExceeded},
+		{err: ErrFileBusy, status: ExitBusy},
+		{err: errors.New("failed to parse"), status: ExitFailure},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.status, ExitStatus(test.err), "%v", test.err)
+	}
+}
@@ -0,0 +1,346 @@
+package mc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// ErrInjectedFault is returned by the store calls that a FaultInjector fails.
+var ErrInjectedFault = errors.New("injected fault")
+
+// errInjectedStorageFault is returned by the storage calls that a FaultInjector fails. It is an I/O
+// error, like the errors a failing disk or network filesystem returns.
+var errInjectedStorageFault = fmt.Errorf("injected fault: %w", syscall.EIO)
+
+// FaultConfig is the latency and the rate of errors a FaultInjector adds to a kind of call. Each call is
+// delayed by Latency plus a random duration of up to Jitter, and then fails with probability ErrorRate.
+type FaultConfig struct {
+	Latency   time.Duration `json:"latency"`
+	Jitter    time.Duration `json:"jitter"`
+	ErrorRate float64       `json:"error_rate"`
+}
+
+// ParseFaultConfig parses a FaultConfig from a comma separated list of settings, such as
+// "latency=50ms,jitter=20ms,errors=0.05". Settings that are left out are 0.
+func ParseFaultConfig(spec string) (FaultConfig, error) {
+	var config FaultConfig
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return config, fmt.Errorf("invalid fault setting '%s'", setting)
+		}
+
+		var err error
+		switch parts[0] {
+		case "latency":
+			config.Latency, err = time.ParseDuration(parts[1])
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(parts[1])
+		case "errors":
+			config.ErrorRate, err = strconv.ParseFloat(parts[1], 64)
+			if err == nil && (config.ErrorRate < 0 || config.ErrorRate > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		default:
+			err = errors.New("unknown setting")
+		}
+
+		if err != nil {
+			return config, fmt.Errorf("invalid fault setting '%s': %s", setting, err)
+		}
+	}
+
+	return config, nil
+}
+
+// FaultInjector adds latency and errors to the calls made to the stores and to storage, so that client
+// retries and the server's error handling can be tested under realistic failures in a staging
+// deployment. It must never be enabled in production. The store calls are wrapped by Middleware, and the
+// storage calls, the filesystem calls made through RunWithTimeout and RunIOWithTimeout, by
+// InjectStorageFaults. The faults can be changed while the server runs through ServeHTTP.
+type FaultInjector struct {
+	mu      sync.Mutex
+	store   FaultConfig
+	storage FaultConfig
+	rand    *rand.Rand
+
+	storeFaults   int64
+	storageFaults int64
+}
+
+// NewFaultInjector creates a FaultInjector that adds the store faults to store calls and the storage
+// faults to storage calls.
+func NewFaultInjector(store, storage FaultConfig) *FaultInjector {
+	return &FaultInjector{
+		store:   store,
+		storage: storage,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// storageFaults is the FaultInjector applied to storage calls. See InjectStorageFaults.
+var storageFaults *FaultInjector
+
+// InjectStorageFaults applies the storage faults of f to every call made through RunWithTimeout and
+// RunIOWithTimeout. It must be called before the server starts. A nil f injects nothing.
+func InjectStorageFaults(f *FaultInjector) {
+	storageFaults = f
+}
+
+// delay returns how long to delay a call, and whether it fails, for config. It must be called with mu
+// held.
+func (f *FaultInjector) delay(config FaultConfig) (time.Duration, bool) {
+	delay := config.Latency
+	if config.Jitter > 0 {
+		delay += time.Duration(f.rand.Int63n(int64(config.Jitter)))
+	}
+
+	return delay, config.ErrorRate > 0 && f.rand.Float64() < config.ErrorRate
+}
+
+// injectStore delays a store call, and returns ErrInjectedFault if it should fail.
+func (f *FaultInjector) injectStore() error {
+	f.mu.Lock()
+	delay, fail := f.delay(f.store)
+	if fail {
+		f.storeFaults++
+	}
+	f.mu.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		return ErrInjectedFault
+	}
+
+	return nil
+}
+
+// injectStorage delays a storage call, and returns an I/O error if it should fail. A nil FaultInjector
+// does nothing.
+func (f *FaultInjector) injectStorage() error {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	delay, fail := f.delay(f.storage)
+	if fail {
+		f.storageFaults++
+	}
+	f.mu.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		return errInjectedStorageFault
+	}
+
+	return nil
+}
+
+// faultSettings is the JSON form of the settings of a FaultInjector.
+type faultSettings struct {
+	Store   FaultConfig `json:"store"`
+	Storage FaultConfig `json:"storage"`
+}
+
+// ServeHTTP returns the faults being injected as JSON. A PUT replaces them with the faults in the request
+// body, in the same form.
+func (f *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var settings faultSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		f.store, f.storage = settings.Store, settings.Storage
+		f.mu.Unlock()
+		log.Warnf("Injecting faults, store: %+v, storage: %+v", settings.Store, settings.Storage)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f.mu.Lock()
+	settings := faultSettings{Store: f.store, Storage: f.storage}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		log.Errorf("Unable to write fault settings: %s", err)
+	}
+}
+
+// String returns the number of faults injected as JSON, so that a FaultInjector can be published with
+// expvar.
+func (f *FaultInjector) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, _ := json.Marshal(map[string]int64{"store_faults": f.storeFaults, "storage_faults": f.storageFaults})
+	return string(b)
+}
+
+// Middleware returns a StoreMiddleware that injects the store faults into the calls to the FileStore and
+// ProjectStore, which are made by every transfer.
+func (f *FaultInjector) Middleware() StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &faultFileStore{FileStore: fileStore, faults: f}
+		},
+		ProjectStore: func(projectStore store.ProjectStore) store.ProjectStore {
+			return &faultProjectStore{ProjectStore: projectStore, faults: f}
+		},
+	}
+}
+
+type faultFileStore struct {
+	store.FileStore
+	faults *FaultInjector
+}
+
+func (s *faultFileStore) UpdateMetadataForFileAndProject(file *mcmodel.File, checksum string, totalBytes int64) error {
+	if err := s.faults.injectStore(); err != nil {
+		return err
+	}
+	return s.FileStore.UpdateMetadataForFileAndProject(file, checksum, totalBytes)
+}
+
+func (s *faultFileStore) CreateFile(name string, projectID, directoryID, ownerID int, mimeType string) (*mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.CreateFile(name, projectID, directoryID, ownerID, mimeType)
+}
+
+func (s *faultFileStore) GetDirByPath(projectID int, path string) (*mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.GetDirByPath(projectID, path)
+}
+
+func (s *faultFileStore) CreateDirectory(parentDirID, projectID, ownerID int, path, name string) (*mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.CreateDirectory(parentDirID, projectID, ownerID, path, name)
+}
+
+func (s *faultFileStore) CreateDirIfNotExists(parentDirID int, path, name string, projectID, ownerID int) (*mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.CreateDirIfNotExists(parentDirID, path, name, projectID, ownerID)
+}
+
+func (s *faultFileStore) ListDirectoryByPath(projectID int, path string) ([]mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.ListDirectoryByPath(projectID, path)
+}
+
+func (s *faultFileStore) GetOrCreateDirPath(projectID, ownerID int, path string) (*mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.GetOrCreateDirPath(projectID, ownerID, path)
+}
+
+func (s *faultFileStore) GetFileByPath(projectID int, path string) (*mcmodel.File, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.FileStore.GetFileByPath(projectID, path)
+}
+
+func (s *faultFileStore) UpdateFileUses(file *mcmodel.File, uuid string, fileID int) error {
+	if err := s.faults.injectStore(); err != nil {
+		return err
+	}
+	return s.FileStore.UpdateFileUses(file, uuid, fileID)
+}
+
+func (s *faultFileStore) PointAtExistingIfExists(file *mcmodel.File) (bool, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return false, err
+	}
+	return s.FileStore.PointAtExistingIfExists(file)
+}
+
+func (s *faultFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return false, err
+	}
+	return s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+}
+
+type faultProjectStore struct {
+	store.ProjectStore
+	faults *FaultInjector
+}
+
+func (s *faultProjectStore) GetProjectByID(projectID int) (*mcmodel.Project, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.ProjectStore.GetProjectByID(projectID)
+}
+
+func (s *faultProjectStore) GetProjectBySlug(slug string) (*mcmodel.Project, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.ProjectStore.GetProjectBySlug(slug)
+}
+
+func (s *faultProjectStore) GetProjectsForUser(userID int) ([]mcmodel.Project, error) {
+	if err := s.faults.injectStore(); err != nil {
+		return nil, err
+	}
+	return s.ProjectStore.GetProjectsForUser(userID)
+}
+
+func (s *faultProjectStore) UpdateProjectSizeAndFileCount(projectID int, size int64, fileCount int) error {
+	if err := s.faults.injectStore(); err != nil {
+		return err
+	}
+	return s.ProjectStore.UpdateProjectSizeAndFileCount(projectID, size, fileCount)
+}
+
+func (s *faultProjectStore) UpdateProjectDirectoryCount(projectID int, directoryCount int) error {
+	if err := s.faults.injectStore(); err != nil {
+		return err
+	}
+	return s.ProjectStore.UpdateProjectDirectoryCount(projectID, directoryCount)
+}
+
+// UserCanAccessProject can't return an error, so a call that should fail is treated as the user not having
+// access.
+func (s *faultProjectStore) UserCanAccessProject(userID, projectID int) bool {
+	if err := s.faults.injectStore(); err != nil {
+		return false
+	}
+	return s.ProjectStore.UserCanAccessProject(userID, projectID)
+}
@@ -0,0 +1,76 @@
+package mc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFaultConfig(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected FaultConfig
+		valid    bool
+	}{
+		{"", FaultConfig{}, true},
+		{"latency=50ms", FaultConfig{Latency: 50 * time.Millisecond}, true},
+		{"latency=1s, jitter=200ms, errors=0.05", FaultConfig{Latency: time.Second, Jitter: 200 * time.Millisecond, ErrorRate: 0.05}, true},
+		{"errors=2", FaultConfig{}, false},
+		{"latency", FaultConfig{}, false},
+		{"timeouts=1", FaultConfig{}, false},
+	}
+
+	for _, test := range tests {
+		config, err := ParseFaultConfig(test.spec)
+		if !test.valid {
+			require.Error(t, err, "'%s' should be invalid", test.spec)
+			continue
+		}
+
+		require.NoError(t, err, "'%s' should be valid", test.spec)
+		require.Equal(t, test.expected, config)
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	stores := &Stores{
+		FileStore:    store.NewFakeFileStore(nil),
+		ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+	}
+
+	faults := NewFaultInjector(FaultConfig{ErrorRate: 1}, FaultConfig{})
+	wrapped := stores.Use(faults.Middleware())
+
+	_, err := wrapped.ProjectStore.GetProjectBySlug("proj")
+	require.ErrorIs(t, err, ErrInjectedFault)
+
+	// The faults are changed through the admin API.
+	req := httptest.NewRequest(http.MethodPut, "/faults", strings.NewReader(`{"storage": {"error_rate": 1}}`))
+	w := httptest.NewRecorder()
+	faults.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	project, err := wrapped.ProjectStore.GetProjectBySlug("proj")
+	require.NoError(t, err)
+	require.Equal(t, 1, project.ID)
+
+	InjectStorageFaults(faults)
+	defer InjectStorageFaults(nil)
+
+	called := false
+	err = RunWithTimeout(context.Background(), time.Second, func() error {
+		called = true
+		return nil
+	})
+	require.ErrorIs(t, err, syscall.EIO)
+	require.False(t, called, "A failed storage call isn't made")
+	require.Equal(t, `{"storage_faults":1,"store_faults":1}`, faults.String())
+}
@@ -0,0 +1,69 @@
+package mc
+
+import "gorm.io/gorm"
+
+// FeatureFlag turns a feature on or off. A flag with a UserSlug only applies to that user, and a flag with
+// a ProjectSlug only applies to that project. See FeatureFlags for how the flags that apply are chosen
+// between.
+type FeatureFlag struct {
+	ID          int    `json:"-"`
+	Name        string `json:"name"`
+	UserSlug    string `json:"user,omitempty"`
+	ProjectSlug string `json:"project,omitempty"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// FeatureFlagStore holds the feature flags that operators set in the database. The flags are kept in the
+// feature_flags table, which mc-sshd adds to the Materials Commons database:
+//
+//	CREATE TABLE feature_flags (
+//	    id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+//	    name VARCHAR(64) NOT NULL,
+//	    user_slug VARCHAR(255) NOT NULL DEFAULT '',
+//	    project_slug VARCHAR(255) NOT NULL DEFAULT '',
+//	    enabled BOOLEAN NOT NULL,
+//	    UNIQUE (name, user_slug, project_slug)
+//	);
+type FeatureFlagStore interface {
+	// ListFeatureFlags returns all the feature flags.
+	ListFeatureFlags() ([]FeatureFlag, error)
+}
+
+func (FeatureFlag) TableName() string {
+	return "feature_flags"
+}
+
+type GormFeatureFlagStore struct {
+	db *gorm.DB
+}
+
+func NewGormFeatureFlagStore(db *gorm.DB) *GormFeatureFlagStore {
+	return &GormFeatureFlagStore{db: db}
+}
+
+func (s *GormFeatureFlagStore) ListFeatureFlags() ([]FeatureFlag, error) {
+	var flags []FeatureFlag
+	if err := s.db.Order("id").Find(&flags).Error; err != nil {
+		return nil, err
+	}
+
+	return flags, nil
+}
+
+// FakeFeatureFlagStore is a FeatureFlagStore for testing. Err, when set, is returned by ListFeatureFlags.
+type FakeFeatureFlagStore struct {
+	Flags []FeatureFlag
+	Err   error
+}
+
+func NewFakeFeatureFlagStore(flags ...FeatureFlag) *FakeFeatureFlagStore {
+	return &FakeFeatureFlagStore{Flags: flags}
+}
+
+func (s *FakeFeatureFlagStore) ListFeatureFlags() ([]FeatureFlag, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	return append([]FeatureFlag(nil), s.Flags...), nil
+}
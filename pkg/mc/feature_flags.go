@@ -0,0 +1,247 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// The features that can be turned on and off with feature flags. They are all on unless a flag turns them
+// off.
+const (
+	// FeatureProjectCreation is creating a project with mkdir at the root. It also needs
+	// Config.AllowProjectCreation.
+	FeatureProjectCreation = "project-creation"
+
+	// FeatureSymlinks is creating symbolic links over SFTP.
+	FeatureSymlinks = "symlinks"
+
+	// FeatureHardLinks is creating hard links over SFTP.
+	FeatureHardLinks = "hard-links"
+
+	// FeatureGuestAccess is logging in with a guest credential (see CreateGuest).
+	FeatureGuestAccess = "guest-access"
+
+	// FeatureConversions is queuing uploaded files for conversion to web viewable versions. Turning it off
+	// for a project opts the project out of conversions. See ConversionLimiter.
+	FeatureConversions = "conversions"
+
+	// FeatureDedup is storing an upload whose checksum matches an existing file by pointing it at that
+	// file's data, and treating a repeated upload as a retry (see IdempotentUploads). Turning it off for a
+	// project, such as a forensic project that must keep every uploaded byte stream verbatim, keeps the
+	// data of every upload. The checksums are still recorded. See VerbatimUploads.
+	FeatureDedup = "dedup"
+)
+
+// KnownFeatures lists the features that can be turned on and off.
+var KnownFeatures = []string{FeatureProjectCreation, FeatureSymlinks, FeatureHardLinks, FeatureGuestAccess, FeatureConversions, FeatureDedup}
+
+// ErrFeatureDisabled is returned for an operation whose feature is turned off for the user or project.
+var ErrFeatureDisabled = fmt.Errorf("this feature isn't enabled: %w", os.ErrPermission)
+
+// FeatureFlags decides whether a feature is enabled for a user in a project, so that capabilities can be
+// rolled out to some users or projects before everyone. The flags come from the server's configuration,
+// and, when there is a FeatureFlagStore, from the database, which Refresh reloads so that flags can be
+// changed without restarting the server.
+//
+// The most specific flag for the feature wins: a flag for the user in the project, then a flag for the
+// user, then a flag for the project, then a flag for everyone. When there are two flags at the same level
+// the one from the database wins. A feature without any flags is enabled. A nil *FeatureFlags enables
+// everything.
+type FeatureFlags struct {
+	static []FeatureFlag
+	store  FeatureFlagStore
+
+	mu    sync.RWMutex
+	flags []FeatureFlag
+}
+
+// NewFeatureFlags creates a FeatureFlags with the flags from the configuration. store may be nil when
+// flags aren't kept in the database.
+func NewFeatureFlags(flags []FeatureFlag, store FeatureFlagStore) *FeatureFlags {
+	return &FeatureFlags{static: flags, store: store, flags: flags}
+}
+
+// ParseFeatureFlags parses a comma separated list of feature flags, each of which is
+// name[@user:slug][@project:slug][=on|off], for example "symlinks=off,symlinks@project:beta-lab=on". A
+// flag without a value turns the feature on.
+func ParseFeatureFlags(spec string) ([]FeatureFlag, error) {
+	var flags []FeatureFlag
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		flag, err := parseFeatureFlag(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feature flag '%s': %s", entry, err)
+		}
+
+		flags = append(flags, flag)
+	}
+
+	return flags, nil
+}
+
+func parseFeatureFlag(entry string) (FeatureFlag, error) {
+	flag := FeatureFlag{Enabled: true}
+	if i := strings.LastIndex(entry, "="); i != -1 {
+		enabled, err := parseOnOff(entry[i+1:])
+		if err != nil {
+			return flag, err
+		}
+		flag.Enabled, entry = enabled, entry[:i]
+	}
+
+	parts := strings.Split(entry, "@")
+	flag.Name = parts[0]
+	if !isFeature(flag.Name) {
+		return flag, fmt.Errorf("unknown feature, must be one of %s", strings.Join(KnownFeatures, ", "))
+	}
+
+	for _, qualifier := range parts[1:] {
+		switch {
+		case strings.HasPrefix(qualifier, "user:") && flag.UserSlug == "":
+			flag.UserSlug = strings.TrimPrefix(qualifier, "user:")
+		case strings.HasPrefix(qualifier, "project:") && flag.ProjectSlug == "":
+			flag.ProjectSlug = strings.TrimPrefix(qualifier, "project:")
+		default:
+			return flag, fmt.Errorf("'%s' must be user:<slug> or project:<slug>", qualifier)
+		}
+	}
+
+	return flag, nil
+}
+
+// ParseFeatureFlagsFile parses a JSON list of feature flags, such as
+// [{"name": "symlinks", "project": "beta-lab", "enabled": true}].
+func ParseFeatureFlagsFile(data []byte) ([]FeatureFlag, error) {
+	var flags []FeatureFlag
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return nil, err
+	}
+
+	for _, flag := range flags {
+		if !isFeature(flag.Name) {
+			return nil, fmt.Errorf("unknown feature '%s', must be one of %s", flag.Name, strings.Join(KnownFeatures, ", "))
+		}
+	}
+
+	return flags, nil
+}
+
+func parseOnOff(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return strconv.ParseBool(value)
+	}
+}
+
+func isFeature(name string) bool {
+	for _, feature := range KnownFeatures {
+		if feature == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Refresh reloads the flags from the store. The flags from the last successful Refresh are kept when it
+// fails.
+func (f *FeatureFlags) Refresh() error {
+	if f.store == nil {
+		return nil
+	}
+
+	stored, err := f.store.ListFeatureFlags()
+	if err != nil {
+		log.Errorf("Unable to load feature flags: %s", err)
+		return err
+	}
+
+	// The stored flags come after the configured ones so that they win ties.
+	flags := make([]FeatureFlag, 0, len(f.static)+len(stored))
+	flags = append(append(flags, f.static...), stored...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flags = flags
+	return nil
+}
+
+// Run calls Refresh now, and then every interval until ctx is done.
+func (f *FeatureFlags) Run(ctx context.Context, interval time.Duration) {
+	_ = f.Refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = f.Refresh()
+		}
+	}
+}
+
+// Enabled returns true if feature is enabled for the user with userSlug in the project with projectSlug.
+// projectSlug is blank when there isn't a project, such as at login, in which case only the flags for
+// everyone and for the user apply.
+func (f *FeatureFlags) Enabled(feature, userSlug, projectSlug string) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	enabled, best := true, -1
+	for _, flag := range f.flags {
+		if flag.Name != feature ||
+			(flag.UserSlug != "" && flag.UserSlug != userSlug) ||
+			(flag.ProjectSlug != "" && flag.ProjectSlug != projectSlug) {
+			continue
+		}
+
+		specificity := 0
+		if flag.UserSlug != "" {
+			specificity += 2
+		}
+
+		if flag.ProjectSlug != "" {
+			specificity++
+		}
+
+		if specificity >= best {
+			enabled, best = flag.Enabled, specificity
+		}
+	}
+
+	return enabled
+}
+
+// Check returns ErrFeatureDisabled if feature isn't enabled for the user with userSlug in the project
+// with projectSlug.
+func (f *FeatureFlags) Check(feature, userSlug, projectSlug string) error {
+	if !f.Enabled(feature, userSlug, projectSlug) {
+		log.Infof("Feature %s is disabled for user %s in project %s", feature, userSlug, projectSlug)
+		return ErrFeatureDisabled
+	}
+
+	return nil
+}
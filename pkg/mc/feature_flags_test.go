@@ -0,0 +1,78 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFeatureFlags(t *testing.T) {
+	flags, err := ParseFeatureFlags("symlinks=off, symlinks@project:beta=on,hard-links@user:alice@project:beta=false,guest-access")
+	require.NoError(t, err)
+	require.Equal(t, []FeatureFlag{
+		{Name: FeatureSymlinks, Enabled: false},
+		{Name: FeatureSymlinks, ProjectSlug: "beta", Enabled: true},
+		{Name: FeatureHardLinks, UserSlug: "alice", ProjectSlug: "beta", Enabled: false},
+		{Name: FeatureGuestAccess, Enabled: true},
+	}, flags)
+
+	for _, spec := range []string{"delete=on", "symlinks=maybe", "symlinks@group:x", "symlinks@user:a@user:b"} {
+		_, err := ParseFeatureFlags(spec)
+		require.Error(t, err, spec)
+	}
+
+	flags, err = ParseFeatureFlagsFile([]byte(`[{"name": "symlinks", "project": "beta", "enabled": true}]`))
+	require.NoError(t, err)
+	require.Equal(t, []FeatureFlag{{Name: FeatureSymlinks, ProjectSlug: "beta", Enabled: true}}, flags)
+
+	_, err = ParseFeatureFlagsFile([]byte(`[{"name": "delete", "enabled": true}]`))
+	require.Error(t, err)
+}
+
+func TestFeatureFlags_Enabled(t *testing.T) {
+	flags, err := ParseFeatureFlags("symlinks=off,symlinks@project:beta=on,symlinks@user:bob=off,symlinks@user:carol@project:beta=off")
+	require.NoError(t, err)
+	features := NewFeatureFlags(flags, nil)
+
+	tests := []struct {
+		name     string
+		user     string
+		project  string
+		expected bool
+	}{
+		{name: "Off for everyone", user: "alice", project: "alpha", expected: false},
+		{name: "On for the project", user: "alice", project: "beta", expected: true},
+		{name: "User flag beats project flag", user: "bob", project: "beta", expected: false},
+		{name: "User in project flag beats the rest", user: "carol", project: "beta", expected: false},
+		{name: "No project at login", user: "alice", project: "", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, features.Enabled(FeatureSymlinks, test.user, test.project))
+		})
+	}
+
+	require.True(t, features.Enabled(FeatureHardLinks, "alice", "alpha"), "features without flags are enabled")
+	require.True(t, errors.Is(features.Check(FeatureSymlinks, "alice", "alpha"), os.ErrPermission))
+
+	var none *FeatureFlags
+	require.True(t, none.Enabled(FeatureSymlinks, "alice", "alpha"))
+}
+
+func TestFeatureFlags_Refresh(t *testing.T) {
+	store := NewFakeFeatureFlagStore(FeatureFlag{Name: FeatureSymlinks, Enabled: true})
+	features := NewFeatureFlags([]FeatureFlag{{Name: FeatureSymlinks, Enabled: false}}, store)
+	require.False(t, features.Enabled(FeatureSymlinks, "alice", "alpha"))
+
+	// The stored flag wins over the configured one at the same level.
+	require.NoError(t, features.Refresh())
+	require.True(t, features.Enabled(FeatureSymlinks, "alice", "alpha"))
+
+	// The flags are kept when they can't be reloaded.
+	store.Err = errors.New("database unavailable")
+	require.Error(t, features.Refresh())
+	require.True(t, features.Enabled(FeatureSymlinks, "alice", "alpha"))
+}
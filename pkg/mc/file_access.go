@@ -0,0 +1,214 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// FileAccessRecorder counts the downloads of each file, and when each file was last downloaded, so that
+// PIs can see which of their datasets are actually being used. Writing to the database on every download
+// would add a write to every read, so the counts are kept in memory and added to the FileAccessStore in a
+// batch by Flush, which Run calls every interval. Counts that fail to be written are kept and retried by
+// the next Flush. FileAccessRecorder implements expvar.Var so that it can be published with expvar.Publish.
+type FileAccessRecorder struct {
+	store FileAccessStore
+	now   func() time.Time
+
+	mu      sync.Mutex
+	pending map[int]*FileAccess
+	flushed int64
+	failed  int64
+}
+
+func NewFileAccessRecorder(store FileAccessStore) *FileAccessRecorder {
+	return &FileAccessRecorder{store: store, now: time.Now, pending: make(map[int]*FileAccess)}
+}
+
+// Downloaded counts a download of the file with fileID, at path in the project. A nil FileAccessRecorder
+// ignores the download.
+func (r *FileAccessRecorder) Downloaded(projectID, fileID int, path string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(FileAccess{FileID: fileID, ProjectID: projectID, Path: path, Downloads: 1, LastAccessedAt: r.now()})
+}
+
+// Accessed records a read of the file with fileID, at path in the project, that doesn't count as a
+// download, so that the file's LastAccessedAt is when it was last read. A nil FileAccessRecorder ignores
+// the read.
+func (r *FileAccessRecorder) Accessed(projectID, fileID int, path string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(FileAccess{FileID: fileID, ProjectID: projectID, Path: path, LastAccessedAt: r.now()})
+}
+
+// LastAccessTimes returns when the files, out of fileIDs, were last read, keyed by file id. The reads
+// that haven't been flushed yet are included. A nil FileAccessRecorder doesn't know of any reads.
+func (r *FileAccessRecorder) LastAccessTimes(fileIDs []int) (map[int]time.Time, error) {
+	if r == nil {
+		return map[int]time.Time{}, nil
+	}
+
+	times, err := r.store.LastAccessTimes(fileIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range fileIDs {
+		if pending, ok := r.pending[id]; ok && pending.LastAccessedAt.After(times[id]) {
+			times[id] = pending.LastAccessedAt
+		}
+	}
+
+	return times, nil
+}
+
+// AccessTime returns the access time reported for file. It is when the file was last read when
+// config.TrackAccessTimes is set and the file has been read, otherwise it is the file's modification time.
+func AccessTime(config *Config, recorder *FileAccessRecorder, file *mcmodel.File) time.Time {
+	if !config.TrackAccessTimes || recorder == nil {
+		return file.UpdatedAt
+	}
+
+	times, err := recorder.LastAccessTimes([]int{file.ID})
+	if err != nil {
+		log.Errorf("Unable to look up the access time of file %d: %s", file.ID, err)
+		return file.UpdatedAt
+	}
+
+	if accessed, ok := times[file.ID]; ok {
+		return accessed
+	}
+
+	return file.UpdatedAt
+}
+
+// add merges access into the pending counts. It must be called with mu held.
+func (r *FileAccessRecorder) add(access FileAccess) {
+	pending, ok := r.pending[access.FileID]
+	if !ok {
+		r.pending[access.FileID] = &access
+		return
+	}
+
+	pending.Downloads += access.Downloads
+	if access.LastAccessedAt.After(pending.LastAccessedAt) {
+		pending.ProjectID, pending.Path, pending.LastAccessedAt = access.ProjectID, access.Path, access.LastAccessedAt
+	}
+}
+
+// NewReader returns a reader that counts a download of the file once r returns io.EOF. A nil
+// FileAccessRecorder returns r.
+func (r *FileAccessRecorder) NewReader(reader io.Reader, projectID, fileID int, path string) io.Reader {
+	if r == nil {
+		return reader
+	}
+
+	return &fileAccessReader{Reader: reader, recorder: r, projectID: projectID, fileID: fileID, path: path}
+}
+
+type fileAccessReader struct {
+	io.Reader
+	recorder  *FileAccessRecorder
+	projectID int
+	fileID    int
+	path      string
+	recorded  bool
+}
+
+func (r *fileAccessReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if errors.Is(err, io.EOF) && !r.recorded {
+		r.recorded = true
+		r.recorder.Downloaded(r.projectID, r.fileID, r.path)
+	}
+
+	return n, err
+}
+
+// Flush adds the pending counts to the store. When the store fails the counts are kept for the next
+// Flush. A nil FileAccessRecorder has nothing to flush.
+func (r *FileAccessRecorder) Flush() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[int]*FileAccess)
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	accesses := make([]FileAccess, 0, len(pending))
+	for _, access := range pending {
+		accesses = append(accesses, *access)
+	}
+
+	err := r.store.AddFileAccesses(accesses)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("Unable to record the downloads of %d files: %s", len(accesses), err)
+		r.failed++
+		for _, access := range accesses {
+			r.add(access)
+		}
+		return err
+	}
+
+	r.flushed += int64(len(accesses))
+	return nil
+}
+
+// Run calls Flush every interval until ctx is done, and once more when it is.
+func (r *FileAccessRecorder) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			_ = r.Flush()
+			return
+		case <-ticker.C:
+			_ = r.Flush()
+		}
+	}
+}
+
+// String returns the number of files with counts waiting to be flushed, the number of file counts
+// flushed, and the number of flushes that failed, as JSON.
+func (r *FileAccessRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, _ := json.Marshal(struct {
+		Pending       int   `json:"pending"`
+		Flushed       int64 `json:"flushed"`
+		FailedFlushes int64 `json:"failed_flushes"`
+	}{len(r.pending), r.flushed, r.failed})
+
+	return string(b)
+}
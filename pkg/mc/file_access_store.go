@@ -0,0 +1,166 @@
+package mc
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FileAccess is the number of times a file has been downloaded, and when it was last downloaded. Path
+// is the project path of the file when it was last downloaded. When access times are tracked (see
+// Config.TrackAccessTimes) LastAccessedAt is when the file was last read, which includes reads that
+// didn't download the whole file.
+type FileAccess struct {
+	FileID         int `gorm:"primaryKey"`
+	ProjectID      int
+	Path           string
+	Downloads      int64
+	LastAccessedAt time.Time
+}
+
+// FileAccessStore holds the download counts of files. The counts are kept in the file_accesses table,
+// which mc-sshd adds to the Materials Commons database:
+//
+//	CREATE TABLE file_accesses (
+//	    file_id INT UNSIGNED PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    path VARCHAR(4096) NOT NULL,
+//	    downloads BIGINT UNSIGNED NOT NULL DEFAULT 0,
+//	    last_accessed_at TIMESTAMP NOT NULL,
+//	    INDEX (project_id, downloads)
+//	);
+type FileAccessStore interface {
+	// AddFileAccesses adds the Downloads of each access to the file's count, and moves the file's
+	// LastAccessedAt forward to the access's.
+	AddFileAccesses(accesses []FileAccess) error
+
+	// ListFileAccesses returns up to limit of the files in the project that have been downloaded, the
+	// most downloaded first.
+	ListFileAccesses(projectID, limit int) ([]FileAccess, error)
+
+	// LastAccessTimes returns the LastAccessedAt of the files, out of fileIDs, that have been read, keyed
+	// by file id.
+	LastAccessTimes(fileIDs []int) (map[int]time.Time, error)
+}
+
+func (FileAccess) TableName() string {
+	return "file_accesses"
+}
+
+type GormFileAccessStore struct {
+	db *gorm.DB
+}
+
+func NewGormFileAccessStore(db *gorm.DB) *GormFileAccessStore {
+	return &GormFileAccessStore{db: db}
+}
+
+// AddFileAccesses upserts the accesses in a single statement.
+func (s *GormFileAccessStore) AddFileAccesses(accesses []FileAccess) error {
+	if len(accesses) == 0 {
+		return nil
+	}
+
+	// MySQL refers to the inserted row with VALUES(), SQLite with excluded.
+	inserted, greatest := "VALUES(%s)", "GREATEST"
+	if isSQLite(s.db) {
+		inserted, greatest = "excluded.%s", "MAX"
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "file_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"project_id":       gorm.Expr(fmt.Sprintf(inserted, "project_id")),
+			"path":             gorm.Expr(fmt.Sprintf(inserted, "path")),
+			"downloads":        gorm.Expr("downloads + " + fmt.Sprintf(inserted, "downloads")),
+			"last_accessed_at": gorm.Expr(fmt.Sprintf("%s(last_accessed_at, %s)", greatest, fmt.Sprintf(inserted, "last_accessed_at"))),
+		}),
+	}).Create(&accesses).Error
+}
+
+func (s *GormFileAccessStore) ListFileAccesses(projectID, limit int) ([]FileAccess, error) {
+	var accesses []FileAccess
+	err := s.db.Where("project_id = ?", projectID).
+		Where("downloads > 0").
+		Order("downloads DESC").
+		Order("file_id").
+		Limit(limit).
+		Find(&accesses).Error
+
+	return accesses, err
+}
+
+func (s *GormFileAccessStore) LastAccessTimes(fileIDs []int) (map[int]time.Time, error) {
+	times := make(map[int]time.Time)
+	if len(fileIDs) == 0 {
+		return times, nil
+	}
+
+	var accesses []FileAccess
+	if err := s.db.Select("file_id", "last_accessed_at").Where("file_id IN ?", fileIDs).Find(&accesses).Error; err != nil {
+		return nil, err
+	}
+
+	for _, access := range accesses {
+		times[access.FileID] = access.LastAccessedAt
+	}
+
+	return times, nil
+}
+
+// FakeFileAccessStore is a FileAccessStore for testing. The counts are recorded in Accesses, keyed by
+// file id.
+type FakeFileAccessStore struct {
+	Accesses map[int]FileAccess
+}
+
+func NewFakeFileAccessStore() *FakeFileAccessStore {
+	return &FakeFileAccessStore{Accesses: make(map[int]FileAccess)}
+}
+
+func (s *FakeFileAccessStore) AddFileAccesses(accesses []FileAccess) error {
+	for _, access := range accesses {
+		existing, ok := s.Accesses[access.FileID]
+		if ok {
+			access.Downloads += existing.Downloads
+			if existing.LastAccessedAt.After(access.LastAccessedAt) {
+				access.LastAccessedAt = existing.LastAccessedAt
+			}
+		}
+		s.Accesses[access.FileID] = access
+	}
+
+	return nil
+}
+
+func (s *FakeFileAccessStore) ListFileAccesses(projectID, limit int) ([]FileAccess, error) {
+	var accesses []FileAccess
+	for _, access := range s.Accesses {
+		if access.ProjectID == projectID && access.Downloads > 0 {
+			accesses = append(accesses, access)
+		}
+	}
+
+	sort.Slice(accesses, func(i, j int) bool {
+		if accesses[i].Downloads != accesses[j].Downloads {
+			return accesses[i].Downloads > accesses[j].Downloads
+		}
+		return accesses[i].FileID < accesses[j].FileID
+	})
+
+	return accesses[:minInt(limit, len(accesses))], nil
+}
+
+func (s *FakeFileAccessStore) LastAccessTimes(fileIDs []int) (map[int]time.Time, error) {
+	times := make(map[int]time.Time)
+	for _, id := range fileIDs {
+		if access, ok := s.Accesses[id]; ok {
+			times[id] = access.LastAccessedAt
+		}
+	}
+
+	return times, nil
+}
@@ -0,0 +1,95 @@
+package mc
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+type failingFileAccessStore struct {
+	*FakeFileAccessStore
+	fail bool
+}
+
+func (s *failingFileAccessStore) AddFileAccesses(accesses []FileAccess) error {
+	if s.fail {
+		return errors.New("database unavailable")
+	}
+
+	return s.FakeFileAccessStore.AddFileAccesses(accesses)
+}
+
+func TestFileAccessRecorder(t *testing.T) {
+	store := &failingFileAccessStore{FakeFileAccessStore: NewFakeFileAccessStore()}
+	recorder := NewFileAccessRecorder(store)
+
+	first := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	recorder.now = func() time.Time { return first }
+	recorder.Downloaded(1, 10, "/data/a.csv")
+	recorder.Downloaded(1, 11, "/data/b.csv")
+
+	// Downloads are kept when the store fails, and written by the next flush.
+	store.fail = true
+	require.Error(t, recorder.Flush())
+	require.Empty(t, store.Accesses)
+
+	later := first.Add(time.Hour)
+	recorder.now = func() time.Time { return later }
+	recorder.Downloaded(1, 10, "/data/renamed.csv")
+
+	store.fail = false
+	require.NoError(t, recorder.Flush())
+	require.Equal(t, FileAccess{FileID: 10, ProjectID: 1, Path: "/data/renamed.csv", Downloads: 2, LastAccessedAt: later}, store.Accesses[10])
+	require.Equal(t, int64(1), store.Accesses[11].Downloads)
+
+	// A download read through to the end is counted once, a partial read isn't counted.
+	_, err := io.ReadAll(recorder.NewReader(strings.NewReader("contents"), 1, 11, "/data/b.csv"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(recorder.NewReader(strings.NewReader("contents"), 1, 12, "/data/c.csv"), make([]byte, 3))
+	require.NoError(t, err)
+	require.NoError(t, recorder.Flush())
+
+	accesses, err := store.ListFileAccesses(1, 10)
+	require.NoError(t, err)
+	require.Len(t, accesses, 2)
+	require.Equal(t, 10, accesses[0].FileID)
+	require.Equal(t, int64(2), accesses[1].Downloads)
+	require.Equal(t, later, accesses[1].LastAccessedAt)
+}
+
+func TestAccessTime(t *testing.T) {
+	store := NewFakeFileAccessStore()
+	recorder := NewFileAccessRecorder(store)
+
+	modified := time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC)
+	read := modified.Add(24 * time.Hour)
+	recorder.now = func() time.Time { return read }
+
+	file := &mcmodel.File{ID: 10, ProjectID: 1, UpdatedAt: modified}
+	config := &Config{TrackAccessTimes: true}
+
+	// Until the file is read its access time is its modification time.
+	require.Equal(t, modified, AccessTime(config, recorder, file))
+
+	// Reads are reported before they are flushed, but aren't counted as downloads.
+	recorder.Accessed(1, 10, "/data/a.csv")
+	require.Equal(t, read, AccessTime(config, recorder, file))
+	require.NoError(t, recorder.Flush())
+	require.Equal(t, read, AccessTime(config, recorder, file))
+
+	accesses, err := store.ListFileAccesses(1, 10)
+	require.NoError(t, err)
+	require.Empty(t, accesses)
+
+	times, err := recorder.LastAccessTimes([]int{10, 11})
+	require.NoError(t, err)
+	require.Equal(t, map[int]time.Time{10: read}, times)
+
+	require.Equal(t, modified, AccessTime(&Config{}, recorder, file))
+	require.Equal(t, modified, AccessTime(config, nil, file))
+}
@@ -0,0 +1,134 @@
+package mc
+
+import (
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// FileAuditStore lists the file records for storage integrity audits (see StorageVerifier).
+type FileAuditStore interface {
+	// ListStoredFiles returns up to limit of the finalized files, in the projects in projectIDs or in
+	// every project when projectIDs is empty. Only files with an ID greater than afterID are returned,
+	// and the files are ordered by ID, so that the files can be paged through. The files have their
+	// Directory loaded.
+	ListStoredFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error)
+
+	// ReferencedUUIDs returns the uuids, out of uuids, whose data is used by a file record, either as the
+	// file's own UUID or as the UsesUUID of a file that shares its data. Deleted files count as
+	// references, since their data is kept until they are purged.
+	ReferencedUUIDs(uuids []string) (map[string]bool, error)
+
+	// ListFilesWithChecksum returns up to limit of the finalized files whose data has checksum, which
+	// hold copies of the same data (see FileRepairer).
+	ListFilesWithChecksum(checksum string, limit int) ([]mcmodel.File, error)
+}
+
+type GormFileAuditStore struct {
+	db *gorm.DB
+}
+
+func NewGormFileAuditStore(db *gorm.DB) *GormFileAuditStore {
+	return &GormFileAuditStore{db: db}
+}
+
+// ListStoredFiles finds the finalized files. A file that has been finalized always has a checksum, files
+// without one are pending, and are handled by the Reconciler.
+func (s *GormFileAuditStore) ListStoredFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	query := s.db.Preload("Directory").
+		Where("checksum <> ?", "").
+		Where("mime_type <> ?", "directory").
+		Where("deleted_at IS NULL").
+		Where("id > ?", afterID)
+
+	if len(projectIDs) != 0 {
+		query = query.Where("project_id IN ?", projectIDs)
+	}
+
+	err := query.Order("id").Limit(limit).Find(&files).Error
+	return files, err
+}
+
+func (s *GormFileAuditStore) ReferencedUUIDs(uuids []string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	if len(uuids) == 0 {
+		return referenced, nil
+	}
+
+	var found []string
+	if err := s.db.Model(&mcmodel.File{}).Where("uuid IN ?", uuids).Pluck("uuid", &found).Error; err != nil {
+		return nil, err
+	}
+
+	var foundUses []string
+	if err := s.db.Model(&mcmodel.File{}).Where("uses_uuid IN ?", uuids).Pluck("uses_uuid", &foundUses).Error; err != nil {
+		return nil, err
+	}
+
+	for _, uuid := range append(found, foundUses...) {
+		referenced[uuid] = true
+	}
+
+	return referenced, nil
+}
+
+// ListFilesWithChecksum includes deleted files, since their data is kept until they are purged.
+func (s *GormFileAuditStore) ListFilesWithChecksum(checksum string, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	err := s.db.Where("checksum = ?", checksum).
+		Where("mime_type <> ?", "directory").
+		Order("id").
+		Limit(limit).
+		Find(&files).Error
+
+	return files, err
+}
+
+// FakeFileAuditStore is a FileAuditStore for testing that returns the files in Files.
+type FakeFileAuditStore struct {
+	Files []mcmodel.File
+}
+
+func NewFakeFileAuditStore(files ...mcmodel.File) *FakeFileAuditStore {
+	return &FakeFileAuditStore{Files: files}
+}
+
+func (s *FakeFileAuditStore) ListStoredFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error) {
+	inProjects := make(map[int]bool)
+	for _, id := range projectIDs {
+		inProjects[id] = true
+	}
+
+	var files []mcmodel.File
+	for _, f := range s.Files {
+		if f.ID > afterID && f.Checksum != "" && !f.IsDir() && (len(projectIDs) == 0 || inProjects[f.ProjectID]) && len(files) < limit {
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+func (s *FakeFileAuditStore) ReferencedUUIDs(uuids []string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, uuid := range uuids {
+		for _, f := range s.Files {
+			if f.UUID == uuid || f.UsesUUID == uuid {
+				referenced[uuid] = true
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+func (s *FakeFileAuditStore) ListFilesWithChecksum(checksum string, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	for _, f := range s.Files {
+		if checksum != "" && f.Checksum == checksum && !f.IsDir() && len(files) < limit {
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
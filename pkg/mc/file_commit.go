@@ -0,0 +1,81 @@
+package mc
+
+import (
+	"errors"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// Creating a file version is done in two steps with the file data written in between. First the file is
+// created with FileStore.CreateFile, which adds a file record that isn't current, so it doesn't show up
+// in listings. Then, once the data has been written, the file is finalized with FileStore.DoneWritingToFile.
+// If anything fails between or during these steps the file record and any data written for it have to be
+// removed, otherwise the record is left dangling. CommitFile and AbortFile take care of this so that either
+// the complete file version exists or nothing does.
+
+// CommitFile finalizes file, which was created with FileStore.CreateFile and whose data has been completely
+// written. All the metadata updates are made in a single transaction. If the transaction fails then the
+// file is aborted (see AbortFile). CommitFile returns true if an existing file with the same checksum was
+// found, in which case file now points at it and the data written for file can be deleted. An upload that
+// repeats the current version of the file (see IdempotentUploads) is removed, and file is set to the
+// current version. An empty file is given EmptyFileChecksum, and keeps its own data rather than pointing at
+// some other empty file.
+func CommitFile(stores *Stores, file *mcmodel.File, checksum string, size int64, mcfsRoot string) (bool, error) {
+	var switched bool
+
+	if size == 0 {
+		checksum = EmptyFileChecksum
+	}
+
+	err := stores.Transaction(func(tx *Stores) error {
+		var err error
+		switched, err = tx.FileStore.DoneWritingToFile(file, checksum, size, tx.ConversionStore)
+		if err == nil && switched && size == 0 {
+			switched = false
+			err = tx.FileStore.UpdateFileUses(file, file.UUID, file.ID)
+		}
+		return err
+	})
+
+	var repeated *RepeatedUploadError
+	if errors.As(err, &repeated) {
+		log.Infof("Upload of file %d in project %d repeats file %d, keeping that version", file.ID, file.ProjectID, repeated.Current.ID)
+		if abortErr := AbortFile(stores, file, mcfsRoot); abortErr != nil {
+			return false, abortErr
+		}
+
+		*file = *repeated.Current
+		return false, nil
+	}
+
+	if err != nil {
+		log.Errorf("Failed finalizing file %d in project %d, removing it: %s", file.ID, file.ProjectID, err)
+		if abortErr := AbortFile(stores, file, mcfsRoot); abortErr != nil {
+			return false, abortErr
+		}
+
+		return false, err
+	}
+
+	return switched, nil
+}
+
+// AbortFile removes file, which was created with FileStore.CreateFile but never finalized, along with any
+// data that was written for it.
+func AbortFile(stores *Stores, file *mcmodel.File, mcfsRoot string) error {
+	if err := stores.PendingFileStore.DeletePendingFile(file); err != nil {
+		log.Errorf("Failed removing unfinished file %d in project %d: %s", file.ID, file.ProjectID, err)
+		return err
+	}
+
+	// Use the path for the file's own UUID. If the file was switched to point at an existing file before
+	// the failure, the path it points at belongs to that other file.
+	if err := os.Remove(file.ToUnderlyingFilePathForUUID(mcfsRoot)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Failed removing data for unfinished file %d: %s", file.ID, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// failingFileStore fails DoneWritingToFile.
+type failingFileStore struct {
+	store.FileStore
+}
+
+func (s *failingFileStore) DoneWritingToFile(_ *mcmodel.File, _ string, _ int64, _ store.ConversionStore) (bool, error) {
+	return false, errors.New("done writing failed")
+}
+
+func TestCommitFile_FailureRemovesFile(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	file := &mcmodel.File{ID: 10, ProjectID: 1, UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"}
+	require.Nil(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0777))
+	require.Nil(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), []byte("data"), 0666))
+
+	pendingFileStore := NewFakePendingFileStore()
+	stores := &Stores{
+		FileStore:        &failingFileStore{},
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: pendingFileStore,
+	}
+
+	switched, err := CommitFile(stores, file, "checksum", 4, mcfsRoot)
+	require.NotNil(t, err, "CommitFile should have failed")
+	require.False(t, switched)
+	require.Equal(t, []int{10}, pendingFileStore.DeletedFileIDs, "The file record should have been removed")
+
+	_, err = os.Stat(file.ToUnderlyingFilePath(mcfsRoot))
+	require.True(t, errors.Is(err, os.ErrNotExist), "The file data should have been removed")
+}
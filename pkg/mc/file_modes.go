@@ -0,0 +1,142 @@
+package mc
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultFileMode is the mode reported for files and directories when no ModeRule applies.
+const DefaultFileMode os.FileMode = 0777
+
+// ModeRule sets the permissions reported for the files and directories in a project, or for a user. The
+// permissions are only reported to clients, for example so that files in a private project are copied
+// as 0600 by scp -p and show as 0600 on sshfs mounts. They don't change who can access the files.
+type ModeRule struct {
+	// ProjectSlug is the slug of the project the rule applies to. It is blank for user rules and for the
+	// default rule.
+	ProjectSlug string
+
+	// UserSlug is the slug of the user the rule applies to. It is blank for project rules and for the
+	// default rule.
+	UserSlug string
+
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+// ParseModeRules parses a comma separated list of mode rules of the form project:slug=mode,
+// user:slug=mode or *=mode. The mode is an octal file mode, optionally followed by /dir-mode. When the
+// directory mode isn't given it is the file mode with execute permission added wherever it has read
+// permission, for example "project:shared=0640,user:alice=0600/0700,*=0644".
+func ParseModeRules(rules string) ([]ModeRule, error) {
+	var modeRules []ModeRule
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		i := strings.Index(rule, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid mode rule '%s', expected project:slug=mode, user:slug=mode or *=mode", rule)
+		}
+
+		var modeRule ModeRule
+		switch target := rule[:i]; {
+		case target == "*":
+		case strings.HasPrefix(target, "project:") && len(target) > len("project:"):
+			modeRule.ProjectSlug = strings.TrimPrefix(target, "project:")
+		case strings.HasPrefix(target, "user:") && len(target) > len("user:"):
+			modeRule.UserSlug = strings.TrimPrefix(target, "user:")
+		default:
+			return nil, fmt.Errorf("invalid mode rule '%s', expected project:slug=mode, user:slug=mode or *=mode", rule)
+		}
+
+		modes := strings.SplitN(rule[i+1:], "/", 2)
+		fileMode, err := parseFileMode(modes[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode rule '%s': %s", rule, err)
+		}
+
+		modeRule.FileMode = fileMode
+		modeRule.DirMode = fileMode | (fileMode&0444)>>2
+		if len(modes) == 2 {
+			if modeRule.DirMode, err = parseFileMode(modes[1]); err != nil {
+				return nil, fmt.Errorf("invalid mode rule '%s': %s", rule, err)
+			}
+		}
+
+		modeRules = append(modeRules, modeRule)
+	}
+
+	return modeRules, nil
+}
+
+func parseFileMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("'%s' is not an octal mode between 0 and 0777", mode)
+	}
+
+	return os.FileMode(m), nil
+}
+
+// FileModes returns the permissions reported for files and directories in the project with projectSlug
+// to the user with userSlug. A rule for the project takes precedence over a rule for the user, which takes
+// precedence over the default rule. Without any matching rule DefaultFileMode is used for both.
+func (c *Config) FileModes(projectSlug, userSlug string) (fileMode, dirMode os.FileMode) {
+	var userRule, defaultRule *ModeRule
+	for i, rule := range c.ModeRules {
+		switch {
+		case rule.ProjectSlug != "":
+			if rule.ProjectSlug == projectSlug {
+				return rule.FileMode, rule.DirMode
+			}
+		case rule.UserSlug != "":
+			if rule.UserSlug == userSlug && userRule == nil {
+				userRule = &c.ModeRules[i]
+			}
+		case defaultRule == nil:
+			defaultRule = &c.ModeRules[i]
+		}
+	}
+
+	switch {
+	case userRule != nil:
+		return userRule.FileMode, userRule.DirMode
+	case defaultRule != nil:
+		return defaultRule.FileMode, defaultRule.DirMode
+	default:
+		return DefaultFileMode, DefaultFileMode
+	}
+}
+
+// modeFileInfo replaces the permissions of a os.FileInfo.
+type modeFileInfo struct {
+	os.FileInfo
+	perm os.FileMode
+}
+
+func (fi modeFileInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode()&^os.ModePerm | fi.perm
+}
+
+// ModeFileInfo returns fi with the permissions from config.FileModes when it is a regular file or a
+// directory. Other entries, such as links, keep their permissions.
+func ModeFileInfo(config *Config, projectSlug, userSlug string, fi os.FileInfo) os.FileInfo {
+	if len(config.ModeRules) == 0 {
+		return fi
+	}
+
+	fileMode, dirMode := config.FileModes(projectSlug, userSlug)
+	switch {
+	case fi.Mode().IsDir():
+		return modeFileInfo{FileInfo: fi, perm: dirMode}
+	case fi.Mode().IsRegular():
+		return modeFileInfo{FileInfo: fi, perm: fileMode}
+	default:
+		return fi
+	}
+}
@@ -0,0 +1,59 @@
+package mc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_FileModes(t *testing.T) {
+	rules, err := ParseModeRules("user:alice=0600/0700, project:shared=0640, *=0644")
+	require.NoError(t, err)
+	config := &Config{ModeRules: rules}
+
+	tests := []struct {
+		project  string
+		user     string
+		fileMode os.FileMode
+		dirMode  os.FileMode
+	}{
+		{"shared", "alice", 0640, 0750},
+		{"private", "alice", 0600, 0700},
+		{"private", "bob", 0644, 0755},
+	}
+
+	for _, test := range tests {
+		fileMode, dirMode := config.FileModes(test.project, test.user)
+		require.Equal(t, test.fileMode, fileMode, "%s/%s", test.project, test.user)
+		require.Equal(t, test.dirMode, dirMode, "%s/%s", test.project, test.user)
+	}
+
+	// Without rules everything is reported as 0777.
+	fileMode, dirMode := (&Config{}).FileModes("shared", "alice")
+	require.Equal(t, DefaultFileMode, fileMode)
+	require.Equal(t, DefaultFileMode, dirMode)
+
+	for _, invalid := range []string{"0644", "group:x=0644", "project:=0644", "*=0999", "*=rw", "*=0644/x"} {
+		_, err := ParseModeRules(invalid)
+		require.Error(t, err, "ParseModeRules should have failed for %s", invalid)
+	}
+}
+
+func TestModeFileInfo(t *testing.T) {
+	rules, err := ParseModeRules("project:private=0600")
+	require.NoError(t, err)
+	config := &Config{ModeRules: rules, WriteOncePaths: []PathRule{{ProjectSlug: "private", Prefix: "/raw"}}}
+
+	file := mcmodel.File{Name: "a.txt", MimeType: "text/plain"}.ToFileInfo()
+	dir := mcmodel.File{Name: "raw", MimeType: "directory"}.ToFileInfo()
+
+	require.Equal(t, os.FileMode(0600), ModeFileInfo(config, "private", "alice", file).Mode())
+	require.Equal(t, os.ModeDir|0700, ModeFileInfo(config, "private", "alice", dir).Mode())
+	require.Equal(t, os.FileMode(0777), ModeFileInfo(config, "other", "alice", file).Mode())
+
+	// Write-once paths still drop the write permissions.
+	fi := WriteOnceFileInfo(config, "private", "/raw/a.txt", ModeFileInfo(config, "private", "alice", file))
+	require.Equal(t, os.FileMode(0400), fi.Mode())
+}
@@ -0,0 +1,322 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// EventFileRepaired is the Event.Type for a file whose damaged data was restored by a FileRepairer.
+const EventFileRepaired = "file.repaired"
+
+// The outcomes of repairing a file.
+const (
+	// RepairIntact is a file whose data turned out to be intact, for example because it was restored
+	// by hand. Its damaged flag is cleared.
+	RepairIntact = "intact"
+
+	// RepairRestored is a file whose data was restored.
+	RepairRestored = "restored"
+
+	// RepairFailed is a file whose data couldn't be restored from any source.
+	RepairFailed = "failed"
+)
+
+// maxChecksumTwins is the number of other files with the same checksum that are tried as sources.
+const maxChecksumTwins = 20
+
+// RepairOutcome is what happened to a single file in a repair. It is written to the report as a line of
+// JSON. Source is where the data was restored from, either "file <id>" for another file with the same
+// checksum, or "replica".
+type RepairOutcome struct {
+	Outcome        string `json:"outcome"`
+	FileID         int    `json:"file_id"`
+	ProjectID      int    `json:"project_id"`
+	Path           string `json:"path,omitempty"`
+	UUID           string `json:"uuid"`
+	UnderlyingPath string `json:"underlying_path"`
+	Source         string `json:"source,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// RepairResult counts the files checked by a FileRepairer, and what happened to them.
+type RepairResult struct {
+	Checked  int
+	Intact   int
+	Restored int
+	Failed   int
+}
+
+func (r RepairResult) String() string {
+	return fmt.Sprintf("%d checked, %d intact, %d restored, %d failed", r.Checked, r.Intact, r.Restored, r.Failed)
+}
+
+// FileRepairer restores the data of files that is missing or doesn't match its checksum. The data is
+// restored from another file record with the same checksum whose data is intact, or from the Replica, a
+// FileServer at another site that has a copy of the data. Restored data is checked against the checksum
+// before it is renamed into place, so a repair never makes a file worse.
+//
+// Run repairs the files flagged as damaged (see ReportMissingData), or every file when All is set. A
+// server can also repair files in the background as they are found to be damaged, see Queue.
+type FileRepairer struct {
+	stores   *Stores
+	mcfsRoot string
+
+	// Replica is the FileServer that data is restored from when no other file has a copy. It is nil when
+	// data is only restored from other files.
+	Replica *RemoteFileCache
+
+	// ProjectIDs limits the repair to these projects. When it is empty every project is repaired.
+	ProjectIDs []int
+
+	// All checks every finalized file, not only the files flagged as damaged. The files found to be
+	// damaged that can't be restored are flagged.
+	All bool
+
+	// BatchSize is the number of files loaded at a time.
+	BatchSize int
+
+	// Report receives the outcome for each file that isn't intact. When it is nil the outcomes are only
+	// counted.
+	Report io.Writer
+
+	// Events receives an EventFileRepaired event for each file restored.
+	Events EventSink
+
+	queue chan mcmodel.File
+}
+
+func NewFileRepairer(stores *Stores, mcfsRoot string) *FileRepairer {
+	return &FileRepairer{
+		stores:    stores,
+		mcfsRoot:  mcfsRoot,
+		BatchSize: 500,
+		Events:    NewLogEventSink(),
+		queue:     make(chan mcmodel.File, 100),
+	}
+}
+
+// Run repairs the files. An error is returned when the files couldn't be listed or the report couldn't be
+// written, the failures to repair individual files are reported and counted in the result.
+func (r *FileRepairer) Run(ctx context.Context) (RepairResult, error) {
+	var result RepairResult
+	var report *json.Encoder
+	if r.Report != nil {
+		report = json.NewEncoder(r.Report)
+	}
+
+	afterID := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		files, err := r.listFiles(ctx, afterID)
+		if err != nil {
+			log.Errorf("Unable to load files to repair: %s", err)
+			return result, err
+		}
+
+		if len(files) == 0 {
+			return result, nil
+		}
+
+		for i := range files {
+			outcome := r.Repair(ctx, &files[i])
+			afterID = files[i].ID
+
+			result.Checked++
+			switch outcome.Outcome {
+			case RepairIntact:
+				result.Intact++
+				continue
+			case RepairRestored:
+				result.Restored++
+			default:
+				result.Failed++
+			}
+
+			if report == nil {
+				continue
+			}
+
+			if err := report.Encode(outcome); err != nil {
+				log.Errorf("Unable to write repair report: %s", err)
+				return result, err
+			}
+		}
+	}
+}
+
+// listFiles returns the next batch of files to repair, those with an ID greater than afterID.
+func (r *FileRepairer) listFiles(ctx context.Context, afterID int) ([]mcmodel.File, error) {
+	stores := r.stores.WithContext(ctx)
+	if r.All {
+		return stores.FileAuditStore.ListStoredFiles(r.ProjectIDs, afterID, r.BatchSize)
+	}
+
+	return stores.DamagedFileStore.ListDamagedFiles(r.ProjectIDs, afterID, r.BatchSize)
+}
+
+// Repair checks a single file's data, and restores it if it is damaged. The file's damaged flag is
+// cleared when its data is intact or has been restored. When All is set, a file that couldn't be
+// restored is flagged.
+func (r *FileRepairer) Repair(ctx context.Context, file *mcmodel.File) *RepairOutcome {
+	stores := r.stores.WithContext(ctx)
+	outcome := &RepairOutcome{
+		FileID:    file.ID,
+		ProjectID: file.ProjectID,
+		UUID:      file.UUIDForPath(),
+	}
+
+	if file.Directory != nil {
+		outcome.Path = file.FullPath()
+	}
+
+	if !hasUnderlyingPath(file) {
+		outcome.Outcome, outcome.Error = RepairFailed, "invalid uuid"
+		return outcome
+	}
+
+	outcome.UnderlyingPath = file.ToUnderlyingFilePath(r.mcfsRoot)
+	checksum, size, err := checksumFile(outcome.UnderlyingPath)
+	if err == nil && checksum == file.Checksum && uint64(size) == file.Size {
+		outcome.Outcome = RepairIntact
+		r.clearDamaged(stores, file.ID)
+		return outcome
+	}
+
+	reason := VerifyMismatch
+	if errors.Is(err, os.ErrNotExist) {
+		reason = VerifyMissing
+	}
+
+	if outcome.Source, err = r.restore(stores, file, outcome.UnderlyingPath); err != nil {
+		log.Errorf("Unable to repair file %d (%s): %s", file.ID, outcome.UnderlyingPath, err)
+		outcome.Outcome, outcome.Error = RepairFailed, err.Error()
+
+		// Files that are already flagged keep their flag.
+		if r.All {
+			damaged := DamagedFile{FileID: file.ID, ProjectID: file.ProjectID, Path: outcome.Path, Reason: reason, DetectedAt: time.Now()}
+			if err := stores.DamagedFileStore.MarkFileDamaged(damaged); err != nil {
+				log.Errorf("Unable to flag file %d as damaged: %s", file.ID, err)
+			}
+		}
+
+		return outcome
+	}
+
+	log.Infof("Repaired file %d (%s) from %s", file.ID, outcome.UnderlyingPath, outcome.Source)
+	outcome.Outcome = RepairRestored
+	r.clearDamaged(stores, file.ID)
+
+	r.Events.Emit(Event{
+		Type:      EventFileRepaired,
+		Time:      time.Now(),
+		ProjectID: file.ProjectID,
+		Path:      outcome.Path,
+		Details: map[string]string{
+			"file_id": strconv.Itoa(file.ID),
+			"uuid":    outcome.UUID,
+			"reason":  reason,
+			"source":  outcome.Source,
+		},
+	})
+
+	return outcome
+}
+
+// restore writes the data for file to path from the first source that has data matching the file's
+// checksum. It returns the source used.
+func (r *FileRepairer) restore(stores *Stores, file *mcmodel.File, path string) (string, error) {
+	if file.Checksum == "" {
+		return "", errors.New("the file has no checksum to check a copy against")
+	}
+
+	twins, err := stores.FileAuditStore.ListFilesWithChecksum(file.Checksum, maxChecksumTwins)
+	if err != nil {
+		return "", err
+	}
+
+	var errs []string
+	for _, twin := range twins {
+		// Files that share the data are stored in the same place.
+		if twin.UUIDForPath() == file.UUIDForPath() || twin.Size != file.Size || !hasUnderlyingPath(&twin) {
+			continue
+		}
+
+		source := "file " + strconv.Itoa(twin.ID)
+		if err := copyVerifiedFile(twin.ToUnderlyingFilePath(r.mcfsRoot), path, file.Checksum); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", source, err))
+			continue
+		}
+
+		return source, nil
+	}
+
+	if r.Replica != nil {
+		err := func() error {
+			body, err := r.Replica.get(file.UUIDForPath())
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+			return writeVerifiedFile(body, path, file.Checksum)
+		}()
+
+		if err == nil {
+			return "replica", nil
+		}
+
+		errs = append(errs, fmt.Sprintf("replica: %s", err))
+	}
+
+	if len(errs) == 0 {
+		return "", errors.New("no copy of the data was found")
+	}
+
+	return "", fmt.Errorf("no intact copy of the data was found (%s)", strings.Join(errs, "; "))
+}
+
+// clearDamaged removes the damaged flag from a file. Failing to is only logged, since the file will be
+// checked again by the next repair.
+func (r *FileRepairer) clearDamaged(stores *Stores, fileID int) {
+	if err := stores.DamagedFileStore.ClearFileDamaged(fileID); err != nil {
+		log.Errorf("Unable to clear the damaged flag of file %d: %s", fileID, err)
+	}
+}
+
+// Queue asks for file to be repaired in the background by RunQueue. Files are dropped, and left to the
+// next repair run, when the queue is full. A nil FileRepairer does nothing.
+func (r *FileRepairer) Queue(file *mcmodel.File) {
+	if r == nil {
+		return
+	}
+
+	select {
+	case r.queue <- *file:
+	default:
+		log.Warnf("Not repairing file %d in the background, the repair queue is full", file.ID)
+	}
+}
+
+// RunQueue repairs the files passed to Queue, one at a time, until ctx is done.
+func (r *FileRepairer) RunQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-r.queue:
+			r.Repair(ctx, &file)
+		}
+	}
+}
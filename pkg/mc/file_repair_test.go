@@ -0,0 +1,94 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRepairer_Run(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	replicaRoot := t.TempDir()
+	dir := &mcmodel.File{ID: 1, Name: "/", Path: "/", ProjectID: 1, MimeType: "directory"}
+
+	// "data" has the md5 checksum 8d777f385d3dfec8815d20f7496026dc, "other" 795f3202b17cb6bc3d4b771d8c6c9eaf.
+	file := func(id int, uuid, checksum string) mcmodel.File {
+		return mcmodel.File{ID: id, Name: uuid[:8] + ".txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+			UUID: uuid, Checksum: checksum, Size: uint64(len("data"))}
+	}
+	twin := file(10, "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", "8d777f385d3dfec8815d20f7496026dc")
+	missing := file(11, "bbbbbbbb-bbbb-cccc-dddd-eeeeeeeeeeee", twin.Checksum)
+	corrupt := file(12, "cccccccc-bbbb-cccc-dddd-eeeeeeeeeeee", "795f3202b17cb6bc3d4b771d8c6c9eaf")
+	lost := file(13, "dddddddd-bbbb-cccc-dddd-eeeeeeeeeeee", "00000000000000000000000000000000")
+	corrupt.Size = uint64(len("other"))
+
+	write := func(root string, f mcmodel.File, contents string) {
+		require.NoError(t, os.MkdirAll(f.ToUnderlyingDirPath(root), 0777))
+		require.NoError(t, os.WriteFile(f.ToUnderlyingFilePath(root), []byte(contents), 0666))
+	}
+	write(mcfsRoot, twin, "data")
+	write(mcfsRoot, corrupt, "otter")
+	write(replicaRoot, corrupt, "other")
+
+	replica := httptest.NewTLSServer(NewFileServer("secret", replicaRoot))
+	defer replica.Close()
+
+	damagedStore := NewFakeDamagedFileStore(twin, missing, corrupt, lost)
+	stores := &Stores{FileAuditStore: NewFakeFileAuditStore(twin, missing, corrupt, lost), DamagedFileStore: damagedStore}
+	for _, f := range []mcmodel.File{twin, missing, lost} {
+		require.NoError(t, damagedStore.MarkFileDamaged(DamagedFile{FileID: f.ID, ProjectID: 1, Reason: VerifyMissing}))
+	}
+
+	var report bytes.Buffer
+	events := &eventCollector{}
+	repairer := NewFileRepairer(stores, mcfsRoot)
+	repairer.Replica = newTestRemoteFileCache(t, replica, "secret", mcfsRoot)
+	repairer.Events = events
+	repairer.Report = &report
+
+	// Only the flagged files are repaired. The twin was flagged by mistake and is intact.
+	result, err := repairer.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, RepairResult{Checked: 3, Intact: 1, Restored: 1, Failed: 1}, result)
+
+	data, err := os.ReadFile(missing.ToUnderlyingFilePath(mcfsRoot))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data), "The missing file is restored from its twin")
+
+	var outcomes []RepairOutcome
+	decoder := json.NewDecoder(&report)
+	for decoder.More() {
+		var outcome RepairOutcome
+		require.NoError(t, decoder.Decode(&outcome))
+		outcomes = append(outcomes, outcome)
+	}
+
+	require.Len(t, outcomes, 2)
+	require.Equal(t, RepairRestored, outcomes[0].Outcome)
+	require.Equal(t, "file 10", outcomes[0].Source)
+	require.Equal(t, RepairFailed, outcomes[1].Outcome)
+	require.Equal(t, lost.ID, outcomes[1].FileID)
+
+	require.Len(t, damagedStore.Damaged, 1, "Only the file that couldn't be restored is still flagged")
+	require.Contains(t, damagedStore.Damaged, lost.ID)
+	require.Len(t, events.events, 1)
+	require.Equal(t, EventFileRepaired, events.events[0].Type)
+
+	// Checking every file finds the corrupt file, which is restored from the replica.
+	repairer.All = true
+	repairer.Report = nil
+	result, err = repairer.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, RepairResult{Checked: 4, Intact: 2, Restored: 1, Failed: 1}, result)
+
+	data, err = os.ReadFile(corrupt.ToUnderlyingFilePath(mcfsRoot))
+	require.NoError(t, err)
+	require.Equal(t, "other", string(data))
+	require.Equal(t, VerifyMissing, damagedStore.Damaged[lost.ID].Reason)
+}
@@ -0,0 +1,251 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// DefaultFileWatchBuffer is the number of recently uploaded files a FileWatcher keeps for the clients
+// watching for them.
+const DefaultFileWatchBuffer = 10000
+
+// NewFile is a file that finished uploading, as returned to the clients watching the directory tree it
+// is in. Path is the file's path in the project, without the project slug.
+type NewFile struct {
+	ProjectID  int       `json:"project_id"`
+	FileID     int       `json:"file_id"`
+	Path       string    `json:"path"`
+	Size       uint64    `json:"size"`
+	Checksum   string    `json:"checksum"`
+	UploadedAt time.Time `json:"uploaded_at"`
+
+	// seq orders the files added to a FileWatcher.
+	seq uint64
+}
+
+// FileRelay passes new files between mc-sshd instances, so that clients watching for files on one
+// instance hear about the files uploaded to the others. Each file published is passed to the Add method of
+// every instance's FileWatcher, including the publisher's (see the mcredis package).
+type FileRelay interface {
+	Publish(file NewFile) error
+}
+
+// FileWatcher lets clients wait for the files uploaded to a directory tree, so that downstream processing
+// can start as soon as data arrives rather than by listing directories every few seconds. Like the
+// UploadHookRunner, the files are queued by its Middleware and looked up in the background, by Run. The
+// most recent files are kept in memory, and each client follows them with a cursor, returned by Wait. A
+// cursor is only meaningful to the FileWatcher that returned it, so a client that comes back to another
+// instance, or after a restart, or that falls so far behind that the files it hasn't seen have been
+// dropped, is told that it missed files, and should list the directory to catch up.
+type FileWatcher struct {
+	stores *Stores
+
+	// Relay, when set, publishes the files uploaded to this instance to every instance.
+	Relay FileRelay
+
+	// queue holds the files waiting to be looked up.
+	queue chan mcmodel.File
+
+	// epoch identifies this FileWatcher in its cursors.
+	epoch string
+
+	mu     sync.Mutex
+	recent []NewFile
+	size   int
+	seq    uint64
+
+	// added is closed, and replaced, each time a file is added, to wake up the waiting clients.
+	added chan struct{}
+}
+
+// NewFileWatcher creates a FileWatcher that keeps the last size files uploaded. Files are looked up
+// with stores.
+func NewFileWatcher(stores *Stores, size int) *FileWatcher {
+	if size < 1 {
+		size = DefaultFileWatchBuffer
+	}
+
+	return &FileWatcher{
+		stores: stores,
+		queue:  make(chan mcmodel.File, 1000),
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:   size,
+		added:  make(chan struct{}),
+	}
+}
+
+// Middleware returns a StoreMiddleware that queues each file that FileStore.DoneWritingToFile finished.
+func (w *FileWatcher) Middleware() StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &watchFileStore{FileStore: fileStore, watcher: w}
+		},
+	}
+}
+
+// Run looks up the queued files, and adds them, or publishes them when there is a Relay, until ctx is done.
+func (w *FileWatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-w.queue:
+			newFile, err := w.lookup(&file)
+			switch {
+			case err != nil:
+				log.Errorf("Unable to look up new file %d in project %d for watchers: %s", file.ID, file.ProjectID, err)
+			case newFile == nil:
+			case w.Relay != nil:
+				if err := w.Relay.Publish(*newFile); err != nil {
+					log.Errorf("Unable to publish new file %d in project %d to watchers: %s", file.ID, file.ProjectID, err)
+				}
+			default:
+				w.Add(*newFile)
+			}
+		}
+	}
+}
+
+// lookup returns the stored version of file, which has its directory. It returns nil if the upload was
+// rolled back.
+func (w *FileWatcher) lookup(file *mcmodel.File) (*NewFile, error) {
+	versions, err := w.stores.VersionStore.ListVersions(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		if version.ID == file.ID && version.Directory != nil {
+			return &NewFile{
+				ProjectID:  version.ProjectID,
+				FileID:     version.ID,
+				Path:       version.FullPath(),
+				Size:       version.Size,
+				Checksum:   version.Checksum,
+				UploadedAt: version.UpdatedAt,
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Add adds file to the recent files and wakes up the clients waiting for it.
+func (w *FileWatcher) Add(file NewFile) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	file.seq = w.seq
+	if len(w.recent) == w.size {
+		w.recent = w.recent[1:]
+	}
+	w.recent = append(w.recent, file)
+
+	close(w.added)
+	w.added = make(chan struct{})
+}
+
+// Wait returns up to limit of the files added to the directory tree at dirPath, in the project with
+// projectID, after cursor. It waits until there is at least one, or ctx is done. A blank cursor starts
+// with the files added after the call. It also returns the cursor to pass to the next call, and true if
+// files may have been missed since cursor.
+func (w *FileWatcher) Wait(ctx context.Context, projectID int, dirPath, cursor string, limit int) ([]NewFile, string, bool) {
+	w.mu.Lock()
+	after, missed := w.parseCursor(cursor)
+	w.mu.Unlock()
+
+	for {
+		w.mu.Lock()
+		var files []NewFile
+		for _, file := range w.recent {
+			if file.seq <= after {
+				continue
+			}
+
+			if file.ProjectID == projectID && inTree(dirPath, file.Path) {
+				files = append(files, file)
+				if len(files) == limit {
+					after = file.seq
+					break
+				}
+			}
+			after = file.seq
+		}
+		added := w.added
+		w.mu.Unlock()
+
+		if len(files) != 0 || missed {
+			return files, w.cursor(after), missed
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, w.cursor(after), false
+		case <-added:
+		}
+	}
+}
+
+// parseCursor returns the sequence number of the last file seen at cursor, and true if files may have been
+// missed since then. It must be called with mu held.
+func (w *FileWatcher) parseCursor(cursor string) (uint64, bool) {
+	if cursor == "" {
+		return w.seq, false
+	}
+
+	i := strings.LastIndex(cursor, "-")
+	if i == -1 || cursor[:i] != w.epoch {
+		return w.seq, true
+	}
+
+	after, err := strconv.ParseUint(cursor[i+1:], 10, 64)
+	if err != nil || after > w.seq {
+		return w.seq, true
+	}
+
+	// The files after the cursor have been dropped once the oldest kept file is more than one past it.
+	if len(w.recent) != 0 && w.recent[0].seq > after+1 {
+		return w.recent[0].seq - 1, true
+	}
+
+	return after, false
+}
+
+func (w *FileWatcher) cursor(after uint64) string {
+	return fmt.Sprintf("%s-%d", w.epoch, after)
+}
+
+// inTree returns true if path is in the directory tree at dirPath.
+func inTree(dirPath, path string) bool {
+	dirPath = filepath.Clean(dirPath)
+	return dirPath == "/" || strings.HasPrefix(path, dirPath+"/")
+}
+
+// watchFileStore queues files on the watcher after DoneWritingToFile succeeds.
+type watchFileStore struct {
+	store.FileStore
+	watcher *FileWatcher
+}
+
+func (s *watchFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	switched, err := s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+	if err == nil {
+		select {
+		case s.watcher.queue <- *file:
+		default:
+			log.Errorf("File watch queue is full, not notifying watchers of file %d in project %d", file.ID, file.ProjectID)
+		}
+	}
+
+	return switched, err
+}
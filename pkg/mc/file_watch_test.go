@@ -0,0 +1,58 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileWatcher_Wait(t *testing.T) {
+	watcher := NewFileWatcher(nil, 3)
+	ctx := context.Background()
+
+	// A blank cursor only sees the files added after it.
+	watcher.Add(NewFile{ProjectID: 1, FileID: 1, Path: "/raw/before.txt"})
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	files, cursor, missed := watcher.Wait(timeout, 1, "/raw", "", 10)
+	cancel()
+	require.Empty(t, files)
+	require.False(t, missed)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		watcher.Add(NewFile{ProjectID: 2, FileID: 2, Path: "/raw/other-project.txt"})
+		watcher.Add(NewFile{ProjectID: 1, FileID: 3, Path: "/processed/a.txt"})
+		watcher.Add(NewFile{ProjectID: 1, FileID: 4, Path: "/raw/run1/a.txt"})
+	}()
+
+	files, cursor, missed = watcher.Wait(ctx, 1, "/raw", cursor, 10)
+	require.False(t, missed)
+	require.Len(t, files, 1)
+	require.Equal(t, 4, files[0].FileID)
+
+	// Only the files after the cursor are returned, up to the limit.
+	watcher.Add(NewFile{ProjectID: 1, FileID: 5, Path: "/raw/b.txt"})
+	watcher.Add(NewFile{ProjectID: 1, FileID: 6, Path: "/raw/c.txt"})
+	files, cursor, missed = watcher.Wait(ctx, 1, "/", cursor, 1)
+	require.False(t, missed)
+	require.Len(t, files, 1)
+	require.Equal(t, 5, files[0].FileID)
+
+	files, _, _ = watcher.Wait(ctx, 1, "/", cursor, 10)
+	require.Len(t, files, 1)
+	require.Equal(t, 6, files[0].FileID)
+
+	// Files dropped from the buffer, and cursors from another watcher, are reported as missed.
+	for id := 7; id <= 10; id++ {
+		watcher.Add(NewFile{ProjectID: 1, FileID: id, Path: "/raw/d.txt"})
+	}
+	files, _, missed = watcher.Wait(ctx, 1, "/raw", cursor, 10)
+	require.True(t, missed)
+	require.Len(t, files, 3)
+
+	files, _, missed = watcher.Wait(ctx, 1, "/raw", "other-1", 10)
+	require.True(t, missed)
+	require.Empty(t, files)
+}
@@ -0,0 +1,141 @@
+package mc
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// findBatchSize is the number of files walkTree loads at a time.
+const findBatchSize = 1000
+
+// FindQuery selects the files in a directory tree listed by mc find. A zero value field matches every
+// file.
+type FindQuery struct {
+	// Name is a glob, in the syntax of path.Match, that the file's name must match.
+	Name string
+
+	// Newer is the time that the file must have been changed after.
+	Newer time.Time
+
+	// Type is "f" to match only files, or "d" to match only directories.
+	Type string
+}
+
+// findDateLayouts are the layouts accepted for -newer, tried in order.
+var findDateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// ParseFindQuery parses the find style tests in args, -name glob, -newer date and -type f|d. Dates are
+// either a day, such as 2024-06-01, or a time in RFC 3339 format. Dates without a time zone are in UTC.
+func ParseFindQuery(args []string) (FindQuery, error) {
+	var q FindQuery
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return q, fmt.Errorf("missing argument to %s", args[i])
+		}
+
+		value := args[i+1]
+		switch args[i] {
+		case "-name":
+			if _, err := path.Match(value, ""); err != nil {
+				return q, fmt.Errorf("invalid -name pattern '%s'", value)
+			}
+			q.Name = value
+		case "-newer":
+			var err error
+			if q.Newer, err = parseFindDate(value); err != nil {
+				return q, err
+			}
+		case "-type":
+			if value != "f" && value != "d" {
+				return q, fmt.Errorf("invalid -type '%s', expected f or d", value)
+			}
+			q.Type = value
+		default:
+			return q, fmt.Errorf("unknown test '%s'", args[i])
+		}
+	}
+
+	return q, nil
+}
+
+func parseFindDate(value string) (time.Time, error) {
+	for _, layout := range findDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid -newer date '%s', expected a date such as 2024-06-01", value)
+}
+
+// Match returns true if file passes all the tests in q.
+func (q FindQuery) Match(file *mcmodel.File) bool {
+	switch {
+	case q.Type == "f" && file.IsDir(), q.Type == "d" && !file.IsDir():
+		return false
+	case !q.Newer.IsZero() && !file.UpdatedAt.After(q.Newer):
+		return false
+	case q.Name != "":
+		// Directories are named by their whole path.
+		name := file.Name
+		if file.IsDir() {
+			name = path.Base(file.Path)
+		}
+
+		matched, _ := path.Match(q.Name, name)
+		return matched
+	default:
+		return true
+	}
+}
+
+// findPath returns the project path of file. The tree pages have the Directory of each file loaded, but
+// the root directory has no parent.
+func findPath(file *mcmodel.File) string {
+	if file.IsDir() || file.Directory == nil {
+		return file.Path
+	}
+
+	return file.FullPath()
+}
+
+// FindFiles calls fn with the project path of each file in the directory tree at dirPath that matches q,
+// in the order the files were created. It stops at the first error returned by fn.
+func FindFiles(stores *Stores, projectID int, dirPath string, q FindQuery, fn func(path string) error) error {
+	return walkTree(stores, projectID, dirPath, func(file *mcmodel.File) error {
+		if !q.Match(file) {
+			return nil
+		}
+		return fn(findPath(file))
+	})
+}
+
+// walkTree calls fn with each file and directory in the directory tree at dirPath, in the order they were
+// created. The files are read from the ListingStore a batch at a time, so large trees can be walked
+// without loading them all at once. It stops at the first error returned by fn.
+func walkTree(stores *Stores, projectID int, dirPath string, fn func(file *mcmodel.File) error) error {
+	afterID := 0
+	for {
+		files, err := stores.ListingStore.ListTreePage(projectID, dirPath, afterID, findBatchSize)
+		if err != nil {
+			log.Errorf("Unable to list the tree at %s in project %d: %s", dirPath, projectID, err)
+			return err
+		}
+
+		for i := range files {
+			if err := fn(&files[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(files) < findBatchSize {
+			return nil
+		}
+
+		afterID = files[len(files)-1].ID
+	}
+}
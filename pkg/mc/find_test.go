@@ -0,0 +1,74 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFindQuery(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected FindQuery
+		valid    bool
+	}{
+		{nil, FindQuery{}, true},
+		{[]string{"-name", "*.tif"}, FindQuery{Name: "*.tif"}, true},
+		{[]string{"-newer", "2024-06-01", "-type", "f"}, FindQuery{Newer: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), Type: "f"}, true},
+		{[]string{"-newer", "2024-06-01T12:30:00Z"}, FindQuery{Newer: time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)}, true},
+		{[]string{"-name"}, FindQuery{}, false},
+		{[]string{"-name", "[a"}, FindQuery{}, false},
+		{[]string{"-newer", "June"}, FindQuery{}, false},
+		{[]string{"-type", "l"}, FindQuery{}, false},
+		{[]string{"-size", "10"}, FindQuery{}, false},
+	}
+
+	for _, test := range tests {
+		q, err := ParseFindQuery(test.args)
+		if !test.valid {
+			require.Error(t, err, "%v should be invalid", test.args)
+			continue
+		}
+
+		require.NoError(t, err, "%v should be valid", test.args)
+		require.Equal(t, test.expected, q)
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	stores := &Stores{ListingStore: NewFakeListingStore(
+		mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		mcmodel.File{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", DirectoryID: 1, MimeType: "directory"},
+		mcmodel.File{ID: 3, ProjectID: 1, Name: "a.tif", DirectoryID: 2, MimeType: "image/tiff", UpdatedAt: old},
+		mcmodel.File{ID: 4, ProjectID: 1, Name: "b.tif", DirectoryID: 2, MimeType: "image/tiff", UpdatedAt: recent},
+		mcmodel.File{ID: 5, ProjectID: 1, Name: "notes.txt", DirectoryID: 2, MimeType: "text/plain", UpdatedAt: recent},
+		mcmodel.File{ID: 6, ProjectID: 1, Name: "c.tif", DirectoryID: 1, MimeType: "image/tiff", UpdatedAt: recent},
+		mcmodel.File{ID: 7, ProjectID: 2, Name: "d.tif", DirectoryID: 8, MimeType: "image/tiff", UpdatedAt: recent},
+	)}
+
+	tests := []struct {
+		dir      string
+		query    FindQuery
+		expected []string
+	}{
+		{"/raw", FindQuery{}, []string{"/raw", "/raw/a.tif", "/raw/b.tif", "/raw/notes.txt"}},
+		{"/raw", FindQuery{Name: "*.tif"}, []string{"/raw/a.tif", "/raw/b.tif"}},
+		{"/raw", FindQuery{Name: "*.tif", Newer: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}, []string{"/raw/b.tif"}},
+		{"/", FindQuery{Name: "*.tif"}, []string{"/raw/a.tif", "/raw/b.tif", "/c.tif"}},
+		{"/", FindQuery{Type: "d"}, []string{"/", "/raw"}},
+	}
+
+	for _, test := range tests {
+		var found []string
+		err := FindFiles(stores, 1, test.dir, test.query, func(path string) error {
+			found = append(found, path)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, test.expected, found, "%s %+v", test.dir, test.query)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package mc
+
+import "errors"
+
+// FreeSpace returns the number of bytes available on the filesystem containing path. It is only
+// supported on Linux.
+func FreeSpace(_ string) (int64, error) {
+	return 0, errors.New("free space is only supported on linux")
+}
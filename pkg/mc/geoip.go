@@ -0,0 +1,173 @@
+package mc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// EventLogin is the Event.Type for a user logging in. Its details include the user, the remote address
+// and, when a GeoIP database is configured, the country and autonomous system of the address.
+const EventLogin = "session.login"
+
+// EventConnectionRejected is the Event.Type for a connection refused because of where it came from.
+const EventConnectionRejected = "connection.rejected"
+
+// GeoInfo is where an address is, as found in the GeoIP databases. Fields that aren't in the databases
+// are left blank.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, such as "US".
+	Country string
+
+	// ASN is the autonomous system number, and ASOrg the organization it is registered to.
+	ASN   uint64
+	ASOrg string
+}
+
+// AddTo adds the country and autonomous system to an event's details.
+func (g GeoInfo) AddTo(details map[string]string) {
+	if g.Country != "" {
+		details["country"] = g.Country
+	}
+
+	if g.ASN != 0 {
+		details["asn"] = strconv.FormatUint(g.ASN, 10)
+	}
+
+	if g.ASOrg != "" {
+		details["as_org"] = g.ASOrg
+	}
+}
+
+// GeoIP looks up addresses in MaxMind DB files, such as GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb.
+// When several databases are given the fields found in each are combined.
+type GeoIP struct {
+	dbs []*mmdb
+}
+
+// NewGeoIP opens the MaxMind DB files at paths.
+func NewGeoIP(paths []string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range paths {
+		db, err := openMMDB(path)
+		if err != nil {
+			log.Errorf("Unable to open GeoIP database %s: %s", path, err)
+			return nil, err
+		}
+		g.dbs = append(g.dbs, db)
+	}
+
+	return g, nil
+}
+
+// Lookup returns where ip is. A nil GeoIP finds nothing.
+func (g *GeoIP) Lookup(ip net.IP) GeoInfo {
+	var info GeoInfo
+	if g == nil || ip == nil {
+		return info
+	}
+
+	for _, db := range g.dbs {
+		value, err := db.lookup(ip)
+		if err != nil {
+			log.Errorf("Unable to look up %s in GeoIP database: %s", ip, err)
+			continue
+		}
+
+		record, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if info.Country == "" {
+			info.Country = mmdbCountry(record, "country")
+		}
+
+		if info.Country == "" {
+			info.Country = mmdbCountry(record, "registered_country")
+		}
+
+		if asn, ok := record["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = asn
+		}
+
+		if org, ok := record["autonomous_system_organization"].(string); ok && info.ASOrg == "" {
+			info.ASOrg = org
+		}
+	}
+
+	return info
+}
+
+// LookupAddr returns where the remote address of a connection is.
+func (g *GeoIP) LookupAddr(addr net.Addr) GeoInfo {
+	if g == nil || addr == nil {
+		return GeoInfo{}
+	}
+
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return g.Lookup(tcpAddr.IP)
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	return g.Lookup(net.ParseIP(host))
+}
+
+func mmdbCountry(record map[string]interface{}, key string) string {
+	country, _ := record[key].(map[string]interface{})
+	isoCode, _ := country["iso_code"].(string)
+	return isoCode
+}
+
+// CountryFilter decides which countries connections are accepted from, for deployments that have to keep
+// out connections from some countries, such as for export control. When Allow is set only connections
+// from those countries are accepted, including rejecting connections whose country isn't known.
+// Connections from the countries in Deny are always rejected.
+type CountryFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// ParseCountryList parses a comma separated list of ISO 3166-1 alpha-2 country codes, such as "US,CA".
+func ParseCountryList(countries string) []string {
+	var list []string
+	for _, country := range strings.Split(countries, ",") {
+		if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+			list = append(list, country)
+		}
+	}
+
+	return list
+}
+
+// Allowed returns true if connections from country are accepted. country is blank when it isn't known.
+func (f CountryFilter) Allowed(country string) bool {
+	for _, denied := range f.Deny {
+		if denied == country {
+			return false
+		}
+	}
+
+	if len(f.Allow) == 0 {
+		return true
+	}
+
+	for _, allowed := range f.Allow {
+		if allowed == country {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsEmpty returns true if the filter accepts every connection.
+func (f CountryFilter) IsEmpty() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
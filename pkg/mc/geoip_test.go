@@ -0,0 +1,167 @@
+package mc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMMDB writes a small IPv4 MaxMind DB with 24 bit records.
+type testMMDB struct {
+	// nodes holds the left and right records of each node. Records that point at data are negative
+	// (-1 - offset into data) until the node count is known, and records that are 0 are empty.
+	nodes [][2]int
+	data  []byte
+}
+
+func (m *testMMDB) insert(cidr string, record map[string]interface{}) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := network.Mask.Size()
+	ip := network.IP.To4()
+
+	if len(m.nodes) == 0 {
+		m.nodes = append(m.nodes, [2]int{})
+	}
+
+	offset := len(m.data)
+	m.data = append(m.data, encodeTestMMDB(record)...)
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if i == ones-1 {
+			m.nodes[node][bit] = -1 - offset
+			break
+		}
+
+		if m.nodes[node][bit] <= 0 {
+			m.nodes = append(m.nodes, [2]int{})
+			m.nodes[node][bit] = len(m.nodes) - 1
+		}
+		node = m.nodes[node][bit]
+	}
+}
+
+func (m *testMMDB) bytes() []byte {
+	var buf []byte
+	nodeCount := len(m.nodes)
+	for _, node := range m.nodes {
+		for _, r := range node {
+			switch {
+			case r < 0:
+				r = nodeCount + 16 + (-1 - r)
+			case r == 0:
+				r = nodeCount
+			}
+			buf = append(buf, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, m.data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return append(buf, encodeTestMMDB(map[string]interface{}{
+		"node_count":  uint64(nodeCount),
+		"record_size": uint64(24),
+		"ip_version":  uint64(4),
+	})...)
+}
+
+// encodeTestMMDB encodes maps, strings shorter than 285 bytes and numbers in the MaxMind DB data format.
+func encodeTestMMDB(value interface{}) []byte {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf := []byte{mmdbMap<<5 | byte(len(v))}
+		for _, key := range keys {
+			buf = append(buf, encodeTestMMDB(key)...)
+			buf = append(buf, encodeTestMMDB(v[key])...)
+		}
+		return buf
+	case string:
+		if len(v) >= 29 {
+			return append([]byte{mmdbString<<5 | 29, byte(len(v) - 29)}, v...)
+		}
+		return append([]byte{mmdbString<<5 | byte(len(v))}, v...)
+	case uint64:
+		return []byte{mmdbUint32<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	panic("unsupported type")
+}
+
+func TestGeoIP_Lookup(t *testing.T) {
+	countries := &testMMDB{}
+	countries.insert("10.0.0.0/8", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+	})
+	countries.insert("192.168.1.0/24", map[string]interface{}{
+		"registered_country": map[string]interface{}{"iso_code": "CA"},
+	})
+
+	asns := &testMMDB{}
+	asns.insert("10.1.0.0/16", map[string]interface{}{
+		"autonomous_system_number":       uint64(64512),
+		"autonomous_system_organization": "Example University",
+	})
+
+	dir := t.TempDir()
+	countriesPath := filepath.Join(dir, "country.mmdb")
+	asnsPath := filepath.Join(dir, "asn.mmdb")
+	require.NoError(t, os.WriteFile(countriesPath, countries.bytes(), 0644))
+	require.NoError(t, os.WriteFile(asnsPath, asns.bytes(), 0644))
+
+	geoIP, err := NewGeoIP([]string{countriesPath, asnsPath})
+	require.NoError(t, err)
+
+	tests := []struct {
+		addr     string
+		expected GeoInfo
+	}{
+		{"10.1.2.3", GeoInfo{Country: "US", ASN: 64512, ASOrg: "Example University"}},
+		{"10.2.0.1", GeoInfo{Country: "US"}},
+		{"192.168.1.10", GeoInfo{Country: "CA"}},
+		{"192.168.2.10", GeoInfo{}},
+		{"2001:db8::1", GeoInfo{}},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expected, geoIP.Lookup(net.ParseIP(test.addr)), test.addr)
+	}
+
+	geo := geoIP.LookupAddr(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22})
+	details := make(map[string]string)
+	geo.AddTo(details)
+	require.Equal(t, map[string]string{"country": "US", "asn": "64512", "as_org": "Example University"}, details)
+
+	var none *GeoIP
+	require.Equal(t, GeoInfo{}, none.Lookup(net.ParseIP("10.1.2.3")))
+
+	_, err = newMMDB([]byte("not a database"))
+	require.Error(t, err)
+}
+
+func TestCountryFilter_Allowed(t *testing.T) {
+	allow := CountryFilter{Allow: ParseCountryList("us, ca")}
+	require.True(t, allow.Allowed("US"))
+	require.False(t, allow.Allowed("FR"))
+	require.False(t, allow.Allowed(""))
+
+	deny := CountryFilter{Deny: ParseCountryList("FR")}
+	require.False(t, deny.Allowed("FR"))
+	require.True(t, deny.Allowed("US"))
+	require.True(t, deny.Allowed(""))
+
+	require.True(t, CountryFilter{}.IsEmpty())
+}
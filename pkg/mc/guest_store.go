@@ -0,0 +1,235 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// GuestSlugPrefix starts the slug of every guest, so that guests can't be confused with Materials
+// Commons users.
+const GuestSlugPrefix = "guest-"
+
+// Limits on how long guest credentials last.
+const (
+	DefaultGuestTTL = 7 * 24 * time.Hour
+	MaxGuestTTL     = 30 * 24 * time.Hour
+)
+
+// EventProjectGuest is the Event.Type for a guest being added to or removed from a project.
+const EventProjectGuest = "project.guest"
+
+// ErrGuestNotFound is returned for a guest slug that doesn't exist or has expired.
+var ErrGuestNotFound = errors.New("no such guest")
+
+// Guest is a temporary credential that lets an external collaborator upload into a single directory of a
+// project, without a Materials Commons account. A guest can only upload, like an instrument account with
+// one drop box (see Config.CheckDropBoxAccess), and its files are owned by the user that created it.
+type Guest struct {
+	ID            int
+	Slug          string
+	Password      string
+	ProjectID     int
+	Path          string
+	CreatedByID   int
+	CreatedBySlug string
+	ExpiresAt     time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// GuestStore holds the guests. Guests are kept in the guest_credentials table, which mc-sshd adds to the
+// Materials Commons database:
+//
+//	CREATE TABLE guest_credentials (
+//	    id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+//	    slug VARCHAR(64) NOT NULL UNIQUE,
+//	    password VARCHAR(255) NOT NULL,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    path VARCHAR(4096) NOT NULL,
+//	    created_by_id INT UNSIGNED NOT NULL,
+//	    created_by_slug VARCHAR(255) NOT NULL DEFAULT '',
+//	    expires_at TIMESTAMP NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    updated_at TIMESTAMP NULL,
+//	    INDEX (project_id)
+//	);
+type GuestStore interface {
+	// CreateGuest adds a guest.
+	CreateGuest(guest *Guest) error
+
+	// GetGuest returns the guest with slug. It returns ErrGuestNotFound if there is no such guest, or
+	// the guest has expired.
+	GetGuest(slug string) (*Guest, error)
+
+	// ListGuests returns the project's guests that haven't expired, ordered by slug.
+	ListGuests(projectID int) ([]Guest, error)
+
+	// DeleteGuest removes the project's guest with slug. It returns ErrGuestNotFound if the project
+	// has no such guest.
+	DeleteGuest(projectID int, slug string) error
+}
+
+func (Guest) TableName() string {
+	return "guest_credentials"
+}
+
+type GormGuestStore struct {
+	db *gorm.DB
+}
+
+func NewGormGuestStore(db *gorm.DB) *GormGuestStore {
+	return &GormGuestStore{db: db}
+}
+
+// CreateGuest also removes the project's expired guests, so that they don't pile up.
+func (s *GormGuestStore) CreateGuest(guest *Guest) error {
+	if err := s.db.Where("project_id = ?", guest.ProjectID).Where("expires_at <= ?", time.Now()).Delete(&Guest{}).Error; err != nil {
+		log.Errorf("Unable to remove the expired guests of project %d: %s", guest.ProjectID, err)
+	}
+
+	return s.db.Create(guest).Error
+}
+
+func (s *GormGuestStore) GetGuest(slug string) (*Guest, error) {
+	var guest Guest
+	err := s.db.Where("slug = ?", slug).Where("expires_at > ?", time.Now()).First(&guest).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, ErrGuestNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	return &guest, nil
+}
+
+func (s *GormGuestStore) ListGuests(projectID int) ([]Guest, error) {
+	var guests []Guest
+	err := s.db.Where("project_id = ?", projectID).
+		Where("expires_at > ?", time.Now()).
+		Order("slug").
+		Find(&guests).Error
+
+	return guests, err
+}
+
+func (s *GormGuestStore) DeleteGuest(projectID int, slug string) error {
+	result := s.db.Where("project_id = ?", projectID).Where("slug = ?", slug).Delete(&Guest{})
+	switch {
+	case result.Error != nil:
+		return result.Error
+	case result.RowsAffected == 0:
+		return ErrGuestNotFound
+	}
+
+	return nil
+}
+
+// FakeGuestStore is a GuestStore for testing. The guests are recorded in Guests, keyed by slug.
+type FakeGuestStore struct {
+	Guests map[string]Guest
+	now    func() time.Time
+}
+
+func NewFakeGuestStore() *FakeGuestStore {
+	return &FakeGuestStore{Guests: make(map[string]Guest), now: time.Now}
+}
+
+func (s *FakeGuestStore) CreateGuest(guest *Guest) error {
+	guest.ID = len(s.Guests) + 1
+	s.Guests[guest.Slug] = *guest
+	return nil
+}
+
+func (s *FakeGuestStore) GetGuest(slug string) (*Guest, error) {
+	guest, ok := s.Guests[slug]
+	if !ok || !guest.ExpiresAt.After(s.now()) {
+		return nil, ErrGuestNotFound
+	}
+
+	return &guest, nil
+}
+
+func (s *FakeGuestStore) ListGuests(projectID int) ([]Guest, error) {
+	var guests []Guest
+	for _, guest := range s.Guests {
+		if guest.ProjectID == projectID && guest.ExpiresAt.After(s.now()) {
+			guests = append(guests, guest)
+		}
+	}
+
+	sort.Slice(guests, func(i, j int) bool { return guests[i].Slug < guests[j].Slug })
+	return guests, nil
+}
+
+func (s *FakeGuestStore) DeleteGuest(projectID int, slug string) error {
+	guest, ok := s.Guests[slug]
+	if !ok || guest.ProjectID != projectID {
+		return ErrGuestNotFound
+	}
+
+	delete(s.Guests, slug)
+	return nil
+}
+
+// CreateGuest adds a guest that can upload into path in project until ttl has passed, and returns the
+// guest and its password. The password is only stored hashed, so it can't be shown again.
+func CreateGuest(stores *Stores, project *mcmodel.Project, createdBy *mcmodel.User, path string, ttl time.Duration) (*Guest, string, error) {
+	if ttl <= 0 || ttl > MaxGuestTTL {
+		return nil, "", fmt.Errorf("guests can last at most %s", MaxGuestTTL)
+	}
+
+	slug, password, hash, err := newScopedCredential(GuestSlugPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	guest := &Guest{
+		Slug:          slug,
+		Password:      hash,
+		ProjectID:     project.ID,
+		Path:          filepath.Clean("/" + path),
+		CreatedByID:   createdBy.ID,
+		CreatedBySlug: createdBy.Slug,
+		ExpiresAt:     time.Now().Add(ttl),
+	}
+
+	if err := stores.GuestStore.CreateGuest(guest); err != nil {
+		log.Errorf("Unable to create a guest for project %d: %s", project.ID, err)
+		return nil, "", err
+	}
+
+	return guest, password, nil
+}
+
+// AuthenticateGuest checks the password of the guest with slug. It returns the user that the guest's
+// sessions run as, which has the guest's slug and the ID of the user that created the guest, and
+// registers the guest's write-only scope in scopes.
+func AuthenticateGuest(stores *Stores, scopes *ScopeRegistry, slug, password string) (*mcmodel.User, error) {
+	guest, err := stores.GuestStore.GetGuest(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(guest.Password), []byte(password)); err != nil {
+		return nil, err
+	}
+
+	project, err := stores.ProjectStore.GetProjectByID(guest.ProjectID)
+	if err != nil {
+		log.Errorf("Unable to find project %d for guest %s: %s", guest.ProjectID, slug, err)
+		return nil, err
+	}
+
+	scopes.Add(slug, guest.CreatedBySlug, Scope{Rule: PathRule{ProjectSlug: project.Slug, Prefix: guest.Path}, Write: true}, guest.ExpiresAt)
+
+	return &mcmodel.User{ID: guest.CreatedByID, Slug: slug, Name: "Guest " + slug}, nil
+}
@@ -0,0 +1,58 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuests(t *testing.T) {
+	project := mcmodel.Project{ID: 1, Slug: "proj"}
+	owner := &mcmodel.User{ID: 7, Slug: "owner"}
+	guestStore := NewFakeGuestStore()
+	stores := &Stores{ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{project}), GuestStore: guestStore}
+	config := DefaultConfig()
+
+	guest, password, err := CreateGuest(stores, &project, owner, "incoming/partner", time.Hour)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(guest.Slug, GuestSlugPrefix))
+	require.Equal(t, "/incoming/partner", guest.Path)
+	require.NotEqual(t, password, guest.Password, "Only the hash of the password is stored")
+
+	_, err = AuthenticateGuest(stores, config.Scopes, guest.Slug, "wrong")
+	require.Error(t, err)
+	require.False(t, config.IsInstrumentAccount(guest.Slug))
+
+	user, err := AuthenticateGuest(stores, config.Scopes, guest.Slug, password)
+	require.NoError(t, err)
+	require.Equal(t, owner.ID, user.ID, "Uploads are owned by the user that created the guest")
+	require.Equal(t, guest.Slug, user.Slug)
+	require.Equal(t, owner.Slug, config.Scopes.Owner(guest.Slug))
+
+	// The guest can only upload into its directory.
+	require.True(t, config.IsInstrumentAccount(guest.Slug))
+	require.False(t, config.CanCreateProjects(guest.Slug))
+	require.NoError(t, config.CheckDropBoxAccess(guest.Slug, "proj", "/incoming/partner/data.csv", DropBoxWrite))
+	require.ErrorIs(t, config.CheckDropBoxAccess(guest.Slug, "proj", "/incoming/partner/data.csv", DropBoxRead), ErrDropBoxOnly)
+	require.ErrorIs(t, config.CheckDropBoxAccess(guest.Slug, "proj", "/results/data.csv", DropBoxWrite), ErrDropBoxOnly)
+	require.NoError(t, config.CheckDropBoxAccess(owner.Slug, "proj", "/results/data.csv", DropBoxRead))
+
+	// Once the guest has expired it can't log in, and its open sessions can't do anything.
+	later := time.Now().Add(2 * time.Hour)
+	guestStore.now = func() time.Time { return later }
+	config.Scopes.now = func() time.Time { return later }
+	_, err = AuthenticateGuest(stores, config.Scopes, guest.Slug, password)
+	require.ErrorIs(t, err, ErrGuestNotFound)
+	require.ErrorIs(t, config.CheckDropBoxAccess(guest.Slug, "proj", "/incoming/partner/data.csv", DropBoxWrite), ErrOutOfScope)
+	require.ErrorIs(t, config.CheckDropBoxAccess(guest.Slug, "", "/", DropBoxStat), ErrOutOfScope)
+
+	_, _, err = CreateGuest(stores, &project, owner, "/incoming", MaxGuestTTL+time.Hour)
+	require.Error(t, err)
+
+	require.NoError(t, guestStore.DeleteGuest(project.ID, guest.Slug))
+	require.ErrorIs(t, guestStore.DeleteGuest(project.ID, guest.Slug), ErrGuestNotFound)
+}
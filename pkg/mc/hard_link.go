@@ -0,0 +1,58 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// ErrCrossProjectLink is returned for a hard link to a file in another project.
+var ErrCrossProjectLink = fmt.Errorf("%w: hard links can't cross projects", syscall.EXDEV)
+
+// ErrLinkDirectory is returned for a hard link to a directory.
+var ErrLinkDirectory = fmt.Errorf("%w: directories can't be hard linked", os.ErrPermission)
+
+// ErrLinkUnfinished is returned for a hard link to a file that is still being uploaded.
+var ErrLinkUnfinished = errors.New("the file is still being uploaded")
+
+// LinkFile hard links source into dir as name, so that the same data can be found under a second path
+// without storing it twice. The link is a new file, owned by ownerID, that uses the data of source the
+// same way an upload of a file that is already stored does (see FileStore.PointAtExistingIfExists). It is
+// created and finalized like an upload, with CommitFile, so either the link exists or nothing does.
+// Unlike a POSIX hard link the two files are independent from then on, a new version of one doesn't
+// change the other.
+func LinkFile(stores *Stores, source, dir *mcmodel.File, name string, ownerID int, mcfsRoot string) (*mcmodel.File, error) {
+	switch {
+	case source.IsDir():
+		return nil, ErrLinkDirectory
+	case source.ProjectID != dir.ProjectID:
+		return nil, ErrCrossProjectLink
+	case source.Checksum == "":
+		return nil, ErrLinkUnfinished
+	}
+
+	link, err := stores.FileStore.CreateFile(name, dir.ProjectID, dir.ID, ownerID, source.MimeType)
+	if err != nil {
+		log.Errorf("Unable to create link %s/%s to file %d: %s", dir.Path, name, source.ID, err)
+		return nil, err
+	}
+
+	if err := stores.FileStore.UpdateFileUses(link, source.UUIDForUses(), source.IDForUses()); err != nil {
+		log.Errorf("Unable to point link %d at file %d: %s", link.ID, source.ID, err)
+		_ = AbortFile(stores, link, mcfsRoot)
+		return nil, err
+	}
+	link.UsesUUID, link.UsesID = source.UUIDForUses(), source.IDForUses()
+
+	// No data was written for the link, so it doesn't matter whether it was switched to another file
+	// with the same checksum.
+	if _, err := CommitFile(stores, link, source.Checksum, int64(source.Size), mcfsRoot); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
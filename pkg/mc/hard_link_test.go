@@ -0,0 +1,63 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkFile(t *testing.T) {
+	dir := &mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}
+	source := &mcmodel.File{ID: 2, ProjectID: 1, UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", Name: "a.tif", DirectoryID: 1,
+		MimeType: "image/tiff", Checksum: "abc", Size: 4}
+	stores := &Stores{
+		FileStore:        store.NewFakeFileStore([]mcmodel.File{*dir, *source}),
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: NewFakePendingFileStore(),
+	}
+
+	link, err := LinkFile(stores, source, dir, "b.tif", 7, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, "b.tif", link.Name)
+	require.Equal(t, 7, link.OwnerID)
+	require.Equal(t, "image/tiff", link.MimeType)
+	require.Equal(t, source.UUID, link.UsesUUID)
+	require.Equal(t, source.ID, link.UsesID)
+
+	// A link to a link uses the original's data.
+	linkToLink, err := LinkFile(stores, &mcmodel.File{ID: 3, ProjectID: 1, UsesUUID: source.UUID, UsesID: source.ID, Checksum: "abc"}, dir, "c.tif", 7, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, source.UUID, linkToLink.UsesUUID)
+	require.Equal(t, source.ID, linkToLink.UsesID)
+
+	_, err = LinkFile(stores, dir, dir, "d", 7, t.TempDir())
+	require.True(t, errors.Is(err, ErrLinkDirectory))
+	require.True(t, errors.Is(err, os.ErrPermission))
+
+	_, err = LinkFile(stores, source, &mcmodel.File{ID: 9, ProjectID: 2, MimeType: "directory"}, "b.tif", 7, t.TempDir())
+	require.True(t, errors.Is(err, syscall.EXDEV))
+
+	_, err = LinkFile(stores, &mcmodel.File{ID: 4, ProjectID: 1, MimeType: "text/plain"}, dir, "e.txt", 7, t.TempDir())
+	require.True(t, errors.Is(err, ErrLinkUnfinished))
+}
+
+func TestLinkFile_FailureRemovesLink(t *testing.T) {
+	dir := &mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}
+	source := &mcmodel.File{ID: 2, ProjectID: 1, UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", Name: "a.tif", DirectoryID: 1,
+		MimeType: "image/tiff", Checksum: "abc", Size: 4}
+	pendingFileStore := NewFakePendingFileStore()
+	stores := &Stores{
+		FileStore:        &failingFileStore{FileStore: uuidFileStore{FakeFileStore: store.NewFakeFileStore([]mcmodel.File{*dir, *source})}},
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: pendingFileStore,
+	}
+
+	_, err := LinkFile(stores, source, dir, "b.tif", 7, t.TempDir())
+	require.Error(t, err)
+	require.Len(t, pendingFileStore.DeletedFileIDs, 1, "The link's file record should have been removed")
+}
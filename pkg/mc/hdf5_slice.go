@@ -0,0 +1,491 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// MaxHDF5SliceBytes is the largest slice served to a client at once, so that the reply fits in the 256 KiB
+// SFTP packets clients accept. Larger slices are read as several smaller ones.
+const MaxHDF5SliceBytes = 224 * 1024
+
+// ErrHDF5Unsupported is returned by ReadHDF5Slice for the datasets, and the groups, whose storage it can't
+// read.
+var ErrHDF5Unsupported = errors.New("unsupported HDF5 storage")
+
+// The HDF5 data layout classes.
+const (
+	hdf5LayoutCompact    = 0
+	hdf5LayoutContiguous = 1
+)
+
+// maxHDF5GroupNodes is the most B-tree and symbol table nodes read to look up a name in an old style
+// group, so that a corrupt file can't have the whole file read.
+const maxHDF5GroupNodes = 4096
+
+// HDF5Slice is a hyperslab read from an HDF5 dataset, or a NetCDF-4 variable, by ReadHDF5Slice. Data holds
+// the slice's elements in row-major order, as they are stored in the file, so a client decodes them with
+// ElementSize, Class, Signed and BigEndian.
+type HDF5Slice struct {
+	// Shape is the size of each of the dataset's dimensions, and Start and Count are where the slice
+	// starts and how many elements it has in each of them.
+	Shape []uint64 `json:"shape"`
+	Start []uint64 `json:"start"`
+	Count []uint64 `json:"count"`
+
+	// Class is integer, float, string, or other for the datatypes, such as compound types, that are
+	// returned as they are stored.
+	Class       string `json:"class"`
+	ElementSize int    `json:"element_size"`
+	Signed      bool   `json:"signed,omitempty"`
+	BigEndian   bool   `json:"big_endian,omitempty"`
+
+	Data []byte `json:"-"`
+}
+
+// ReadHDF5Slice reads the slice of the dataset at datasetPath, such as /entry/data/counts, in the HDF5 file
+// in f that starts at start and has count elements in each dimension. Only the slice is read, so a few
+// megabytes can be taken from a file of hundreds of gigabytes. Datasets stored compact or contiguous are
+// read. Chunked datasets, which may be compressed, and variable length data, return ErrHDF5Unsupported, as
+// do groups that keep their links in dense storage. A slice larger than maxBytes is refused.
+func ReadHDF5Slice(f io.ReaderAt, datasetPath string, start, count []uint64, maxBytes int64) (*HDF5Slice, error) {
+	r := &hdf5Reader{f: f, heaps: make(map[int64][]byte)}
+	address, err := r.readSuperblock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(strings.Trim(datasetPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if address, err = r.lookupLink(address, name); err != nil {
+			return nil, err
+		}
+	}
+
+	messages, err := r.readObjectHeader(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataspace, datatype, layout []byte
+	for _, message := range messages {
+		switch message.kind {
+		case hdf5MessageDataspace:
+			dataspace = message.data
+		case hdf5MessageDatatype:
+			datatype = message.data
+		case hdf5MessageLayout:
+			layout = message.data
+		}
+	}
+
+	if dataspace == nil || datatype == nil || layout == nil {
+		return nil, fmt.Errorf("'%s' is not a dataset: %w", datasetPath, os.ErrInvalid)
+	}
+
+	shape, ok := r.dataspaceDims(dataspace)
+	if !ok {
+		return nil, fmt.Errorf("invalid dataspace for '%s'", datasetPath)
+	}
+
+	slice, err := hdf5SliceType(datatype)
+	if err != nil {
+		return nil, err
+	}
+	slice.Shape, slice.Start, slice.Count = shape, start, count
+
+	elements, err := hdf5SliceElements(shape, start, count, maxBytes/int64(slice.ElementSize))
+	if err != nil {
+		return nil, err
+	}
+
+	data, size, err := r.layoutData(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The dataset's elements all have to be in its storage.
+	needed := int64(slice.ElementSize)
+	for _, dim := range shape {
+		if dim > 1<<62 || (dim != 0 && needed > size/int64(dim)) {
+			return nil, fmt.Errorf("invalid storage for '%s'", datasetPath)
+		}
+		needed *= int64(dim)
+	}
+
+	if needed > size {
+		return nil, fmt.Errorf("invalid storage for '%s'", datasetPath)
+	}
+
+	slice.Data = make([]byte, elements*int64(slice.ElementSize))
+	if err := readHDF5Hyperslab(data, slice); err != nil {
+		return nil, err
+	}
+
+	return slice, nil
+}
+
+// hdf5SliceType returns an HDF5Slice with the type of the elements of the datatype message in datatype.
+func hdf5SliceType(datatype []byte) (*HDF5Slice, error) {
+	if len(datatype) < 8 {
+		return nil, fmt.Errorf("invalid datatype")
+	}
+
+	class, bits := datatype[0]&0x0f, datatype[1]
+	slice := &HDF5Slice{Class: "other", ElementSize: int(binary.LittleEndian.Uint32(datatype[4:]))}
+	switch class {
+	case hdf5FixedPoint:
+		slice.Class, slice.BigEndian, slice.Signed = "integer", bits&0x01 != 0, bits&0x08 != 0
+	case hdf5FloatingPoint:
+		slice.Class, slice.BigEndian = "float", bits&0x01 != 0
+	case hdf5String:
+		slice.Class = "string"
+	case hdf5VariableLength:
+		return nil, fmt.Errorf("%w: variable length data", ErrHDF5Unsupported)
+	}
+
+	if slice.ElementSize <= 0 {
+		return nil, fmt.Errorf("invalid datatype")
+	}
+
+	return slice, nil
+}
+
+// hdf5SliceElements returns the number of elements in the slice of a dataset with shape that starts at
+// start and has count elements in each dimension, or an error if the slice isn't in the dataset or has
+// more than maxElements.
+func hdf5SliceElements(shape, start, count []uint64, maxElements int64) (int64, error) {
+	if len(start) != len(shape) || len(count) != len(shape) {
+		return 0, fmt.Errorf("the dataset has %d dimensions: %w", len(shape), os.ErrInvalid)
+	}
+
+	elements := int64(1)
+	for i := range shape {
+		if start[i] > shape[i] || count[i] > shape[i]-start[i] {
+			return 0, fmt.Errorf("the slice is outside dimension %d, of size %d: %w", i, shape[i], os.ErrInvalid)
+		}
+
+		if count[i] > 1<<62 || (count[i] != 0 && elements > maxElements/int64(count[i])) {
+			return 0, fmt.Errorf("the slice has more than %d elements: %w", maxElements, os.ErrInvalid)
+		}
+		elements *= int64(count[i])
+	}
+
+	return elements, nil
+}
+
+// readHDF5Hyperslab reads slice.Data from data, the dataset's elements in row-major order. The elements of
+// the slice in its innermost dimensions, those that the slice takes all of, are read together, along with
+// the run of the next dimension out.
+func readHDF5Hyperslab(data io.ReaderAt, slice *HDF5Slice) error {
+	if len(slice.Data) == 0 {
+		return nil
+	}
+
+	rank := len(slice.Shape)
+	elementSize := int64(slice.ElementSize)
+
+	// strides are the number of elements each step in a dimension moves by.
+	strides := make([]int64, rank)
+	stride := int64(1)
+	for i := rank - 1; i >= 0; i-- {
+		strides[i] = stride
+		stride *= int64(slice.Shape[i])
+	}
+
+	// Dimensions inner onwards are read in runs of run elements.
+	inner, run := rank, int64(1)
+	for inner > 0 {
+		inner--
+		run *= int64(slice.Count[inner])
+		if slice.Count[inner] != slice.Shape[inner] {
+			break
+		}
+	}
+
+	index := make([]uint64, inner)
+	for out := int64(0); out < int64(len(slice.Data)); out += run * elementSize {
+		offset := int64(0)
+		for i := 0; i < rank; i++ {
+			position := slice.Start[i]
+			if i < inner {
+				position += index[i]
+			}
+			offset += int64(position) * strides[i]
+		}
+
+		n, err := data.ReadAt(slice.Data[out:out+run*elementSize], offset*elementSize)
+		if int64(n) != run*elementSize {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		for i := inner - 1; i >= 0; i-- {
+			index[i]++
+			if index[i] < slice.Count[i] {
+				break
+			}
+			index[i] = 0
+		}
+	}
+
+	return nil
+}
+
+// layoutData returns the storage of a compact or contiguous dataset with the layout message in layout,
+// and its size.
+func (r *hdf5Reader) layoutData(layout []byte) (io.ReaderAt, int64, error) {
+	if len(layout) < 2 || (layout[0] != 3 && layout[0] != 4) {
+		return nil, 0, fmt.Errorf("%w: data layout", ErrHDF5Unsupported)
+	}
+
+	switch layout[1] {
+	case hdf5LayoutCompact:
+		if len(layout) < 4 {
+			return nil, 0, fmt.Errorf("invalid data layout")
+		}
+
+		size := int(binary.LittleEndian.Uint16(layout[2:]))
+		if 4+size > len(layout) {
+			return nil, 0, fmt.Errorf("invalid data layout")
+		}
+		return bytes.NewReader(layout[4 : 4+size]), int64(size), nil
+	case hdf5LayoutContiguous:
+		address, ok := hdf5Uint(layout[2:], r.offsetSize)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid data layout")
+		}
+
+		size, ok := hdf5Uint(layout[minInt(2+r.offsetSize, len(layout)):], r.lengthSize)
+		if !ok || size > 1<<62 {
+			return nil, 0, fmt.Errorf("invalid data layout")
+		}
+
+		// A dataset that hasn't been written to has the undefined address.
+		if r.undefined(address) {
+			return nil, 0, fmt.Errorf("the dataset has no data: %w", os.ErrNotExist)
+		}
+
+		return io.NewSectionReader(r.f, r.base+int64(address), int64(size)), int64(size), nil
+	default:
+		return nil, 0, fmt.Errorf("%w: chunked or virtual dataset", ErrHDF5Unsupported)
+	}
+}
+
+// lookupLink returns the address of the object header of the object linked to as name from the group
+// whose object header is at address. Both the link messages of new style groups and the symbol tables of
+// old style groups are read.
+func (r *hdf5Reader) lookupLink(address int64, name string) (int64, error) {
+	messages, err := r.readObjectHeader(address)
+	if err != nil {
+		return 0, err
+	}
+
+	dense := false
+	for _, message := range messages {
+		switch message.kind {
+		case hdf5MessageLink:
+			linkName, target, ok := r.decodeLink(message.data)
+			if ok && linkName == name {
+				return target, nil
+			}
+		case hdf5MessageLinkInfo:
+			dense = r.hasDenseLinks(message.data)
+		case hdf5MessageSymbolTable:
+			return r.lookupSymbolTable(message.data, name)
+		}
+	}
+
+	if dense {
+		return 0, fmt.Errorf("%w: group with dense link storage", ErrHDF5Unsupported)
+	}
+
+	return 0, fmt.Errorf("'%s': %w", name, os.ErrNotExist)
+}
+
+// decodeLink decodes the name and target of the hard link in the link message in data. Soft and
+// external links return false.
+func (r *hdf5Reader) decodeLink(data []byte) (string, int64, bool) {
+	if len(data) < 2 || data[0] != 1 {
+		return "", 0, false
+	}
+
+	flags, pos := data[1], 2
+	if flags&0x08 != 0 {
+		if pos >= len(data) || data[pos] != 0 {
+			return "", 0, false
+		}
+		pos++
+	}
+	if flags&0x04 != 0 {
+		// The creation order.
+		pos += 8
+	}
+	if flags&0x10 != 0 {
+		// The name's character set.
+		pos++
+	}
+
+	nameLength, ok := hdf5Uint(data[minInt(pos, len(data)):], 1<<(flags&0x03))
+	if !ok {
+		return "", 0, false
+	}
+	pos += 1 << (flags & 0x03)
+
+	if nameLength > uint64(len(data)) || pos+int(nameLength) > len(data) {
+		return "", 0, false
+	}
+	name := string(data[pos : pos+int(nameLength)])
+
+	target, ok := hdf5Uint(data[pos+int(nameLength):], r.offsetSize)
+	return name, int64(target), ok
+}
+
+// hasDenseLinks returns true if the link info message in data has the address of a fractal heap, which
+// the group keeps its links in when it has many of them.
+func (r *hdf5Reader) hasDenseLinks(data []byte) bool {
+	if len(data) < 2 {
+		return false
+	}
+
+	pos := 2
+	if data[1]&0x01 != 0 {
+		// The maximum creation index.
+		pos += 8
+	}
+
+	address, ok := hdf5Uint(data[minInt(pos, len(data)):], r.offsetSize)
+	return ok && !r.undefined(address)
+}
+
+// undefined returns true if address is the undefined address, which has all its bits set.
+func (r *hdf5Reader) undefined(address uint64) bool {
+	return address == uint64(1)<<(8*uint(r.offsetSize))-1
+}
+
+// lookupSymbolTable returns the address of the object header of name in the old style group whose symbol
+// table message is in data. The group's version 1 B-tree is walked to its symbol table nodes, whose entries
+// are named in the group's local heap.
+func (r *hdf5Reader) lookupSymbolTable(data []byte, name string) (int64, error) {
+	btree, ok := hdf5Uint(data, r.offsetSize)
+	if !ok {
+		return 0, fmt.Errorf("invalid symbol table")
+	}
+
+	heapAddress, ok := hdf5Uint(data[minInt(r.offsetSize, len(data)):], r.offsetSize)
+	if !ok {
+		return 0, fmt.Errorf("invalid symbol table")
+	}
+
+	names, err := r.readLocalHeap(int64(heapAddress))
+	if err != nil {
+		return 0, err
+	}
+
+	entrySize := 2*r.offsetSize + 24
+	nodes := []int64{int64(btree)}
+	for i := 0; i < len(nodes); i++ {
+		if i >= maxHDF5GroupNodes {
+			return 0, fmt.Errorf("%w: group with too many nodes", ErrHDF5Unsupported)
+		}
+
+		header, err := r.readAt(nodes[i], 8)
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case bytes.HasPrefix(header, []byte("TREE")) && len(header) == 8 && header[4] == 0:
+			children, err := r.readGroupBTreeNode(nodes[i], int(binary.LittleEndian.Uint16(header[6:])))
+			if err != nil {
+				return 0, err
+			}
+			nodes = append(nodes, children...)
+		case bytes.HasPrefix(header, []byte("SNOD")) && len(header) == 8:
+			symbols := int(binary.LittleEndian.Uint16(header[6:]))
+			entries, err := r.readAt(nodes[i]+8, int64(symbols*entrySize))
+			if err != nil {
+				return 0, err
+			}
+
+			for pos := 0; pos+entrySize <= len(entries); pos += entrySize {
+				nameOffset, _ := hdf5Uint(entries[pos:], r.offsetSize)
+				target, _ := hdf5Uint(entries[pos+r.offsetSize:], r.offsetSize)
+				if nameOffset < uint64(len(names)) && heapString(names[nameOffset:]) == name {
+					return int64(target), nil
+				}
+			}
+		default:
+			return 0, fmt.Errorf("invalid group node at %d", nodes[i])
+		}
+	}
+
+	return 0, fmt.Errorf("'%s': %w", name, os.ErrNotExist)
+}
+
+// readGroupBTreeNode returns the children of the version 1 group B-tree node at address, which has
+// entries children. The children of a leaf node are symbol table nodes.
+func (r *hdf5Reader) readGroupBTreeNode(address int64, entries int) ([]int64, error) {
+	// The signature, type, level, entries used and sibling addresses come before the keys, which are
+	// offsets into the local heap, and children, which alternate.
+	pos := int64(8 + 2*r.offsetSize)
+	data, err := r.readAt(address+pos, int64(entries*(r.lengthSize+r.offsetSize)+r.lengthSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var children []int64
+	for i := 0; i < entries; i++ {
+		child, ok := hdf5Uint(data[minInt(r.lengthSize+i*(r.lengthSize+r.offsetSize), len(data)):], r.offsetSize)
+		if !ok {
+			return nil, fmt.Errorf("invalid group node at %d", address)
+		}
+		children = append(children, int64(child))
+	}
+
+	return children, nil
+}
+
+// readLocalHeap returns the data segment of the local heap at address, which holds the names of the
+// links in an old style group.
+func (r *hdf5Reader) readLocalHeap(address int64) ([]byte, error) {
+	header, err := r.readAt(address, int64(8+2*r.lengthSize+r.offsetSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(header, []byte("HEAP")) {
+		return nil, fmt.Errorf("invalid local heap at %d", address)
+	}
+
+	size, ok := hdf5Uint(header[minInt(8, len(header)):], r.lengthSize)
+	if !ok {
+		return nil, fmt.Errorf("invalid local heap at %d", address)
+	}
+
+	dataAddress, ok := hdf5Uint(header[minInt(8+2*r.lengthSize, len(header)):], r.offsetSize)
+	if !ok || size > maxMetadataHeaderSize {
+		return nil, fmt.Errorf("invalid local heap at %d", address)
+	}
+
+	return r.readAt(int64(dataAddress), int64(size))
+}
+
+// heapString returns the null terminated string at the start of b.
+func heapString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+
+	return string(b)
+}
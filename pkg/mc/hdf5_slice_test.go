@@ -0,0 +1,263 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHDF5Slice(t *testing.T) {
+	f := bytes.NewReader(writeHDF5Datasets())
+
+	int32s := func(values ...int32) []byte {
+		b := make([]byte, 4*len(values))
+		for i, v := range values {
+			binary.LittleEndian.PutUint32(b[4*i:], uint32(v))
+		}
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		dataset  string
+		start    []uint64
+		count    []uint64
+		maxBytes int64
+		expected []byte
+		err      error
+	}{
+		{name: "whole dataset", dataset: "/entry/counts", start: []uint64{0, 0}, count: []uint64{3, 4},
+			expected: int32s(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)},
+		{name: "block", dataset: "entry/counts", start: []uint64{1, 1}, count: []uint64{2, 2},
+			expected: int32s(5, 6, 9, 10)},
+		{name: "rows", dataset: "/entry/counts", start: []uint64{1, 0}, count: []uint64{2, 4},
+			expected: int32s(4, 5, 6, 7, 8, 9, 10, 11)},
+		{name: "column", dataset: "/entry/counts", start: []uint64{0, 2}, count: []uint64{3, 1},
+			expected: int32s(2, 6, 10)},
+		{name: "empty", dataset: "/entry/counts", start: []uint64{3, 0}, count: []uint64{0, 4},
+			expected: []byte{}},
+		{name: "outside the dataset", dataset: "/entry/counts", start: []uint64{2, 0}, count: []uint64{2, 4},
+			err: os.ErrInvalid},
+		{name: "wrong number of dimensions", dataset: "/entry/counts", start: []uint64{0}, count: []uint64{3},
+			err: os.ErrInvalid},
+		{name: "too large", dataset: "/entry/counts", start: []uint64{0, 0}, count: []uint64{3, 4}, maxBytes: 40,
+			err: os.ErrInvalid},
+		{name: "compact", dataset: "/entry/compact", start: []uint64{1}, count: []uint64{2},
+			expected: float64s(2.5, 3.5)},
+		{name: "chunked", dataset: "/entry/chunked", start: []uint64{0}, count: []uint64{1},
+			err: ErrHDF5Unsupported},
+		{name: "missing", dataset: "/entry/missing", start: []uint64{0}, count: []uint64{1},
+			err: os.ErrNotExist},
+		{name: "missing group", dataset: "/nope/counts", start: []uint64{0}, count: []uint64{1},
+			err: os.ErrNotExist},
+		{name: "group", dataset: "/entry", start: nil, count: nil,
+			err: os.ErrInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxBytes := test.maxBytes
+			if maxBytes == 0 {
+				maxBytes = MaxHDF5SliceBytes
+			}
+
+			slice, err := ReadHDF5Slice(f, test.dataset, test.start, test.count, maxBytes)
+			if test.err != nil {
+				require.Error(t, err)
+				require.True(t, errors.Is(err, test.err), "%s", err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.expected, slice.Data)
+		})
+	}
+
+	slice, err := ReadHDF5Slice(f, "/entry/counts", []uint64{0, 0}, []uint64{1, 1}, MaxHDF5SliceBytes)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, slice.Shape)
+	require.Equal(t, "integer", slice.Class)
+	require.Equal(t, 4, slice.ElementSize)
+	require.True(t, slice.Signed)
+	require.False(t, slice.BigEndian)
+
+	_, err = ReadHDF5Slice(bytes.NewReader([]byte("not hdf5")), "/data", nil, nil, MaxHDF5SliceBytes)
+	require.Error(t, err)
+}
+
+func float64s(values ...float64) []byte {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(v))
+	}
+	return b
+}
+
+// hdf5ObjectHeaderV1 returns a version 1 object header with messages.
+func hdf5ObjectHeaderV1(messages ...[]byte) []byte {
+	body := &hdf5Builder{}
+	for _, message := range messages {
+		body.Write(message)
+	}
+
+	b := &hdf5Builder{}
+	b.WriteByte(1)
+	b.WriteByte(0)
+	b.uint(uint64(len(messages)), 2)
+	b.uint(1, 4)
+	b.uint(uint64(body.Len()), 4)
+	b.uint(0, 4)
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// hdf5ObjectHeaderV2 returns a version 2 object header with messages, each a type and data.
+func hdf5ObjectHeaderV2(messages ...[]byte) []byte {
+	body := &hdf5Builder{}
+	for _, message := range messages {
+		body.WriteByte(message[0])
+		body.uint(uint64(len(message)-1), 2)
+		body.WriteByte(0)
+		body.Write(message[1:])
+	}
+
+	b := &hdf5Builder{}
+	b.WriteString("OHDR")
+	b.WriteByte(2)
+	b.WriteByte(0x02)
+	b.uint(uint64(body.Len()), 4)
+	b.Write(body.Bytes())
+	b.uint(0, 4)
+	return b.Bytes()
+}
+
+// hdf5Dataspace returns a version 1 dataspace message with dims.
+func hdf5Dataspace(dims ...uint64) []byte {
+	b := &hdf5Builder{}
+	b.WriteByte(1)
+	b.WriteByte(byte(len(dims)))
+	b.Write(make([]byte, 6))
+	for _, dim := range dims {
+		b.uint(dim, 8)
+	}
+	return b.Bytes()
+}
+
+// hdf5Link returns a link message for a hard link to address.
+func hdf5Link(name string, address uint64) []byte {
+	b := &hdf5Builder{}
+	b.WriteByte(hdf5MessageLink)
+	b.WriteByte(1)
+	b.WriteByte(0)
+	b.WriteByte(byte(len(name)))
+	b.WriteString(name)
+	b.uint(address, 8)
+	return b.Bytes()
+}
+
+// writeHDF5Datasets returns an HDF5 file whose root group is an old style group, with a symbol table, that
+// has the new style group entry, with link messages. In entry are counts, a 3 by 4 contiguous dataset of
+// the int32s 0 to 11, compact, a compact dataset of 3 float64s, and chunked, a chunked dataset.
+func writeHDF5Datasets() []byte {
+	const (
+		rootAddress    = 96
+		heapAddress    = 512
+		heapData       = 600
+		btreeAddress   = 700
+		snodAddress    = 800
+		entryAddress   = 1000
+		countsAddress  = 1200
+		compactAddress = 1400
+		chunkedAddress = 1600
+		countsData     = 2048
+	)
+
+	b := &hdf5Builder{}
+	b.Write(hdf5Signature)
+	b.Write([]byte{0, 0, 0, 0, 0, 8, 8, 0})
+	b.uint(4, 2)
+	b.uint(16, 2)
+	b.uint(0, 4)
+	b.uint(0, 8)
+	b.uint(math.MaxUint64, 8)
+	b.uint(countsData+48, 8)
+	b.uint(math.MaxUint64, 8)
+	b.uint(0, 8)
+	b.uint(rootAddress, 8)
+	b.Write(make([]byte, 24))
+
+	symbolTable := &hdf5Builder{}
+	symbolTable.uint(btreeAddress, 8)
+	symbolTable.uint(heapAddress, 8)
+	b.Write(hdf5ObjectHeaderV1(hdf5MessageV1(hdf5MessageSymbolTable, symbolTable.Bytes())))
+
+	// The names are at offsets 8 and 16 of the heap's data.
+	b.Write(make([]byte, heapAddress-b.Len()))
+	b.WriteString("HEAP\x00\x00\x00\x00")
+	b.uint(24, 8)
+	b.uint(math.MaxUint64, 8)
+	b.uint(heapData, 8)
+	b.Write(make([]byte, heapData-b.Len()))
+	b.WriteString("\x00\x00\x00\x00\x00\x00\x00\x00entry\x00\x00\x00other\x00\x00\x00")
+
+	b.Write(make([]byte, btreeAddress-b.Len()))
+	b.WriteString("TREE\x00\x00")
+	b.uint(1, 2)
+	b.uint(math.MaxUint64, 8)
+	b.uint(math.MaxUint64, 8)
+	b.uint(0, 8)
+	b.uint(snodAddress, 8)
+	b.uint(16, 8)
+
+	b.Write(make([]byte, snodAddress-b.Len()))
+	b.WriteString("SNOD\x01\x00")
+	b.uint(2, 2)
+	for _, entry := range [][2]uint64{{16, 0}, {8, entryAddress}} {
+		b.uint(entry[0], 8)
+		b.uint(entry[1], 8)
+		b.Write(make([]byte, 24))
+	}
+
+	b.Write(make([]byte, entryAddress-b.Len()))
+	b.Write(hdf5ObjectHeaderV2(
+		hdf5Link("counts", countsAddress),
+		hdf5Link("compact", compactAddress),
+		hdf5Link("chunked", chunkedAddress)))
+
+	contiguous := &hdf5Builder{}
+	contiguous.Write([]byte{3, hdf5LayoutContiguous})
+	contiguous.uint(countsData, 8)
+	contiguous.uint(48, 8)
+	b.Write(make([]byte, countsAddress-b.Len()))
+	b.Write(hdf5ObjectHeaderV1(
+		hdf5MessageV1(hdf5MessageDataspace, hdf5Dataspace(3, 4)),
+		hdf5MessageV1(hdf5MessageDatatype, hdf5Datatype(hdf5FixedPoint, 0x08, 4, 4)),
+		hdf5MessageV1(hdf5MessageLayout, contiguous.Bytes())))
+
+	compact := &hdf5Builder{}
+	compact.Write([]byte{3, hdf5LayoutCompact})
+	compact.uint(24, 2)
+	compact.Write(float64s(1.5, 2.5, 3.5))
+	b.Write(make([]byte, compactAddress-b.Len()))
+	b.Write(hdf5ObjectHeaderV2(
+		append([]byte{hdf5MessageDataspace}, hdf5Dataspace(3)...),
+		append([]byte{hdf5MessageDatatype}, hdf5Datatype(hdf5FloatingPoint, 0x20, 8, 12)...),
+		append([]byte{hdf5MessageLayout}, compact.Bytes()...)))
+
+	b.Write(make([]byte, chunkedAddress-b.Len()))
+	b.Write(hdf5ObjectHeaderV1(
+		hdf5MessageV1(hdf5MessageDataspace, hdf5Dataspace(3)),
+		hdf5MessageV1(hdf5MessageDatatype, hdf5Datatype(hdf5FloatingPoint, 0x20, 8, 12)),
+		hdf5MessageV1(hdf5MessageLayout, []byte{3, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0})))
+
+	b.Write(make([]byte, countsData-b.Len()))
+	for i := 0; i < 12; i++ {
+		b.uint(uint64(i), 4)
+	}
+	return b.Bytes()
+}
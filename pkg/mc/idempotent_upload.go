@@ -0,0 +1,130 @@
+package mc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// IdempotencyWindows is how long, for each project keyed by slug, an upload of a file is treated as a
+// retry of the previous upload of it. Clients that time out waiting for an upload to finish often upload
+// the file again, so when the same user uploads the same data to the same path within the window the
+// upload succeeds without creating another version. The "*" window applies to the projects without their
+// own. A window of 0 turns it off.
+type IdempotencyWindows map[string]time.Duration
+
+// ParseIdempotencyWindows parses a comma separated list of project-slug=duration, where a project-slug of
+// * applies to every other project, for example "instrument-data=10m,*=2m".
+func ParseIdempotencyWindows(windows string) (IdempotencyWindows, error) {
+	idempotencyWindows := make(IdempotencyWindows)
+	for _, window := range strings.Split(windows, ",") {
+		window = strings.TrimSpace(window)
+		if window == "" {
+			continue
+		}
+
+		i := strings.Index(window, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid idempotency window '%s', expected project-slug=duration", window)
+		}
+
+		d, err := time.ParseDuration(window[i+1:])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid idempotency window '%s': bad duration", window)
+		}
+
+		idempotencyWindows[window[:i]] = d
+	}
+
+	return idempotencyWindows, nil
+}
+
+// For returns the window of the project with projectSlug.
+func (w IdempotencyWindows) For(projectSlug string) time.Duration {
+	if d, ok := w[projectSlug]; ok {
+		return d
+	}
+
+	return w["*"]
+}
+
+// RepeatedUploadError is returned by FileStore.DoneWritingToFile, when IdempotentUploads is used, for an
+// upload that repeats Current. CommitFile removes the upload and points the file at Current instead.
+type RepeatedUploadError struct {
+	Current *mcmodel.File
+}
+
+func (e *RepeatedUploadError) Error() string {
+	return fmt.Sprintf("repeats the upload of file %d", e.Current.ID)
+}
+
+// IsRepeat returns true if a file finished with checksum and size, by ownerID at now, repeats the upload
+// of current within window.
+func IsRepeat(current *mcmodel.File, checksum string, size int64, ownerID int, window time.Duration, now time.Time) bool {
+	return window > 0 && current.Current && current.Checksum == checksum && int64(current.Size) == size &&
+		current.OwnerID == ownerID && !current.UpdatedAt.Before(now.Add(-window))
+}
+
+// IdempotentUploads returns a StoreMiddleware whose FileStore.DoneWritingToFile fails with a
+// RepeatedUploadError for an upload that repeats the current version of its file within the project's
+// window. The projects and versions are looked up with stores. Every upload to a project that config turns
+// FeatureDedup off for is kept, whatever its window.
+func IdempotentUploads(stores *Stores, windows IdempotencyWindows, config *Config) StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &idempotentFileStore{FileStore: fileStore, stores: stores, windows: windows, config: config}
+		},
+	}
+}
+
+type idempotentFileStore struct {
+	store.FileStore
+	stores  *Stores
+	windows IdempotencyWindows
+	config  *Config
+}
+
+func (s *idempotentFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	if current := s.repeatedUpload(file, checksum, size); current != nil {
+		return false, &RepeatedUploadError{Current: current}
+	}
+
+	return s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+}
+
+// repeatedUpload returns the current version of file when the upload repeats it. Failures to look it up
+// are logged, and the upload is finished as usual.
+func (s *idempotentFileStore) repeatedUpload(file *mcmodel.File, checksum string, size int64) *mcmodel.File {
+	project, err := s.stores.ProjectStore.GetProjectByID(file.ProjectID)
+	if err != nil {
+		log.Errorf("Unable to look up project %d to check for a repeated upload of file %d: %s", file.ProjectID, file.ID, err)
+		return nil
+	}
+
+	window := s.windows.For(project.Slug)
+	if window <= 0 || !s.config.DedupEnabled(project.Slug) {
+		return nil
+	}
+
+	versions, err := s.stores.VersionStore.ListVersions(file)
+	if err != nil {
+		log.Errorf("Unable to list the versions of file %d to check for a repeated upload: %s", file.ID, err)
+		return nil
+	}
+
+	now := time.Now()
+	for i := range versions {
+		if versions[i].ID != file.ID && versions[i].Current {
+			if IsRepeat(&versions[i], checksum, size, file.OwnerID, window, now) {
+				return &versions[i]
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
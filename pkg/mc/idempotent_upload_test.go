@@ -0,0 +1,95 @@
+package mc
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIdempotencyWindows(t *testing.T) {
+	windows, err := ParseIdempotencyWindows("instrument-data=10m, *=2m,quiet=0s")
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Minute, windows.For("instrument-data"))
+	require.Equal(t, 2*time.Minute, windows.For("other"))
+	require.Equal(t, time.Duration(0), windows.For("quiet"))
+
+	for _, windows := range []string{"=2m", "proj", "proj=soon", "proj=-1m"} {
+		_, err := ParseIdempotencyWindows(windows)
+		require.Error(t, err, windows)
+	}
+}
+
+func TestIsRepeat(t *testing.T) {
+	now := time.Now()
+	current := &mcmodel.File{Current: true, Checksum: "abc", Size: 10, OwnerID: 1, UpdatedAt: now.Add(-time.Minute)}
+
+	tests := []struct {
+		name     string
+		checksum string
+		size     int64
+		ownerID  int
+		window   time.Duration
+		repeat   bool
+	}{
+		{name: "retry", checksum: "abc", size: 10, ownerID: 1, window: 2 * time.Minute, repeat: true},
+		{name: "outside the window", checksum: "abc", size: 10, ownerID: 1, window: 30 * time.Second},
+		{name: "different data", checksum: "abd", size: 10, ownerID: 1, window: 2 * time.Minute},
+		{name: "different user", checksum: "abc", size: 10, ownerID: 2, window: 2 * time.Minute},
+		{name: "turned off", checksum: "abc", size: 10, ownerID: 1},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.repeat, IsRepeat(current, test.checksum, test.size, test.ownerID, test.window, now), test.name)
+	}
+}
+
+func TestIdempotentUploads(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo")
+	require.NoError(t, err)
+	stores = stores.Use(IdempotentUploads(stores, IdempotencyWindows{"*": time.Minute}, nil))
+
+	project, err := stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+	dir, err := stores.FileStore.GetDirByPath(project.ID, "/")
+	require.NoError(t, err)
+
+	upload := func(ownerID int, contents string) *mcmodel.File {
+		file, err := stores.FileStore.CreateFile("a.txt", project.ID, dir.ID, ownerID, "text/plain")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0755))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), []byte(contents), 0644))
+
+		_, err = CommitFile(stores, file, contents+"-checksum", int64(len(contents)), mcfsRoot)
+		require.NoError(t, err)
+		return file
+	}
+
+	first := upload(1, "data")
+
+	// The retry becomes the first upload, and its data is removed.
+	retry, err := stores.FileStore.CreateFile("a.txt", project.ID, dir.ID, 1, "text/plain")
+	require.NoError(t, err)
+	retryPath := retry.ToUnderlyingFilePath(mcfsRoot)
+	require.NoError(t, os.MkdirAll(retry.ToUnderlyingDirPath(mcfsRoot), 0755))
+	require.NoError(t, os.WriteFile(retryPath, []byte("data"), 0644))
+	_, err = CommitFile(stores, retry, "data-checksum", 4, mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, first.ID, retry.ID)
+	require.NoFileExists(t, retryPath)
+	require.FileExists(t, first.ToUnderlyingFilePath(mcfsRoot))
+
+	versions, err := stores.VersionStore.ListVersions(first)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+
+	// Another user uploading the same data creates a version.
+	other := upload(2, "data")
+	require.NotEqual(t, first.ID, other.ID)
+	versions, err = stores.VersionStore.ListVersions(first)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+}
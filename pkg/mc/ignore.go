@@ -0,0 +1,99 @@
+package mc
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MCIgnoreFileName is the name of the file that users can include at the top of an uploaded tree
+// to list additional names to ignore.
+const MCIgnoreFileName = ".mcignore"
+
+// DefaultIgnorePatterns are the names of OS generated files that are ignored by default.
+var DefaultIgnorePatterns = []string{".DS_Store", "Thumbs.db", "~$*"}
+
+// IgnoreList determines which uploaded files and directories should be silently skipped rather than
+// stored in the project. Patterns use filepath.Match syntax and are matched against each individual
+// name in a path, so a pattern that matches a directory name also ignores everything under that
+// directory. There are two sources of patterns: the server wide patterns that the IgnoreList was
+// created with, and patterns loaded from .mcignore files that were uploaded during the session. The
+// .mcignore patterns only apply to paths under the directory the .mcignore file was uploaded to.
+type IgnoreList struct {
+	patterns []string
+
+	mu sync.Mutex
+
+	// mcignorePatterns is keyed by the directory the .mcignore file was uploaded to.
+	mcignorePatterns map[string][]string
+}
+
+// NewIgnoreList creates an IgnoreList with the server wide patterns.
+func NewIgnoreList(patterns []string) *IgnoreList {
+	return &IgnoreList{
+		patterns:         patterns,
+		mcignorePatterns: make(map[string][]string),
+	}
+}
+
+// AddMCIgnore loads the patterns from the contents of a .mcignore file that was uploaded to dir.
+// Each line is a pattern. Blank lines and lines starting with # are skipped.
+func (l *IgnoreList) AddMCIgnore(dir string, contents []byte) {
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mcignorePatterns[filepath.Clean(dir)] = patterns
+}
+
+// IsIgnored returns true if any name in path matches one of the server wide patterns, or one of the
+// patterns from a .mcignore file uploaded to a directory above path.
+func (l *IgnoreList) IsIgnored(path string) bool {
+	path = filepath.Clean(path)
+	if matchesAnyName(path, l.patterns) {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for dir, patterns := range l.mcignorePatterns {
+		prefix := dir
+		if prefix != "/" {
+			prefix = prefix + "/"
+		}
+
+		if strings.HasPrefix(path, prefix) && matchesAnyName(strings.TrimPrefix(path, prefix), patterns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesAnyName returns true if any of the names in path match any of the patterns.
+func matchesAnyName(path string, patterns []string) bool {
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,32 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreList_IsIgnored(t *testing.T) {
+	l := NewIgnoreList(DefaultIgnorePatterns)
+	l.AddMCIgnore("/upload", []byte("# comment\n\n*.tmp\n__MACOSX\n"))
+
+	tests := []struct {
+		tname           string
+		path            string
+		shouldBeIgnored bool
+	}{
+		{"Test regular file", "/dir1/file.txt", false},
+		{"Test .DS_Store", "/dir1/.DS_Store", true},
+		{"Test office temp file", "/dir1/~$report.docx", true},
+		{"Test file under ignored directory", "/dir1/.DS_Store/file.txt", true},
+		{"Test .mcignore pattern under its directory", "/upload/sub/file.tmp", true},
+		{"Test .mcignore directory pattern", "/upload/__MACOSX/file.txt", true},
+		{"Test .mcignore pattern outside its directory", "/other/file.tmp", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tname, func(t *testing.T) {
+			require.Equal(t, test.shouldBeIgnored, l.IsIgnored(test.path), "Unexpected result for path %s", test.path)
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateWindow is a time of day window, optionally limited to some days of the week, with a rate cap. A
+// window whose end is before its start runs past midnight, and belongs to the day it starts on.
+type RateWindow struct {
+	// Days are the days of the week the window applies on. An empty Days is every day.
+	Days []time.Weekday
+
+	// Start and End are the times of day, as offsets from midnight, that the window starts and ends.
+	Start time.Duration
+	End   time.Duration
+
+	// Rate is the cap, in bytes per second. 0 is no cap.
+	Rate int64
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseRateWindows parses a comma separated list of "[days ]HH:MM-HH:MM=rate" windows, for example
+// "mon-fri 08:00-18:00=50M,18:00-08:00=0". Days are a day, such as sat, or a range of days, such as
+// mon-fri. The rate is in bytes per second, and can have a K, M or G suffix. A rate of 0 is no cap.
+func ParseRateWindows(s string) ([]RateWindow, error) {
+	var windows []RateWindow
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		window, err := parseRateWindow(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate window '%s': %w", entry, err)
+		}
+
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+func parseRateWindow(entry string) (RateWindow, error) {
+	var window RateWindow
+
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) != 2 {
+		return window, fmt.Errorf("missing '=rate'")
+	}
+
+	rate, err := parseByteSize(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return window, err
+	}
+	window.Rate = rate
+
+	fields := strings.Fields(parts[0])
+	switch len(fields) {
+	case 1:
+	case 2:
+		if window.Days, err = parseDays(fields[0]); err != nil {
+			return window, err
+		}
+		fields = fields[1:]
+	default:
+		return window, fmt.Errorf("expected '[days ]HH:MM-HH:MM'")
+	}
+
+	times := strings.SplitN(fields[0], "-", 2)
+	if len(times) != 2 {
+		return window, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+
+	if window.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return window, err
+	}
+
+	if window.End, err = parseTimeOfDay(times[1]); err != nil {
+		return window, err
+	}
+
+	return window, nil
+}
+
+// parseDays parses a day, such as mon, or a range of days, such as mon-fri or fri-mon.
+func parseDays(s string) ([]time.Weekday, error) {
+	names := strings.SplitN(strings.ToLower(s), "-", 2)
+	first, ok := weekdays[names[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown day '%s'", names[0])
+	}
+
+	last := first
+	if len(names) == 2 {
+		if last, ok = weekdays[names[1]]; !ok {
+			return nil, fmt.Errorf("unknown day '%s'", names[1])
+		}
+	}
+
+	days := []time.Weekday{first}
+	for day := first; day != last; {
+		day = (day + 1) % 7
+		days = append(days, day)
+	}
+
+	return days, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseByteSize parses a number of bytes with an optional K, M or G suffix, which are powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+
+	n, err := strconv.ParseInt(strings.TrimRight(s, "KMG"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// contains returns true if t is in the window.
+func (w RateWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+	day := t.Weekday()
+
+	if w.End <= w.Start {
+		// The window runs past midnight. Early in the morning t is in the window that started the
+		// day before.
+		if sinceMidnight < w.End {
+			return w.onDay((day + 6) % 7)
+		}
+
+		return sinceMidnight >= w.Start && w.onDay(day)
+	}
+
+	return sinceMidnight >= w.Start && sinceMidnight < w.End && w.onDay(day)
+}
+
+func (w RateWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WindowedRateLimiter caps the combined rate of the transfers through it, with a cap that depends on the
+// time of day, so that, for example, ingest can be capped during business hours at a shared facility and
+// be unlimited at night. The cap is from the first of its windows that contains the current time. There
+// is no cap outside of the windows.
+type WindowedRateLimiter struct {
+	windows []RateWindow
+	now     func() time.Time
+	sleep   func(ctx context.Context, d time.Duration) error
+
+	// mu guards the token bucket. tokens is the number of bytes that can be sent now, and goes negative
+	// when the transfers have reserved more than is available. The bucket holds up to a second's worth
+	// of bytes at rate.
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewWindowedRateLimiter creates a WindowedRateLimiter with the windows.
+func NewWindowedRateLimiter(windows []RateWindow) *WindowedRateLimiter {
+	return &WindowedRateLimiter{windows: windows, now: time.Now, sleep: sleepContext}
+}
+
+// Rate returns the current cap, in bytes per second, or 0 if there is no cap.
+func (l *WindowedRateLimiter) Rate() int64 {
+	now := l.now()
+	for _, w := range l.windows {
+		if w.contains(now) {
+			return w.Rate
+		}
+	}
+
+	return 0
+}
+
+// Wait blocks until n bytes can be transferred under the current cap, or ctx is done. A nil
+// WindowedRateLimiter never blocks.
+func (l *WindowedRateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	return l.sleep(ctx, delay)
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending them.
+func (l *WindowedRateLimiter) reserve(n int) time.Duration {
+	rate := l.Rate()
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate <= 0 {
+		l.rate = 0
+		return 0
+	}
+
+	if rate != l.rate {
+		// The window changed, so start a new bucket at the new rate.
+		l.rate, l.tokens, l.last = rate, float64(rate), now
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// NewReader returns a reader whose reads are capped by the limiter. A nil WindowedRateLimiter returns r.
+func (l *WindowedRateLimiter) NewReader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &rateLimitedReader{Reader: r, ctx: ctx, limiter: l}
+}
+
+type rateLimitedReader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *WindowedRateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if waitErr := r.limiter.Wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+
+	return n, err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateWindows(t *testing.T) {
+	windows, err := ParseRateWindows("mon-fri 08:00-18:00=50M, sat-sun 22:00-06:00=1K,18:00-08:00=0")
+	require.NoError(t, err)
+	require.Equal(t, []RateWindow{
+		{
+			Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start: 8 * time.Hour,
+			End:   18 * time.Hour,
+			Rate:  50 * 1024 * 1024,
+		},
+		{Days: []time.Weekday{time.Saturday, time.Sunday}, Start: 22 * time.Hour, End: 6 * time.Hour, Rate: 1024},
+		{Start: 18 * time.Hour, End: 8 * time.Hour, Rate: 0},
+	}, windows)
+
+	for _, invalid := range []string{"08:00-18:00", "08:00=1M", "someday 08:00-18:00=1M", "08:00-25:00=1M", "08:00-18:00=fast"} {
+		_, err := ParseRateWindows(invalid)
+		require.Error(t, err, "ParseRateWindows should have failed for %s", invalid)
+	}
+}
+
+func TestWindowedRateLimiter(t *testing.T) {
+	windows, err := ParseRateWindows("mon-fri 08:00-18:00=1000,sat 22:00-02:00=10")
+	require.NoError(t, err)
+
+	// 2022-06-06 was a Monday.
+	now := time.Date(2022, 6, 6, 9, 0, 0, 0, time.Local)
+	var slept time.Duration
+	limiter := NewWindowedRateLimiter(windows)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}
+
+	tests := []struct {
+		time time.Time
+		rate int64
+	}{
+		{time.Date(2022, 6, 6, 7, 59, 0, 0, time.Local), 0},
+		{time.Date(2022, 6, 6, 8, 0, 0, 0, time.Local), 1000},
+		{time.Date(2022, 6, 10, 17, 59, 0, 0, time.Local), 1000},
+		{time.Date(2022, 6, 11, 12, 0, 0, 0, time.Local), 0},
+		{time.Date(2022, 6, 11, 23, 0, 0, 0, time.Local), 10},
+		{time.Date(2022, 6, 12, 1, 0, 0, 0, time.Local), 10},
+		{time.Date(2022, 6, 13, 1, 0, 0, 0, time.Local), 0},
+	}
+
+	for _, test := range tests {
+		now = test.time
+		require.Equal(t, test.rate, limiter.Rate(), test.time.String())
+	}
+
+	// A second's worth of bytes is sent straight away, after that the transfers wait.
+	now = time.Date(2022, 6, 6, 9, 0, 0, 0, time.Local)
+	require.NoError(t, limiter.Wait(context.Background(), 1000))
+	require.Zero(t, slept)
+	require.NoError(t, limiter.Wait(context.Background(), 500))
+	require.Equal(t, 500*time.Millisecond, slept)
+
+	// Outside of the windows there is no cap.
+	slept = 0
+	now = time.Date(2022, 6, 6, 20, 0, 0, 0, time.Local)
+	require.NoError(t, limiter.Wait(context.Background(), 1000000))
+	require.Zero(t, slept)
+
+	var none *WindowedRateLimiter
+	require.NoError(t, none.Wait(context.Background(), 1000))
+}
@@ -0,0 +1,118 @@
+package mc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// DefaultKeepaliveMaxMissed is the default Keepalive.MaxMissed.
+const DefaultKeepaliveMaxMissed = 3
+
+// KeepaliveConn is the part of an SSH connection (golang.org/x/crypto/ssh.Conn) used by a Keepalive.
+type KeepaliveConn interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+	Close() error
+}
+
+// Keepalive detects dead client connections. A laptop that goes to sleep, or loses its network, leaves
+// a half-open connection behind that can hold open files, write locks and unfinished uploads for hours
+// until TCP gives up on it. Keepalive sends a keepalive request to the client every Interval, and closes
+// the connection when MaxMissed requests in a row go unanswered, so that the sessions on it end and clean
+// up. Any reply, including a failure reply, shows the client is still there.
+type Keepalive struct {
+	Interval  time.Duration
+	MaxMissed int
+
+	mu       sync.Mutex
+	watching map[KeepaliveConn]bool
+
+	// closed counts the connections closed because they stopped answering.
+	closed int64
+}
+
+// NewKeepalive creates a Keepalive that sends a keepalive request every interval.
+func NewKeepalive(interval time.Duration) *Keepalive {
+	return &Keepalive{
+		Interval:  interval,
+		MaxMissed: DefaultKeepaliveMaxMissed,
+		watching:  make(map[KeepaliveConn]bool),
+	}
+}
+
+// Watch starts sending keepalive requests on conn until ctx is done or the connection is closed. It
+// returns straight away. Each session calls Watch for its connection, but a connection is only watched
+// once however many sessions it has. A nil Keepalive doesn't watch connections.
+func (k *Keepalive) Watch(ctx context.Context, conn KeepaliveConn) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.watching[conn] {
+		return
+	}
+
+	k.watching[conn] = true
+	go k.watch(ctx, conn)
+}
+
+func (k *Keepalive) watch(ctx context.Context, conn KeepaliveConn) {
+	defer func() {
+		k.mu.Lock()
+		delete(k.watching, conn)
+		k.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+
+	// replies receives the outcome of each keepalive request. A request is only sent once the previous
+	// one has been answered, so an unanswered request is counted as missed at each tick until it is.
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case err := <-replies:
+			if err != nil {
+				// The connection has been closed.
+				return
+			}
+			pending = false
+			missed = 0
+
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= k.MaxMissed {
+					log.Infof("Closing connection, %d keepalive requests went unanswered", missed)
+					atomic.AddInt64(&k.closed, 1)
+					_ = conn.Close()
+					return
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
+
+// Closed returns the number of connections that have been closed because they stopped answering.
+func (k *Keepalive) Closed() int64 {
+	return atomic.LoadInt64(&k.closed)
+}
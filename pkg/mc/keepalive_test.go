@@ -0,0 +1,70 @@
+package mc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeepaliveConn answers keepalive requests unless it is hung.
+type fakeKeepaliveConn struct {
+	hung     bool
+	requests int64
+	closed   chan struct{}
+}
+
+func newFakeKeepaliveConn(hung bool) *fakeKeepaliveConn {
+	return &fakeKeepaliveConn{hung: hung, closed: make(chan struct{})}
+}
+
+func (c *fakeKeepaliveConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	atomic.AddInt64(&c.requests, 1)
+	if c.hung {
+		<-c.closed
+		return false, nil, context.Canceled
+	}
+
+	return false, nil, nil
+}
+
+func (c *fakeKeepaliveConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestKeepalive_Watch(t *testing.T) {
+	keepalive := NewKeepalive(10 * time.Millisecond)
+	keepalive.MaxMissed = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hung := newFakeKeepaliveConn(true)
+	alive := newFakeKeepaliveConn(false)
+	keepalive.Watch(ctx, hung)
+	keepalive.Watch(ctx, hung)
+	keepalive.Watch(ctx, alive)
+
+	select {
+	case <-hung.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The connection that stopped answering should have been closed")
+	}
+
+	// The hung connection is only watched once, so only one request is sent to it.
+	require.Equal(t, int64(1), atomic.LoadInt64(&hung.requests))
+	require.Equal(t, int64(1), keepalive.Closed())
+
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&alive.requests) >= 3 }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-alive.closed:
+		t.Fatal("The connection that answers should be left open")
+	default:
+	}
+
+	var none *Keepalive
+	none.Watch(ctx, alive)
+}
@@ -0,0 +1,134 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// ErrLeadershipLost is returned by MaintainLeadership when another instance has become the leader, or
+// leadership couldn't be renewed in time.
+var ErrLeadershipLost = errors.New("leadership lost")
+
+// LeaderElector decides which of a primary mc-sshd and its warm standbys is active. Only the leader opens
+// the SSH listener, so instruments pointed at a single address fail over to a standby when the primary
+// goes down, without needing a load balancer.
+type LeaderElector interface {
+	// TryAcquire tries to become the leader, or to stay the leader if this instance already is. It
+	// returns whether this instance is the leader. It doesn't wait for the leader to go away.
+	TryAcquire(ctx context.Context) (bool, error)
+
+	// Release gives up leadership, so that a standby can take over right away.
+	Release()
+}
+
+// WaitForLeadership calls elector.TryAcquire every interval until this instance is the leader. It returns
+// ctx.Err() if ctx is done first. Errors from TryAcquire are logged and retried.
+func WaitForLeadership(ctx context.Context, elector LeaderElector, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		leader, err := elector.TryAcquire(ctx)
+		switch {
+		case err != nil:
+			log.Errorf("Unable to check for leadership: %s", err)
+		case leader:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// MaintainLeadership renews leadership every interval. It returns ErrLeadershipLost once another
+// instance is the leader, or when leadership hasn't been renewed for timeout, which should be less
+// than the time a lease lasts so that this instance stops before a standby can take over. It returns
+// ctx.Err() if ctx is done first.
+func MaintainLeadership(ctx context.Context, elector LeaderElector, interval, timeout time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastRenewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		leader, err := elector.TryAcquire(ctx)
+		switch {
+		case err != nil:
+			log.Errorf("Unable to renew leadership: %s", err)
+			if time.Since(lastRenewed) >= timeout {
+				return ErrLeadershipLost
+			}
+		case !leader:
+			return ErrLeadershipLost
+		default:
+			lastRenewed = time.Now()
+		}
+	}
+}
+
+// FileLeaderElector is a LeaderElector that uses an exclusive lock on a file. The leader is the instance
+// holding the lock, which the operating system releases when the instance exits, however it exits. The
+// instances have to be on the same host, or use a shared filesystem with working flock support.
+type FileLeaderElector struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileLeaderElector(path string) *FileLeaderElector {
+	return &FileLeaderElector{path: path}
+}
+
+func (e *FileLeaderElector) TryAcquire(_ context.Context) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file != nil {
+		// The lock is held until it is released, so there is nothing to renew.
+		return true, nil
+	}
+
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	locked, err := tryLockFile(f)
+	if err != nil || !locked {
+		_ = f.Close()
+		return false, err
+	}
+
+	e.file = f
+	return true, nil
+}
+
+func (e *FileLeaderElector) Release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		return
+	}
+
+	// Closing the file releases the lock.
+	if err := e.file.Close(); err != nil {
+		log.Errorf("Unable to release leadership lock %s: %s", e.path, err)
+	}
+	e.file = nil
+}
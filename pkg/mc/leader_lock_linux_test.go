@@ -0,0 +1,29 @@
+package mc
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLeaderElector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mcsshd.lock")
+	primary := NewFileLeaderElector(path)
+	standby := NewFileLeaderElector(path)
+
+	leader, err := primary.TryAcquire(context.Background())
+	require.NoError(t, err)
+	require.True(t, leader)
+
+	leader, err = standby.TryAcquire(context.Background())
+	require.NoError(t, err)
+	require.False(t, leader, "Only one instance can hold the lock")
+
+	primary.Release()
+
+	leader, err = standby.TryAcquire(context.Background())
+	require.NoError(t, err)
+	require.True(t, leader, "The standby takes over once the lock is released")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mc
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLockFile takes an exclusive lock on f without waiting. It is only supported on Linux.
+func tryLockFile(_ *os.File) (bool, error) {
+	return false, errors.New("file leader election is only supported on linux")
+}
@@ -0,0 +1,52 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedLeaderElector returns the results of TryAcquire in order, repeating the last one.
+type scriptedLeaderElector struct {
+	results []error
+	leader  []bool
+	calls   int
+}
+
+func (e *scriptedLeaderElector) TryAcquire(_ context.Context) (bool, error) {
+	i := e.calls
+	if i >= len(e.leader) {
+		i = len(e.leader) - 1
+	}
+	e.calls++
+	return e.leader[i], e.results[i]
+}
+
+func (e *scriptedLeaderElector) Release() {}
+
+func TestWaitForLeadership(t *testing.T) {
+	elector := &scriptedLeaderElector{
+		leader:  []bool{false, false, true},
+		results: []error{nil, errors.New("redis down"), nil},
+	}
+
+	require.NoError(t, WaitForLeadership(context.Background(), elector, time.Millisecond))
+	require.Equal(t, 3, elector.calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	never := &scriptedLeaderElector{leader: []bool{false}, results: []error{nil}}
+	require.ErrorIs(t, WaitForLeadership(ctx, never, time.Millisecond), context.Canceled)
+}
+
+func TestMaintainLeadership(t *testing.T) {
+	lost := &scriptedLeaderElector{leader: []bool{true, false}, results: []error{nil, nil}}
+	require.ErrorIs(t, MaintainLeadership(context.Background(), lost, time.Millisecond, time.Hour), ErrLeadershipLost)
+
+	// Leadership is given up once it can't be renewed within the timeout.
+	failing := &scriptedLeaderElector{leader: []bool{false}, results: []error{errors.New("redis down")}}
+	require.ErrorIs(t, MaintainLeadership(context.Background(), failing, time.Millisecond, 10*time.Millisecond), ErrLeadershipLost)
+}
@@ -0,0 +1,160 @@
+package mc
+
+import (
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// FileLink makes the file with FileID a link to the file with TargetFileID. The target may be in
+// another project.
+type FileLink struct {
+	FileID       int `gorm:"primaryKey"`
+	TargetFileID int
+}
+
+func (FileLink) TableName() string {
+	return "file_links"
+}
+
+// LinkStore resolves Materials Commons files that are links to other files. Links are presented to
+// SFTP clients as symbolic links.
+type LinkStore interface {
+	// GetLinkTargets returns the target of each file in files that is a link, keyed by the ID of the
+	// link. Files that aren't links are left out. The targets have their Directory loaded.
+	GetLinkTargets(files []mcmodel.File) (map[int]*mcmodel.File, error)
+}
+
+// GormLinkStore reads links from the file_links table, which mc-sshd adds to the Materials Commons
+// database:
+//
+//	CREATE TABLE file_links (
+//	    file_id INT UNSIGNED PRIMARY KEY,
+//	    target_file_id INT UNSIGNED NOT NULL
+//	);
+//
+// A link whose target has been deleted is left out, so that it shows as a regular file.
+type GormLinkStore struct {
+	db *gorm.DB
+}
+
+func NewGormLinkStore(db *gorm.DB) *GormLinkStore {
+	return &GormLinkStore{db: db}
+}
+
+func (s *GormLinkStore) GetLinkTargets(files []mcmodel.File) (map[int]*mcmodel.File, error) {
+	targets := make(map[int]*mcmodel.File)
+	if len(files) == 0 {
+		return targets, nil
+	}
+
+	fileIDs := make([]int, 0, len(files))
+	for _, f := range files {
+		fileIDs = append(fileIDs, f.ID)
+	}
+
+	var links []FileLink
+	if err := s.db.Where("file_id IN ?", fileIDs).Find(&links).Error; err != nil {
+		return nil, err
+	}
+
+	if len(links) == 0 {
+		return targets, nil
+	}
+
+	targetIDs := make([]int, 0, len(links))
+	for _, link := range links {
+		targetIDs = append(targetIDs, link.TargetFileID)
+	}
+
+	var targetFiles []mcmodel.File
+	err := s.db.Preload("Directory").
+		Where("id IN ?", targetIDs).
+		Where("deleted_at IS NULL").
+		Find(&targetFiles).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*mcmodel.File, len(targetFiles))
+	for i := range targetFiles {
+		byID[targetFiles[i].ID] = &targetFiles[i]
+	}
+
+	for _, link := range links {
+		if target, ok := byID[link.TargetFileID]; ok {
+			targets[link.FileID] = target
+		}
+	}
+
+	return targets, nil
+}
+
+// NoLinksStore is a LinkStore for databases without file links. No file is a link.
+type NoLinksStore struct{}
+
+func NewNoLinksStore() *NoLinksStore {
+	return &NoLinksStore{}
+}
+
+func (s *NoLinksStore) GetLinkTargets(_ []mcmodel.File) (map[int]*mcmodel.File, error) {
+	return map[int]*mcmodel.File{}, nil
+}
+
+// FakeLinkStore is a LinkStore for testing. Targets maps the ID of each link to its target.
+type FakeLinkStore struct {
+	Targets map[int]*mcmodel.File
+}
+
+func NewFakeLinkStore(targets map[int]*mcmodel.File) *FakeLinkStore {
+	return &FakeLinkStore{Targets: targets}
+}
+
+func (s *FakeLinkStore) GetLinkTargets(files []mcmodel.File) (map[int]*mcmodel.File, error) {
+	targets := make(map[int]*mcmodel.File)
+	for _, f := range files {
+		if target, ok := s.Targets[f.ID]; ok {
+			targets[f.ID] = target
+		}
+	}
+
+	return targets, nil
+}
+
+// GetLinkTargets returns the targets for the files that are links, for the user with userID. A target in
+// another project than its link is only returned if the user can access that project; otherwise the link
+// maps to nil, so that it can be hidden rather than giving the user a way into a project they aren't a
+// member of. If the stores don't have a LinkStore, or the targets can't be loaded, then the files are
+// treated as not being links.
+func GetLinkTargets(stores *Stores, userID int, files []mcmodel.File) map[int]*mcmodel.File {
+	if stores.LinkStore == nil {
+		return nil
+	}
+
+	targets, err := stores.LinkStore.GetLinkTargets(files)
+	if err != nil {
+		log.Errorf("Unable to load link targets: %s", err)
+		return nil
+	}
+
+	// Links usually point within the same few projects, so only check each project once.
+	canAccess := make(map[int]bool)
+	for _, f := range files {
+		target, isLink := targets[f.ID]
+		if !isLink || target.ProjectID == f.ProjectID {
+			continue
+		}
+
+		allowed, checked := canAccess[target.ProjectID]
+		if !checked {
+			allowed = stores.ProjectStore.UserCanAccessProject(userID, target.ProjectID)
+			canAccess[target.ProjectID] = allowed
+		}
+
+		if !allowed {
+			targets[f.ID] = nil
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,70 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// memberProjectStore only lets users access the projects in members.
+type memberProjectStore struct {
+	*store.FakeProjectStore
+	members map[int]bool
+	checks  int
+}
+
+func (s *memberProjectStore) UserCanAccessProject(_, projectID int) bool {
+	s.checks++
+	return s.members[projectID]
+}
+
+func TestGetLinkTargets(t *testing.T) {
+	sameProject := &mcmodel.File{ID: 100, ProjectID: 1, Name: "a.txt"}
+	memberProject := &mcmodel.File{ID: 200, ProjectID: 2, Name: "b.txt"}
+	otherProject := &mcmodel.File{ID: 300, ProjectID: 3, Name: "c.txt"}
+	otherProject2 := &mcmodel.File{ID: 301, ProjectID: 3, Name: "d.txt"}
+
+	projectStore := &memberProjectStore{FakeProjectStore: store.NewFakeProjectStore(nil), members: map[int]bool{1: true, 2: true}}
+	stores := &Stores{
+		ProjectStore: projectStore,
+		LinkStore: NewFakeLinkStore(map[int]*mcmodel.File{
+			1: sameProject,
+			2: memberProject,
+			3: otherProject,
+			4: otherProject2,
+		}),
+	}
+
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1},
+		{ID: 2, ProjectID: 1},
+		{ID: 3, ProjectID: 1},
+		{ID: 4, ProjectID: 1},
+		{ID: 5, ProjectID: 1},
+	}
+
+	targets := GetLinkTargets(stores, 10, files)
+	require.Same(t, sameProject, targets[1])
+	require.Same(t, memberProject, targets[2])
+
+	// Links into a project the user can't access are still links, but without a target.
+	target, isLink := targets[3]
+	require.True(t, isLink)
+	require.Nil(t, target)
+	target, isLink = targets[4]
+	require.True(t, isLink)
+	require.Nil(t, target)
+
+	_, isLink = targets[5]
+	require.False(t, isLink)
+
+	// Each other project is only checked once, and the link's own project isn't checked.
+	require.Equal(t, 2, projectStore.checks)
+}
+
+func TestGetLinkTargetsWithoutLinkStore(t *testing.T) {
+	stores := &Stores{ProjectStore: store.NewFakeProjectStore(nil)}
+	require.Empty(t, GetLinkTargets(stores, 10, []mcmodel.File{{ID: 1, ProjectID: 1}}))
+}
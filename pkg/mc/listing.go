@@ -0,0 +1,163 @@
+package mc
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// InternalFileNames are the names of the files that control the server, rather than hold data. They
+// are hidden from listings when Config.HideInternalFiles is set.
+var InternalFileNames = []string{MCIgnoreFileName, DeleteConfirmationFileName}
+
+// IsInternalFileName returns true if name is one of the InternalFileNames.
+func IsInternalFileName(name string) bool {
+	return containsString(InternalFileNames, name)
+}
+
+// dotFileInfo is a "." or ".." entry. It has the attributes of the directory it refers to.
+type dotFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi dotFileInfo) Name() string {
+	return fi.name
+}
+
+// ArrangeListing puts the entries of a directory listing in the order clients see them. The entries are
+// sorted by name, byte by byte, so that listings are the same every time regardless of the order the
+// store returns them in. The InternalFileNames are removed when config.HideInternalFiles is set. When
+// config.ListDotEntries is set the listing starts with "." and "..", as OpenSSH's sftp-server does,
+// with the attributes of dir and parent. A nil parent uses the attributes of dir, as for the root.
+func ArrangeListing(config *Config, dir, parent os.FileInfo, entries []os.FileInfo) []os.FileInfo {
+	arranged := make([]os.FileInfo, 0, len(entries)+2)
+	if config.ListDotEntries && dir != nil {
+		if parent == nil {
+			parent = dir
+		}
+		arranged = append(arranged, dotFileInfo{FileInfo: dir, name: "."}, dotFileInfo{FileInfo: parent, name: ".."})
+	}
+
+	sorted := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		if config.HideInternalFiles && IsInternalFileName(fi.Name()) {
+			continue
+		}
+		sorted = append(sorted, fi)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name() < sorted[j].Name() })
+
+	return append(arranged, sorted...)
+}
+
+// PagedListing is a directory listing that is read from the ListingStore a page at a time as the client
+// asks for the entries, rather than all at once, so that listing a directory with millions of entries
+// only holds a page of them in memory. It is used for directories with more than Config.MaxListEntries
+// entries. The entries are ordered and filtered as ArrangeListing does. PagedListing implements the
+// sftp.ListerAt interface. Clients read listings from the start, so reading an offset before the
+// current page starts over from the first page.
+type PagedListing struct {
+	store     ListingStore
+	projectID int
+	dirID     int
+	pageSize  int
+
+	// convert turns a page of files into the entries returned to the client.
+	convert      func(files []mcmodel.File) []os.FileInfo
+	leading      []os.FileInfo
+	hideInternal bool
+
+	mu sync.Mutex
+
+	// page holds the entries from offset pageOffset. afterName is the name of the last file read from
+	// the store, and done is set once the store has no more files.
+	page       []os.FileInfo
+	pageOffset int64
+	afterName  string
+	done       bool
+}
+
+// NewPagedListing creates a PagedListing for the directory with dirID in the project, that reads
+// pageSize files at a time and turns them into entries with convert. dir and parent are the attributes
+// used for the "." and ".." entries, as for ArrangeListing.
+func NewPagedListing(config *Config, store ListingStore, projectID, dirID, pageSize int, dir, parent os.FileInfo,
+	convert func(files []mcmodel.File) []os.FileInfo) *PagedListing {
+	l := &PagedListing{
+		store:        store,
+		projectID:    projectID,
+		dirID:        dirID,
+		pageSize:     pageSize,
+		convert:      convert,
+		leading:      ArrangeListing(config, dir, parent, nil),
+		hideInternal: config.HideInternalFiles,
+	}
+
+	l.reset()
+	return l
+}
+
+// reset goes back to the start of the listing. It must be called with mu held.
+func (l *PagedListing) reset() {
+	l.page = l.leading
+	l.pageOffset = 0
+	l.afterName = ""
+	l.done = false
+}
+
+// nextPage replaces the current page with the next one. It must be called with mu held.
+func (l *PagedListing) nextPage() error {
+	files, err := l.store.ListDirectoryPage(l.projectID, l.dirID, l.afterName, l.pageSize)
+	if err != nil {
+		return err
+	}
+
+	if len(files) < l.pageSize {
+		l.done = true
+	}
+	if len(files) != 0 {
+		l.afterName = files[len(files)-1].Name
+	}
+
+	l.pageOffset += int64(len(l.page))
+	l.page = l.page[:0:0]
+	for _, fi := range l.convert(files) {
+		if !l.hideInternal || !IsInternalFileName(fi.Name()) {
+			l.page = append(l.page, fi)
+		}
+	}
+
+	return nil
+}
+
+// ListAt copies the entries starting at offset into files. It returns io.EOF once the end of the
+// listing is reached.
+func (l *PagedListing) ListAt(files []os.FileInfo, offset int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset < l.pageOffset {
+		l.reset()
+	}
+
+	n := 0
+	for n < len(files) {
+		position := offset + int64(n)
+		for position >= l.pageOffset+int64(len(l.page)) {
+			if l.done {
+				return n, io.EOF
+			}
+			if err := l.nextPage(); err != nil {
+				return n, err
+			}
+		}
+
+		n += copy(files[n:], l.page[position-l.pageOffset:])
+	}
+
+	return n, nil
+}
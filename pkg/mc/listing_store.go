@@ -0,0 +1,242 @@
+package mc
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// DirectoryUsage is the size of a directory tree: the total size of the files in it, and the number of
+// files and directories in it, not counting the directory itself.
+type DirectoryUsage struct {
+	Size        int64
+	Files       int64
+	Directories int64
+}
+
+// ListingStore pages through the entries of large directories, so that listing them doesn't load every
+// entry at once (see PagedListing), and totals up directory trees.
+type ListingStore interface {
+	// CountDirectoryEntries returns the number of entries in the directory with dirID, the number of
+	// files FileStore.ListDirectoryByPath returns for it.
+	CountDirectoryEntries(projectID, dirID int) (int64, error)
+
+	// ListDirectoryPage returns up to limit of the entries in the directory with dirID whose names sort
+	// after afterName, ordered by name byte by byte. A blank afterName starts at the first entry.
+	ListDirectoryPage(projectID, dirID int, afterName string, limit int) ([]mcmodel.File, error)
+
+	// GetDirectoryUsage returns the usage of the directory tree at dirPath, computed from the file
+	// records rather than the files in storage.
+	GetDirectoryUsage(projectID int, dirPath string) (*DirectoryUsage, error)
+
+	// ListTreePage returns up to limit of the files and directories in the directory tree at dirPath,
+	// including the directory itself, whose IDs are greater than afterID. They are ordered by ID, so
+	// that a large tree can be paged through, and the files have their Directory loaded.
+	ListTreePage(projectID int, dirPath string, afterID, limit int) ([]mcmodel.File, error)
+}
+
+type GormListingStore struct {
+	db *gorm.DB
+}
+
+func NewGormListingStore(db *gorm.DB) *GormListingStore {
+	return &GormListingStore{db: db}
+}
+
+// directoryEntries selects the entries of a directory in the same way as ListDirectoryByPath.
+func (s *GormListingStore) directoryEntries(projectID, dirID int) *gorm.DB {
+	return s.db.Model(&mcmodel.File{}).
+		Where("directory_id = ?", dirID).
+		Where("project_id = ?", projectID).
+		Where("deleted_at IS NULL").
+		Where("dataset_id IS NULL").
+		Where("current = true")
+}
+
+func (s *GormListingStore) CountDirectoryEntries(projectID, dirID int) (int64, error) {
+	var count int64
+	err := s.directoryEntries(projectID, dirID).Count(&count).Error
+	return count, err
+}
+
+// ListDirectoryPage compares the names as binary strings, so that the order matches Go's string order
+// regardless of the column's collation. SQLite compares strings as binary by default.
+func (s *GormListingStore) ListDirectoryPage(projectID, dirID int, afterName string, limit int) ([]mcmodel.File, error) {
+	name := "BINARY name"
+	if isSQLite(s.db) {
+		name = "name"
+	}
+
+	var files []mcmodel.File
+	err := s.directoryEntries(projectID, dirID).
+		Where(name+" > ?", afterName).
+		Order(name).
+		Limit(limit).
+		Find(&files).Error
+
+	return files, err
+}
+
+// likeEscaper escapes the characters that are special in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// treeDirectories selects the directories in the tree at dirPath, by path.
+func (s *GormListingStore) treeDirectories(projectID int, dirPath string) *gorm.DB {
+	query := s.db.Model(&mcmodel.File{}).
+		Where("project_id = ?", projectID).
+		Where("mime_type = ?", "directory").
+		Where("deleted_at IS NULL").
+		Where("dataset_id IS NULL").
+		Where("current = true")
+
+	if dirPath == "/" {
+		return query
+	}
+
+	return query.Where("path = ? OR path LIKE ?", dirPath, likeEscaper.Replace(dirPath)+"/%")
+}
+
+// GetDirectoryUsage finds the directories in the tree by path, and then sums up the files in them.
+func (s *GormListingStore) GetDirectoryUsage(projectID int, dirPath string) (*DirectoryUsage, error) {
+	dirs := func() *gorm.DB {
+		return s.treeDirectories(projectID, dirPath)
+	}
+
+	var usage DirectoryUsage
+	if err := dirs().Count(&usage.Directories).Error; err != nil {
+		return nil, err
+	}
+
+	// The tree's own directory isn't counted.
+	if usage.Directories > 0 {
+		usage.Directories--
+	}
+
+	var totals struct {
+		Files int64
+		Size  int64
+	}
+
+	err := s.db.Model(&mcmodel.File{}).
+		Select("COUNT(*) AS files, COALESCE(SUM(size), 0) AS size").
+		Where("project_id = ?", projectID).
+		Where("directory_id IN (?)", dirs().Select("id")).
+		Where("mime_type <> ?", "directory").
+		Where("deleted_at IS NULL").
+		Where("dataset_id IS NULL").
+		Where("current = true").
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+
+	usage.Files, usage.Size = totals.Files, totals.Size
+	return &usage, nil
+}
+
+// ListTreePage finds the directories in the tree by path, and then pages through them and the files in
+// them.
+func (s *GormListingStore) ListTreePage(projectID int, dirPath string, afterID, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	err := s.db.Preload("Directory").
+		Where("project_id = ?", projectID).
+		Where("id IN (?) OR directory_id IN (?)",
+			s.treeDirectories(projectID, dirPath).Select("id"), s.treeDirectories(projectID, dirPath).Select("id")).
+		Where("deleted_at IS NULL").
+		Where("dataset_id IS NULL").
+		Where("current = true").
+		Where("id > ?", afterID).
+		Order("id").
+		Limit(limit).
+		Find(&files).Error
+
+	return files, err
+}
+
+// FakeListingStore is a ListingStore for testing that pages through the files in Files.
+type FakeListingStore struct {
+	Files []mcmodel.File
+}
+
+func NewFakeListingStore(files ...mcmodel.File) *FakeListingStore {
+	return &FakeListingStore{Files: files}
+}
+
+func (s *FakeListingStore) entries(projectID, dirID int) []mcmodel.File {
+	var files []mcmodel.File
+	for _, f := range s.Files {
+		if f.ProjectID == projectID && f.DirectoryID == dirID {
+			files = append(files, f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+func (s *FakeListingStore) CountDirectoryEntries(projectID, dirID int) (int64, error) {
+	return int64(len(s.entries(projectID, dirID))), nil
+}
+
+func (s *FakeListingStore) ListDirectoryPage(projectID, dirID int, afterName string, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	for _, f := range s.entries(projectID, dirID) {
+		if f.Name > afterName && len(files) < limit {
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+func (s *FakeListingStore) GetDirectoryUsage(projectID int, dirPath string) (*DirectoryUsage, error) {
+	inTree := make(map[int]bool)
+	for _, f := range s.Files {
+		if f.ProjectID == projectID && f.IsDir() && (dirPath == "/" || f.Path == dirPath || strings.HasPrefix(f.Path, dirPath+"/")) {
+			inTree[f.ID] = true
+		}
+	}
+
+	var usage DirectoryUsage
+	for _, f := range s.Files {
+		switch {
+		case f.ProjectID != projectID:
+		case f.IsDir() && inTree[f.ID] && f.Path != dirPath:
+			usage.Directories++
+		case !f.IsDir() && inTree[f.DirectoryID]:
+			usage.Files++
+			usage.Size += int64(f.Size)
+		}
+	}
+
+	return &usage, nil
+}
+
+func (s *FakeListingStore) ListTreePage(projectID int, dirPath string, afterID, limit int) ([]mcmodel.File, error) {
+	dirs := make(map[int]*mcmodel.File)
+	for i := range s.Files {
+		f := &s.Files[i]
+		if f.ProjectID == projectID && f.IsDir() && (dirPath == "/" || f.Path == dirPath || strings.HasPrefix(f.Path, dirPath+"/")) {
+			dirs[f.ID] = f
+		}
+	}
+
+	var files []mcmodel.File
+	for _, f := range s.Files {
+		if f.ID <= afterID || f.ProjectID != projectID {
+			continue
+		}
+
+		if _, ok := dirs[f.ID]; !ok && dirs[f.DirectoryID] == nil {
+			continue
+		}
+
+		f.Directory = dirs[f.DirectoryID]
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files[:minInt(limit, len(files))], nil
+}
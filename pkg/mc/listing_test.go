@@ -0,0 +1,151 @@
+package mc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrangeListing(t *testing.T) {
+	fileInfo := func(name, mimeType string) os.FileInfo {
+		f := mcmodel.File{Name: name, MimeType: mimeType}
+		return f.ToFileInfo()
+	}
+
+	names := func(fileInfos []os.FileInfo) []string {
+		var names []string
+		for _, fi := range fileInfos {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+
+	entries := []os.FileInfo{
+		fileInfo("b.csv", "text/csv"),
+		fileInfo(MCIgnoreFileName, "text/plain"),
+		fileInfo("B.csv", "text/csv"),
+		fileInfo("a", "directory"),
+	}
+	dir := fileInfo("raw", "directory")
+	parent := fileInfo("data", "directory")
+
+	tests := []struct {
+		name           string
+		listDotEntries bool
+		hideInternal   bool
+		expected       []string
+	}{
+		{"sorted", false, false, []string{MCIgnoreFileName, "B.csv", "a", "b.csv"}},
+		{"hide internal files", false, true, []string{"B.csv", "a", "b.csv"}},
+		{"dot entries", true, true, []string{".", "..", "B.csv", "a", "b.csv"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.ListDotEntries = test.listDotEntries
+			config.HideInternalFiles = test.hideInternal
+
+			arranged := ArrangeListing(config, dir, parent, entries)
+			require.Equal(t, test.expected, names(arranged))
+		})
+	}
+
+	// The dot entries have the attributes of the directories they refer to, and the root is its own parent.
+	config := DefaultConfig()
+	config.ListDotEntries = true
+	arranged := ArrangeListing(config, dir, nil, nil)
+	require.Len(t, arranged, 2)
+	require.True(t, arranged[0].IsDir())
+	require.True(t, arranged[1].IsDir())
+
+	require.Equal(t, "b.csv", entries[0].Name(), "The entries passed in aren't reordered")
+}
+
+func TestPagedListing(t *testing.T) {
+	var files []mcmodel.File
+	for i := 24; i >= 0; i-- {
+		files = append(files, mcmodel.File{ID: i + 1, ProjectID: 1, DirectoryID: 100, Name: fmt.Sprintf("file-%02d", i), MimeType: "text/plain"})
+	}
+	files = append(files,
+		mcmodel.File{ID: 50, ProjectID: 1, DirectoryID: 100, Name: MCIgnoreFileName, MimeType: "text/plain"},
+		mcmodel.File{ID: 51, ProjectID: 1, DirectoryID: 101, Name: "elsewhere", MimeType: "text/plain"})
+
+	listingStore := NewFakeListingStore(files...)
+	count, err := listingStore.CountDirectoryEntries(1, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(26), count)
+
+	config := DefaultConfig()
+	config.ListDotEntries = true
+	config.HideInternalFiles = true
+
+	pages := 0
+	convert := func(files []mcmodel.File) []os.FileInfo {
+		pages++
+		var fileInfos []os.FileInfo
+		for _, f := range files {
+			fileInfos = append(fileInfos, f.ToFileInfo())
+		}
+		return fileInfos
+	}
+
+	dir := mcmodel.File{Name: "big", MimeType: "directory"}
+	listing := NewPagedListing(config, listingStore, 1, 100, 10, dir.ToFileInfo(), nil, convert)
+
+	// Read the listing the way the sftp server does, a batch at a time.
+	readAll := func() []string {
+		var names []string
+		batch := make([]os.FileInfo, 7)
+		for offset := int64(0); ; {
+			n, err := listing.ListAt(batch, offset)
+			for _, fi := range batch[:n] {
+				names = append(names, fi.Name())
+			}
+			offset += int64(n)
+			if err == io.EOF {
+				return names
+			}
+			require.NoError(t, err)
+		}
+	}
+
+	expected := []string{".", ".."}
+	for i := 0; i < 25; i++ {
+		expected = append(expected, fmt.Sprintf("file-%02d", i))
+	}
+
+	require.Equal(t, expected, readAll())
+	require.Equal(t, 3, pages, "The entries are read 10 at a time")
+
+	// Reading the listing again starts over.
+	require.Equal(t, expected, readAll())
+
+	n, err := listing.ListAt(make([]os.FileInfo, 5), 100)
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestDirectoryUsage(t *testing.T) {
+	listingStore := NewFakeListingStore(
+		mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		mcmodel.File{ID: 2, ProjectID: 1, DirectoryID: 1, Name: "raw", Path: "/raw", MimeType: "directory"},
+		mcmodel.File{ID: 3, ProjectID: 1, DirectoryID: 2, Name: "run-1", Path: "/raw/run-1", MimeType: "directory"},
+		mcmodel.File{ID: 4, ProjectID: 1, DirectoryID: 1, Name: "raw2", Path: "/raw2", MimeType: "directory"},
+		mcmodel.File{ID: 5, ProjectID: 1, DirectoryID: 2, Name: "a.tif", Size: 100, MimeType: "image/tiff"},
+		mcmodel.File{ID: 6, ProjectID: 1, DirectoryID: 3, Name: "b.tif", Size: 200, MimeType: "image/tiff"},
+		mcmodel.File{ID: 7, ProjectID: 1, DirectoryID: 4, Name: "c.tif", Size: 400, MimeType: "image/tiff"},
+	)
+
+	usage, err := listingStore.GetDirectoryUsage(1, "/raw")
+	require.NoError(t, err)
+	require.Equal(t, DirectoryUsage{Size: 300, Files: 2, Directories: 1}, *usage)
+
+	usage, err = listingStore.GetDirectoryUsage(1, "/")
+	require.NoError(t, err)
+	require.Equal(t, DirectoryUsage{Size: 700, Files: 3, Directories: 3}, *usage)
+}
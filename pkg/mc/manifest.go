@@ -0,0 +1,246 @@
+package mc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// ManifestFileName is the name of a manifest file. When a manifest is uploaded every file it lists is
+// checked against the data stored on the server once the session ends, and the results are written
+// to a ManifestReportFileName file in the same directory as the manifest. The manifest uses the
+// format written by sha256sum, with paths relative to the directory the manifest is in.
+const ManifestFileName = "manifest.sha256"
+
+// ManifestReportFileName is the name of the file the results of verifying a manifest are written to.
+const ManifestReportFileName = "manifest.report"
+
+// ManifestEntry is a single line from a manifest.
+type ManifestEntry struct {
+	Checksum string
+	Path     string
+}
+
+// ParseManifest parses the contents of a manifest. Each line is a hex encoded SHA-256 checksum followed
+// by a space, then either a space (text mode) or a '*' (binary mode), then the path. Blank lines and
+// lines starting with # are skipped.
+func ParseManifest(contents []byte) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// 64 hex characters, a space, a mode character and at least one character of path.
+		if len(line) < 67 || line[64] != ' ' || (line[65] != ' ' && line[65] != '*') {
+			return nil, fmt.Errorf("line %d is malformed", lineNumber)
+		}
+
+		checksum := strings.ToLower(line[:64])
+		if strings.Trim(checksum, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("line %d has an invalid checksum", lineNumber)
+		}
+
+		entries = append(entries, ManifestEntry{Checksum: checksum, Path: line[66:]})
+	}
+
+	return entries, scanner.Err()
+}
+
+// ManifestVerifier collects the manifests uploaded during a session so that they can be verified when
+// the session ends, after the files they list have been uploaded.
+type ManifestVerifier struct {
+	stores   *Stores
+	mcfsRoot string
+
+	mu        sync.Mutex
+	manifests []pendingManifest
+}
+
+type pendingManifest struct {
+	projectID int
+	ownerID   int
+	path      string
+}
+
+func NewManifestVerifier(stores *Stores, mcfsRoot string) *ManifestVerifier {
+	return &ManifestVerifier{stores: stores, mcfsRoot: mcfsRoot}
+}
+
+// Add queues the manifest at path in the project to be verified. The report is owned by ownerID.
+func (v *ManifestVerifier) Add(projectID, ownerID int, path string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.manifests = append(v.manifests, pendingManifest{projectID: projectID, ownerID: ownerID, path: path})
+}
+
+// VerifyAll verifies all the queued manifests and writes their reports. Failures are logged.
+func (v *ManifestVerifier) VerifyAll() {
+	v.mu.Lock()
+	manifests := v.manifests
+	v.manifests = nil
+	v.mu.Unlock()
+
+	for _, m := range manifests {
+		if err := VerifyManifest(v.stores, m.projectID, m.ownerID, m.path, v.mcfsRoot); err != nil {
+			log.Errorf("Unable to verify manifest %s in project %d: %s", m.path, m.projectID, err)
+		}
+	}
+}
+
+// VerifyManifest checks each file listed in the manifest at manifestPath against the data stored for it,
+// and writes the results to a ManifestReportFileName file next to the manifest.
+func VerifyManifest(stores *Stores, projectID, ownerID int, manifestPath, mcfsRoot string) error {
+	manifestFile, err := stores.FileStore.GetFileByPath(projectID, manifestPath)
+	if err != nil {
+		return err
+	}
+
+	contents, err := os.ReadFile(manifestFile.ToUnderlyingFilePath(mcfsRoot))
+	if err != nil {
+		return err
+	}
+
+	var report bytes.Buffer
+	dir := filepath.Dir(manifestPath)
+	CheckManifest(&report, stores, projectID, dir, contents, mcfsRoot)
+
+	return CreateFileWithContents(stores, projectID, ownerID, filepath.Join(dir, ManifestReportFileName), report.Bytes(), mcfsRoot)
+}
+
+// CheckManifest checks each file listed in the manifest with contents, whose paths are relative to the
+// directory at dir in the project, against the data stored for it, and writes the results to w.
+func CheckManifest(w io.Writer, stores *Stores, projectID int, dir string, contents []byte, mcfsRoot string) {
+	entries, err := ParseManifest(contents)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n", ManifestFileName, err)
+		return
+	}
+
+	writeManifestResults(w, stores, projectID, dir, entries, mcfsRoot)
+}
+
+// writeManifestResults writes a line for each entry in the style of sha256sum --check, followed by a summary.
+func writeManifestResults(w io.Writer, stores *Stores, projectID int, dir string, entries []ManifestEntry, mcfsRoot string) {
+	var ok, failed, missing int
+	for _, entry := range entries {
+		// Only files under the manifest's directory can be checked.
+		path := filepath.Join(dir, entry.Path)
+		if !strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") || path == dir {
+			fmt.Fprintf(w, "%s: INVALID PATH\n", entry.Path)
+			failed++
+			continue
+		}
+
+		file, err := stores.FileStore.GetFileByPath(projectID, path)
+		if err != nil || file.IsDir() {
+			fmt.Fprintf(w, "%s: MISSING\n", entry.Path)
+			missing++
+			continue
+		}
+
+		checksum, err := sha256File(file.ToUnderlyingFilePath(mcfsRoot))
+		switch {
+		case err != nil:
+			log.Errorf("Unable to read file %d for manifest verification: %s", file.ID, err)
+			fmt.Fprintf(w, "%s: FAILED open or read\n", entry.Path)
+			failed++
+		case checksum != entry.Checksum:
+			fmt.Fprintf(w, "%s: FAILED\n", entry.Path)
+			failed++
+		default:
+			fmt.Fprintf(w, "%s: OK\n", entry.Path)
+			ok++
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d files: %d OK, %d FAILED, %d MISSING\n", len(entries), ok, failed, missing)
+}
+
+// sha256File returns the hex encoded SHA-256 checksum of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// CreateFileWithContents creates a new version of the file at path in the project, owned by ownerID,
+// containing contents. It is used for files generated by the server rather than uploaded by a user.
+func CreateFileWithContents(stores *Stores, projectID, ownerID int, path string, contents []byte, mcfsRoot string) error {
+	_, err := CreateFileFromReader(stores, projectID, ownerID, path, bytes.NewReader(contents), mcfsRoot)
+	return err
+}
+
+// CreateFileFromReader creates a new version of the file at path in the project, owned by ownerID, with
+// the data read from r. The directory the file is in must already exist. It returns the new file, with its
+// checksum and size.
+func CreateFileFromReader(stores *Stores, projectID, ownerID int, path string, r io.Reader, mcfsRoot string) (*mcmodel.File, error) {
+	dir, err := stores.FileStore.GetDirByPath(projectID, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(path)
+	file, err := stores.FileStore.CreateFile(name, projectID, dir.ID, ownerID, GetMimeType(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0777); err != nil {
+		_ = AbortFile(stores, file, mcfsRoot)
+		return nil, err
+	}
+
+	f, err := os.Create(file.ToUnderlyingFilePath(mcfsRoot))
+	if err != nil {
+		_ = AbortFile(stores, file, mcfsRoot)
+		return nil, err
+	}
+
+	hasher := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, hasher), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = AbortFile(stores, file, mcfsRoot)
+		return nil, err
+	}
+
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	switched, err := CommitFile(stores, file, checksum, size, mcfsRoot)
+	if err != nil {
+		return nil, err
+	}
+	file.Checksum, file.Size = checksum, uint64(size)
+
+	if switched {
+		_ = os.Remove(file.ToUnderlyingFilePathForUUID(mcfsRoot))
+	}
+
+	return file, nil
+}
@@ -0,0 +1,40 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseManifest(t *testing.T) {
+	checksum := strings.Repeat("ab", 32)
+	tests := []struct {
+		name        string
+		contents    string
+		shouldFail  bool
+		wantEntries []ManifestEntry
+	}{
+		{"Text mode entry", checksum + "  data/run1.h5\n", false, []ManifestEntry{{checksum, "data/run1.h5"}}},
+		{"Binary mode entry", checksum + " *run1.h5\n", false, []ManifestEntry{{checksum, "run1.h5"}}},
+		{"Uppercase checksum", strings.ToUpper(checksum) + "  run1.h5", false, []ManifestEntry{{checksum, "run1.h5"}}},
+		{"Path with spaces", checksum + "  my run.h5\r\n", false, []ManifestEntry{{checksum, "my run.h5"}}},
+		{"Blank lines and comments are skipped", "# comment\n\n" + checksum + "  a\n", false, []ManifestEntry{{checksum, "a"}}},
+		{"Missing path", checksum + "  \n", true, nil},
+		{"Short checksum", "abcd  run1.h5\n", true, nil},
+		{"Invalid checksum characters", strings.Repeat("zz", 32) + "  run1.h5\n", true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := ParseManifest([]byte(test.contents))
+			if test.shouldFail {
+				require.NotNil(t, err, "ParseManifest should have failed for %q", test.contents)
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, test.wantEntries, entries)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package mc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// InMemoryPathLocker is a PathLocker whose locks are only visible within this process.
+type InMemoryPathLocker struct {
+	mu sync.Mutex
+
+	// locked contains an entry for each path that currently has a writer. The key is
+	// built by lockKey.
+	locked map[string]bool
+}
+
+// NewInMemoryPathLocker creates a new InMemoryPathLocker with no paths locked.
+func NewInMemoryPathLocker() *InMemoryPathLocker {
+	return &InMemoryPathLocker{locked: make(map[string]bool)}
+}
+
+// Lock attempts to acquire the write lock for path in the given project. It returns ErrFileBusy
+// if another writer holds the lock.
+func (l *InMemoryPathLocker) Lock(projectID int, path string) error {
+	key := lockKey(projectID, path)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locked[key] {
+		return ErrFileBusy
+	}
+
+	l.locked[key] = true
+	return nil
+}
+
+// Unlock releases the write lock for path in the given project. Unlocking a path that isn't
+// locked is a no-op.
+func (l *InMemoryPathLocker) Unlock(projectID int, path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locked, lockKey(projectID, path))
+}
+
+// lockKey creates the key used to track a path. Paths are only unique within a project, so the
+// project id is included in the key.
+func lockKey(projectID int, path string) string {
+	return fmt.Sprintf("%d:%s", projectID, path)
+}
+
+// InMemorySessionCounter is a SessionCounter that only counts sessions within this process.
+type InMemorySessionCounter struct {
+	mu     sync.Mutex
+	counts map[int]int64
+}
+
+// NewInMemorySessionCounter creates a new InMemorySessionCounter with no sessions.
+func NewInMemorySessionCounter() *InMemorySessionCounter {
+	return &InMemorySessionCounter{counts: make(map[int]int64)}
+}
+
+// Increment adds a session for the user and returns the user's session count.
+func (c *InMemorySessionCounter) Increment(userID int) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[userID]++
+	return c.counts[userID], nil
+}
+
+// Decrement removes a session for the user. Users without any sessions are removed so that
+// the map doesn't grow with every user that ever connected.
+func (c *InMemorySessionCounter) Decrement(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[userID]--
+	if c.counts[userID] <= 0 {
+		delete(c.counts, userID)
+	}
+}
+
+// InMemoryQuotaCounter is a QuotaCounter that only counts the bytes reserved within this process.
+type InMemoryQuotaCounter struct {
+	mu    sync.Mutex
+	bytes map[int]int64
+}
+
+// NewInMemoryQuotaCounter creates a new InMemoryQuotaCounter with all counts set to zero.
+func NewInMemoryQuotaCounter() *InMemoryQuotaCounter {
+	return &InMemoryQuotaCounter{bytes: make(map[int]int64)}
+}
+
+// AddBytes adds n bytes to the count for the project, and returns the new total.
+func (c *InMemoryQuotaCounter) AddBytes(projectID int, n int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes[projectID] += n
+	total := c.bytes[projectID]
+	if total <= 0 {
+		delete(c.bytes, projectID)
+	}
+
+	return total, nil
+}
+
+// Bytes returns the number of bytes reserved in the project.
+func (c *InMemoryQuotaCounter) Bytes(projectID int) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes[projectID], nil
+}
+
+// InMemoryAdvisoryLocker is an AdvisoryLocker whose locks are only visible within this process.
+type InMemoryAdvisoryLocker struct {
+	mu sync.Mutex
+
+	// locks is keyed by lockKey.
+	locks map[string]advisoryLock
+}
+
+type advisoryLock struct {
+	userID  int
+	expires time.Time
+}
+
+// NewInMemoryAdvisoryLocker creates a new InMemoryAdvisoryLocker with no paths locked.
+func NewInMemoryAdvisoryLocker() *InMemoryAdvisoryLocker {
+	return &InMemoryAdvisoryLocker{locks: make(map[string]advisoryLock)}
+}
+
+// Lock takes, or extends, the user's lock on path for ttl. It returns ErrFileLocked if another user
+// holds the lock.
+func (l *InMemoryAdvisoryLocker) Lock(projectID int, path string, userID int, ttl time.Duration) error {
+	key := lockKey(projectID, path)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lock, ok := l.locks[key]; ok && lock.userID != userID && time.Now().Before(lock.expires) {
+		return ErrFileLocked
+	}
+
+	l.locks[key] = advisoryLock{userID: userID, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// Unlock releases the user's lock on path. It returns ErrNotLocked if the user doesn't hold the lock.
+func (l *InMemoryAdvisoryLocker) Unlock(projectID int, path string, userID int) error {
+	key := lockKey(projectID, path)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lock, ok := l.locks[key]; !ok || lock.userID != userID || time.Now().After(lock.expires) {
+		return ErrNotLocked
+	}
+
+	delete(l.locks, key)
+	return nil
+}
+
+// LockHolder returns the user holding the lock on path. Expired locks are removed.
+func (l *InMemoryAdvisoryLocker) LockHolder(projectID int, path string) (int, bool, error) {
+	key := lockKey(projectID, path)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[key]
+	if !ok {
+		return 0, false, nil
+	}
+
+	if time.Now().After(lock.expires) {
+		delete(l.locks, key)
+		return 0, false, nil
+	}
+
+	return lock.userID, true, nil
+}
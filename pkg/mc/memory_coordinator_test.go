@@ -0,0 +1,51 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryPathLocker_Lock(t *testing.T) {
+	l := NewInMemoryPathLocker()
+
+	require.Nil(t, l.Lock(1, "/dir1/file.txt"), "First lock should succeed")
+	require.ErrorIs(t, l.Lock(1, "/dir1/file.txt"), ErrFileBusy, "Second lock on same path should fail")
+	require.Nil(t, l.Lock(2, "/dir1/file.txt"), "Same path in a different project should succeed")
+	require.Nil(t, l.Lock(1, "/dir1/file2.txt"), "Different path in the same project should succeed")
+
+	l.Unlock(1, "/dir1/file.txt")
+	require.Nil(t, l.Lock(1, "/dir1/file.txt"), "Lock after unlock should succeed")
+}
+
+func TestInMemorySessionCounter(t *testing.T) {
+	c := NewInMemorySessionCounter()
+
+	count, _ := c.Increment(1)
+	require.Equal(t, int64(1), count)
+	count, _ = c.Increment(1)
+	require.Equal(t, int64(2), count)
+
+	c.Decrement(1)
+	c.Decrement(1)
+	require.Empty(t, c.counts, "Users without sessions should be removed")
+}
+
+func TestInMemoryAdvisoryLocker(t *testing.T) {
+	l := NewInMemoryAdvisoryLocker()
+
+	require.Nil(t, l.Lock(1, "/results.csv", 10, time.Hour), "First lock should succeed")
+	require.Nil(t, l.Lock(1, "/results.csv", 10, time.Hour), "Relocking by the holder should extend the lock")
+	require.ErrorIs(t, l.Lock(1, "/results.csv", 11, time.Hour), ErrFileLocked, "Lock by another user should fail")
+	require.ErrorIs(t, CheckAdvisoryLock(l, 1, "/results.csv", 11), ErrFileLocked, "Writes by another user should fail")
+	require.Nil(t, CheckAdvisoryLock(l, 1, "/results.csv", 10), "Writes by the holder should succeed")
+	require.ErrorIs(t, l.Unlock(1, "/results.csv", 11), ErrNotLocked, "Only the holder can unlock")
+
+	require.Nil(t, l.Unlock(1, "/results.csv", 10))
+	_, locked, _ := l.LockHolder(1, "/results.csv")
+	require.False(t, locked, "Path should be unlocked after Unlock")
+
+	require.Nil(t, l.Lock(1, "/expired.csv", 10, -time.Second))
+	require.Nil(t, l.Lock(1, "/expired.csv", 11, time.Hour), "An expired lock can be taken by another user")
+}
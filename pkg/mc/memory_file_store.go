@@ -0,0 +1,556 @@
+package mc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// MemoryFileStore keeps the file records in memory, in place of the files table, for running mc-sshd
+// without a database (see NewOfflineStores). Unlike the fake stores used in testing it can be used by
+// concurrent sessions, and it is the FileStore, VersionStore, PendingFileStore, FileAuditStore and
+// ListingStore, so that all of them see the same files. Lookups scan every file, so it is only meant for
+// the small projects of demos and development. Files that aren't found return gorm.ErrRecordNotFound,
+// the same as the database.
+type MemoryFileStore struct {
+	mu           sync.Mutex
+	files        []mcmodel.File
+	lastID       int
+	mcfsRoot     string
+	projectStore store.ProjectStore
+	now          func() time.Time
+}
+
+// NewMemoryFileStore creates a MemoryFileStore for the files stored under mcfsRoot. The sizes of the
+// projects in projectStore are updated as files are written.
+func NewMemoryFileStore(mcfsRoot string, projectStore store.ProjectStore) *MemoryFileStore {
+	return &MemoryFileStore{mcfsRoot: mcfsRoot, projectStore: projectStore, now: time.Now}
+}
+
+// CreateProjectRoot creates the root directory of the project with projectID.
+func (s *MemoryFileStore) CreateProjectRoot(projectID, ownerID int) (*mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createDir(0, projectID, ownerID, "/", "/")
+}
+
+// add stores f with the next ID and a new UUID. It must be called with mu held.
+func (s *MemoryFileStore) add(f mcmodel.File) (*mcmodel.File, error) {
+	var err error
+	if f.UUID, err = uuid.GenerateUUID(); err != nil {
+		return nil, err
+	}
+
+	s.lastID++
+	f.ID = s.lastID
+	f.CreatedAt, f.UpdatedAt = s.now(), s.now()
+	s.files = append(s.files, f)
+	return s.withDirectory(f), nil
+}
+
+// createDir must be called with mu held.
+func (s *MemoryFileStore) createDir(parentDirID, projectID, ownerID int, path, name string) (*mcmodel.File, error) {
+	if dir := s.findDir(projectID, path); dir != nil {
+		return s.withDirectory(*dir), nil
+	}
+
+	return s.add(mcmodel.File{
+		OwnerID:              ownerID,
+		MimeType:             "directory",
+		MediaTypeDescription: "directory",
+		DirectoryID:          parentDirID,
+		Current:              true,
+		Path:                 path,
+		ProjectID:            projectID,
+		Name:                 name,
+	})
+}
+
+// find returns the stored file with id, or nil. It must be called with mu held.
+func (s *MemoryFileStore) find(id int) *mcmodel.File {
+	// The files are appended in ID order.
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].ID >= id })
+	if i < len(s.files) && s.files[i].ID == id {
+		return &s.files[i]
+	}
+
+	return nil
+}
+
+// findDir must be called with mu held.
+func (s *MemoryFileStore) findDir(projectID int, path string) *mcmodel.File {
+	for i := range s.files {
+		if s.files[i].IsDir() && s.files[i].ProjectID == projectID && s.files[i].Path == path {
+			return &s.files[i]
+		}
+	}
+
+	return nil
+}
+
+// withDirectory returns a copy of f with its Directory loaded. It must be called with mu held.
+func (s *MemoryFileStore) withDirectory(f mcmodel.File) *mcmodel.File {
+	if dir := s.find(f.DirectoryID); dir != nil && f.DirectoryID != 0 {
+		d := *dir
+		f.Directory = &d
+	}
+
+	return &f
+}
+
+// list returns copies, with their Directory loaded, of the files that match. It must be called with mu
+// held.
+func (s *MemoryFileStore) list(match func(f *mcmodel.File) bool, limit int) []mcmodel.File {
+	var files []mcmodel.File
+	for i := range s.files {
+		if limit > 0 && len(files) >= limit {
+			break
+		}
+
+		if match(&s.files[i]) {
+			files = append(files, *s.withDirectory(s.files[i]))
+		}
+	}
+
+	return files
+}
+
+func (s *MemoryFileStore) UpdateMetadataForFileAndProject(file *mcmodel.File, checksum string, totalBytes int64) error {
+	finfo, err := os.Stat(file.ToUnderlyingFilePath(s.mcfsRoot))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.find(file.ID)
+	if f == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	// The previous versions are no longer current.
+	for i := range s.files {
+		if s.files[i].DirectoryID == f.DirectoryID && s.files[i].Name == f.Name {
+			s.files[i].Current = false
+		}
+	}
+
+	f.Size, f.Current, f.UpdatedAt = uint64(finfo.Size()), true, s.now()
+	if checksum != "" {
+		f.Checksum = checksum
+	}
+	file.Size, file.Current, file.Checksum = f.Size, f.Current, f.Checksum
+
+	return s.projectStore.UpdateProjectSizeAndFileCount(file.ProjectID, totalBytes, 0)
+}
+
+func (s *MemoryFileStore) CreateFile(name string, projectID, directoryID, ownerID int, mimeType string) (*mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.add(mcmodel.File{
+		ProjectID:   projectID,
+		Name:        name,
+		DirectoryID: directoryID,
+		MimeType:    mimeType,
+		OwnerID:     ownerID,
+	})
+}
+
+func (s *MemoryFileStore) GetDirByPath(projectID int, path string) (*mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.findDir(projectID, path)
+	if dir == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return s.withDirectory(*dir), nil
+}
+
+func (s *MemoryFileStore) CreateDirectory(parentDirID, projectID, ownerID int, path, name string) (*mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createDir(parentDirID, projectID, ownerID, path, name)
+}
+
+func (s *MemoryFileStore) CreateDirIfNotExists(parentDirID int, path, name string, projectID, ownerID int) (*mcmodel.File, error) {
+	return s.CreateDirectory(parentDirID, projectID, ownerID, path, name)
+}
+
+func (s *MemoryFileStore) ListDirectoryByPath(projectID int, path string) ([]mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.findDir(projectID, path)
+	if dir == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	dirID := dir.ID
+	return s.list(func(f *mcmodel.File) bool { return f.DirectoryID == dirID && f.Current }, 0), nil
+}
+
+func (s *MemoryFileStore) GetOrCreateDirPath(projectID, ownerID int, path string) (*mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parent := s.findDir(projectID, "/")
+	if parent == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	dir := s.withDirectory(*parent)
+	current := "/"
+	for _, name := range strings.Split(strings.Trim(filepath.Clean(path), "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		current = filepath.Join(current, name)
+		var err error
+		if dir, err = s.createDir(dir.ID, projectID, ownerID, current, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return dir, nil
+}
+
+func (s *MemoryFileStore) GetFileByPath(projectID int, path string) (*mcmodel.File, error) {
+	if path == "/" {
+		return s.GetDirByPath(projectID, path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.findDir(projectID, filepath.Dir(path))
+	if dir == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	dirID, name := dir.ID, filepath.Base(path)
+	files := s.list(func(f *mcmodel.File) bool { return f.DirectoryID == dirID && f.Name == name && f.Current }, 1)
+	if len(files) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return &files[0], nil
+}
+
+func (s *MemoryFileStore) UpdateFileUses(file *mcmodel.File, uuid string, fileID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.find(file.ID)
+	if f == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	f.UsesUUID, f.UsesID = uuid, fileID
+	file.UsesUUID, file.UsesID = uuid, fileID
+	return nil
+}
+
+func (s *MemoryFileStore) PointAtExistingIfExists(file *mcmodel.File) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if file.Checksum == "" {
+		return false, nil
+	}
+
+	for i := range s.files {
+		matched := s.files[i]
+		if matched.ID != file.ID && matched.Checksum == file.Checksum && !matched.IsDir() {
+			if f := s.find(file.ID); f != nil {
+				f.UsesUUID, f.UsesID = matched.UUIDForUses(), matched.IDForUses()
+				file.UsesUUID, file.UsesID = f.UsesUUID, f.UsesID
+			}
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// DoneWritingToFile finishes a file in the same way as the database's FileStore.
+func (s *MemoryFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	if err := s.UpdateMetadataForFileAndProject(file, checksum, size); err != nil {
+		return false, err
+	}
+
+	switched, err := s.PointAtExistingIfExists(file)
+	if err != nil {
+		return false, err
+	}
+
+	if file.IsConvertible() {
+		if _, err := conversionStore.AddFileToConvert(file); err != nil {
+			return switched, err
+		}
+	}
+
+	return switched, nil
+}
+
+func (s *MemoryFileStore) ListVersions(file *mcmodel.File) ([]mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.list(func(f *mcmodel.File) bool { return f.DirectoryID == file.DirectoryID && f.Name == file.Name }, 0)
+
+	// Newest first.
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+
+	return versions, nil
+}
+
+// DeleteVersion removes the version's record, since there is no deleted_at to set.
+func (s *MemoryFileStore) DeleteVersion(file *mcmodel.File) error {
+	return s.remove(file.ID)
+}
+
+func (s *MemoryFileStore) DeletePendingFile(file *mcmodel.File) error {
+	return s.remove(file.ID)
+}
+
+func (s *MemoryFileStore) SetExpectedSize(file *mcmodel.File, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f := s.find(file.ID); f != nil && !f.Current {
+		f.Size = uint64(size)
+	}
+
+	return nil
+}
+
+// remove removes the file with id, unless it is current.
+func (s *MemoryFileStore) remove(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.files {
+		if s.files[i].ID == id && !s.files[i].Current {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryFileStore) ListPendingFiles(createdBefore time.Time, afterID, limit int) ([]mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(func(f *mcmodel.File) bool {
+		return !f.Current && f.Checksum == "" && !f.IsDir() && f.CreatedAt.Before(createdBefore) && f.ID > afterID
+	}, limit), nil
+}
+
+func (s *MemoryFileStore) ListStoredFiles(projectIDs []int, afterID, limit int) ([]mcmodel.File, error) {
+	inProjects := make(map[int]bool)
+	for _, id := range projectIDs {
+		inProjects[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(func(f *mcmodel.File) bool {
+		return f.ID > afterID && f.Checksum != "" && !f.IsDir() && (len(projectIDs) == 0 || inProjects[f.ProjectID])
+	}, limit), nil
+}
+
+func (s *MemoryFileStore) ReferencedUUIDs(uuids []string) (map[string]bool, error) {
+	wanted := make(map[string]bool)
+	for _, uuid := range uuids {
+		wanted[uuid] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referenced := make(map[string]bool)
+	for _, f := range s.files {
+		if wanted[f.UUID] {
+			referenced[f.UUID] = true
+		}
+		if wanted[f.UsesUUID] {
+			referenced[f.UsesUUID] = true
+		}
+	}
+
+	return referenced, nil
+}
+
+func (s *MemoryFileStore) ListFilesWithChecksum(checksum string, limit int) ([]mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(func(f *mcmodel.File) bool { return checksum != "" && f.Checksum == checksum && !f.IsDir() }, limit), nil
+}
+
+func (s *MemoryFileStore) CountDirectoryEntries(projectID, dirID int) (int64, error) {
+	files, err := s.ListDirectoryPage(projectID, dirID, "", 0)
+	return int64(len(files)), err
+}
+
+func (s *MemoryFileStore) ListDirectoryPage(projectID, dirID int, afterName string, limit int) ([]mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := s.list(func(f *mcmodel.File) bool {
+		return f.ProjectID == projectID && f.DirectoryID == dirID && f.Current && f.Name > afterName
+	}, 0)
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+	}
+
+	return files, nil
+}
+
+// dirInTree returns true if dir, a directory, is dirPath or is under it.
+func dirInTree(dir *mcmodel.File, dirPath string) bool {
+	return dirPath == "/" || dir.Path == dirPath || strings.HasPrefix(dir.Path, dirPath+"/")
+}
+
+func (s *MemoryFileStore) GetDirectoryUsage(projectID int, dirPath string) (*DirectoryUsage, error) {
+	files, err := s.ListTreePage(projectID, dirPath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage DirectoryUsage
+	for _, f := range files {
+		switch {
+		case f.IsDir() && f.Path != dirPath:
+			usage.Directories++
+		case !f.IsDir():
+			usage.Files++
+			usage.Size += int64(f.Size)
+		}
+	}
+
+	return &usage, nil
+}
+
+func (s *MemoryFileStore) ListTreePage(projectID int, dirPath string, afterID, limit int) ([]mcmodel.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(func(f *mcmodel.File) bool {
+		if f.ProjectID != projectID || !f.Current || f.ID <= afterID {
+			return false
+		}
+
+		if f.IsDir() {
+			return dirInTree(f, dirPath)
+		}
+
+		dir := s.find(f.DirectoryID)
+		return dir != nil && dirInTree(dir, dirPath)
+	}, limit), nil
+}
+
+// NewOfflineStores returns stores that keep everything in memory, so that mc-sshd can be run, to develop
+// and demo it, without a Materials Commons database. The projects are created, each with its root
+// directory, and are owned by the user with ownerID. The file data is stored under mcfsRoot as usual, but
+// the records are lost when mc-sshd stops. Stores without an in memory version, such as the tags and
+// metadata, are the fakes used in testing.
+func NewOfflineStores(mcfsRoot string, ownerID int, projectSlugs ...string) (*Stores, error) {
+	var projects []mcmodel.Project
+	for i, slug := range projectSlugs {
+		projectUUID, err := uuid.GenerateUUID()
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, mcmodel.Project{ID: i + 1, UUID: projectUUID, Slug: slug, Name: slug, OwnerID: ownerID})
+	}
+
+	projectStore := store.NewFakeProjectStore(projects)
+	files := NewMemoryFileStore(mcfsRoot, projectStore)
+	for _, project := range projects {
+		if _, err := files.CreateProjectRoot(project.ID, ownerID); err != nil {
+			return nil, fmt.Errorf("unable to create the root of project %s: %w", project.Slug, err)
+		}
+	}
+
+	return &Stores{
+		FileStore:        files,
+		ProjectStore:     projectStore,
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: files,
+		VersionStore:     files,
+		LinkStore:        NewNoLinksStore(),
+
+		ProjectCreateStore:  NewFakeProjectCreateStore(projectStore),
+		TagStore:            NewFakeTagStore(),
+		MetadataStore:       NewFakeMetadataStore(),
+		ProjectMemberStore:  NewFakeProjectMemberStore(),
+		FileAuditStore:      files,
+		ProjectNetworkStore: NewFakeProjectNetworkStore(),
+		GuestStore:          NewFakeGuestStore(),
+		TokenStore:          NewFakeTokenStore(),
+		FileAccessStore:     NewFakeFileAccessStore(),
+		ListingStore:        files,
+		DamagedFileStore:    NewFakeDamagedFileStore(),
+
+		ProjectSlugAliasStore: NewFakeProjectSlugAliasStore(),
+		ResumableUploadStore:  NewFakeResumableUploadStore(),
+		UserUsageStore:        NewFakeUserUsageStore(),
+		SymlinkStore:          NewFakeSymlinkStore(),
+		FeatureFlagStore:      NewFakeFeatureFlagStore(),
+		UploadProvenanceStore: NewFakeUploadProvenanceStore(),
+
+		ProjectExtractPathStore: NewFakeProjectExtractPathStore(),
+	}, nil
+}
+
+// MemoryUserStore is the store.UserStore for the users of offline stores (see NewOfflineStores).
+type MemoryUserStore struct {
+	users []mcmodel.User
+}
+
+func NewMemoryUserStore(users ...mcmodel.User) *MemoryUserStore {
+	return &MemoryUserStore{users: users}
+}
+
+func (s *MemoryUserStore) GetUsersWithGlobusAccount() ([]mcmodel.User, error) {
+	var users []mcmodel.User
+	for _, u := range s.users {
+		if u.GlobusUser != "" {
+			users = append(users, u)
+		}
+	}
+
+	return users, nil
+}
+
+func (s *MemoryUserStore) GetUserBySlug(slug string) (*mcmodel.User, error) {
+	for _, u := range s.users {
+		if u.Slug == slug {
+			return &u, nil
+		}
+	}
+
+	return nil, gorm.ErrRecordNotFound
+}
@@ -0,0 +1,82 @@
+package mc
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestOfflineStores(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo")
+	require.NoError(t, err)
+
+	project, err := stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+
+	dir, err := stores.FileStore.GetOrCreateDirPath(project.ID, 1, "/raw/scans")
+	require.NoError(t, err)
+	require.Equal(t, "/raw/scans", dir.Path)
+	require.Equal(t, "/raw", dir.Directory.Path)
+
+	// write creates a version of a.txt in dir, the same way an upload does.
+	write := func(contents string) *mcmodel.File {
+		file, err := stores.FileStore.CreateFile("a.txt", project.ID, dir.ID, 1, "text/plain")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0755))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), []byte(contents), 0644))
+
+		_, err = stores.FileStore.DoneWritingToFile(file, contents+"-checksum", int64(len(contents)), stores.ConversionStore)
+		require.NoError(t, err)
+		return file
+	}
+
+	first := write("first")
+	second := write("second!")
+
+	file, err := stores.FileStore.GetFileByPath(project.ID, "/raw/scans/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, second.ID, file.ID)
+	require.Equal(t, uint64(7), file.Size)
+	require.Equal(t, "/raw/scans/a.txt", file.FullPath())
+
+	versions, err := stores.VersionStore.ListVersions(file)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, []int{second.ID, first.ID}, []int{versions[0].ID, versions[1].ID})
+	require.False(t, versions[1].Current)
+
+	files, err := stores.FileStore.ListDirectoryByPath(project.ID, "/raw/scans")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	usage, err := stores.ListingStore.GetDirectoryUsage(project.ID, "/raw")
+	require.NoError(t, err)
+	require.Equal(t, DirectoryUsage{Size: 7, Files: 1, Directories: 1}, *usage)
+
+	project, err = stores.ProjectStore.GetProjectByID(project.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(12), project.Size)
+
+	// Only versions that aren't current can be removed.
+	require.NoError(t, stores.VersionStore.DeleteVersion(&versions[0]))
+	require.NoError(t, stores.VersionStore.DeleteVersion(&versions[1]))
+	versions, err = stores.VersionStore.ListVersions(file)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+
+	// An upload that was never finished is pending.
+	pending, err := stores.FileStore.CreateFile("b.txt", project.ID, dir.ID, 1, "text/plain")
+	require.NoError(t, err)
+	pendingFiles, err := stores.PendingFileStore.ListPendingFiles(time.Now().Add(time.Minute), 0, 10)
+	require.NoError(t, err)
+	require.Len(t, pendingFiles, 1)
+	require.Equal(t, pending.ID, pendingFiles[0].ID)
+
+	_, err = stores.FileStore.GetFileByPath(project.ID, "/raw/scans/b.txt")
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
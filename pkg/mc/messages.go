@@ -0,0 +1,137 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ErrProjectNotFound is returned when a project slug doesn't exist, or the user doesn't have access to
+// the project. The two aren't distinguished so that project slugs can't be discovered.
+var ErrProjectNotFound = errors.New("no such project")
+
+// catalogEntry holds the translations, keyed by language, of the message for an error.
+type catalogEntry struct {
+	err          error
+	translations map[string]string
+}
+
+// catalog holds the translated messages for the errors users are most likely to see. The first entry
+// that matches an error, with errors.Is, is used, so more specific errors must come before the general
+// ones they wrap, such as ErrReadOnly before os.ErrPermission.
+var catalog = []catalogEntry{
+	{ErrProjectNotFound, map[string]string{
+		"de": "Projekt nicht gefunden",
+		"es": "proyecto no encontrado",
+		"fr": "projet introuvable",
+	}},
+	{ErrReadOnly, map[string]string{
+		"de": "dieser Server ist schreibgeschützt",
+		"es": "este servidor es de solo lectura",
+		"fr": "ce serveur est en lecture seule",
+	}},
+	{ErrNetworkRestricted, map[string]string{
+		"de": "Zugriff durch Netzwerkrichtlinie eingeschränkt",
+		"es": "acceso restringido por la política de red",
+		"fr": "accès restreint par la politique réseau",
+	}},
+	{ErrFileDataMissing, map[string]string{
+		"de": "die Daten der Datei fehlen im Speicher, dies wurde den Administratoren gemeldet",
+		"es": "faltan los datos del archivo en el almacenamiento, se ha informado a los administradores",
+		"fr": "les données du fichier sont absentes du stockage, cela a été signalé aux administrateurs",
+	}},
+	{os.ErrPermission, map[string]string{
+		"de": "Zugriff verweigert",
+		"es": "permiso denegado",
+		"fr": "permission refusée",
+	}},
+	{syscall.ENOSPC, map[string]string{
+		"de": "Speicherplatz oder Kontingent erschöpft",
+		"es": "espacio en disco o cuota excedida",
+		"fr": "espace disque ou quota dépassé",
+	}},
+	{syscall.EDQUOT, map[string]string{
+		"de": "Speicherplatz oder Kontingent erschöpft",
+		"es": "espacio en disco o cuota excedida",
+		"fr": "espace disque ou quota dépassé",
+	}},
+	{ErrTooManySessions, map[string]string{
+		"de": "zu viele offene Sitzungen für diesen Benutzer",
+		"es": "demasiadas sesiones abiertas para este usuario",
+		"fr": "trop de sessions ouvertes pour cet utilisateur",
+	}},
+	{ErrFileBusy, map[string]string{
+		"de": "Datei belegt: eine andere Sitzung schreibt gerade in diese Datei",
+		"es": "archivo ocupado: otra sesión está escribiendo en este archivo",
+		"fr": "fichier occupé : une autre session écrit dans ce fichier",
+	}},
+	{ErrFileLocked, map[string]string{
+		"de": "Datei gesperrt: ein anderer Benutzer hält eine Sperre auf diese Datei",
+		"es": "archivo bloqueado: otro usuario tiene un bloqueo sobre este archivo",
+		"fr": "fichier verrouillé : un autre utilisateur détient un verrou sur ce fichier",
+	}},
+	{ErrWritesThrottled, map[string]string{
+		"de": "der Server ist mit dem Abschließen von Uploads ausgelastet, bitte später erneut versuchen",
+		"es": "el servidor está ocupado finalizando cargas, inténtelo más tarde",
+		"fr": "le serveur est occupé à finaliser des envois, réessayez plus tard",
+	}},
+}
+
+// localizedError is an error whose message has been translated. It wraps the original error so that
+// errors.Is still works.
+type localizedError struct {
+	msg string
+	err error
+}
+
+func (e *localizedError) Error() string {
+	return e.msg
+}
+
+func (e *localizedError) Unwrap() error {
+	return e.err
+}
+
+// Localize returns err with its message translated into language, an ISO 639-1 code such as "de". The
+// original English message is kept, in parentheses, since it has details such as the path and is
+// what support staff will recognize. Errors that aren't in the catalog, and all errors when language
+// is blank or has no translations, are returned unchanged. So are errors for which os.IsNotExist is
+// true, since pkg/sftp needs those unwrapped to return the "no such file" status.
+func Localize(err error, language string) error {
+	if err == nil || language == "" || os.IsNotExist(err) {
+		return err
+	}
+
+	for _, entry := range catalog {
+		if !errors.Is(err, entry.err) {
+			continue
+		}
+
+		translation, ok := entry.translations[language]
+		if !ok {
+			return err
+		}
+
+		return &localizedError{msg: fmt.Sprintf("%s (%s)", translation, err), err: err}
+	}
+
+	return err
+}
+
+// LocaleLanguage returns the language from a POSIX locale such as de_DE.UTF-8, which is "de". It
+// returns blank for the C and POSIX locales, and for English, which needs no translation.
+func LocaleLanguage(locale string) string {
+	language := strings.ToLower(locale)
+	if i := strings.IndexAny(language, "_.@"); i != -1 {
+		language = language[:i]
+	}
+
+	switch language {
+	case "", "c", "posix", "en":
+		return ""
+	default:
+		return language
+	}
+}
@@ -0,0 +1,47 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalize(t *testing.T) {
+	err := fmt.Errorf("%w my-project", ErrProjectNotFound)
+
+	localized := Localize(err, "de")
+	require.Equal(t, "Projekt nicht gefunden (no such project my-project)", localized.Error())
+	require.True(t, errors.Is(localized, ErrProjectNotFound), "The original error should still match")
+
+	require.Equal(t, err, Localize(err, ""), "English isn't translated")
+	require.Equal(t, err, Localize(err, "xx"), "Languages without translations aren't translated")
+
+	// ErrReadOnly is also os.ErrPermission, but has its own message.
+	require.Equal(t, "dieser Server ist schreibgeschützt (this server is read-only: permission denied)", Localize(ErrReadOnly, "de").Error())
+
+	require.Same(t, os.ErrNotExist, Localize(os.ErrNotExist, "de"), "Not exist errors must be left for pkg/sftp")
+
+	other := errors.New("something else")
+	require.Same(t, other, Localize(other, "de"))
+	require.Nil(t, Localize(nil, "de"))
+}
+
+func TestLocaleLanguage(t *testing.T) {
+	tests := map[string]string{
+		"de_DE.UTF-8": "de",
+		"fr_FR":       "fr",
+		"es":          "es",
+		"sr_RS@latin": "sr",
+		"en_US.UTF-8": "",
+		"C.UTF-8":     "",
+		"POSIX":       "",
+		"":            "",
+	}
+
+	for locale, expected := range tests {
+		require.Equal(t, expected, LocaleLanguage(locale), "Wrong language for locale '%s'", locale)
+	}
+}
@@ -0,0 +1,226 @@
+package mc
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits on the metadata extracted from a single file, so that a file with a huge header doesn't flood the
+// attributes table.
+const (
+	maxMetadataEntries     = 200
+	maxMetadataValueLength = 1024
+	maxMetadataHeaderSize  = 1024 * 1024
+)
+
+// metadataExtractor extracts the key/value metadata embedded in a file.
+type metadataExtractor func(f *os.File) (map[string]string, error)
+
+// metadataExtractors are the built-in extractors, keyed by file extension.
+var metadataExtractors = map[string]metadataExtractor{
+	".tif":  extractTIFFMetadata,
+	".tiff": extractTIFFMetadata,
+	".edf":  extractEDFMetadata,
+	".cif":  extractCIFMetadata,
+	".mpt":  extractMPTMetadata,
+	".h5":   extractHDF5Metadata,
+	".hdf5": extractHDF5Metadata,
+	".nxs":  extractHDF5Metadata,
+}
+
+// HasMetadataExtractor returns true if there is a built-in extractor for files called name.
+func HasMetadataExtractor(name string) bool {
+	_, ok := metadataExtractors[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// MetadataExtractorHook returns an upload hook that extracts the embedded metadata from the files that
+// have a built-in extractor: TIFF tags, EDF headers, CIF data items, EC-Lab .mpt headers and the
+// attributes on the root group of HDF5 files.
+func MetadataExtractorHook() UploadHook {
+	var extensions []string
+	for ext := range metadataExtractors {
+		extensions = append(extensions, regexp.QuoteMeta(ext))
+	}
+	sort.Strings(extensions)
+
+	return UploadHook{
+		Match:  regexp.MustCompile(`(?i)(` + strings.Join(extensions, "|") + `)$`),
+		Action: HookExtractMetadata,
+	}
+}
+
+// ExtractMetadata extracts the metadata embedded in the file at path, using the built-in extractor for
+// the extension of name. It returns nil if there is no extractor for name. At most maxMetadataEntries
+// entries are returned, and long values are truncated.
+func ExtractMetadata(path, name string) (map[string]string, error) {
+	extractor, ok := metadataExtractors[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	metadata, err := extractor(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return limitMetadata(metadata), nil
+}
+
+// limitMetadata applies maxMetadataEntries and maxMetadataValueLength to metadata. The entries kept are
+// the first ones by key, so that the result doesn't change from one run to the next.
+func limitMetadata(metadata map[string]string) map[string]string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	limited := make(map[string]string)
+	for i, key := range keys {
+		if i == maxMetadataEntries {
+			break
+		}
+
+		value := metadata[key]
+		if len(value) > maxMetadataValueLength {
+			value = value[:maxMetadataValueLength]
+		}
+		limited[key] = value
+	}
+
+	return limited
+}
+
+// newHeaderScanner returns a scanner over the lines in the first maxMetadataHeaderSize bytes of r.
+func newHeaderScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(io.LimitReader(r, maxMetadataHeaderSize))
+	scanner.Buffer(make([]byte, 64*1024), maxMetadataHeaderSize)
+	return scanner
+}
+
+// extractEDFMetadata extracts the header of an ESRF Data Format file. The header is enclosed in braces
+// and has a "key = value ;" entry on each line.
+func extractEDFMetadata(f *os.File) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	scanner := newHeaderScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "}" || strings.HasPrefix(line, "}") {
+			break
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(line, "{"), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if key != "" {
+			metadata[key] = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(parts[1]), ";"))
+		}
+	}
+
+	return metadata, scanner.Err()
+}
+
+// extractCIFMetadata extracts the single valued data items, such as _cell_length_a 5.4307, from a
+// Crystallographic Information File. Looped data, such as the atom sites, and multi-line values are
+// skipped. The keys don't have the leading underscore.
+func extractCIFMetadata(f *os.File) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	inLoop, inText, loopHasData := false, false, false
+	scanner := newHeaderScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Multi-line text fields start and end with a semicolon at the start of a line.
+		if strings.HasPrefix(line, ";") {
+			inText = !inText
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case inText || line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "loop_"):
+			inLoop, loopHasData = true, false
+			continue
+		case strings.HasPrefix(line, "data_"):
+			inLoop = false
+			metadata["data_block"] = strings.TrimPrefix(line, "data_")
+			continue
+		case inLoop && !strings.HasPrefix(line, "_"):
+			loopHasData = true
+			continue
+		case inLoop && !loopHasData:
+			// One of the loop's column names.
+			continue
+		}
+
+		inLoop = false
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "_") {
+			continue
+		}
+
+		value := strings.TrimSpace(fields[1])
+		if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if value != "" && value != "?" && value != "." {
+			metadata[strings.TrimPrefix(fields[0], "_")] = value
+		}
+	}
+
+	return metadata, scanner.Err()
+}
+
+// extractMPTMetadata extracts the header of a BioLogic EC-Lab .mpt text file. The header starts with
+// "EC-Lab ASCII FILE", followed by a "Nb header lines : N" line giving its length, and has a
+// "key : value" entry on most lines.
+func extractMPTMetadata(f *os.File) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	// Until the "Nb header lines" line is read, the header is assumed to be long enough to include it.
+	headerLines := 3
+	scanner := newHeaderScanner(f)
+	for line := 1; line < headerLines && scanner.Scan(); line++ {
+		parts := strings.SplitN(scanner.Text(), " : ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if key == "Nb header lines" {
+			// The last header line has the column names. The header is limited so that a corrupt file
+			// can't have the whole file read as its header.
+			if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 100000 {
+				headerLines = n
+			}
+			continue
+		}
+
+		if key != "" && value != "" {
+			metadata[key] = value
+		}
+	}
+
+	return metadata, scanner.Err()
+}
@@ -0,0 +1,332 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		expected map[string]string
+	}{
+		{
+			name: "scan.edf",
+			contents: []byte("{\nHeaderID = EH:000001:000000:000000 ;\nDim_1 = 2048 ;\n" +
+				"Title = ct scan 1 ;\n}\n\x00\x01\x02"),
+			expected: map[string]string{"HeaderID": "EH:000001:000000:000000", "Dim_1": "2048", "Title": "ct scan 1"},
+		},
+		{
+			name: "si.CIF",
+			contents: []byte("data_si\n_chemical_name_common 'Silicon'\n_cell_length_a 5.4307\n_cell_volume ?\n" +
+				"_journal_name_full\n;\nA multi-line value\n;\nloop_\n_atom_site_label\n_atom_site_fract_x\n" +
+				"Si1 0.0\nSi2 0.25\n_symmetry_space_group_name_H-M 'F d -3 m'\n"),
+			expected: map[string]string{
+				"data_block":                    "si",
+				"chemical_name_common":          "Silicon",
+				"cell_length_a":                 "5.4307",
+				"symmetry_space_group_name_H-M": "F d -3 m",
+			},
+		},
+		{
+			name: "cycle.mpt",
+			contents: []byte("EC-Lab ASCII FILE\nNb header lines : 5\n\nElectrode material : NMC\n" +
+				"mode\tox/red\tcontrol/V\n1\t0\t3.2\nAfter header : ignored\n"),
+			expected: map[string]string{"Electrode material": "NMC"},
+		},
+		{
+			name:     "image.tif",
+			contents: writeTIFF(),
+			expected: map[string]string{
+				"ImageWidth":    "640",
+				"ImageLength":   "480",
+				"BitsPerSample": "8,8,8",
+				"Make":          "ACME",
+				"XResolution":   "300",
+			},
+		},
+		{
+			name:     "run.h5",
+			contents: writeHDF5V0(),
+			expected: map[string]string{
+				"title":       "run one",
+				"temperature": "300.5",
+				"shape":       "1,-2,3",
+				"sample":      "silicon wafer",
+			},
+		},
+		{
+			name:     "run.nxs",
+			contents: writeHDF5V2(),
+			expected: map[string]string{"facility": "APS"},
+		},
+		{
+			name:     "notes.txt",
+			contents: []byte("not extracted"),
+			expected: nil,
+		},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		require.NoError(t, os.WriteFile(path, test.contents, 0644))
+
+		metadata, err := ExtractMetadata(path, test.name)
+		require.NoError(t, err, test.name)
+		require.Equal(t, test.expected, metadata, test.name)
+	}
+
+	require.True(t, MetadataExtractorHook().Match.MatchString("/proj/raw/image.TIFF"))
+	require.False(t, MetadataExtractorHook().Match.MatchString("/proj/raw/notes.txt"))
+
+	// A file that isn't in the format its name claims is an error.
+	path := filepath.Join(dir, "fake.h5")
+	require.NoError(t, os.WriteFile(path, []byte("not hdf5"), 0644))
+	_, err := ExtractMetadata(path, "fake.h5")
+	require.Error(t, err)
+}
+
+func TestHDF5DataspaceElementsOverflow(t *testing.T) {
+	r := &hdf5Reader{lengthSize: 8}
+
+	// Ten dimensions of 64 and one of 8 have 2^63 elements, which overflows an int.
+	data := []byte{1, 11, 0, 0, 0, 0, 0, 0}
+	for i := 0; i < 11; i++ {
+		dim := make([]byte, 8)
+		dim[0] = 64
+		if i == 10 {
+			dim[0] = 8
+		}
+		data = append(data, dim...)
+	}
+
+	_, ok := r.dataspaceElements(data)
+	require.False(t, ok)
+
+	count, ok := r.dataspaceElements([]byte{1, 2, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0})
+	require.True(t, ok)
+	require.Equal(t, 64, count)
+}
+
+// writeTIFF returns a little endian TIFF header and first directory, without any image data.
+func writeTIFF() []byte {
+	le := binary.LittleEndian
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+
+	entry := func(tag, fieldType uint16, count uint32, value uint32) []byte {
+		b := make([]byte, 12)
+		le.PutUint16(b, tag)
+		le.PutUint16(b[2:], fieldType)
+		le.PutUint32(b[4:], count)
+		le.PutUint32(b[8:], value)
+		return b
+	}
+
+	// The directory has 6 entries, and the values that don't fit in an entry follow it.
+	const valuesOffset = 8 + 2 + 6*12 + 4
+	buf = append(buf, 6, 0)
+	buf = append(buf, entry(256, tiffShort, 1, 640)...)
+	buf = append(buf, entry(257, tiffLong, 1, 480)...)
+	buf = append(buf, entry(258, tiffShort, 3, valuesOffset)...)
+	buf = append(buf, entry(271, tiffASCII, 5, valuesOffset+6)...)
+	buf = append(buf, entry(282, tiffRational, 1, valuesOffset+11)...)
+	buf = append(buf, entry(999, tiffLong, 1, 7)...)
+	buf = append(buf, 0, 0, 0, 0)
+
+	buf = append(buf, 8, 0, 8, 0, 8, 0)
+	buf = append(buf, "ACME\x00"...)
+	return append(buf, 44, 1, 0, 0, 1, 0, 0, 0)
+}
+
+// hdf5Builder lays out a test HDF5 file with 8 byte offsets and lengths.
+type hdf5Builder struct {
+	bytes.Buffer
+}
+
+func (b *hdf5Builder) uint(n uint64, size int) {
+	for i := 0; i < size; i++ {
+		b.WriteByte(byte(n >> (8 * i)))
+	}
+}
+
+func (b *hdf5Builder) pad() {
+	for b.Len()%8 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+// hdf5Datatype returns a datatype message with the class and version, bit fields, size and properties.
+func hdf5Datatype(class, bits byte, size uint32, properties int) []byte {
+	b := &hdf5Builder{}
+	b.WriteByte(0x10 | class)
+	b.WriteByte(bits)
+	b.uint(0, 2)
+	b.uint(uint64(size), 4)
+	b.Write(make([]byte, properties))
+	return b.Bytes()
+}
+
+// hdf5AttributeV1 returns a version 1 attribute message with a version 1 dataspace of dims.
+func hdf5AttributeV1(name string, datatype []byte, dims []uint64, data []byte) []byte {
+	dataspace := &hdf5Builder{}
+	dataspace.WriteByte(1)
+	dataspace.WriteByte(byte(len(dims)))
+	dataspace.Write(make([]byte, 6))
+	for _, dim := range dims {
+		dataspace.uint(dim, 8)
+	}
+
+	b := &hdf5Builder{}
+	b.WriteByte(1)
+	b.WriteByte(0)
+	b.uint(uint64(len(name)+1), 2)
+	b.uint(uint64(len(datatype)), 2)
+	b.uint(uint64(dataspace.Len()), 2)
+	b.WriteString(name + "\x00")
+	b.pad()
+	b.Write(datatype)
+	b.pad()
+	b.Write(dataspace.Bytes())
+	b.pad()
+	b.Write(data)
+	b.pad()
+	return b.Bytes()
+}
+
+// hdf5MessageV1 returns a version 1 object header message, with data padded to a multiple of 8 bytes.
+func hdf5MessageV1(kind uint16, data []byte) []byte {
+	padded := &hdf5Builder{}
+	padded.Write(data)
+	padded.pad()
+
+	b := &hdf5Builder{}
+	b.uint(uint64(kind), 2)
+	b.uint(uint64(padded.Len()), 2)
+	b.Write(make([]byte, 4))
+	b.Write(padded.Bytes())
+	return b.Bytes()
+}
+
+// writeHDF5V0 returns an HDF5 file with a version 0 superblock, and a version 1 object header for the
+// root group. One of the root group's attributes is in a continuation block, and one is a variable
+// length string in the global heap.
+func writeHDF5V0() []byte {
+	const (
+		rootAddress = 96
+		heapAddress = 1024
+		contAddress = 2048
+	)
+
+	var le = binary.LittleEndian
+	float := make([]byte, 8)
+	le.PutUint64(float, math.Float64bits(300.5))
+	ints := make([]byte, 12)
+	le.PutUint32(ints, 1)
+	le.PutUint32(ints[4:], uint32(0xfffffffe))
+	le.PutUint32(ints[8:], 3)
+
+	vlen := &hdf5Builder{}
+	vlen.uint(13, 4)
+	vlen.uint(heapAddress, 8)
+	vlen.uint(1, 4)
+
+	cont := &hdf5Builder{}
+	cont.uint(contAddress, 8)
+	contBlock := hdf5MessageV1(hdf5MessageAttribute,
+		hdf5AttributeV1("sample", hdf5Datatype(hdf5VariableLength, 1, 16, 12), nil, vlen.Bytes()))
+	cont.uint(uint64(len(contBlock)), 8)
+
+	messages := &hdf5Builder{}
+	messages.Write(hdf5MessageV1(hdf5MessageAttribute,
+		hdf5AttributeV1("title", hdf5Datatype(hdf5String, 0, 8, 0), nil, []byte("run one\x00"))))
+	messages.Write(hdf5MessageV1(hdf5MessageAttribute,
+		hdf5AttributeV1("temperature", hdf5Datatype(hdf5FloatingPoint, 0x20, 8, 12), nil, float)))
+	messages.Write(hdf5MessageV1(hdf5MessageAttribute,
+		hdf5AttributeV1("shape", hdf5Datatype(hdf5FixedPoint, 0x08, 4, 4), []uint64{3}, ints)))
+	messages.Write(hdf5MessageV1(hdf5MessageContinuation, cont.Bytes()))
+
+	b := &hdf5Builder{}
+	b.Write(hdf5Signature)
+	b.Write([]byte{0, 0, 0, 0, 0, 8, 8, 0})
+	b.uint(4, 2)
+	b.uint(16, 2)
+	b.uint(0, 4)
+	b.uint(0, 8)
+	b.uint(math.MaxUint64, 8)
+	b.uint(contAddress+uint64(len(contBlock)), 8)
+	b.uint(math.MaxUint64, 8)
+
+	// The root group's symbol table entry.
+	b.uint(0, 8)
+	b.uint(rootAddress, 8)
+	b.Write(make([]byte, 24))
+
+	b.WriteByte(1)
+	b.WriteByte(0)
+	b.uint(5, 2)
+	b.uint(1, 4)
+	b.uint(uint64(messages.Len()), 4)
+	b.uint(0, 4)
+	b.Write(messages.Bytes())
+
+	b.Write(make([]byte, heapAddress-b.Len()))
+	b.WriteString("GCOL\x01\x00\x00\x00")
+	b.uint(16+16+16+16, 8)
+	b.uint(1, 2)
+	b.uint(1, 2)
+	b.uint(0, 4)
+	b.uint(13, 8)
+	b.WriteString("silicon wafer")
+	b.pad()
+	b.Write(make([]byte, 16))
+
+	b.Write(make([]byte, contAddress-b.Len()))
+	b.Write(contBlock)
+	return b.Bytes()
+}
+
+// writeHDF5V2 returns an HDF5 file with a version 2 superblock, and a version 2 object header with a
+// version 3 attribute for the root group.
+func writeHDF5V2() []byte {
+	const rootAddress = 48
+
+	attribute := &hdf5Builder{}
+	attribute.WriteByte(3)
+	attribute.WriteByte(0)
+	attribute.uint(uint64(len("facility")+1), 2)
+	attribute.uint(8, 2)
+	attribute.uint(4, 2)
+	attribute.WriteByte(0)
+	attribute.WriteString("facility\x00")
+	attribute.Write(hdf5Datatype(hdf5String, 0, 4, 0))
+	attribute.Write([]byte{2, 0, 0, 0})
+	attribute.WriteString("APS\x00")
+
+	b := &hdf5Builder{}
+	b.Write(hdf5Signature)
+	b.Write([]byte{2, 8, 8, 0})
+	b.uint(0, 8)
+	b.uint(math.MaxUint64, 8)
+	b.uint(0, 8)
+	b.uint(rootAddress, 8)
+	b.uint(0, 4)
+
+	b.WriteString("OHDR")
+	b.WriteByte(2)
+	b.WriteByte(0x02)
+	b.uint(uint64(4+attribute.Len()), 4)
+	b.WriteByte(hdf5MessageAttribute)
+	b.uint(uint64(attribute.Len()), 2)
+	b.WriteByte(0)
+	b.Write(attribute.Bytes())
+	b.uint(0, 4)
+	return b.Bytes()
+}
@@ -0,0 +1,59 @@
+//go:build go1.18
+
+package mc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The parsers fuzzed here read files uploaded by users, so no file can be allowed to crash the server.
+
+func fuzzExtractMetadata(f *testing.F, name string) {
+	// Each input is written to the same file, as a directory per input slows fuzzing down.
+	path := filepath.Join(f.TempDir(), name)
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		if err := os.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		metadata, err := ExtractMetadata(path, name)
+		if err == nil && len(metadata) > maxMetadataEntries {
+			t.Errorf("%d keys extracted, more than the %d allowed", len(metadata), maxMetadataEntries)
+		}
+	})
+}
+
+func FuzzExtractHDF5Metadata(f *testing.F) {
+	f.Add(writeHDF5V0())
+	f.Add(writeHDF5V2())
+	f.Add([]byte("\x89HDF\r\n\x1a\n"))
+	fuzzExtractMetadata(f, "data.h5")
+}
+
+func FuzzReadHDF5Slice(f *testing.F) {
+	f.Add(writeHDF5Datasets(), "/entry/counts")
+	f.Add(writeHDF5Datasets(), "/entry/compact")
+	f.Add(writeHDF5V2(), "/")
+	f.Fuzz(func(t *testing.T, contents []byte, dataset string) {
+		for _, rank := range []int{0, 1, 2} {
+			start, count := make([]uint64, rank), make([]uint64, rank)
+			for i := range count {
+				count[i] = 1
+			}
+
+			slice, err := ReadHDF5Slice(bytes.NewReader(contents), dataset, start, count, MaxHDF5SliceBytes)
+			if err == nil && len(slice.Data) > MaxHDF5SliceBytes {
+				t.Errorf("%d bytes read, more than the %d allowed", len(slice.Data), MaxHDF5SliceBytes)
+			}
+		}
+	})
+}
+
+func FuzzExtractTIFFMetadata(f *testing.F) {
+	f.Add(writeTIFF())
+	f.Add([]byte("MM\x00*\x00\x00\x00\x08"))
+	fuzzExtractMetadata(f, "image.tif")
+}
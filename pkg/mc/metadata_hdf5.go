@@ -0,0 +1,584 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hdf5Signature starts the HDF5 superblock, which is at offset 0, 512, 1024, 2048 and so on, depending on
+// the size of the file's user block.
+var hdf5Signature = []byte("\x89HDF\r\n\x1a\n")
+
+var errNotHDF5 = errors.New("not an HDF5 file")
+
+// The HDF5 object header message types that are read.
+const (
+	hdf5MessageDataspace    = 0x01
+	hdf5MessageLinkInfo     = 0x02
+	hdf5MessageDatatype     = 0x03
+	hdf5MessageLink         = 0x06
+	hdf5MessageLayout       = 0x08
+	hdf5MessageAttribute    = 0x0c
+	hdf5MessageContinuation = 0x10
+	hdf5MessageSymbolTable  = 0x11
+)
+
+// The HDF5 datatype classes that attribute values are decoded from.
+const (
+	hdf5FixedPoint     = 0
+	hdf5FloatingPoint  = 1
+	hdf5String         = 3
+	hdf5VariableLength = 9
+)
+
+// Limits on what is read from an HDF5 file, so that a corrupt file can't have the whole file read.
+const (
+	maxHDF5Continuations   = 64
+	maxHDF5AttributeValues = 64
+)
+
+// extractHDF5Metadata extracts the attributes on the root group of an HDF5 (or NeXus) file, which is
+// where instruments and NeXus writers record the facility, instrument and sample. Attributes with
+// integer, floating point and string values are recorded. Attributes with several values are recorded
+// with the values separated by commas. Attributes in dense storage, which HDF5 only uses for objects with
+// many attributes, aren't read.
+func extractHDF5Metadata(f *os.File) (map[string]string, error) {
+	r := &hdf5Reader{f: f, heaps: make(map[int64][]byte)}
+	rootAddress, err := r.readSuperblock()
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := r.readObjectHeader(rootAddress)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the root group: %w", err)
+	}
+
+	metadata := make(map[string]string)
+	for _, message := range messages {
+		if message.kind != hdf5MessageAttribute {
+			continue
+		}
+
+		name, value, ok := r.decodeAttribute(message.data)
+		if ok && name != "" {
+			metadata[name] = value
+		}
+	}
+
+	return metadata, nil
+}
+
+// hdf5Reader reads the parts of an HDF5 file needed to get the root group's attributes, and to find and
+// read datasets for ReadHDF5Slice. All addresses in the file are relative to base.
+type hdf5Reader struct {
+	f          io.ReaderAt
+	base       int64
+	offsetSize int
+	lengthSize int
+
+	// heaps caches the global heap collections that variable length strings are stored in.
+	heaps map[int64][]byte
+}
+
+type hdf5Message struct {
+	kind uint16
+	data []byte
+}
+
+// readAt reads up to n bytes at the address. Fewer bytes are returned at the end of the file.
+func (r *hdf5Reader) readAt(address int64, n int64) ([]byte, error) {
+	if n < 0 || n > maxMetadataHeaderSize {
+		return nil, fmt.Errorf("invalid block size %d", n)
+	}
+
+	buf := make([]byte, n)
+	read, err := r.f.ReadAt(buf, r.base+address)
+	if err != nil && !(errors.Is(err, io.EOF) && read > 0) {
+		return nil, err
+	}
+
+	return buf[:read], nil
+}
+
+// hdf5Uint decodes the little endian number of size bytes at the start of b, or returns false if b is too
+// short.
+func hdf5Uint(b []byte, size int) (uint64, bool) {
+	if len(b) < size || size > 8 {
+		return 0, false
+	}
+
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+
+	return n, true
+}
+
+// readSuperblock finds and reads the superblock, and returns the address of the root group's object
+// header.
+func (r *hdf5Reader) readSuperblock() (int64, error) {
+	var sb []byte
+	for offset := int64(0); offset <= 1<<20; offset = max64(512, offset*2) {
+		block, err := r.readAt(offset, 128)
+		if err != nil || len(block) < 16 {
+			return 0, errNotHDF5
+		}
+
+		if bytes.HasPrefix(block, hdf5Signature) {
+			r.base, sb = offset, block
+			break
+		}
+	}
+
+	if sb == nil {
+		return 0, errNotHDF5
+	}
+
+	var rootAddress int
+	switch version := sb[8]; version {
+	case 0, 1:
+		r.offsetSize, r.lengthSize = int(sb[13]), int(sb[14])
+		start := 24
+		if version == 1 {
+			start = 28
+		}
+
+		// The base, free space, end of file and driver addresses are followed by the root group's
+		// symbol table entry, which starts with the offset of its name.
+		rootAddress = start + 5*r.offsetSize
+	case 2, 3:
+		r.offsetSize, r.lengthSize = int(sb[9]), int(sb[10])
+
+		// The base, superblock extension and end of file addresses come before the root group's.
+		rootAddress = 12 + 3*r.offsetSize
+	default:
+		return 0, fmt.Errorf("unsupported HDF5 superblock version %d", version)
+	}
+
+	if r.offsetSize < 2 || r.offsetSize > 8 || r.lengthSize < 2 || r.lengthSize > 8 {
+		return 0, errNotHDF5
+	}
+
+	address, ok := hdf5Uint(sb[minInt(rootAddress, len(sb)):], r.offsetSize)
+	if !ok {
+		return 0, errNotHDF5
+	}
+
+	return int64(address), nil
+}
+
+// hdf5Block is a block of object header messages to read.
+type hdf5Block struct {
+	address int64
+	length  int64
+}
+
+// readObjectHeader reads the messages in the version 1 or 2 object header at address, following its
+// continuation messages.
+func (r *hdf5Reader) readObjectHeader(address int64) ([]hdf5Message, error) {
+	prefix, err := r.readAt(address, 48)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(prefix, []byte("OHDR")) {
+		return r.readObjectHeaderV2(address, prefix)
+	}
+
+	if len(prefix) < 16 || prefix[0] != 1 {
+		return nil, fmt.Errorf("invalid object header at %d", address)
+	}
+
+	size := int64(binary.LittleEndian.Uint32(prefix[8:12]))
+	var messages []hdf5Message
+	blocks := []hdf5Block{{address: address + 16, length: size}}
+	for i := 0; i < len(blocks) && i <= maxHDF5Continuations; i++ {
+		data, err := r.readAt(blocks[i].address, blocks[i].length)
+		if err != nil {
+			return nil, err
+		}
+
+		// Version 1 messages have a type, size, flags and 3 reserved bytes.
+		for pos := 0; pos+8 <= len(data); {
+			kind := binary.LittleEndian.Uint16(data[pos:])
+			end := pos + 8 + int(binary.LittleEndian.Uint16(data[pos+2:]))
+			if end > len(data) {
+				break
+			}
+
+			message := hdf5Message{kind: kind, data: data[pos+8 : end]}
+			if block, ok := r.continuation(message); ok {
+				blocks = append(blocks, block)
+			}
+			messages = append(messages, message)
+			pos = end
+		}
+	}
+
+	return messages, nil
+}
+
+func (r *hdf5Reader) readObjectHeaderV2(address int64, prefix []byte) ([]hdf5Message, error) {
+	if len(prefix) < 7 || prefix[4] != 2 {
+		return nil, fmt.Errorf("invalid object header at %d", address)
+	}
+
+	flags := prefix[5]
+	pos := 6
+	if flags&0x20 != 0 {
+		// Access, modification, change and birth times.
+		pos += 16
+	}
+	if flags&0x10 != 0 {
+		// Attribute phase change values.
+		pos += 4
+	}
+
+	sizeOfSize := 1 << (flags & 0x03)
+	size, ok := hdf5Uint(prefix[minInt(pos, len(prefix)):], sizeOfSize)
+	if !ok {
+		return nil, fmt.Errorf("invalid object header at %d", address)
+	}
+
+	// Version 2 messages have a type, size and flags, and the creation order if it is tracked.
+	headerSize := 4
+	if flags&0x04 != 0 {
+		headerSize = 6
+	}
+
+	var messages []hdf5Message
+	blocks := []hdf5Block{{address: address + int64(pos+sizeOfSize), length: int64(size)}}
+	for i := 0; i < len(blocks) && i <= maxHDF5Continuations; i++ {
+		data, err := r.readAt(blocks[i].address, blocks[i].length)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			// Continuation blocks have a signature and end with a checksum.
+			if !bytes.HasPrefix(data, []byte("OCHK")) || len(data) < 8 {
+				return nil, fmt.Errorf("invalid continuation block at %d", blocks[i].address)
+			}
+			data = data[4 : len(data)-4]
+		}
+
+		for pos := 0; pos+headerSize <= len(data); {
+			kind := uint16(data[pos])
+			end := pos + headerSize + int(binary.LittleEndian.Uint16(data[pos+1:]))
+			if end > len(data) {
+				break
+			}
+
+			message := hdf5Message{kind: kind, data: data[pos+headerSize : end]}
+			if block, ok := r.continuation(message); ok {
+				blocks = append(blocks, block)
+			}
+			messages = append(messages, message)
+			pos = end
+		}
+	}
+
+	return messages, nil
+}
+
+// continuation returns the block that message continues the object header in, if it is a continuation
+// message.
+func (r *hdf5Reader) continuation(message hdf5Message) (hdf5Block, bool) {
+	if message.kind != hdf5MessageContinuation {
+		return hdf5Block{}, false
+	}
+
+	address, ok := hdf5Uint(message.data, r.offsetSize)
+	if !ok {
+		return hdf5Block{}, false
+	}
+
+	length, ok := hdf5Uint(message.data[r.offsetSize:], r.lengthSize)
+	if !ok {
+		return hdf5Block{}, false
+	}
+
+	return hdf5Block{address: int64(address), length: int64(length)}, true
+}
+
+// decodeAttribute decodes the name and value of the attribute message in data. It returns false for
+// attributes whose value can't be decoded, such as compound values or shared datatypes.
+func (r *hdf5Reader) decodeAttribute(data []byte) (string, string, bool) {
+	if len(data) < 8 {
+		return "", "", false
+	}
+
+	version, flags := data[0], data[1]
+	nameSize := int(binary.LittleEndian.Uint16(data[2:]))
+	datatypeSize := int(binary.LittleEndian.Uint16(data[4:]))
+	dataspaceSize := int(binary.LittleEndian.Uint16(data[6:]))
+
+	// Version 1 pads the name, datatype and dataspace to multiples of 8 bytes, and version 3 adds the
+	// name's character set.
+	pad := func(n int) int { return n }
+	pos := 8
+	switch version {
+	case 1:
+		pad = func(n int) int { return (n + 7) &^ 7 }
+	case 2:
+	case 3:
+		pos = 9
+	default:
+		return "", "", false
+	}
+
+	if version > 1 && flags&0x03 != 0 {
+		// Shared datatypes and dataspaces are stored elsewhere.
+		return "", "", false
+	}
+
+	fields := make([][]byte, 3)
+	for i, size := range []int{nameSize, datatypeSize, dataspaceSize} {
+		if pos+size > len(data) {
+			return "", "", false
+		}
+		fields[i] = data[pos : pos+size]
+		pos += pad(size)
+	}
+
+	if pos > len(data) {
+		return "", "", false
+	}
+
+	name := strings.TrimRight(string(fields[0]), "\x00")
+	count, ok := r.dataspaceElements(fields[2])
+	if !ok {
+		return "", "", false
+	}
+
+	value, ok := r.decodeValues(fields[1], data[pos:], count)
+	return name, value, ok
+}
+
+// dataspaceElements returns the number of elements in the dataspace message in data.
+func (r *hdf5Reader) dataspaceElements(data []byte) (int, bool) {
+	dims, ok := r.dataspaceDims(data)
+	if !ok {
+		return 0, false
+	}
+
+	count := 1
+	for _, dim := range dims {
+		// Checking before multiplying keeps count from overflowing.
+		if dim > maxHDF5AttributeValues || (dim != 0 && count > maxHDF5AttributeValues/int(dim)) {
+			return 0, false
+		}
+		count *= int(dim)
+	}
+
+	return count, true
+}
+
+// dataspaceDims returns the size of each dimension of the dataspace message in data. A scalar dataspace
+// has none, and a null dataspace, which has no elements, has a single dimension of 0.
+func (r *hdf5Reader) dataspaceDims(data []byte) ([]uint64, bool) {
+	if len(data) < 4 {
+		return nil, false
+	}
+
+	version, rank := data[0], int(data[1])
+	pos := 8
+	switch version {
+	case 1:
+	case 2:
+		pos = 4
+		if data[3] == 2 {
+			return []uint64{0}, true
+		}
+	default:
+		return nil, false
+	}
+
+	dims := make([]uint64, 0, rank)
+	for i := 0; i < rank; i++ {
+		dim, ok := hdf5Uint(data[minInt(pos, len(data)):], r.lengthSize)
+		if !ok {
+			return nil, false
+		}
+		dims = append(dims, dim)
+		pos += r.lengthSize
+	}
+
+	return dims, true
+}
+
+// decodeValues decodes count values of the datatype message in datatype from data, separated by
+// commas.
+func (r *hdf5Reader) decodeValues(datatype, data []byte, count int) (string, bool) {
+	if len(datatype) < 8 {
+		return "", false
+	}
+
+	class := datatype[0] & 0x0f
+	bits := datatype[1]
+	size := int(binary.LittleEndian.Uint32(datatype[4:]))
+
+	elementSize := size
+	if class == hdf5VariableLength {
+		// The length, then the global heap collection address and the index in it.
+		elementSize = 4 + r.offsetSize + 4
+	}
+
+	if elementSize <= 0 || elementSize*count > len(data) {
+		return "", false
+	}
+
+	values := make([]string, count)
+	for i := range values {
+		element := data[i*elementSize : (i+1)*elementSize]
+		switch class {
+		case hdf5FixedPoint:
+			if size > 8 {
+				return "", false
+			}
+			values[i] = decodeHDF5Integer(element, bits&0x01 != 0, bits&0x08 != 0)
+		case hdf5FloatingPoint:
+			value, ok := decodeHDF5Float(element, bits&0x01 != 0)
+			if !ok {
+				return "", false
+			}
+			values[i] = value
+		case hdf5String:
+			values[i] = strings.TrimRight(string(element), "\x00 ")
+		case hdf5VariableLength:
+			if bits&0x0f != 1 {
+				// Only variable length strings, not sequences.
+				return "", false
+			}
+
+			value, ok := r.readVariableLengthString(element)
+			if !ok {
+				return "", false
+			}
+			values[i] = value
+		default:
+			return "", false
+		}
+	}
+
+	return strings.Join(values, ","), true
+}
+
+func decodeHDF5Integer(element []byte, bigEndian, signed bool) string {
+	le := element
+	if bigEndian {
+		le = make([]byte, len(element))
+		for i := range element {
+			le[i] = element[len(element)-1-i]
+		}
+	}
+
+	n, _ := hdf5Uint(le, len(le))
+	if signed && len(le) < 8 && n&(1<<(8*len(le)-1)) != 0 {
+		// Sign extend.
+		n |= ^uint64(0) << (8 * len(le))
+	}
+
+	if signed {
+		return strconv.FormatInt(int64(n), 10)
+	}
+
+	return strconv.FormatUint(n, 10)
+}
+
+func decodeHDF5Float(element []byte, bigEndian bool) (string, bool) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+
+	switch len(element) {
+	case 4:
+		return strconv.FormatFloat(float64(math.Float32frombits(order.Uint32(element))), 'g', -1, 32), true
+	case 8:
+		return strconv.FormatFloat(math.Float64frombits(order.Uint64(element)), 'g', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// readVariableLengthString reads a variable length string from the global heap. element has the length
+// of the string, and the address of the heap collection and the index of the string in it.
+func (r *hdf5Reader) readVariableLengthString(element []byte) (string, bool) {
+	address, _ := hdf5Uint(element[4:], r.offsetSize)
+	index, _ := hdf5Uint(element[4+r.offsetSize:], 4)
+
+	heap, err := r.readGlobalHeap(int64(address))
+	if err != nil {
+		return "", false
+	}
+
+	// Each object has its index, reference count, 4 reserved bytes and size, and its data is padded to
+	// a multiple of 8 bytes.
+	for pos := 8 + r.lengthSize; pos+8+r.lengthSize <= len(heap); {
+		objectIndex := binary.LittleEndian.Uint16(heap[pos:])
+		size, _ := hdf5Uint(heap[pos+8:], r.lengthSize)
+		start := pos + 8 + r.lengthSize
+		if objectIndex == 0 || size > uint64(len(heap)-start) {
+			// Index 0 is the free space at the end of the collection.
+			break
+		}
+
+		if uint64(objectIndex) == index {
+			return strings.TrimRight(string(heap[start:start+int(size)]), "\x00"), true
+		}
+
+		pos = start + (int(size)+7)&^7
+	}
+
+	return "", false
+}
+
+func (r *hdf5Reader) readGlobalHeap(address int64) ([]byte, error) {
+	if heap, ok := r.heaps[address]; ok {
+		return heap, nil
+	}
+
+	header, err := r.readAt(address, int64(8+r.lengthSize))
+	if err != nil {
+		return nil, err
+	}
+
+	size, ok := hdf5Uint(header[minInt(8, len(header)):], r.lengthSize)
+	if !bytes.HasPrefix(header, []byte("GCOL")) || !ok {
+		return nil, fmt.Errorf("invalid global heap at %d", address)
+	}
+
+	heap, err := r.readAt(address, int64(size))
+	if err != nil {
+		return nil, err
+	}
+
+	r.heaps[address] = heap
+	return heap, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,132 @@
+package mc
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// MetadataStore records key/value metadata on files, as Materials Commons attributes, so that it can be
+// searched for in the UI. gomcdb only has read support for attributes.
+type MetadataStore interface {
+	// SetFileMetadata sets each key in metadata as an attribute of file. An attribute the file already
+	// has with the same name is replaced.
+	SetFileMetadata(file *mcmodel.File, metadata map[string]string) error
+}
+
+type GormMetadataStore struct {
+	db *gorm.DB
+}
+
+func NewGormMetadataStore(db *gorm.DB) *GormMetadataStore {
+	return &GormMetadataStore{db: db}
+}
+
+// attribute is a row in the Materials Commons attributes table. Files have an attributable_type of
+// fileTaggableType, which is the Materials Commons model for files.
+type attribute struct {
+	ID               int
+	UUID             string
+	Name             string
+	AttributableID   int
+	AttributableType string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (attribute) TableName() string {
+	return "attributes"
+}
+
+// attributeValue is a row in the Materials Commons attribute_values table. Val is a JSON object with
+// the value in its "value" key.
+type attributeValue struct {
+	ID          int
+	UUID        string
+	AttributeID int
+	Unit        string
+	Val         string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (attributeValue) TableName() string {
+	return "attribute_values"
+}
+
+func (s *GormMetadataStore) SetFileMetadata(file *mcmodel.File, metadata map[string]string) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		for name, value := range metadata {
+			var existing []int
+			err := tx.Model(&attribute{}).
+				Where("attributable_type = ?", fileTaggableType).
+				Where("attributable_id = ?", file.ID).
+				Where("name = ?", name).
+				Pluck("id", &existing).Error
+			if err != nil {
+				return err
+			}
+
+			if len(existing) != 0 {
+				if err := tx.Where("attribute_id IN ?", existing).Delete(&attributeValue{}).Error; err != nil {
+					return err
+				}
+
+				if err := tx.Where("id IN ?", existing).Delete(&attribute{}).Error; err != nil {
+					return err
+				}
+			}
+
+			a := attribute{Name: name, AttributableID: file.ID, AttributableType: fileTaggableType}
+			if a.UUID, err = uuid.GenerateUUID(); err != nil {
+				return err
+			}
+
+			if err := tx.Create(&a).Error; err != nil {
+				return err
+			}
+
+			val, err := json.Marshal(map[string]string{"value": value})
+			if err != nil {
+				return err
+			}
+
+			v := attributeValue{AttributeID: a.ID, Val: string(val)}
+			if v.UUID, err = uuid.GenerateUUID(); err != nil {
+				return err
+			}
+
+			if err := tx.Create(&v).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, s.db)
+}
+
+// FakeMetadataStore is a MetadataStore for testing. The metadata for each file is recorded in Metadata,
+// keyed by the file ID.
+type FakeMetadataStore struct {
+	Metadata map[int]map[string]string
+}
+
+func NewFakeMetadataStore() *FakeMetadataStore {
+	return &FakeMetadataStore{Metadata: make(map[int]map[string]string)}
+}
+
+func (s *FakeMetadataStore) SetFileMetadata(file *mcmodel.File, metadata map[string]string) error {
+	if s.Metadata[file.ID] == nil {
+		s.Metadata[file.ID] = make(map[string]string)
+	}
+
+	for name, value := range metadata {
+		s.Metadata[file.ID][name] = value
+	}
+
+	return nil
+}
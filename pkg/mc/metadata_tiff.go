@@ -0,0 +1,160 @@
+package mc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tiffTags are the names of the TIFF tags that are recorded as metadata.
+var tiffTags = map[uint16]string{
+	256:   "ImageWidth",
+	257:   "ImageLength",
+	258:   "BitsPerSample",
+	259:   "Compression",
+	262:   "PhotometricInterpretation",
+	270:   "ImageDescription",
+	271:   "Make",
+	272:   "Model",
+	277:   "SamplesPerPixel",
+	282:   "XResolution",
+	283:   "YResolution",
+	296:   "ResolutionUnit",
+	305:   "Software",
+	306:   "DateTime",
+	315:   "Artist",
+	316:   "HostComputer",
+	33432: "Copyright",
+}
+
+// The TIFF field types that are decoded.
+const (
+	tiffByte     = 1
+	tiffASCII    = 2
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+var errNotTIFF = errors.New("not a TIFF file")
+
+// extractTIFFMetadata extracts the tags in tiffTags from the first image of a TIFF file. BigTIFF files
+// aren't supported.
+func extractTIFFMetadata(f *os.File) (map[string]string, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return nil, errNotTIFF
+	}
+
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errNotTIFF
+	}
+
+	if order.Uint16(header[2:4]) != 42 {
+		return nil, errNotTIFF
+	}
+
+	ifdOffset := int64(order.Uint32(header[4:8]))
+	var count [2]byte
+	if _, err := f.ReadAt(count[:], ifdOffset); err != nil {
+		return nil, fmt.Errorf("unable to read the TIFF directory: %w", err)
+	}
+
+	entries := make([]byte, 12*int(order.Uint16(count[:])))
+	if _, err := f.ReadAt(entries, ifdOffset+2); err != nil {
+		return nil, fmt.Errorf("unable to read the TIFF directory: %w", err)
+	}
+
+	metadata := make(map[string]string)
+	for i := 0; i < len(entries); i += 12 {
+		entry := entries[i : i+12]
+		name, ok := tiffTags[order.Uint16(entry[0:2])]
+		if !ok {
+			continue
+		}
+
+		value, err := readTIFFValue(f, order, entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read TIFF tag %s: %w", name, err)
+		}
+
+		if value != "" {
+			metadata[name] = value
+		}
+	}
+
+	return metadata, nil
+}
+
+// readTIFFValue reads the value of the 12 byte directory entry as a string. Values with several
+// elements, such as BitsPerSample for an RGB image, are separated by commas. Unknown field types are
+// returned as "".
+func readTIFFValue(f *os.File, order binary.ByteOrder, entry []byte) (string, error) {
+	fieldType := order.Uint16(entry[2:4])
+	count := int64(order.Uint32(entry[4:8]))
+
+	var size int64
+	switch fieldType {
+	case tiffByte, tiffASCII:
+		size = 1
+	case tiffShort:
+		size = 2
+	case tiffLong:
+		size = 4
+	case tiffRational:
+		size = 8
+	default:
+		return "", nil
+	}
+
+	if count*size > maxMetadataValueLength*8 {
+		count = maxMetadataValueLength * 8 / size
+	}
+
+	// Values of up to 4 bytes are stored in the entry itself, otherwise the entry has their offset.
+	var data []byte
+	if count*size <= 4 {
+		data = entry[8 : 8+count*size]
+	} else {
+		data = make([]byte, count*size)
+		if _, err := f.ReadAt(data, int64(order.Uint32(entry[8:12]))); err != nil {
+			return "", err
+		}
+	}
+
+	if fieldType == tiffASCII {
+		return strings.TrimSpace(strings.TrimRight(string(data), "\x00")), nil
+	}
+
+	values := make([]string, count)
+	for i := range values {
+		element := data[int64(i)*size:]
+		switch fieldType {
+		case tiffByte:
+			values[i] = strconv.Itoa(int(element[0]))
+		case tiffShort:
+			values[i] = strconv.Itoa(int(order.Uint16(element)))
+		case tiffLong:
+			values[i] = strconv.FormatUint(uint64(order.Uint32(element)), 10)
+		case tiffRational:
+			numerator, denominator := order.Uint32(element), order.Uint32(element[4:])
+			if denominator == 0 {
+				values[i] = "0"
+			} else {
+				values[i] = strconv.FormatFloat(float64(numerator)/float64(denominator), 'g', -1, 64)
+			}
+		}
+	}
+
+	return strings.Join(values, ","), nil
+}
@@ -0,0 +1,197 @@
+package mc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// MetadataViewDirName is the name of the read-only virtual directory, at the root of each project, that
+// shows what the server did with the files in the project. It mirrors the project's directories, and has a
+// JSON document, named after the file with a MetadataViewSuffix, for each file. For example the document
+// for /my-project/raw/scan.tif is /my-project/.mc/raw/scan.tif.json. See FileMetadataView.
+const MetadataViewDirName = ".mc"
+
+// MetadataViewSuffix is added to the names of files in the MetadataViewDirName.
+const MetadataViewSuffix = ".json"
+
+// ErrMetadataView is returned for attempts to change the MetadataViewDirName.
+var ErrMetadataView = fmt.Errorf("%w: %s is read-only", os.ErrPermission, MetadataViewDirName)
+
+// maxSharedFiles is the number of files with the same contents that are counted for a FileMetadataView.
+const maxSharedFiles = 1000
+
+// FileMetadataView is the JSON document for a file in the MetadataViewDirName. Version counts the
+// versions of the file from the oldest, which is 1. Deduplicated is set when the file's data is stored
+// once for it and another file, because the file had the same checksum as an existing file when it was
+// uploaded, or is a hard link. SharedWith counts the other files with the same contents, which includes
+// files in other projects, so their paths aren't shown. PreviousChecksums are the checksums of the
+// versions before this one, newest first. UploadedFrom is where the version was uploaded from, when that
+// was recorded (see UploadProvenanceStore).
+type FileMetadataView struct {
+	Path              string    `json:"path"`
+	FileID            int       `json:"file_id"`
+	UUID              string    `json:"uuid"`
+	Size              uint64    `json:"size"`
+	Checksum          string    `json:"checksum"`
+	MimeType          string    `json:"mime_type"`
+	CreatedAt         time.Time `json:"created_at"`
+	Version           int       `json:"version"`
+	Versions          int       `json:"versions"`
+	Current           bool      `json:"current"`
+	Deduplicated      bool      `json:"deduplicated"`
+	UsesUUID          string    `json:"uses_uuid,omitempty"`
+	SharedWith        int       `json:"shared_with"`
+	PreviousChecksums []string  `json:"previous_checksums"`
+
+	UploadedFrom *UploadProvenance `json:"uploaded_from,omitempty"`
+}
+
+// ParseMetadataViewPath returns the path within the MetadataViewDirName of path, a path in a project, and
+// true if path is in the MetadataViewDirName.
+func ParseMetadataViewPath(path string) (string, bool) {
+	path = cleanClientPath(path)
+	switch {
+	case path == "/"+MetadataViewDirName:
+		return "/", true
+	case strings.HasPrefix(path, "/"+MetadataViewDirName+"/"):
+		return path[len(MetadataViewDirName)+1:], true
+	default:
+		return path, false
+	}
+}
+
+// StatMetadataView looks up the file or directory in the project that viewPath, a path within the
+// MetadataViewDirName, is for. A directory is shown under its own name, a file under its name with the
+// MetadataViewSuffix.
+func StatMetadataView(stores *Stores, projectID int, viewPath string) (*mcmodel.File, error) {
+	if file, err := StatPath(stores.FileStore, projectID, viewPath); err == nil && file.IsDir() {
+		return file, nil
+	}
+
+	if !strings.HasSuffix(viewPath, MetadataViewSuffix) {
+		return nil, os.ErrNotExist
+	}
+
+	file, err := StatPath(stores.FileStore, projectID, strings.TrimSuffix(viewPath, MetadataViewSuffix))
+	if err != nil || file.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	return file, nil
+}
+
+// NewFileMetadataView creates the FileMetadataView for file, which is at path in its project.
+func NewFileMetadataView(stores *Stores, file *mcmodel.File, path string) (*FileMetadataView, error) {
+	view := &FileMetadataView{
+		Path:              path,
+		FileID:            file.ID,
+		UUID:              file.UUID,
+		Size:              file.Size,
+		Checksum:          file.Checksum,
+		MimeType:          file.MimeType,
+		CreatedAt:         file.CreatedAt,
+		Current:           file.Current,
+		UsesUUID:          file.UsesUUID,
+		Deduplicated:      file.UsesUUID != "" && file.UsesUUID != file.UUID,
+		PreviousChecksums: []string{},
+	}
+
+	versions, err := stores.VersionStore.ListVersions(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// The versions are newest first.
+	view.Versions = len(versions)
+	for i, version := range versions {
+		if version.ID == file.ID {
+			view.Version = len(versions) - i
+			for _, previous := range versions[i+1:] {
+				view.PreviousChecksums = append(view.PreviousChecksums, previous.Checksum)
+			}
+			break
+		}
+	}
+
+	if file.Checksum != "" {
+		shared, err := stores.FileAuditStore.ListFilesWithChecksum(file.Checksum, maxSharedFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range shared {
+			if f.ID != file.ID {
+				view.SharedWith++
+			}
+		}
+	}
+
+	if stores.UploadProvenanceStore != nil {
+		provenance, err := stores.UploadProvenanceStore.GetUploadProvenance([]int{file.ID})
+		if err != nil {
+			return nil, err
+		}
+
+		view.UploadedFrom = provenance[file.ID]
+	}
+
+	return view, nil
+}
+
+// MetadataViewData returns the JSON document for file, which is at path in its project.
+func MetadataViewData(stores *Stores, file *mcmodel.File, path string) ([]byte, error) {
+	view, err := NewFileMetadataView(stores, file, path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(view, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// MetadataViewFileInfo returns the entry for file in the MetadataViewDirName. Directories keep their name,
+// files are named with the MetadataViewSuffix and have size bytes. Neither can be written.
+func MetadataViewFileInfo(file *mcmodel.File, size int64) os.FileInfo {
+	if file.IsDir() {
+		return metadataViewFileInfo{FileInfo: file.ToFileInfo(), name: file.Name, mode: os.ModeDir | 0555}
+	}
+
+	return metadataViewFileInfo{FileInfo: file.ToFileInfo(), name: file.Name + MetadataViewSuffix, size: size, mode: 0444}
+}
+
+// MetadataViewRootFileInfo returns the entry for the MetadataViewDirName itself.
+func MetadataViewRootFileInfo(root *mcmodel.File) os.FileInfo {
+	return metadataViewFileInfo{FileInfo: root.ToFileInfo(), name: MetadataViewDirName, mode: os.ModeDir | 0555}
+}
+
+type metadataViewFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi metadataViewFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi metadataViewFileInfo) Size() int64 {
+	if fi.mode.IsDir() {
+		return fi.FileInfo.Size()
+	}
+
+	return fi.size
+}
+
+func (fi metadataViewFileInfo) Mode() os.FileMode {
+	return fi.mode
+}
@@ -0,0 +1,109 @@
+package mc
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMetadataViewPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		viewPath string
+		inView   bool
+	}{
+		{path: "/.mc", viewPath: "/", inView: true},
+		{path: "/.mc/", viewPath: "/", inView: true},
+		{path: "/.mc/raw/a.tif.json", viewPath: "/raw/a.tif.json", inView: true},
+		{path: "/raw/.mc/a.tif.json", viewPath: "/raw/.mc/a.tif.json", inView: false},
+		{path: "/.mcignore", viewPath: "/.mcignore", inView: false},
+	}
+
+	for _, test := range tests {
+		viewPath, inView := ParseMetadataViewPath(test.path)
+		require.Equal(t, test.viewPath, viewPath, test.path)
+		require.Equal(t, test.inView, inView, test.path)
+	}
+}
+
+func TestFileMetadataView(t *testing.T) {
+	dir := mcmodel.File{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", DirectoryID: 1, MimeType: "directory"}
+	version := func(id int, checksum, usesUUID string, current bool) mcmodel.File {
+		return mcmodel.File{ID: id, ProjectID: 1, Name: "a.tif", DirectoryID: 2, Directory: &dir, MimeType: "image/tiff",
+			Checksum: checksum, UsesUUID: usesUUID, Current: current}
+	}
+
+	// Newest first.
+	versions := []mcmodel.File{version(12, "ccc", "uuid-of-5", true), version(11, "bbb", "", false), version(10, "aaa", "", false)}
+	files := append([]mcmodel.File{{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}, dir}, versions[0])
+
+	stores := &Stores{
+		FileStore:    store.NewFakeFileStore(files),
+		VersionStore: NewFakeVersionStore(versions...),
+
+		// The file's contents are also in a file in another project.
+		FileAuditStore: NewFakeFileAuditStore(append(versions, mcmodel.File{ID: 5, ProjectID: 9, Name: "other.tif", Checksum: "ccc"})...),
+	}
+
+	file, err := StatMetadataView(stores, 1, "/raw/a.tif.json")
+	require.NoError(t, err)
+	require.Equal(t, 12, file.ID)
+
+	d, err := StatMetadataView(stores, 1, "/raw")
+	require.NoError(t, err)
+	require.True(t, d.IsDir())
+
+	_, err = StatMetadataView(stores, 1, "/raw/a.tif")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	data, err := MetadataViewData(stores, file, "/raw/a.tif")
+	require.NoError(t, err)
+
+	var view FileMetadataView
+	require.NoError(t, json.Unmarshal(data, &view))
+	require.Equal(t, "/raw/a.tif", view.Path)
+	require.Equal(t, 3, view.Version)
+	require.Equal(t, 3, view.Versions)
+	require.True(t, view.Deduplicated)
+	require.Equal(t, 1, view.SharedWith)
+	require.Equal(t, []string{"bbb", "aaa"}, view.PreviousChecksums)
+	require.Nil(t, view.UploadedFrom)
+
+	// An older version only lists the versions before it.
+	older, err := NewFileMetadataView(stores, &versions[1], "/raw/a.tif")
+	require.NoError(t, err)
+	require.Equal(t, 2, older.Version)
+	require.False(t, older.Deduplicated)
+	require.Equal(t, 0, older.SharedWith)
+	require.Equal(t, []string{"aaa"}, older.PreviousChecksums)
+
+	// The current version was uploaded by a client whose provenance was recorded.
+	stores.UploadProvenanceStore = NewFakeUploadProvenanceStore()
+	source := NewUploadSource("SSH-2.0-OpenSSH_8.9p1", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 52814}, "abc123")
+	RecordUploadProvenance(stores.UploadProvenanceStore, file, 7, "sftp", source)
+
+	data, err = MetadataViewData(stores, file, "/raw/a.tif")
+	require.NoError(t, err)
+	view = FileMetadataView{}
+	require.NoError(t, json.Unmarshal(data, &view))
+	require.NotNil(t, view.UploadedFrom)
+	require.Equal(t, 7, view.UploadedFrom.UserID)
+	require.Equal(t, "sftp", view.UploadedFrom.Protocol)
+	require.Equal(t, "SSH-2.0-OpenSSH_8.9p1", view.UploadedFrom.ClientVersion)
+	require.Equal(t, "10.1.2.3", view.UploadedFrom.RemoteAddr)
+	require.Equal(t, "abc123", view.UploadedFrom.SessionID)
+
+	older, err = NewFileMetadataView(stores, &versions[1], "/raw/a.tif")
+	require.NoError(t, err)
+	require.Nil(t, older.UploadedFrom)
+
+	fi := MetadataViewFileInfo(file, int64(len(data)))
+	require.Equal(t, "a.tif.json", fi.Name())
+	require.Equal(t, int64(len(data)), fi.Size())
+	require.Equal(t, os.FileMode(0444), fi.Mode())
+}
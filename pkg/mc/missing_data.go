@@ -0,0 +1,54 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// EventFileDataMissing is the Event.Type for a file whose record exists but whose data was missing from
+// storage when it was opened.
+const EventFileDataMissing = "file.data_missing"
+
+// ErrFileDataMissing is returned when a file is opened whose data is missing from storage. It doesn't wrap
+// os.ErrNotExist, so that users can tell it apart from a file that doesn't exist.
+var ErrFileDataMissing = errors.New("the file's data is missing from storage, it has been reported to the administrators")
+
+// ReportMissingData handles a file, being downloaded as described by transfer, whose data is missing from
+// storage. It logs the problem, flags the file as damaged so that it is picked up by the FileRepairer,
+// and emits an EventFileDataMissing event. It returns the error to give the user.
+func ReportMissingData(stores *Stores, events EventSink, file *mcmodel.File, transfer Transfer) error {
+	log.Errorf("The data for file %d (%s) in project %d is missing from storage, uuid %s",
+		file.ID, transfer.Path, transfer.ProjectID, file.UUIDForPath())
+
+	damaged := DamagedFile{
+		FileID:     file.ID,
+		ProjectID:  file.ProjectID,
+		Path:       transfer.Path,
+		Reason:     VerifyMissing,
+		DetectedAt: time.Now(),
+	}
+
+	if err := stores.DamagedFileStore.MarkFileDamaged(damaged); err != nil {
+		log.Errorf("Unable to flag file %d as damaged: %s", file.ID, err)
+	}
+
+	events.Emit(Event{
+		Type:      EventFileDataMissing,
+		Time:      damaged.DetectedAt,
+		ProjectID: transfer.ProjectID,
+		Path:      transfer.Path,
+		Details: map[string]string{
+			"file_id":  strconv.Itoa(file.ID),
+			"uuid":     file.UUIDForPath(),
+			"protocol": transfer.Protocol,
+			"user_id":  strconv.Itoa(transfer.UserID),
+		},
+	})
+
+	return fmt.Errorf("'%s': %w", transfer.Path, ErrFileDataMissing)
+}
@@ -0,0 +1,310 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errInvalidMMDB is returned for data that isn't laid out as the MaxMind DB format describes.
+var errInvalidMMDB = errors.New("invalid MaxMind DB")
+
+// mmdb reads a MaxMind DB file, the format of the GeoIP2 and GeoLite2 databases (see
+// https://maxmind.github.io/MaxMind-DB/). The whole file is held in memory.
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// data is the data section, which the search tree points into.
+	data []byte
+
+	// ipv4Start is the node reached by the 96 zero bits that IPv4 addresses are mapped to in an IPv6 tree.
+	ipv4Start uint
+}
+
+// openMMDB reads the MaxMind DB file at path.
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMMDB(buf)
+}
+
+func newMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata", errInvalidMMDB)
+	}
+
+	metadataSection := buf[i+len(mmdbMetadataMarker):]
+	value, _, err := decodeMMDB(metadataSection, metadataSection, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata isn't a map", errInvalidMMDB)
+	}
+
+	db := &mmdb{buf: buf}
+	for key, field := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		n, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%w: no %s in metadata", errInvalidMMDB, key)
+		}
+		*field = uint(n)
+	}
+
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalidMMDB, db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%w: search tree is larger than the file", errInvalidMMDB)
+	}
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if the database has no record for it.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8)&1))
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, fmt.Errorf("%w: search tree is deeper than the address", errInvalidMMDB)
+	}
+
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, fmt.Errorf("%w: record points outside of the data section", errInvalidMMDB)
+	}
+
+	value, _, err := decodeMMDB(db.data, db.data, offset)
+	return value, err
+}
+
+// The MaxMind DB data types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decodeMMDB decodes the value at offset in buf, and returns the value and the offset following it.
+// Pointers are offsets into data. Strings are returned as string, numbers as uint64, int64 or float64,
+// maps as map[string]interface{} and arrays as []interface{}.
+func decodeMMDB(buf, data []byte, offset uint) (interface{}, uint, error) {
+	next := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(buf)) {
+			return nil, fmt.Errorf("%w: value runs past the end of the data", errInvalidMMDB)
+		}
+		b := buf[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	ctrl, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	typ := uint(ctrl[0] >> 5)
+	if typ == mmdbPointer {
+		pointerSize := uint(ctrl[0]>>3) & 0x3
+		b, err := next(pointerSize + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var pointer uint
+		if pointerSize != 3 {
+			pointer = uint(ctrl[0] & 0x7)
+		}
+		for _, c := range b {
+			pointer = pointer<<8 | uint(c)
+		}
+		pointer += []uint{0, 2048, 526336, 0}[pointerSize]
+
+		if pointer >= uint(len(data)) {
+			return nil, 0, fmt.Errorf("%w: pointer outside of the data section", errInvalidMMDB)
+		}
+
+		// A pointer never points at another pointer, which also keeps a bad file from looping.
+		if data[pointer]>>5 == mmdbPointer {
+			return nil, 0, fmt.Errorf("%w: pointer to a pointer", errInvalidMMDB)
+		}
+
+		value, _, err := decodeMMDB(data, data, pointer)
+		return value, offset, err
+	}
+
+	if typ == mmdbExtended {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n := uint(0)
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[size-29] + n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, minInt(int(size), 64))
+		for i := uint(0); i < size; i++ {
+			key, keyEnd, err := decodeMMDB(buf, data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			value, valueEnd, err := decodeMMDB(buf, data, keyEnd)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key isn't a string", errInvalidMMDB)
+			}
+			m[k] = value
+			offset = valueEnd
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		a := make([]interface{}, 0, minInt(int(size), 64))
+		for i := uint(0); i < size; i++ {
+			value, end, err := decodeMMDB(buf, data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = end
+		}
+		return a, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err := next(size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double of size %d", errInvalidMMDB, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float of size %d", errInvalidMMDB, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: integer of size %d", errInvalidMMDB, size)
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: integer of size %d", errInvalidMMDB, size)
+		}
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		// Short int32s are padded with zeros, so the value is only negative when all 4 bytes are given.
+		return int64(int32(n)), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unknown data type %d", errInvalidMMDB, typ)
+	}
+}
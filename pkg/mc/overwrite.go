@@ -0,0 +1,42 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// ErrFileExists is returned when writing to a path where overwrites aren't allowed and a file
+// already exists at that path. It wraps os.ErrExist.
+var ErrFileExists = fmt.Errorf("%w: files in this path can't be overwritten", os.ErrExist)
+
+// CheckOverwrite returns ErrFileExists if path in the project matches one of config.NoOverwritePaths
+// and a file already exists at path, or ErrWriteOnce if it matches one of config.WriteOncePaths.
+// Normally writing to an existing file creates a new version, but the NoOverwritePaths and
+// WriteOncePaths are for areas, such as raw data, that should never change once written. The write is
+// only allowed when the lookup finds there is no file at path; a failure to look it up is returned.
+func CheckOverwrite(fileStore store.FileStore, project *mcmodel.Project, path string, config *Config) error {
+	writeOnce := MatchesAnyPathRule(config.WriteOncePaths, project.Slug, path)
+	if !writeOnce && !MatchesAnyPathRule(config.NoOverwritePaths, project.Slug, path) {
+		return nil
+	}
+
+	switch _, err := fileStore.GetFileByPath(project.ID, path); {
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		log.Errorf("Unable to check for an existing file at %s in project %d: %s", path, project.ID, err)
+		return err
+	}
+
+	if writeOnce {
+		return ErrWriteOnce
+	}
+
+	return ErrFileExists
+}
@@ -0,0 +1,41 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPathLimitExceeded is wrapped by the errors returned from ValidatePathLimits.
+var ErrPathLimitExceeded = errors.New("path limit exceeded")
+
+// ValidatePathLimits checks path, a project path without the project slug, against the path depth,
+// name length and total path length limits in config. A limit of 0 means that there is no limit. The
+// error returned describes which limit was exceeded, so that the user gets a clear message rather
+// than a failure from the database.
+func ValidatePathLimits(path string, config *Config) error {
+	if config.MaxPathLength > 0 && len(path) > config.MaxPathLength {
+		return fmt.Errorf("%w: path is %d characters long, the maximum allowed is %d", ErrPathLimitExceeded, len(path), config.MaxPathLength)
+	}
+
+	var components []string
+	for _, component := range strings.Split(path, "/") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+
+	if config.MaxPathDepth > 0 && len(components) > config.MaxPathDepth {
+		return fmt.Errorf("%w: path is %d levels deep, the maximum allowed is %d", ErrPathLimitExceeded, len(components), config.MaxPathDepth)
+	}
+
+	if config.MaxNameLength > 0 {
+		for _, component := range components {
+			if len(component) > config.MaxNameLength {
+				return fmt.Errorf("%w: name '%s' is %d characters long, the maximum allowed is %d", ErrPathLimitExceeded, component, len(component), config.MaxNameLength)
+			}
+		}
+	}
+
+	return nil
+}
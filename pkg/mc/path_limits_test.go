@@ -0,0 +1,35 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePathLimits(t *testing.T) {
+	config := &Config{MaxPathDepth: 3, MaxNameLength: 10, MaxPathLength: 30}
+	tests := []struct {
+		tname      string
+		path       string
+		shouldFail bool
+	}{
+		{"Test path within limits", "/dir1/dir2/file.txt", false},
+		{"Test path too deep", "/dir1/dir2/dir3/file.txt", true},
+		{"Test name too long", "/dir1/this-name-is-too-long.txt", true},
+		{"Test path too long", "/" + strings.Repeat("d/", 20), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tname, func(t *testing.T) {
+			err := ValidatePathLimits(test.path, config)
+			if test.shouldFail {
+				require.ErrorIs(t, err, ErrPathLimitExceeded, "Path %s should have exceeded a limit", test.path)
+			} else {
+				require.Nil(t, err, "Path %s should have been within limits, got %s", test.path, err)
+			}
+		})
+	}
+
+	require.Nil(t, ValidatePathLimits("/"+strings.Repeat("d/", 100), &Config{}), "No limits set should always pass")
+}
@@ -0,0 +1,60 @@
+package mc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PathRule selects a path, and everything under it, in a project. Rules are used to apply a policy,
+// such as Config.NoOverwritePaths, to only part of a project.
+type PathRule struct {
+	// ProjectSlug is the slug of the project the rule applies to. A ProjectSlug of "*" applies the
+	// rule to every project.
+	ProjectSlug string
+
+	// Prefix is the project path (without the project slug) the rule applies to.
+	Prefix string
+}
+
+// ParsePathRules parses a comma separated list of rules of the form project-slug:/path, for
+// example "my-project:/raw,*:/instrument-data".
+func ParsePathRules(rules string) ([]PathRule, error) {
+	var pathRules []PathRule
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		i := strings.Index(rule, ":")
+		if i < 1 || !strings.HasPrefix(rule[i+1:], "/") {
+			return nil, fmt.Errorf("invalid path rule '%s', expected project-slug:/path", rule)
+		}
+
+		pathRules = append(pathRules, PathRule{ProjectSlug: rule[:i], Prefix: filepath.Clean(rule[i+1:])})
+	}
+
+	return pathRules, nil
+}
+
+// Matches returns true if path in the project with projectSlug is the rule's Prefix or is under it.
+func (r PathRule) Matches(projectSlug, path string) bool {
+	if r.ProjectSlug != "*" && r.ProjectSlug != projectSlug {
+		return false
+	}
+
+	path = filepath.Clean(path)
+	return r.Prefix == "/" || path == r.Prefix || strings.HasPrefix(path, r.Prefix+"/")
+}
+
+// MatchesAnyPathRule returns true if any of the rules matches path in the project with projectSlug.
+func MatchesAnyPathRule(rules []PathRule, projectSlug, path string) bool {
+	for _, rule := range rules {
+		if rule.Matches(projectSlug, path) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,38 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePathRules(t *testing.T) {
+	rules, err := ParsePathRules("proj:/raw, *:/instrument-data/ ")
+	require.Nil(t, err)
+	require.Equal(t, []PathRule{{"proj", "/raw"}, {"*", "/instrument-data"}}, rules)
+
+	for _, invalid := range []string{"proj", ":/raw", "proj:raw"} {
+		_, err := ParsePathRules(invalid)
+		require.NotNil(t, err, "ParsePathRules should have failed for '%s'", invalid)
+	}
+}
+
+func TestPathRule_Matches(t *testing.T) {
+	tests := []struct {
+		rule        PathRule
+		projectSlug string
+		path        string
+		shouldMatch bool
+	}{
+		{PathRule{"proj", "/raw"}, "proj", "/raw", true},
+		{PathRule{"proj", "/raw"}, "proj", "/raw/run1/data.h5", true},
+		{PathRule{"proj", "/raw"}, "proj", "/rawdata/file.txt", false},
+		{PathRule{"proj", "/raw"}, "other", "/raw/file.txt", false},
+		{PathRule{"*", "/raw"}, "other", "/raw/file.txt", true},
+		{PathRule{"proj", "/"}, "proj", "/anything.txt", true},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.shouldMatch, test.rule.Matches(test.projectSlug, test.path), "rule %+v for %s:%s", test.rule, test.projectSlug, test.path)
+	}
+}
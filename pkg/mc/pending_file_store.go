@@ -0,0 +1,105 @@
+package mc
+
+import (
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// PendingFileStore handles file versions that have been created with FileStore.CreateFile but
+// haven't been finalized with FileStore.DoneWritingToFile. store.FileStore has no way to remove
+// a file, so these calls live here.
+type PendingFileStore interface {
+	// DeletePendingFile removes the record for a file that was never finalized. Files that have
+	// been finalized (are current) are never removed.
+	DeletePendingFile(file *mcmodel.File) error
+
+	// SetExpectedSize records the size that a pending file has once all of its data has been written,
+	// for uploads that know it up front, such as SCP. It is kept as the file's size until the file is
+	// finalized. The Reconciler only completes pending files whose data has this size.
+	SetExpectedSize(file *mcmodel.File, size int64) error
+
+	// ListPendingFiles returns up to limit files that were created before createdBefore and never
+	// finalized. Only files with an ID greater than afterID are returned, and the files are ordered
+	// by ID, so that the files can be paged through. The files have their Directory loaded.
+	ListPendingFiles(createdBefore time.Time, afterID, limit int) ([]mcmodel.File, error)
+}
+
+type GormPendingFileStore struct {
+	db *gorm.DB
+}
+
+func NewGormPendingFileStore(db *gorm.DB) *GormPendingFileStore {
+	return &GormPendingFileStore{db: db}
+}
+
+func (s *GormPendingFileStore) DeletePendingFile(file *mcmodel.File) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		return tx.Where("current = ?", false).Delete(&mcmodel.File{}, file.ID).Error
+	}, s.db)
+}
+
+func (s *GormPendingFileStore) SetExpectedSize(file *mcmodel.File, size int64) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		return tx.Model(&mcmodel.File{}).Where("id = ?", file.ID).Where("current = ?", false).Update("size", size).Error
+	}, s.db)
+}
+
+// ListPendingFiles finds the pending files. A file that has been finalized always has a checksum, so
+// files that aren't current and don't have a checksum have never been finalized.
+func (s *GormPendingFileStore) ListPendingFiles(createdBefore time.Time, afterID, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	err := s.db.Preload("Directory").
+		Where("current = ?", false).
+		Where("checksum = ?", "").
+		Where("mime_type <> ?", "directory").
+		Where("deleted_at IS NULL").
+		Where("dataset_id IS NULL").
+		Where("created_at < ?", createdBefore).
+		Where("id > ?", afterID).
+		Order("id").
+		Limit(limit).
+		Find(&files).Error
+
+	return files, err
+}
+
+// FakePendingFileStore is a PendingFileStore for testing. ListPendingFiles returns the files from
+// PendingFiles, DeletePendingFile records the IDs of the deleted files, and SetExpectedSize sets the
+// size of the file in PendingFiles.
+type FakePendingFileStore struct {
+	PendingFiles   []mcmodel.File
+	DeletedFileIDs []int
+}
+
+func NewFakePendingFileStore(pendingFiles ...mcmodel.File) *FakePendingFileStore {
+	return &FakePendingFileStore{PendingFiles: pendingFiles}
+}
+
+func (s *FakePendingFileStore) DeletePendingFile(file *mcmodel.File) error {
+	s.DeletedFileIDs = append(s.DeletedFileIDs, file.ID)
+	return nil
+}
+
+func (s *FakePendingFileStore) SetExpectedSize(file *mcmodel.File, size int64) error {
+	for i := range s.PendingFiles {
+		if s.PendingFiles[i].ID == file.ID {
+			s.PendingFiles[i].Size = uint64(size)
+		}
+	}
+
+	return nil
+}
+
+func (s *FakePendingFileStore) ListPendingFiles(createdBefore time.Time, afterID, limit int) ([]mcmodel.File, error) {
+	var files []mcmodel.File
+	for _, f := range s.PendingFiles {
+		if f.ID > afterID && f.CreatedAt.Before(createdBefore) && len(files) < limit {
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
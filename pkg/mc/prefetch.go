@@ -0,0 +1,257 @@
+package mc
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// PrefetchReader reads ahead from a reader that is read sequentially, such as a file being downloaded
+// with SCP. It is double buffered: while the caller consumes one chunk, the next chunk is read in the
+// background. This overlaps reading from storage with writing to the network, which helps when storage
+// has high latency, such as an NFS mounted mcfsRoot. Reading ahead starts with the first Read, or when
+// Start is called, so creating a PrefetchReader for each file of a recursive download doesn't read them
+// all at once. See PrefetchPipeline.
+type PrefetchReader struct {
+	r         io.Reader
+	chunkSize int
+
+	// onStart is called by the first Read. It is set by PrefetchPipeline.Add.
+	onStart   func()
+	readOnce  sync.Once
+	startOnce sync.Once
+
+	// chunks holds the chunk read ahead. free holds the buffers that can be read into.
+	chunks chan prefetchChunk
+	free   chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// buf is the chunk being consumed, current is what is left of it, and err is the error that ended
+	// the reads, returned once current is empty.
+	buf     []byte
+	current []byte
+	err     error
+}
+
+type prefetchChunk struct {
+	data []byte
+	err  error
+}
+
+// NewPrefetchReader creates a PrefetchReader that reads r in chunkSize chunks. Close must be called to
+// stop reading ahead when the reader isn't read to the end.
+func NewPrefetchReader(r io.Reader, chunkSize int) *PrefetchReader {
+	return &PrefetchReader{
+		r:         r,
+		chunkSize: chunkSize,
+		chunks:    make(chan prefetchChunk, 1),
+		free:      make(chan []byte, 2),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start starts reading ahead, if it hasn't already started. The buffers are only allocated once
+// reading ahead starts.
+func (p *PrefetchReader) Start() {
+	p.startOnce.Do(func() {
+		p.free <- make([]byte, p.chunkSize)
+		p.free <- make([]byte, p.chunkSize)
+		go p.readAhead(p.r)
+	})
+}
+
+// readAhead fills the free buffers from r until r returns an error, including io.EOF, or p is closed.
+func (p *PrefetchReader) readAhead(r io.Reader) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+
+		select {
+		case p.chunks <- prefetchChunk{data: buf[:n], err: err}:
+		case <-p.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *PrefetchReader) Read(b []byte) (int, error) {
+	p.readOnce.Do(func() {
+		if p.onStart != nil {
+			p.onStart()
+		}
+	})
+	p.Start()
+
+	for len(p.current) == 0 {
+		if p.err != nil {
+			p.release()
+			return 0, p.err
+		}
+
+		// The buffer just consumed can be read into again. free has room for every buffer, so this
+		// never blocks.
+		if p.buf != nil {
+			p.free <- p.buf[:cap(p.buf)]
+			p.buf = nil
+		}
+
+		chunk := <-p.chunks
+		p.buf, p.current, p.err = chunk.data, chunk.data, chunk.err
+	}
+
+	n := copy(b, p.current)
+	p.current = p.current[n:]
+	return n, nil
+}
+
+// release drops the buffers once reading ahead has finished, since the reader may be kept around, for
+// example in the list of files being downloaded.
+func (p *PrefetchReader) release() {
+	p.buf = nil
+	for {
+		select {
+		case <-p.free:
+		default:
+			return
+		}
+	}
+}
+
+// Close stops reading ahead. It doesn't close the underlying reader.
+func (p *PrefetchReader) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+// PrefetchPipeline reads ahead across files that are read one after the other, such as the files of a
+// recursive SCP download. When a file starts being read the next Depth files start reading ahead too,
+// so that opening them and reading their first chunks overlaps with sending the current file. This is
+// what speeds up downloading trees of many small files. No more than Depth+1 files are read ahead at
+// once, however many files are added.
+type PrefetchPipeline struct {
+	Depth int
+
+	mu      sync.Mutex
+	readers []*PrefetchReader
+}
+
+func NewPrefetchPipeline(depth int) *PrefetchPipeline {
+	return &PrefetchPipeline{Depth: depth}
+}
+
+// Add adds p as the next file to be read. It must be called before p is read.
+func (pl *PrefetchPipeline) Add(p *PrefetchReader) {
+	pl.mu.Lock()
+	i := len(pl.readers)
+	pl.readers = append(pl.readers, p)
+	pl.mu.Unlock()
+
+	p.onStart = func() { pl.started(i) }
+}
+
+// started starts reading ahead the Depth files after the i'th file, which has started being read.
+func (pl *PrefetchPipeline) started(i int) {
+	pl.mu.Lock()
+	pl.readers[i] = nil
+	next := append([]*PrefetchReader(nil), pl.readers[i+1:minInt(i+1+pl.Depth, len(pl.readers))]...)
+	pl.mu.Unlock()
+
+	for _, p := range next {
+		if p != nil {
+			p.Start()
+		}
+	}
+}
+
+// lazyReader opens its reader on the first Read, and closes it once it returns an error, including
+// io.EOF, so that only the files being read are open.
+type lazyReader struct {
+	open func() (io.ReadCloser, error)
+
+	mu     sync.Mutex
+	r      io.ReadCloser
+	err    error
+	closed bool
+}
+
+// NewLazyReader returns a reader that calls open on the first Read, and reads from the reader it returns.
+// The returned reader is closed when it has been read to the end, when it fails, or by Close.
+func NewLazyReader(open func() (io.ReadCloser, error)) io.ReadCloser {
+	return &lazyReader{open: open}
+}
+
+func (l *lazyReader) Read(b []byte) (int, error) {
+	r, err := l.reader()
+	if err != nil {
+		return 0, err
+	}
+
+	// The lock isn't held while reading, so that a read that hangs doesn't also hang Close.
+	n, err := r.Read(b)
+	if err != nil {
+		l.finish(err)
+	}
+
+	return n, err
+}
+
+// reader returns the underlying reader, opening it the first time.
+func (l *lazyReader) reader() (io.ReadCloser, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.err != nil:
+		return nil, l.err
+	case l.r != nil:
+		return l.r, nil
+	case l.closed:
+		return nil, os.ErrClosed
+	}
+
+	if l.r, l.err = l.open(); l.err != nil {
+		return nil, l.err
+	}
+
+	return l.r, nil
+}
+
+// finish closes the underlying reader after it returned err.
+func (l *lazyReader) finish(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err == nil {
+		l.err = err
+		_ = l.r.Close()
+	}
+}
+
+func (l *lazyReader) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	if l.r == nil || l.err != nil {
+		return nil
+	}
+
+	l.err = os.ErrClosed
+	return l.r.Close()
+}
@@ -0,0 +1,146 @@
+package mc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchReader(t *testing.T) {
+	data := make([]byte, 100*1024+17)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	for _, chunkSize := range []int{1, 1000, 32 * 1024, len(data), 2 * len(data)} {
+		p := NewPrefetchReader(iotest.HalfReader(bytes.NewReader(data)), chunkSize)
+		read, err := io.ReadAll(iotest.OneByteReader(io.LimitReader(p, 10))) // a few small reads first
+		require.NoError(t, err)
+
+		rest, err := io.ReadAll(p)
+		require.NoError(t, err)
+		require.Equal(t, data, append(read, rest...), "chunk size %d", chunkSize)
+
+		n, err := p.Read(make([]byte, 10))
+		require.Equal(t, 0, n)
+		require.ErrorIs(t, err, io.EOF)
+		require.NoError(t, p.Close())
+	}
+
+	// Errors are returned after the data read before them.
+	failure := errors.New("storage failure")
+	p := NewPrefetchReader(io.MultiReader(bytes.NewReader(data[:10]), iotest.ErrReader(failure)), 4)
+	read, err := io.ReadAll(p)
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, data[:10], read)
+
+	// A reader that isn't read to the end stops reading ahead when it is closed.
+	p = NewPrefetchReader(bytes.NewReader(data), 8)
+	_, err = p.Read(make([]byte, 4))
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.NoError(t, p.Close())
+}
+
+// openRecorder records which of a set of files have been opened.
+type openRecorder struct {
+	mu     sync.Mutex
+	opened map[int]bool
+	closed map[int]bool
+}
+
+type recordedFile struct {
+	io.Reader
+	recorder *openRecorder
+	i        int
+}
+
+func (f *recordedFile) Close() error {
+	f.recorder.mu.Lock()
+	defer f.recorder.mu.Unlock()
+	f.recorder.closed[f.i] = true
+	return nil
+}
+
+func (r *openRecorder) open(i int, contents string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.opened[i] = true
+		return &recordedFile{Reader: bytes.NewReader([]byte(contents)), recorder: r, i: i}, nil
+	}
+}
+
+func (r *openRecorder) count() (opened, closed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.opened), len(r.closed)
+}
+
+func TestPrefetchPipeline(t *testing.T) {
+	recorder := &openRecorder{opened: make(map[int]bool), closed: make(map[int]bool)}
+	pipeline := NewPrefetchPipeline(2)
+
+	// Like scp -r, every file is set up before any of them are read.
+	var files []io.Reader
+	for i := 0; i < 10; i++ {
+		p := NewPrefetchReader(NewLazyReader(recorder.open(i, fmt.Sprintf("file %d", i))), 4)
+		pipeline.Add(p)
+		files = append(files, p)
+	}
+
+	opened, _ := recorder.count()
+	require.Equal(t, 0, opened, "Nothing is opened until the first file is read")
+
+	contents, err := io.ReadAll(files[0])
+	require.NoError(t, err)
+	require.Equal(t, "file 0", string(contents))
+
+	// Reading the first file starts the next two.
+	require.Eventually(t, func() bool {
+		opened, _ := recorder.count()
+		return opened == 3
+	}, time.Second, time.Millisecond)
+
+	for i, f := range files[1:] {
+		contents, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("file %d", i+1), string(contents))
+	}
+
+	opened, closed := recorder.count()
+	require.Equal(t, 10, opened)
+	require.Equal(t, 10, closed, "Files are closed once they have been read")
+}
+
+func TestLazyReader(t *testing.T) {
+	recorder := &openRecorder{opened: make(map[int]bool), closed: make(map[int]bool)}
+
+	r := NewLazyReader(recorder.open(1, "contents"))
+	require.NoError(t, r.Close())
+	_, err := r.Read(make([]byte, 4))
+	require.ErrorIs(t, err, os.ErrClosed)
+	opened, _ := recorder.count()
+	require.Equal(t, 0, opened, "A reader closed before it is read is never opened")
+
+	r = NewLazyReader(recorder.open(2, "contents"))
+	_, err = r.Read(make([]byte, 4))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	_, closed := recorder.count()
+	require.Equal(t, 1, closed)
+
+	failure := errors.New("missing")
+	r = NewLazyReader(func() (io.ReadCloser, error) { return nil, failure })
+	_, err = r.Read(make([]byte, 4))
+	require.ErrorIs(t, err, failure)
+	require.NoError(t, r.Close())
+}
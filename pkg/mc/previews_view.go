@@ -0,0 +1,130 @@
+package mc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// PreviewsDirName is the name of the read-only virtual directory, in each directory of a project, that
+// holds the web previews of the directory's files made by the conversions queued through the
+// ConversionStore. A preview is named after its file with the extension of the preview's format, so the
+// JPEG of /my-project/raw/scan.tif is /my-project/raw/.previews/scan.tif.jpg, and the PDF of
+// /my-project/docs/notes.docx is /my-project/docs/.previews/notes.docx.pdf. Only the files that have been
+// converted are in it. It isn't shown in the listings of its directory.
+const PreviewsDirName = ".previews"
+
+// ConversionDirName is the directory, under the mcfs root, that the Materials Commons web application
+// writes converted files to, each named after the UUID of the file's data and the extension of its format.
+const ConversionDirName = "__conversion"
+
+// ErrPreviews is returned for attempts to change a PreviewsDirName.
+var ErrPreviews = fmt.Errorf("%w: %s is read-only", os.ErrPermission, PreviewsDirName)
+
+// ParsePreviewsPath splits path, a path in a project, into the directory whose PreviewsDirName it is in
+// and the name within that, which is blank for the PreviewsDirName itself. It returns true if path is in
+// a PreviewsDirName. The name has a '/' when path is below a preview, which doesn't exist.
+func ParsePreviewsPath(path string) (dir, name string, ok bool) {
+	path = cleanClientPath(path)
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if part == PreviewsDirName {
+			return filepath.Join("/", strings.Join(parts[:i], "/")), strings.Join(parts[i+1:], "/"), true
+		}
+	}
+
+	return path, "", false
+}
+
+// PreviewExt returns the extension of file's preview, or blank if it isn't converted.
+func PreviewExt(file *mcmodel.File) string {
+	switch {
+	case !file.IsConvertible():
+		return ""
+	case strings.HasPrefix(file.MimeType, "image/"):
+		return ".jpg"
+	default:
+		return ".pdf"
+	}
+}
+
+// ConvertedFilePath returns the path of file's converted data, or blank if it isn't converted. The file
+// doesn't exist until its conversion has run.
+func ConvertedFilePath(mcfsRoot string, file *mcmodel.File) string {
+	ext := PreviewExt(file)
+	if ext == "" {
+		return ""
+	}
+
+	return filepath.Join(mcfsRoot, ConversionDirName, file.UUIDForPath()+ext)
+}
+
+// ListPreviews returns the entries of the PreviewsDirName in the directory at dir, one for each file in
+// it that has been converted.
+func ListPreviews(stores *Stores, projectID int, dir, mcfsRoot string) ([]os.FileInfo, error) {
+	files, err := stores.FileStore.ListDirectoryByPath(projectID, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileInfos []os.FileInfo
+	for i := range files {
+		if fi, err := previewFileInfo(&files[i], mcfsRoot); err == nil {
+			fileInfos = append(fileInfos, fi)
+		}
+	}
+
+	return fileInfos, nil
+}
+
+// StatPreview returns the file that the preview named name, in the PreviewsDirName in the directory at
+// dir, is of, and the preview's entry. A blank name is the PreviewsDirName itself, which has no file.
+func StatPreview(stores *Stores, projectID int, dir, name, mcfsRoot string) (*mcmodel.File, os.FileInfo, error) {
+	d, err := stores.FileStore.GetDirByPath(projectID, dir)
+	if err != nil {
+		return nil, nil, os.ErrNotExist
+	}
+
+	if name == "" {
+		return nil, metadataViewFileInfo{FileInfo: d.ToFileInfo(), name: PreviewsDirName, mode: os.ModeDir | 0555}, nil
+	}
+
+	if strings.Contains(name, "/") {
+		return nil, nil, os.ErrNotExist
+	}
+
+	ext := filepath.Ext(name)
+	file, err := stores.FileStore.GetFileByPath(projectID, filepath.Join(dir, strings.TrimSuffix(name, ext)))
+	if err != nil || file.IsDir() || PreviewExt(file) != ext {
+		return nil, nil, os.ErrNotExist
+	}
+
+	fi, err := previewFileInfo(file, mcfsRoot)
+	if err != nil {
+		return nil, nil, os.ErrNotExist
+	}
+
+	return file, fi, nil
+}
+
+// previewFileInfo returns the entry for the preview of file, and an error if file hasn't been converted.
+func previewFileInfo(file *mcmodel.File, mcfsRoot string) (os.FileInfo, error) {
+	path := ConvertedFilePath(mcfsRoot, file)
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+
+	return metadataViewFileInfo{FileInfo: fi, name: file.Name + PreviewExt(file), size: fi.Size(), mode: 0444}, nil
+}
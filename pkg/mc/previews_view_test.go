@@ -0,0 +1,78 @@
+package mc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePreviewsPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		dir    string
+		name   string
+		inView bool
+	}{
+		{path: "/.previews", dir: "/", name: "", inView: true},
+		{path: "/raw/.previews/", dir: "/raw", name: "", inView: true},
+		{path: "/raw/.previews/a.tif.jpg", dir: "/raw", name: "a.tif.jpg", inView: true},
+		{path: "/raw/.previews/a.tif.jpg/b", dir: "/raw", name: "a.tif.jpg/b", inView: true},
+		{path: "/raw/a.tif", dir: "/raw/a.tif", name: "", inView: false},
+		{path: "/raw/.previews.old", dir: "/raw/.previews.old", name: "", inView: false},
+	}
+
+	for _, test := range tests {
+		dir, name, inView := ParsePreviewsPath(test.path)
+		require.Equal(t, test.dir, dir, test.path)
+		require.Equal(t, test.name, name, test.path)
+		require.Equal(t, test.inView, inView, test.path)
+	}
+}
+
+func TestPreviews(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo")
+	require.NoError(t, err)
+	project, err := stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+
+	_, err = stores.FileStore.GetOrCreateDirPath(project.ID, 1, "/raw")
+	require.NoError(t, err)
+	for _, path := range []string{"/raw/converted.tif", "/raw/waiting.tif", "/raw/notes.txt"} {
+		require.NoError(t, CreateFileWithContents(stores, project.ID, 1, path, []byte(path), mcfsRoot))
+	}
+
+	converted, err := stores.FileStore.GetFileByPath(project.ID, "/raw/converted.tif")
+	require.NoError(t, err)
+	require.Equal(t, "image/tiff", converted.MimeType)
+	require.NoError(t, os.MkdirAll(filepath.Join(mcfsRoot, ConversionDirName), 0755))
+	require.NoError(t, os.WriteFile(ConvertedFilePath(mcfsRoot, converted), []byte("jpeg"), 0644))
+
+	// Only the files that have been converted have previews.
+	fileInfos, err := ListPreviews(stores, project.ID, "/raw", mcfsRoot)
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 1)
+	require.Equal(t, "converted.tif.jpg", fileInfos[0].Name())
+	require.Equal(t, int64(4), fileInfos[0].Size())
+	require.Equal(t, os.FileMode(0444), fileInfos[0].Mode())
+
+	file, fi, err := StatPreview(stores, project.ID, "/raw", "converted.tif.jpg", mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, converted.ID, file.ID)
+	require.Equal(t, int64(4), fi.Size())
+
+	_, fi, err = StatPreview(stores, project.ID, "/raw", "", mcfsRoot)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, PreviewsDirName, fi.Name())
+
+	for _, name := range []string{"waiting.tif.jpg", "converted.tif.pdf", "converted.tif", "notes.txt.pdf", "converted.tif.jpg/x"} {
+		_, _, err = StatPreview(stores, project.ID, "/raw", name, mcfsRoot)
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+
+	_, _, err = StatPreview(stores, project.ID, "/missing", "", mcfsRoot)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,164 @@
+package mc
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// ProjectCreateStore creates new projects. gomcdb's ProjectStore doesn't support creating projects.
+type ProjectCreateStore interface {
+	// CreateProject creates a project, along with its team and root directory, owned by ownerID. It
+	// returns ErrProjectExists if a project with the slug already exists.
+	CreateProject(name, slug string, ownerID int) (*mcmodel.Project, error)
+}
+
+// ErrProjectExists is returned when creating a project whose slug is already taken. It wraps EEXIST so
+// that a mkdir of an existing project fails the way it would for an existing directory.
+var ErrProjectExists = fmt.Errorf("%w: project already exists", syscall.EEXIST)
+
+type GormProjectCreateStore struct {
+	db *gorm.DB
+}
+
+func NewGormProjectCreateStore(db *gorm.DB) *GormProjectCreateStore {
+	return &GormProjectCreateStore{db: db}
+}
+
+// team is the minimal part of a Materials Commons team needed to create one. Every project has a team,
+// and the project owner is the team's first admin.
+type team struct {
+	ID        int
+	UUID      string
+	Name      string
+	OwnerID   int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (team) TableName() string {
+	return "teams"
+}
+
+func (s *GormProjectCreateStore) CreateProject(name, slug string, ownerID int) (*mcmodel.Project, error) {
+	var project mcmodel.Project
+	err := store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&mcmodel.Project{}).Where("slug = ?", slug).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count != 0 {
+			return ErrProjectExists
+		}
+
+		t := team{Name: fmt.Sprintf("Team for %s", name), OwnerID: ownerID}
+		var err error
+		if t.UUID, err = uuid.GenerateUUID(); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&t).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec("INSERT INTO team2admin (team_id, user_id) VALUES (?, ?)", t.ID, ownerID).Error; err != nil {
+			return err
+		}
+
+		project = mcmodel.Project{Name: name, Slug: slug, OwnerID: ownerID, TeamID: t.ID, FileTypes: "{}"}
+		if project.UUID, err = uuid.GenerateUUID(); err != nil {
+			return err
+		}
+
+		if err := tx.Omit("Owner").Create(&project).Error; err != nil {
+			return err
+		}
+
+		root := mcmodel.File{
+			OwnerID:              ownerID,
+			MimeType:             "directory",
+			MediaTypeDescription: "directory",
+			Current:              true,
+			Path:                 "/",
+			Name:                 "/",
+			ProjectID:            project.ID,
+		}
+		if root.UUID, err = uuid.GenerateUUID(); err != nil {
+			return err
+		}
+
+		return tx.Omit("Directory").Create(&root).Error
+	}, s.db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// FakeProjectCreateStore is a ProjectCreateStore for testing. A slug is taken if ProjectStore has a project
+// with that slug, or it was already created. The created projects are recorded in Projects.
+type FakeProjectCreateStore struct {
+	ProjectStore store.ProjectStore
+	Projects     []mcmodel.Project
+}
+
+func NewFakeProjectCreateStore(projectStore store.ProjectStore) *FakeProjectCreateStore {
+	return &FakeProjectCreateStore{ProjectStore: projectStore}
+}
+
+func (s *FakeProjectCreateStore) CreateProject(name, slug string, ownerID int) (*mcmodel.Project, error) {
+	if _, err := s.ProjectStore.GetProjectBySlug(slug); err == nil {
+		return nil, ErrProjectExists
+	}
+
+	for _, p := range s.Projects {
+		if p.Slug == slug {
+			return nil, ErrProjectExists
+		}
+	}
+
+	project := mcmodel.Project{ID: 10000 + len(s.Projects), Name: name, Slug: slug, OwnerID: ownerID}
+	s.Projects = append(s.Projects, project)
+	return &project, nil
+}
+
+// ProjectSlugFromName creates a slug from a project name, in the style Materials Commons uses: lower
+// case, with each run of characters other than letters and digits replaced by a single dash.
+func ProjectSlugFromName(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() != 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	return b.String()
+}
+
+// CreateProjectFromName creates a project named name owned by ownerID. The slug is generated from the
+// name. If that slug is already taken, including by a project the user can't see, then ErrProjectExists
+// is returned, rather than creating a project under a slug the user didn't ask for.
+func CreateProjectFromName(stores *Stores, name string, ownerID int) (*mcmodel.Project, error) {
+	slug := ProjectSlugFromName(name)
+	if slug == "" {
+		return nil, fmt.Errorf("invalid project name '%s'", name)
+	}
+
+	return stores.ProjectCreateStore.CreateProject(name, slug, ownerID)
+}
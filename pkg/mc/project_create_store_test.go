@@ -0,0 +1,139 @@
+package mc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestProjectSlugFromName(t *testing.T) {
+	tests := []struct {
+		name         string
+		expectedSlug string
+	}{
+		{"my-project", "my-project"},
+		{"My Project", "my-project"},
+		{"  Beamline 7 -- run 2 ", "beamline-7-run-2"},
+		{"XRD_data.2022", "xrd-data-2022"},
+		{"---", ""},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expectedSlug, ProjectSlugFromName(test.name), "Wrong slug for name %q", test.name)
+	}
+}
+
+func TestCreateProjectFromName(t *testing.T) {
+	projectStore := store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "taken"}})
+	stores := &Stores{ProjectStore: projectStore, ProjectCreateStore: NewFakeProjectCreateStore(projectStore)}
+
+	project, err := CreateProjectFromName(stores, "New Project", 5)
+	require.NoError(t, err)
+	require.Equal(t, "new-project", project.Slug)
+	require.Equal(t, 5, project.OwnerID)
+
+	// A taken slug fails like mkdir of an existing directory, rather than creating a project under
+	// another slug.
+	_, err = CreateProjectFromName(stores, "taken", 5)
+	require.ErrorIs(t, err, ErrProjectExists)
+	require.ErrorIs(t, err, syscall.EEXIST)
+
+	_, err = CreateProjectFromName(stores, "New Project", 6)
+	require.ErrorIs(t, err, ErrProjectExists)
+
+	_, err = CreateProjectFromName(stores, "!!!", 5)
+	require.Error(t, err, "Names without letters or digits can't be used")
+}
+
+// txConnPool lets a dry run gorm.DB run transactions. Nothing is sent to a database.
+type txConnPool struct{}
+
+func (p *txConnPool) PrepareContext(_ context.Context, _ string) (*sql.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p *txConnPool) ExecContext(_ context.Context, _ string, _ ...interface{}) (sql.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p *txConnPool) QueryContext(_ context.Context, _ string, _ ...interface{}) (*sql.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p *txConnPool) QueryRowContext(_ context.Context, _ string, _ ...interface{}) *sql.Row {
+	return nil
+}
+
+func (p *txConnPool) BeginTx(_ context.Context, _ *sql.TxOptions) (gorm.ConnPool, error) {
+	return &txConn{}, nil
+}
+
+type txConn struct {
+	txConnPool
+}
+
+func (c *txConn) Commit() error   { return nil }
+func (c *txConn) Rollback() error { return nil }
+
+func TestGormProjectCreateStore(t *testing.T) {
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: &txConnPool{}, SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	require.NoError(t, err)
+
+	// existing is the count the slug lookup returns, and lookupErr the error it fails with.
+	var (
+		existing  int64
+		lookupErr error
+		tables    []string
+	)
+	require.NoError(t, db.Callback().Query().After("gorm:query").Register("test:slug", func(tx *gorm.DB) {
+		if count, ok := tx.Statement.Dest.(*int64); ok {
+			*count = existing
+			tx.RowsAffected = 1
+		}
+
+		if lookupErr != nil {
+			_ = tx.AddError(lookupErr)
+		}
+	}))
+	require.NoError(t, db.Callback().Create().After("gorm:create").Register("test:tables", func(tx *gorm.DB) {
+		tables = append(tables, tx.Statement.Table)
+	}))
+	require.NoError(t, db.Callback().Raw().After("gorm:raw").Register("test:raw", func(tx *gorm.DB) {
+		if sql := strings.Fields(tx.Statement.SQL.String()); sql[0] == "INSERT" {
+			tables = append(tables, sql[2])
+		}
+	}))
+
+	s := NewGormProjectCreateStore(db)
+
+	project, err := s.CreateProject("New Project", "new-project", 5)
+	require.NoError(t, err)
+	require.Equal(t, "new-project", project.Slug)
+	require.Equal(t, 5, project.OwnerID)
+	require.NotEmpty(t, project.UUID)
+	require.Equal(t, []string{"teams", "team2admin", "projects", "files"}, tables)
+
+	// A taken slug creates nothing.
+	tables = nil
+	existing = 1
+	_, err = s.CreateProject("Taken", "taken", 5)
+	require.ErrorIs(t, err, ErrProjectExists)
+	require.Empty(t, tables)
+
+	// A failed lookup is returned as is, it doesn't mean the slug is free or taken.
+	existing = 0
+	lookupErr = errors.New("connection refused")
+	_, err = s.CreateProject("New Project", "new-project", 5)
+	require.ErrorIs(t, err, lookupErr)
+	require.NotErrorIs(t, err, ErrProjectExists)
+	require.Empty(t, tables)
+}
@@ -0,0 +1,137 @@
+package mc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// ProjectExtractPathStore holds the directories of each project that archives are extracted in when they
+// are uploaded, for instruments that can only write archives. Project owners and admins opt directories in
+// with mc project set-extract-paths. A project without any extract paths has no archives extracted. See
+// UploadHookRunner.
+type ProjectExtractPathStore interface {
+	// GetExtractPaths returns the project's extract paths, or none if it hasn't opted in.
+	GetExtractPaths(projectID int) ([]string, error)
+
+	// SetExtractPaths replaces the project's extract paths. Setting no paths opts the project out.
+	SetExtractPaths(projectID int, paths []string) error
+}
+
+// EventProjectExtractPaths is the Event.Type for a change to the directories a project has archives
+// extracted in.
+const EventProjectExtractPaths = "project.extract-paths"
+
+// ParseExtractPaths cleans each of the project paths in paths, which have to be absolute.
+func ParseExtractPaths(paths []string) ([]string, error) {
+	var cleaned []string
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid extract path '%s', expected a path in the project such as /incoming", path)
+		}
+		cleaned = append(cleaned, filepath.Clean(path))
+	}
+
+	return cleaned, nil
+}
+
+// InExtractPath returns true if path, a path in a project, is in one of the project's extractPaths.
+func InExtractPath(extractPaths []string, path string) bool {
+	path = filepath.Clean("/" + path)
+	for _, extractPath := range extractPaths {
+		if extractPath == "/" || strings.HasPrefix(path, extractPath+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+type GormProjectExtractPathStore struct {
+	db *gorm.DB
+}
+
+func NewGormProjectExtractPathStore(db *gorm.DB) *GormProjectExtractPathStore {
+	return &GormProjectExtractPathStore{db: db}
+}
+
+// projectExtractPath is a row in the project_extract_paths table, which mc-sshd adds to the Materials
+// Commons database:
+//
+//	CREATE TABLE project_extract_paths (
+//	    id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    path VARCHAR(4096) NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    updated_at TIMESTAMP NULL,
+//	    INDEX (project_id)
+//	);
+type projectExtractPath struct {
+	ID        int
+	ProjectID int
+	Path      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (projectExtractPath) TableName() string {
+	return "project_extract_paths"
+}
+
+func (s *GormProjectExtractPathStore) GetExtractPaths(projectID int) ([]string, error) {
+	var rows []projectExtractPath
+	if err := s.db.Where("project_id = ?", projectID).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, row := range rows {
+		paths = append(paths, row.Path)
+	}
+
+	return paths, nil
+}
+
+func (s *GormProjectExtractPathStore) SetExtractPaths(projectID int, paths []string) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		if err := tx.Where("project_id = ?", projectID).Delete(&projectExtractPath{}).Error; err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			if err := tx.Create(&projectExtractPath{ProjectID: projectID, Path: path}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, s.db)
+}
+
+// FakeProjectExtractPathStore is a ProjectExtractPathStore for testing. The extract paths for each project
+// are recorded in Paths, keyed by the project ID.
+type FakeProjectExtractPathStore struct {
+	Paths map[int][]string
+}
+
+func NewFakeProjectExtractPathStore() *FakeProjectExtractPathStore {
+	return &FakeProjectExtractPathStore{Paths: make(map[int][]string)}
+}
+
+func (s *FakeProjectExtractPathStore) GetExtractPaths(projectID int) ([]string, error) {
+	return s.Paths[projectID], nil
+}
+
+func (s *FakeProjectExtractPathStore) SetExtractPaths(projectID int, paths []string) error {
+	if len(paths) == 0 {
+		delete(s.Paths, projectID)
+		return nil
+	}
+
+	s.Paths[projectID] = paths
+	return nil
+}
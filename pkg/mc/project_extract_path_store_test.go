@@ -0,0 +1,36 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExtractPaths(t *testing.T) {
+	paths, err := ParseExtractPaths([]string{"/incoming/", "/raw//xrd"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/incoming", "/raw/xrd"}, paths)
+
+	_, err = ParseExtractPaths([]string{"incoming"})
+	require.Error(t, err)
+}
+
+func TestInExtractPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"/incoming/run1.zip", true},
+		{"/incoming/sub/run1.tar.gz", true},
+		{"/incoming2/run1.zip", false},
+		{"/run1.zip", false},
+		{"/raw/xrd/run1.zip", true},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expected, InExtractPath([]string{"/incoming", "/raw/xrd"}, test.path), test.path)
+	}
+
+	require.True(t, InExtractPath([]string{"/"}, "/run1.zip"), "The project root holds every path")
+	require.False(t, InExtractPath(nil, "/run1.zip"))
+}
@@ -0,0 +1,168 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// ProjectMember is a user on a project's team. Admins can manage the project's members.
+type ProjectMember struct {
+	User  mcmodel.User
+	Admin bool
+}
+
+// ProjectMemberStore manages the members of projects, which are the users on the project's team.
+// gomcdb's ProjectStore can only check whether a user can access a project.
+type ProjectMemberStore interface {
+	// ListProjectMembers returns the members of the project, admins first.
+	ListProjectMembers(project *mcmodel.Project) ([]ProjectMember, error)
+
+	// AddProjectMember adds user to the project, as an admin if admin is true. A member can be made an
+	// admin by adding them again. It returns ErrAlreadyMember if the user is already a member, or is
+	// already an admin.
+	AddProjectMember(project *mcmodel.Project, user *mcmodel.User, admin bool) error
+}
+
+// EventProjectMember is the Event.Type for an attempt to add a member to a project. It is emitted whether
+// or not the member was added.
+const EventProjectMember = "project.member"
+
+// ErrAlreadyMember is returned when adding a user to a project they are already a member of.
+var ErrAlreadyMember = errors.New("the user is already a member of the project")
+
+// ErrNotProjectAdmin is returned when a user who isn't the project's owner or an admin tries to manage
+// its members or networks. It wraps os.ErrPermission.
+var ErrNotProjectAdmin = fmt.Errorf("%w: only the project's owner and admins can manage its members and networks", os.ErrPermission)
+
+type GormProjectMemberStore struct {
+	db *gorm.DB
+}
+
+func NewGormProjectMemberStore(db *gorm.DB) *GormProjectMemberStore {
+	return &GormProjectMemberStore{db: db}
+}
+
+func (s *GormProjectMemberStore) ListProjectMembers(project *mcmodel.Project) ([]ProjectMember, error) {
+	var admins, members []mcmodel.User
+	err := s.db.Where("id in (select user_id from team2admin where team_id = ?)", project.TeamID).
+		Order("slug").
+		Find(&admins).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Where("id in (select user_id from team2member where team_id = ?)", project.TeamID).
+		Where("id not in (select user_id from team2admin where team_id = ?)", project.TeamID).
+		Order("slug").
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var projectMembers []ProjectMember
+	for _, user := range admins {
+		projectMembers = append(projectMembers, ProjectMember{User: user, Admin: true})
+	}
+
+	for _, user := range members {
+		projectMembers = append(projectMembers, ProjectMember{User: user})
+	}
+
+	return projectMembers, nil
+}
+
+func (s *GormProjectMemberStore) AddProjectMember(project *mcmodel.Project, user *mcmodel.User, admin bool) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		var adminCount, memberCount int64
+		err := tx.Table("team2admin").Where("team_id = ?", project.TeamID).Where("user_id = ?", user.ID).Count(&adminCount).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Table("team2member").Where("team_id = ?", project.TeamID).Where("user_id = ?", user.ID).Count(&memberCount).Error
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case adminCount != 0, memberCount != 0 && !admin:
+			return ErrAlreadyMember
+		case !admin:
+			return tx.Exec("INSERT INTO team2member (team_id, user_id) VALUES (?, ?)", project.TeamID, user.ID).Error
+		}
+
+		// A member being made an admin is moved from team2member to team2admin.
+		if err := tx.Exec("DELETE FROM team2member WHERE team_id = ? AND user_id = ?", project.TeamID, user.ID).Error; err != nil {
+			return err
+		}
+
+		return tx.Exec("INSERT INTO team2admin (team_id, user_id) VALUES (?, ?)", project.TeamID, user.ID).Error
+	}, s.db)
+}
+
+// FakeProjectMemberStore is a ProjectMemberStore for testing. The members of each project are recorded
+// in Members, keyed by the project ID.
+type FakeProjectMemberStore struct {
+	Members map[int][]ProjectMember
+}
+
+func NewFakeProjectMemberStore() *FakeProjectMemberStore {
+	return &FakeProjectMemberStore{Members: make(map[int][]ProjectMember)}
+}
+
+func (s *FakeProjectMemberStore) ListProjectMembers(project *mcmodel.Project) ([]ProjectMember, error) {
+	var admins, members []ProjectMember
+	for _, member := range s.Members[project.ID] {
+		if member.Admin {
+			admins = append(admins, member)
+		} else {
+			members = append(members, member)
+		}
+	}
+
+	return append(admins, members...), nil
+}
+
+func (s *FakeProjectMemberStore) AddProjectMember(project *mcmodel.Project, user *mcmodel.User, admin bool) error {
+	for i, member := range s.Members[project.ID] {
+		if member.User.ID != user.ID {
+			continue
+		}
+
+		if member.Admin || !admin {
+			return ErrAlreadyMember
+		}
+
+		s.Members[project.ID][i].Admin = true
+		return nil
+	}
+
+	s.Members[project.ID] = append(s.Members[project.ID], ProjectMember{User: *user, Admin: admin})
+	return nil
+}
+
+// CanManageProjectMembers returns true if user can add members to the project, which the project's
+// owner and admins can.
+func CanManageProjectMembers(stores *Stores, project *mcmodel.Project, user *mcmodel.User) (bool, error) {
+	if project.OwnerID == user.ID {
+		return true, nil
+	}
+
+	members, err := stores.ProjectMemberStore.ListProjectMembers(project)
+	if err != nil {
+		return false, err
+	}
+
+	for _, member := range members {
+		if member.User.ID == user.ID {
+			return member.Admin, nil
+		}
+	}
+
+	return false, nil
+}
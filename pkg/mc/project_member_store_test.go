@@ -0,0 +1,46 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanManageProjectMembers(t *testing.T) {
+	project := &mcmodel.Project{ID: 1, OwnerID: 1}
+	owner := &mcmodel.User{ID: 1, Slug: "owner"}
+	admin := &mcmodel.User{ID: 2, Slug: "admin"}
+	member := &mcmodel.User{ID: 3, Slug: "member"}
+	outsider := &mcmodel.User{ID: 4, Slug: "outsider"}
+
+	memberStore := NewFakeProjectMemberStore()
+	stores := &Stores{ProjectMemberStore: memberStore}
+	require.NoError(t, memberStore.AddProjectMember(project, member, false))
+	require.NoError(t, memberStore.AddProjectMember(project, admin, false))
+	require.ErrorIs(t, memberStore.AddProjectMember(project, admin, false), ErrAlreadyMember)
+
+	// Adding a member again as an admin makes them an admin.
+	require.NoError(t, memberStore.AddProjectMember(project, admin, true))
+	require.ErrorIs(t, memberStore.AddProjectMember(project, admin, true), ErrAlreadyMember)
+
+	members, err := memberStore.ListProjectMembers(project)
+	require.NoError(t, err)
+	require.Equal(t, []ProjectMember{{User: *admin, Admin: true}, {User: *member}}, members)
+
+	tests := []struct {
+		user      *mcmodel.User
+		canManage bool
+	}{
+		{owner, true},
+		{admin, true},
+		{member, false},
+		{outsider, false},
+	}
+
+	for _, test := range tests {
+		canManage, err := CanManageProjectMembers(stores, project, test.user)
+		require.NoError(t, err)
+		require.Equal(t, test.canManage, canManage, test.user.Slug)
+	}
+}
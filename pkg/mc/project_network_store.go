@@ -0,0 +1,233 @@
+package mc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// ProjectNetworkStore holds the networks that a project can be accessed from. Project owners and admins
+// use it to limit a project to, for example, the subnet its instruments are on. A project without any
+// networks can be accessed from anywhere.
+type ProjectNetworkStore interface {
+	// GetProjectNetworks returns the networks the project can be accessed from, or none if it isn't
+	// restricted.
+	GetProjectNetworks(projectID int) ([]*net.IPNet, error)
+
+	// GetNetworksForProjects returns the networks of each of the projects that is restricted, keyed by
+	// the project ID, in one lookup. A project with networks that can't be parsed is returned with none,
+	// which doesn't allow anything.
+	GetNetworksForProjects(projectIDs []int) (map[int][]*net.IPNet, error)
+
+	// SetProjectNetworks replaces the networks the project can be accessed from. Setting no networks
+	// removes the restriction.
+	SetProjectNetworks(projectID int, networks []*net.IPNet) error
+}
+
+// EventProjectNetworks is the Event.Type for a change to the networks a project can be accessed from.
+const EventProjectNetworks = "project.networks"
+
+// ErrNetworkRestricted is returned when a project is accessed from outside of the networks it is
+// restricted to. It wraps os.ErrPermission.
+var ErrNetworkRestricted = fmt.Errorf("%w: access restricted by network policy", os.ErrPermission)
+
+type GormProjectNetworkStore struct {
+	db *gorm.DB
+}
+
+func NewGormProjectNetworkStore(db *gorm.DB) *GormProjectNetworkStore {
+	return &GormProjectNetworkStore{db: db}
+}
+
+// projectNetwork is a row in the project_networks table, which mc-sshd adds to the Materials Commons
+// database:
+//
+//	CREATE TABLE project_networks (
+//	    id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    cidr VARCHAR(64) NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    updated_at TIMESTAMP NULL,
+//	    INDEX (project_id)
+//	);
+type projectNetwork struct {
+	ID        int
+	ProjectID int
+	CIDR      string `gorm:"column:cidr"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (projectNetwork) TableName() string {
+	return "project_networks"
+}
+
+func (s *GormProjectNetworkStore) GetProjectNetworks(projectID int) ([]*net.IPNet, error) {
+	var rows []projectNetwork
+	if err := s.db.Where("project_id = ?", projectID).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var networks []*net.IPNet
+	for _, row := range rows {
+		_, network, err := net.ParseCIDR(row.CIDR)
+		if err != nil {
+			// A network that can't be parsed doesn't allow anything, so the project stays restricted.
+			log.Errorf("Invalid network %q for project %d: %s", row.CIDR, projectID, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	if len(rows) != 0 && len(networks) == 0 {
+		return nil, fmt.Errorf("project %d has no valid networks", projectID)
+	}
+
+	return networks, nil
+}
+
+func (s *GormProjectNetworkStore) GetNetworksForProjects(projectIDs []int) (map[int][]*net.IPNet, error) {
+	networks := make(map[int][]*net.IPNet)
+	if len(projectIDs) == 0 {
+		return networks, nil
+	}
+
+	var rows []projectNetwork
+	if err := s.db.Where("project_id in ?", projectIDs).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		// The project is restricted even when none of its networks can be parsed.
+		restricted := networks[row.ProjectID]
+		_, network, err := net.ParseCIDR(row.CIDR)
+		if err != nil {
+			log.Errorf("Invalid network %q for project %d: %s", row.CIDR, row.ProjectID, err)
+		} else {
+			restricted = append(restricted, network)
+		}
+		networks[row.ProjectID] = restricted
+	}
+
+	return networks, nil
+}
+
+func (s *GormProjectNetworkStore) SetProjectNetworks(projectID int, networks []*net.IPNet) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		if err := tx.Where("project_id = ?", projectID).Delete(&projectNetwork{}).Error; err != nil {
+			return err
+		}
+
+		for _, network := range networks {
+			if err := tx.Create(&projectNetwork{ProjectID: projectID, CIDR: network.String()}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, s.db)
+}
+
+// FakeProjectNetworkStore is a ProjectNetworkStore for testing. The networks for each project are
+// recorded in Networks, keyed by the project ID.
+type FakeProjectNetworkStore struct {
+	Networks map[int][]*net.IPNet
+}
+
+func NewFakeProjectNetworkStore() *FakeProjectNetworkStore {
+	return &FakeProjectNetworkStore{Networks: make(map[int][]*net.IPNet)}
+}
+
+func (s *FakeProjectNetworkStore) GetProjectNetworks(projectID int) ([]*net.IPNet, error) {
+	return s.Networks[projectID], nil
+}
+
+func (s *FakeProjectNetworkStore) GetNetworksForProjects(projectIDs []int) (map[int][]*net.IPNet, error) {
+	networks := make(map[int][]*net.IPNet)
+	for _, projectID := range projectIDs {
+		if n, ok := s.Networks[projectID]; ok {
+			networks[projectID] = n
+		}
+	}
+
+	return networks, nil
+}
+
+func (s *FakeProjectNetworkStore) SetProjectNetworks(projectID int, networks []*net.IPNet) error {
+	if len(networks) == 0 {
+		delete(s.Networks, projectID)
+		return nil
+	}
+
+	s.Networks[projectID] = networks
+	return nil
+}
+
+// ParseNetworks parses a list of CIDRs, such as 10.1.2.0/24. A single address, such as 10.1.2.3, is
+// treated as a network holding only that address.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s'", cidr)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// NetworksContain returns true if addr is in one of networks.
+func NetworksContain(networks []*net.IPNet, addr net.Addr) bool {
+	ip := net.ParseIP(remoteHost(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckProjectNetwork returns ErrNetworkRestricted if the project is restricted to networks that
+// remoteAddr isn't in. Projects can't be restricted when there is no ProjectNetworkStore.
+func CheckProjectNetwork(stores *Stores, project *mcmodel.Project, remoteAddr net.Addr) error {
+	if stores.ProjectNetworkStore == nil {
+		return nil
+	}
+
+	networks, err := stores.ProjectNetworkStore.GetProjectNetworks(project.ID)
+	if err != nil {
+		log.Errorf("Unable to get the networks for project %d: %s", project.ID, err)
+		return err
+	}
+
+	if len(networks) == 0 || NetworksContain(networks, remoteAddr) {
+		return nil
+	}
+
+	log.Infof("Denying access to project %d (%s) from %s: not in the project's networks", project.ID, project.Slug, remoteAddr)
+	return fmt.Errorf("%w: %s", ErrNetworkRestricted, project.Slug)
+}
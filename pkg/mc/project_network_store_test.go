@@ -0,0 +1,63 @@
+package mc
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAndValidateProjectForClient(t *testing.T) {
+	networkStore := NewFakeProjectNetworkStore()
+	stores := &Stores{
+		ProjectStore:        store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "instrument"}, {ID: 2, Slug: "open"}}),
+		ProjectNetworkStore: networkStore,
+	}
+
+	networks, err := ParseNetworks([]string{"10.1.2.0/24", " 192.168.7.9 ", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.NoError(t, networkStore.SetProjectNetworks(1, networks))
+
+	tests := []struct {
+		path       string
+		remoteAddr string
+		err        error
+	}{
+		{"/instrument/raw/a.tif", "10.1.2.50:40000", nil},
+		{"/instrument/raw/a.tif", "192.168.7.9:40000", nil},
+		{"/instrument/raw/a.tif", "[2001:db8::5]:40000", nil},
+		{"/instrument/raw/a.tif", "192.168.7.10:40000", ErrNetworkRestricted},
+		{"/instrument/raw/a.tif", "10.1.3.50:40000", ErrNetworkRestricted},
+		{"/open/a.txt", "10.1.3.50:40000", nil},
+		{"/missing/a.txt", "10.1.2.50:40000", ErrProjectNotFound},
+	}
+
+	for _, test := range tests {
+		remoteAddr, err := net.ResolveTCPAddr("tcp", test.remoteAddr)
+		require.NoError(t, err)
+
+		_, err = GetAndValidateProjectForClient(test.path, 1, remoteAddr, stores)
+		if test.err == nil {
+			require.NoError(t, err, "%s from %s", test.path, test.remoteAddr)
+			continue
+		}
+		require.ErrorIs(t, err, test.err, "%s from %s", test.path, test.remoteAddr)
+	}
+
+	// The restriction is a permission error, but not one that hides the project.
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.1.3.50"), Port: 40000}
+	_, err = GetAndValidateProjectForClient("/instrument", 1, remoteAddr, stores)
+	require.ErrorIs(t, err, os.ErrPermission)
+	require.NotErrorIs(t, err, ErrProjectNotFound)
+
+	// Removing the networks removes the restriction.
+	require.NoError(t, networkStore.SetProjectNetworks(1, nil))
+	_, err = GetAndValidateProjectForClient("/instrument", 1, remoteAddr, stores)
+	require.NoError(t, err)
+
+	_, err = ParseNetworks([]string{"10.1.2.0/33"})
+	require.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package mc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProjectQuotas are the number of bytes, for each project keyed by slug, the project may use. The "*"
+// quota applies to the projects without their own. A quota of 0 means no quota.
+type ProjectQuotas map[string]int64
+
+// ParseProjectQuotas parses a comma separated list of project-slug=bytes, where a project-slug of * applies
+// to every other project, for example "instrument-data=10000000000000,*=1000000000000".
+func ParseProjectQuotas(quotas string) (ProjectQuotas, error) {
+	projectQuotas := make(ProjectQuotas)
+	for _, quota := range strings.Split(quotas, ",") {
+		quota = strings.TrimSpace(quota)
+		if quota == "" {
+			continue
+		}
+
+		i := strings.Index(quota, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid project quota '%s', expected project-slug=bytes", quota)
+		}
+
+		n, err := strconv.ParseInt(quota[i+1:], 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid project quota '%s': bad size", quota)
+		}
+
+		projectQuotas[quota[:i]] = n
+	}
+
+	return projectQuotas, nil
+}
+
+// For returns the quota of the project with projectSlug, and whether there is one for it.
+func (q ProjectQuotas) For(projectSlug string) (int64, bool) {
+	if n, ok := q[projectSlug]; ok {
+		return n, true
+	}
+
+	n, ok := q["*"]
+	return n, ok
+}
+
+// QuotaFor returns the number of bytes the project with projectSlug may use. It is the project's quota in
+// ProjectQuotas, falling back to ProjectQuota. 0 means no quota.
+func (c *Config) QuotaFor(projectSlug string) int64 {
+	if n, ok := c.ProjectQuotas.For(projectSlug); ok {
+		return n
+	}
+
+	return c.ProjectQuota
+}
@@ -0,0 +1,39 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProjectQuotas(t *testing.T) {
+	quotas, err := ParseProjectQuotas("instrument-data=1000, *=100,unlimited=0")
+	require.NoError(t, err)
+
+	n, ok := quotas.For("instrument-data")
+	require.True(t, ok)
+	require.Equal(t, int64(1000), n)
+
+	n, ok = quotas.For("other")
+	require.True(t, ok)
+	require.Equal(t, int64(100), n)
+
+	n, ok = quotas.For("unlimited")
+	require.True(t, ok)
+	require.Equal(t, int64(0), n)
+
+	for _, quotas := range []string{"=100", "proj", "proj=big", "proj=-1"} {
+		_, err := ParseProjectQuotas(quotas)
+		require.Error(t, err, quotas)
+	}
+}
+
+func TestConfigQuotaFor(t *testing.T) {
+	config := &Config{ProjectQuota: 500, ProjectQuotas: ProjectQuotas{"instrument-data": 1000, "unlimited": 0}}
+	require.Equal(t, int64(1000), config.QuotaFor("instrument-data"))
+	require.Equal(t, int64(0), config.QuotaFor("unlimited"))
+	require.Equal(t, int64(500), config.QuotaFor("other"))
+
+	config.ProjectQuotas["*"] = 200
+	require.Equal(t, int64(200), config.QuotaFor("other"))
+}
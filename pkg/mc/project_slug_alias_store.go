@@ -0,0 +1,132 @@
+package mc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ProjectSlugAlias is an old slug of a project, which still resolves to the project after it has been
+// renamed, so that bookmarks and scripts using the old slug keep working.
+type ProjectSlugAlias struct {
+	Slug      string `gorm:"primaryKey"`
+	ProjectID int
+	CreatedAt time.Time
+}
+
+// ProjectSlugAliasStore holds the old slugs of renamed projects. The aliases are kept in the
+// project_slug_aliases table, which mc-sshd adds to the Materials Commons database:
+//
+//	CREATE TABLE project_slug_aliases (
+//	    slug VARCHAR(255) PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    INDEX (project_id)
+//	);
+type ProjectSlugAliasStore interface {
+	// GetProjectIDForSlugAlias returns the id of the project that slug is an alias of. It returns
+	// gorm.ErrRecordNotFound if slug isn't an alias.
+	GetProjectIDForSlugAlias(slug string) (int, error)
+
+	// AddProjectSlugAlias makes slug an alias of the project. An existing alias with the same slug is
+	// pointed at the project.
+	AddProjectSlugAlias(slug string, projectID int) error
+}
+
+// ErrSlugInUse is returned when adding an alias that is the current slug of a project.
+var ErrSlugInUse = errors.New("the slug is in use by a project")
+
+func (ProjectSlugAlias) TableName() string {
+	return "project_slug_aliases"
+}
+
+type GormProjectSlugAliasStore struct {
+	db *gorm.DB
+}
+
+func NewGormProjectSlugAliasStore(db *gorm.DB) *GormProjectSlugAliasStore {
+	return &GormProjectSlugAliasStore{db: db}
+}
+
+func (s *GormProjectSlugAliasStore) GetProjectIDForSlugAlias(slug string) (int, error) {
+	var alias ProjectSlugAlias
+	if err := s.db.Where("slug = ?", slug).First(&alias).Error; err != nil {
+		return 0, err
+	}
+
+	return alias.ProjectID, nil
+}
+
+func (s *GormProjectSlugAliasStore) AddProjectSlugAlias(slug string, projectID int) error {
+	var count int64
+	if err := s.db.Model(&mcmodel.Project{}).Where("slug = ?", slug).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count != 0 {
+		return ErrSlugInUse
+	}
+
+	alias := ProjectSlugAlias{Slug: slug, ProjectID: projectID, CreatedAt: time.Now()}
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&alias).Error
+}
+
+// FakeProjectSlugAliasStore is a ProjectSlugAliasStore for testing. The aliases are kept in Aliases, which
+// maps each alias to its project id.
+type FakeProjectSlugAliasStore struct {
+	Aliases map[string]int
+}
+
+func NewFakeProjectSlugAliasStore() *FakeProjectSlugAliasStore {
+	return &FakeProjectSlugAliasStore{Aliases: make(map[string]int)}
+}
+
+func (s *FakeProjectSlugAliasStore) GetProjectIDForSlugAlias(slug string) (int, error) {
+	projectID, ok := s.Aliases[slug]
+	if !ok {
+		return 0, gorm.ErrRecordNotFound
+	}
+
+	return projectID, nil
+}
+
+func (s *FakeProjectSlugAliasStore) AddProjectSlugAlias(slug string, projectID int) error {
+	s.Aliases[slug] = projectID
+	return nil
+}
+
+// GetProjectBySlugOrAlias returns the project with slug. When no project has the slug, and it is an old
+// slug of a renamed project, the renamed project is returned with a deprecation warning logged. The
+// returned project then has the old slug as its Slug, since the paths the client sends start with the old
+// slug, and the project's slug is removed from them with RemoveProjectSlugFromPath.
+func GetProjectBySlugOrAlias(stores *Stores, slug string) (*mcmodel.Project, error) {
+	project, err := stores.ProjectStore.GetProjectBySlug(slug)
+	if err == nil || stores.ProjectSlugAliasStore == nil || slug == "" {
+		return project, err
+	}
+
+	projectID, aliasErr := stores.ProjectSlugAliasStore.GetProjectIDForSlugAlias(slug)
+	if aliasErr != nil {
+		if !errors.Is(aliasErr, gorm.ErrRecordNotFound) {
+			log.Errorf("Unable to look up slug alias %s: %s", slug, aliasErr)
+			return nil, aliasErr
+		}
+		return nil, err
+	}
+
+	renamed, err := stores.ProjectStore.GetProjectByID(projectID)
+	if err != nil {
+		log.Errorf("Unable to find project %d for slug alias %s: %s", projectID, slug, err)
+		return nil, err
+	}
+
+	log.Warnf("Project %d was accessed by its old slug %s, its slug is now %s", renamed.ID, slug, renamed.Slug)
+
+	aliased := *renamed
+	aliased.Slug = slug
+	return &aliased, nil
+}
@@ -0,0 +1,52 @@
+package mc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAndValidateProjectForClient_SlugAlias(t *testing.T) {
+	aliasStore := NewFakeProjectSlugAliasStore()
+	stores := &Stores{
+		ProjectStore:          store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "renamed"}, {ID: 2, Slug: "other"}}),
+		ProjectSlugAliasStore: aliasStore,
+	}
+	require.NoError(t, aliasStore.AddProjectSlugAlias("original", 1))
+
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.50"), Port: 40000}
+	tests := []struct {
+		path string
+		id   int
+		slug string
+		err  error
+	}{
+		{"/renamed/raw/a.tif", 1, "renamed", nil},
+		{"/original/raw/a.tif", 1, "original", nil},
+		{"/other/raw/a.tif", 2, "other", nil},
+		{"/missing/a.txt", 0, "", ErrProjectNotFound},
+	}
+
+	for _, test := range tests {
+		project, err := GetAndValidateProjectForClient(test.path, 1, remoteAddr, stores)
+		if test.err != nil {
+			require.ErrorIs(t, err, test.err, test.path)
+			continue
+		}
+
+		require.NoError(t, err, test.path)
+		require.Equal(t, test.id, project.ID, test.path)
+
+		// The project has the slug the client used, so that it is removed from the client's paths.
+		require.Equal(t, test.slug, project.Slug, test.path)
+		require.Equal(t, "/raw/a.tif", RemoveProjectSlugFromPath(test.path, project.Slug), test.path)
+	}
+
+	// Without an alias store only current slugs resolve.
+	stores.ProjectSlugAliasStore = nil
+	_, err := GetAndValidateProjectForClient("/original", 1, remoteAddr, stores)
+	require.ErrorIs(t, err, ErrProjectNotFound)
+}
@@ -0,0 +1,248 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// EventPull is the Event.Type for each attempt to pull a file into a project from a URL.
+const EventPull = "project.pull"
+
+// DefaultS3Endpoint is the default Puller.S3Endpoint.
+const DefaultS3Endpoint = "https://s3.amazonaws.com"
+
+// ErrPullNotAllowed is returned for a URL, or a redirect, that isn't in one of the sources the server is
+// allowed to pull from.
+var ErrPullNotAllowed = fmt.Errorf("%w: the server isn't allowed to pull from this URL", os.ErrPermission)
+
+// PullSource is a place the server is allowed to pull data from. A URL is in the source when it has the
+// source's scheme and host, and its path starts with the source's path. A host that starts with "*." also
+// matches its subdomains.
+type PullSource struct {
+	Scheme string
+	Host   string
+	Path   string
+}
+
+// pullSchemes are the URL schemes that can be pulled from.
+var pullSchemes = map[string]bool{"http": true, "https": true, "s3": true}
+
+// ParsePullSources parses a comma separated list of URLs that the server is allowed to pull from, for
+// example "https://data.example.org/shared/,https://*.hpc.example.edu,s3://beamline-data".
+func ParsePullSources(sources string) ([]PullSource, error) {
+	var parsed []PullSource
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+
+		u, err := url.Parse(source)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("invalid pull source '%s': %w", source, err)
+		case !pullSchemes[u.Scheme]:
+			return nil, fmt.Errorf("invalid pull source '%s': the scheme must be http, https or s3", source)
+		case u.Host == "":
+			return nil, fmt.Errorf("invalid pull source '%s': missing host", source)
+		}
+
+		parsed = append(parsed, PullSource{Scheme: u.Scheme, Host: strings.ToLower(u.Host), Path: u.Path})
+	}
+
+	return parsed, nil
+}
+
+// Match returns true if u is in the source.
+func (s PullSource) Match(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	switch {
+	case u.Scheme != s.Scheme:
+		return false
+	case strings.HasPrefix(s.Host, "*."):
+		if !strings.HasSuffix(host, s.Host[1:]) {
+			return false
+		}
+	case host != s.Host:
+		return false
+	}
+
+	// The path must be below the source's path, not just start with the same characters.
+	p := path.Clean("/" + u.Path)
+	prefix := strings.TrimSuffix(s.Path, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// Puller fetches data from URLs straight into projects, so that a large dataset on a cluster's scratch
+// space or in an object store doesn't have to be relayed through a user's laptop. Only the URLs in its
+// sources can be pulled from, and each redirect is checked against them too. http and https URLs are
+// fetched as they are. An s3://bucket/key URL is fetched, unsigned, from S3Endpoint as
+// S3Endpoint/bucket/key, so the bucket has to let the server read it, which suits public buckets and the
+// object stores of local clusters. Globus transfers aren't supported, but a Globus collection that serves
+// its files over https can be pulled from with its https URL.
+type Puller struct {
+	sources []PullSource
+	locker  PathLocker
+	client  *http.Client
+
+	// S3Endpoint is the URL s3:// URLs are fetched from.
+	S3Endpoint string
+}
+
+// NewPuller creates a Puller that can pull from sources. Each file is locked with locker while it is
+// written, like an upload.
+func NewPuller(sources []PullSource, locker PathLocker) *Puller {
+	p := &Puller{sources: sources, locker: locker, S3Endpoint: DefaultS3Endpoint}
+
+	// There is no overall timeout, since pulls can be very large. They are stopped by cancelling the
+	// context passed to Pull.
+	p.client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			if !p.Allowed(req.URL) {
+				return fmt.Errorf("redirect to %s: %w", req.URL.Redacted(), ErrPullNotAllowed)
+			}
+
+			return nil
+		},
+	}
+
+	return p
+}
+
+// Allowed returns true if u is in one of the Puller's sources.
+func (p *Puller) Allowed(u *url.URL) bool {
+	for _, source := range p.sources {
+		if source.Match(u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pull fetches the data at rawURL into a new version of the file at path in project, owned by ownerID. If
+// path is a directory, or ends in a slash, the file is named after the last element of the URL's path.
+// The directories the file is in are created, and the same rules are applied to the path as to uploads:
+// sanitizing, path limits, overwrite protection and the project quota. It returns the file created, and
+// its path.
+func (p *Puller) Pull(ctx context.Context, stores *Stores, config *Config, project *mcmodel.Project, ownerID int, rawURL, filePath, mcfsRoot string) (*mcmodel.File, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid URL: %w", err)
+	}
+
+	// The URL is checked and fetched with its path cleaned, so that ".." can't climb out of a source.
+	if u.Path != "" {
+		u.Path, u.RawPath = path.Clean(u.Path), ""
+	}
+
+	if !pullSchemes[u.Scheme] || !p.Allowed(u) {
+		return nil, "", ErrPullNotAllowed
+	}
+
+	if strings.HasSuffix(filePath, "/") || isDir(stores, project.ID, filePath) {
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return nil, "", fmt.Errorf("unable to name the file after '%s', give a file path", rawURL)
+		}
+		filePath = filepath.Join(filePath, name)
+	}
+
+	filePath, err = SanitizePath(filepath.Join("/", filePath), config.SanitizePolicy)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := ValidatePathLimits(filePath, config); err != nil {
+		return nil, "", err
+	}
+
+	if err := CheckOverwrite(stores.FileStore, project, filePath, config); err != nil {
+		return nil, "", err
+	}
+
+	if err := p.locker.Lock(project.ID, filePath); err != nil {
+		return nil, "", err
+	}
+	defer p.locker.Unlock(project.ID, filePath)
+
+	fetchURL := u.String()
+	if u.Scheme == "s3" {
+		fetchURL = strings.TrimSuffix(p.S3Endpoint, "/") + "/" + u.Host + path.Clean("/"+u.Path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fetchURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unable to fetch %s: %s", u.Redacted(), resp.Status)
+	}
+
+	var r io.Reader = resp.Body
+	if quota := config.QuotaFor(project.Slug); quota > 0 {
+		remaining := quota - project.Size
+		if resp.ContentLength > remaining {
+			return nil, "", ErrQuotaExceeded
+		}
+
+		// The Content-Length can't be trusted, so the quota is also applied to the data read.
+		r = &quotaReader{r: resp.Body, remaining: remaining}
+	}
+
+	if _, err := stores.FileStore.GetOrCreateDirPath(project.ID, ownerID, filepath.Dir(filePath)); err != nil {
+		log.Errorf("Unable to create directory %s in project %d to pull into: %s", filepath.Dir(filePath), project.ID, err)
+		return nil, "", err
+	}
+
+	file, err := CreateFileFromReader(stores, project.ID, ownerID, filePath, r, mcfsRoot)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to pull %s: %w", u.Redacted(), err)
+	}
+
+	return file, filePath, nil
+}
+
+// isDir returns true if p is a directory in the project.
+func isDir(stores *Stores, projectID int, p string) bool {
+	dir, err := stores.FileStore.GetDirByPath(projectID, filepath.Join("/", p))
+	return err == nil && dir.IsDir()
+}
+
+// quotaReader returns ErrQuotaExceeded once more than remaining bytes have been read.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, ErrQuotaExceeded
+	}
+
+	return n, err
+}
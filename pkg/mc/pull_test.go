@@ -0,0 +1,110 @@
+package mc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullSource_Match(t *testing.T) {
+	sources, err := ParsePullSources("https://data.example.org/shared/, https://*.hpc.example.edu, s3://beamline-data")
+	require.NoError(t, err)
+	require.Len(t, sources, 3)
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{url: "https://data.example.org/shared/run1/a.h5", allowed: true},
+		{url: "https://data.example.org/shared", allowed: true},
+		{url: "https://data.example.org/shared-other/a.h5", allowed: false},
+		{url: "http://data.example.org/shared/a.h5", allowed: false},
+		{url: "https://DATA.example.org/shared/a.h5", allowed: true},
+		{url: "https://scratch.hpc.example.edu/run/a.h5", allowed: true},
+		{url: "https://hpc.example.edu.evil.com/a.h5", allowed: false},
+		{url: "s3://beamline-data/2024/a.h5", allowed: true},
+		{url: "s3://other-bucket/a.h5", allowed: false},
+	}
+
+	puller := NewPuller(sources, NewInMemoryPathLocker())
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			require.NoError(t, err)
+			require.Equal(t, test.allowed, puller.Allowed(u))
+		})
+	}
+
+	_, err = ParsePullSources("ftp://files.example.org")
+	require.Error(t, err)
+}
+
+func TestPuller_Pull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data/run1/output.h5":
+			_, _ = w.Write([]byte("hdf5 data"))
+		case "/data/escape":
+			http.Redirect(w, r, "/private/secret", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	sources, err := ParsePullSources(server.URL + "/data")
+	require.NoError(t, err)
+
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", DirectoryID: 1, MimeType: "directory"},
+	}
+	stores := &Stores{
+		FileStore:        uuidFileStore{FakeFileStore: store.NewFakeFileStore(files)},
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: NewFakePendingFileStore(),
+	}
+	project := &mcmodel.Project{ID: 1, Slug: "proj"}
+	config := DefaultConfig()
+	mcfsRoot := t.TempDir()
+	puller := NewPuller(sources, NewInMemoryPathLocker())
+	ctx := context.Background()
+
+	// Pulling into a directory names the file after the URL.
+	file, path, err := puller.Pull(ctx, stores, config, project, 7, server.URL+"/data/run1/output.h5", "/raw", mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, "/raw/output.h5", path)
+	require.Equal(t, uint64(9), file.Size)
+	contents, err := os.ReadFile(file.ToUnderlyingFilePath(mcfsRoot))
+	require.NoError(t, err)
+	require.Equal(t, "hdf5 data", string(contents))
+
+	file, path, err = puller.Pull(ctx, stores, config, project, 7, server.URL+"/data/run1/output.h5", "/raw/run1/renamed.h5", mcfsRoot)
+	require.NoError(t, err)
+	require.Equal(t, "/raw/run1/renamed.h5", path)
+	require.Equal(t, "renamed.h5", file.Name)
+
+	_, _, err = puller.Pull(ctx, stores, config, project, 7, server.URL+"/private/secret", "/raw/", mcfsRoot)
+	require.True(t, errors.Is(err, ErrPullNotAllowed))
+
+	_, _, err = puller.Pull(ctx, stores, config, project, 7, server.URL+"/data/../private/secret", "/raw/", mcfsRoot)
+	require.True(t, errors.Is(err, ErrPullNotAllowed))
+
+	_, _, err = puller.Pull(ctx, stores, config, project, 7, server.URL+"/data/escape", "/raw/", mcfsRoot)
+	require.True(t, errors.Is(err, ErrPullNotAllowed))
+
+	_, _, err = puller.Pull(ctx, stores, config, project, 7, server.URL+"/data/missing", "/raw/", mcfsRoot)
+	require.Error(t, err)
+
+	config.ProjectQuota = 4
+	_, _, err = puller.Pull(ctx, stores, config, project, 7, server.URL+"/data/run1/output.h5", "/raw/", mcfsRoot)
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+}
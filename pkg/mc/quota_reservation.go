@@ -0,0 +1,114 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// ErrQuotaExceeded is returned when an upload, pull or archive extraction would take a project over its
+// quota. It wraps syscall.EDQUOT.
+var ErrQuotaExceeded = fmt.Errorf("%w: the project quota would be exceeded", syscall.EDQUOT)
+
+// QuotaReservationSize is how much of a project's quota an upload reserves in the QuotaCounter at a time.
+// Reserving in large steps keeps the project from being looked up on every write, at the cost of each
+// upload in progress possibly holding up to this much more than it has written.
+const QuotaReservationSize = 8 * 1024 * 1024
+
+// QuotaReservation enforces a project's quota on an upload. The data of an upload isn't counted in the
+// project's size until the upload is committed, so as it is written the upload reserves room for it in
+// the QuotaCounter, which is shared by the instances. A project is over its quota when its size plus the
+// bytes reserved by its uploads in progress is more than its quota. The reservation is released once the
+// upload has been committed, or abandoned.
+type QuotaReservation struct {
+	mu       sync.Mutex
+	counter  QuotaCounter
+	stores   *Stores
+	config   *Config
+	project  *mcmodel.Project
+	quota    int64
+	reserved int64
+}
+
+// NewQuotaReservation creates a QuotaReservation, with nothing reserved, for an upload to project. The
+// project's size is looked up with stores when more of its quota is reserved.
+func NewQuotaReservation(counter QuotaCounter, stores *Stores, config *Config, project *mcmodel.Project) *QuotaReservation {
+	return &QuotaReservation{
+		counter: counter,
+		stores:  stores,
+		config:  config,
+		project: project,
+		quota:   config.QuotaFor(project.Slug),
+	}
+}
+
+// Reserve makes sure that room for an upload of size bytes is reserved. It returns ErrQuotaExceeded when
+// reserving the room would take the project over its quota. A nil QuotaReservation, or one for a project
+// without a quota, always has room.
+func (r *QuotaReservation) Reserve(size int64) error {
+	if r == nil || r.quota <= 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if size <= r.reserved {
+		return nil
+	}
+
+	n := (size - r.reserved + QuotaReservationSize - 1) / QuotaReservationSize * QuotaReservationSize
+	inProgress, err := r.counter.AddBytes(r.project.ID, n)
+	if err != nil {
+		log.Errorf("Unable to reserve %d bytes of the quota of project %d: %s", n, r.project.ID, err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.DBTimeout)
+	defer cancel()
+
+	// The project is looked up, rather than using the one the upload started with, since its size changes
+	// as the other uploads to it are committed.
+	current, err := r.stores.WithContext(ctx).ProjectStore.GetProjectByID(r.project.ID)
+	switch {
+	case err != nil:
+		log.Errorf("Unable to look up project %d to check its quota: %s", r.project.ID, err)
+	case current.Size+inProgress > r.quota:
+		err = ErrQuotaExceeded
+	default:
+		r.reserved += n
+		return nil
+	}
+
+	r.release(n)
+	return err
+}
+
+// Release gives back the room reserved for the upload. It is called once the upload's data has been
+// counted in the project's size, or the upload was abandoned.
+func (r *QuotaReservation) Release() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.release(r.reserved)
+	r.reserved = 0
+}
+
+// release gives back n bytes of the project's quota.
+func (r *QuotaReservation) release(n int64) {
+	if n == 0 {
+		return
+	}
+
+	if _, err := r.counter.AddBytes(r.project.ID, -n); err != nil {
+		log.Errorf("Unable to release %d bytes of the quota of project %d: %s", n, r.project.ID, err)
+	}
+}
@@ -0,0 +1,51 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaReservation(t *testing.T) {
+	project := &mcmodel.Project{ID: 1, Slug: "proj", Size: QuotaReservationSize}
+	stores := &Stores{ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{*project})}
+	config := DefaultConfig()
+	config.ProjectQuota = 4 * QuotaReservationSize
+	counter := NewInMemoryQuotaCounter()
+
+	first := NewQuotaReservation(counter, stores, config, project)
+	require.NoError(t, first.Reserve(10))
+	require.NoError(t, first.Reserve(QuotaReservationSize))
+	reserved, err := counter.Bytes(project.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(QuotaReservationSize), reserved)
+
+	// The project's size plus the first upload's reservation leaves room for 2 more reservations.
+	second := NewQuotaReservation(counter, stores, config, project)
+	require.NoError(t, second.Reserve(2*QuotaReservationSize))
+	require.ErrorIs(t, second.Reserve(2*QuotaReservationSize+1), ErrQuotaExceeded)
+	require.ErrorIs(t, first.Reserve(QuotaReservationSize+1), ErrQuotaExceeded)
+
+	reserved, err = counter.Bytes(project.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*QuotaReservationSize), reserved)
+
+	// Once the first upload is done its room can be used by the second.
+	first.Release()
+	require.NoError(t, second.Reserve(3*QuotaReservationSize))
+
+	second.Release()
+	reserved, err = counter.Bytes(project.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), reserved)
+
+	// Projects without a quota, and uploads that don't reserve, always have room.
+	config.ProjectQuota = 0
+	require.NoError(t, NewQuotaReservation(counter, stores, config, project).Reserve(100*QuotaReservationSize))
+
+	var none *QuotaReservation
+	require.NoError(t, none.Reserve(100*QuotaReservationSize))
+	none.Release()
+}
@@ -0,0 +1,222 @@
+package mc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// replicaLagWindow is how long after a session writes to the database its lookups keep going to the
+// primary. It needs to be longer than the replica usually lags behind the primary.
+const replicaLagWindow = 30 * time.Second
+
+// NewGormStoresWithReadReplica creates Stores where the read heavy calls (directory listings, stats, and
+// project lookups) go to the read replica in readDB, and everything else goes to the primary in db.
+// Calls made as part of writing a file, such as GetDirByPath and GetOrCreateDirPath, always go to the
+// primary so that they see the results of writes that haven't been replicated yet. For the stores
+// returned by ForSession the read heavy calls also go to the primary for replicaLagWindow after the
+// session writes, so that a session sees its own writes. Other sessions may not see a file that was just
+// written until the replica catches up. Calls made in a transaction all go to the primary.
+func NewGormStoresWithReadReplica(db, readDB *gorm.DB, mcfsRoot string) *Stores {
+	if err := registerSessionWritesCallbacks(db); err != nil {
+		log.Errorf("Unable to track session writes, lookups after a write may not see it: %s", err)
+	}
+
+	return gormStoresWithReadReplica(db, readDB, mcfsRoot, nil)
+}
+
+// gormStoresWithReadReplica creates the read replica Stores for the session whose writes are tracked in
+// writes. It is nil for the stores that aren't for a session.
+func gormStoresWithReadReplica(db, readDB *gorm.DB, mcfsRoot string, writes *sessionWrites) *Stores {
+	stores := newGormStoresWithReadReplica(db, readDB, mcfsRoot, writes)
+	stores.withContext = func(ctx context.Context) *Stores {
+		ctx = writes.bind(ctx)
+		return gormStoresWithReadReplica(db.WithContext(ctx), readDB.WithContext(ctx), mcfsRoot, writes)
+	}
+
+	stores.transaction = func(fn func(tx *Stores) error) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			return fn(newGormStores(tx, mcfsRoot))
+		})
+	}
+
+	stores.forSession = func() *Stores {
+		writes := &sessionWrites{}
+		return gormStoresWithReadReplica(db.WithContext(writes.bind(context.Background())), readDB, mcfsRoot, writes)
+	}
+
+	return stores
+}
+
+func newGormStoresWithReadReplica(db, readDB *gorm.DB, mcfsRoot string, writes *sessionWrites) *Stores {
+	// The ListingStore is only ever used bound to a request, so it is created with the database that is
+	// current for the request.
+	listingDB := readDB
+	if writes.recent() {
+		listingDB = db
+	}
+
+	return &Stores{
+		FileStore: &readSplitFileStore{
+			FileStore: store.NewGormFileStore(db, mcfsRoot),
+			readStore: store.NewGormFileStore(readDB, mcfsRoot),
+			writes:    writes,
+		},
+		ProjectStore: &readSplitProjectStore{
+			ProjectStore: store.NewGormProjectStore(db),
+			readStore:    store.NewGormProjectStore(readDB),
+			writes:       writes,
+		},
+		ConversionStore:  store.NewGormConversionStore(db),
+		PendingFileStore: NewGormPendingFileStore(db),
+		VersionStore:     NewGormVersionStore(db),
+		LinkStore:        NewGormLinkStore(db),
+
+		ProjectCreateStore:  NewGormProjectCreateStore(db),
+		TagStore:            NewGormTagStore(db),
+		MetadataStore:       NewGormMetadataStore(db),
+		ProjectMemberStore:  NewGormProjectMemberStore(db),
+		FileAuditStore:      NewGormFileAuditStore(db),
+		ProjectNetworkStore: NewGormProjectNetworkStore(db),
+		GuestStore:          NewGormGuestStore(db),
+		TokenStore:          NewGormTokenStore(db),
+		FileAccessStore:     NewGormFileAccessStore(db),
+		ListingStore:        NewGormListingStore(listingDB),
+		DamagedFileStore:    NewGormDamagedFileStore(db),
+
+		ProjectSlugAliasStore: NewGormProjectSlugAliasStore(db),
+		ResumableUploadStore:  NewGormResumableUploadStore(db),
+		UserUsageStore:        NewGormUserUsageStore(readDB),
+		SymlinkStore:          NewGormSymlinkStore(db),
+		FeatureFlagStore:      NewGormFeatureFlagStore(readDB),
+		UploadProvenanceStore: NewGormUploadProvenanceStore(db),
+
+		ProjectExtractPathStore: NewGormProjectExtractPathStore(db),
+	}
+}
+
+// sessionWrites records when a session last wrote to the primary. The session's database calls carry it
+// in their context (see bind), where the callbacks registered by registerSessionWritesCallbacks find it.
+type sessionWrites struct {
+	// last is the time, in Unix nanoseconds, of the last write. It is updated atomically.
+	last int64
+}
+
+// sessionWritesKey is the context key for a session's *sessionWrites.
+type sessionWritesKey struct{}
+
+// bind returns ctx carrying w, so that the writes made with it are recorded in w. A nil w returns ctx.
+func (w *sessionWrites) bind(ctx context.Context) context.Context {
+	if w == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, sessionWritesKey{}, w)
+}
+
+// wrote records a write made now.
+func (w *sessionWrites) wrote() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+// recent returns true if the session wrote within replicaLagWindow. It is always false for a nil w.
+func (w *sessionWrites) recent() bool {
+	if w == nil {
+		return false
+	}
+
+	last := atomic.LoadInt64(&w.last)
+	return last != 0 && time.Since(time.Unix(0, last)) < replicaLagWindow
+}
+
+// registerSessionWritesCallbacks registers the callbacks that record each create, update, delete and raw
+// statement made on db in the sessionWrites in the statement's context.
+func registerSessionWritesCallbacks(db *gorm.DB) error {
+	record := func(tx *gorm.DB) {
+		if tx.Statement.Context == nil {
+			return
+		}
+
+		if w, ok := tx.Statement.Context.Value(sessionWritesKey{}).(*sessionWrites); ok {
+			w.wrote()
+		}
+	}
+
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("mc:session_writes", record); err != nil {
+		return err
+	}
+
+	if err := callbacks.Update().After("gorm:update").Register("mc:session_writes", record); err != nil {
+		return err
+	}
+
+	if err := callbacks.Delete().After("gorm:delete").Register("mc:session_writes", record); err != nil {
+		return err
+	}
+
+	return callbacks.Raw().After("gorm:raw").Register("mc:session_writes", record)
+}
+
+// readSplitFileStore sends ListDirectoryByPath and GetFileByPath to readStore, unless the session wrote
+// recently. All other calls go to the embedded primary store.FileStore.
+type readSplitFileStore struct {
+	store.FileStore
+	readStore store.FileStore
+	writes    *sessionWrites
+}
+
+func (s *readSplitFileStore) ListDirectoryByPath(projectID int, path string) ([]mcmodel.File, error) {
+	return s.reader().ListDirectoryByPath(projectID, path)
+}
+
+func (s *readSplitFileStore) GetFileByPath(projectID int, path string) (*mcmodel.File, error) {
+	return s.reader().GetFileByPath(projectID, path)
+}
+
+// reader returns the store the read heavy calls go to.
+func (s *readSplitFileStore) reader() store.FileStore {
+	if s.writes.recent() {
+		return s.FileStore
+	}
+
+	return s.readStore
+}
+
+// readSplitProjectStore sends the project lookups and access checks to readStore, unless the session
+// wrote recently. Updates go to the embedded primary store.ProjectStore.
+type readSplitProjectStore struct {
+	store.ProjectStore
+	readStore store.ProjectStore
+	writes    *sessionWrites
+}
+
+func (s *readSplitProjectStore) GetProjectByID(projectID int) (*mcmodel.Project, error) {
+	return s.reader().GetProjectByID(projectID)
+}
+
+func (s *readSplitProjectStore) GetProjectBySlug(slug string) (*mcmodel.Project, error) {
+	return s.reader().GetProjectBySlug(slug)
+}
+
+func (s *readSplitProjectStore) GetProjectsForUser(userID int) ([]mcmodel.Project, error) {
+	return s.reader().GetProjectsForUser(userID)
+}
+
+func (s *readSplitProjectStore) UserCanAccessProject(userID, projectID int) bool {
+	return s.reader().UserCanAccessProject(userID, projectID)
+}
+
+// reader returns the store the project lookups go to.
+func (s *readSplitProjectStore) reader() store.ProjectStore {
+	if s.writes.recent() {
+		return s.ProjectStore
+	}
+
+	return s.readStore
+}
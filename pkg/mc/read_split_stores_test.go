@@ -0,0 +1,83 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestReadSplitStoresAfterWrite(t *testing.T) {
+	// The file and project have been written to the primary, but haven't reached the replica yet.
+	dirs := []mcmodel.File{{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}}
+	written := append(dirs, mcmodel.File{ID: 2, ProjectID: 1, Name: "a.txt", Path: "/a.txt", DirectoryID: 1, MimeType: "text/plain", Current: true})
+	writes := &sessionWrites{}
+	fileStore := &readSplitFileStore{
+		FileStore: store.NewFakeFileStore(written),
+		readStore: store.NewFakeFileStore(dirs),
+		writes:    writes,
+	}
+	projectStore := &readSplitProjectStore{
+		ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		readStore:    store.NewFakeProjectStore(nil),
+		writes:       writes,
+	}
+
+	_, err := fileStore.GetFileByPath(1, "/a.txt")
+	require.Error(t, err)
+	_, err = projectStore.GetProjectBySlug("proj")
+	require.Error(t, err)
+
+	// Right after the session writes its lookups go to the primary.
+	writes.wrote()
+	_, err = fileStore.GetFileByPath(1, "/a.txt")
+	require.NoError(t, err)
+	_, err = projectStore.GetProjectBySlug("proj")
+	require.NoError(t, err)
+
+	// Once the replica has had time to catch up they go back to the replica.
+	writes.last = time.Now().Add(-replicaLagWindow).UnixNano()
+	_, err = fileStore.GetFileByPath(1, "/a.txt")
+	require.Error(t, err)
+
+	// Stores that aren't for a session always use the replica.
+	fileStore.writes = nil
+	_, err = fileStore.GetFileByPath(1, "/a.txt")
+	require.Error(t, err)
+}
+
+func TestGormStoresWithReadReplicaTrackSessionWrites(t *testing.T) {
+	open := func() *gorm.DB {
+		db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+		require.NoError(t, err)
+		return db
+	}
+
+	stores := NewGormStoresWithReadReplica(open(), open(), t.TempDir())
+	session := stores.ForSession()
+	other := stores.ForSession()
+
+	writesFor := func(stores *Stores) *sessionWrites {
+		return stores.FileStore.(*readSplitFileStore).writes
+	}
+
+	require.Nil(t, writesFor(stores))
+	require.False(t, writesFor(session).recent())
+
+	// A write made with the session's stores bound to a request is recorded for the session only.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, session.WithContext(ctx).ResumableUploadStore.SaveResumableUpload(&ResumableUpload{ProjectID: 1, Path: "/a.txt"}))
+	require.True(t, writesFor(session).recent())
+	require.True(t, writesFor(session.WithContext(ctx)).recent())
+	require.False(t, writesFor(other).recent())
+
+	// So are writes made without binding the stores to a request.
+	require.NoError(t, other.ResumableUploadStore.SaveResumableUpload(&ResumableUpload{ProjectID: 1, Path: "/b.txt"}))
+	require.True(t, writesFor(other).recent())
+}
@@ -0,0 +1,192 @@
+package mc
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// EventChecksumMismatch is the Event.Type for a download whose data didn't match the file's checksum.
+const EventChecksumMismatch = "file.checksum_mismatch"
+
+// ReadVerification determines whether the data of a file is checked against its checksum as it is
+// downloaded, which catches data that has been silently corrupted in storage when it is used.
+type ReadVerification string
+
+const (
+	// ReadVerifyOff doesn't check downloads.
+	ReadVerifyOff ReadVerification = "off"
+
+	// ReadVerifyLog logs a download that doesn't match its checksum, and emits an EventChecksumMismatch
+	// event.
+	ReadVerifyLog ReadVerification = "log"
+
+	// ReadVerifyFail also fails the download, so that the client doesn't keep the damaged data.
+	ReadVerifyFail ReadVerification = "fail"
+)
+
+// ErrChecksumMismatch is returned by a download that failed because its data doesn't match the file's
+// checksum.
+var ErrChecksumMismatch = errors.New("the file's data doesn't match its checksum, it may be damaged")
+
+// maxPendingVerifyBytes is the amount of data read out of order that a ChecksumVerifier holds on to.
+const maxPendingVerifyBytes = 8 * 1024 * 1024
+
+// ChecksumVerifier hashes the data of a file as it is downloaded, and checks the hash against the file's
+// checksum once the whole file has been read. SFTP clients send several reads at once, so reads can
+// arrive out of order. Data read ahead of the data hashed so far is held until the data before it has
+// been read, up to maxPendingVerifyBytes. Beyond that, or when the client doesn't read the whole file,
+// the download isn't checked.
+type ChecksumVerifier struct {
+	mode     ReadVerification
+	file     *mcmodel.File
+	events   EventSink
+	transfer Transfer
+
+	mu           sync.Mutex
+	hasher       hash.Hash
+	offset       int64
+	pending      map[int64][]byte
+	pendingBytes int
+	done         bool
+}
+
+// NewChecksumVerifier creates a ChecksumVerifier for downloading file. The transfer describes the download
+// for the EventChecksumMismatch event. It returns nil, which verifies nothing, when mode is ReadVerifyOff or
+// the file is empty or has no checksum.
+func NewChecksumVerifier(mode ReadVerification, file *mcmodel.File, events EventSink, transfer Transfer) *ChecksumVerifier {
+	if (mode != ReadVerifyLog && mode != ReadVerifyFail) || file.Size == 0 || file.Checksum == "" {
+		return nil
+	}
+
+	return &ChecksumVerifier{
+		mode:     mode,
+		file:     file,
+		events:   events,
+		transfer: transfer,
+		hasher:   md5.New(),
+		pending:  make(map[int64][]byte),
+	}
+}
+
+// Add hashes b, which was read at offset. Once the whole file has been hashed it checks the checksum, and
+// returns ErrChecksumMismatch when it doesn't match and the mode is ReadVerifyFail. A nil ChecksumVerifier
+// ignores the data.
+func (v *ChecksumVerifier) Add(b []byte, offset int64) error {
+	if v == nil || len(b) == 0 {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.done {
+		return nil
+	}
+
+	switch {
+	case offset+int64(len(b)) <= v.offset:
+		// Data that has already been hashed, read again.
+		return nil
+	case offset <= v.offset:
+		v.hash(b[v.offset-offset:])
+	case v.pendingBytes+len(b) > maxPendingVerifyBytes:
+		log.Debugf("Not verifying the download of file %d, the reads are too far out of order", v.file.ID)
+		v.done, v.pending = true, nil
+		return nil
+	default:
+		v.pending[offset] = append([]byte(nil), b...)
+		v.pendingBytes += len(b)
+		return nil
+	}
+
+	for {
+		next, ok := v.pending[v.offset]
+		if !ok {
+			break
+		}
+		delete(v.pending, v.offset)
+		v.pendingBytes -= len(next)
+		v.hash(next)
+	}
+
+	if uint64(v.offset) < v.file.Size {
+		return nil
+	}
+
+	v.done, v.pending = true, nil
+	return v.check()
+}
+
+// hash adds b, the data at v.offset, to the hash. It must be called with mu held.
+func (v *ChecksumVerifier) hash(b []byte) {
+	_, _ = v.hasher.Write(b)
+	v.offset += int64(len(b))
+}
+
+// check compares the hash with the file's checksum. It must be called with mu held.
+func (v *ChecksumVerifier) check() error {
+	checksum := fmt.Sprintf("%x", v.hasher.Sum(nil))
+	if checksum == v.file.Checksum {
+		return nil
+	}
+
+	log.Errorf("The data downloaded for file %d (%s) in project %d has checksum %s, expected %s",
+		v.file.ID, v.transfer.Path, v.transfer.ProjectID, checksum, v.file.Checksum)
+
+	v.events.Emit(Event{
+		Type:      EventChecksumMismatch,
+		Time:      time.Now(),
+		ProjectID: v.transfer.ProjectID,
+		Path:      v.transfer.Path,
+		Details: map[string]string{
+			"file_id":           strconv.Itoa(v.file.ID),
+			"protocol":          v.transfer.Protocol,
+			"user_id":           strconv.Itoa(v.transfer.UserID),
+			"expected_checksum": v.file.Checksum,
+			"actual_checksum":   checksum,
+			"failed":            strconv.FormatBool(v.mode == ReadVerifyFail),
+		},
+	})
+
+	if v.mode == ReadVerifyFail {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// NewReader returns a reader that adds the data read from r, which reads the file from the start, to the
+// verifier. A failed check is returned by the Read that completes the file. A nil ChecksumVerifier
+// returns r.
+func (v *ChecksumVerifier) NewReader(r io.Reader) io.Reader {
+	if v == nil {
+		return r
+	}
+
+	return &verifyingReader{Reader: r, verifier: v}
+}
+
+type verifyingReader struct {
+	io.Reader
+	verifier *ChecksumVerifier
+	offset   int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if verifyErr := r.verifier.Add(p[:n], r.offset); verifyErr != nil {
+		return n, verifyErr
+	}
+
+	r.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,83 @@
+package mc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumVerifier(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	file := &mcmodel.File{ID: 1, Size: uint64(len(data)), Checksum: fmt.Sprintf("%x", md5.Sum(data))}
+	damaged := append([]byte(nil), data...)
+	damaged[500] ^= 1
+
+	// reads lists the offsets of the 100 byte reads, in the order they arrive.
+	inOrder := []int64{0, 100, 200, 300, 400, 500, 600, 700, 800, 900}
+	outOfOrder := []int64{100, 0, 300, 200, 200, 500, 400, 900, 700, 600, 800}
+
+	tests := []struct {
+		name     string
+		mode     ReadVerification
+		data     []byte
+		reads    []int64
+		mismatch bool
+		err      error
+	}{
+		{"match", ReadVerifyFail, data, inOrder, false, nil},
+		{"match out of order", ReadVerifyFail, data, outOfOrder, false, nil},
+		{"mismatch logged", ReadVerifyLog, damaged, inOrder, true, nil},
+		{"mismatch fails", ReadVerifyFail, damaged, outOfOrder, true, ErrChecksumMismatch},
+		{"off", ReadVerifyOff, damaged, inOrder, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := &eventCollector{}
+			v := NewChecksumVerifier(test.mode, file, events, Transfer{Protocol: "sftp", ProjectID: 2, Path: "/a.dat"})
+
+			var err error
+			for _, offset := range test.reads {
+				if addErr := v.Add(test.data[offset:offset+100], offset); addErr != nil {
+					err = addErr
+				}
+			}
+
+			require.ErrorIs(t, err, test.err)
+			if !test.mismatch {
+				require.Empty(t, events.events)
+				return
+			}
+
+			require.Len(t, events.events, 1)
+			require.Equal(t, EventChecksumMismatch, events.events[0].Type)
+			require.Equal(t, "/a.dat", events.events[0].Path)
+		})
+	}
+
+	// A partial download isn't checked.
+	events := &eventCollector{}
+	v := NewChecksumVerifier(ReadVerifyFail, file, events, Transfer{})
+	require.NoError(t, v.Add(damaged[:600], 0))
+	require.Empty(t, events.events)
+
+	// The reader returns the failure with the last of the data.
+	v = NewChecksumVerifier(ReadVerifyFail, file, &eventCollector{}, Transfer{})
+	read, err := io.ReadAll(v.NewReader(iotest.HalfReader(bytes.NewReader(damaged))))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Equal(t, damaged, read)
+
+	v = NewChecksumVerifier(ReadVerifyFail, file, &eventCollector{}, Transfer{})
+	read, err = io.ReadAll(v.NewReader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+}
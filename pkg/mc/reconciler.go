@@ -0,0 +1,238 @@
+package mc
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// DefaultReconcileMinAge is the default Reconciler.MinAge.
+const DefaultReconcileMinAge = 24 * time.Hour
+
+// Reconciler cleans up file versions that were created with FileStore.CreateFile but never finalized
+// with FileStore.DoneWritingToFile. These are left behind when a server crashed or lost its database
+// connection part way through an upload. For each pending file the Reconciler checks the physical
+// file. If all of the file's data exists, that is it has the size recorded with
+// PendingFileStore.SetExpectedSize at the start of the upload, then the file is finalized (completed).
+// Otherwise, including when the size wasn't known up front, as for SFTP uploads, or when a newer
+// version of the file has since been uploaded, the pending file is removed (expunged).
+type Reconciler struct {
+	stores      *Stores
+	coordinator *Coordinator
+	mcfsRoot    string
+
+	// MinAge is how long ago a pending file must have been created before it is reconciled. It
+	// keeps the Reconciler away from uploads that are still in progress.
+	MinAge time.Duration
+
+	// BatchSize is the number of pending files loaded at a time.
+	BatchSize int
+
+	// DryRun reports what would be done without changing anything.
+	DryRun bool
+}
+
+// ReconcileResult counts what happened to the pending files in a reconciliation run.
+type ReconcileResult struct {
+	Completed int
+	Expunged  int
+
+	// Skipped counts the files that were being written to by a session, so were left alone.
+	Skipped int
+
+	Failed int
+}
+
+func (r ReconcileResult) String() string {
+	return fmt.Sprintf("%d completed, %d expunged, %d skipped, %d failed", r.Completed, r.Expunged, r.Skipped, r.Failed)
+}
+
+func NewReconciler(stores *Stores, coordinator *Coordinator, mcfsRoot string) *Reconciler {
+	return &Reconciler{
+		stores:      stores,
+		coordinator: coordinator,
+		mcfsRoot:    mcfsRoot,
+		MinAge:      DefaultReconcileMinAge,
+		BatchSize:   500,
+	}
+}
+
+// Run does a single reconciliation pass over all the pending files that are older than MinAge. An
+// error is only returned when the pending files couldn't be loaded, failures to reconcile a single
+// file are logged and counted in the result.
+func (r *Reconciler) Run(ctx context.Context) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	createdBefore := time.Now().Add(-r.MinAge)
+	afterID := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		files, err := r.stores.WithContext(ctx).PendingFileStore.ListPendingFiles(createdBefore, afterID, r.BatchSize)
+		if err != nil {
+			log.Errorf("Unable to load pending files: %s", err)
+			return result, err
+		}
+
+		if len(files) == 0 {
+			return result, nil
+		}
+
+		for i := range files {
+			r.reconcileFile(ctx, &files[i], &result)
+			afterID = files[i].ID
+		}
+	}
+}
+
+// RunPeriodically runs a reconciliation pass every interval until ctx is done.
+func (r *Reconciler) RunPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := r.Run(ctx)
+			if err != nil {
+				log.Errorf("Reconciliation of pending files stopped early: %s", err)
+			}
+			log.Infof("Reconciled pending files: %s", result)
+		}
+	}
+}
+
+// reconcileFile completes or expunges a single pending file, and updates result with what was done.
+func (r *Reconciler) reconcileFile(ctx context.Context, file *mcmodel.File, result *ReconcileResult) {
+	if file.Directory == nil {
+		// The directory the file was in is gone, so there is nowhere to complete the file into.
+		r.expunge(ctx, file, result)
+		return
+	}
+
+	path := file.FullPath()
+
+	// Don't touch a file that a session is writing to. The Reconciler shouldn't see these because
+	// of MinAge, but a very long upload could still be in progress.
+	if err := r.coordinator.PathLocker.Lock(file.ProjectID, path); err != nil {
+		result.Skipped++
+		return
+	}
+	defer r.coordinator.PathLocker.Unlock(file.ProjectID, path)
+
+	stores := r.stores.WithContext(ctx)
+
+	// The data staged by an interrupted SCP upload is only part of the file, so it is never completed.
+	// Staged uploads that haven't been resumed by the time they are reconciled are expunged.
+	if stores.ResumableUploadStore != nil {
+		upload, err := stores.ResumableUploadStore.GetResumableUpload(file.ProjectID, path)
+		switch {
+		case err != nil:
+			log.Errorf("Unable to look up the staged upload of %s in project %d: %s", path, file.ProjectID, err)
+			result.Failed++
+			return
+		case upload != nil && upload.FileID == file.ID:
+			r.expunge(ctx, file, result)
+			if !r.DryRun {
+				if err := stores.ResumableUploadStore.DeleteResumableUpload(file.ProjectID, path); err != nil {
+					log.Errorf("Unable to remove the staged upload of %s in project %d: %s", path, file.ProjectID, err)
+				}
+			}
+			return
+		}
+	}
+
+	// If a newer version has been uploaded then completing this file would replace it.
+	if current, err := stores.FileStore.GetFileByPath(file.ProjectID, path); err == nil && current.CreatedAt.After(file.CreatedAt) {
+		r.expunge(ctx, file, result)
+		return
+	}
+
+	// Without the size the upload expected there is no telling whether the data is complete.
+	if file.Size == 0 {
+		r.expunge(ctx, file, result)
+		return
+	}
+
+	checksum, size, err := checksumFile(file.ToUnderlyingFilePathForUUID(r.mcfsRoot))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		r.expunge(ctx, file, result)
+		return
+	case err != nil:
+		log.Errorf("Unable to read data for pending file %d: %s", file.ID, err)
+		result.Failed++
+		return
+	case size != int64(file.Size):
+		log.Infof("Pending file %d has %d of its %d bytes", file.ID, size, file.Size)
+		r.expunge(ctx, file, result)
+		return
+	}
+
+	if r.DryRun {
+		log.Infof("Would complete pending file %d (%s in project %d)", file.ID, path, file.ProjectID)
+		result.Completed++
+		return
+	}
+
+	switched, err := CommitFile(stores, file, checksum, size, r.mcfsRoot)
+	if err != nil {
+		// CommitFile has already tried to remove the file.
+		result.Failed++
+		return
+	}
+
+	if switched {
+		// An existing file has the same checksum, so this file's data isn't needed.
+		_ = os.Remove(file.ToUnderlyingFilePathForUUID(r.mcfsRoot))
+	}
+
+	log.Infof("Completed pending file %d (%s in project %d)", file.ID, path, file.ProjectID)
+	result.Completed++
+}
+
+// expunge removes a pending file and updates result.
+func (r *Reconciler) expunge(ctx context.Context, file *mcmodel.File, result *ReconcileResult) {
+	if r.DryRun {
+		log.Infof("Would expunge pending file %d in project %d", file.ID, file.ProjectID)
+		result.Expunged++
+		return
+	}
+
+	if err := AbortFile(r.stores.WithContext(ctx), file, r.mcfsRoot); err != nil {
+		result.Failed++
+		return
+	}
+
+	log.Infof("Expunged pending file %d in project %d", file.ID, file.ProjectID)
+	result.Expunged++
+}
+
+// checksumFile returns the MD5 checksum and size of the file at path.
+func checksumFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), size, nil
+}
@@ -0,0 +1,53 @@
+package mc
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconciler_Run(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	dir := &mcmodel.File{ID: 1, Name: "/", Path: "/", ProjectID: 1, MimeType: "directory"}
+	old := time.Now().Add(-48 * time.Hour)
+
+	withData := mcmodel.File{ID: 10, Name: "a.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", CreatedAt: old, Size: 4}
+	withoutData := mcmodel.File{ID: 11, Name: "b.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "ffffffff-bbbb-cccc-dddd-eeeeeeeeeeee", CreatedAt: old, Size: 4}
+	tooNew := mcmodel.File{ID: 12, Name: "c.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "11111111-bbbb-cccc-dddd-eeeeeeeeeeee", CreatedAt: time.Now(), Size: 4}
+	truncated := mcmodel.File{ID: 13, Name: "d.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "22222222-bbbb-cccc-dddd-eeeeeeeeeeee", CreatedAt: old, Size: 10}
+	unknownSize := mcmodel.File{ID: 14, Name: "e.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "33333333-bbbb-cccc-dddd-eeeeeeeeeeee", CreatedAt: old}
+
+	for _, f := range []mcmodel.File{withData, truncated, unknownSize} {
+		require.Nil(t, os.MkdirAll(f.ToUnderlyingDirPath(mcfsRoot), 0777))
+		require.Nil(t, os.WriteFile(f.ToUnderlyingFilePath(mcfsRoot), []byte("data"), 0666))
+	}
+
+	pendingFileStore := NewFakePendingFileStore(withData, withoutData, tooNew, truncated, unknownSize)
+	stores := &Stores{
+		FileStore:        store.NewFakeFileStore([]mcmodel.File{*dir}),
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: pendingFileStore,
+	}
+
+	reconciler := NewReconciler(stores, NewInMemoryCoordinator(), mcfsRoot)
+	reconciler.BatchSize = 1
+
+	result, err := reconciler.Run(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, ReconcileResult{Completed: 1, Expunged: 3}, result)
+	require.Equal(t, []int{11, 13, 14}, pendingFileStore.DeletedFileIDs,
+		"The files without data, with only part of their data, or whose size isn't known should be expunged")
+
+	_, err = os.Stat(truncated.ToUnderlyingFilePath(mcfsRoot))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,374 @@
+package mc
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// ErrReadOnly is returned for writes to a server running in read-only mode.
+var ErrReadOnly = fmt.Errorf("this server is read-only: %w", os.ErrPermission)
+
+// DefaultRangeReadLimit is the default RemoteFileCache.RangeReadLimit.
+const DefaultRangeReadLimit = 1024 * 1024
+
+// ErrInsecureFileServerURL is returned for a FileServer URL that isn't https. The shared token, and the
+// file data, must not be sent in the clear.
+var ErrInsecureFileServerURL = errors.New("the file server URL must be https")
+
+// FileReader is the data of a file opened for reading.
+type FileReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// RemoteFileCache is used by a read-only satellite mc-sshd, at a site far from the primary, that shares the
+// primary's database but not its storage. File data is fetched from the primary's FileServer the first time
+// it is read, checked against the file's checksum, and cached under the satellite's own mcfsRoot, so repeated
+// downloads are served locally.
+type RemoteFileCache struct {
+	baseURL  string
+	token    string
+	mcfsRoot string
+	client   *http.Client
+
+	// RangeReadLimit is how much of a file that isn't cached can be read through Open before the whole
+	// file is fetched. Until then each read is a single ranged request to the primary, so that previews
+	// such as head, file and magic byte sniffing don't have to wait for a large file to be fetched.
+	RangeReadLimit int64
+
+	// fetching holds a lock for each file being fetched, so that concurrent reads of the same file
+	// only fetch it once. It is keyed by the UUID of the file data. A lock is removed once nothing
+	// is waiting on it.
+	mu       sync.Mutex
+	fetching map[string]*fetchLock
+}
+
+// fetchLock is held while a file is fetched. waiters counts the reads holding, or waiting for, it.
+type fetchLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// NewRemoteFileCache creates a RemoteFileCache that fetches files from the FileServer at baseURL,
+// authenticating with token, and caches them under mcfsRoot. baseURL must be https. rootCAs are the
+// certificate authorities trusted for the FileServer's certificate; nil uses the system's.
+func NewRemoteFileCache(baseURL, token, mcfsRoot string, rootCAs *x509.CertPool) (*RemoteFileCache, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %s", ErrInsecureFileServerURL, baseURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+
+	return &RemoteFileCache{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		token:    token,
+		mcfsRoot: mcfsRoot,
+		client:   &http.Client{Timeout: 12 * time.Hour, Transport: transport},
+		fetching: make(map[string]*fetchLock),
+
+		RangeReadLimit: DefaultRangeReadLimit,
+	}, nil
+}
+
+// Open opens the data for file for reading. A file that is already cached is read locally. Otherwise
+// nothing is fetched until the file is read. The first RangeReadLimit bytes read are fetched with
+// ranged requests for just the bytes asked for, and after that the whole file is fetched with Ensure
+// and read locally.
+func (c *RemoteFileCache) Open(file *mcmodel.File) (FileReader, error) {
+	path := file.ToUnderlyingFilePath(c.mcfsRoot)
+	if _, err := os.Stat(path); err == nil {
+		return os.Open(path)
+	}
+
+	return &remoteFileReader{cache: c, file: file}, nil
+}
+
+// Ensure makes sure the data for file is in the local cache, fetching it from the primary if it isn't.
+// A nil RemoteFileCache does nothing, since all the files are local.
+func (c *RemoteFileCache) Ensure(file *mcmodel.File) error {
+	if c == nil {
+		return nil
+	}
+
+	uuid := file.UUIDForPath()
+	path := file.ToUnderlyingFilePath(c.mcfsRoot)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	lock := c.lockFor(uuid)
+	lock.Lock()
+	defer c.unlock(uuid, lock)
+
+	// Another read may have fetched the file while this one waited.
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := c.fetch(file, path); err != nil {
+		log.Errorf("Unable to fetch file %d (%s) from %s: %s", file.ID, uuid, c.baseURL, err)
+		return err
+	}
+
+	return nil
+}
+
+// lockFor returns the fetchLock for uuid, counting the caller as one of its waiters. It must be released
+// with unlock.
+func (c *RemoteFileCache) lockFor(uuid string) *fetchLock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lock, ok := c.fetching[uuid]
+	if !ok {
+		lock = &fetchLock{}
+		c.fetching[uuid] = lock
+	}
+
+	lock.waiters++
+	return lock
+}
+
+// unlock unlocks lock, and removes it from fetching once nothing else is waiting on it.
+func (c *RemoteFileCache) unlock(uuid string, lock *fetchLock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(c.fetching, uuid)
+	}
+
+	lock.Unlock()
+}
+
+// get requests the data for uuid from the FileServer. The caller must close the returned body.
+func (c *RemoteFileCache) get(uuid string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/files/"+uuid, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", c.baseURL, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// fetch downloads the data for file to path. The data is only put in place once it has been checked
+// against the file's checksum (see writeVerifiedFile), so that a partial or corrupted download is never
+// served.
+func (c *RemoteFileCache) fetch(file *mcmodel.File, path string) error {
+	if file.Checksum == "" {
+		return errors.New("the file has no checksum to verify its data against")
+	}
+
+	body, err := c.get(file.UUIDForPath())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return writeVerifiedFile(body, path, file.Checksum)
+}
+
+// remoteFileReader reads a file that isn't cached, see RemoteFileCache.Open.
+type remoteFileReader struct {
+	cache *RemoteFileCache
+	file  *mcmodel.File
+
+	// mu guards rangeRead and local. local is the cached file, once the file has been fetched.
+	mu        sync.Mutex
+	rangeRead int64
+	local     *os.File
+}
+
+func (r *remoteFileReader) ReadAt(b []byte, offset int64) (int, error) {
+	local, err := r.localFileFor(int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+
+	if local != nil {
+		return local.ReadAt(b, offset)
+	}
+
+	return r.cache.readRange(r.file, b, offset)
+}
+
+// localFileFor returns the cached file once n more bytes would take the reads over RangeReadLimit, and
+// nil while reads should still be ranged.
+func (r *remoteFileReader) localFileFor(n int64) (*os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.local != nil || r.rangeRead+n <= r.cache.RangeReadLimit {
+		r.rangeRead += n
+		return r.local, nil
+	}
+
+	if err := r.cache.Ensure(r.file); err != nil {
+		return nil, err
+	}
+
+	local, err := os.Open(r.file.ToUnderlyingFilePath(r.cache.mcfsRoot))
+	if err != nil {
+		return nil, err
+	}
+
+	r.local = local
+	return local, nil
+}
+
+func (r *remoteFileReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.local == nil {
+		return nil
+	}
+
+	return r.local.Close()
+}
+
+// readRange reads len(b) bytes at offset in the data for file from the primary, in a single ranged
+// request. Like os.File.ReadAt, it returns io.EOF when fewer bytes than asked for are read. A range
+// can't be checked against the file's checksum, which is why only RangeReadLimit bytes are read this
+// way, but the response must be for the range asked for, of data the size of the file.
+func (c *RemoteFileCache) readRange(file *mcmodel.File, b []byte, offset int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/files/"+file.UUIDForPath(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(b))-1))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if err := checkContentRange(resp.Header.Get("Content-Range"), offset, int64(file.Size)); err != nil {
+			log.Errorf("Unable to read file %d (%s) from %s: %s", file.ID, file.UUIDForPath(), c.baseURL, err)
+			return 0, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The offset is at or past the end of the file.
+		return 0, io.EOF
+	default:
+		log.Errorf("Unable to read file %d (%s) from %s: primary returned %s", file.ID, file.UUIDForPath(), c.baseURL, resp.Status)
+		return 0, fmt.Errorf("primary returned %s", resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, b)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// checkContentRange checks that contentRange, the Content-Range of a response to a ranged request, starts
+// at offset of data that is size bytes long. A size of 0 isn't checked, since the size isn't known.
+func checkContentRange(contentRange string, offset, size int64) error {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return fmt.Errorf("invalid Content-Range '%s'", contentRange)
+	}
+
+	if start != offset {
+		return fmt.Errorf("Content-Range '%s' doesn't start at %d", contentRange, offset)
+	}
+
+	if size != 0 && total != strconv.FormatInt(size, 10) {
+		return fmt.Errorf("Content-Range '%s' isn't for data of %d bytes", contentRange, size)
+	}
+
+	return nil
+}
+
+// uuidPattern matches the UUIDs used for file data.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// FileServer serves file data, by UUID, to RemoteFileCaches at satellite sites. Requests must include
+// the shared token as a bearer token, so it must be served over TLS.
+type FileServer struct {
+	token    string
+	mcfsRoot string
+}
+
+func NewFileServer(token, mcfsRoot string) *FileServer {
+	return &FileServer{token: token, mcfsRoot: mcfsRoot}
+}
+
+// ServeHTTP handles GET /files/<uuid>.
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if s.token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	uuid := strings.TrimPrefix(r.URL.Path, "/files/")
+	if r.Method != http.MethodGet || !uuidPattern.MatchString(uuid) {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(mcmodel.File{UUID: uuid}.ToUnderlyingFilePathForUUID(s.mcfsRoot))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		log.Errorf("Unable to open file data %s for a satellite: %s", uuid, err)
+		http.Error(w, "unable to open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		http.Error(w, "unable to open file", http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, uuid, finfo.ModTime(), f)
+}
@@ -0,0 +1,185 @@
+package mc
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRemoteFileCache creates a RemoteFileCache for the FileServer in server, which trusts the server's
+// certificate.
+func newTestRemoteFileCache(t *testing.T, server *httptest.Server, token, mcfsRoot string) *RemoteFileCache {
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	cache, err := NewRemoteFileCache(server.URL, token, mcfsRoot, rootCAs)
+	require.NoError(t, err)
+	return cache
+}
+
+func TestNewRemoteFileCache_RequiresHTTPS(t *testing.T) {
+	_, err := NewRemoteFileCache("http://primary.example.org:8443", "secret", t.TempDir(), nil)
+	require.ErrorIs(t, err, ErrInsecureFileServerURL)
+
+	_, err = NewRemoteFileCache("https://primary.example.org:8443", "secret", t.TempDir(), nil)
+	require.NoError(t, err)
+}
+
+func TestRemoteFileCache_Ensure(t *testing.T) {
+	primaryRoot := t.TempDir()
+	satelliteRoot := t.TempDir()
+
+	// "file data" has the md5 checksum 6ef7c14ddb5cac8c4a560afb698e0bba.
+	file := &mcmodel.File{ID: 1, UUID: "b5e9a1d4-3c1f-4c2e-9a53-6f0b1d2e3c4f", Checksum: "6ef7c14ddb5cac8c4a560afb698e0bba"}
+	path := file.ToUnderlyingFilePath(primaryRoot)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	require.NoError(t, os.WriteFile(path, []byte("file data"), 0666))
+
+	primary := httptest.NewTLSServer(NewFileServer("secret", primaryRoot))
+	defer primary.Close()
+
+	// The wrong token is refused.
+	err := newTestRemoteFileCache(t, primary, "wrong", satelliteRoot).Ensure(file)
+	require.Error(t, err)
+	require.NoFileExists(t, file.ToUnderlyingFilePath(satelliteRoot))
+
+	// A server whose certificate isn't trusted is refused.
+	untrusted, err := NewRemoteFileCache(primary.URL, "secret", satelliteRoot, nil)
+	require.NoError(t, err)
+	require.Error(t, untrusted.Ensure(file))
+	require.NoFileExists(t, file.ToUnderlyingFilePath(satelliteRoot))
+
+	// Data that doesn't match the file's checksum isn't cached.
+	cache := newTestRemoteFileCache(t, primary, "secret", satelliteRoot)
+	corrupt := *file
+	corrupt.Checksum = "00000000000000000000000000000000"
+	require.Error(t, cache.Ensure(&corrupt))
+	require.NoFileExists(t, file.ToUnderlyingFilePath(satelliteRoot))
+
+	require.NoError(t, cache.Ensure(file))
+	data, err := os.ReadFile(file.ToUnderlyingFilePath(satelliteRoot))
+	require.NoError(t, err)
+	require.Equal(t, "file data", string(data))
+
+	// The fetch locks are removed once the fetches are done.
+	require.Empty(t, cache.fetching)
+
+	// Once cached the file is served locally, even if the primary goes away.
+	primary.Close()
+	require.NoError(t, cache.Ensure(file))
+
+	// A nil cache means the files are local.
+	var local *RemoteFileCache
+	require.NoError(t, local.Ensure(file))
+}
+
+func TestRemoteFileCache_Open(t *testing.T) {
+	primaryRoot := t.TempDir()
+	satelliteRoot := t.TempDir()
+
+	// "0123456789abcdef" has the md5 checksum 4032af8d61035123906e58e067140cc5.
+	file := &mcmodel.File{ID: 1, UUID: "b5e9a1d4-3c1f-4c2e-9a53-6f0b1d2e3c4f", Checksum: "4032af8d61035123906e58e067140cc5", Size: 16}
+	path := file.ToUnderlyingFilePath(primaryRoot)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	require.NoError(t, os.WriteFile(path, []byte("0123456789abcdef"), 0666))
+
+	requests := 0
+	fileServer := NewFileServer("secret", primaryRoot)
+	primary := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer primary.Close()
+
+	cache := newTestRemoteFileCache(t, primary, "secret", satelliteRoot)
+	cache.RangeReadLimit = 8
+
+	r, err := cache.Open(file)
+	require.NoError(t, err)
+	require.Equal(t, 0, requests, "Opening a file doesn't fetch it")
+
+	// The first and last bytes are read with a request each, without caching the file.
+	b := make([]byte, 4)
+	n, err := r.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.Equal(t, "0123", string(b[:n]))
+
+	n, err = r.ReadAt(b, 14)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, "ef", string(b[:n]))
+	require.Equal(t, 2, requests)
+	require.NoFileExists(t, file.ToUnderlyingFilePath(satelliteRoot))
+
+	// Past RangeReadLimit the whole file is fetched and read locally.
+	n, err = r.ReadAt(b, 4)
+	require.NoError(t, err)
+	require.Equal(t, "4567", string(b[:n]))
+	require.Equal(t, 3, requests)
+	require.FileExists(t, file.ToUnderlyingFilePath(satelliteRoot))
+
+	n, err = r.ReadAt(b, 8)
+	require.NoError(t, err)
+	require.Equal(t, "89ab", string(b[:n]))
+	require.Equal(t, 3, requests)
+	require.NoError(t, r.Close())
+}
+
+func TestRemoteFileCache_RangeForOtherData(t *testing.T) {
+	primaryRoot := t.TempDir()
+
+	file := &mcmodel.File{ID: 1, UUID: "b5e9a1d4-3c1f-4c2e-9a53-6f0b1d2e3c4f", Size: 32}
+	path := file.ToUnderlyingFilePath(primaryRoot)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	require.NoError(t, os.WriteFile(path, []byte("0123456789abcdef"), 0666))
+
+	primary := httptest.NewTLSServer(NewFileServer("secret", primaryRoot))
+	defer primary.Close()
+
+	// The primary's data isn't the size of the file, so it isn't the file's data.
+	r, err := newTestRemoteFileCache(t, primary, "secret", t.TempDir()).Open(file)
+	require.NoError(t, err)
+	_, err = r.ReadAt(make([]byte, 4), 0)
+	require.Error(t, err)
+}
+
+func TestCheckContentRange(t *testing.T) {
+	tests := []struct {
+		contentRange string
+		offset       int64
+		size         int64
+		valid        bool
+	}{
+		{"bytes 0-3/16", 0, 16, true},
+		{"bytes 4-7/16", 4, 16, true},
+		{"bytes 4-7/*", 4, 0, true},
+		{"bytes 0-3/16", 4, 16, false},
+		{"bytes 0-3/20", 0, 16, false},
+		{"", 0, 16, false},
+	}
+
+	for _, test := range tests {
+		err := checkContentRange(test.contentRange, test.offset, test.size)
+		if test.valid {
+			require.NoError(t, err, test.contentRange)
+		} else {
+			require.Error(t, err, test.contentRange)
+		}
+	}
+}
+
+func TestFileServer_RejectsInvalidUUIDs(t *testing.T) {
+	server := NewFileServer("secret", t.TempDir())
+
+	req := httptest.NewRequest(http.MethodGet, "/files/../../etc/passwd", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,397 @@
+package mc
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ResumableUpload is the data staged by an SCP upload that was interrupted. Its key is the path, the size
+// the client announced for the file and the checksum of the data received, so that an upload of the same
+// file can continue from where the interrupted one stopped. The data is kept in File, a pending file that
+// was never finalized. Uploads that aren't resumed are removed by the Reconciler along with File.
+type ResumableUpload struct {
+	ID              int
+	ProjectID       int    `gorm:"uniqueIndex:idx_resumable_uploads_path"`
+	Path            string `gorm:"uniqueIndex:idx_resumable_uploads_path"`
+	Size            int64
+	Received        int64
+	PartialChecksum string
+	FileID          int
+	File            *mcmodel.File `gorm:"foreignKey:FileID;references:ID"`
+	OwnerID         int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// ResumableUploadStore holds the staged data of interrupted SCP uploads. The uploads are kept in the
+// resumable_uploads table, which mc-sshd adds to the Materials Commons database:
+//
+//	CREATE TABLE resumable_uploads (
+//	    id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    path VARCHAR(4096) NOT NULL,
+//	    size BIGINT NOT NULL,
+//	    received BIGINT NOT NULL,
+//	    partial_checksum VARCHAR(32) NOT NULL,
+//	    file_id INT UNSIGNED NOT NULL,
+//	    owner_id INT UNSIGNED NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    updated_at TIMESTAMP NULL,
+//	    UNIQUE KEY (project_id, path(255))
+//	);
+type ResumableUploadStore interface {
+	// SaveResumableUpload records the staged data of an upload, replacing any upload already staged for
+	// the same path.
+	SaveResumableUpload(upload *ResumableUpload) error
+
+	// GetResumableUpload returns the upload staged for path in the project, with its File and the
+	// File's Directory loaded, or nil when there isn't one.
+	GetResumableUpload(projectID int, path string) (*ResumableUpload, error)
+
+	// DeleteResumableUpload removes the upload staged for path in the project. It isn't an error if there
+	// isn't one. The staged File isn't removed.
+	DeleteResumableUpload(projectID int, path string) error
+}
+
+func (ResumableUpload) TableName() string {
+	return "resumable_uploads"
+}
+
+// Matches returns true if upload was staged by an upload of the same file as one of size bytes by the user
+// with ownerID, whose first upload.Received bytes have partialChecksum. An upload whose File has since been
+// finalized doesn't match anything.
+func (upload *ResumableUpload) Matches(size int64, ownerID int, partialChecksum string) bool {
+	return upload.File != nil && !upload.File.Current && upload.Size == size && upload.OwnerID == ownerID &&
+		upload.PartialChecksum == partialChecksum
+}
+
+// StagedChecksum returns the checksum of the data staged for upload, which is upload.PartialChecksum unless
+// the staged data changed after it was recorded.
+func StagedChecksum(upload *ResumableUpload, mcfsRoot string) (string, error) {
+	f, err := os.Open(upload.File.ToUnderlyingFilePath(mcfsRoot))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	if n, err := io.Copy(hasher, io.LimitReader(f, upload.Received)); err != nil {
+		return "", err
+	} else if n != upload.Received {
+		return "", ErrStagedDataChanged
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+type GormResumableUploadStore struct {
+	db *gorm.DB
+}
+
+func NewGormResumableUploadStore(db *gorm.DB) *GormResumableUploadStore {
+	return &GormResumableUploadStore{db: db}
+}
+
+func (s *GormResumableUploadStore) SaveResumableUpload(upload *ResumableUpload) error {
+	return s.db.Omit("File").Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "project_id"}, {Name: "path"}},
+		DoUpdates: clause.AssignmentColumns([]string{"size", "received", "partial_checksum", "file_id", "owner_id", "updated_at"}),
+	}).Create(upload).Error
+}
+
+func (s *GormResumableUploadStore) GetResumableUpload(projectID int, path string) (*ResumableUpload, error) {
+	var upload ResumableUpload
+	err := s.db.Preload("File.Directory").
+		Where("project_id = ?", projectID).
+		Where("path = ?", path).
+		First(&upload).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+func (s *GormResumableUploadStore) DeleteResumableUpload(projectID int, path string) error {
+	return s.db.Where("project_id = ?", projectID).Where("path = ?", path).Delete(&ResumableUpload{}).Error
+}
+
+// FakeResumableUploadStore is a ResumableUploadStore for testing. The uploads are kept in Uploads, keyed
+// by path, for a single project.
+type FakeResumableUploadStore struct {
+	Uploads map[string]*ResumableUpload
+}
+
+func NewFakeResumableUploadStore() *FakeResumableUploadStore {
+	return &FakeResumableUploadStore{Uploads: make(map[string]*ResumableUpload)}
+}
+
+func (s *FakeResumableUploadStore) SaveResumableUpload(upload *ResumableUpload) error {
+	s.Uploads[upload.Path] = upload
+	return nil
+}
+
+func (s *FakeResumableUploadStore) GetResumableUpload(projectID int, path string) (*ResumableUpload, error) {
+	upload, ok := s.Uploads[path]
+	if !ok || upload.ProjectID != projectID {
+		return nil, nil
+	}
+
+	return upload, nil
+}
+
+func (s *FakeResumableUploadStore) DeleteResumableUpload(projectID int, path string) error {
+	delete(s.Uploads, path)
+	return nil
+}
+
+// ErrResumeOffset is returned when an upload is continued from an offset other than the end of its staged
+// data.
+var ErrResumeOffset = fmt.Errorf("%w: the offset isn't the end of the staged data", os.ErrInvalid)
+
+// ErrResumeChecksum is returned when an upload is continued with a checksum for the start of the file
+// that isn't the checksum of the staged data, so the staged data is from a different file.
+var ErrResumeChecksum = fmt.Errorf("%w: the checksum isn't the checksum of the staged data", os.ErrInvalid)
+
+// ErrStagedDataChanged is returned when the staged data of an upload no longer matches its checksum. The
+// staged upload is discarded, so the file has to be uploaded from the beginning.
+var ErrStagedDataChanged = errors.New("the staged data doesn't match its checksum, upload the whole file again")
+
+// ErrUploadIncomplete is returned when the data sent to continue an upload ends before the end of the file.
+// The data received is staged, so the upload can be continued again.
+var ErrUploadIncomplete = errors.New("the data ended before the end of the file")
+
+// ErrUploadTooLong is returned when more data is sent to continue an upload than is left of the file.
+var ErrUploadTooLong = fmt.Errorf("%w: more data was sent than is left of the file", os.ErrInvalid)
+
+// ContinueUpload continues upload, an interrupted SCP upload, with the rest of the file's data read from r.
+// Unlike uploading the file again with SCP (see ResumeWriter), only the data after the staged data is sent,
+// so the client starts r at offset, which has to be upload.Received. The client checks that the staged
+// data is from the same file by comparing upload.PartialChecksum with the checksum of the first offset
+// bytes of its copy, and the staged data is checked against PartialChecksum before anything is appended
+// to it. Once the whole file has been received it is committed (see CommitFile), the staged upload is
+// removed and the file is returned. When r ends early what was received is staged and ErrUploadIncomplete
+// is returned.
+func ContinueUpload(stores *Stores, upload *ResumableUpload, offset int64, r io.Reader, mcfsRoot string) (*mcmodel.File, error) {
+	if offset != upload.Received {
+		return nil, ErrResumeOffset
+	}
+
+	file := upload.File
+	f, err := os.OpenFile(file.ToUnderlyingFilePath(mcfsRoot), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum, received, err := appendToStaged(f, upload, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	switch {
+	case errors.Is(err, ErrStagedDataChanged):
+		log.Errorf("Discarding the staged upload of %s in project %d: %s", upload.Path, upload.ProjectID, err)
+		_ = AbortFile(stores, file, mcfsRoot)
+		_ = stores.ResumableUploadStore.DeleteResumableUpload(upload.ProjectID, upload.Path)
+		return nil, err
+	case err != nil:
+		if received != 0 {
+			upload.Received, upload.PartialChecksum = offset+received, checksum
+			if err := stores.ResumableUploadStore.SaveResumableUpload(upload); err != nil {
+				log.Errorf("Unable to stage the upload of %s in project %d: %s", upload.Path, upload.ProjectID, err)
+			}
+		}
+		return nil, err
+	}
+
+	switched, err := CommitFile(stores, file, checksum, upload.Size, mcfsRoot)
+	if err != nil {
+		_ = stores.ResumableUploadStore.DeleteResumableUpload(upload.ProjectID, upload.Path)
+		return nil, err
+	}
+
+	if switched {
+		// The file now points at an existing file with the same data, so the data received isn't needed.
+		_ = os.Remove(file.ToUnderlyingFilePathForUUID(mcfsRoot))
+	}
+
+	if err := stores.ResumableUploadStore.DeleteResumableUpload(upload.ProjectID, upload.Path); err != nil {
+		log.Errorf("Unable to remove the staged upload of %s in project %d: %s", upload.Path, upload.ProjectID, err)
+	}
+
+	return file, nil
+}
+
+// appendToStaged checks the staged data of upload in f against its checksum, and then appends the rest of
+// the file, read from r, to it. It returns the checksum of the data in f, and the number of bytes appended,
+// which are kept when the append fails part way.
+func appendToStaged(f *os.File, upload *ResumableUpload, r io.Reader) (string, int64, error) {
+	hasher := md5.New()
+	if n, err := io.Copy(hasher, io.LimitReader(f, upload.Received)); err != nil {
+		return "", 0, err
+	} else if n != upload.Received || fmt.Sprintf("%x", hasher.Sum(nil)) != upload.PartialChecksum {
+		return "", 0, ErrStagedDataChanged
+	}
+
+	if err := f.Truncate(upload.Received); err != nil {
+		return "", 0, err
+	}
+
+	// One byte more than is left is read, to find out whether the client sent too much.
+	remaining := upload.Size - upload.Received
+	received, err := io.Copy(&hashedWriter{w: f, hasher: hasher}, io.LimitReader(r, remaining+1))
+	switch {
+	case received > remaining:
+		_ = f.Truncate(upload.Received)
+		return "", 0, ErrUploadTooLong
+	case err == nil && received < remaining:
+		err = ErrUploadIncomplete
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), received, err
+}
+
+// hashedWriter writes to w, and adds the data w accepted to hasher, so that the checksum matches what was
+// written even when a write fails part way.
+type hashedWriter struct {
+	w      io.Writer
+	hasher hash.Hash
+}
+
+func (w *hashedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	_, _ = w.hasher.Write(p[:n])
+	return n, err
+}
+
+// ResumeWriter writes an upload into a file that may already hold a prefix of it, the staged data of an
+// interrupted upload. SCP can't tell the client to skip ahead, so the client sends the whole file again.
+// The data sent for the staged prefix is compared with the staged data rather than written, which checks
+// that the same file is being uploaded. At the first byte that differs the staged data is discarded, and
+// the rest of the upload is written over it. A ResumeWriter with no staged data writes every byte. Clients
+// that can send only the rest of the file continue the upload with ContinueUpload instead.
+type ResumeWriter struct {
+	f        *os.File
+	staged   int64
+	offset   int64
+	diverged bool
+	buf      []byte
+	hasher   hash.Hash
+}
+
+// NewResumeWriter creates a ResumeWriter for f, whose first staged bytes are staged data.
+func NewResumeWriter(f *os.File, staged int64) *ResumeWriter {
+	return &ResumeWriter{f: f, staged: staged, hasher: md5.New()}
+}
+
+func (w *ResumeWriter) Write(p []byte) (int, error) {
+	n := 0
+	if w.offset < w.staged {
+		n = int(minInt64(int64(len(p)), w.staged-w.offset))
+		if cap(w.buf) < n {
+			w.buf = make([]byte, n)
+		}
+
+		read, err := w.f.ReadAt(w.buf[:n], w.offset)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		same := commonPrefixLength(w.buf[:read], p[:n])
+		w.accept(p[:same])
+		if same != n {
+			// Not the same data, so rewrite from here on.
+			w.staged, w.diverged = w.offset, true
+			n = same
+		}
+	}
+
+	if n == len(p) {
+		return n, nil
+	}
+
+	written, err := w.f.WriteAt(p[n:], w.offset)
+	w.accept(p[n : n+written])
+	return n + written, err
+}
+
+// accept adds b, which is in the file at offset, to the data received.
+func (w *ResumeWriter) accept(b []byte) {
+	_, _ = w.hasher.Write(b)
+	w.offset += int64(len(b))
+}
+
+// Checksum returns the MD5 checksum of the data received so far.
+func (w *ResumeWriter) Checksum() string {
+	return fmt.Sprintf("%x", w.hasher.Sum(nil))
+}
+
+// Verified returns the number of staged bytes that were found to match the upload, and so weren't
+// written again.
+func (w *ResumeWriter) Verified() int64 {
+	return minInt64(w.offset, w.staged)
+}
+
+// Valid returns the length of the prefix of the file that holds the upload's data, either received in
+// this upload or staged and not yet compared. When it is more than the data received, the staged data's
+// checksum still applies, otherwise Checksum is the checksum of the prefix.
+func (w *ResumeWriter) Valid() int64 {
+	if w.diverged || w.offset >= w.staged {
+		return w.offset
+	}
+
+	return w.staged
+}
+
+// Received returns the number of bytes of the upload received so far.
+func (w *ResumeWriter) Received() int64 {
+	return w.offset
+}
+
+// Truncate truncates the file to Valid, dropping any staged data that an interrupted upload replaced.
+func (w *ResumeWriter) Truncate() error {
+	return w.f.Truncate(w.Valid())
+}
+
+// Finish truncates the file to the data received, once the whole upload has been, dropping any staged
+// data past its end.
+func (w *ResumeWriter) Finish() error {
+	return w.f.Truncate(w.offset)
+}
+
+// commonPrefixLength returns the number of bytes at the start of a and b that are the same.
+func commonPrefixLength(a, b []byte) int {
+	n := minInt(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,156 @@
+package mc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeWriter(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+
+	tests := []struct {
+		name     string
+		staged   []byte
+		upload   []byte
+		verified int64
+	}{
+		{"no staged data", nil, data, 0},
+		{"same file", data[:12], data, 12},
+		{"different file", []byte("0123XXXXXXXX"), data, 4},
+		{"staged past the end", append(append([]byte(nil), data...), "extra"...), data, 20},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(path, test.staged, 0600))
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		require.NoError(t, err)
+
+		w := NewResumeWriter(f, int64(len(test.staged)))
+		for i := 0; i < len(test.upload); i += 7 {
+			n, err := w.Write(test.upload[i:minInt(i+7, len(test.upload))])
+			require.NoError(t, err, test.name)
+			require.Equal(t, minInt(7, len(test.upload)-i), n, test.name)
+		}
+
+		require.NoError(t, w.Finish(), test.name)
+		require.NoError(t, f.Close())
+
+		contents, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, string(test.upload), string(contents), test.name)
+		require.Equal(t, test.verified, w.Verified(), test.name)
+		require.Equal(t, fmt.Sprintf("%x", md5.Sum(test.upload)), w.Checksum(), test.name)
+	}
+}
+
+func TestResumeWriter_Interrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte("0123456789"), 0600))
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Interrupted while comparing the staged data, all of the staged data is still valid.
+	w := NewResumeWriter(f, 10)
+	_, err = w.Write([]byte("0123"))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), w.Received())
+	require.Equal(t, int64(10), w.Valid())
+
+	// Interrupted after the upload turned out to be a different file, only the data received is valid.
+	w = NewResumeWriter(f, 10)
+	_, err = w.Write([]byte("01X"))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), w.Valid())
+	require.NoError(t, w.Truncate())
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "01X", string(contents))
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("01X"))), w.Checksum())
+}
+
+func TestContinueUpload(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo")
+	require.NoError(t, err)
+
+	project, err := stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+	dir, err := stores.FileStore.GetDirByPath(project.ID, "/")
+	require.NoError(t, err)
+
+	data := []byte("0123456789abcdefghij")
+	stage := func(staged []byte) *ResumableUpload {
+		file, err := stores.FileStore.CreateFile("a.txt", project.ID, dir.ID, 1, "text/plain")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0755))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), staged, 0644))
+
+		upload := &ResumableUpload{ProjectID: project.ID, Path: "/a.txt", Size: int64(len(data)), Received: int64(len(staged)),
+			PartialChecksum: fmt.Sprintf("%x", md5.Sum(staged)), FileID: file.ID, File: file, OwnerID: 1}
+		require.NoError(t, stores.ResumableUploadStore.SaveResumableUpload(upload))
+		return upload
+	}
+
+	upload := stage(data[:8])
+
+	// An upload of the same file, by the same user, matches the staged data.
+	checksum, err := StagedChecksum(upload, mcfsRoot)
+	require.NoError(t, err)
+	require.True(t, upload.Matches(int64(len(data)), 1, checksum))
+	require.False(t, upload.Matches(int64(len(data)), 2, checksum))
+	require.False(t, upload.Matches(int64(len(data)+1), 1, checksum))
+
+	// Only the end of the staged data can be continued from.
+	_, err = ContinueUpload(stores, upload, 4, bytes.NewReader(data[4:]), mcfsRoot)
+	require.ErrorIs(t, err, ErrResumeOffset)
+
+	// Too much data leaves the staged data as it was.
+	_, err = ContinueUpload(stores, upload, 8, bytes.NewReader(append(data[8:], 'X')), mcfsRoot)
+	require.ErrorIs(t, err, ErrUploadTooLong)
+	require.Equal(t, int64(8), upload.Received)
+
+	// Data that ends early is staged, so the upload can be continued again from there.
+	_, err = ContinueUpload(stores, upload, 8, bytes.NewReader(data[8:12]), mcfsRoot)
+	require.ErrorIs(t, err, ErrUploadIncomplete)
+	staged, err := stores.ResumableUploadStore.GetResumableUpload(project.ID, "/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(12), staged.Received)
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum(data[:12])), staged.PartialChecksum)
+
+	file, err := ContinueUpload(stores, staged, 12, bytes.NewReader(data[12:]), mcfsRoot)
+	require.NoError(t, err)
+	require.True(t, file.Current)
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), file.Checksum)
+
+	contents, err := os.ReadFile(file.ToUnderlyingFilePath(mcfsRoot))
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(contents))
+
+	staged, err = stores.ResumableUploadStore.GetResumableUpload(project.ID, "/a.txt")
+	require.NoError(t, err)
+	require.Nil(t, staged, "The staged upload should be removed once the file is committed")
+
+	// Staged data that has changed since it was staged is discarded rather than appended to.
+	upload = stage([]byte("01234567"))
+	require.NoError(t, os.WriteFile(upload.File.ToUnderlyingFilePath(mcfsRoot), []byte("0123XXXX"), 0644))
+	checksum, err = StagedChecksum(upload, mcfsRoot)
+	require.NoError(t, err)
+	require.False(t, upload.Matches(int64(len(data)), 1, checksum))
+	_, err = ContinueUpload(stores, upload, 8, bytes.NewReader(data[8:]), mcfsRoot)
+	require.ErrorIs(t, err, ErrStagedDataChanged)
+	require.NoFileExists(t, upload.File.ToUnderlyingFilePath(mcfsRoot))
+	staged, err = stores.ResumableUploadStore.GetResumableUpload(project.ID, "/a.txt")
+	require.NoError(t, err)
+	require.Nil(t, staged)
+}
@@ -0,0 +1,280 @@
+package mc
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// RootMigrator copies the data for the stored files from one mcfs root to another, for example to move
+// onto new storage hardware. Each file is copied to a temporary file, checked against the checksum in
+// the database, and then renamed into place, so a file in the new root is always complete. Files that
+// are already in the new root with the right checksum are skipped, so a migration can be run while the
+// server is still writing to the old root, and then run again after the server has been switched to the
+// new root (MCFS_DIR) to pick up the files written in between.
+//
+// Where a file is stored is derived from the mcfs root and the file's uuid, there are no per file
+// placement records, so a migration of a subset of the projects can't delete the data it copied from the
+// old root while the server is still using it.
+type RootMigrator struct {
+	stores   *Stores
+	fromRoot string
+	toRoot   string
+
+	// ProjectIDs limits the migration to these projects. When it is empty every project is migrated.
+	ProjectIDs []int
+
+	// BatchSize is the number of files loaded at a time.
+	BatchSize int
+
+	// DeleteSource deletes the data from the old root once it has been copied and checked. It can't be
+	// used with ProjectIDs.
+	DeleteSource bool
+
+	// StatePath is a file that the migration's progress is saved to after each batch of files. A
+	// migration that is stopped resumes from where it got to when it is run again with the same
+	// StatePath and DeleteSource. The progress of a run without DeleteSource isn't used by a run with it,
+	// which starts from the beginning so that the data copied by the earlier runs is deleted too. When it
+	// is blank the migration starts from the beginning each time.
+	StatePath string
+}
+
+// MigrateResult counts what happened to the files in a migration run.
+type MigrateResult struct {
+	Copied int
+
+	// AlreadyPresent counts the files that were already in the new root with the right checksum.
+	AlreadyPresent int
+
+	Deleted int
+	Failed  int
+}
+
+func (r MigrateResult) String() string {
+	return fmt.Sprintf("%d copied, %d already present, %d deleted from the old root, %d failed",
+		r.Copied, r.AlreadyPresent, r.Deleted, r.Failed)
+}
+
+// ErrPartialMigrationDelete is returned when a RootMigrator is asked to delete the data it copies for a
+// subset of the projects.
+var ErrPartialMigrationDelete = errors.New("the old root can only be deleted from when migrating every project")
+
+func NewRootMigrator(stores *Stores, fromRoot, toRoot string) *RootMigrator {
+	return &RootMigrator{
+		stores:    stores,
+		fromRoot:  fromRoot,
+		toRoot:    toRoot,
+		BatchSize: 500,
+	}
+}
+
+// Run migrates the files. An error is only returned when the files couldn't be loaded or the progress
+// couldn't be saved, failures to migrate a single file are logged and counted in the result.
+func (m *RootMigrator) Run(ctx context.Context) (MigrateResult, error) {
+	var result MigrateResult
+
+	if m.DeleteSource && len(m.ProjectIDs) != 0 {
+		return result, ErrPartialMigrationDelete
+	}
+
+	if filepath.Clean(m.fromRoot) == filepath.Clean(m.toRoot) {
+		return result, fmt.Errorf("the old and new roots are both %s", m.fromRoot)
+	}
+
+	afterID, err := m.loadState()
+	if err != nil {
+		log.Errorf("Unable to load migration state from %s: %s", m.StatePath, err)
+		return result, err
+	}
+
+	if afterID != 0 {
+		log.Infof("Resuming migration after file %d", afterID)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		files, err := m.stores.WithContext(ctx).FileAuditStore.ListStoredFiles(m.ProjectIDs, afterID, m.BatchSize)
+		if err != nil {
+			log.Errorf("Unable to load files to migrate: %s", err)
+			return result, err
+		}
+
+		if len(files) == 0 {
+			return result, nil
+		}
+
+		for i := range files {
+			m.migrateFile(&files[i], &result)
+			afterID = files[i].ID
+		}
+
+		if err := m.saveState(afterID); err != nil {
+			log.Errorf("Unable to save migration state to %s: %s", m.StatePath, err)
+			return result, err
+		}
+	}
+}
+
+// migrateFile copies a single file's data to the new root, deletes it from the old root if DeleteSource
+// is set, and updates result with what was done.
+func (m *RootMigrator) migrateFile(file *mcmodel.File, result *MigrateResult) {
+	if !hasUnderlyingPath(file) {
+		log.Errorf("Unable to migrate file %d: invalid uuid '%s'", file.ID, file.UUIDForPath())
+		result.Failed++
+		return
+	}
+
+	from := file.ToUnderlyingFilePath(m.fromRoot)
+	to := file.ToUnderlyingFilePath(m.toRoot)
+
+	// Files that share their data have the same path, so the data may already have been copied.
+	if checksum, _, err := checksumFile(to); err == nil && checksum == file.Checksum {
+		result.AlreadyPresent++
+		m.deleteSource(file, from, result)
+		return
+	}
+
+	if err := copyVerifiedFile(from, to, file.Checksum); err != nil {
+		log.Errorf("Unable to migrate file %d (%s): %s", file.ID, from, err)
+		result.Failed++
+		return
+	}
+
+	result.Copied++
+	m.deleteSource(file, from, result)
+}
+
+// deleteSource removes the data at from if DeleteSource is set.
+func (m *RootMigrator) deleteSource(file *mcmodel.File, from string, result *MigrateResult) {
+	if !m.DeleteSource {
+		return
+	}
+
+	switch err := os.Remove(from); {
+	case err == nil:
+		result.Deleted++
+	case !errors.Is(err, os.ErrNotExist):
+		log.Errorf("Unable to delete migrated file %d (%s): %s", file.ID, from, err)
+	}
+}
+
+// copyVerifiedFile copies from to to, if the data copied has the MD5 checksum.
+func copyVerifiedFile(from, to, checksum string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeVerifiedFile(src, to, checksum)
+}
+
+// writeVerifiedFile writes the data read from src to to, if the data has the MD5 checksum. The data is
+// written to a temporary file that is renamed into place once it has been checked.
+func writeVerifiedFile(src io.Reader, to, checksum string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(to), ".migrate-"+filepath.Base(to)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), src); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if copied := fmt.Sprintf("%x", hasher.Sum(nil)); copied != checksum {
+		return fmt.Errorf("checksum of the copied data is %s, expected %s", copied, checksum)
+	}
+
+	return os.Rename(tmp.Name(), to)
+}
+
+// The phases of a migration saved with its progress. A state file written before the phase was saved
+// only has the ID, and is for the copy phase.
+const (
+	migratePhaseCopy   = "copy"
+	migratePhaseDelete = "delete"
+)
+
+// phase returns the phase of the migration that m runs.
+func (m *RootMigrator) phase() string {
+	if m.DeleteSource {
+		return migratePhaseDelete
+	}
+
+	return migratePhaseCopy
+}
+
+// loadState returns the ID of the last file migrated, from StatePath. The saved progress is only used
+// when it is for the same phase as this run.
+func (m *RootMigrator) loadState() (int, error) {
+	if m.StatePath == "" {
+		return 0, nil
+	}
+
+	contents, err := os.ReadFile(m.StatePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+
+	phase, id := migratePhaseCopy, strings.TrimSpace(string(contents))
+	if fields := strings.Fields(id); len(fields) == 2 {
+		phase, id = fields[0], fields[1]
+	}
+
+	afterID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if phase != m.phase() {
+		log.Infof("Saved migration progress is for the %s phase, starting the %s phase from the beginning", phase, m.phase())
+		return 0, nil
+	}
+
+	return afterID, nil
+}
+
+// saveState saves afterID, the ID of the last file migrated, and the phase, to StatePath.
+func (m *RootMigrator) saveState(afterID int) error {
+	if m.StatePath == "" {
+		return nil
+	}
+
+	tmp := m.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%s %d\n", m.phase(), afterID)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.StatePath)
+}
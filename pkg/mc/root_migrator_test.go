@@ -0,0 +1,76 @@
+package mc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootMigrator_Run(t *testing.T) {
+	fromRoot, toRoot := t.TempDir(), t.TempDir()
+	statePath := filepath.Join(t.TempDir(), "state")
+
+	// "data" has the md5 checksum 8d777f385d3dfec8815d20f7496026dc.
+	first := mcmodel.File{ID: 10, ProjectID: 1, Name: "a.txt", UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee",
+		Checksum: "8d777f385d3dfec8815d20f7496026dc", Size: 4}
+	shared := mcmodel.File{ID: 11, ProjectID: 2, Name: "b.txt", UUID: "bbbbbbbb-cccc-cccc-dddd-eeeeeeeeeeee",
+		UsesUUID: first.UUID, Checksum: first.Checksum, Size: 4}
+	corrupt := mcmodel.File{ID: 12, ProjectID: 1, Name: "c.txt", UUID: "cccccccc-bbbb-cccc-dddd-eeeeeeeeeeee",
+		Checksum: first.Checksum, Size: 4}
+
+	for file, contents := range map[*mcmodel.File]string{&first: "data", &corrupt: "date"} {
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(fromRoot), 0777))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(fromRoot), []byte(contents), 0666))
+	}
+
+	auditStore := NewFakeFileAuditStore(first, shared, corrupt)
+	migrator := NewRootMigrator(&Stores{FileAuditStore: auditStore}, fromRoot, toRoot)
+	migrator.BatchSize = 2
+	migrator.StatePath = statePath
+
+	result, err := migrator.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, MigrateResult{Copied: 1, AlreadyPresent: 1, Failed: 1}, result)
+
+	contents, err := os.ReadFile(first.ToUnderlyingFilePath(toRoot))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(contents))
+	require.NoFileExists(t, corrupt.ToUnderlyingFilePath(toRoot), "A copy that doesn't match the checksum shouldn't be kept")
+
+	// A second run resumes after the files already migrated.
+	newer := mcmodel.File{ID: 13, ProjectID: 1, Name: "d.txt", UUID: "dddddddd-bbbb-cccc-dddd-eeeeeeeeeeee",
+		Checksum: first.Checksum, Size: 4}
+	require.NoError(t, os.WriteFile(newer.ToUnderlyingFilePath(fromRoot), []byte("data"), 0666))
+	auditStore.Files = append(auditStore.Files, newer)
+
+	result, err = migrator.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, MigrateResult{Copied: 1}, result)
+
+	// A run that deletes from the old root doesn't resume from the copy runs' progress, so the data they
+	// copied is deleted too. The file that couldn't be copied is kept.
+	migrator.DeleteSource = true
+
+	result, err = migrator.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, MigrateResult{AlreadyPresent: 3, Deleted: 2, Failed: 1}, result)
+	for _, file := range []mcmodel.File{first, newer} {
+		require.NoFileExists(t, file.ToUnderlyingFilePath(fromRoot))
+		require.FileExists(t, file.ToUnderlyingFilePath(toRoot))
+	}
+	require.FileExists(t, corrupt.ToUnderlyingFilePath(fromRoot))
+
+	// An interrupted run that deletes resumes from its own progress.
+	result, err = migrator.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, MigrateResult{}, result)
+
+	// The old root can't be deleted from when migrating some of the projects.
+	migrator.ProjectIDs = []int{1}
+	_, err = migrator.Run(context.Background())
+	require.ErrorIs(t, err, ErrPartialMigrationDelete)
+}
@@ -0,0 +1,120 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SanitizePolicy determines what happens to file and directory names that contain characters that
+// are invalid in Materials Commons or on other platforms.
+type SanitizePolicy string
+
+const (
+	// SanitizeOff accepts all names as is.
+	SanitizeOff SanitizePolicy = "off"
+
+	// SanitizeReject fails the upload or mkdir with an error describing the problem with the name.
+	SanitizeReject SanitizePolicy = "reject"
+
+	// SanitizeTransliterate replaces invalid characters with an underscore, strips trailing spaces
+	// and dots, and appends an underscore to reserved Windows names. The names are only mapped when
+	// files and directories are created, so looking up the name the client used fails, and names that
+	// map to the same name, such as "a:b" and "a_b", are versions of the same file. It is only suited
+	// to one way uploads from clients that don't look the files up again.
+	SanitizeTransliterate SanitizePolicy = "transliterate"
+)
+
+// ErrInvalidName is wrapped by the errors returned from SanitizePath when the policy is SanitizeReject.
+var ErrInvalidName = errors.New("invalid name")
+
+// windowsInvalidChars are the characters that can't appear in a Windows file name. Control characters
+// are also invalid and are checked separately.
+const windowsInvalidChars = `<>:"\|?*`
+
+// windowsReservedNames are names that can't be used for a file on Windows, regardless of extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizePath applies the policy to each name in path. For SanitizeTransliterate the returned path
+// is the path to use in place of path. For SanitizeReject path is returned unchanged, or an error
+// wrapping ErrInvalidName is returned for the first invalid name.
+func SanitizePath(path string, policy SanitizePolicy) (string, error) {
+	if policy == SanitizeOff || policy == "" {
+		return path, nil
+	}
+
+	names := strings.Split(path, "/")
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+
+		problem := nameProblem(name)
+		if problem == "" {
+			continue
+		}
+
+		if policy == SanitizeReject {
+			return "", fmt.Errorf("%w: '%s' %s", ErrInvalidName, name, problem)
+		}
+
+		names[i] = transliterateName(name)
+	}
+
+	return strings.Join(names, "/"), nil
+}
+
+// nameProblem returns a description of what is wrong with name, or "" if name is valid.
+func nameProblem(name string) string {
+	for _, c := range name {
+		switch {
+		case c < 0x20 || c == 0x7f:
+			return "contains a control character"
+		case strings.ContainsRune(windowsInvalidChars, c):
+			return fmt.Sprintf("contains the character '%c' which is not allowed on Windows", c)
+		}
+	}
+
+	if strings.HasSuffix(name, " ") || strings.HasSuffix(name, ".") {
+		return "ends with a space or a dot"
+	}
+
+	if isWindowsReservedName(name) {
+		return "is a reserved name on Windows"
+	}
+
+	return ""
+}
+
+// transliterateName turns name into a valid name.
+func transliterateName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(windowsInvalidChars, c) {
+			return '_'
+		}
+		return c
+	}, name)
+
+	name = strings.TrimRight(name, " .")
+	if name == "" {
+		return "_"
+	}
+
+	if isWindowsReservedName(name) {
+		ext := filepath.Ext(name)
+		return strings.TrimSuffix(name, ext) + "_" + ext
+	}
+
+	return name
+}
+
+// isWindowsReservedName returns true if name, ignoring case and extension, is reserved on Windows.
+func isWindowsReservedName(name string) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return windowsReservedNames[strings.ToUpper(base)]
+}
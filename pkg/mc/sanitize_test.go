@@ -0,0 +1,45 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		tname    string
+		path     string
+		expected string
+	}{
+		{"Test valid path", "/dir1/file.txt", "/dir1/file.txt"},
+		{"Test control character", "/dir1/fi\tle.txt", "/dir1/fi_le.txt"},
+		{"Test windows invalid character", "/dir:1/file?.txt", "/dir_1/file_.txt"},
+		{"Test trailing space and dot", "/dir1 ./file.txt", "/dir1/file.txt"},
+		{"Test reserved name", "/dir1/con.txt", "/dir1/con_.txt"},
+		{"Test name that is all dots", "/dir1/...", "/dir1/_"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tname, func(t *testing.T) {
+			sanitized, err := SanitizePath(test.path, SanitizeTransliterate)
+			require.Nil(t, err)
+			require.Equal(t, test.expected, sanitized)
+
+			_, err = SanitizePath(test.path, SanitizeReject)
+			if test.path == test.expected {
+				require.Nil(t, err, "Valid path %s should not be rejected", test.path)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidName, "Invalid path %s should be rejected", test.path)
+			}
+		})
+	}
+}
+
+func TestDefaultSanitizePolicy(t *testing.T) {
+	// Transliterated names can't be looked up by the names the client used, so invalid names are
+	// rejected unless the server is configured otherwise.
+	path, err := SanitizePath("/dir:1/file.txt", DefaultConfig().SanitizePolicy)
+	require.ErrorIs(t, err, ErrInvalidName)
+	require.Empty(t, path)
+}
@@ -0,0 +1,108 @@
+package mc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// SchemaModels are the gomcdb models the server reads and writes. The tables are created and changed
+// by the Materials Commons web app's migrations, so after an upgrade of only one of the web app and
+// mc-sshd the models may no longer match the database. Writes would then silently drop, or fail on, the
+// columns that don't match. See CheckSchema.
+var SchemaModels = []interface{}{&mcmodel.File{}, &mcmodel.Project{}, &mcmodel.User{}, &mcmodel.Conversion{}}
+
+// SchemaMismatch is a table, or a column of a table, that a model expects and the database doesn't
+// have. Column is blank when the whole table is missing.
+type SchemaMismatch struct {
+	Table  string
+	Column string
+}
+
+func (m SchemaMismatch) String() string {
+	if m.Column == "" {
+		return fmt.Sprintf("table %s", m.Table)
+	}
+
+	return fmt.Sprintf("column %s.%s", m.Table, m.Column)
+}
+
+// ExpectedSchema returns the columns of each of models, keyed by table.
+func ExpectedSchema(models ...interface{}) (map[string][]string, error) {
+	cache := &sync.Map{}
+	tables := make(map[string][]string)
+	for _, model := range models {
+		s, err := schema.Parse(model, cache, schema.NamingStrategy{})
+		if err != nil {
+			return nil, err
+		}
+
+		tables[s.Table] = append([]string{}, s.DBNames...)
+	}
+
+	return tables, nil
+}
+
+// CompareSchema returns the tables and columns in expected that actual doesn't have, sorted by table and
+// column. Extra tables and columns in actual are fine, since the models only use some of them.
+func CompareSchema(expected, actual map[string][]string) []SchemaMismatch {
+	var mismatches []SchemaMismatch
+	for table, columns := range expected {
+		actualColumns, ok := actual[table]
+		if !ok {
+			mismatches = append(mismatches, SchemaMismatch{Table: table})
+			continue
+		}
+
+		have := make(map[string]bool, len(actualColumns))
+		for _, column := range actualColumns {
+			have[column] = true
+		}
+
+		for _, column := range columns {
+			if !have[column] {
+				mismatches = append(mismatches, SchemaMismatch{Table: table, Column: column})
+			}
+		}
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].Table != mismatches[j].Table {
+			return mismatches[i].Table < mismatches[j].Table
+		}
+		return mismatches[i].Column < mismatches[j].Column
+	})
+
+	return mismatches
+}
+
+// CheckSchema returns the tables and columns that models expect and db doesn't have. Only the names are
+// compared, a column that changed type isn't found.
+func CheckSchema(db *gorm.DB, models ...interface{}) ([]SchemaMismatch, error) {
+	expected, err := ExpectedSchema(models...)
+	if err != nil {
+		return nil, err
+	}
+
+	actual := make(map[string][]string)
+	for table := range expected {
+		if !db.Migrator().HasTable(table) {
+			continue
+		}
+
+		columnTypes, err := db.Migrator().ColumnTypes(table)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the columns of table %s: %w", table, err)
+		}
+
+		for _, columnType := range columnTypes {
+			actual[table] = append(actual[table], columnType.Name())
+		}
+	}
+
+	return CompareSchema(expected, actual), nil
+}
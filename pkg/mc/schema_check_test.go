@@ -0,0 +1,40 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareSchema(t *testing.T) {
+	expected, err := ExpectedSchema(SchemaModels...)
+	require.NoError(t, err)
+	require.Contains(t, expected["files"], "uses_uuid")
+	require.Contains(t, expected["projects"], "slug")
+
+	// The relationships, such as a file's directory, aren't columns.
+	require.NotContains(t, expected["files"], "directory")
+
+	// A database that matches, with a column the models don't use.
+	actual := make(map[string][]string)
+	for table, columns := range expected {
+		actual[table] = append([]string{"added_later"}, columns...)
+	}
+	require.Empty(t, CompareSchema(expected, actual))
+
+	// A partial upgrade, where a column was renamed and a table hasn't been created.
+	files, err := ExpectedSchema(&mcmodel.File{})
+	require.NoError(t, err)
+	var renamed []string
+	for _, column := range files["files"] {
+		if column != "uses_uuid" {
+			renamed = append(renamed, column)
+		}
+	}
+	actual["files"] = append(renamed, "uses_file_uuid")
+	delete(actual, "conversions")
+
+	require.Equal(t, []SchemaMismatch{{Table: "conversions"}, {Table: "files", Column: "uses_uuid"}}, CompareSchema(expected, actual))
+	require.Equal(t, "column files.uses_uuid", SchemaMismatch{Table: "files", Column: "uses_uuid"}.String())
+}
@@ -0,0 +1,149 @@
+package mc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrOutOfScope is returned when a user logged in with a scoped credential, such as a token, tries to
+// do something its scope doesn't allow. It wraps os.ErrPermission.
+var ErrOutOfScope = fmt.Errorf("%w: outside of the scope of this credential", os.ErrPermission)
+
+// Scope is what a scoped credential, such as a guest or a token, allows: reading and/or writing a path,
+// and everything under it, in a single project.
+type Scope struct {
+	Rule  PathRule
+	Read  bool
+	Write bool
+}
+
+// Check returns an error if the scope doesn't allow the access to path in the project with projectSlug.
+// Like a drop box, a scope allows getting the attributes of the directories leading to its path, so
+// that clients can check it exists. A write-only scope is a drop box, and returns ErrDropBoxOnly. Other
+// scopes return ErrOutOfScope.
+func (s Scope) Check(projectSlug, path string, access DropBoxAccess) error {
+	path = filepath.Clean("/" + path)
+	matches := s.Rule.Matches(projectSlug, path)
+
+	switch {
+	case access == DropBoxRead && s.Read && matches:
+		return nil
+	case access == DropBoxWrite && s.Write && matches:
+		return nil
+	case access == DropBoxStat && (s.Read || s.Write) && (projectSlug == "" || matches || leadsTo(s.Rule, projectSlug, path)):
+		return nil
+	case s.Write && !s.Read:
+		return ErrDropBoxOnly
+	default:
+		return ErrOutOfScope
+	}
+}
+
+// ScopeRegistry holds the scopes of the users that have logged in to this instance with a scoped
+// credential, keyed by the slug they logged in with, along with the slug of the user each credential
+// belongs to. Scopes are never removed, since the sessions run as
+// the user that the credential belongs to and would otherwise lose their restrictions. Instead an expired
+// scope no longer allows anything.
+type ScopeRegistry struct {
+	mu     sync.Mutex
+	scopes map[string]registeredScope
+	now    func() time.Time
+}
+
+type registeredScope struct {
+	scope   Scope
+	owner   string
+	expires time.Time
+}
+
+// NewScopeRegistry creates an empty ScopeRegistry.
+func NewScopeRegistry() *ScopeRegistry {
+	return &ScopeRegistry{scopes: make(map[string]registeredScope), now: time.Now}
+}
+
+// Add registers the scope of the credential with slug, which belongs to the user with ownerSlug and
+// expires at expires.
+func (r *ScopeRegistry) Add(slug, ownerSlug string, scope Scope, expires time.Time) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scopes[slug] = registeredScope{scope: scope, owner: ownerSlug, expires: expires}
+}
+
+// Scope returns the scope of the credential with slug, and whether slug is a scoped credential. An
+// expired credential has a scope that allows nothing. A nil ScopeRegistry has no scoped credentials.
+func (r *ScopeRegistry) Scope(slug string) (Scope, bool) {
+	if r == nil {
+		return Scope{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registered, ok := r.scopes[slug]
+	switch {
+	case !ok:
+		return Scope{}, false
+	case !registered.expires.After(r.now()):
+		return Scope{Rule: registered.scope.Rule}, true
+	default:
+		return registered.scope, true
+	}
+}
+
+// IsScoped returns true if the user with slug logged in with a scoped credential.
+func (r *ScopeRegistry) IsScoped(slug string) bool {
+	_, ok := r.Scope(slug)
+	return ok
+}
+
+// Owner returns the slug of the user that the scoped credential with slug belongs to, and slug itself
+// when it isn't a scoped credential. Credentials created before their owner's slug was recorded have a
+// blank owner.
+func (r *ScopeRegistry) Owner(slug string) string {
+	if r == nil {
+		return slug
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if registered, ok := r.scopes[slug]; ok {
+		return registered.owner
+	}
+
+	return slug
+}
+
+// newScopedCredential generates the slug and secret of a scoped credential, and the bcrypt hash of the
+// secret, which is what is stored. The slug is prefix followed by random hex.
+func newScopedCredential(prefix string) (slug, secret, hash string, err error) {
+	slugSuffix := make([]byte, 6)
+	secretBytes := make([]byte, 15)
+	if _, err := rand.Read(slugSuffix); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", "", err
+	}
+
+	secret = strings.ToLower(base32.StdEncoding.EncodeToString(secretBytes))
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return prefix + hex.EncodeToString(slugSuffix), secret, string(hashBytes), nil
+}
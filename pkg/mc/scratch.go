@@ -0,0 +1,278 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/apex/log"
+)
+
+// ScratchDirName is the name of the virtual directory, in the root beside the projects, that holds the
+// connection's ScratchArea. Files put in it, such as an archive to extract with mc extract or a manifest
+// to check with mc verify-manifest, never become file versions in a project, and are removed when the
+// connection ends. A project with this slug can't be reached while scratch areas are turned on.
+const ScratchDirName = "tmp"
+
+// scratchPrefix starts the name of each ScratchArea's directory, so that those left behind by an
+// instance that didn't stop cleanly can be told apart from other files and removed.
+const scratchPrefix = "mc-sshd-scratch-"
+
+// DefaultScratchLimit is the default limit on the bytes each ScratchArea can hold.
+const DefaultScratchLimit = 10 << 30
+
+// ErrScratchFull is returned for a write or truncate that would take a ScratchArea past its limit.
+var ErrScratchFull = fmt.Errorf("%w: the scratch area is full", syscall.ENOSPC)
+
+// ErrNoScratch is returned for the paths in ScratchDirName when scratch areas aren't turned on.
+var ErrNoScratch = errors.New("there is no scratch area on this server")
+
+// ErrScratchBoundary is returned for attempts to rename, or link, files between a ScratchArea and a
+// project. Files are uploaded to a project rather than moved there, so that each becomes a file version.
+var ErrScratchBoundary = fmt.Errorf("%w: files can't be moved between /%s and a project", os.ErrPermission, ScratchDirName)
+
+// ParseScratchPath returns the path within ScratchDirName of path, a path from the root, and true if
+// path is in ScratchDirName. ScratchDirName itself is "/".
+func ParseScratchPath(path string) (string, bool) {
+	path = cleanClientPath(path)
+	if GetProjectSlugFromPath(path) != ScratchDirName {
+		return path, false
+	}
+
+	return RemoveProjectSlugFromPath(path, ScratchDirName), true
+}
+
+// ScratchArea is a directory on local disk that a connection can stage intermediate files in. Every
+// session on the connection, such as an SFTP session and the mc commands run over the same connection
+// with ssh -o ControlMaster, shares it.
+//
+// The files in the area can hold up to its limit of bytes, so that one connection can't fill the disk.
+// The limit is only enforced on the files written with OpenFile, and changed with Truncate and Remove.
+type ScratchArea struct {
+	dir string
+
+	// limit is the most bytes the files in the area can hold, 0 for no limit.
+	limit int64
+
+	// mu guards used, the bytes the files in the area hold, and is held across each change to their
+	// sizes so that the changes are counted one at a time.
+	mu   sync.Mutex
+	used int64
+}
+
+// Path returns where path, a path within ScratchDirName, is on local disk. Cleaning path as an absolute
+// path keeps ".." from going above the scratch area.
+func (a *ScratchArea) Path(path string) string {
+	return filepath.Join(a.dir, cleanClientPath(path))
+}
+
+// Used returns the number of bytes the files in the area hold.
+func (a *ScratchArea) Used() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used
+}
+
+// OpenFile opens the file at path, a path within ScratchDirName, like os.OpenFile. Its writes are counted
+// against the area's limit.
+func (a *ScratchArea) OpenFile(path string, flag int, perm os.FileMode) (*ScratchFile, error) {
+	localPath := a.Path(path)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var truncated int64
+	if flag&os.O_TRUNC != 0 {
+		if fi, err := os.Lstat(localPath); err == nil && fi.Mode().IsRegular() {
+			truncated = fi.Size()
+		}
+	}
+
+	f, err := os.OpenFile(localPath, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	a.used -= truncated
+	return &ScratchFile{f: f, area: a}, nil
+}
+
+// Truncate changes the size of the file at path, a path within ScratchDirName, like os.Truncate. Growing
+// the file is counted against the area's limit.
+func (a *ScratchArea) Truncate(path string, size int64) error {
+	localPath := a.Path(path)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	if err := a.reserve(size - fi.Size()); err != nil {
+		return err
+	}
+
+	if err := os.Truncate(localPath, size); err != nil {
+		return err
+	}
+
+	a.used += size - fi.Size()
+	return nil
+}
+
+// Remove removes the file or empty directory at path, a path within ScratchDirName, like os.Remove, and
+// gives the bytes a file held back to the area.
+func (a *ScratchArea) Remove(path string) error {
+	localPath := a.Path(path)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Lstat(localPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(localPath); err != nil {
+		return err
+	}
+
+	if fi.Mode().IsRegular() {
+		a.used -= fi.Size()
+	}
+
+	return nil
+}
+
+// reserve returns ErrScratchFull if growing the files in the area by n bytes would take it past its limit.
+// a.mu must be held.
+func (a *ScratchArea) reserve(n int64) error {
+	if n > 0 && a.limit > 0 && a.used+n > a.limit {
+		return ErrScratchFull
+	}
+
+	return nil
+}
+
+// ScratchFile is a file in a ScratchArea opened with OpenFile.
+type ScratchFile struct {
+	f    *os.File
+	area *ScratchArea
+}
+
+func (f *ScratchFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.f.ReadAt(p, off)
+}
+
+// WriteAt writes p at off, like os.File.WriteAt, unless growing the file to hold it would take the area
+// past its limit, in which case nothing is written and ErrScratchFull is returned.
+func (f *ScratchFile) WriteAt(p []byte, off int64) (int, error) {
+	a := f.area
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	before, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := a.reserve(off + int64(len(p)) - before.Size()); err != nil {
+		return 0, err
+	}
+
+	n, err := f.f.WriteAt(p, off)
+
+	// Count what the write did to the file, even if it failed part way.
+	if after, statErr := f.f.Stat(); statErr == nil {
+		a.used += after.Size() - before.Size()
+	}
+
+	return n, err
+}
+
+func (f *ScratchFile) Close() error {
+	return f.f.Close()
+}
+
+// ScratchAreas hands out the ScratchArea of each connection, each a directory under root that is created
+// the first time the connection uses it and removed when the connection ends.
+type ScratchAreas struct {
+	root string
+
+	// limit is the limit of each ScratchArea.
+	limit int64
+
+	mu    sync.Mutex
+	areas map[string]*ScratchArea
+}
+
+// NewScratchAreas creates the ScratchAreas under root, creating root if it doesn't exist. Each area can
+// hold up to limit bytes, 0 for no limit. The scratch areas left in root by an earlier run are removed.
+func NewScratchAreas(root string, limit int64) (*ScratchAreas, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(root, scratchPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, leftover := range leftovers {
+		if err := os.RemoveAll(leftover); err != nil {
+			log.Errorf("Unable to remove the leftover scratch area %s: %s", leftover, err)
+		}
+	}
+
+	return &ScratchAreas{root: root, limit: limit, areas: make(map[string]*ScratchArea)}, nil
+}
+
+// ForConnection returns the ScratchArea of the connection with connID, creating it if it is the
+// connection's first use of it. The ScratchArea and everything in it are removed once done is closed,
+// which is when the connection ends.
+func (s *ScratchAreas) ForConnection(connID string, done <-chan struct{}) (*ScratchArea, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if area, ok := s.areas[connID]; ok {
+		return area, nil
+	}
+
+	dir, err := os.MkdirTemp(s.root, scratchPrefix)
+	if err != nil {
+		log.Errorf("Unable to create a scratch area in %s: %s", s.root, err)
+		return nil, err
+	}
+
+	area := &ScratchArea{dir: dir, limit: s.limit}
+	s.areas[connID] = area
+
+	go func() {
+		<-done
+		s.remove(connID, area)
+	}()
+
+	return area, nil
+}
+
+// remove removes the ScratchArea of the connection with connID.
+func (s *ScratchAreas) remove(connID string, area *ScratchArea) {
+	s.mu.Lock()
+	delete(s.areas, connID)
+	s.mu.Unlock()
+
+	if err := os.RemoveAll(area.dir); err != nil {
+		log.Errorf("Unable to remove scratch area %s: %s", area.dir, err)
+	}
+}
+
+// ScratchDirFileInfo returns the entry for ScratchDirName in the root, made from the entry fi of the
+// scratch area's directory.
+func ScratchDirFileInfo(fi os.FileInfo) os.FileInfo {
+	return metadataViewFileInfo{FileInfo: fi, name: ScratchDirName, mode: os.ModeDir | 0700}
+}
@@ -0,0 +1,137 @@
+package mc
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScratchPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/tmp", "/", true},
+		{"/tmp/", "/", true},
+		{"/tmp/run-42/data.zip", "/run-42/data.zip", true},
+		{"tmp/data.zip", "/data.zip", true},
+		{"/tmp/../my-project/a.txt", "/my-project/a.txt", false},
+		{"/tmpfiles/a.txt", "/tmpfiles/a.txt", false},
+		{"/my-project/tmp/a.txt", "/my-project/tmp/a.txt", false},
+		{"/", "/", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, ok := ParseScratchPath(test.path)
+			require.Equal(t, test.ok, ok)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestScratchAreas(t *testing.T) {
+	root := t.TempDir()
+
+	// Scratch areas left behind by an earlier run are removed, and nothing else is.
+	leftover := filepath.Join(root, scratchPrefix+"old")
+	require.NoError(t, os.MkdirAll(filepath.Join(leftover, "run-42"), 0700))
+	other := filepath.Join(root, "keep.txt")
+	require.NoError(t, os.WriteFile(other, []byte("keep"), 0600))
+
+	areas, err := NewScratchAreas(root, 0)
+	require.NoError(t, err)
+	require.NoDirExists(t, leftover)
+	require.FileExists(t, other)
+
+	done1, done2 := make(chan struct{}), make(chan struct{})
+	area1, err := areas.ForConnection("conn-1", done1)
+	require.NoError(t, err)
+	area2, err := areas.ForConnection("conn-2", done2)
+	require.NoError(t, err)
+	require.NotEqual(t, area1.Path("/"), area2.Path("/"))
+
+	// Every session on a connection gets the same scratch area.
+	again, err := areas.ForConnection("conn-1", done1)
+	require.NoError(t, err)
+	require.Same(t, area1, again)
+
+	// Paths can't escape the scratch area.
+	require.Equal(t, filepath.Join(area1.Path("/"), "etc/passwd"), area1.Path("../../etc/passwd"))
+
+	require.NoError(t, os.WriteFile(area1.Path("/data.zip"), []byte("zip"), 0600))
+
+	// Ending a connection removes its scratch area, and only its scratch area.
+	close(done1)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(area1.Path("/"))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+	require.DirExists(t, area2.Path("/"))
+
+	// A new connection with the same ID gets a new scratch area.
+	area3, err := areas.ForConnection("conn-1", make(chan struct{}))
+	require.NoError(t, err)
+	require.NotEqual(t, area1.Path("/"), area3.Path("/"))
+	require.DirExists(t, area3.Path("/"))
+}
+
+func TestScratchArea_Limit(t *testing.T) {
+	areas, err := NewScratchAreas(t.TempDir(), 10)
+	require.NoError(t, err)
+	area, err := areas.ForConnection("conn-1", make(chan struct{}))
+	require.NoError(t, err)
+
+	f, err := area.OpenFile("/a.dat", os.O_RDWR|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteAt([]byte("012345"), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), area.Used())
+
+	// Rewriting data the file already holds doesn't use any more of the area.
+	_, err = f.WriteAt([]byte("abc"), 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), area.Used())
+
+	// Neither a write nor a truncate can take the area past its limit, including from another file.
+	_, err = f.WriteAt([]byte("6789X"), 6)
+	require.ErrorIs(t, err, ErrScratchFull)
+	require.ErrorIs(t, err, syscall.ENOSPC)
+	require.ErrorIs(t, area.Truncate("/a.dat", 11), ErrScratchFull)
+
+	g, err := area.OpenFile("/b.dat", os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	defer g.Close()
+	_, err = g.WriteAt([]byte("01234"), 0)
+	require.ErrorIs(t, err, ErrScratchFull)
+	_, err = g.WriteAt([]byte("0123"), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), area.Used())
+
+	fi, err := os.Stat(area.Path("/a.dat"))
+	require.NoError(t, err)
+	require.Equal(t, int64(6), fi.Size(), "A write past the limit shouldn't write anything")
+
+	// Shrinking, truncating on open and removing files give the space back.
+	require.NoError(t, area.Truncate("/a.dat", 2))
+	require.Equal(t, int64(6), area.Used())
+
+	h, err := area.OpenFile("/b.dat", os.O_WRONLY|os.O_TRUNC, 0600)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+	require.Equal(t, int64(2), area.Used())
+
+	require.NoError(t, area.Remove("/a.dat"))
+	require.Equal(t, int64(0), area.Used())
+
+	_, err = g.WriteAt([]byte("0123456789"), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), area.Used())
+}
@@ -0,0 +1,89 @@
+package mc
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// The SSH environment variables that clients can send as hints, for example with
+// ssh -o SetEnv=MC_PROJECT=my-project. The locale variables (LC_ALL, LC_MESSAGES and LANG), which
+// many ssh clients send by default, are also used. Other environment variables are ignored.
+const (
+	// EnvProject is the slug of the session's default project. Relative paths are resolved
+	// against it (see SessionEnv.ResolvePath).
+	EnvProject = "MC_PROJECT"
+
+	// EnvUploadTag is a tag that is attached to each file uploaded in the session.
+	EnvUploadTag = "MC_UPLOAD_TAG"
+)
+
+// maxUploadTagLength is the longest tag Materials Commons accepts.
+const maxUploadTagLength = 255
+
+// SessionEnv holds the hints a client sent as SSH environment variables.
+type SessionEnv struct {
+	// Project is the slug from EnvProject, or blank if it wasn't set.
+	Project string
+
+	// UploadTag is the tag from EnvUploadTag, or blank if it wasn't set.
+	UploadTag string
+
+	// Language is the language, such as "de", from the client's locale that user-facing errors are
+	// translated into (see Localize). It is blank for English, or when the client didn't send a locale.
+	Language string
+}
+
+// ParseSessionEnv gets the SessionEnv from environ, a list of key=value strings as returned by
+// ssh.Session.Environ(). Invalid values are logged and ignored, rather than failing the session.
+func ParseSessionEnv(environ []string) SessionEnv {
+	var env SessionEnv
+	locales := make(map[string]string)
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+
+		switch parts[0] {
+		case EnvProject:
+			if value == "" || strings.ContainsAny(value, "/\\") || value == "." || value == ".." {
+				log.Errorf("Ignoring invalid %s '%s'", EnvProject, value)
+				continue
+			}
+			env.Project = value
+		case EnvUploadTag:
+			if value == "" || len(value) > maxUploadTagLength {
+				log.Errorf("Ignoring invalid %s '%s'", EnvUploadTag, value)
+				continue
+			}
+			env.UploadTag = value
+		case "LC_ALL", "LC_MESSAGES", "LANG":
+			locales[parts[0]] = value
+		}
+	}
+
+	// LC_ALL overrides LC_MESSAGES, which overrides LANG.
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locales[key] != "" {
+			env.Language = LocaleLanguage(locales[key])
+			break
+		}
+	}
+
+	return env
+}
+
+// ResolvePath returns path with relative paths resolved against the default project, so that with
+// MC_PROJECT=my-project the path data/file.txt is /my-project/data/file.txt. Absolute paths, and all
+// paths when there is no default project, are returned unchanged.
+func (e SessionEnv) ResolvePath(path string) string {
+	if e.Project == "" || strings.HasPrefix(path, "/") {
+		return path
+	}
+
+	return filepath.Join("/", e.Project, path)
+}
@@ -0,0 +1,38 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSessionEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		environ  []string
+		expected SessionEnv
+	}{
+		{"No hints", []string{"LANG=en_US.UTF-8"}, SessionEnv{}},
+		{"Project and tag", []string{"MC_PROJECT=my-project", "MC_UPLOAD_TAG=run-42"}, SessionEnv{Project: "my-project", UploadTag: "run-42"}},
+		{"Project with a slash is ignored", []string{"MC_PROJECT=my-project/dir"}, SessionEnv{}},
+		{"Blank values are ignored", []string{"MC_PROJECT=", "MC_UPLOAD_TAG= "}, SessionEnv{}},
+		{"Tag can contain =", []string{"MC_UPLOAD_TAG=a=b"}, SessionEnv{UploadTag: "a=b"}},
+		{"Language from LANG", []string{"LANG=de_DE.UTF-8"}, SessionEnv{Language: "de"}},
+		{"LC_ALL overrides LANG", []string{"LANG=de_DE.UTF-8", "LC_ALL=fr_FR.UTF-8"}, SessionEnv{Language: "fr"}},
+		{"English needs no translation", []string{"LANG=en_US.UTF-8"}, SessionEnv{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, ParseSessionEnv(test.environ))
+		})
+	}
+}
+
+func TestSessionEnv_ResolvePath(t *testing.T) {
+	env := SessionEnv{Project: "my-project"}
+	require.Equal(t, "/my-project/data/file.txt", env.ResolvePath("data/file.txt"))
+	require.Equal(t, "/my-project", env.ResolvePath("."))
+	require.Equal(t, "/other/file.txt", env.ResolvePath("/other/file.txt"))
+	require.Equal(t, "data/file.txt", SessionEnv{}.ResolvePath("data/file.txt"))
+}
@@ -0,0 +1,214 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// SessionRegistry tracks the open SFTP sessions on this instance, with the user and projects for each
+// session and when the session was last used. Clients such as sshfs keep their sessions open while a
+// mount is idle, and a user mounting the same project from many machines can leave dozens of sessions
+// holding handles and caches open. The registry counts these sessions per user and per project, and Reap
+// closes the sessions that haven't been used for a while.
+type SessionRegistry struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[*TrackedSession]bool
+	reaped   int64
+}
+
+// TrackedSession is a session registered with a SessionRegistry.
+type TrackedSession struct {
+	registry *SessionRegistry
+	user     string
+	started  time.Time
+	close    func()
+
+	// The fields below are protected by registry.mu.
+	lastUsed time.Time
+	projects map[string]bool
+}
+
+// NewSessionRegistry creates an empty SessionRegistry.
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		now:      time.Now,
+		sessions: make(map[*TrackedSession]bool),
+	}
+}
+
+// Register adds a session for user. close is called to close the session if it is reaped. A nil
+// SessionRegistry doesn't track sessions, and returns a nil TrackedSession.
+func (r *SessionRegistry) Register(user string, close func()) *TrackedSession {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	t := &TrackedSession{
+		registry: r,
+		user:     user,
+		started:  now,
+		close:    close,
+		lastUsed: now,
+		projects: make(map[string]bool),
+	}
+	r.sessions[t] = true
+	return t
+}
+
+// Unregister removes a session added by Register. It is called when the session ends.
+func (r *SessionRegistry) Unregister(t *TrackedSession) {
+	if r == nil || t == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, t)
+}
+
+// Touch marks the session as used.
+func (t *TrackedSession) Touch() {
+	if t == nil {
+		return
+	}
+
+	t.registry.mu.Lock()
+	defer t.registry.mu.Unlock()
+	t.lastUsed = t.registry.now()
+}
+
+// AddProject records that the session has used project.
+func (t *TrackedSession) AddProject(project string) {
+	if t == nil {
+		return
+	}
+
+	t.registry.mu.Lock()
+	defer t.registry.mu.Unlock()
+	t.projects[project] = true
+}
+
+// Track returns a wrapper around the session's channel that marks the session as used each time a
+// request is read from it. A nil TrackedSession returns rwc.
+func (t *TrackedSession) Track(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	if t == nil {
+		return rwc
+	}
+
+	return &trackedReadWriteCloser{ReadWriteCloser: rwc, session: t}
+}
+
+type trackedReadWriteCloser struct {
+	io.ReadWriteCloser
+	session *TrackedSession
+}
+
+func (t *trackedReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	if n > 0 {
+		t.session.Touch()
+	}
+
+	return n, err
+}
+
+// Reap closes the sessions that haven't been used for idle, and returns how many it closed. The closed
+// sessions stay registered until they are unregistered as they end.
+func (r *SessionRegistry) Reap(idle time.Duration) int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	now := r.now()
+	var idleSessions []*TrackedSession
+	for t := range r.sessions {
+		if now.Sub(t.lastUsed) >= idle {
+			idleSessions = append(idleSessions, t)
+			// Keep the session from being reaped again while it is closing.
+			t.lastUsed = now
+		}
+	}
+	r.reaped += int64(len(idleSessions))
+	r.mu.Unlock()
+
+	for _, t := range idleSessions {
+		log.Infof("Closing session for user %s, it has been idle for over %s", t.user, idle)
+		t.close()
+	}
+
+	return len(idleSessions)
+}
+
+// RunReaper reaps the sessions that have been idle for idle until ctx is done.
+func (r *SessionRegistry) RunReaper(ctx context.Context, idle time.Duration) {
+	interval := idle / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reap(idle)
+		}
+	}
+}
+
+// SessionCounts is a snapshot of the sessions in a SessionRegistry.
+type SessionCounts struct {
+	Sessions   int64            `json:"sessions"`
+	Reaped     int64            `json:"reaped"`
+	ByUser     map[string]int64 `json:"by_user"`
+	ByProject  map[string]int64 `json:"by_project"`
+	OldestIdle float64          `json:"oldest_idle_seconds"`
+}
+
+// Counts returns the number of open sessions, in total, for each user and for each project.
+func (r *SessionRegistry) Counts() SessionCounts {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := SessionCounts{
+		Sessions:  int64(len(r.sessions)),
+		Reaped:    r.reaped,
+		ByUser:    make(map[string]int64),
+		ByProject: make(map[string]int64),
+	}
+
+	now := r.now()
+	for t := range r.sessions {
+		counts.ByUser[t.user]++
+		for project := range t.projects {
+			counts.ByProject[project]++
+		}
+
+		if idle := now.Sub(t.lastUsed).Seconds(); idle > counts.OldestIdle {
+			counts.OldestIdle = idle
+		}
+	}
+
+	return counts
+}
+
+// String returns the session counts as JSON, so that the registry can be published with expvar.
+func (r *SessionRegistry) String() string {
+	b, _ := json.Marshal(r.Counts())
+	return string(b)
+}
@@ -0,0 +1,46 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	now := time.Now()
+	registry := NewSessionRegistry()
+	registry.now = func() time.Time { return now }
+
+	var closed []string
+	idle := registry.Register("alice", func() { closed = append(closed, "idle") })
+	active := registry.Register("alice", func() { closed = append(closed, "active") })
+	other := registry.Register("bob", func() { closed = append(closed, "other") })
+	idle.AddProject("proj")
+	active.AddProject("proj")
+	other.AddProject("other-proj")
+
+	counts := registry.Counts()
+	require.Equal(t, int64(3), counts.Sessions)
+	require.Equal(t, map[string]int64{"alice": 2, "bob": 1}, counts.ByUser)
+	require.Equal(t, map[string]int64{"proj": 2, "other-proj": 1}, counts.ByProject)
+
+	now = now.Add(10 * time.Minute)
+	active.Touch()
+	registry.Unregister(other)
+
+	require.Equal(t, 1, registry.Reap(5*time.Minute))
+	require.Equal(t, []string{"idle"}, closed)
+
+	// A reaped session isn't reaped again while it is closing.
+	require.Zero(t, registry.Reap(5*time.Minute))
+
+	registry.Unregister(idle)
+	counts = registry.Counts()
+	require.Equal(t, int64(1), counts.Sessions)
+	require.Equal(t, int64(1), counts.Reaped)
+
+	var none *SessionRegistry
+	require.Nil(t, none.Register("alice", func() {}))
+	require.Zero(t, none.Reap(time.Minute))
+}
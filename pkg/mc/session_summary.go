@@ -0,0 +1,153 @@
+package mc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// maxSummaryFailures is the number of failures a SessionSummary lists. Failures beyond that are only
+// counted.
+const maxSummaryFailures = 10
+
+// SessionSummary totals up the transfers made in a session, so that when the session ends the user can
+// be told what was transferred and what failed, and the same summary can be logged. A user checking on an
+// overnight upload otherwise has nothing to go by.
+type SessionSummary struct {
+	now     func() time.Time
+	started time.Time
+
+	mu              sync.Mutex
+	uploads         int
+	uploadedBytes   int64
+	downloads       int
+	downloadedBytes int64
+	failureCount    int
+	failures        []string
+}
+
+// NewSessionSummary creates a SessionSummary for a session starting now.
+func NewSessionSummary() *SessionSummary {
+	return &SessionSummary{now: time.Now, started: time.Now()}
+}
+
+// RecordTransfer adds a completed transfer to the summary. A nil SessionSummary records nothing.
+func (s *SessionSummary) RecordTransfer(t Transfer) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.Direction == TransferUpload {
+		s.uploads++
+		s.uploadedBytes += t.Bytes
+	} else {
+		s.downloads++
+		s.downloadedBytes += t.Bytes
+	}
+}
+
+// RecordFailure adds a failed transfer of path to the summary. Nil errors, and a nil SessionSummary, are
+// ignored.
+func (s *SessionSummary) RecordFailure(direction, path string, err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failureCount++
+	if len(s.failures) < maxSummaryFailures {
+		s.failures = append(s.failures, fmt.Sprintf("%s %s: %s", direction, path, err))
+	}
+}
+
+// Empty returns true if nothing was transferred, or failed to be, in the session, or s is nil.
+func (s *SessionSummary) Empty() bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads == 0 && s.downloads == 0 && s.failureCount == 0
+}
+
+// String returns the summary as the text shown to users, one line per fact.
+func (s *SessionSummary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := s.now().Sub(s.started)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Session summary (%s):\n", elapsed.Round(time.Second))
+	fmt.Fprintf(&b, "  uploaded %d files, %s\n", s.uploads, formatByteSize(s.uploadedBytes))
+	fmt.Fprintf(&b, "  downloaded %d files, %s\n", s.downloads, formatByteSize(s.downloadedBytes))
+	if elapsed > 0 {
+		rate := float64(s.uploadedBytes+s.downloadedBytes) / elapsed.Seconds()
+		fmt.Fprintf(&b, "  average throughput %s/s\n", formatByteSize(int64(rate)))
+	}
+
+	if s.failureCount == 0 {
+		b.WriteString("  no failures\n")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "  %d failed:\n", s.failureCount)
+	for _, failure := range s.failures {
+		fmt.Fprintf(&b, "    %s\n", failure)
+	}
+
+	if more := s.failureCount - len(s.failures); more > 0 {
+		fmt.Fprintf(&b, "    and %d more\n", more)
+	}
+
+	return b.String()
+}
+
+// Log logs the summary as a single structured entry for the session of user over protocol.
+func (s *SessionSummary) Log(protocol, user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := log.WithFields(log.Fields{
+		"protocol":         protocol,
+		"user":             user,
+		"duration":         s.now().Sub(s.started).Round(time.Second).String(),
+		"uploads":          s.uploads,
+		"uploaded_bytes":   s.uploadedBytes,
+		"downloads":        s.downloads,
+		"downloaded_bytes": s.downloadedBytes,
+		"failures":         s.failureCount,
+	})
+
+	if s.failureCount != 0 {
+		entry.Warn("Session ended with failures")
+		return
+	}
+
+	entry.Info("Session ended")
+}
+
+// formatByteSize formats n bytes with a K, M, G or T suffix, powers of 1024 as in parseByteSize.
+func formatByteSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	size := float64(n) / 1024
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f%c", size, units[unit])
+}
@@ -0,0 +1,42 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionSummary(t *testing.T) {
+	summary := NewSessionSummary()
+	require.True(t, summary.Empty())
+
+	started := summary.started
+	summary.now = func() time.Time { return started.Add(100 * time.Second) }
+
+	summary.RecordTransfer(Transfer{Direction: TransferUpload, Bytes: 300 * 1024 * 1024})
+	summary.RecordTransfer(Transfer{Direction: TransferUpload, Bytes: 100 * 1024 * 1024})
+	summary.RecordTransfer(Transfer{Direction: TransferDownload, Bytes: 512})
+	summary.RecordFailure(TransferUpload, "/proj/ok.dat", nil)
+	require.False(t, summary.Empty())
+
+	require.Equal(t, `Session summary (1m40s):
+  uploaded 2 files, 400.0M
+  downloaded 1 files, 512 bytes
+  average throughput 4.0M/s
+  no failures
+`, summary.String())
+
+	for i := 0; i < maxSummaryFailures+2; i++ {
+		summary.RecordFailure(TransferUpload, fmt.Sprintf("/proj/%d.dat", i), errors.New("disk full"))
+	}
+
+	require.Contains(t, summary.String(), "  12 failed:\n    upload /proj/0.dat: disk full\n")
+	require.Contains(t, summary.String(), "    and 2 more\n")
+
+	var nilSummary *SessionSummary
+	nilSummary.RecordTransfer(Transfer{Direction: TransferUpload})
+	require.True(t, nilSummary.Empty())
+}
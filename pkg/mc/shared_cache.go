@@ -0,0 +1,290 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// SharedCache caches project lookups, access checks, directory listings and file lookups in memory,
+// shared by all the sessions on an instance. A user who mounts the same project with sshfs from many
+// machines has a session for each mount, and each mount lists and stats the same directories, so
+// without a shared cache every mount adds the same load to the database. Use it with Middleware.
+//
+// Entries are kept for ttl. Writes made through the cached FileStore drop the project's listings and
+// file lookups straight away, but changes made by other instances, or by Materials Commons itself, are
+// only seen once the entries expire, so ttl should be short. Failed lookups aren't cached.
+type SharedCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	projects map[string]cacheEntry
+	access   map[string]cacheEntry
+
+	// files holds the listings and file lookups for each project, keyed by project ID.
+	files map[int]map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// NewSharedCache creates a SharedCache whose entries are kept for ttl.
+func NewSharedCache(ttl time.Duration) *SharedCache {
+	return &SharedCache{
+		ttl:      ttl,
+		now:      time.Now,
+		projects: make(map[string]cacheEntry),
+		access:   make(map[string]cacheEntry),
+		files:    make(map[int]map[string]cacheEntry),
+	}
+}
+
+// Middleware returns a StoreMiddleware that caches the ProjectStore's project lookups and access checks
+// when cacheProjects is true, and the FileStore's listings and file lookups when cacheFiles is true. The
+// project lookups don't need caching here when they are already cached in Redis.
+func (c *SharedCache) Middleware(cacheProjects, cacheFiles bool) StoreMiddleware {
+	var m StoreMiddleware
+	if cacheProjects {
+		m.ProjectStore = func(projectStore store.ProjectStore) store.ProjectStore {
+			return &sharedCacheProjectStore{ProjectStore: projectStore, cache: c}
+		}
+	}
+
+	if cacheFiles {
+		m.FileStore = func(fileStore store.FileStore) store.FileStore {
+			return &sharedCacheFileStore{FileStore: fileStore, cache: c}
+		}
+	}
+
+	return m
+}
+
+func (c *SharedCache) get(entries map[string]cacheEntry, key string) (interface{}, bool) {
+	entry, ok := entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if c.now().After(entry.expires) {
+		delete(entries, key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (c *SharedCache) set(entries map[string]cacheEntry, key string, value interface{}) {
+	entries[key] = cacheEntry{value: value, expires: c.now().Add(c.ttl)}
+}
+
+// projectFiles returns the file entries for projectID. c.mu must be held.
+func (c *SharedCache) projectFiles(projectID int) map[string]cacheEntry {
+	entries, ok := c.files[projectID]
+	if !ok {
+		entries = make(map[string]cacheEntry)
+		c.files[projectID] = entries
+	}
+
+	return entries
+}
+
+// invalidate drops the cached listings and file lookups for projectID.
+func (c *SharedCache) invalidate(projectID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, projectID)
+}
+
+// Prune drops the expired entries. Entries are also dropped when they are looked up after expiring,
+// so Prune only needs calling periodically to free the memory held by entries that aren't looked up
+// again.
+func (c *SharedCache) Prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, entries := range []map[string]cacheEntry{c.projects, c.access} {
+		for key, entry := range entries {
+			if now.After(entry.expires) {
+				delete(entries, key)
+			}
+		}
+	}
+
+	for projectID, entries := range c.files {
+		for key, entry := range entries {
+			if now.After(entry.expires) {
+				delete(entries, key)
+			}
+		}
+
+		if len(entries) == 0 {
+			delete(c.files, projectID)
+		}
+	}
+}
+
+// Run prunes the expired entries every ttl until ctx is done.
+func (c *SharedCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Prune()
+		}
+	}
+}
+
+// sharedCacheProjectStore caches GetProjectBySlug and UserCanAccessProject in a SharedCache.
+type sharedCacheProjectStore struct {
+	store.ProjectStore
+	cache *SharedCache
+}
+
+func (s *sharedCacheProjectStore) GetProjectBySlug(slug string) (*mcmodel.Project, error) {
+	s.cache.mu.Lock()
+	cached, ok := s.cache.get(s.cache.projects, slug)
+	s.cache.mu.Unlock()
+
+	if ok {
+		project := cached.(mcmodel.Project)
+		return &project, nil
+	}
+
+	project, err := s.ProjectStore.GetProjectBySlug(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.mu.Lock()
+	s.cache.set(s.cache.projects, slug, *project)
+	s.cache.mu.Unlock()
+
+	return project, nil
+}
+
+func (s *sharedCacheProjectStore) UserCanAccessProject(userID, projectID int) bool {
+	key := fmt.Sprintf("%d:%d", userID, projectID)
+
+	s.cache.mu.Lock()
+	cached, ok := s.cache.get(s.cache.access, key)
+	s.cache.mu.Unlock()
+
+	if ok {
+		return cached.(bool)
+	}
+
+	canAccess := s.ProjectStore.UserCanAccessProject(userID, projectID)
+
+	s.cache.mu.Lock()
+	s.cache.set(s.cache.access, key, canAccess)
+	s.cache.mu.Unlock()
+
+	return canAccess
+}
+
+// sharedCacheFileStore caches ListDirectoryByPath and GetFileByPath in a SharedCache. The cached files
+// are copied in and out of the cache, so that callers can't change each other's files. The calls that
+// change a project drop its cached entries.
+type sharedCacheFileStore struct {
+	store.FileStore
+	cache *SharedCache
+}
+
+func (s *sharedCacheFileStore) ListDirectoryByPath(projectID int, path string) ([]mcmodel.File, error) {
+	key := "list:" + path
+
+	s.cache.mu.Lock()
+	cached, ok := s.cache.get(s.cache.projectFiles(projectID), key)
+	s.cache.mu.Unlock()
+
+	if ok {
+		return append([]mcmodel.File(nil), cached.([]mcmodel.File)...), nil
+	}
+
+	files, err := s.FileStore.ListDirectoryByPath(projectID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.mu.Lock()
+	s.cache.set(s.cache.projectFiles(projectID), key, append([]mcmodel.File(nil), files...))
+	s.cache.mu.Unlock()
+
+	return files, nil
+}
+
+func (s *sharedCacheFileStore) GetFileByPath(projectID int, path string) (*mcmodel.File, error) {
+	key := "file:" + path
+
+	s.cache.mu.Lock()
+	cached, ok := s.cache.get(s.cache.projectFiles(projectID), key)
+	s.cache.mu.Unlock()
+
+	if ok {
+		file := cached.(mcmodel.File)
+		return &file, nil
+	}
+
+	file, err := s.FileStore.GetFileByPath(projectID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.mu.Lock()
+	s.cache.set(s.cache.projectFiles(projectID), key, *file)
+	s.cache.mu.Unlock()
+
+	return file, nil
+}
+
+func (s *sharedCacheFileStore) UpdateMetadataForFileAndProject(file *mcmodel.File, checksum string, totalBytes int64) error {
+	defer s.cache.invalidate(file.ProjectID)
+	return s.FileStore.UpdateMetadataForFileAndProject(file, checksum, totalBytes)
+}
+
+func (s *sharedCacheFileStore) CreateFile(name string, projectID, directoryID, ownerID int, mimeType string) (*mcmodel.File, error) {
+	defer s.cache.invalidate(projectID)
+	return s.FileStore.CreateFile(name, projectID, directoryID, ownerID, mimeType)
+}
+
+func (s *sharedCacheFileStore) CreateDirectory(parentDirID, projectID, ownerID int, path, name string) (*mcmodel.File, error) {
+	defer s.cache.invalidate(projectID)
+	return s.FileStore.CreateDirectory(parentDirID, projectID, ownerID, path, name)
+}
+
+func (s *sharedCacheFileStore) CreateDirIfNotExists(parentDirID int, path, name string, projectID, ownerID int) (*mcmodel.File, error) {
+	defer s.cache.invalidate(projectID)
+	return s.FileStore.CreateDirIfNotExists(parentDirID, path, name, projectID, ownerID)
+}
+
+func (s *sharedCacheFileStore) GetOrCreateDirPath(projectID, ownerID int, path string) (*mcmodel.File, error) {
+	defer s.cache.invalidate(projectID)
+	return s.FileStore.GetOrCreateDirPath(projectID, ownerID, path)
+}
+
+func (s *sharedCacheFileStore) UpdateFileUses(file *mcmodel.File, uuid string, fileID int) error {
+	defer s.cache.invalidate(file.ProjectID)
+	return s.FileStore.UpdateFileUses(file, uuid, fileID)
+}
+
+func (s *sharedCacheFileStore) PointAtExistingIfExists(file *mcmodel.File) (bool, error) {
+	defer s.cache.invalidate(file.ProjectID)
+	return s.FileStore.PointAtExistingIfExists(file)
+}
+
+func (s *sharedCacheFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	defer s.cache.invalidate(file.ProjectID)
+	return s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+}
@@ -0,0 +1,75 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFileStore counts the calls to ListDirectoryByPath.
+type countingFileStore struct {
+	store.FileStore
+	calls int
+}
+
+func (s *countingFileStore) ListDirectoryByPath(projectID int, path string) ([]mcmodel.File, error) {
+	s.calls++
+	return s.FileStore.ListDirectoryByPath(projectID, path)
+}
+
+func TestSharedCache(t *testing.T) {
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory", Current: true},
+		{ID: 2, ProjectID: 1, DirectoryID: 1, Name: "a.txt", Path: "/a.txt", Current: true},
+	}
+	fileStore := &countingFileStore{FileStore: store.NewFakeFileStore(files)}
+	projectStore := &countingProjectStore{ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}})}
+
+	now := time.Now()
+	cache := NewSharedCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	// Each session has its own stores, but they share the cache.
+	stores := &Stores{FileStore: fileStore, ProjectStore: projectStore}
+	session1 := stores.Use(cache.Middleware(true, true))
+	session2 := stores.Use(cache.Middleware(true, true))
+
+	for _, s := range []*Stores{session1, session2} {
+		project, err := s.ProjectStore.GetProjectBySlug("proj")
+		require.NoError(t, err)
+		require.Equal(t, 1, project.ID)
+
+		listing, err := s.FileStore.ListDirectoryByPath(1, "/")
+		require.NoError(t, err)
+		require.Len(t, listing, 1)
+	}
+	require.Equal(t, 1, projectStore.calls)
+	require.Equal(t, 1, fileStore.calls)
+
+	// Failed lookups aren't cached.
+	_, err := session1.ProjectStore.GetProjectBySlug("missing")
+	require.Error(t, err)
+	_, err = session2.ProjectStore.GetProjectBySlug("missing")
+	require.Error(t, err)
+	require.Equal(t, 3, projectStore.calls)
+
+	// A write drops the project's listings.
+	_, err = session1.FileStore.CreateFile("b.txt", 1, 1, 1, "text/plain")
+	require.NoError(t, err)
+	listing, err := session2.FileStore.ListDirectoryByPath(1, "/")
+	require.NoError(t, err)
+	require.Len(t, listing, 2)
+	require.Equal(t, 2, fileStore.calls)
+
+	// Entries expire after the ttl.
+	now = now.Add(2 * time.Minute)
+	cache.Prune()
+	require.Empty(t, cache.files)
+	require.Empty(t, cache.projects)
+	_, err = session1.FileStore.ListDirectoryByPath(1, "/")
+	require.NoError(t, err)
+	require.Equal(t, 3, fileStore.calls)
+}
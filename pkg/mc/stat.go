@@ -0,0 +1,28 @@
+package mc
+
+import (
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// StatPath returns the file or directory at path in the project. GetFileByPath looks an entry up by its
+// name in its parent directory, which misses directories in some stores, such as the project's root,
+// which has no parent, and directories that aren't marked current. Directories are looked up by their
+// path instead when GetFileByPath doesn't find them, so that clients can stat every directory they can
+// list. The error from GetFileByPath is returned when neither finds the path.
+func StatPath(fileStore store.FileStore, projectID int, path string) (*mcmodel.File, error) {
+	if path == "/" {
+		return fileStore.GetDirByPath(projectID, path)
+	}
+
+	file, err := fileStore.GetFileByPath(projectID, path)
+	if err == nil {
+		return file, nil
+	}
+
+	if dir, dirErr := fileStore.GetDirByPath(projectID, path); dirErr == nil {
+		return dir, nil
+	}
+
+	return nil, err
+}
@@ -0,0 +1,46 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatPath(t *testing.T) {
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", DirectoryID: 1, MimeType: "directory"},
+		// A directory whose name doesn't match its path isn't found in its parent.
+		{ID: 3, ProjectID: 1, Name: "Renamed", Path: "/raw/run1", DirectoryID: 2, MimeType: "directory"},
+		{ID: 4, ProjectID: 1, Name: "a.tif", DirectoryID: 2, MimeType: "image/tiff"},
+	}
+	fileStore := store.NewFakeFileStore(files)
+
+	tests := []struct {
+		path       string
+		expectedID int
+	}{
+		{"/", 1},
+		{"/raw", 2},
+		{"/raw/run1", 3},
+		{"/raw/a.tif", 4},
+		{"/raw/b.tif", 0},
+		{"/missing", 0},
+	}
+
+	for _, test := range tests {
+		file, err := StatPath(fileStore, 1, test.path)
+		if test.expectedID == 0 {
+			require.Error(t, err, "%s shouldn't exist", test.path)
+			continue
+		}
+
+		require.NoError(t, err, "%s should exist", test.path)
+		require.Equal(t, test.expectedID, file.ID)
+	}
+
+	_, err := StatPath(fileStore, 2, "/raw")
+	require.Error(t, err)
+}
@@ -0,0 +1,309 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// The kinds of problem found by a StorageVerifier.
+const (
+	// VerifyMismatch is a file whose data doesn't match the checksum or size recorded for it.
+	VerifyMismatch = "mismatch"
+
+	// VerifyMissing is a file whose data doesn't exist.
+	VerifyMissing = "missing"
+
+	// VerifyUnreadable is a file whose data couldn't be read.
+	VerifyUnreadable = "unreadable"
+
+	// VerifyOrphan is data under the mcfs root that no file record uses.
+	VerifyOrphan = "orphan"
+)
+
+// VerifyProblem is a single problem found by a StorageVerifier. It is written to the report as a line of
+// JSON. Orphans only have the Kind, UUID and UnderlyingPath set.
+type VerifyProblem struct {
+	Kind             string `json:"kind"`
+	FileID           int    `json:"file_id,omitempty"`
+	ProjectID        int    `json:"project_id,omitempty"`
+	Path             string `json:"path,omitempty"`
+	UUID             string `json:"uuid"`
+	UnderlyingPath   string `json:"underlying_path"`
+	ExpectedChecksum string `json:"expected_checksum,omitempty"`
+	ActualChecksum   string `json:"actual_checksum,omitempty"`
+	ExpectedSize     uint64 `json:"expected_size,omitempty"`
+	ActualSize       int64  `json:"actual_size,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// VerifyResult counts the files checked by a StorageVerifier, and the problems found.
+type VerifyResult struct {
+	Checked    int
+	Mismatched int
+	Missing    int
+	Unreadable int
+	Orphans    int
+}
+
+func (r VerifyResult) String() string {
+	return fmt.Sprintf("%d checked, %d mismatched, %d missing, %d unreadable, %d orphans",
+		r.Checked, r.Mismatched, r.Missing, r.Unreadable, r.Orphans)
+}
+
+// Problems returns the number of problems found.
+func (r VerifyResult) Problems() int {
+	return r.Mismatched + r.Missing + r.Unreadable + r.Orphans
+}
+
+// StorageVerifier audits the integrity of the stored files. It re-hashes the data for each finalized file
+// and reports the files whose data doesn't match the checksum and size in the database, or is missing.
+// When auditing every project it also reports orphans, data under the mcfs root that isn't used by any
+// file. Each problem is written to Report as a line of JSON, so that the report can be processed by
+// scripts. Nothing is changed, except that DamagedOnly clears the damaged flags of intact files.
+type StorageVerifier struct {
+	stores   *Stores
+	mcfsRoot string
+
+	// ProjectIDs limits the audit to these projects. When it is empty every project is audited, and the
+	// mcfs root is searched for orphans.
+	ProjectIDs []int
+
+	// DamagedOnly limits the audit to the files flagged as damaged when they were used (see
+	// ReportMissingData), and clears the flags of the files found to be intact, for example after their
+	// data has been restored. The mcfs root isn't searched for orphans.
+	DamagedOnly bool
+
+	// BatchSize is the number of files loaded at a time, and the number of uuids checked at a time when
+	// searching for orphans.
+	BatchSize int
+
+	// Report receives the problems found. When it is nil the problems are only counted.
+	Report io.Writer
+}
+
+func NewStorageVerifier(stores *Stores, mcfsRoot string) *StorageVerifier {
+	return &StorageVerifier{
+		stores:    stores,
+		mcfsRoot:  mcfsRoot,
+		BatchSize: 500,
+	}
+}
+
+// Run audits the files. An error is returned when the files couldn't be listed or the report couldn't be
+// written, the problems found with individual files are reported and counted in the result.
+func (v *StorageVerifier) Run(ctx context.Context) (VerifyResult, error) {
+	var result VerifyResult
+	var report *json.Encoder
+	if v.Report != nil {
+		report = json.NewEncoder(v.Report)
+	}
+
+	afterID := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		files, err := v.listFiles(ctx, afterID)
+		if err != nil {
+			log.Errorf("Unable to load files to verify: %s", err)
+			return result, err
+		}
+
+		if len(files) == 0 {
+			break
+		}
+
+		for i := range files {
+			problem := v.verifyFile(&files[i], &result)
+			if problem == nil && v.DamagedOnly {
+				v.clearDamaged(ctx, files[i].ID)
+			}
+
+			if err := v.report(report, problem); err != nil {
+				return result, err
+			}
+			afterID = files[i].ID
+		}
+	}
+
+	if len(v.ProjectIDs) != 0 || v.DamagedOnly {
+		return result, nil
+	}
+
+	return result, v.findOrphans(ctx, report, &result)
+}
+
+// listFiles returns the next batch of files to audit, those with an ID greater than afterID.
+func (v *StorageVerifier) listFiles(ctx context.Context, afterID int) ([]mcmodel.File, error) {
+	stores := v.stores.WithContext(ctx)
+	if v.DamagedOnly {
+		return stores.DamagedFileStore.ListDamagedFiles(v.ProjectIDs, afterID, v.BatchSize)
+	}
+
+	return stores.FileAuditStore.ListStoredFiles(v.ProjectIDs, afterID, v.BatchSize)
+}
+
+// clearDamaged removes the damaged flag from a file found to be intact. Failing to is only logged, since
+// the file will be checked again by the next audit.
+func (v *StorageVerifier) clearDamaged(ctx context.Context, fileID int) {
+	if err := v.stores.WithContext(ctx).DamagedFileStore.ClearFileDamaged(fileID); err != nil {
+		log.Errorf("Unable to clear the damaged flag of file %d: %s", fileID, err)
+	}
+}
+
+// verifyFile checks a single file's data and updates result. It returns the problem found, or nil.
+func (v *StorageVerifier) verifyFile(file *mcmodel.File, result *VerifyResult) *VerifyProblem {
+	result.Checked++
+
+	if !hasUnderlyingPath(file) {
+		result.Unreadable++
+		return &VerifyProblem{Kind: VerifyUnreadable, FileID: file.ID, ProjectID: file.ProjectID, UUID: file.UUIDForPath(),
+			Error: "invalid uuid"}
+	}
+
+	underlyingPath := file.ToUnderlyingFilePath(v.mcfsRoot)
+	problem := &VerifyProblem{
+		FileID:           file.ID,
+		ProjectID:        file.ProjectID,
+		UUID:             file.UUIDForPath(),
+		UnderlyingPath:   underlyingPath,
+		ExpectedChecksum: file.Checksum,
+		ExpectedSize:     file.Size,
+	}
+
+	if file.Directory != nil {
+		problem.Path = file.FullPath()
+	}
+
+	checksum, size, err := checksumFile(underlyingPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		problem.Kind = VerifyMissing
+		result.Missing++
+	case err != nil:
+		problem.Kind = VerifyUnreadable
+		problem.Error = err.Error()
+		result.Unreadable++
+	case checksum != file.Checksum || uint64(size) != file.Size:
+		problem.Kind = VerifyMismatch
+		problem.ActualChecksum = checksum
+		problem.ActualSize = size
+		result.Mismatched++
+	default:
+		return nil
+	}
+
+	return problem
+}
+
+// findOrphans searches the mcfs root for data that isn't used by any file, and updates result. Only the
+// files laid out the way file data is stored, in mcfsRoot/xx/yy/uuid, are considered.
+func (v *StorageVerifier) findOrphans(ctx context.Context, report *json.Encoder, result *VerifyResult) error {
+	var batch []string
+	paths := make(map[string]string)
+
+	checkBatch := func() error {
+		referenced, err := v.stores.WithContext(ctx).FileAuditStore.ReferencedUUIDs(batch)
+		if err != nil {
+			log.Errorf("Unable to look up file uuids: %s", err)
+			return err
+		}
+
+		for _, uuid := range batch {
+			if referenced[uuid] {
+				continue
+			}
+
+			result.Orphans++
+			if err := v.report(report, &VerifyProblem{Kind: VerifyOrphan, UUID: uuid, UnderlyingPath: paths[uuid]}); err != nil {
+				return err
+			}
+		}
+
+		batch = batch[:0]
+		paths = make(map[string]string)
+		return nil
+	}
+
+	err := filepath.WalkDir(v.mcfsRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(v.mcfsRoot, path)
+		parts := strings.Split(rel, string(filepath.Separator))
+
+		if d.IsDir() {
+			// Only descend into the two levels of directories that hold the file data.
+			if rel != "." && (len(parts) > 2 || len(parts[len(parts)-1]) != 2) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if len(parts) != 3 || !d.Type().IsRegular() || !isDataFileName(parts[0]+parts[1], parts[2]) {
+			return nil
+		}
+
+		batch = append(batch, parts[2])
+		paths[parts[2]] = path
+		if len(batch) < v.BatchSize {
+			return nil
+		}
+
+		return checkBatch()
+	})
+
+	if err != nil {
+		log.Errorf("Unable to search %s for orphans: %s", v.mcfsRoot, err)
+		return err
+	}
+
+	if len(batch) != 0 {
+		return checkBatch()
+	}
+
+	return nil
+}
+
+// isDataFileName returns true if name is a uuid that is stored in the directories named dirs, as
+// mcmodel.File.ToUnderlyingFilePath lays out file data.
+func isDataFileName(dirs, name string) bool {
+	uuidParts := strings.Split(name, "-")
+	return len(name) == 36 && len(uuidParts) == 5 && len(uuidParts[1]) == 4 && uuidParts[1] == dirs
+}
+
+// hasUnderlyingPath returns true if file has a uuid that mcmodel.File.ToUnderlyingFilePath can lay out.
+func hasUnderlyingPath(file *mcmodel.File) bool {
+	uuidParts := strings.Split(file.UUIDForPath(), "-")
+	return len(uuidParts) == 5 && len(uuidParts[1]) == 4
+}
+
+// report writes problem to the report, if there is one.
+func (v *StorageVerifier) report(report *json.Encoder, problem *VerifyProblem) error {
+	if problem == nil || report == nil {
+		return nil
+	}
+
+	if err := report.Encode(problem); err != nil {
+		log.Errorf("Unable to write verification report: %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageVerifier_Run(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	dir := &mcmodel.File{ID: 1, Name: "/", Path: "/", ProjectID: 1, MimeType: "directory"}
+
+	// "data" has the md5 checksum 8d777f385d3dfec8815d20f7496026dc.
+	good := mcmodel.File{ID: 10, Name: "good.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", Checksum: "8d777f385d3dfec8815d20f7496026dc", Size: 4}
+	shared := mcmodel.File{ID: 11, Name: "shared.txt", ProjectID: 2, DirectoryID: 1, Directory: dir,
+		UUID: "bbbbbbbb-cccc-cccc-dddd-eeeeeeeeeeee", UsesUUID: good.UUID, Checksum: good.Checksum, Size: 4}
+	corrupt := mcmodel.File{ID: 12, Name: "corrupt.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "cccccccc-bbbb-cccc-dddd-eeeeeeeeeeee", Checksum: good.Checksum, Size: 4}
+	missing := mcmodel.File{ID: 13, Name: "missing.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "dddddddd-bbbb-cccc-dddd-eeeeeeeeeeee", Checksum: good.Checksum, Size: 4}
+	orphan := mcmodel.File{UUID: "eeeeeeee-bbbb-cccc-dddd-eeeeeeeeeeee"}
+
+	for file, contents := range map[*mcmodel.File]string{&good: "data", &corrupt: "date", &orphan: "lost"} {
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0777))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), []byte(contents), 0666))
+	}
+
+	// Files that aren't laid out like file data aren't orphans.
+	require.NoError(t, os.MkdirAll(filepath.Join(mcfsRoot, "conversions"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(mcfsRoot, "conversions", orphan.UUID), []byte("x"), 0666))
+
+	stores := &Stores{FileAuditStore: NewFakeFileAuditStore(*dir, good, shared, corrupt, missing)}
+
+	var report bytes.Buffer
+	verifier := NewStorageVerifier(stores, mcfsRoot)
+	verifier.BatchSize = 2
+	verifier.Report = &report
+
+	result, err := verifier.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, VerifyResult{Checked: 4, Mismatched: 1, Missing: 1, Orphans: 1}, result)
+
+	var problems []VerifyProblem
+	decoder := json.NewDecoder(&report)
+	for decoder.More() {
+		var problem VerifyProblem
+		require.NoError(t, decoder.Decode(&problem))
+		problems = append(problems, problem)
+	}
+
+	require.Len(t, problems, 3)
+	require.Equal(t, VerifyMismatch, problems[0].Kind)
+	require.Equal(t, corrupt.ID, problems[0].FileID)
+	require.Equal(t, "/corrupt.txt", problems[0].Path)
+	require.Equal(t, VerifyMissing, problems[1].Kind)
+	require.Equal(t, missing.ID, problems[1].FileID)
+	require.Equal(t, VerifyOrphan, problems[2].Kind)
+	require.Equal(t, orphan.UUID, problems[2].UUID)
+
+	// A project subset isn't searched for orphans.
+	verifier.ProjectIDs = []int{2}
+	verifier.Report = nil
+	result, err = verifier.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, VerifyResult{Checked: 1}, result)
+}
+
+func TestStorageVerifier_DamagedOnly(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	dir := &mcmodel.File{ID: 1, Name: "/", Path: "/", ProjectID: 1, MimeType: "directory"}
+	restored := mcmodel.File{ID: 10, Name: "restored.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", Checksum: "8d777f385d3dfec8815d20f7496026dc", Size: 4}
+	missing := mcmodel.File{ID: 11, Name: "missing.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "bbbbbbbb-bbbb-cccc-dddd-eeeeeeeeeeee", Checksum: restored.Checksum, Size: 4}
+	intact := mcmodel.File{ID: 12, Name: "intact.txt", ProjectID: 1, DirectoryID: 1, Directory: dir,
+		UUID: "cccccccc-bbbb-cccc-dddd-eeeeeeeeeeee", Checksum: restored.Checksum, Size: 4}
+
+	damagedStore := NewFakeDamagedFileStore(restored, missing, intact)
+	stores := &Stores{DamagedFileStore: damagedStore}
+	events := &eventCollector{}
+
+	// Both files are flagged when their data is found to be missing.
+	for _, file := range []mcmodel.File{restored, missing} {
+		file := file
+		err := ReportMissingData(stores, events, &file, Transfer{Protocol: "sftp", ProjectID: 1, Path: "/" + file.Name})
+		require.ErrorIs(t, err, ErrFileDataMissing)
+		require.False(t, os.IsNotExist(err), "The error is distinct from a file that doesn't exist")
+	}
+
+	require.Len(t, damagedStore.Damaged, 2)
+	require.Equal(t, VerifyMissing, damagedStore.Damaged[missing.ID].Reason)
+	require.Len(t, events.events, 2)
+	require.Equal(t, EventFileDataMissing, events.events[0].Type)
+
+	// The data of one of them is then restored.
+	require.NoError(t, os.MkdirAll(restored.ToUnderlyingDirPath(mcfsRoot), 0777))
+	require.NoError(t, os.WriteFile(restored.ToUnderlyingFilePath(mcfsRoot), []byte("data"), 0666))
+
+	verifier := NewStorageVerifier(stores, mcfsRoot)
+	verifier.DamagedOnly = true
+	result, err := verifier.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, VerifyResult{Checked: 2, Missing: 1}, result, "Only the flagged files are checked")
+
+	require.Len(t, damagedStore.Damaged, 1, "The restored file's flag is cleared")
+	require.Contains(t, damagedStore.Damaged, missing.ID)
+}
@@ -1,23 +1,320 @@
 package mc
 
 import (
+	"context"
+
 	"github.com/materials-commons/gomcdb/store"
 	"gorm.io/gorm"
 )
 
 // Stores is a place to consolidate the various stores that are used by the handlers. It
 // allows the stores to be easily created and cleans up the number of parameters that need
-// to be passed in to create a mcscp.Handler or mcsftp.Handler.
+// to be passed in to create a mcscp.Handler or mcsftp.Handler. Cross-cutting behavior can be
+// layered on top of the stores with StoreMiddleware (see Stores.Use).
 type Stores struct {
-	FileStore       store.FileStore
-	ProjectStore    store.ProjectStore
-	ConversionStore store.ConversionStore
+	FileStore        store.FileStore
+	ProjectStore     store.ProjectStore
+	ConversionStore  store.ConversionStore
+	PendingFileStore PendingFileStore
+	VersionStore     VersionStore
+	LinkStore        LinkStore
+
+	ProjectCreateStore  ProjectCreateStore
+	TagStore            TagStore
+	MetadataStore       MetadataStore
+	ProjectMemberStore  ProjectMemberStore
+	FileAuditStore      FileAuditStore
+	ProjectNetworkStore ProjectNetworkStore
+	GuestStore          GuestStore
+	TokenStore          TokenStore
+	FileAccessStore     FileAccessStore
+	ListingStore        ListingStore
+	DamagedFileStore    DamagedFileStore
+
+	ProjectSlugAliasStore ProjectSlugAliasStore
+	ResumableUploadStore  ResumableUploadStore
+	UserUsageStore        UserUsageStore
+	SymlinkStore          SymlinkStore
+	FeatureFlagStore      FeatureFlagStore
+	UploadProvenanceStore UploadProvenanceStore
+
+	ProjectExtractPathStore ProjectExtractPathStore
+
+	// withContext creates a copy of the stores whose database calls are bound to a context. It
+	// is nil for stores that can't be bound to a context, such as the fake stores used in testing.
+	withContext func(ctx context.Context) *Stores
+
+	// transaction runs fn with a copy of the stores whose database calls are all made in a single
+	// transaction. It is nil for stores that don't support transactions.
+	transaction func(fn func(tx *Stores) error) error
+
+	// forSession creates a copy of the stores for a single session. It is nil for stores that don't
+	// keep any per session state.
+	forSession func() *Stores
 }
 
 func NewGormStores(db *gorm.DB, mcfsRoot string) *Stores {
+	stores := newGormStores(db, mcfsRoot)
+	stores.withContext = func(ctx context.Context) *Stores {
+		return NewGormStores(db.WithContext(ctx), mcfsRoot)
+	}
+
+	stores.transaction = func(fn func(tx *Stores) error) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			return fn(newGormStores(tx, mcfsRoot))
+		})
+	}
+
+	return stores
+}
+
+func newGormStores(db *gorm.DB, mcfsRoot string) *Stores {
 	return &Stores{
-		FileStore:       store.NewGormFileStore(db, mcfsRoot),
-		ProjectStore:    store.NewGormProjectStore(db),
-		ConversionStore: store.NewGormConversionStore(db),
+		FileStore:        store.NewGormFileStore(db, mcfsRoot),
+		ProjectStore:     store.NewGormProjectStore(db),
+		ConversionStore:  store.NewGormConversionStore(db),
+		PendingFileStore: NewGormPendingFileStore(db),
+		VersionStore:     NewGormVersionStore(db),
+		LinkStore:        NewGormLinkStore(db),
+
+		ProjectCreateStore:  NewGormProjectCreateStore(db),
+		TagStore:            NewGormTagStore(db),
+		MetadataStore:       NewGormMetadataStore(db),
+		ProjectMemberStore:  NewGormProjectMemberStore(db),
+		FileAuditStore:      NewGormFileAuditStore(db),
+		ProjectNetworkStore: NewGormProjectNetworkStore(db),
+		GuestStore:          NewGormGuestStore(db),
+		TokenStore:          NewGormTokenStore(db),
+		FileAccessStore:     NewGormFileAccessStore(db),
+		ListingStore:        NewGormListingStore(db),
+		DamagedFileStore:    NewGormDamagedFileStore(db),
+
+		ProjectSlugAliasStore: NewGormProjectSlugAliasStore(db),
+		ResumableUploadStore:  NewGormResumableUploadStore(db),
+		UserUsageStore:        NewGormUserUsageStore(db),
+		SymlinkStore:          NewGormSymlinkStore(db),
+		FeatureFlagStore:      NewGormFeatureFlagStore(db),
+		UploadProvenanceStore: NewGormUploadProvenanceStore(db),
+
+		ProjectExtractPathStore: NewGormProjectExtractPathStore(db),
+	}
+}
+
+// WithContext returns a copy of the stores whose database calls are canceled when ctx is done. If
+// the stores can't be bound to a context then s is returned.
+func (s *Stores) WithContext(ctx context.Context) *Stores {
+	if s.withContext == nil {
+		return s
+	}
+
+	return s.withContext(ctx)
+}
+
+// Transaction calls fn with a copy of the stores whose database calls are all made in a single
+// transaction. The transaction is committed if fn returns nil, otherwise it is rolled back. If
+// the stores don't support transactions then fn is called with s.
+func (s *Stores) Transaction(fn func(tx *Stores) error) error {
+	if s.transaction == nil {
+		return fn(s)
+	}
+
+	return s.transaction(fn)
+}
+
+// ForSession returns a copy of the stores for a single SSH session, or command. Stores that route calls
+// by what the session has done, such as the read replica stores (see NewGormStoresWithReadReplica), keep
+// that state in the copy. If the stores don't keep any per session state then s is returned.
+func (s *Stores) ForSession() *Stores {
+	if s.forSession == nil {
+		return s
 	}
+
+	return s.forSession()
+}
+
+// StoreMiddleware wraps stores to add cross-cutting behavior such as caching, tracing or retries.
+// Each field is optional, a nil field leaves that store unwrapped.
+type StoreMiddleware struct {
+	FileStore        func(fileStore store.FileStore) store.FileStore
+	ProjectStore     func(projectStore store.ProjectStore) store.ProjectStore
+	ConversionStore  func(conversionStore store.ConversionStore) store.ConversionStore
+	PendingFileStore func(pendingFileStore PendingFileStore) PendingFileStore
+	VersionStore     func(versionStore VersionStore) VersionStore
+	LinkStore        func(linkStore LinkStore) LinkStore
+
+	ProjectCreateStore  func(projectCreateStore ProjectCreateStore) ProjectCreateStore
+	TagStore            func(tagStore TagStore) TagStore
+	MetadataStore       func(metadataStore MetadataStore) MetadataStore
+	ProjectMemberStore  func(projectMemberStore ProjectMemberStore) ProjectMemberStore
+	FileAuditStore      func(fileAuditStore FileAuditStore) FileAuditStore
+	ProjectNetworkStore func(projectNetworkStore ProjectNetworkStore) ProjectNetworkStore
+	GuestStore          func(guestStore GuestStore) GuestStore
+	TokenStore          func(tokenStore TokenStore) TokenStore
+	FileAccessStore     func(fileAccessStore FileAccessStore) FileAccessStore
+	ListingStore        func(listingStore ListingStore) ListingStore
+	DamagedFileStore    func(damagedFileStore DamagedFileStore) DamagedFileStore
+
+	ProjectSlugAliasStore func(projectSlugAliasStore ProjectSlugAliasStore) ProjectSlugAliasStore
+	ResumableUploadStore  func(resumableUploadStore ResumableUploadStore) ResumableUploadStore
+	UserUsageStore        func(userUsageStore UserUsageStore) UserUsageStore
+	SymlinkStore          func(symlinkStore SymlinkStore) SymlinkStore
+	FeatureFlagStore      func(featureFlagStore FeatureFlagStore) FeatureFlagStore
+	UploadProvenanceStore func(uploadProvenanceStore UploadProvenanceStore) UploadProvenanceStore
+
+	ProjectExtractPathStore func(projectExtractPathStore ProjectExtractPathStore) ProjectExtractPathStore
+}
+
+// Use returns a copy of the stores wrapped by each of the middleware. The middleware are applied in
+// order, so the last middleware is the outermost wrapper and sees each call first. The wrapping is
+// preserved by WithContext, Transaction and ForSession.
+func (s *Stores) Use(middleware ...StoreMiddleware) *Stores {
+	wrapped := &Stores{
+		FileStore:        s.FileStore,
+		ProjectStore:     s.ProjectStore,
+		ConversionStore:  s.ConversionStore,
+		PendingFileStore: s.PendingFileStore,
+		VersionStore:     s.VersionStore,
+		LinkStore:        s.LinkStore,
+
+		ProjectCreateStore:  s.ProjectCreateStore,
+		TagStore:            s.TagStore,
+		MetadataStore:       s.MetadataStore,
+		ProjectMemberStore:  s.ProjectMemberStore,
+		FileAuditStore:      s.FileAuditStore,
+		ProjectNetworkStore: s.ProjectNetworkStore,
+		GuestStore:          s.GuestStore,
+		TokenStore:          s.TokenStore,
+		FileAccessStore:     s.FileAccessStore,
+		ListingStore:        s.ListingStore,
+		DamagedFileStore:    s.DamagedFileStore,
+
+		ProjectSlugAliasStore: s.ProjectSlugAliasStore,
+		ResumableUploadStore:  s.ResumableUploadStore,
+		UserUsageStore:        s.UserUsageStore,
+		SymlinkStore:          s.SymlinkStore,
+		FeatureFlagStore:      s.FeatureFlagStore,
+		UploadProvenanceStore: s.UploadProvenanceStore,
+
+		ProjectExtractPathStore: s.ProjectExtractPathStore,
+	}
+
+	for _, m := range middleware {
+		if m.FileStore != nil {
+			wrapped.FileStore = m.FileStore(wrapped.FileStore)
+		}
+
+		if m.ProjectStore != nil {
+			wrapped.ProjectStore = m.ProjectStore(wrapped.ProjectStore)
+		}
+
+		if m.ConversionStore != nil {
+			wrapped.ConversionStore = m.ConversionStore(wrapped.ConversionStore)
+		}
+
+		if m.PendingFileStore != nil {
+			wrapped.PendingFileStore = m.PendingFileStore(wrapped.PendingFileStore)
+		}
+
+		if m.VersionStore != nil {
+			wrapped.VersionStore = m.VersionStore(wrapped.VersionStore)
+		}
+
+		if m.LinkStore != nil {
+			wrapped.LinkStore = m.LinkStore(wrapped.LinkStore)
+		}
+
+		if m.ProjectCreateStore != nil {
+			wrapped.ProjectCreateStore = m.ProjectCreateStore(wrapped.ProjectCreateStore)
+		}
+
+		if m.TagStore != nil {
+			wrapped.TagStore = m.TagStore(wrapped.TagStore)
+		}
+
+		if m.MetadataStore != nil {
+			wrapped.MetadataStore = m.MetadataStore(wrapped.MetadataStore)
+		}
+
+		if m.ProjectMemberStore != nil {
+			wrapped.ProjectMemberStore = m.ProjectMemberStore(wrapped.ProjectMemberStore)
+		}
+
+		if m.FileAuditStore != nil {
+			wrapped.FileAuditStore = m.FileAuditStore(wrapped.FileAuditStore)
+		}
+
+		if m.ProjectNetworkStore != nil {
+			wrapped.ProjectNetworkStore = m.ProjectNetworkStore(wrapped.ProjectNetworkStore)
+		}
+
+		if m.GuestStore != nil {
+			wrapped.GuestStore = m.GuestStore(wrapped.GuestStore)
+		}
+
+		if m.TokenStore != nil {
+			wrapped.TokenStore = m.TokenStore(wrapped.TokenStore)
+		}
+
+		if m.FileAccessStore != nil {
+			wrapped.FileAccessStore = m.FileAccessStore(wrapped.FileAccessStore)
+		}
+
+		if m.ListingStore != nil {
+			wrapped.ListingStore = m.ListingStore(wrapped.ListingStore)
+		}
+
+		if m.DamagedFileStore != nil {
+			wrapped.DamagedFileStore = m.DamagedFileStore(wrapped.DamagedFileStore)
+		}
+
+		if m.ProjectSlugAliasStore != nil {
+			wrapped.ProjectSlugAliasStore = m.ProjectSlugAliasStore(wrapped.ProjectSlugAliasStore)
+		}
+
+		if m.ResumableUploadStore != nil {
+			wrapped.ResumableUploadStore = m.ResumableUploadStore(wrapped.ResumableUploadStore)
+		}
+
+		if m.UserUsageStore != nil {
+			wrapped.UserUsageStore = m.UserUsageStore(wrapped.UserUsageStore)
+		}
+
+		if m.SymlinkStore != nil {
+			wrapped.SymlinkStore = m.SymlinkStore(wrapped.SymlinkStore)
+		}
+
+		if m.FeatureFlagStore != nil {
+			wrapped.FeatureFlagStore = m.FeatureFlagStore(wrapped.FeatureFlagStore)
+		}
+
+		if m.UploadProvenanceStore != nil {
+			wrapped.UploadProvenanceStore = m.UploadProvenanceStore(wrapped.UploadProvenanceStore)
+		}
+
+		if m.ProjectExtractPathStore != nil {
+			wrapped.ProjectExtractPathStore = m.ProjectExtractPathStore(wrapped.ProjectExtractPathStore)
+		}
+	}
+
+	if s.withContext != nil {
+		wrapped.withContext = func(ctx context.Context) *Stores {
+			return s.withContext(ctx).Use(middleware...)
+		}
+	}
+
+	if s.transaction != nil {
+		wrapped.transaction = func(fn func(tx *Stores) error) error {
+			return s.transaction(func(tx *Stores) error {
+				return fn(tx.Use(middleware...))
+			})
+		}
+	}
+
+	if s.forSession != nil {
+		wrapped.forSession = func() *Stores {
+			return s.forSession().Use(middleware...)
+		}
+	}
+
+	return wrapped
 }
@@ -0,0 +1,42 @@
+package mc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// countingProjectStore counts the calls to GetProjectBySlug.
+type countingProjectStore struct {
+	store.ProjectStore
+	calls int
+}
+
+func (s *countingProjectStore) GetProjectBySlug(slug string) (*mcmodel.Project, error) {
+	s.calls++
+	return s.ProjectStore.GetProjectBySlug(slug)
+}
+
+func TestStores_Use(t *testing.T) {
+	stores := &Stores{
+		FileStore:       store.NewFakeFileStore(nil),
+		ProjectStore:    store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		ConversionStore: store.NewFakeConversionStore(),
+	}
+
+	counter := &countingProjectStore{}
+	wrapped := stores.Use(StoreMiddleware{
+		ProjectStore: func(projectStore store.ProjectStore) store.ProjectStore {
+			counter.ProjectStore = projectStore
+			return counter
+		},
+	})
+
+	_, err := wrapped.WithContext(context.Background()).ProjectStore.GetProjectBySlug("proj")
+	require.Nil(t, err)
+	require.Equal(t, 1, counter.calls, "Call should have gone through the middleware")
+	require.Same(t, stores.FileStore, wrapped.FileStore, "FileStore has no middleware and should not be wrapped")
+}
@@ -0,0 +1,108 @@
+package mc
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// SymlinkMimeType is the mime type of the files that are symbolic links created by clients.
+const SymlinkMimeType = "inode/symlink"
+
+// ErrInvalidSymlinkTarget is returned for a symbolic link with a blank target, or a target that is too
+// long.
+var ErrInvalidSymlinkTarget = errors.New("invalid symbolic link target")
+
+// CreateSymlink creates a symbolic link named name in dir that points at target. The link is a file that
+// has no data, and whose target is kept in the SymlinkStore. target is kept exactly as it was given, and
+// doesn't have to exist, so that the links in a tree of analysis results can be uploaded before, or
+// without, the files they point at.
+func CreateSymlink(stores *Stores, dir *mcmodel.File, name, target string, ownerID int, maxPathLength int, mcfsRoot string) (*mcmodel.File, error) {
+	if stores.SymlinkStore == nil {
+		return nil, fmt.Errorf("symbolic links aren't supported")
+	}
+
+	if target == "" || (maxPathLength > 0 && len(target) > maxPathLength) {
+		return nil, ErrInvalidSymlinkTarget
+	}
+
+	link, err := stores.FileStore.CreateFile(name, dir.ProjectID, dir.ID, ownerID, SymlinkMimeType)
+	if err != nil {
+		log.Errorf("Unable to create symbolic link %s/%s: %s", dir.Path, name, err)
+		return nil, err
+	}
+
+	// The link is finalized like an upload of an empty file (see CommitFile), with its target added in
+	// the same transaction.
+	emptyChecksum := fmt.Sprintf("%x", md5.Sum(nil))
+	err = stores.Transaction(func(tx *Stores) error {
+		symlink := &Symlink{FileID: link.ID, ProjectID: link.ProjectID, Target: target, CreatedAt: time.Now()}
+		if err := tx.SymlinkStore.AddSymlink(symlink); err != nil {
+			return err
+		}
+
+		_, err := tx.FileStore.DoneWritingToFile(link, emptyChecksum, 0, tx.ConversionStore)
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("Failed finalizing symbolic link %d in project %d, removing it: %s", link.ID, link.ProjectID, err)
+		if abortErr := AbortFile(stores, link, mcfsRoot); abortErr != nil {
+			return nil, abortErr
+		}
+
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// GetSymlinkTargets returns the targets of the files that are symbolic links created by clients, keyed by
+// the file's ID. If the stores don't have a SymlinkStore, or the targets can't be loaded, then the files are
+// treated as not being symbolic links.
+func GetSymlinkTargets(stores *Stores, files []mcmodel.File) map[int]string {
+	if stores.SymlinkStore == nil {
+		return nil
+	}
+
+	var ids []int
+	for _, f := range files {
+		if f.MimeType == SymlinkMimeType {
+			ids = append(ids, f.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	targets, err := stores.SymlinkStore.GetSymlinkTargets(ids)
+	if err != nil {
+		log.Errorf("Unable to load symbolic link targets: %s", err)
+		return nil
+	}
+
+	return targets
+}
+
+// ResolveSymlinkTarget returns the project path that target, the target of a symbolic link in the directory
+// linkDir of the project with projectSlug, points at. An absolute target starts with a project slug, the
+// same as the paths clients use. It returns false if target is in another project.
+func ResolveSymlinkTarget(projectSlug, linkDir, target string) (string, bool) {
+	if !strings.HasPrefix(target, "/") {
+		// A relative target can't go above the project's root, the same as for a path under /.
+		return path.Join("/", linkDir, target), true
+	}
+
+	if GetProjectSlugFromPath(target) != projectSlug {
+		return "", false
+	}
+
+	return RemoveProjectSlugFromPath(target, projectSlug), true
+}
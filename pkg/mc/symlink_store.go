@@ -0,0 +1,95 @@
+package mc
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Symlink is a symbolic link created by a client. The link is the file with FileID, and Target is the path
+// it points at, exactly as the client gave it, so that it reads back the same. A relative Target is relative
+// to the link's directory.
+type Symlink struct {
+	FileID    int `gorm:"primaryKey"`
+	ProjectID int
+	Target    string
+	CreatedAt time.Time
+}
+
+// SymlinkStore holds the targets of the symbolic links created by clients. The targets are kept in the
+// file_symlinks table, which mc-sshd adds to the Materials Commons database:
+//
+//	CREATE TABLE file_symlinks (
+//	    file_id INT UNSIGNED PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    target VARCHAR(4096) NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    INDEX (project_id)
+//	);
+type SymlinkStore interface {
+	// AddSymlink records the target of a symbolic link.
+	AddSymlink(symlink *Symlink) error
+
+	// GetSymlinkTargets returns the target of each file in fileIDs that is a symbolic link, keyed by the
+	// file's ID. Files that aren't symbolic links are left out.
+	GetSymlinkTargets(fileIDs []int) (map[int]string, error)
+}
+
+func (Symlink) TableName() string {
+	return "file_symlinks"
+}
+
+type GormSymlinkStore struct {
+	db *gorm.DB
+}
+
+func NewGormSymlinkStore(db *gorm.DB) *GormSymlinkStore {
+	return &GormSymlinkStore{db: db}
+}
+
+func (s *GormSymlinkStore) AddSymlink(symlink *Symlink) error {
+	return s.db.Create(symlink).Error
+}
+
+func (s *GormSymlinkStore) GetSymlinkTargets(fileIDs []int) (map[int]string, error) {
+	targets := make(map[int]string)
+	if len(fileIDs) == 0 {
+		return targets, nil
+	}
+
+	var symlinks []Symlink
+	if err := s.db.Where("file_id IN ?", fileIDs).Find(&symlinks).Error; err != nil {
+		return nil, err
+	}
+
+	for _, symlink := range symlinks {
+		targets[symlink.FileID] = symlink.Target
+	}
+
+	return targets, nil
+}
+
+// FakeSymlinkStore is a SymlinkStore for testing. Targets maps the ID of each symbolic link to its target.
+type FakeSymlinkStore struct {
+	Targets map[int]string
+}
+
+func NewFakeSymlinkStore() *FakeSymlinkStore {
+	return &FakeSymlinkStore{Targets: make(map[int]string)}
+}
+
+func (s *FakeSymlinkStore) AddSymlink(symlink *Symlink) error {
+	s.Targets[symlink.FileID] = symlink.Target
+	return nil
+}
+
+func (s *FakeSymlinkStore) GetSymlinkTargets(fileIDs []int) (map[int]string, error) {
+	targets := make(map[int]string)
+	for _, id := range fileIDs {
+		if target, ok := s.Targets[id]; ok {
+			targets[id] = target
+		}
+	}
+
+	return targets, nil
+}
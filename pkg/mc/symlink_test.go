@@ -0,0 +1,74 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		linkDir  string
+		target   string
+		expected string
+		ok       bool
+	}{
+		{name: "Relative target", linkDir: "/results", target: "a.tif", expected: "/results/a.tif", ok: true},
+		{name: "Relative target in parent", linkDir: "/results/run1", target: "../../raw/a.tif", expected: "/raw/a.tif", ok: true},
+		{name: "Relative target stops at the root", linkDir: "/results", target: "../../../a.tif", expected: "/a.tif", ok: true},
+		{name: "Absolute target in the project", linkDir: "/results", target: "/proj/raw/a.tif", expected: "/raw/a.tif", ok: true},
+		{name: "Absolute target in another project", linkDir: "/results", target: "/other/raw/a.tif", ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, ok := ResolveSymlinkTarget("proj", test.linkDir, test.target)
+			require.Equal(t, test.ok, ok)
+			if test.ok {
+				require.Equal(t, test.expected, p)
+			}
+		})
+	}
+}
+
+func TestCreateSymlink(t *testing.T) {
+	dir := &mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}
+	symlinkStore := NewFakeSymlinkStore()
+	stores := &Stores{
+		FileStore:        uuidFileStore{FakeFileStore: store.NewFakeFileStore([]mcmodel.File{*dir})},
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: NewFakePendingFileStore(),
+		SymlinkStore:     symlinkStore,
+	}
+
+	link, err := CreateSymlink(stores, dir, "a.tif", "../raw/a.tif", 7, 4096, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, SymlinkMimeType, link.MimeType)
+	require.Equal(t, 7, link.OwnerID)
+	require.Equal(t, map[int]string{link.ID: "../raw/a.tif"}, GetSymlinkTargets(stores, []mcmodel.File{*link, *dir}))
+
+	_, err = CreateSymlink(stores, dir, "b.tif", "", 7, 4096, t.TempDir())
+	require.ErrorIs(t, err, ErrInvalidSymlinkTarget)
+
+	_, err = CreateSymlink(stores, dir, "c.tif", strings.Repeat("a", 4097), 7, 4096, t.TempDir())
+	require.ErrorIs(t, err, ErrInvalidSymlinkTarget)
+}
+
+func TestCreateSymlink_FailureRemovesLink(t *testing.T) {
+	dir := &mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}
+	pendingFileStore := NewFakePendingFileStore()
+	stores := &Stores{
+		FileStore:        &failingFileStore{FileStore: uuidFileStore{FakeFileStore: store.NewFakeFileStore([]mcmodel.File{*dir})}},
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: pendingFileStore,
+		SymlinkStore:     NewFakeSymlinkStore(),
+	}
+
+	_, err := CreateSymlink(stores, dir, "a.tif", "raw/a.tif", 7, 4096, t.TempDir())
+	require.Error(t, err)
+	require.Len(t, pendingFileStore.DeletedFileIDs, 1, "The symbolic link's file record should have been removed")
+}
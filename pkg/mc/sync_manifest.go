@@ -0,0 +1,91 @@
+package mc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// The formats a sync manifest can be written in.
+const (
+	// SyncManifestJSON writes each file as a JSON object on its own line.
+	SyncManifestJSON = "json"
+
+	// SyncManifestCSV writes a header line followed by a line for each file.
+	SyncManifestCSV = "csv"
+)
+
+// SyncManifestEntry is a file in a sync manifest. Path is relative to the directory the manifest is for,
+// and ModTime is when the file was last changed, in UTC.
+type SyncManifestEntry struct {
+	Path     string    `json:"path"`
+	Size     uint64    `json:"size"`
+	Checksum string    `json:"checksum"`
+	ModTime  time.Time `json:"mtime"`
+}
+
+// WriteSyncManifest writes the path, size, checksum and modification time of every file in the directory
+// tree at dirPath to w in format, so that a script mirroring the tree can work out what has changed from a
+// single request rather than stat'ing every path. Files that are still being uploaded, which don't have a
+// checksum yet, are left out.
+func WriteSyncManifest(w io.Writer, stores *Stores, projectID int, dirPath, format string) error {
+	var write func(entry SyncManifestEntry) error
+	var flush func() error
+
+	switch format {
+	case SyncManifestJSON:
+		encoder := json.NewEncoder(w)
+		write = func(entry SyncManifestEntry) error { return encoder.Encode(entry) }
+		flush = func() error { return nil }
+	case SyncManifestCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"path", "size", "checksum", "mtime"}); err != nil {
+			return err
+		}
+
+		write = func(entry SyncManifestEntry) error {
+			return cw.Write([]string{entry.Path, strconv.FormatUint(entry.Size, 10), entry.Checksum, entry.ModTime.Format(time.RFC3339)})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return fmt.Errorf("invalid format '%s', expected %s or %s", format, SyncManifestJSON, SyncManifestCSV)
+	}
+
+	err := walkTree(stores, projectID, dirPath, func(file *mcmodel.File) error {
+		if file.IsDir() || file.Checksum == "" {
+			return nil
+		}
+
+		return write(SyncManifestEntry{
+			Path:     relativeTreePath(dirPath, findPath(file)),
+			Size:     file.Size,
+			Checksum: file.Checksum,
+			ModTime:  file.UpdatedAt.UTC(),
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// relativeTreePath returns p, a path in the directory tree at dirPath, relative to dirPath.
+func relativeTreePath(dirPath, p string) string {
+	if dirPath == "/" {
+		return strings.TrimPrefix(p, "/")
+	}
+
+	return strings.TrimPrefix(p, path.Clean(dirPath)+"/")
+}
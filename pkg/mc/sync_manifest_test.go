@@ -0,0 +1,36 @@
+package mc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSyncManifest(t *testing.T) {
+	changed := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	stores := &Stores{ListingStore: NewFakeListingStore(
+		mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		mcmodel.File{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", DirectoryID: 1, MimeType: "directory"},
+		mcmodel.File{ID: 3, ProjectID: 1, Name: "a.tif", DirectoryID: 2, Size: 10, Checksum: "c1", UpdatedAt: changed},
+		mcmodel.File{ID: 4, ProjectID: 1, Name: "run,2.csv", DirectoryID: 2, Size: 5, Checksum: "c2", UpdatedAt: changed},
+		mcmodel.File{ID: 5, ProjectID: 1, Name: "uploading.tif", DirectoryID: 2, Size: 1},
+		mcmodel.File{ID: 6, ProjectID: 1, Name: "notes.txt", DirectoryID: 1, Size: 3, Checksum: "c3", UpdatedAt: changed},
+	)}
+
+	var out bytes.Buffer
+	require.NoError(t, WriteSyncManifest(&out, stores, 1, "/raw", SyncManifestCSV))
+	require.Equal(t, "path,size,checksum,mtime\n"+
+		"a.tif,10,c1,2024-06-01T12:00:00Z\n"+
+		"\"run,2.csv\",5,c2,2024-06-01T12:00:00Z\n", out.String())
+
+	out.Reset()
+	require.NoError(t, WriteSyncManifest(&out, stores, 1, "/", SyncManifestJSON))
+	require.Equal(t, `{"path":"raw/a.tif","size":10,"checksum":"c1","mtime":"2024-06-01T12:00:00Z"}`+"\n"+
+		`{"path":"raw/run,2.csv","size":5,"checksum":"c2","mtime":"2024-06-01T12:00:00Z"}`+"\n"+
+		`{"path":"notes.txt","size":3,"checksum":"c3","mtime":"2024-06-01T12:00:00Z"}`+"\n", out.String())
+
+	require.Error(t, WriteSyncManifest(&out, stores, 1, "/", "xml"))
+}
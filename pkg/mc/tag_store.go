@@ -0,0 +1,111 @@
+package mc
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// TagStore attaches Materials Commons tags to files. gomcdb doesn't have tag support.
+type TagStore interface {
+	// TagFile attaches tag to file, creating the tag if it doesn't exist. Tagging a file with a tag
+	// it already has does nothing.
+	TagFile(file *mcmodel.File, tag string) error
+}
+
+// fileTaggableType is the taggable_type Materials Commons uses for files in the taggables table.
+const fileTaggableType = "App\\Models\\File"
+
+type GormTagStore struct {
+	db *gorm.DB
+}
+
+func NewGormTagStore(db *gorm.DB) *GormTagStore {
+	return &GormTagStore{db: db}
+}
+
+// tag is a row in the Materials Commons tags table. The name and slug are JSON objects keyed by
+// locale, of which Materials Commons only uses "en".
+type tag struct {
+	ID        int
+	Name      string
+	Slug      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (tag) TableName() string {
+	return "tags"
+}
+
+func (s *GormTagStore) TagFile(file *mcmodel.File, name string) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		// SQLite's json_extract returns the text without its quotes.
+		englishName := "JSON_UNQUOTE(JSON_EXTRACT(name, '$.en'))"
+		if isSQLite(tx) {
+			englishName = "json_extract(name, '$.en')"
+		}
+
+		var t tag
+		err := tx.Where(englishName+" = ?", name).Where("type IS NULL").First(&t).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+			if t.Name, err = localizedJSON(name); err != nil {
+				return err
+			}
+
+			if t.Slug, err = localizedJSON(ProjectSlugFromName(name)); err != nil {
+				return err
+			}
+
+			if err := tx.Create(&t).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+
+		var count int64
+		err = tx.Table("taggables").
+			Where("tag_id = ?", t.ID).
+			Where("taggable_type = ?", fileTaggableType).
+			Where("taggable_id = ?", file.ID).
+			Count(&count).Error
+		if err != nil || count != 0 {
+			return err
+		}
+
+		return tx.Exec("INSERT INTO taggables (tag_id, taggable_type, taggable_id) VALUES (?, ?, ?)", t.ID, fileTaggableType, file.ID).Error
+	}, s.db)
+}
+
+// localizedJSON returns value as the JSON object, keyed by locale, that Materials Commons stores
+// translatable tag fields in.
+func localizedJSON(value string) (string, error) {
+	b, err := json.Marshal(map[string]string{"en": value})
+	return string(b), err
+}
+
+// FakeTagStore is a TagStore for testing. The tags for each file are recorded in Tags, keyed by the
+// file ID.
+type FakeTagStore struct {
+	Tags map[int][]string
+}
+
+func NewFakeTagStore() *FakeTagStore {
+	return &FakeTagStore{Tags: make(map[int][]string)}
+}
+
+func (s *FakeTagStore) TagFile(file *mcmodel.File, tag string) error {
+	for _, t := range s.Tags[file.ID] {
+		if t == tag {
+			return nil
+		}
+	}
+
+	s.Tags[file.ID] = append(s.Tags[file.ID], tag)
+	return nil
+}
@@ -0,0 +1,68 @@
+package mc
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// TaggedDirName is the name of the virtual directory used to tag uploads by path. A path component
+// of .tagged is followed by the tag to apply, so uploading into /my-project/.tagged/xrd/run1 stores
+// the files in /my-project/run1 and tags each of them with xrd. A path can have more than one tag, as
+// in /my-project/.tagged/xrd/.tagged/sample-a.
+const TaggedDirName = ".tagged"
+
+// ParseTaggedPath removes the TaggedDirName components, and the tags following them, from path. It
+// returns the path that the file is stored at and the tags, in the order they appear in path.
+func ParseTaggedPath(path string) (string, []string) {
+	if !strings.Contains(path, TaggedDirName) {
+		return path, nil
+	}
+
+	var (
+		kept []string
+		tags []string
+	)
+
+	parts := strings.Split(cleanClientPath(path), "/")
+	for i := 0; i < len(parts); i++ {
+		if parts[i] != TaggedDirName {
+			kept = append(kept, parts[i])
+			continue
+		}
+
+		// Skip over the tag. A trailing .tagged, without a tag, is dropped.
+		i++
+		if i < len(parts) && !containsString(tags, parts[i]) {
+			tags = append(tags, parts[i])
+		}
+	}
+
+	return filepath.Join(append([]string{"/"}, kept...)...), tags
+}
+
+// TagUploadedFile attaches each of the tags to a file that was just uploaded. Blank tags are skipped.
+// Failures are logged rather than returned, as the upload itself succeeded.
+func TagUploadedFile(tagStore TagStore, file *mcmodel.File, tags ...string) {
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+
+		if err := tagStore.TagFile(file, tag); err != nil {
+			log.Errorf("Unable to tag file %d with '%s': %s", file.ID, tag, err)
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,32 @@
+package mc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTaggedPath(t *testing.T) {
+	tests := []struct {
+		path         string
+		expectedPath string
+		expectedTags []string
+	}{
+		{"/run1/file.dat", "/run1/file.dat", nil},
+		{"/.tagged/xrd/run1/file.dat", "/run1/file.dat", []string{"xrd"}},
+		{"/data/.tagged/xrd/file.dat", "/data/file.dat", []string{"xrd"}},
+		{"/.tagged/xrd/.tagged/sample-a/file.dat", "/file.dat", []string{"xrd", "sample-a"}},
+		{"/.tagged/xrd/.tagged/xrd/file.dat", "/file.dat", []string{"xrd"}},
+		{"/.tagged/xrd", "/", []string{"xrd"}},
+		{"/.tagged", "/", nil},
+		{"/not.tagged/file.dat", "/not.tagged/file.dat", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			path, tags := ParseTaggedPath(test.path)
+			require.Equal(t, test.expectedPath, path)
+			require.Equal(t, test.expectedTags, tags)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Defaults for the Tarpit settings.
+const (
+	DefaultTarpitDelay    = 5 * time.Second
+	DefaultTarpitMaxDelay = time.Minute
+	DefaultTarpitWindow   = time.Hour
+)
+
+// maxTarpitUsers is the number of distinct user slugs kept for each offender.
+const maxTarpitUsers = 10
+
+// Tarpit slows down the clients that keep trying user slugs that don't exist, which is what the
+// internet-wide SSH scanners do. Once a host has tried Threshold unknown users within Window, each
+// further attempt is answered after Delay, growing by Delay with each attempt up to MaxDelay. Only the
+// first unknown user from each host is logged, and every attempt is written to Feed as a line of JSON so
+// that it can be passed on to a security operations center instead of filling the server log.
+type Tarpit struct {
+	Threshold int
+	Delay     time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+
+	// Feed, if set, receives a TarpitAttempt as a line of JSON for each unknown user tried.
+	Feed io.Writer
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	offenders map[string]*TarpitOffender
+}
+
+// TarpitAttempt is an attempt to log in as a user that doesn't exist.
+type TarpitAttempt struct {
+	Time       time.Time     `json:"time"`
+	RemoteHost string        `json:"remote_host"`
+	User       string        `json:"user"`
+	Attempts   int           `json:"attempts"`
+	Delay      time.Duration `json:"delay_ns"`
+}
+
+// TarpitOffender is a host that has tried unknown users within the window.
+type TarpitOffender struct {
+	RemoteHost string    `json:"remote_host"`
+	Attempts   int       `json:"attempts"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Users      []string  `json:"users"`
+}
+
+// NewTarpit creates a Tarpit that slows down hosts after threshold unknown users.
+func NewTarpit(threshold int) *Tarpit {
+	return &Tarpit{
+		Threshold: threshold,
+		Delay:     DefaultTarpitDelay,
+		MaxDelay:  DefaultTarpitMaxDelay,
+		Window:    DefaultTarpitWindow,
+		now:       time.Now,
+		offenders: make(map[string]*TarpitOffender),
+	}
+}
+
+// InvalidUser records an attempt from remoteAddr to log in as user, which doesn't exist, and returns how
+// long to wait before answering. A nil Tarpit logs the attempt and doesn't delay it.
+func (t *Tarpit) InvalidUser(remoteAddr net.Addr, user string) time.Duration {
+	host := remoteHost(remoteAddr)
+	if t == nil {
+		log.Errorf("Invalid user slug %q from %s", user, host)
+		return 0
+	}
+
+	t.mu.Lock()
+	now := t.now()
+	offender, ok := t.offenders[host]
+	if !ok || now.Sub(offender.LastSeen) > t.Window {
+		offender = &TarpitOffender{RemoteHost: host, FirstSeen: now}
+		t.offenders[host] = offender
+		log.Errorf("Invalid user slug %q from %s", user, host)
+	}
+
+	offender.Attempts++
+	offender.LastSeen = now
+	if len(offender.Users) < maxTarpitUsers && !containsString(offender.Users, user) {
+		offender.Users = append(offender.Users, user)
+	}
+
+	var delay time.Duration
+	if offender.Attempts > t.Threshold {
+		delay = t.Delay * time.Duration(offender.Attempts-t.Threshold)
+		if delay > t.MaxDelay {
+			delay = t.MaxDelay
+		}
+	}
+
+	attempt := TarpitAttempt{Time: now, RemoteHost: host, User: user, Attempts: offender.Attempts, Delay: delay}
+	if t.Feed != nil {
+		// The feed is written while holding the lock so that lines from concurrent attempts don't mix.
+		if err := json.NewEncoder(t.Feed).Encode(attempt); err != nil {
+			log.Errorf("Unable to write tarpit feed: %s", err)
+		}
+	}
+	t.mu.Unlock()
+
+	return delay
+}
+
+// Offenders returns the hosts that have tried unknown users within the window, with the most attempts first.
+func (t *Tarpit) Offenders() []TarpitOffender {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offenders := make([]TarpitOffender, 0, len(t.offenders))
+	for _, offender := range t.offenders {
+		o := *offender
+		o.Users = append([]string(nil), offender.Users...)
+		offenders = append(offenders, o)
+	}
+
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Attempts != offenders[j].Attempts {
+			return offenders[i].Attempts > offenders[j].Attempts
+		}
+		return offenders[i].RemoteHost < offenders[j].RemoteHost
+	})
+
+	return offenders
+}
+
+// ServeHTTP writes the current offenders as JSON.
+func (t *Tarpit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Offenders()); err != nil {
+		log.Errorf("Unable to write tarpit offenders: %s", err)
+	}
+}
+
+// String returns the number of offenders as JSON, so that a Tarpit can be published with expvar.
+func (t *Tarpit) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, _ := json.Marshal(map[string]int{"offenders": len(t.offenders)})
+	return string(b)
+}
+
+// Prune forgets the hosts that haven't tried an unknown user within the window.
+func (t *Tarpit) Prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for host, offender := range t.offenders {
+		if now.Sub(offender.LastSeen) > t.Window {
+			delete(t.offenders, host)
+		}
+	}
+}
+
+// Run calls Prune every window until ctx is done.
+func (t *Tarpit) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Prune()
+		}
+	}
+}
+
+// remoteHost returns the host part of addr, so that attempts from different ports of a host are counted together.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
@@ -0,0 +1,56 @@
+package mc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarpit_InvalidUser(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var feed bytes.Buffer
+	tarpit := NewTarpit(2)
+	tarpit.Delay = time.Second
+	tarpit.MaxDelay = 3 * time.Second
+	tarpit.Feed = &feed
+	tarpit.now = func() time.Time { return now }
+
+	scanner := &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 50000}
+	other := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50001}
+
+	var delays []time.Duration
+	for i, user := range []string{"admin", "root", "admin", "oracle", "test", "guest"} {
+		scanner.Port = 50000 + i
+		delays = append(delays, tarpit.InvalidUser(scanner, user))
+	}
+	require.Equal(t, []time.Duration{0, 0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, delays)
+	require.Equal(t, time.Duration(0), tarpit.InvalidUser(other, "alice"))
+
+	offenders := tarpit.Offenders()
+	require.Len(t, offenders, 2)
+	require.Equal(t, "203.0.113.5", offenders[0].RemoteHost)
+	require.Equal(t, 6, offenders[0].Attempts)
+	require.Equal(t, []string{"admin", "root", "oracle", "test", "guest"}, offenders[0].Users)
+
+	lines := strings.Split(strings.TrimSpace(feed.String()), "\n")
+	require.Len(t, lines, 7)
+	var attempt TarpitAttempt
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &attempt))
+	require.Equal(t, "203.0.113.5", attempt.RemoteHost)
+	require.Equal(t, "admin", attempt.User)
+	require.Equal(t, time.Second, attempt.Delay)
+
+	// Once the window has passed the host starts over.
+	now = now.Add(2 * DefaultTarpitWindow)
+	require.Equal(t, time.Duration(0), tarpit.InvalidUser(scanner, "admin"))
+	tarpit.Prune()
+	require.Len(t, tarpit.Offenders(), 1)
+
+	var none *Tarpit
+	require.Equal(t, time.Duration(0), none.InvalidUser(scanner, "admin"))
+}
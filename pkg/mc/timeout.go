@@ -0,0 +1,179 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RunWithTimeout runs fn, returning early with an error if ctx is canceled or timeout passes
+// before fn finishes. It is used for filesystem calls, which can't be canceled. When fn doesn't
+// finish in time it is left running in the background, but the caller is no longer blocked on it.
+// A timeout of 0 means no timeout.
+func RunWithTimeout(ctx context.Context, timeout time.Duration, fn func() error) error {
+	_, err := RunIOWithTimeout(ctx, timeout, func() (int, error) {
+		return 0, fn()
+	})
+
+	return err
+}
+
+// RunIOWithTimeout is RunWithTimeout for calls such as Read and Write that return a count along
+// with an error. The count is 0 if fn didn't finish in time. A call left running keeps using whatever
+// fn uses, so calls working on a buffer the caller reuses should use WriteAtWithTimeout or
+// ReadAtWithTimeout instead.
+func RunIOWithTimeout(ctx context.Context, timeout time.Duration, fn func() (int, error)) (int, error) {
+	n, _, err := runIO(ctx, timeout, fn)
+	return n, err
+}
+
+// runIO is RunIOWithTimeout, also returning whether fn finished. When it didn't fn is still running.
+func runIO(ctx context.Context, timeout time.Duration, fn func() (int, error)) (int, bool, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	// done is buffered so that fn can finish and exit its goroutine even when no one is
+	// waiting on it anymore.
+	done := make(chan result, 1)
+	go func() {
+		if err := storageFaults.injectStorage(); err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		n, err := fn()
+		done <- result{n: n, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.n, true, r.err
+	case <-ctx.Done():
+		return 0, false, fmt.Errorf("operation did not complete: %w", ctx.Err())
+	}
+}
+
+// ioBuffers holds the buffers that the calls made by WriteAtWithTimeout and ReadAtWithTimeout own.
+var ioBuffers sync.Pool
+
+// getIOBuffer returns a buffer of size bytes from ioBuffers, or a new one.
+func getIOBuffer(size int) []byte {
+	if b, ok := ioBuffers.Get().(*[]byte); ok && cap(*b) >= size {
+		return (*b)[:size]
+	}
+
+	return make([]byte, size)
+}
+
+// putIOBuffer returns b to ioBuffers. It must only be called once the call using b has finished.
+func putIOBuffer(b []byte) {
+	ioBuffers.Put(&b)
+}
+
+// canAbandon returns true if a call run with RunIOWithTimeout, with ctx and timeout, can be left running.
+func canAbandon(ctx context.Context, timeout time.Duration) bool {
+	return timeout > 0 || ctx.Done() != nil
+}
+
+// WriteAtWithTimeout is RunIOWithTimeout for w.WriteAt(b, off). The write is made from a copy of b, so
+// that a write left running after a timeout doesn't write whatever the caller has since put in b.
+func WriteAtWithTimeout(ctx context.Context, timeout time.Duration, w io.WriterAt, b []byte, off int64) (int, error) {
+	return writeOwned(ctx, timeout, b, func(buf []byte) (int, error) {
+		return w.WriteAt(buf, off)
+	})
+}
+
+// ReadAtWithTimeout is RunIOWithTimeout for r.ReadAt(b, off). The data is read into a buffer owned by
+// the read, and copied into b once it finishes, so that a read left running after a timeout never
+// writes into b once the caller has reused it.
+func ReadAtWithTimeout(ctx context.Context, timeout time.Duration, r io.ReaderAt, b []byte, off int64) (int, error) {
+	return readOwned(ctx, timeout, b, func(buf []byte) (int, error) {
+		return r.ReadAt(buf, off)
+	})
+}
+
+// writeOwned runs write, bounded by ctx and timeout, with a copy of p. The copy is only reused once
+// write has finished.
+func writeOwned(ctx context.Context, timeout time.Duration, p []byte, write func(buf []byte) (int, error)) (int, error) {
+	if !canAbandon(ctx, timeout) {
+		return write(p)
+	}
+
+	buf := getIOBuffer(len(p))
+	copy(buf, p)
+	n, finished, err := runIO(ctx, timeout, func() (int, error) {
+		return write(buf)
+	})
+
+	if finished {
+		putIOBuffer(buf)
+	}
+
+	return n, err
+}
+
+// readOwned runs read, bounded by ctx and timeout, into a buffer the size of p, and copies what was read
+// into p once read finishes.
+func readOwned(ctx context.Context, timeout time.Duration, p []byte, read func(buf []byte) (int, error)) (int, error) {
+	if !canAbandon(ctx, timeout) {
+		return read(p)
+	}
+
+	buf := getIOBuffer(len(p))
+	n, finished, err := runIO(ctx, timeout, func() (int, error) {
+		return read(buf)
+	})
+
+	if !finished {
+		return n, err
+	}
+
+	copy(p, buf[:n])
+	putIOBuffer(buf)
+	return n, err
+}
+
+// timeoutWriter applies RunIOWithTimeout to each call to Write. Like WriteAtWithTimeout it writes from a
+// copy of the data.
+type timeoutWriter struct {
+	ctx     context.Context
+	timeout time.Duration
+	w       io.Writer
+}
+
+// NewTimeoutWriter wraps w so that each individual Write is bounded by timeout. This allows long
+// running copies, where the total time isn't known in advance, to still detect a hung write.
+func NewTimeoutWriter(ctx context.Context, timeout time.Duration, w io.Writer) io.Writer {
+	return &timeoutWriter{ctx: ctx, timeout: timeout, w: w}
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	return writeOwned(w.ctx, w.timeout, p, w.w.Write)
+}
+
+// timeoutReader applies RunIOWithTimeout to each call to Read. Like ReadAtWithTimeout it reads into a
+// buffer of its own.
+type timeoutReader struct {
+	ctx     context.Context
+	timeout time.Duration
+	r       io.Reader
+}
+
+// NewTimeoutReader wraps r so that each individual Read is bounded by timeout.
+func NewTimeoutReader(ctx context.Context, timeout time.Duration, r io.Reader) io.Reader {
+	return &timeoutReader{ctx: ctx, timeout: timeout, r: r}
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	return readOwned(r.ctx, r.timeout, p, r.r.Read)
+}
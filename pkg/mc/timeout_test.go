@@ -0,0 +1,90 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hungFile is an io.WriterAt and io.ReaderAt whose calls don't return until release is closed, like a
+// call on a hung NFS mount. Writes send the data they were given on written once released.
+type hungFile struct {
+	release chan struct{}
+	written chan []byte
+}
+
+func newHungFile() *hungFile {
+	return &hungFile{release: make(chan struct{}), written: make(chan []byte, 1)}
+}
+
+func (f *hungFile) WriteAt(b []byte, _ int64) (int, error) {
+	<-f.release
+	f.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (f *hungFile) ReadAt(b []byte, _ int64) (int, error) {
+	<-f.release
+	return copy(b, "late data"), nil
+}
+
+func (f *hungFile) Write(b []byte) (int, error) {
+	return f.WriteAt(b, 0)
+}
+
+func TestWriteAtWithTimeoutOwnsBuffer(t *testing.T) {
+	f := newHungFile()
+	b := []byte("client data")
+
+	_, err := WriteAtWithTimeout(context.Background(), 10*time.Millisecond, f, b, 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The caller reuses b for the next request before the hung write finishes.
+	copy(b, "next reques")
+	close(f.release)
+	require.Equal(t, "client data", string(<-f.written))
+
+	n, err := WriteAtWithTimeout(context.Background(), time.Second, f, b, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(b), n)
+	require.Equal(t, "next reques", string(<-f.written))
+}
+
+func TestReadAtWithTimeoutOwnsBuffer(t *testing.T) {
+	f := newHungFile()
+	b := make([]byte, 9)
+
+	_, err := ReadAtWithTimeout(context.Background(), 10*time.Millisecond, f, b, 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The hung read finishing doesn't write into b, which the caller has reused.
+	copy(b, "reused...")
+	close(f.release)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, "reused...", string(b))
+
+	n, err := ReadAtWithTimeout(context.Background(), time.Second, f, b, 0)
+	require.NoError(t, err)
+	require.Equal(t, "late data", string(b[:n]))
+
+	// Without a timeout or a context that can be canceled b is used directly.
+	n, err = ReadAtWithTimeout(context.Background(), 0, bytes.NewReader([]byte("direct")), b, 0)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, "direct", string(b[:n]))
+}
+
+func TestTimeoutWriterOwnsBuffer(t *testing.T) {
+	f := newHungFile()
+	b := []byte("copy data")
+
+	_, err := NewTimeoutWriter(context.Background(), 10*time.Millisecond, f).Write(b)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	copy(b, "next data")
+	close(f.release)
+	require.Equal(t, "copy data", string(<-f.written))
+}
@@ -0,0 +1,274 @@
+package mc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// TokenSlugPrefix starts the slug of every token, so that tokens can't be confused with Materials
+// Commons users.
+const TokenSlugPrefix = "token-"
+
+// Limits on how long tokens last.
+const (
+	DefaultTokenTTL = 30 * 24 * time.Hour
+	MaxTokenTTL     = 365 * 24 * time.Hour
+)
+
+// The access a token can give.
+const (
+	TokenRead      = "read"
+	TokenWrite     = "write"
+	TokenReadWrite = "read-write"
+)
+
+// EventToken is the Event.Type for a token being created or revoked.
+const EventToken = "token"
+
+// ErrTokenNotFound is returned for a token slug that doesn't exist or has expired.
+var ErrTokenNotFound = errors.New("no such token")
+
+// Token is a secret a user delegates part of their access with, such as to a pipeline job. A token is
+// scoped to a path, and everything under it, in a single project, and can allow reading, writing or both.
+// Logging in with the token's slug and secret gives a session that runs as the user that created it but
+// is limited to the token's scope (see Scope.Check), for example write-only to /raw/run-42.
+type Token struct {
+	ID        int
+	Slug      string
+	Secret    string
+	UserID    int
+	UserSlug  string
+	ProjectID int
+	Path      string
+	Access    string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TokenStore holds the tokens. Tokens are kept in the access_tokens table, which mc-sshd adds to the
+// Materials Commons database:
+//
+//	CREATE TABLE access_tokens (
+//	    id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+//	    slug VARCHAR(64) NOT NULL UNIQUE,
+//	    secret VARCHAR(255) NOT NULL,
+//	    user_id INT UNSIGNED NOT NULL,
+//	    user_slug VARCHAR(255) NOT NULL DEFAULT '',
+//	    project_id INT UNSIGNED NOT NULL,
+//	    path VARCHAR(4096) NOT NULL,
+//	    access VARCHAR(16) NOT NULL,
+//	    expires_at TIMESTAMP NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    updated_at TIMESTAMP NULL,
+//	    INDEX (user_id)
+//	);
+type TokenStore interface {
+	// CreateToken adds a token.
+	CreateToken(token *Token) error
+
+	// GetToken returns the token with slug. It returns ErrTokenNotFound if there is no such token, or
+	// the token has expired.
+	GetToken(slug string) (*Token, error)
+
+	// ListTokens returns the user's tokens that haven't expired, ordered by slug.
+	ListTokens(userID int) ([]Token, error)
+
+	// DeleteToken removes the user's token with slug. It returns ErrTokenNotFound if the user has no
+	// such token.
+	DeleteToken(userID int, slug string) error
+}
+
+func (Token) TableName() string {
+	return "access_tokens"
+}
+
+type GormTokenStore struct {
+	db *gorm.DB
+}
+
+func NewGormTokenStore(db *gorm.DB) *GormTokenStore {
+	return &GormTokenStore{db: db}
+}
+
+// CreateToken also removes the user's expired tokens, so that they don't pile up.
+func (s *GormTokenStore) CreateToken(token *Token) error {
+	if err := s.db.Where("user_id = ?", token.UserID).Where("expires_at <= ?", time.Now()).Delete(&Token{}).Error; err != nil {
+		log.Errorf("Unable to remove the expired tokens of user %d: %s", token.UserID, err)
+	}
+
+	return s.db.Create(token).Error
+}
+
+func (s *GormTokenStore) GetToken(slug string) (*Token, error) {
+	var token Token
+	err := s.db.Where("slug = ?", slug).Where("expires_at > ?", time.Now()).First(&token).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, ErrTokenNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (s *GormTokenStore) ListTokens(userID int) ([]Token, error) {
+	var tokens []Token
+	err := s.db.Where("user_id = ?", userID).
+		Where("expires_at > ?", time.Now()).
+		Order("slug").
+		Find(&tokens).Error
+
+	return tokens, err
+}
+
+func (s *GormTokenStore) DeleteToken(userID int, slug string) error {
+	result := s.db.Where("user_id = ?", userID).Where("slug = ?", slug).Delete(&Token{})
+	switch {
+	case result.Error != nil:
+		return result.Error
+	case result.RowsAffected == 0:
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// FakeTokenStore is a TokenStore for testing. The tokens are recorded in Tokens, keyed by slug.
+type FakeTokenStore struct {
+	Tokens map[string]Token
+	now    func() time.Time
+}
+
+func NewFakeTokenStore() *FakeTokenStore {
+	return &FakeTokenStore{Tokens: make(map[string]Token), now: time.Now}
+}
+
+func (s *FakeTokenStore) CreateToken(token *Token) error {
+	token.ID = len(s.Tokens) + 1
+	s.Tokens[token.Slug] = *token
+	return nil
+}
+
+func (s *FakeTokenStore) GetToken(slug string) (*Token, error) {
+	token, ok := s.Tokens[slug]
+	if !ok || !token.ExpiresAt.After(s.now()) {
+		return nil, ErrTokenNotFound
+	}
+
+	return &token, nil
+}
+
+func (s *FakeTokenStore) ListTokens(userID int) ([]Token, error) {
+	var tokens []Token
+	for _, token := range s.Tokens {
+		if token.UserID == userID && token.ExpiresAt.After(s.now()) {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Slug < tokens[j].Slug })
+	return tokens, nil
+}
+
+func (s *FakeTokenStore) DeleteToken(userID int, slug string) error {
+	token, ok := s.Tokens[slug]
+	if !ok || token.UserID != userID {
+		return ErrTokenNotFound
+	}
+
+	delete(s.Tokens, slug)
+	return nil
+}
+
+// tokenScope returns the scope of a token in the project with projectSlug.
+func tokenScope(token *Token, projectSlug string) (Scope, error) {
+	scope := Scope{Rule: PathRule{ProjectSlug: projectSlug, Prefix: token.Path}}
+	switch token.Access {
+	case TokenRead:
+		scope.Read = true
+	case TokenWrite:
+		scope.Write = true
+	case TokenReadWrite:
+		scope.Read, scope.Write = true, true
+	default:
+		return scope, fmt.Errorf("invalid access '%s', expected %s, %s or %s", token.Access, TokenRead, TokenWrite, TokenReadWrite)
+	}
+
+	return scope, nil
+}
+
+// CreateToken adds a token for user that gives access, one of TokenRead, TokenWrite or TokenReadWrite, to
+// path in project until ttl has passed. It returns the token and its secret. The secret is only stored
+// hashed, so it can't be shown again.
+func CreateToken(stores *Stores, project *mcmodel.Project, user *mcmodel.User, path, access string, ttl time.Duration) (*Token, string, error) {
+	if ttl <= 0 || ttl > MaxTokenTTL {
+		return nil, "", fmt.Errorf("tokens can last at most %s", MaxTokenTTL)
+	}
+
+	slug, secret, hash, err := newScopedCredential(TokenSlugPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := &Token{
+		Slug:      slug,
+		Secret:    hash,
+		UserID:    user.ID,
+		UserSlug:  user.Slug,
+		ProjectID: project.ID,
+		Path:      filepath.Clean("/" + path),
+		Access:    access,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	if _, err := tokenScope(token, project.Slug); err != nil {
+		return nil, "", err
+	}
+
+	if err := stores.TokenStore.CreateToken(token); err != nil {
+		log.Errorf("Unable to create a token for user %d: %s", user.ID, err)
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+// AuthenticateToken checks the secret of the token with slug. It returns the user that the token's
+// sessions run as, which has the token's slug and the ID of the user that created the token, and
+// registers the token's scope in scopes.
+func AuthenticateToken(stores *Stores, scopes *ScopeRegistry, slug, secret string) (*mcmodel.User, error) {
+	token, err := stores.TokenStore.GetToken(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(token.Secret), []byte(secret)); err != nil {
+		return nil, err
+	}
+
+	project, err := stores.ProjectStore.GetProjectByID(token.ProjectID)
+	if err != nil {
+		log.Errorf("Unable to find project %d for token %s: %s", token.ProjectID, slug, err)
+		return nil, err
+	}
+
+	scope, err := tokenScope(token, project.Slug)
+	if err != nil {
+		log.Errorf("Token %s has an invalid scope: %s", slug, err)
+		return nil, err
+	}
+
+	scopes.Add(slug, token.UserSlug, scope, token.ExpiresAt)
+
+	return &mcmodel.User{ID: token.UserID, Slug: slug, Name: "Token " + slug}, nil
+}
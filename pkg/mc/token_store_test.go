@@ -0,0 +1,81 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	project := mcmodel.Project{ID: 1, Slug: "proj"}
+	owner := &mcmodel.User{ID: 7, Slug: "owner"}
+	tokenStore := NewFakeTokenStore()
+	stores := &Stores{ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{project}), TokenStore: tokenStore}
+	config := DefaultConfig()
+
+	token, secret, err := CreateToken(stores, &project, owner, "raw/run-42", TokenRead, time.Hour)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(token.Slug, TokenSlugPrefix))
+	require.Equal(t, "/raw/run-42", token.Path)
+	require.NotEqual(t, secret, token.Secret, "Only the hash of the secret is stored")
+
+	_, err = AuthenticateToken(stores, config.Scopes, token.Slug, "wrong")
+	require.Error(t, err)
+
+	user, err := AuthenticateToken(stores, config.Scopes, token.Slug, secret)
+	require.NoError(t, err)
+	require.Equal(t, owner.ID, user.ID, "Sessions run as the user that created the token")
+	require.Equal(t, token.Slug, user.Slug)
+	require.Equal(t, owner.Slug, config.Scopes.Owner(token.Slug))
+
+	// A read-only token can only read under its path.
+	require.NoError(t, config.CheckDropBoxAccess(token.Slug, "proj", "/raw/run-42/a.tif", DropBoxRead))
+	require.NoError(t, config.CheckDropBoxAccess(token.Slug, "proj", "/raw", DropBoxStat))
+	require.ErrorIs(t, config.CheckDropBoxAccess(token.Slug, "proj", "/raw/run-42/a.tif", DropBoxWrite), ErrOutOfScope)
+	require.ErrorIs(t, config.CheckDropBoxAccess(token.Slug, "proj", "/raw/run-43/a.tif", DropBoxRead), ErrOutOfScope)
+	require.ErrorIs(t, config.CheckDropBoxAccess(token.Slug, "other", "/raw/run-42/a.tif", DropBoxRead), ErrOutOfScope)
+
+	_, _, err = CreateToken(stores, &project, owner, "/raw", "admin", time.Hour)
+	require.Error(t, err)
+	_, _, err = CreateToken(stores, &project, owner, "/raw", TokenWrite, MaxTokenTTL+time.Hour)
+	require.Error(t, err)
+
+	tokens, err := tokenStore.ListTokens(owner.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+
+	require.ErrorIs(t, tokenStore.DeleteToken(owner.ID+1, token.Slug), ErrTokenNotFound)
+	require.NoError(t, tokenStore.DeleteToken(owner.ID, token.Slug))
+	_, err = AuthenticateToken(stores, config.Scopes, token.Slug, secret)
+	require.ErrorIs(t, err, ErrTokenNotFound)
+}
+
+func TestScopeCheck(t *testing.T) {
+	rule := PathRule{ProjectSlug: "proj", Prefix: "/raw/run-42"}
+	tests := []struct {
+		scope  Scope
+		path   string
+		access DropBoxAccess
+		err    error
+	}{
+		{Scope{Rule: rule, Read: true, Write: true}, "/raw/run-42/a.tif", DropBoxWrite, nil},
+		{Scope{Rule: rule, Read: true, Write: true}, "/raw/run-42/a.tif", DropBoxRead, nil},
+		{Scope{Rule: rule, Write: true}, "/raw/run-42/a.tif", DropBoxRead, ErrDropBoxOnly},
+		{Scope{Rule: rule, Write: true}, "/raw", DropBoxStat, nil},
+		{Scope{Rule: rule, Read: true}, "/results", DropBoxStat, ErrOutOfScope},
+		{Scope{Rule: rule}, "/raw/run-42/a.tif", DropBoxStat, ErrOutOfScope},
+	}
+
+	for _, test := range tests {
+		err := test.scope.Check("proj", test.path, test.access)
+		if test.err == nil {
+			require.NoError(t, err, "%+v %s", test.scope, test.path)
+			continue
+		}
+		require.ErrorIs(t, err, test.err, "%+v %s", test.scope, test.path)
+	}
+}
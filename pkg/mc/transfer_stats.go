@@ -0,0 +1,245 @@
+package mc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventSlowTransfer is the Event.Type for a transfer whose throughput was below TransferStats.SlowRate.
+const EventSlowTransfer = "transfer.slow"
+
+// Transfer directions.
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// throughputBuckets are the upper bounds, in bytes per second, of the throughput histogram buckets.
+var throughputBuckets = []int64{
+	64 * 1024,
+	256 * 1024,
+	1024 * 1024,
+	4 * 1024 * 1024,
+	16 * 1024 * 1024,
+	64 * 1024 * 1024,
+	256 * 1024 * 1024,
+}
+
+// Transfer is a single completed upload or download of a file.
+type Transfer struct {
+	Direction string
+	Protocol  string
+	UserID    int
+	ProjectID int
+	Path      string
+	Bytes     int64
+	Duration  time.Duration
+
+	// Timing is the breakdown of the transfer's Duration. It is nil when it wasn't measured.
+	Timing *TransferTiming
+}
+
+// Throughput returns the transfer's throughput in bytes per second.
+func (t Transfer) Throughput() int64 {
+	if t.Duration <= 0 {
+		return t.Bytes
+	}
+
+	return int64(float64(t.Bytes) / t.Duration.Seconds())
+}
+
+// TransferStats records the throughput of each completed transfer in a histogram per direction. Transfers
+// slower than SlowRate are emitted to the EventSink as EventSlowTransfer events, so that users with
+// problems such as a broken MTU or a failing NIC can be found. TransferStats implements expvar.Var so that
+// it can be published with expvar.Publish.
+type TransferStats struct {
+	// MinSize is the size, in bytes, below which transfers are counted but otherwise ignored. The
+	// throughput of small transfers is dominated by latency, so it says little about the network.
+	MinSize int64
+
+	// SlowRate is the throughput, in bytes per second, below which a transfer is reported as slow.
+	// 0 turns off the reporting.
+	SlowRate int64
+
+	// TraceTimings emits an EventTransferCompleted event, with the transfer's timing breakdown, for each
+	// transfer that has one, so that a slow upload can be diagnosed from a single event.
+	TraceTimings bool
+
+	events EventSink
+
+	mu         sync.Mutex
+	directions map[string]*transferHistogram
+	slow       int64
+}
+
+type transferHistogram struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+
+	// Buckets counts the transfers of at least MinSize by throughput. Each count is for the
+	// transfers with a throughput up to the bucket's bound, and above the previous bucket's.
+	Buckets []int64 `json:"-"`
+}
+
+func NewTransferStats(events EventSink) *TransferStats {
+	return &TransferStats{
+		MinSize:    1024 * 1024,
+		events:     events,
+		directions: make(map[string]*transferHistogram),
+	}
+}
+
+// Record adds a completed transfer to the stats. A nil TransferStats ignores the transfer.
+func (s *TransferStats) Record(t Transfer) {
+	if s == nil {
+		return
+	}
+
+	throughput := t.Throughput()
+	slow := t.Bytes >= s.MinSize && s.SlowRate > 0 && throughput < s.SlowRate
+
+	s.mu.Lock()
+	h, ok := s.directions[t.Direction]
+	if !ok {
+		h = &transferHistogram{Buckets: make([]int64, len(throughputBuckets)+1)}
+		s.directions[t.Direction] = h
+	}
+
+	h.Count++
+	h.Bytes += t.Bytes
+
+	if t.Bytes >= s.MinSize {
+		bucket := len(throughputBuckets)
+		for i, bound := range throughputBuckets {
+			if throughput <= bound {
+				bucket = i
+				break
+			}
+		}
+		h.Buckets[bucket]++
+	}
+
+	if slow {
+		s.slow++
+	}
+	s.mu.Unlock()
+
+	if slow {
+		details := transferDetails(t, throughput)
+		details["slow_rate_per_second"] = strconv.FormatInt(s.SlowRate, 10)
+		s.events.Emit(Event{
+			Type:      EventSlowTransfer,
+			Time:      time.Now(),
+			ProjectID: t.ProjectID,
+			Path:      t.Path,
+			Details:   details,
+		})
+	}
+
+	if s.TraceTimings && t.Timing != nil {
+		s.events.Emit(Event{
+			Type:      EventTransferCompleted,
+			Time:      time.Now(),
+			ProjectID: t.ProjectID,
+			Path:      t.Path,
+			Details:   transferDetails(t, throughput),
+		})
+	}
+}
+
+// transferDetails returns the details of an event about transfer t, including its timing breakdown when
+// it has one.
+func transferDetails(t Transfer, throughput int64) map[string]string {
+	details := map[string]string{
+		"direction":        t.Direction,
+		"protocol":         t.Protocol,
+		"user_id":          strconv.Itoa(t.UserID),
+		"bytes":            strconv.FormatInt(t.Bytes, 10),
+		"duration":         t.Duration.String(),
+		"bytes_per_second": strconv.FormatInt(throughput, 10),
+	}
+
+	if t.Timing != nil {
+		t.Timing.AddTo(details)
+	}
+
+	return details
+}
+
+// String returns the stats as JSON. The histogram for each direction is keyed by the upper bound of each
+// bucket in bytes per second.
+func (s *TransferStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type histogramJSON struct {
+		*transferHistogram
+		Throughput map[string]int64 `json:"throughput_histogram"`
+	}
+
+	directions := make(map[string]histogramJSON, len(s.directions))
+	for direction, h := range s.directions {
+		buckets := make(map[string]int64, len(h.Buckets))
+		for i, count := range h.Buckets {
+			bound := "+Inf"
+			if i < len(throughputBuckets) {
+				bound = fmt.Sprint(throughputBuckets[i])
+			}
+			buckets[bound] = count
+		}
+		directions[direction] = histogramJSON{transferHistogram: h, Throughput: buckets}
+	}
+
+	b, _ := json.Marshal(struct {
+		Directions map[string]histogramJSON `json:"directions"`
+		Slow       int64                    `json:"slow"`
+	}{directions, s.slow})
+
+	return string(b)
+}
+
+// NewReader returns a reader that records a transfer of the bytes read from r once r returns io.EOF. The
+// transfer's duration is measured from the first Read, and its Bytes and Duration are filled in from
+// the reads, as is the Transfer of its Timing when it has one. A nil TransferStats returns r.
+func (s *TransferStats) NewReader(r io.Reader, t Transfer) io.Reader {
+	if s == nil {
+		return r
+	}
+
+	return &transferReader{Reader: r, stats: s, transfer: t}
+}
+
+type transferReader struct {
+	io.Reader
+	stats    *TransferStats
+	transfer Transfer
+	started  time.Time
+	recorded bool
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+
+	n, err := r.Reader.Read(p)
+	r.transfer.Bytes += int64(n)
+
+	if errors.Is(err, io.EOF) && !r.recorded {
+		r.recorded = true
+		r.transfer.Duration = time.Since(r.started)
+		if r.transfer.Timing != nil {
+			timing := *r.transfer.Timing
+			timing.Transfer = r.transfer.Duration
+			r.transfer.Timing = &timing
+		}
+		r.stats.Record(r.transfer)
+	}
+
+	return n, err
+}
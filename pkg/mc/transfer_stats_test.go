@@ -0,0 +1,73 @@
+package mc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferStats_Record(t *testing.T) {
+	events := &eventCollector{}
+	stats := NewTransferStats(events)
+	stats.SlowRate = 1024 * 1024
+
+	// 10MB in 1s is fast enough, 10MB in 100s isn't, and a small transfer is never slow.
+	stats.Record(Transfer{Direction: TransferUpload, Bytes: 10 * 1024 * 1024, Duration: time.Second})
+	stats.Record(Transfer{Direction: TransferUpload, Bytes: 10 * 1024 * 1024, Duration: 100 * time.Second, Path: "/slow.dat"})
+	stats.Record(Transfer{Direction: TransferDownload, Bytes: 10, Duration: time.Minute})
+
+	require.Len(t, events.events, 1)
+	require.Equal(t, EventSlowTransfer, events.events[0].Type)
+	require.Equal(t, "/slow.dat", events.events[0].Path)
+
+	require.JSONEq(t, `{
+		"directions": {
+			"upload": {"count": 2, "bytes": 20971520, "throughput_histogram": {
+				"65536": 0, "262144": 1, "1048576": 0, "4194304": 0, "16777216": 1, "67108864": 0, "268435456": 0, "+Inf": 0}},
+			"download": {"count": 1, "bytes": 10, "throughput_histogram": {
+				"65536": 0, "262144": 0, "1048576": 0, "4194304": 0, "16777216": 0, "67108864": 0, "268435456": 0, "+Inf": 0}}
+		},
+		"slow": 1
+	}`, stats.String())
+}
+
+func TestTransferStats_NewReader(t *testing.T) {
+	stats := NewTransferStats(&eventCollector{})
+	stats.MinSize = 0
+
+	r := stats.NewReader(bytes.NewReader(make([]byte, 1000)), Transfer{Direction: TransferDownload})
+	n, err := io.Copy(io.Discard, r)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), n)
+	require.Equal(t, int64(1), stats.directions[TransferDownload].Count)
+	require.Equal(t, int64(1000), stats.directions[TransferDownload].Bytes)
+
+	var nilStats *TransferStats
+	require.NotPanics(t, func() { nilStats.Record(Transfer{}) })
+}
+
+func TestTransferStats_TraceTimings(t *testing.T) {
+	events := &eventCollector{}
+	stats := NewTransferStats(events)
+	timing := &TransferTiming{Auth: 5 * time.Millisecond, Resolve: time.Millisecond, Transfer: 2 * time.Second, Hash: 1500 * time.Microsecond, Commit: 40 * time.Millisecond}
+
+	// Only the transfers with a timing breakdown are traced, and only once tracing is turned on.
+	stats.Record(Transfer{Direction: TransferUpload, Bytes: 10, Timing: timing})
+	stats.TraceTimings = true
+	stats.Record(Transfer{Direction: TransferUpload, Bytes: 10})
+	stats.Record(Transfer{Direction: TransferUpload, Protocol: "sftp", Bytes: 10, Path: "/a.dat", Timing: timing})
+
+	require.Len(t, events.events, 1)
+	event := events.events[0]
+	require.Equal(t, EventTransferCompleted, event.Type)
+	require.Equal(t, "/a.dat", event.Path)
+	require.Equal(t, "sftp", event.Details["protocol"])
+	require.Equal(t, "5.000", event.Details["auth_ms"])
+	require.Equal(t, "1.000", event.Details["resolve_ms"])
+	require.Equal(t, "2000.000", event.Details["transfer_ms"])
+	require.Equal(t, "1.500", event.Details["hash_ms"])
+	require.Equal(t, "40.000", event.Details["commit_ms"])
+}
@@ -0,0 +1,59 @@
+package mc
+
+import (
+	"io"
+	"strconv"
+	"time"
+)
+
+// EventTransferCompleted is the Event.Type for a completed transfer, emitted with the transfer's timing
+// breakdown when TransferStats.TraceTimings is set.
+const EventTransferCompleted = "transfer.completed"
+
+// TransferTiming breaks down where the time of a transfer went, so that a slow transfer can be diagnosed
+// from its event. The parts that don't apply to a transfer, such as Commit for a download, are 0.
+type TransferTiming struct {
+	// Auth is how long authenticating the session that made the transfer took.
+	Auth time.Duration
+
+	// Resolve is the time spent finding the project, directory and file, and opening the file, before
+	// any data was transferred.
+	Resolve time.Duration
+
+	// Transfer is the time spent moving the data between the client and storage. It includes Hash,
+	// since the data is hashed as it is transferred.
+	Transfer time.Duration
+
+	// Hash is the time spent computing the checksum of the data.
+	Hash time.Duration
+
+	// Commit is the time spent finalizing an upload in the database.
+	Commit time.Duration
+}
+
+// AddTo adds the timing to the details of an event, in milliseconds.
+func (t TransferTiming) AddTo(details map[string]string) {
+	details["auth_ms"] = formatMillis(t.Auth)
+	details["resolve_ms"] = formatMillis(t.Resolve)
+	details["transfer_ms"] = formatMillis(t.Transfer)
+	details["hash_ms"] = formatMillis(t.Hash)
+	details["commit_ms"] = formatMillis(t.Commit)
+}
+
+// TimedWriter adds the time spent in the writes to Writer to Elapsed, such as to measure the time spent
+// hashing data as it is copied.
+type TimedWriter struct {
+	io.Writer
+	Elapsed time.Duration
+}
+
+func (w *TimedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.Writer.Write(p)
+	w.Elapsed += time.Since(start)
+	return n, err
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,421 @@
+package mc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// The actions an UploadHook can take.
+const (
+	// HookExtractMetadata runs the hook's command and records each key=value line it writes to stdout
+	// as metadata on the file (see MetadataStore). Without a command, the metadata embedded in the file
+	// is recorded using the built-in extractor for its format (see ExtractMetadata).
+	HookExtractMetadata = "extract-metadata"
+
+	// HookUnzip extracts a zip, tar or gzipped tar archive into the directory it was uploaded to (see
+	// ExtractArchive). It is also run on the archives uploaded into a project's extract paths (see
+	// ProjectExtractPathStore).
+	HookUnzip = "unzip"
+
+	// HookConvert queues the file for conversion, for example to create a web viewable version of it.
+	HookConvert = "convert"
+
+	// HookExec runs the hook's command.
+	HookExec = "exec"
+)
+
+// EventUploadHook is the Event.Type for an upload hook that was run on a file.
+const EventUploadHook = "upload.hook"
+
+// DefaultUploadHookTimeout is the default UploadHookRunner.Timeout.
+const DefaultUploadHookTimeout = 10 * time.Minute
+
+// DefaultUploadHookWorkers is the default UploadHookRunner.Workers.
+const DefaultUploadHookWorkers = 4
+
+// uploadHookQueueSize is the number of files that can be waiting for their hooks to be run before
+// finishing an upload waits for room in the queue.
+const uploadHookQueueSize = 1000
+
+// UploadHook is an action to take on each uploaded file whose path matches Match.
+type UploadHook struct {
+	// Match is matched against the path of the file including the project slug, for example
+	// /my-project/raw/run1.zip, so that a hook can be limited to a project.
+	Match *regexp.Regexp
+
+	// Action is one of HookExtractMetadata, HookUnzip, HookConvert or HookExec.
+	Action string
+
+	// Command is the command, and its arguments, run by the HookExec action, and by the
+	// HookExtractMetadata action when it isn't using the built-in extractors.
+	// It isn't run through a shell. The file is described to the command by environment variables:
+	// MC_FILE is the path of the file's data on the server, MC_PATH is its path in the project, and
+	// MC_PROJECT, MC_PROJECT_ID, MC_FILE_ID and MC_USER_ID are the project slug, project ID, file ID
+	// and the ID of the user who uploaded it.
+	Command []string
+}
+
+// ParseUploadHooks parses a JSON array of upload hooks, such as:
+//
+//	[
+//	  {"match": "\\.zip$", "action": "unzip"},
+//	  {"match": "^/my-project/raw/", "action": "exec", "command": ["/usr/local/bin/notify-lab"]}
+//	]
+func ParseUploadHooks(data []byte) ([]UploadHook, error) {
+	var entries []struct {
+		Match   string   `json:"match"`
+		Action  string   `json:"action"`
+		Command []string `json:"command"`
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	var hooks []UploadHook
+	for _, entry := range entries {
+		match, err := regexp.Compile(entry.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match '%s': %w", entry.Match, err)
+		}
+
+		switch entry.Action {
+		case HookExec:
+			if len(entry.Command) == 0 {
+				return nil, fmt.Errorf("the %s hook for '%s' has no command", entry.Action, entry.Match)
+			}
+		case HookExtractMetadata, HookUnzip, HookConvert:
+		default:
+			return nil, fmt.Errorf("unknown action '%s' for '%s'", entry.Action, entry.Match)
+		}
+
+		hooks = append(hooks, UploadHook{Match: match, Action: entry.Action, Command: entry.Command})
+	}
+
+	return hooks, nil
+}
+
+// UploadHookRunner runs the UploadHooks on files after they have been uploaded, so that common chores
+// such as unpacking archives happen on the server rather than in cron jobs. Like the VersionPruner, the
+// hooks are run in the background, by Run, so that they don't slow down uploads. The hooks that match a
+// file are run in order. A hook that fails is logged and doesn't stop the hooks after it. Each hook run
+// is emitted as an EventUploadHook event.
+//
+// The archives uploaded into the directories a project has opted in to automatic extraction for (see
+// ProjectExtractPathStore) are extracted after the hooks, with the project's quota reserved in the
+// runner's QuotaCounter. This is for instruments that can only write archives. Each archive is extracted
+// into the directory it was uploaded to, and is kept.
+//
+// The files are queued in memory. When the queue is full, finishing an upload waits until there is room,
+// so that a burst of uploads slows down rather than losing hook runs.
+type UploadHookRunner struct {
+	stores       *Stores
+	hooks        []UploadHook
+	config       *Config
+	events       EventSink
+	quotaCounter QuotaCounter
+	mcfsRoot     string
+
+	// Timeout is how long the command run by a hook may take.
+	Timeout time.Duration
+
+	// Workers is the number of files whose hooks are run at the same time.
+	Workers int
+
+	// queue holds the files waiting for their hooks to be run.
+	queue chan mcmodel.File
+
+	// stopped is closed when Run returns, so that nothing waits to queue a file that won't be run.
+	stopped chan struct{}
+}
+
+// NewUploadHookRunner creates an UploadHookRunner. The files created by hooks, such as those extracted
+// from an archive, are created with stores, so they don't have hooks run on them unless stores has the
+// runner's Middleware. The extracted files reserve room in their project's quota in quotaCounter.
+func NewUploadHookRunner(stores *Stores, hooks []UploadHook, config *Config, events EventSink, quotaCounter QuotaCounter, mcfsRoot string) *UploadHookRunner {
+	return &UploadHookRunner{
+		stores:       stores,
+		hooks:        hooks,
+		config:       config,
+		events:       events,
+		quotaCounter: quotaCounter,
+		mcfsRoot:     mcfsRoot,
+		Timeout:      DefaultUploadHookTimeout,
+		Workers:      DefaultUploadHookWorkers,
+		queue:        make(chan mcmodel.File, uploadHookQueueSize),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Middleware returns a StoreMiddleware that queues each file that FileStore.DoneWritingToFile finished
+// to have its hooks run. Without any hooks only archives are queued, in case they were uploaded into an
+// extract path. A file finished in a transaction that is then rolled back is skipped by RunHooks.
+func (r *UploadHookRunner) Middleware() StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &hookFileStore{FileStore: fileStore, runner: r}
+		},
+	}
+}
+
+// Run runs the hooks for the queued files, on up to Workers files at a time, until ctx is done. Run
+// should only be called once.
+func (r *UploadHookRunner) Run(ctx context.Context) {
+	defer close(r.stopped)
+
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// work runs the hooks for queued files until ctx is done.
+func (r *UploadHookRunner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-r.queue:
+			if _, err := r.RunHooks(ctx, &file); err != nil {
+				log.Errorf("Unable to run upload hooks for file %d in project %d: %s", file.ID, file.ProjectID, err)
+			}
+		}
+	}
+}
+
+// RunHooks runs the hooks that match file's path, and extracts it if it is an archive in one of its
+// project's extract paths. It returns the number of hooks run, including the extraction. An error is only
+// returned when the file couldn't be looked up.
+func (r *UploadHookRunner) RunHooks(ctx context.Context, file *mcmodel.File) (int, error) {
+	project, err := r.stores.ProjectStore.GetProjectByID(file.ProjectID)
+	if err != nil {
+		return 0, err
+	}
+
+	versions, err := r.stores.VersionStore.ListVersions(file)
+	if err != nil {
+		return 0, err
+	}
+
+	// Use the stored version of the file, which has its directory, and is missing if the upload was
+	// rolled back.
+	var current *mcmodel.File
+	for i := range versions {
+		if versions[i].ID == file.ID && versions[i].Directory != nil {
+			current = &versions[i]
+			break
+		}
+	}
+
+	if current == nil {
+		return 0, nil
+	}
+
+	path := current.FullPath()
+	matchPath := filepath.Join("/", project.Slug, path)
+
+	hooks := r.hooks
+	if hook, ok := r.extractPathHook(project, path); ok {
+		hooks = append(hooks[:len(hooks):len(hooks)], hook)
+	}
+
+	run := 0
+	for _, hook := range hooks {
+		if !hook.Match.MatchString(matchPath) {
+			continue
+		}
+
+		outcome := "ok"
+		if err := r.runHook(ctx, hook, project, current, path); err != nil {
+			log.Errorf("Upload hook %s failed for %s: %s", hook.Action, matchPath, err)
+			outcome = err.Error()
+		}
+
+		run++
+		r.events.Emit(Event{
+			Type:      EventUploadHook,
+			Time:      time.Now(),
+			ProjectID: project.ID,
+			FileID:    current.ID,
+			Path:      path,
+			Details: map[string]string{
+				"action":  hook.Action,
+				"match":   hook.Match.String(),
+				"outcome": outcome,
+			},
+		})
+	}
+
+	return run, nil
+}
+
+// runHook runs hook for file. A hook that panics, such as on a malformed file, only fails itself.
+func (r *UploadHookRunner) runHook(ctx context.Context, hook UploadHook, project *mcmodel.Project, file *mcmodel.File, path string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("hook panicked: %v", p)
+		}
+	}()
+
+	switch hook.Action {
+	case HookConvert:
+		_, err := r.stores.ConversionStore.AddFileToConvert(file)
+		return err
+	case HookUnzip:
+		extracted, err := ExtractArchive(r.stores, r.quotaCounter, r.config, project, file, filepath.Dir(path), r.mcfsRoot)
+		log.Infof("Extracted %d files from %s in project %d", extracted, path, project.ID)
+		return err
+	case HookExec:
+		_, err := r.runCommand(ctx, hook.Command, project, file, path)
+		return err
+	case HookExtractMetadata:
+		var metadata map[string]string
+		if len(hook.Command) == 0 {
+			var err error
+			if metadata, err = ExtractMetadata(file.ToUnderlyingFilePath(r.mcfsRoot), file.Name); err != nil {
+				return err
+			}
+		} else {
+			out, err := r.runCommand(ctx, hook.Command, project, file, path)
+			if err != nil {
+				return err
+			}
+			metadata = parseMetadata(out)
+		}
+
+		if len(metadata) == 0 {
+			return nil
+		}
+
+		return r.stores.MetadataStore.SetFileMetadata(file, metadata)
+	default:
+		return fmt.Errorf("unknown action '%s'", hook.Action)
+	}
+}
+
+// extractPathHook returns a HookUnzip hook for the file at path, a path in project, when the file is an
+// archive in one of the project's extract paths.
+func (r *UploadHookRunner) extractPathHook(project *mcmodel.Project, path string) (UploadHook, bool) {
+	if !IsArchive(path) || r.stores.ProjectExtractPathStore == nil {
+		return UploadHook{}, false
+	}
+
+	extractPaths, err := r.stores.ProjectExtractPathStore.GetExtractPaths(project.ID)
+	if err != nil {
+		log.Errorf("Unable to look up the extract paths of project %d: %s", project.ID, err)
+		return UploadHook{}, false
+	}
+
+	if !InExtractPath(extractPaths, path) {
+		return UploadHook{}, false
+	}
+
+	match := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Join("/", project.Slug, path)) + "$")
+	return UploadHook{Match: match, Action: HookUnzip}, true
+}
+
+// runCommand runs command for file, and returns what it wrote to stdout.
+func (r *UploadHookRunner) runCommand(ctx context.Context, command []string, project *mcmodel.Project, file *mcmodel.File, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"MC_FILE="+file.ToUnderlyingFilePath(r.mcfsRoot),
+		"MC_PATH="+path,
+		"MC_PROJECT="+project.Slug,
+		"MC_PROJECT_ID="+strconv.Itoa(project.ID),
+		"MC_FILE_ID="+strconv.Itoa(file.ID),
+		"MC_USER_ID="+strconv.Itoa(file.OwnerID),
+	)
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// parseMetadata parses the key=value lines in out. Blank lines, lines starting with # and lines without
+// an = are skipped.
+func parseMetadata(out []byte) map[string]string {
+	metadata := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+
+		metadata[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return metadata
+}
+
+// enqueue queues file to have its hooks run. When the queue is full it waits for room, unless the
+// runner has stopped.
+func (r *UploadHookRunner) enqueue(file mcmodel.File) {
+	select {
+	case r.queue <- file:
+		return
+	default:
+	}
+
+	log.Warnf("Upload hook queue is full, waiting to queue file %d in project %d", file.ID, file.ProjectID)
+	select {
+	case r.queue <- file:
+	case <-r.stopped:
+		log.Errorf("Upload hooks have stopped, not running hooks for file %d in project %d", file.ID, file.ProjectID)
+	}
+}
+
+// hookFileStore queues files on the runner after DoneWritingToFile succeeds.
+type hookFileStore struct {
+	store.FileStore
+	runner *UploadHookRunner
+}
+
+func (s *hookFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	switched, err := s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+	if err == nil && (len(s.runner.hooks) != 0 || IsArchive(file.Name)) {
+		s.runner.enqueue(*file)
+	}
+
+	return switched, err
+}
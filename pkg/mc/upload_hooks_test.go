@@ -0,0 +1,302 @@
+package mc
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+// uuidFileStore gives the files created by a FakeFileStore a UUID, so that their data is written to a
+// path of its own.
+type uuidFileStore struct {
+	*store.FakeFileStore
+}
+
+func (s uuidFileStore) CreateFile(name string, projectID, directoryID, ownerID int, mimeType string) (*mcmodel.File, error) {
+	f, err := s.FakeFileStore.CreateFile(name, projectID, directoryID, ownerID, mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	f.UUID, err = uuid.GenerateUUID()
+	return f, err
+}
+
+func TestParseUploadHooks(t *testing.T) {
+	hooks, err := ParseUploadHooks([]byte(`[
+		{"match": "\\.zip$", "action": "unzip"},
+		{"match": "^/proj/raw/", "action": "exec", "command": ["/bin/true"]}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, hooks, 2)
+	require.Equal(t, HookUnzip, hooks[0].Action)
+	require.True(t, hooks[1].Match.MatchString("/proj/raw/run1.dat"))
+	require.Equal(t, []string{"/bin/true"}, hooks[1].Command)
+
+	for _, invalid := range []string{
+		`{"match": ".*", "action": "unzip"}`,
+		`[{"match": "(", "action": "unzip"}]`,
+		`[{"match": ".*", "action": "delete"}]`,
+		`[{"match": ".*", "action": "exec"}]`,
+	} {
+		_, err := ParseUploadHooks([]byte(invalid))
+		require.Error(t, err, "ParseUploadHooks should have failed for %s", invalid)
+	}
+}
+
+func TestUploadHookRunner_RunHooks(t *testing.T) {
+	mcfsRoot := t.TempDir()
+
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", MimeType: "directory", DirectoryID: 1},
+	}
+
+	archive := mcmodel.File{ID: 10, ProjectID: 1, OwnerID: 3, Name: "run1.zip", DirectoryID: 2, Directory: &files[1], Current: true}
+	archive.UUID, _ = uuid.GenerateUUID()
+	require.NoError(t, os.MkdirAll(archive.ToUnderlyingDirPath(mcfsRoot), 0777))
+	writeZip(t, archive.ToUnderlyingFilePath(mcfsRoot), map[string]string{
+		"a.txt":         "a",
+		"sub/b.txt":     "b",
+		"../escape.txt": "c",
+		".DS_Store":     "ignored",
+	})
+
+	metadataStore := NewFakeMetadataStore()
+	fileStore := uuidFileStore{FakeFileStore: store.NewFakeFileStore(files)}
+	stores := &Stores{
+		FileStore:        fileStore,
+		ProjectStore:     store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: NewFakePendingFileStore(),
+		VersionStore:     NewFakeVersionStore(archive),
+		MetadataStore:    metadataStore,
+	}
+
+	hooks, err := ParseUploadHooks([]byte(`[
+		{"match": "^/proj/raw/.*\\.zip$", "action": "unzip"},
+		{"match": "\\.zip$", "action": "extract-metadata", "command": ["sh", "-c", "echo project=$MC_PROJECT; echo '# comment'; echo path = $MC_PATH"]},
+		{"match": "^/other/", "action": "exec", "command": ["false"]}
+	]`))
+	require.NoError(t, err)
+
+	events := &eventCollector{}
+	runner := NewUploadHookRunner(stores, hooks, DefaultConfig(), events, NewInMemoryQuotaCounter(), mcfsRoot)
+
+	run, err := runner.RunHooks(context.Background(), &mcmodel.File{ID: 10, Name: "run1.zip", ProjectID: 1, DirectoryID: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, run)
+	require.Len(t, events.events, 2)
+	require.Equal(t, "ok", events.events[0].Details["outcome"])
+	require.Equal(t, "ok", events.events[1].Details["outcome"])
+
+	for _, path := range []string{"/raw/a.txt", "/raw/sub/b.txt", "/raw/escape.txt"} {
+		_, err := fileStore.GetFileByPath(1, path)
+		require.NoError(t, err, "%s should have been extracted", path)
+	}
+
+	_, err = fileStore.GetFileByPath(1, "/raw/.DS_Store")
+	require.Error(t, err, "Ignored entries aren't extracted")
+
+	require.Equal(t, map[string]string{"project": "proj", "path": "/raw/run1.zip"}, metadataStore.Metadata[10])
+
+	// A file that is no longer stored, such as one whose upload was rolled back, is skipped.
+	run, err = runner.RunHooks(context.Background(), &mcmodel.File{ID: 11, Name: "run1.zip", ProjectID: 1, DirectoryID: 2})
+	require.NoError(t, err)
+	require.Equal(t, 0, run)
+}
+
+func TestUploadHookRunner_ExtractPaths(t *testing.T) {
+	mcfsRoot := t.TempDir()
+
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "incoming", Path: "/incoming", MimeType: "directory", DirectoryID: 1},
+		{ID: 3, ProjectID: 1, Name: "other", Path: "/other", MimeType: "directory", DirectoryID: 1},
+	}
+
+	var archives []mcmodel.File
+	for _, dir := range files[1:] {
+		dir := dir
+		archive := mcmodel.File{ID: 10 + dir.ID, ProjectID: 1, OwnerID: 3, Name: "run1.zip", DirectoryID: dir.ID, Directory: &dir, Current: true}
+		archive.UUID, _ = uuid.GenerateUUID()
+		require.NoError(t, os.MkdirAll(archive.ToUnderlyingDirPath(mcfsRoot), 0777))
+		writeZip(t, archive.ToUnderlyingFilePath(mcfsRoot), map[string]string{"a.txt": "a"})
+		archives = append(archives, archive)
+	}
+
+	extractPaths := NewFakeProjectExtractPathStore()
+	require.NoError(t, extractPaths.SetExtractPaths(1, []string{"/incoming"}))
+
+	fileStore := uuidFileStore{FakeFileStore: store.NewFakeFileStore(files)}
+	stores := &Stores{
+		FileStore:               fileStore,
+		ProjectStore:            store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		PendingFileStore:        NewFakePendingFileStore(),
+		VersionStore:            NewFakeVersionStore(archives...),
+		ProjectExtractPathStore: extractPaths,
+	}
+
+	events := &eventCollector{}
+	runner := NewUploadHookRunner(stores, nil, DefaultConfig(), events, NewInMemoryQuotaCounter(), mcfsRoot)
+
+	// Only the archive in the project's extract path is extracted.
+	run, err := runner.RunHooks(context.Background(), &archives[0])
+	require.NoError(t, err)
+	require.Equal(t, 1, run)
+	require.Equal(t, HookUnzip, events.events[0].Details["action"])
+	_, err = fileStore.GetFileByPath(1, "/incoming/a.txt")
+	require.NoError(t, err)
+
+	run, err = runner.RunHooks(context.Background(), &archives[1])
+	require.NoError(t, err)
+	require.Equal(t, 0, run)
+	_, err = fileStore.GetFileByPath(1, "/other/a.txt")
+	require.Error(t, err)
+
+	// Without any hooks only archives are queued.
+	hookStore := runner.Middleware().FileStore(store.NewFakeFileStore(files))
+	_, err = hookStore.DoneWritingToFile(&mcmodel.File{ID: 20, ProjectID: 1, Name: "a.txt", DirectoryID: 2}, "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, runner.queue, 0)
+
+	_, err = hookStore.DoneWritingToFile(&archives[0], "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, runner.queue, 1)
+}
+
+// blockingConversionStore holds each AddFileToConvert until release is closed, and records how many
+// were held at once.
+type blockingConversionStore struct {
+	store.ConversionStore
+	release chan struct{}
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	converted  int
+}
+
+func (s *blockingConversionStore) AddFileToConvert(file *mcmodel.File) (*mcmodel.Conversion, error) {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mu.Unlock()
+
+	<-s.release
+
+	s.mu.Lock()
+	s.running--
+	s.converted++
+	s.mu.Unlock()
+	return &mcmodel.Conversion{}, nil
+}
+
+func TestUploadHookRunner_QueueBackpressure(t *testing.T) {
+	dir := mcmodel.File{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"}
+	var uploads []mcmodel.File
+	for id := 10; id < 15; id++ {
+		uploads = append(uploads, mcmodel.File{ID: id, ProjectID: 1, Name: fmt.Sprintf("%d.txt", id), DirectoryID: 1, Directory: &dir})
+	}
+
+	conversionStore := &blockingConversionStore{release: make(chan struct{})}
+	stores := &Stores{
+		ProjectStore:    store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		ConversionStore: conversionStore,
+		VersionStore:    NewFakeVersionStore(uploads...),
+	}
+
+	hooks, err := ParseUploadHooks([]byte(`[{"match": ".*", "action": "convert"}]`))
+	require.NoError(t, err)
+
+	runner := NewUploadHookRunner(stores, hooks, DefaultConfig(), &eventCollector{}, NewInMemoryQuotaCounter(), t.TempDir())
+	runner.Workers = 2
+	runner.queue = make(chan mcmodel.File, 1)
+	fileStore := runner.Middleware().FileStore(store.NewFakeFileStore([]mcmodel.File{dir}))
+
+	// Without a running runner the first upload fills the queue, and the next one waits for room rather
+	// than being dropped.
+	_, err = fileStore.DoneWritingToFile(&uploads[0], "", 0, nil)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range uploads[1:] {
+			_, err := fileStore.DoneWritingToFile(&uploads[i+1], "", 0, nil)
+			require.NoError(t, err)
+		}
+	}()
+
+	select {
+	case <-done:
+		require.Fail(t, "finishing uploads should wait while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		runner.Run(ctx)
+	}()
+
+	// No more than Workers files have their hooks run at once, so while they are held the queue stays
+	// full and the remaining uploads keep waiting.
+	require.Eventually(t, func() bool {
+		conversionStore.mu.Lock()
+		defer conversionStore.mu.Unlock()
+		return conversionStore.running == 2
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		require.Fail(t, "finishing uploads should wait while the workers are busy")
+	default:
+	}
+
+	close(conversionStore.release)
+	<-done
+
+	require.Eventually(t, func() bool {
+		conversionStore.mu.Lock()
+		defer conversionStore.mu.Unlock()
+		return conversionStore.converted == len(uploads)
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, conversionStore.maxRunning)
+
+	cancel()
+	<-stopped
+
+	// Once the runner has stopped, finishing an upload doesn't wait for a queue that won't be drained.
+	runner.queue <- uploads[0]
+	_, err = fileStore.DoneWritingToFile(&uploads[1], "", 0, nil)
+	require.NoError(t, err)
+}
+
+func writeZip(t *testing.T, path string, entries map[string]string) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for name, contents := range entries {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, zw.Close())
+}
@@ -0,0 +1,34 @@
+package mc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// PrecheckUnchanged reads an upload of size bytes from r, when it could be the same as current, the current
+// version of the file at the upload's path, and returns true if it is. The upload is only read when it
+// is no larger than limit and is the same size as current, so that re-uploading a tree of mostly unchanged
+// files, such as with scp -r, doesn't create a version, or write any data, for the files that haven't
+// changed. The returned reader reads the upload from the start, including what was read, for when the
+// upload isn't the same. A limit of 0 turns off the check.
+func PrecheckUnchanged(current *mcmodel.File, size, limit int64, r io.Reader) (bool, io.Reader, error) {
+	if limit <= 0 || size > limit || current == nil || current.IsDir() || current.Checksum == "" || int64(current.Size) != size {
+		return false, r, nil
+	}
+
+	var buf bytes.Buffer
+	hasher := md5.New()
+	if _, err := io.CopyN(io.MultiWriter(&buf, hasher), r, size); err != nil {
+		return false, nil, err
+	}
+
+	if fmt.Sprintf("%x", hasher.Sum(nil)) == current.Checksum {
+		return true, nil, nil
+	}
+
+	return false, io.MultiReader(&buf, r), nil
+}
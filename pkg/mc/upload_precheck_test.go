@@ -0,0 +1,52 @@
+package mc
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrecheckUnchanged(t *testing.T) {
+	current := &mcmodel.File{Size: 5, MimeType: "text/plain", Checksum: fmt.Sprintf("%x", md5.Sum([]byte("hello")))}
+
+	tests := []struct {
+		name      string
+		current   *mcmodel.File
+		data      string
+		limit     int64
+		unchanged bool
+	}{
+		{name: "same", current: current, data: "hello", limit: 10, unchanged: true},
+		{name: "different data", current: current, data: "jello", limit: 10},
+		{name: "different size", current: current, data: "hello!", limit: 10},
+		{name: "over limit", current: current, data: "hello", limit: 4},
+		{name: "turned off", current: current, data: "hello", limit: 0},
+		{name: "no current version", data: "hello", limit: 10},
+		{name: "directory", current: &mcmodel.File{MimeType: "directory", Size: 5, Checksum: current.Checksum}, data: "hello", limit: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unchanged, r, err := PrecheckUnchanged(test.current, int64(len(test.data)), test.limit, strings.NewReader(test.data))
+			require.NoError(t, err)
+			require.Equal(t, test.unchanged, unchanged)
+			if unchanged {
+				return
+			}
+
+			// Whatever was read for the check is read again.
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, test.data, string(data))
+		})
+	}
+
+	// The client disconnecting before sending the whole file is an error.
+	_, _, err := PrecheckUnchanged(current, 5, 10, strings.NewReader("hel"))
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,153 @@
+package mc
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// UploadSource is where a session's uploads come from: the SSH client software, as given in its version
+// string such as SSH-2.0-OpenSSH_8.9p1, the address it connected from and the ID of the session.
+type UploadSource struct {
+	ClientVersion string
+	RemoteAddr    string
+	SessionID     string
+}
+
+// NewUploadSource creates the UploadSource for a session with clientVersion, connected from remoteAddr,
+// whose port isn't kept.
+func NewUploadSource(clientVersion string, remoteAddr net.Addr, sessionID string) UploadSource {
+	return UploadSource{ClientVersion: clientVersion, RemoteAddr: remoteHost(remoteAddr), SessionID: sessionID}
+}
+
+// UploadProvenance records where the file version with FileID was uploaded from, so that years later it
+// can still be told which machine, and which client, uploaded it.
+type UploadProvenance struct {
+	FileID        int       `gorm:"primaryKey" json:"file_id"`
+	ProjectID     int       `json:"project_id"`
+	UserID        int       `json:"user_id"`
+	Protocol      string    `json:"protocol"`
+	ClientVersion string    `json:"client_version"`
+	RemoteAddr    string    `json:"remote_addr"`
+	SessionID     string    `json:"session_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// UploadProvenanceStore holds the UploadProvenance of each uploaded file version. It is kept in the
+// file_upload_provenance table, which mc-sshd adds to the Materials Commons database:
+//
+//	CREATE TABLE file_upload_provenance (
+//	    file_id INT UNSIGNED PRIMARY KEY,
+//	    project_id INT UNSIGNED NOT NULL,
+//	    user_id INT UNSIGNED NOT NULL,
+//	    protocol VARCHAR(16) NOT NULL,
+//	    client_version VARCHAR(255) NOT NULL,
+//	    remote_addr VARCHAR(64) NOT NULL,
+//	    session_id VARCHAR(64) NOT NULL,
+//	    created_at TIMESTAMP NULL,
+//	    INDEX (project_id),
+//	    INDEX (remote_addr)
+//	);
+type UploadProvenanceStore interface {
+	// AddUploadProvenance records where a file version was uploaded from.
+	AddUploadProvenance(provenance *UploadProvenance) error
+
+	// GetUploadProvenance returns the provenance of each file in fileIDs that has one, keyed by the
+	// file's ID.
+	GetUploadProvenance(fileIDs []int) (map[int]*UploadProvenance, error)
+}
+
+func (UploadProvenance) TableName() string {
+	return "file_upload_provenance"
+}
+
+// RecordUploadProvenance records that file, which was just uploaded over protocol by the user with
+// userID, came from source. Failures are logged rather than returned, as the upload itself succeeded.
+// Nothing is recorded when there is no UploadProvenanceStore.
+func RecordUploadProvenance(provenanceStore UploadProvenanceStore, file *mcmodel.File, userID int, protocol string, source UploadSource) {
+	if provenanceStore == nil {
+		return
+	}
+
+	err := provenanceStore.AddUploadProvenance(&UploadProvenance{
+		FileID:        file.ID,
+		ProjectID:     file.ProjectID,
+		UserID:        userID,
+		Protocol:      protocol,
+		ClientVersion: source.ClientVersion,
+		RemoteAddr:    source.RemoteAddr,
+		SessionID:     source.SessionID,
+	})
+
+	if err != nil {
+		log.Errorf("Unable to record the provenance of file %d: %s", file.ID, err)
+	}
+}
+
+type GormUploadProvenanceStore struct {
+	db *gorm.DB
+}
+
+func NewGormUploadProvenanceStore(db *gorm.DB) *GormUploadProvenanceStore {
+	return &GormUploadProvenanceStore{db: db}
+}
+
+func (s *GormUploadProvenanceStore) AddUploadProvenance(provenance *UploadProvenance) error {
+	return s.db.Create(provenance).Error
+}
+
+func (s *GormUploadProvenanceStore) GetUploadProvenance(fileIDs []int) (map[int]*UploadProvenance, error) {
+	provenance := make(map[int]*UploadProvenance)
+	if len(fileIDs) == 0 {
+		return provenance, nil
+	}
+
+	var rows []UploadProvenance
+	if err := s.db.Where("file_id IN ?", fileIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		provenance[rows[i].FileID] = &rows[i]
+	}
+
+	return provenance, nil
+}
+
+// FakeUploadProvenanceStore is an UploadProvenanceStore for testing, and for the offline server.
+// Provenance maps the ID of each uploaded file to its provenance.
+type FakeUploadProvenanceStore struct {
+	mu         sync.Mutex
+	Provenance map[int]UploadProvenance
+}
+
+func NewFakeUploadProvenanceStore() *FakeUploadProvenanceStore {
+	return &FakeUploadProvenanceStore{Provenance: make(map[int]UploadProvenance)}
+}
+
+func (s *FakeUploadProvenanceStore) AddUploadProvenance(provenance *UploadProvenance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provenance.CreatedAt = time.Now()
+	s.Provenance[provenance.FileID] = *provenance
+	return nil
+}
+
+func (s *FakeUploadProvenanceStore) GetUploadProvenance(fileIDs []int) (map[int]*UploadProvenance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provenance := make(map[int]*UploadProvenance)
+	for _, id := range fileIDs {
+		if p, ok := s.Provenance[id]; ok {
+			provenance[id] = &p
+		}
+	}
+
+	return provenance, nil
+}
@@ -0,0 +1,129 @@
+package mc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// UserStorageUsage is the storage used across all projects by the files a user uploaded.
+type UserStorageUsage struct {
+	User  string `json:"user"`
+	Size  int64  `json:"bytes"`
+	Files int64  `json:"files"`
+}
+
+// UserUsageStats keeps the storage used by each user, across all their projects, for the metrics.
+// Totaling up the usage means going through every file, so it is done by Refresh, which Run calls every
+// interval, rather than on every scrape. UserUsageStats implements expvar.Var so that it can be published
+// with expvar.Publish, and WritePrometheus writes it in the Prometheus text format.
+type UserUsageStats struct {
+	store UserUsageStore
+
+	mu          sync.Mutex
+	usage       []UserStorageUsage
+	refreshedAt time.Time
+}
+
+func NewUserUsageStats(store UserUsageStore) *UserUsageStats {
+	return &UserUsageStats{store: store}
+}
+
+// Refresh totals up the usage of each user from the store. The usage from the last successful Refresh is
+// kept when it fails.
+func (u *UserUsageStats) Refresh() error {
+	usage, err := u.store.ListUserUsage()
+	if err != nil {
+		log.Errorf("Unable to total up the storage used by each user: %s", err)
+		return err
+	}
+
+	// The usage is ordered by user, so each user's projects are next to each other.
+	var totals []UserStorageUsage
+	for _, uu := range usage {
+		if len(totals) == 0 || totals[len(totals)-1].User != uu.UserSlug {
+			totals = append(totals, UserStorageUsage{User: uu.UserSlug})
+		}
+
+		total := &totals[len(totals)-1]
+		total.Size += uu.Size
+		total.Files += uu.Files
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usage, u.refreshedAt = totals, time.Now()
+	return nil
+}
+
+// Run calls Refresh now, and then every interval until ctx is done.
+func (u *UserUsageStats) Run(ctx context.Context, interval time.Duration) {
+	_ = u.Refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = u.Refresh()
+		}
+	}
+}
+
+// Snapshot returns the usage as of the last Refresh, ordered by user.
+func (u *UserUsageStats) Snapshot() []UserStorageUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]UserStorageUsage(nil), u.usage...)
+}
+
+// String returns the usage, and when it was last refreshed, as JSON.
+func (u *UserUsageStats) String() string {
+	u.mu.Lock()
+	refreshedAt := u.refreshedAt
+	u.mu.Unlock()
+
+	b, _ := json.Marshal(struct {
+		RefreshedAt time.Time          `json:"refreshed_at"`
+		Users       []UserStorageUsage `json:"users"`
+	}{refreshedAt, u.Snapshot()})
+	return string(b)
+}
+
+// WritePrometheus writes the usage as gauges in the Prometheus text exposition format.
+func (u *UserUsageStats) WritePrometheus(w io.Writer) error {
+	usage := u.Snapshot()
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(us UserStorageUsage) int64
+	}{
+		{"mcsshd_user_stored_bytes", "Size of the files the user uploaded, across all projects.",
+			func(us UserStorageUsage) int64 { return us.Size }},
+		{"mcsshd_user_stored_files", "Number of files the user uploaded, across all projects.",
+			func(us UserStorageUsage) int64 { return us.Files }},
+	}
+
+	for _, g := range gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name); err != nil {
+			return err
+		}
+
+		for _, us := range usage {
+			if _, err := fmt.Fprintf(w, "%s{user=\"%s\"} %d\n", g.name, escapeLabel(us.User), g.value(us)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package mc
+
+import (
+	"sort"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// UserUsage is the storage used in a project by the files a user uploaded: the total size of the current
+// versions of the files, and the number of files.
+type UserUsage struct {
+	UserID      int
+	UserSlug    string
+	ProjectID   int
+	ProjectSlug string
+	Size        int64
+	Files       int64
+}
+
+// UserUsageStore attributes the storage used by files to the users that uploaded them, rather than to
+// their projects, for departments that charge back by uploader. The usage is totaled up from the file
+// records, so there is nothing extra to keep in step as files are written and deleted.
+type UserUsageStore interface {
+	// GetUserUsage returns the usage of the user with userID in each project they uploaded files to,
+	// ordered by project slug.
+	GetUserUsage(userID int) ([]UserUsage, error)
+
+	// ListUserUsage returns the usage of every user in every project they uploaded files to, ordered by
+	// user slug and then project slug.
+	ListUserUsage() ([]UserUsage, error)
+}
+
+type GormUserUsageStore struct {
+	db *gorm.DB
+}
+
+func NewGormUserUsageStore(db *gorm.DB) *GormUserUsageStore {
+	return &GormUserUsageStore{db: db}
+}
+
+func (s *GormUserUsageStore) GetUserUsage(userID int) ([]UserUsage, error) {
+	return s.listUsage(s.usage().Where("files.owner_id = ?", userID))
+}
+
+func (s *GormUserUsageStore) ListUserUsage() ([]UserUsage, error) {
+	return s.listUsage(s.usage())
+}
+
+// usage totals up the current versions of the files by owner and project. Deleted files and the files
+// in published datasets aren't counted, the same as for GetDirectoryUsage.
+func (s *GormUserUsageStore) usage() *gorm.DB {
+	return s.db.Model(&mcmodel.File{}).
+		Select("files.owner_id AS user_id, users.slug AS user_slug, files.project_id AS project_id, "+
+			"projects.slug AS project_slug, COUNT(*) AS files, COALESCE(SUM(files.size), 0) AS size").
+		Joins("JOIN users ON users.id = files.owner_id").
+		Joins("JOIN projects ON projects.id = files.project_id").
+		Where("files.mime_type <> ?", "directory").
+		Where("files.deleted_at IS NULL").
+		Where("files.dataset_id IS NULL").
+		Where("files.current = true").
+		Group("files.owner_id, users.slug, files.project_id, projects.slug")
+}
+
+func (s *GormUserUsageStore) listUsage(query *gorm.DB) ([]UserUsage, error) {
+	var usage []UserUsage
+	if err := query.Order("users.slug, projects.slug").Scan(&usage).Error; err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// FakeUserUsageStore is a UserUsageStore for testing. The usage returned is Usage, which isn't computed
+// from any files.
+type FakeUserUsageStore struct {
+	Usage []UserUsage
+}
+
+func NewFakeUserUsageStore(usage ...UserUsage) *FakeUserUsageStore {
+	return &FakeUserUsageStore{Usage: usage}
+}
+
+func (s *FakeUserUsageStore) GetUserUsage(userID int) ([]UserUsage, error) {
+	var usage []UserUsage
+	for _, u := range s.sorted() {
+		if u.UserID == userID {
+			usage = append(usage, u)
+		}
+	}
+
+	return usage, nil
+}
+
+func (s *FakeUserUsageStore) ListUserUsage() ([]UserUsage, error) {
+	return s.sorted(), nil
+}
+
+func (s *FakeUserUsageStore) sorted() []UserUsage {
+	usage := append([]UserUsage(nil), s.Usage...)
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].UserSlug != usage[j].UserSlug {
+			return usage[i].UserSlug < usage[j].UserSlug
+		}
+		return usage[i].ProjectSlug < usage[j].ProjectSlug
+	})
+
+	return usage
+}
@@ -0,0 +1,36 @@
+package mc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserUsageStats(t *testing.T) {
+	store := NewFakeUserUsageStore(
+		UserUsage{UserID: 2, UserSlug: "bob", ProjectID: 1, ProjectSlug: "proj", Size: 100, Files: 1},
+		UserUsage{UserID: 1, UserSlug: "alice", ProjectID: 2, ProjectSlug: "proj2", Size: 2048, Files: 3},
+		UserUsage{UserID: 1, UserSlug: "alice", ProjectID: 1, ProjectSlug: "proj", Size: 1024, Files: 2},
+	)
+
+	stats := NewUserUsageStats(store)
+	require.Empty(t, stats.Snapshot())
+
+	require.NoError(t, stats.Refresh())
+	require.Equal(t, []UserStorageUsage{
+		{User: "alice", Size: 3072, Files: 5},
+		{User: "bob", Size: 100, Files: 1},
+	}, stats.Snapshot())
+
+	var metrics strings.Builder
+	require.NoError(t, stats.WritePrometheus(&metrics))
+	require.Contains(t, metrics.String(), "# TYPE mcsshd_user_stored_bytes gauge\n")
+	require.Contains(t, metrics.String(), `mcsshd_user_stored_bytes{user="alice"} 3072`)
+	require.Contains(t, metrics.String(), `mcsshd_user_stored_files{user="bob"} 1`)
+
+	usage, err := store.GetUserUsage(1)
+	require.NoError(t, err)
+	require.Len(t, usage, 2)
+	require.Equal(t, "proj", usage[0].ProjectSlug)
+}
@@ -1,48 +1,84 @@
 package mc
 
 import (
+	"errors"
 	"fmt"
 	"mime"
+	"net"
 	"path/filepath"
 	"strings"
 
 	"github.com/apex/log"
 	"github.com/materials-commons/gomcdb/mcmodel"
 	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
 )
 
 // RemoveProjectSlugFromPath removes the slug project name from the path. For example the slug
 // project name might be my-project-acf4. All paths will be prefixed with /my-project-acf4. So if
-// the path is /my-project-acf4/file.txt then this method will return /file.txt
+// the path is /my-project-acf4/file.txt then this method will return /file.txt. The path comes from
+// the client, so it is cleaned first, and the returned path always starts with a /. Only a complete
+// path component is removed, so a path of /my-project-acf4-2/file.txt is returned unchanged.
 func RemoveProjectSlugFromPath(path, projectSlug string) string {
-	cleanedPath := filepath.Clean(path)
+	cleanedPath := cleanClientPath(path)
 	sluggedNamePath := filepath.Join("/", projectSlug)
 
-	if strings.HasPrefix(cleanedPath, sluggedNamePath) {
-		cleanedPath = strings.TrimPrefix(cleanedPath, sluggedNamePath)
-	}
-
-	if cleanedPath == "" {
+	switch {
+	case cleanedPath == sluggedNamePath:
 		return "/"
+	case strings.HasPrefix(cleanedPath, sluggedNamePath+"/"):
+		return strings.TrimPrefix(cleanedPath, sluggedNamePath)
+	default:
+		return cleanedPath
 	}
-
-	return cleanedPath
 }
 
 // GetProjectSlugFromPath extracts the project slug from the beginning of the path. For example /my-project/this/that
-// has a project slug of "my-project".
+// has a project slug of "my-project". The path comes from the client, so it is cleaned first. This means that a
+// path without a leading slash (eg my-project/this) is treated as if it had one, and a path with no project
+// in it (eg "" or "/") returns an empty slug.
 func GetProjectSlugFromPath(path string) string {
-	parts := strings.Split(path, "/")
+	parts := strings.Split(cleanClientPath(path), "/")
 	// parts will be an array with the first element being an
 	// empty string. For example if the path is /my-project/this/that,
 	// then the array will be:
 	// ["", "my-project", "this", "that"]
-	// So the project slug is parts[1]
+	// So the project slug is parts[1]. A path of "/" will give ["", ""].
 	projectSlug := parts[1]
 
 	return projectSlug
 }
 
+// cleanClientPath turns a path sent by the client into a clean absolute path. Relative paths are
+// treated as starting at the root, and ".." can't be used to go above the root.
+func cleanClientPath(path string) string {
+	return NormalizeClientPath(path)
+}
+
+// NormalizeClientPath turns a path sent by the client into a clean absolute path, the same way as slugs
+// are extracted from paths, tolerating the Windows form of paths (see ClientPathToSlash).
+func NormalizeClientPath(path string) string {
+	return filepath.Clean("/" + ClientPathToSlash(path))
+}
+
+// ClientPathToSlash converts the Windows form of a path, which some Windows clients send, to the usual
+// form. Backslashes are treated as path separators, and a leading drive letter is dropped, leaving an
+// absolute path, so that C:\my-project\raw\a.tif and /C:/my-project/raw/a.tif are /my-project/raw/a.tif.
+// The path isn't cleaned, and a relative path, without a drive letter, stays relative.
+func ClientPathToSlash(path string) string {
+	path = strings.ReplaceAll(path, "\\", "/")
+	trimmed := strings.TrimLeft(path, "/")
+	if len(trimmed) >= 2 && trimmed[1] == ':' && isASCIILetter(trimmed[0]) && (len(trimmed) == 2 || trimmed[2] == '/') {
+		return "/" + strings.TrimLeft(trimmed[2:], "/")
+	}
+
+	return path
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
 // GetMimeType will determine the type of file from its extension. It strips out the extra information
 // such as the charset and just returns the underlying type. It returns "unknown" for the mime type if
 // the mime package is unable to determine the type.
@@ -69,15 +105,45 @@ func GetAndValidateProjectFromPath(path string, userID int, projectStore store.P
 	projectSlug := GetProjectSlugFromPath(path)
 
 	project, err := projectStore.GetProjectBySlug(projectSlug)
-	if err != nil {
-		log.Errorf("No such project slug %s", projectSlug)
-		return nil, err
+	return validateProject(project, err, projectSlug, userID, projectStore)
+}
+
+// validateProject checks that the project looked up for projectSlug was found, and that the user has
+// access to it. ErrProjectNotFound is only returned when there is no such project, or the user can't
+// access it. Any other lookup error, such as a database timeout, is returned as is, so that it isn't
+// taken, and cached, as the project not existing.
+func validateProject(project *mcmodel.Project, err error, projectSlug string, userID int, projectStore store.ProjectStore) (*mcmodel.Project, error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		log.Errorf("No such project slug %s: %s", projectSlug, err)
+		return nil, fmt.Errorf("%w %s", ErrProjectNotFound, projectSlug)
+	case err != nil:
+		log.Errorf("Unable to look up project slug %s: %s", projectSlug, err)
+		return nil, fmt.Errorf("unable to look up project %s: %w", projectSlug, err)
 	}
 
 	// Once we have the project we need to check that the user has access to the project.
 	if !projectStore.UserCanAccessProject(userID, project.ID) {
 		log.Errorf("User %d doesn't have access to project %d (%s)", userID, project.ID, project.Slug)
-		return nil, fmt.Errorf("no such project %s", projectSlug)
+		return nil, fmt.Errorf("%w %s", ErrProjectNotFound, projectSlug)
+	}
+
+	return project, nil
+}
+
+// GetAndValidateProjectForClient is GetAndValidateProjectFromPath for a client connected from remoteAddr.
+// The slug in the path can also be an old slug of a renamed project (see GetProjectBySlugOrAlias). It
+// also checks that the project isn't restricted to networks that the client isn't on, returning
+// ErrNetworkRestricted if it is.
+func GetAndValidateProjectForClient(path string, userID int, remoteAddr net.Addr, stores *Stores) (*mcmodel.Project, error) {
+	projectSlug := GetProjectSlugFromPath(path)
+	project, err := GetProjectBySlugOrAlias(stores, projectSlug)
+	if project, err = validateProject(project, err, projectSlug, userID, stores.ProjectStore); err != nil {
+		return nil, err
+	}
+
+	if err := CheckProjectNetwork(stores, project, remoteAddr); err != nil {
+		return nil, err
 	}
 
 	return project, nil
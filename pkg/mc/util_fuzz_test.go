@@ -0,0 +1,70 @@
+//go:build go1.18
+
+package mc
+
+import (
+	"strings"
+	"testing"
+)
+
+// The functions fuzzed here all work directly on paths sent by the client.
+
+func FuzzGetProjectSlugFromPath(f *testing.F) {
+	for _, seed := range []string{"", "/", "foo", "/my-project/this/that", "//a//b", "/../..", "/a/./b/../c"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		slug := GetProjectSlugFromPath(path)
+		if strings.Contains(slug, "/") {
+			t.Errorf("slug %q for path %q contains a /", slug, path)
+		}
+	})
+}
+
+func FuzzRemoveProjectSlugFromPath(f *testing.F) {
+	f.Add("/my-project/file.txt", "my-project")
+	f.Add("/my-project-2/file.txt", "my-project")
+	f.Add("", "")
+	f.Add("foo", "foo")
+	f.Add("/../x", "..")
+
+	f.Fuzz(func(t *testing.T, path, slug string) {
+		p := RemoveProjectSlugFromPath(path, slug)
+		if !strings.HasPrefix(p, "/") {
+			t.Errorf("path %q with slug %q gave %q which doesn't start with /", path, slug, p)
+		}
+
+		if strings.Contains(p, "/../") || strings.HasSuffix(p, "/..") {
+			t.Errorf("path %q with slug %q gave %q which contains ..", path, slug, p)
+		}
+	})
+}
+
+func FuzzSanitizePath(f *testing.F) {
+	for _, seed := range []string{"/dir1/file.txt", "/dir:1/fi\tle?.txt", "/con.txt", "/...", "/a /b.", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		sanitized, err := SanitizePath(path, SanitizeTransliterate)
+		if err != nil {
+			t.Fatalf("transliterate should never fail, got %s for %q", err, path)
+		}
+
+		for _, name := range strings.Split(sanitized, "/") {
+			if name == "" {
+				continue
+			}
+
+			if problem := nameProblem(name); problem != "" {
+				t.Errorf("sanitized name %q from path %q %s", name, path, problem)
+			}
+		}
+
+		again, _ := SanitizePath(sanitized, SanitizeTransliterate)
+		if again != sanitized {
+			t.Errorf("sanitizing is not idempotent: %q became %q then %q", path, sanitized, again)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package mc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestGetProjectSlugFromPath(t *testing.T) {
+	tests := []struct {
+		path         string
+		expectedSlug string
+	}{
+		{"/my-project/this/that", "my-project"},
+		{"/my-project", "my-project"},
+		{"my-project/this", "my-project"},
+		{"", ""},
+		{"/", ""},
+		{"foo", "foo"},
+		{"//my-project//this", "my-project"},
+		{"/../my-project/this", "my-project"},
+		{`\my-project\this`, "my-project"},
+		{`C:\my-project\this`, "my-project"},
+		{"/C:/my-project/this", "my-project"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expectedSlug, GetProjectSlugFromPath(test.path), "Wrong slug for path %q", test.path)
+	}
+}
+
+func TestRemoveProjectSlugFromPath(t *testing.T) {
+	tests := []struct {
+		path         string
+		slug         string
+		expectedPath string
+	}{
+		{"/my-project/file.txt", "my-project", "/file.txt"},
+		{"/my-project", "my-project", "/"},
+		{"/my-project/", "my-project", "/"},
+		{"my-project/dir/file.txt", "my-project", "/dir/file.txt"},
+		{"/my-project-2/file.txt", "my-project", "/my-project-2/file.txt"},
+		{"", "my-project", "/"},
+		{`/\my-project\dir\file.txt`, "my-project", "/dir/file.txt"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expectedPath, RemoveProjectSlugFromPath(test.path, test.slug), "Wrong path for %q with slug %q", test.path, test.slug)
+	}
+}
+
+func TestNormalizeClientPath(t *testing.T) {
+	tests := []struct {
+		path         string
+		expectedPath string
+	}{
+		{"/my-project/raw/a.tif", "/my-project/raw/a.tif"},
+		{`\my-project\raw\a.tif`, "/my-project/raw/a.tif"},
+		{`my-project\raw\`, "/my-project/raw"},
+		{`C:\my-project\raw\a.tif`, "/my-project/raw/a.tif"},
+		{"c:/my-project/raw", "/my-project/raw"},
+		{"/D:/my-project", "/my-project"},
+		{"C:", "/"},
+		{`\..\..\my-project`, "/my-project"},
+
+		// Only a drive letter on its own is dropped.
+		{"/ab:/my-project", "/ab:/my-project"},
+		{"/1:/my-project", "/1:/my-project"},
+		{"/my-project/C:/raw", "/my-project/C:/raw"},
+		{"C:my-project", "/C:my-project"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expectedPath, NormalizeClientPath(test.path), "Wrong path for %q", test.path)
+	}
+
+	// Relative paths stay relative until they are resolved.
+	require.Equal(t, "raw/a.tif", ClientPathToSlash(`raw\a.tif`))
+	require.Equal(t, "/my-project/raw", ClientPathToSlash(`C:\my-project/raw`))
+}
+
+func TestValidateProject(t *testing.T) {
+	projectStore := store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}})
+
+	project, err := validateProject(&mcmodel.Project{ID: 1, Slug: "proj"}, nil, "proj", 1, projectStore)
+	require.NoError(t, err)
+	require.Equal(t, 1, project.ID)
+
+	_, err = validateProject(nil, gorm.ErrRecordNotFound, "missing", 1, projectStore)
+	require.ErrorIs(t, err, ErrProjectNotFound)
+
+	// Errors other than the project not existing aren't reported as it not existing.
+	lookupErr := errors.New("database timeout")
+	_, err = validateProject(nil, lookupErr, "proj", 1, projectStore)
+	require.ErrorIs(t, err, lookupErr)
+	require.NotErrorIs(t, err, ErrProjectNotFound)
+}
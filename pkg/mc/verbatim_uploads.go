@@ -0,0 +1,50 @@
+package mc
+
+import (
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// VerbatimUploads returns a StoreMiddleware that keeps the data of every upload to the projects that
+// FeatureDedup is turned off for. FileStore.DoneWritingToFile still records the upload's checksum, but
+// when it has pointed the upload at an existing file with the same checksum the upload is pointed back at
+// its own data, so CommitFile keeps it. The projects are looked up with stores, and the feature flags are
+// taken from config on each upload, so that they can be set up after the middleware. It must be used
+// before DedupStatsMiddleware, so that the uploads it keeps aren't counted as deduplicated.
+func VerbatimUploads(stores *Stores, config *Config) StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &verbatimFileStore{FileStore: fileStore, stores: stores, config: config}
+		},
+	}
+}
+
+type verbatimFileStore struct {
+	store.FileStore
+	stores *Stores
+	config *Config
+}
+
+func (s *verbatimFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	switched, err := s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+	if err != nil || !switched {
+		return switched, err
+	}
+
+	// When the project can't be looked up the data is kept, since storing it twice is safer than losing
+	// the verbatim copy of a project that requires one.
+	project, err := s.stores.ProjectStore.GetProjectByID(file.ProjectID)
+	if err != nil {
+		log.Errorf("Unable to look up project %d to check whether file %d is kept verbatim, keeping it: %s", file.ProjectID, file.ID, err)
+	} else if s.config.DedupEnabled(project.Slug) {
+		return true, nil
+	}
+
+	// The file keeps its own data.
+	if err := s.FileStore.UpdateFileUses(file, file.UUID, file.ID); err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
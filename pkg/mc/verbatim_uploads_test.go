@@ -0,0 +1,72 @@
+package mc
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbatimUploads(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo", "forensics")
+	require.NoError(t, err)
+
+	flags, err := ParseFeatureFlags("dedup@project:forensics=off")
+	require.NoError(t, err)
+	config := &Config{Features: NewFeatureFlags(flags, nil)}
+
+	dedupStats := NewDedupStats()
+	stores = stores.Use(VerbatimUploads(stores, config), DedupStatsMiddleware(dedupStats))
+	stores = stores.Use(IdempotentUploads(stores, IdempotencyWindows{"*": time.Minute}, config))
+
+	upload := func(projectSlug, name, contents string) (*mcmodel.File, bool) {
+		project, err := stores.ProjectStore.GetProjectBySlug(projectSlug)
+		require.NoError(t, err)
+		dir, err := stores.FileStore.GetDirByPath(project.ID, "/")
+		require.NoError(t, err)
+
+		file, err := stores.FileStore.CreateFile(name, project.ID, dir.ID, 1, "text/plain")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0755))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), []byte(contents), 0644))
+
+		switched, err := CommitFile(stores, file, contents+"-checksum", int64(len(contents)), mcfsRoot)
+		require.NoError(t, err)
+		return file, switched
+	}
+
+	original, switched := upload("demo", "a.txt", "data")
+	require.False(t, switched)
+
+	// Without the flag an upload of the same data uses the existing copy.
+	copied, switched := upload("demo", "b.txt", "data")
+	require.True(t, switched)
+	require.Equal(t, original.UUID, copied.UsesUUID)
+
+	// With dedup turned off the data of every upload is kept, including a repeated upload, and its
+	// checksum is still recorded.
+	first, switched := upload("forensics", "a.txt", "data")
+	require.False(t, switched)
+	require.Equal(t, first.ToUnderlyingFilePathForUUID(mcfsRoot), first.ToUnderlyingFilePath(mcfsRoot))
+
+	repeat, switched := upload("forensics", "a.txt", "data")
+	require.False(t, switched)
+	require.NotEqual(t, first.ID, repeat.ID)
+	require.Equal(t, repeat.ToUnderlyingFilePathForUUID(mcfsRoot), repeat.ToUnderlyingFilePath(mcfsRoot))
+	require.FileExists(t, repeat.ToUnderlyingFilePath(mcfsRoot))
+
+	stored, err := stores.FileStore.GetFileByPath(repeat.ProjectID, "/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, repeat.ID, stored.ID)
+	require.Equal(t, "data-checksum", stored.Checksum)
+
+	versions, err := stores.VersionStore.ListVersions(repeat)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+
+	// Only the upload that used the existing copy is counted.
+	require.Equal(t, int64(1), dedupStats.Totals().Files)
+}
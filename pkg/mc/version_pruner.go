@@ -0,0 +1,236 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+)
+
+// PrunePolicy limits the number of versions kept for the files under a path. A version is kept if
+// either KeepLast or KeepDaily keeps it. The current version is always kept.
+type PrunePolicy struct {
+	PathRule
+
+	// KeepLast is the number of most recent versions to keep.
+	KeepLast int
+
+	// KeepDaily is the number of days, counting back from today, for which the newest version
+	// from each day is kept.
+	KeepDaily int
+}
+
+// ParsePrunePolicies parses a semicolon separated list of policies. Each policy is a project-slug:/path
+// rule (see ParsePathRules) followed by keep-last=N and/or keep-daily=N, separated by spaces. For
+// example "my-project:/analysis keep-last=5 keep-daily=7;*:/notes keep-last=10".
+func ParsePrunePolicies(policies string) ([]PrunePolicy, error) {
+	var prunePolicies []PrunePolicy
+	for _, policy := range strings.Split(policies, ";") {
+		fields := strings.Fields(policy)
+		if len(fields) == 0 {
+			continue
+		}
+
+		rules, err := ParsePathRules(fields[0])
+		if err != nil || len(rules) != 1 {
+			return nil, fmt.Errorf("invalid prune policy '%s': expected a single project-slug:/path", policy)
+		}
+
+		prunePolicy := PrunePolicy{PathRule: rules[0]}
+		for _, field := range fields[1:] {
+			var value int
+			key := strings.SplitN(field, "=", 2)
+			if len(key) == 2 {
+				value, err = strconv.Atoi(key[1])
+			}
+
+			switch {
+			case len(key) != 2 || err != nil || value < 0:
+				return nil, fmt.Errorf("invalid prune policy '%s': bad setting '%s'", policy, field)
+			case key[0] == "keep-last":
+				prunePolicy.KeepLast = value
+			case key[0] == "keep-daily":
+				prunePolicy.KeepDaily = value
+			default:
+				return nil, fmt.Errorf("invalid prune policy '%s': unknown setting '%s'", policy, key[0])
+			}
+		}
+
+		if prunePolicy.KeepLast == 0 && prunePolicy.KeepDaily == 0 {
+			return nil, fmt.Errorf("invalid prune policy '%s': keep-last or keep-daily must be set", policy)
+		}
+
+		prunePolicies = append(prunePolicies, prunePolicy)
+	}
+
+	return prunePolicies, nil
+}
+
+// VersionsToPrune returns the versions that the policy doesn't keep. The versions must be ordered
+// newest first.
+func (p PrunePolicy) VersionsToPrune(versions []mcmodel.File, now time.Time) []mcmodel.File {
+	var (
+		toPrune    []mcmodel.File
+		daysKept   = make(map[string]bool)
+		dailySince = now.AddDate(0, 0, -p.KeepDaily)
+	)
+
+	for i, version := range versions {
+		keep := version.Current || i < p.KeepLast
+
+		if p.KeepDaily > 0 && version.CreatedAt.After(dailySince) {
+			day := version.CreatedAt.UTC().Format("2006-01-02")
+			if !daysKept[day] {
+				daysKept[day] = true
+				keep = true
+			}
+		}
+
+		if !keep {
+			toPrune = append(toPrune, version)
+		}
+	}
+
+	return toPrune
+}
+
+// VersionPruner applies the PrunePolicies to files after a new version has been written. Pruning is done
+// in the background, by Run, so that it doesn't slow down uploads. Each pruned version is marked as
+// deleted and an EventVersionPruned event is emitted for it.
+type VersionPruner struct {
+	stores   *Stores
+	policies []PrunePolicy
+	events   EventSink
+
+	// queue holds the files waiting to be pruned.
+	queue chan mcmodel.File
+}
+
+func NewVersionPruner(stores *Stores, policies []PrunePolicy, events EventSink) *VersionPruner {
+	return &VersionPruner{
+		stores:   stores,
+		policies: policies,
+		events:   events,
+		queue:    make(chan mcmodel.File, 1000),
+	}
+}
+
+// Middleware returns a StoreMiddleware that queues each file that FileStore.DoneWritingToFile finished
+// to be pruned. A file finished in a transaction may be pruned before the transaction is committed, this
+// is safe because current versions are never pruned.
+func (p *VersionPruner) Middleware() StoreMiddleware {
+	return StoreMiddleware{
+		FileStore: func(fileStore store.FileStore) store.FileStore {
+			return &pruningFileStore{FileStore: fileStore, pruner: p}
+		},
+	}
+}
+
+// Run prunes the queued files until ctx is done.
+func (p *VersionPruner) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-p.queue:
+			if _, err := p.Prune(&file); err != nil {
+				log.Errorf("Unable to prune versions of file %d in project %d: %s", file.ID, file.ProjectID, err)
+			}
+		}
+	}
+}
+
+// Prune applies the first PrunePolicy that matches file's path to the versions of file, and returns
+// the number of versions that were pruned.
+func (p *VersionPruner) Prune(file *mcmodel.File) (int, error) {
+	project, err := p.stores.ProjectStore.GetProjectByID(file.ProjectID)
+	if err != nil {
+		return 0, err
+	}
+
+	if !p.mayApplyToProject(project.Slug) {
+		return 0, nil
+	}
+
+	versions, err := p.stores.VersionStore.ListVersions(file)
+	if err != nil || len(versions) == 0 || versions[0].Directory == nil {
+		return 0, err
+	}
+
+	path := versions[0].FullPath()
+	policy, ok := p.policyFor(project.Slug, path)
+	if !ok {
+		return 0, nil
+	}
+
+	pruned := 0
+	now := time.Now()
+	for _, version := range policy.VersionsToPrune(versions, now) {
+		if err := p.stores.VersionStore.DeleteVersion(&version); err != nil {
+			log.Errorf("Unable to prune version %d of %s in project %d: %s", version.ID, path, project.ID, err)
+			continue
+		}
+
+		pruned++
+		p.events.Emit(Event{
+			Type:      EventVersionPruned,
+			Time:      now,
+			ProjectID: project.ID,
+			FileID:    version.ID,
+			Path:      path,
+			Details: map[string]string{
+				"version_created_at": version.CreatedAt.Format(time.RFC3339),
+				"policy":             fmt.Sprintf("%s:%s keep-last=%d keep-daily=%d", policy.ProjectSlug, policy.Prefix, policy.KeepLast, policy.KeepDaily),
+			},
+		})
+	}
+
+	return pruned, nil
+}
+
+// mayApplyToProject returns true if any of the policies can match a path in the project. It avoids
+// loading the versions for files in projects that don't have any policies.
+func (p *VersionPruner) mayApplyToProject(projectSlug string) bool {
+	for _, policy := range p.policies {
+		if policy.ProjectSlug == "*" || policy.ProjectSlug == projectSlug {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policyFor returns the first policy that matches path in the project.
+func (p *VersionPruner) policyFor(projectSlug, path string) (PrunePolicy, bool) {
+	for _, policy := range p.policies {
+		if policy.Matches(projectSlug, path) {
+			return policy, true
+		}
+	}
+
+	return PrunePolicy{}, false
+}
+
+// pruningFileStore queues files on the pruner after DoneWritingToFile succeeds.
+type pruningFileStore struct {
+	store.FileStore
+	pruner *VersionPruner
+}
+
+func (s *pruningFileStore) DoneWritingToFile(file *mcmodel.File, checksum string, size int64, conversionStore store.ConversionStore) (bool, error) {
+	switched, err := s.FileStore.DoneWritingToFile(file, checksum, size, conversionStore)
+	if err == nil {
+		select {
+		case s.pruner.queue <- *file:
+		default:
+			log.Errorf("Version pruning queue is full, not pruning file %d in project %d", file.ID, file.ProjectID)
+		}
+	}
+
+	return switched, err
+}
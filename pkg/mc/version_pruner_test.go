@@ -0,0 +1,96 @@
+package mc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrunePolicies(t *testing.T) {
+	policies, err := ParsePrunePolicies("proj:/analysis keep-last=5 keep-daily=7; *:/notes keep-last=10")
+	require.Nil(t, err)
+	require.Equal(t, []PrunePolicy{
+		{PathRule: PathRule{"proj", "/analysis"}, KeepLast: 5, KeepDaily: 7},
+		{PathRule: PathRule{"*", "/notes"}, KeepLast: 10},
+	}, policies)
+
+	for _, invalid := range []string{"proj:/analysis", "proj:/analysis keep-last=x", "proj:/a keep-weekly=2", "proj keep-last=2"} {
+		_, err := ParsePrunePolicies(invalid)
+		require.NotNil(t, err, "ParsePrunePolicies should have failed for '%s'", invalid)
+	}
+}
+
+// eventCollector is an EventSink that keeps the emitted events.
+type eventCollector struct {
+	events []Event
+}
+
+func (c *eventCollector) Emit(event Event) {
+	c.events = append(c.events, event)
+}
+
+func TestPrunePolicy_VersionsToPrune(t *testing.T) {
+	now := time.Date(2022, 6, 10, 12, 0, 0, 0, time.UTC)
+	version := func(id int, age time.Duration, current bool) mcmodel.File {
+		return mcmodel.File{ID: id, Current: current, CreatedAt: now.Add(-age)}
+	}
+
+	// Newest first. With keep-last=2 and keep-daily=3 versions 10 and 11 are the last two, 12 is
+	// the newest from yesterday and 14 the newest from two days ago.
+	versions := []mcmodel.File{
+		version(10, time.Minute, true),
+		version(11, 2*time.Minute, false),
+		version(12, 25*time.Hour, false),
+		version(13, 26*time.Hour, false),
+		version(14, 49*time.Hour, false),
+		version(15, 30*24*time.Hour, false),
+	}
+
+	tests := []struct {
+		name       string
+		policy     PrunePolicy
+		wantPruned []int
+	}{
+		{"Keep last 2 and 3 days of dailies", PrunePolicy{KeepLast: 2, KeepDaily: 3}, []int{13, 15}},
+		{"Keep last 3", PrunePolicy{KeepLast: 3}, []int{13, 14, 15}},
+		{"Keep dailies only keeps the current version", PrunePolicy{KeepDaily: 1}, []int{11, 12, 13, 14, 15}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pruned []int
+			for _, v := range test.policy.VersionsToPrune(versions, now) {
+				pruned = append(pruned, v.ID)
+			}
+			require.Equal(t, test.wantPruned, pruned)
+		})
+	}
+}
+
+func TestVersionPruner_Prune(t *testing.T) {
+	dir := &mcmodel.File{ID: 1, Path: "/analysis", MimeType: "directory"}
+	version := func(id int, current bool) mcmodel.File {
+		return mcmodel.File{ID: id, Name: "notes.txt", ProjectID: 1, DirectoryID: 1, Directory: dir, Current: current}
+	}
+
+	versionStore := NewFakeVersionStore(version(10, true), version(11, false), version(12, false))
+	stores := &Stores{
+		ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		VersionStore: versionStore,
+	}
+
+	policies := []PrunePolicy{{PathRule: PathRule{"other", "/"}, KeepLast: 1}, {PathRule: PathRule{"proj", "/analysis"}, KeepLast: 2}}
+	events := &eventCollector{}
+	pruner := NewVersionPruner(stores, policies, events)
+
+	pruned, err := pruner.Prune(&mcmodel.File{ID: 10, Name: "notes.txt", ProjectID: 1, DirectoryID: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, pruned)
+	require.Equal(t, []int{12}, versionStore.DeletedVersionIDs)
+	require.Len(t, events.events, 1)
+	require.Equal(t, EventVersionPruned, events.events[0].Type)
+	require.Equal(t, "/analysis/notes.txt", events.events[0].Path)
+}
@@ -0,0 +1,78 @@
+package mc
+
+import (
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"gorm.io/gorm"
+)
+
+// VersionStore handles the versions of a file. Each time a file is written a new version is created,
+// these are the files with the same name in the same directory.
+type VersionStore interface {
+	// ListVersions returns all the versions of file, including file itself, newest first. The versions
+	// have their Directory loaded.
+	ListVersions(file *mcmodel.File) ([]mcmodel.File, error)
+
+	// DeleteVersion marks a version that isn't current as deleted. The file data isn't removed
+	// since other files with the same checksum may point at it.
+	DeleteVersion(file *mcmodel.File) error
+}
+
+type GormVersionStore struct {
+	db *gorm.DB
+}
+
+func NewGormVersionStore(db *gorm.DB) *GormVersionStore {
+	return &GormVersionStore{db: db}
+}
+
+func (s *GormVersionStore) ListVersions(file *mcmodel.File) ([]mcmodel.File, error) {
+	var versions []mcmodel.File
+	err := s.db.Preload("Directory").
+		Where("directory_id = ?", file.DirectoryID).
+		Where("name = ?", file.Name).
+		Where("deleted_at IS NULL").
+		Where("dataset_id IS NULL").
+		Order("created_at desc").
+		Find(&versions).Error
+
+	return versions, err
+}
+
+func (s *GormVersionStore) DeleteVersion(file *mcmodel.File) error {
+	return store.WithTxRetryDefault(func(tx *gorm.DB) error {
+		return tx.Model(&mcmodel.File{}).
+			Where("id = ?", file.ID).
+			Where("current = ?", false).
+			Update("deleted_at", time.Now()).Error
+	}, s.db)
+}
+
+// FakeVersionStore is a VersionStore for testing. ListVersions returns Versions, which should be
+// ordered newest first, and DeleteVersion records the IDs of the deleted versions.
+type FakeVersionStore struct {
+	Versions          []mcmodel.File
+	DeletedVersionIDs []int
+}
+
+func NewFakeVersionStore(versions ...mcmodel.File) *FakeVersionStore {
+	return &FakeVersionStore{Versions: versions}
+}
+
+func (s *FakeVersionStore) ListVersions(file *mcmodel.File) ([]mcmodel.File, error) {
+	var versions []mcmodel.File
+	for _, v := range s.Versions {
+		if v.DirectoryID == file.DirectoryID && v.Name == file.Name {
+			versions = append(versions, v)
+		}
+	}
+
+	return versions, nil
+}
+
+func (s *FakeVersionStore) DeleteVersion(file *mcmodel.File) error {
+	s.DeletedVersionIDs = append(s.DeletedVersionIDs, file.ID)
+	return nil
+}
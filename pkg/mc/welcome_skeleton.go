@@ -0,0 +1,200 @@
+package mc
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// WelcomeSkeleton is a layout of directories and files, such as a README, that is created in a new user's
+// default project the first time they log in, so that they see an obvious structure for their data
+// instead of an empty listing. A login is treated as the user's first when their default project is
+// still empty, which the skeleton then fills in, so it is only ever created once.
+type WelcomeSkeleton struct {
+	// dirs are the directory paths in the project, in the order they are created.
+	dirs []string
+
+	// files are the files in the project, keyed by path.
+	files map[string]*welcomeFile
+
+	// mu serializes the checks for an empty project and the creation of the skeleton, so that two
+	// sessions logging in at the same time don't both create it.
+	mu sync.Mutex
+}
+
+type welcomeFile struct {
+	contents []byte
+
+	// template renders the contents, with WelcomeData, when the file is a template. It is nil otherwise.
+	template *template.Template
+}
+
+// WelcomeData is what the templates in a WelcomeSkeleton are rendered with.
+type WelcomeData struct {
+	UserName    string
+	UserSlug    string
+	ProjectName string
+	ProjectSlug string
+}
+
+// welcomeTemplateExt is the extension of the files in a skeleton's directory that are templates. They are
+// rendered with text/template, and created without the extension, so README.md.tmpl becomes README.md.
+const welcomeTemplateExt = ".tmpl"
+
+// LoadWelcomeSkeleton loads the skeleton from dir, whose directories and files are created in the project
+// with the same layout. Files ending in .tmpl are templates (see WelcomeData). Anything other than
+// directories and regular files is skipped.
+func LoadWelcomeSkeleton(dir string) (*WelcomeSkeleton, error) {
+	skeleton := &WelcomeSkeleton{files: make(map[string]*welcomeFile)}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		projectPath := filepath.Join("/", rel)
+		switch {
+		case projectPath == "/":
+			return nil
+		case d.IsDir():
+			skeleton.dirs = append(skeleton.dirs, projectPath)
+			return nil
+		case !d.Type().IsRegular():
+			return nil
+		}
+
+		contents, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		file := &welcomeFile{contents: contents}
+		if strings.HasSuffix(projectPath, welcomeTemplateExt) {
+			projectPath = strings.TrimSuffix(projectPath, welcomeTemplateExt)
+			if file.template, err = template.New(projectPath).Parse(string(contents)); err != nil {
+				return fmt.Errorf("invalid template %s: %w", p, err)
+			}
+		}
+
+		skeleton.files[projectPath] = file
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return skeleton, nil
+}
+
+// Create creates the skeleton in user's default project, when it is still empty, and returns the project.
+// The default project is the one with projectSlug, usually the session's SessionEnv.Project, or when that
+// is blank, the only project that user owns. The skeleton is only created in a project owned by user. It
+// returns nil, and no error, when it wasn't created.
+func (s *WelcomeSkeleton) Create(stores *Stores, user *mcmodel.User, projectSlug, mcfsRoot string) (*mcmodel.Project, error) {
+	project, err := s.defaultProject(stores, user, projectSlug)
+	if err != nil || project == nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := stores.FileStore.ListDirectoryByPath(project.ID, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) != 0 {
+		return nil, nil
+	}
+
+	for _, dir := range s.dirs {
+		if _, err := stores.FileStore.GetOrCreateDirPath(project.ID, user.ID, dir); err != nil {
+			return nil, fmt.Errorf("unable to create %s: %w", dir, err)
+		}
+	}
+
+	data := WelcomeData{UserName: user.Name, UserSlug: user.Slug, ProjectName: project.Name, ProjectSlug: project.Slug}
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		contents, err := s.files[path].render(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render %s: %w", path, err)
+		}
+
+		if err := CreateFileWithContents(stores, project.ID, user.ID, path, contents, mcfsRoot); err != nil {
+			return nil, fmt.Errorf("unable to create %s: %w", path, err)
+		}
+	}
+
+	return project, nil
+}
+
+// defaultProject returns the project the skeleton is created in for user, or nil when there isn't one.
+func (s *WelcomeSkeleton) defaultProject(stores *Stores, user *mcmodel.User, projectSlug string) (*mcmodel.Project, error) {
+	if projectSlug != "" {
+		project, err := GetProjectBySlugOrAlias(stores, projectSlug)
+		if err != nil {
+			log.Errorf("Unable to find project %s for the welcome skeleton of user %d: %s", projectSlug, user.ID, err)
+			return nil, nil
+		}
+
+		if project.OwnerID != user.ID {
+			return nil, nil
+		}
+
+		return project, nil
+	}
+
+	projects, err := stores.ProjectStore.GetProjectsForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var owned *mcmodel.Project
+	for i := range projects {
+		if projects[i].OwnerID != user.ID {
+			continue
+		}
+
+		if owned != nil {
+			// With more than one project there is no default.
+			return nil, nil
+		}
+		owned = &projects[i]
+	}
+
+	return owned, nil
+}
+
+func (f *welcomeFile) render(data WelcomeData) ([]byte, error) {
+	if f.template == nil {
+		return f.contents, nil
+	}
+
+	var buf bytes.Buffer
+	if err := f.template.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
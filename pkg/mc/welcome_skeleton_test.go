@@ -0,0 +1,63 @@
+package mc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWelcomeSkeleton(t *testing.T) {
+	templateDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(templateDir, "raw", "instrument"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(templateDir, "analysis"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(templateDir, "README.md.tmpl"), []byte("Welcome {{.UserName}} to {{.ProjectName}}"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(templateDir, "raw", "NOTES.txt"), []byte("{{ not a template }}"), 0644))
+
+	skeleton, err := LoadWelcomeSkeleton(templateDir)
+	require.NoError(t, err)
+
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo", "other")
+	require.NoError(t, err)
+	user := &mcmodel.User{ID: 1, Slug: "alice", Name: "Alice"}
+
+	// With more than one project, and no project given by the session, there is no default project.
+	project, err := skeleton.Create(stores, user, "", mcfsRoot)
+	require.NoError(t, err)
+	require.Nil(t, project)
+
+	project, err = skeleton.Create(stores, user, "demo", mcfsRoot)
+	require.NoError(t, err)
+	require.NotNil(t, project)
+
+	for _, dir := range []string{"/raw", "/raw/instrument", "/analysis"} {
+		_, err := stores.FileStore.GetDirByPath(project.ID, dir)
+		require.NoError(t, err, dir)
+	}
+
+	readFile := func(path string) string {
+		file, err := stores.FileStore.GetFileByPath(project.ID, path)
+		require.NoError(t, err, path)
+		contents, err := os.ReadFile(file.ToUnderlyingFilePath(mcfsRoot))
+		require.NoError(t, err, path)
+		return string(contents)
+	}
+	require.Equal(t, "Welcome Alice to demo", readFile("/README.md"))
+	require.Equal(t, "{{ not a template }}", readFile("/raw/NOTES.txt"))
+
+	// Once the project has files it isn't the user's first login.
+	project, err = skeleton.Create(stores, user, "demo", mcfsRoot)
+	require.NoError(t, err)
+	require.Nil(t, project)
+
+	// The skeleton isn't created in another user's project.
+	project, err = skeleton.Create(stores, &mcmodel.User{ID: 2, Slug: "bob"}, "other", mcfsRoot)
+	require.NoError(t, err)
+	require.Nil(t, project)
+
+	_, err = LoadWelcomeSkeleton(filepath.Join(templateDir, "missing"))
+	require.Error(t, err)
+}
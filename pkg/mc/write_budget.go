@@ -0,0 +1,137 @@
+package mc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// writeBuffers holds the buffers that SFTP writes are coalesced in, so that a burst of uploads reuses
+// buffers rather than allocating one for each file.
+var writeBuffers sync.Pool
+
+// GetWriteBuffer returns an empty buffer with room for size bytes from the pool, or a new one.
+func GetWriteBuffer(size int) []byte {
+	if b, ok := writeBuffers.Get().(*[]byte); ok && cap(*b) >= size {
+		return (*b)[:0]
+	}
+
+	return make([]byte, 0, size)
+}
+
+// PutWriteBuffer returns b to the pool. b must not be used after it has been returned, so a buffer
+// that may still be in use, such as by a write that timed out, must not be returned.
+func PutWriteBuffer(b []byte) {
+	if cap(b) == 0 {
+		return
+	}
+
+	b = b[:0]
+	writeBuffers.Put(&b)
+}
+
+// WriteBudget bounds the memory a session's uploads hold: the buffers that sequential writes are
+// coalesced in, and the data of the writes being written to storage. Without it a client uploading many
+// large files in parallel has a buffer for each file, and every write, in memory at once.
+//
+// Buffers are reserved with Reserve, which doesn't wait, and a write that can't reserve a buffer is
+// written directly instead. Writes wait in BeginWrite until the budget has room, which holds back the
+// client. A write is always let through when no other write is in progress, so reserved buffers can't
+// hold up writes forever, and the memory held can exceed Limit by a single write.
+type WriteBudget struct {
+	// Limit is the number of bytes that can be held. 0 means no limit.
+	Limit int64
+
+	mu      sync.Mutex
+	held    int64
+	writing int
+
+	// changed is closed, and replaced, each time bytes are released.
+	changed chan struct{}
+}
+
+func NewWriteBudget(limit int64) *WriteBudget {
+	return &WriteBudget{Limit: limit, changed: make(chan struct{})}
+}
+
+// Reserve reserves n bytes for a buffer if there is room, and returns whether it did. The bytes are
+// released with Release. A nil WriteBudget always has room.
+func (b *WriteBudget) Reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Limit > 0 && b.held+n > b.Limit {
+		return false
+	}
+
+	b.held += n
+	return true
+}
+
+// Release releases n bytes reserved by Reserve.
+func (b *WriteBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.release(n)
+}
+
+// BeginWrite waits for room for a write of n bytes, and holds the bytes until EndWrite. It returns an
+// error if ctx is done first. A nil WriteBudget never waits.
+func (b *WriteBudget) BeginWrite(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		if b.Limit <= 0 || b.held+n <= b.Limit || b.writing == 0 {
+			b.held += n
+			b.writing++
+			b.mu.Unlock()
+			return nil
+		}
+
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for write memory: %w", ctx.Err())
+		}
+	}
+}
+
+// EndWrite releases the n bytes held by BeginWrite.
+func (b *WriteBudget) EndWrite(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writing--
+	b.release(n)
+}
+
+// Held returns the number of bytes reserved and being written.
+func (b *WriteBudget) Held() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held
+}
+
+// release releases n bytes and wakes up the writes waiting for room. It must be called with mu held.
+func (b *WriteBudget) release(n int64) {
+	b.held -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,78 @@
+package mc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBudget(t *testing.T) {
+	budget := NewWriteBudget(100)
+
+	require.True(t, budget.Reserve(60))
+	require.False(t, budget.Reserve(60), "the budget doesn't have room for a second buffer")
+
+	// The reserved buffer doesn't hold up a write when no other write is in progress.
+	require.NoError(t, budget.BeginWrite(context.Background(), 60))
+	require.Equal(t, int64(120), budget.Held())
+
+	// A second write waits for room.
+	started := make(chan struct{})
+	go func() {
+		require.NoError(t, budget.BeginWrite(context.Background(), 30))
+		close(started)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("write started before the budget had room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.EndWrite(60)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("write didn't start once the budget had room")
+	}
+	require.Equal(t, int64(90), budget.Held())
+
+	budget.EndWrite(30)
+	budget.Release(60)
+	require.Equal(t, int64(0), budget.Held())
+}
+
+func TestWriteBudget_BeginWriteCanceled(t *testing.T) {
+	budget := NewWriteBudget(10)
+	require.NoError(t, budget.BeginWrite(context.Background(), 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, budget.BeginWrite(ctx, 10), context.DeadlineExceeded)
+	require.Equal(t, int64(10), budget.Held())
+}
+
+func TestWriteBudget_Unlimited(t *testing.T) {
+	var budget *WriteBudget
+	require.True(t, budget.Reserve(1<<40))
+	require.NoError(t, budget.BeginWrite(context.Background(), 1<<40))
+	budget.EndWrite(1 << 40)
+	budget.Release(1 << 40)
+
+	budget = NewWriteBudget(0)
+	require.True(t, budget.Reserve(1<<40))
+	require.NoError(t, budget.BeginWrite(context.Background(), 1<<40))
+}
+
+func TestGetWriteBuffer(t *testing.T) {
+	b := GetWriteBuffer(1024)
+	require.Len(t, b, 0)
+	require.GreaterOrEqual(t, cap(b), 1024)
+
+	PutWriteBuffer(append(b, "data"...))
+	b = GetWriteBuffer(1024)
+	require.Len(t, b, 0)
+	require.GreaterOrEqual(t, cap(b), 1024)
+}
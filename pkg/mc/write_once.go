@@ -0,0 +1,51 @@
+package mc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrWriteOnce is returned when attempting to overwrite, rename or remove something in a write-once
+// path. It wraps os.ErrPermission.
+var ErrWriteOnce = fmt.Errorf("%w: files in write-once directories can't be changed", os.ErrPermission)
+
+// CheckWriteOnce returns ErrWriteOnce if path in the project with projectSlug is in one of
+// config.WriteOncePaths, or is a directory containing one of them. It is used to refuse renames and
+// removes, which would change the write-once path. Overwrites are checked by CheckOverwrite.
+func CheckWriteOnce(config *Config, projectSlug, path string) error {
+	path = filepath.Clean("/" + path)
+	for _, rule := range config.WriteOncePaths {
+		if rule.Matches(projectSlug, path) {
+			return ErrWriteOnce
+		}
+
+		if (rule.ProjectSlug == "*" || rule.ProjectSlug == projectSlug) && (path == "/" || strings.HasPrefix(rule.Prefix, path+"/")) {
+			// Removing or renaming a parent directory would take the write-once path with it.
+			return ErrWriteOnce
+		}
+	}
+
+	return nil
+}
+
+// writeOnceFileInfo presents a file in a write-once path as read-only.
+type writeOnceFileInfo struct {
+	os.FileInfo
+}
+
+func (fi writeOnceFileInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode() &^ 0222
+}
+
+// WriteOnceFileInfo returns fi with its write permissions removed when it is a regular file at path in
+// one of config.WriteOncePaths, so that listings show that it can't be changed. Directories keep their
+// permissions since files can still be created in them.
+func WriteOnceFileInfo(config *Config, projectSlug, path string, fi os.FileInfo) os.FileInfo {
+	if !fi.Mode().IsRegular() || !MatchesAnyPathRule(config.WriteOncePaths, projectSlug, path) {
+		return fi
+	}
+
+	return writeOnceFileInfo{FileInfo: fi}
+}
@@ -0,0 +1,89 @@
+package mc
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckWriteOnce(t *testing.T) {
+	config := &Config{WriteOncePaths: []PathRule{{"proj", "/raw/xrd"}}}
+
+	tests := []struct {
+		projectSlug string
+		path        string
+		writeOnce   bool
+	}{
+		{"proj", "/raw/xrd", true},
+		{"proj", "/raw/xrd/run1/data.raw", true},
+		{"proj", "/raw", true},
+		{"proj", "/", true},
+		{"proj", "/raw/xrd2", false},
+		{"proj", "/processed", false},
+		{"other", "/raw/xrd/data.raw", false},
+	}
+
+	for _, test := range tests {
+		err := CheckWriteOnce(config, test.projectSlug, test.path)
+		if test.writeOnce {
+			require.ErrorIs(t, err, ErrWriteOnce, "%s:%s", test.projectSlug, test.path)
+		} else {
+			require.NoError(t, err, "%s:%s", test.projectSlug, test.path)
+		}
+	}
+}
+
+// lookupFailingFileStore fails GetFileByPath, as when the database can't be reached.
+type lookupFailingFileStore struct {
+	store.FileStore
+}
+
+func (s *lookupFailingFileStore) GetFileByPath(_ int, _ string) (*mcmodel.File, error) {
+	return nil, errors.New("lookup failed")
+}
+
+func TestCheckOverwriteLookupFailure(t *testing.T) {
+	project := &mcmodel.Project{ID: 1, Slug: "proj"}
+	config := &Config{WriteOncePaths: []PathRule{{"proj", "/raw"}}, NoOverwritePaths: []PathRule{{"proj", "/results"}}}
+	fileStore := &lookupFailingFileStore{}
+
+	// When it can't be told whether the file exists the write isn't allowed.
+	err := CheckOverwrite(fileStore, project, "/raw/data.raw", config)
+	require.EqualError(t, err, "lookup failed")
+	err = CheckOverwrite(fileStore, project, "/results/out.csv", config)
+	require.EqualError(t, err, "lookup failed")
+
+	// Paths without rules aren't looked up.
+	require.NoError(t, CheckOverwrite(fileStore, project, "/processed/out.csv", config))
+}
+
+func TestWriteOnceOverwriteAndListing(t *testing.T) {
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", MimeType: "directory", DirectoryID: 1},
+		{ID: 3, ProjectID: 1, Name: "data.raw", MimeType: "application/octet-stream", DirectoryID: 2, Current: true},
+	}
+
+	project := &mcmodel.Project{ID: 1, Slug: "proj"}
+	config := &Config{WriteOncePaths: []PathRule{{"proj", "/raw"}}}
+	fileStore := store.NewFakeFileStore(files)
+
+	require.ErrorIs(t, CheckOverwrite(fileStore, project, "/raw/data.raw", config), ErrWriteOnce)
+	require.NoError(t, CheckOverwrite(fileStore, project, "/raw/new.raw", config))
+
+	// A rename or remove is refused however deep in the project it is.
+	err := GuardDestructiveOperation(fileStore, config, &mcmodel.User{ID: 1}, project, OpRemove, "/raw/run1/data.raw")
+	require.ErrorIs(t, err, ErrWriteOnce)
+	err = GuardDestructiveOperation(fileStore, config, &mcmodel.User{ID: 1}, project, OpRmdir, "/raw")
+	require.ErrorIs(t, err, ErrWriteOnce)
+
+	fi := WriteOnceFileInfo(config, project.Slug, "/raw/data.raw", files[2].ToFileInfo())
+	require.Equal(t, os.FileMode(0555), fi.Mode())
+
+	fi = WriteOnceFileInfo(config, project.Slug, "/raw", files[1].ToFileInfo())
+	require.Equal(t, os.FileMode(0777)|os.ModeDir, fi.Mode(), "Directories stay writable so files can be created")
+}
@@ -0,0 +1,57 @@
+package mc
+
+// EmptyFileChecksum is the MD5 checksum of a file with no data, such as one created by touch.
+const EmptyFileChecksum = "d41d8cd98f00b204e9800998ecf8427e"
+
+// WriteTracker follows the offsets of the writes to a file, whose data is hashed in the order it is
+// written, to tell whether that hash is the checksum of the file. It isn't when the writes skipped
+// ahead, such as a client creating a sparse file, went back over data already written, or the file was
+// truncated. The zero value is a tracker for a file that hasn't been written to.
+type WriteTracker struct {
+	next     int64
+	unhashed bool
+}
+
+// Write records a write of n bytes at offset.
+func (t *WriteTracker) Write(offset int64, n int) {
+	if n == 0 {
+		return
+	}
+
+	if offset != t.next {
+		t.unhashed = true
+	}
+
+	if end := offset + int64(n); end > t.next {
+		t.next = end
+	}
+}
+
+// Truncate records the file being truncated, or extended, to size.
+func (t *WriteTracker) Truncate(size int64) {
+	if size != t.next {
+		t.unhashed = true
+	}
+
+	t.next = size
+}
+
+// Sequential returns true if the writes were one after another from the start of the file, and cover all
+// size bytes of it.
+func (t *WriteTracker) Sequential(size int64) bool {
+	return !t.unhashed && t.next == size
+}
+
+// Checksum returns the checksum of the file at path, which has size bytes. When the writes were sequential
+// it is hashed, the checksum of the writes, otherwise the file is read to checksum it.
+func (t *WriteTracker) Checksum(hashed string, size int64, path string) (string, error) {
+	switch {
+	case size == 0:
+		return EmptyFileChecksum, nil
+	case t.Sequential(size):
+		return hashed, nil
+	}
+
+	checksum, _, err := checksumFile(path)
+	return checksum, err
+}
@@ -0,0 +1,82 @@
+package mc
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTracker(t *testing.T) {
+	tests := []struct {
+		name       string
+		writes     func(t *WriteTracker)
+		size       int64
+		sequential bool
+	}{
+		{name: "nothing written", writes: func(t *WriteTracker) {}, size: 0, sequential: true},
+		{name: "sequential", writes: func(t *WriteTracker) { t.Write(0, 4); t.Write(4, 4) }, size: 8, sequential: true},
+		{name: "sparse", writes: func(t *WriteTracker) { t.Write(4, 4) }, size: 8},
+		{name: "out of order", writes: func(t *WriteTracker) { t.Write(4, 4); t.Write(0, 4) }, size: 8},
+		{name: "rewritten", writes: func(t *WriteTracker) { t.Write(0, 4); t.Write(0, 4) }, size: 4},
+		{name: "short of the size", writes: func(t *WriteTracker) { t.Write(0, 4) }, size: 8},
+		{name: "truncated", writes: func(t *WriteTracker) { t.Write(0, 8); t.Truncate(4) }, size: 4},
+		{name: "truncated then written", writes: func(t *WriteTracker) { t.Truncate(0); t.Write(0, 4) }, size: 4, sequential: true},
+	}
+
+	for _, test := range tests {
+		var tracker WriteTracker
+		test.writes(&tracker)
+		require.Equal(t, test.sequential, tracker.Sequential(test.size), test.name)
+	}
+}
+
+func TestWriteTrackerChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sparse")
+	require.NoError(t, os.WriteFile(path, []byte("\x00\x00data"), 0644))
+
+	var tracker WriteTracker
+	tracker.Write(2, 4)
+	checksum, err := tracker.Checksum(fmt.Sprintf("%x", md5.Sum([]byte("data"))), 6, path)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("\x00\x00data"))), checksum)
+
+	// An empty file, such as from touch, has the empty checksum whatever was hashed.
+	var empty WriteTracker
+	checksum, err = empty.Checksum("", 0, filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	require.Equal(t, EmptyFileChecksum, checksum)
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum(nil)), EmptyFileChecksum)
+}
+
+func TestCommitEmptyFile(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := NewOfflineStores(mcfsRoot, 1, "demo")
+	require.NoError(t, err)
+
+	project, err := stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+	dir, err := stores.FileStore.GetDirByPath(project.ID, "/")
+	require.NoError(t, err)
+
+	// Empty files don't point at each other's data, and keep their own.
+	for _, name := range []string{"a.txt", "b.txt"} {
+		file, err := stores.FileStore.CreateFile(name, project.ID, dir.ID, 1, "text/plain")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(mcfsRoot), 0755))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(mcfsRoot), nil, 0644))
+
+		switched, err := CommitFile(stores, file, "", 0, mcfsRoot)
+		require.NoError(t, err)
+		require.False(t, switched, name)
+		require.Equal(t, file.UUID, file.UUIDForUses(), name)
+		require.FileExists(t, file.ToUnderlyingFilePath(mcfsRoot))
+
+		file, err = stores.FileStore.GetFileByPath(project.ID, "/"+name)
+		require.NoError(t, err)
+		require.Equal(t, EmptyFileChecksum, file.Checksum)
+	}
+}
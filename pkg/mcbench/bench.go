@@ -0,0 +1,199 @@
+package mcbench
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The workloads that Run knows how to generate.
+const (
+	// WorkloadSmallFiles uploads many small files into a single directory.
+	WorkloadSmallFiles = "small"
+
+	// WorkloadLargeFiles uploads a few large files.
+	WorkloadLargeFiles = "large"
+
+	// WorkloadDeepTree uploads files spread across a deeply nested directory tree.
+	WorkloadDeepTree = "deep"
+)
+
+// Options describes the server to benchmark against and the workload to run.
+type Options struct {
+	// Addr is the host:port of the mc-sshd server.
+	Addr string
+
+	// User is the user slug to log in as, and Password is that user's password.
+	User     string
+	Password string
+
+	// ProjectSlug is the project to upload into. All files are uploaded under a new directory in
+	// the project so that the benchmark doesn't touch existing files.
+	ProjectSlug string
+
+	// Workload is one of WorkloadSmallFiles, WorkloadLargeFiles or WorkloadDeepTree.
+	Workload string
+
+	// Files is the number of files to upload, and FileSize is the size of each file in bytes.
+	Files    int
+	FileSize int64
+
+	// Depth is the depth of the directory tree for WorkloadDeepTree.
+	Depth int
+
+	// Concurrency is the number of SFTP sessions uploading files in parallel.
+	Concurrency int
+}
+
+// Result is the outcome of a benchmark run.
+type Result struct {
+	Files   int64
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+func (r Result) String() string {
+	seconds := r.Elapsed.Seconds()
+	if seconds == 0 {
+		seconds = 1
+	}
+
+	return fmt.Sprintf("%d files, %d bytes in %s: %.2f files/s, %.2f MB/s",
+		r.Files, r.Bytes, r.Elapsed.Round(time.Millisecond), float64(r.Files)/seconds, float64(r.Bytes)/seconds/(1024*1024))
+}
+
+// Run connects to the server and uploads the generated workload, returning the throughput. Each file
+// has unique contents so that the server's deduplication doesn't skew the results.
+func Run(opts Options) (*Result, error) {
+	sshConfig := &ssh.ClientConfig{
+		User: opts.User,
+		Auth: []ssh.AuthMethod{ssh.Password(opts.Password)},
+		// The benchmark is meant to be run against test deployments, so the host key isn't checked.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	conn, err := ssh.Dial("tcp", opts.Addr, sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", opts.Addr, err)
+	}
+	defer conn.Close()
+
+	paths, err := workloadPaths(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	var (
+		result   Result
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+
+	// Start all the sessions before starting the clock so that session setup isn't included in the
+	// throughput.
+	var clients []*sftp.Client
+	for i := 0; i < opts.Concurrency; i++ {
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			return nil, fmt.Errorf("unable to start sftp session: %w", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	work := make(chan int)
+	start := time.Now()
+
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *sftp.Client) {
+			defer wg.Done()
+			for fileIndex := range work {
+				n, err := uploadFile(client, paths[fileIndex], int64(fileIndex), opts.FileSize)
+				if err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					continue
+				}
+				atomic.AddInt64(&result.Files, 1)
+				atomic.AddInt64(&result.Bytes, n)
+			}
+		}(client)
+	}
+
+	for i := range paths {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	return &result, firstErr
+}
+
+// workloadPaths returns the path of each file to upload for the workload.
+func workloadPaths(opts Options) ([]string, error) {
+	root := path.Join("/", opts.ProjectSlug, fmt.Sprintf("mc-bench-%d", time.Now().Unix()))
+	paths := make([]string, opts.Files)
+
+	switch opts.Workload {
+	case WorkloadSmallFiles, WorkloadLargeFiles:
+		for i := range paths {
+			paths[i] = path.Join(root, fmt.Sprintf("file-%d.dat", i))
+		}
+	case WorkloadDeepTree:
+		if opts.Depth < 1 {
+			return nil, fmt.Errorf("depth must be at least 1 for the %s workload", WorkloadDeepTree)
+		}
+		// Files are spread round-robin across the levels of a single deep branch.
+		for i := range paths {
+			dir := root
+			for level := 0; level <= i%opts.Depth; level++ {
+				dir = path.Join(dir, fmt.Sprintf("level-%d", level))
+			}
+			paths[i] = path.Join(dir, fmt.Sprintf("file-%d.dat", i))
+		}
+	default:
+		return nil, fmt.Errorf("unknown workload '%s'", opts.Workload)
+	}
+
+	return paths, nil
+}
+
+// uploadFile creates the directories for filePath and uploads size bytes generated from seed to it.
+func uploadFile(client *sftp.Client, filePath string, seed, size int64) (int64, error) {
+	if err := client.MkdirAll(path.Dir(filePath)); err != nil {
+		return 0, fmt.Errorf("unable to create directory for %s: %w", filePath, err)
+	}
+
+	f, err := client.Create(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create %s: %w", filePath, err)
+	}
+
+	n, err := io.Copy(f, io.LimitReader(rand.New(rand.NewSource(seed+time.Now().UnixNano())), size))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return n, fmt.Errorf("unable to write %s: %w", filePath, err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,246 @@
+package mcclient
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CapabilitiesExtension is the SFTP extension that returns the server's capabilities. It is the server's
+// mcsftp.CapabilitiesExtension.
+const CapabilitiesExtension = "mc-capabilities@materialscommons.org"
+
+// ErrNoCapabilities is returned by Client.Capabilities for a server that doesn't advertise its
+// capabilities, such as an older mc-sshd.
+var ErrNoCapabilities = errors.New("the server doesn't advertise its capabilities")
+
+// The features a server can advertise. They are the server's mc.Capability constants.
+const (
+	FeatureTags            = "tags"
+	FeatureDedup           = "dedup"
+	FeatureSessionEnv      = "session-env"
+	FeatureHardLinks       = "hard-links"
+	FeatureSymlinks        = "symlinks"
+	FeatureProjectCreation = "project-creation"
+	FeatureSCPResume       = "scp-resume"
+)
+
+// Capabilities is what the server supports for the user. It is the server's mc.Capabilities.
+type Capabilities struct {
+	Version  int      `json:"version"`
+	Server   string   `json:"server"`
+	ReadOnly bool     `json:"read_only"`
+	Features []string `json:"features"`
+
+	MaxPathDepth  int   `json:"max_path_depth,omitempty"`
+	MaxNameLength int   `json:"max_name_length,omitempty"`
+	MaxPathLength int   `json:"max_path_length,omitempty"`
+	ProjectQuota  int64 `json:"project_quota,omitempty"`
+}
+
+// HasFeature returns true if the server advertised feature.
+func (c *Capabilities) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SFTP packet types and the protocol version used for the extended requests.
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+	sftpVersion         = 3
+
+	maxPacketLength = 256 * 1024
+)
+
+// Capabilities asks the server for its capabilities. It returns ErrNoCapabilities if the server doesn't
+// advertise them.
+func (c *Client) Capabilities() (*Capabilities, error) {
+	if _, ok := c.sftp.HasExtension(CapabilitiesExtension); !ok {
+		return nil, ErrNoCapabilities
+	}
+
+	session, err := c.newExtensionSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	data, err := session.request(CapabilitiesExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	var capabilities Capabilities
+	if err := json.Unmarshal(data, &capabilities); err != nil {
+		return nil, fmt.Errorf("invalid capabilities: %w", err)
+	}
+
+	return &capabilities, nil
+}
+
+// extensionSession is an SFTP session for the extended requests that mc-sshd adds. The sftp package can't
+// send extended requests it doesn't know about, so they are sent on a session of their own.
+type extensionSession struct {
+	session *ssh.Session
+	w       io.Writer
+	r       io.Reader
+	id      uint32
+}
+
+func (c *Client) newExtensionSession() (*extensionSession, error) {
+	session, err := c.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &extensionSession{session: session}
+	if err := s.init(); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *extensionSession) init() error {
+	var err error
+	if s.w, err = s.session.StdinPipe(); err != nil {
+		return err
+	}
+
+	if s.r, err = s.session.StdoutPipe(); err != nil {
+		return err
+	}
+
+	if err := s.session.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
+
+	if err := writePacket(s.w, sshFxpInit, uint32Field(sftpVersion)); err != nil {
+		return err
+	}
+
+	if packetType, _, err := readPacket(s.r); err != nil {
+		return err
+	} else if packetType != sshFxpVersion {
+		return fmt.Errorf("unexpected SFTP packet type %d in reply to init", packetType)
+	}
+
+	return nil
+}
+
+// request sends the extended request name, with fields as its data, and returns the data of the reply.
+// Requests are sent one at a time.
+func (s *extensionSession) request(name string, fields ...[]byte) ([]byte, error) {
+	s.id++
+	fields = append([][]byte{uint32Field(s.id), stringField(name)}, fields...)
+	if err := writePacket(s.w, sshFxpExtended, fields...); err != nil {
+		return nil, err
+	}
+
+	packetType, body, err := readPacket(s.r)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(body) < 4 || binary.BigEndian.Uint32(body) != s.id:
+		return nil, fmt.Errorf("unexpected reply to %s", name)
+	case packetType == sshFxpStatus:
+		return nil, fmt.Errorf("%s failed: %s", name, statusMessage(body[4:]))
+	case packetType != sshFxpExtendedReply:
+		return nil, fmt.Errorf("unexpected SFTP packet type %d in reply to %s", packetType, name)
+	}
+
+	return body[4:], nil
+}
+
+func (s *extensionSession) Close() error {
+	return s.session.Close()
+}
+
+func writePacket(w io.Writer, packetType byte, fields ...[]byte) error {
+	b := make([]byte, 5, 64)
+	b[4] = packetType
+	for _, field := range fields {
+		b = append(b, field...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	_, err := w.Write(b)
+	return err
+}
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > maxPacketLength {
+		return 0, nil, fmt.Errorf("invalid SFTP packet length %d", length)
+	}
+
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header[4], body, nil
+}
+
+// statusMessage returns the message of a status packet's body, after its id.
+func statusMessage(b []byte) string {
+	if len(b) < 8 {
+		return "unknown error"
+	}
+
+	n := binary.BigEndian.Uint32(b[4:])
+	if uint32(len(b)-8) < n {
+		return "unknown error"
+	}
+
+	return string(b[8 : 8+n])
+}
+
+func uint32Field(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func stringField(s string) []byte {
+	return append(uint32Field(uint32(len(s))), s...)
+}
+
+func uint64Field(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// unmarshalString reads an SFTP string, a uint32 length followed by that many bytes, from the start of b.
+func unmarshalString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, false
+	}
+
+	return b[4 : 4+n], b[4+n:], true
+}
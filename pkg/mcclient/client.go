@@ -0,0 +1,126 @@
+// Package mcclient is a client for mc-sshd, the Materials Commons SSH server. It wraps the sftp package with
+// the conventions the server defines, so that tools and pipelines don't each have to: paths that start with
+// the project slug (see ProjectPath and TaggedPath), the server's capabilities (see Client.Capabilities),
+// skipping files the server already has (see UploadOptions.SkipUnchanged) and the manifests the server
+// verifies uploads against (see UploadOptions.Manifest).
+package mcclient
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes the server to connect to and how to log in.
+type Config struct {
+	// Addr is the host:port of the mc-sshd server.
+	Addr string
+
+	// User is the user slug to log in as.
+	User string
+
+	// Auth are the ways to log in, such as ssh.Password or ssh.PublicKeys.
+	Auth []ssh.AuthMethod
+
+	// HostKeyCallback checks the server's host key. It is required, use ssh.InsecureIgnoreHostKey only
+	// against test servers.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Timeout bounds connecting and logging in. 0 means no limit.
+	Timeout time.Duration
+}
+
+// Client is a connection to a mc-sshd server, with an SFTP session on it.
+type Client struct {
+	conn *ssh.Client
+	sftp *sftp.Client
+}
+
+// Dial connects to the server in config and starts an SFTP session.
+func Dial(config Config) (*Client, error) {
+	if config.HostKeyCallback == nil {
+		return nil, fmt.Errorf("a HostKeyCallback is required")
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            config.Auth,
+		HostKeyCallback: config.HostKeyCallback,
+		Timeout:         config.Timeout,
+	}
+
+	conn, err := ssh.Dial("tcp", config.Addr, sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", config.Addr, err)
+	}
+
+	c, err := NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewClient starts an SFTP session on conn, an existing connection to a mc-sshd server. Closing the Client
+// closes conn.
+func NewClient(conn *ssh.Client) (*Client, error) {
+	sftpClient, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start sftp session: %w", err)
+	}
+
+	return &Client{conn: conn, sftp: sftpClient}, nil
+}
+
+// SFTP returns the client's SFTP session, for the operations this package doesn't wrap.
+func (c *Client) SFTP() *sftp.Client {
+	return c.sftp
+}
+
+// Close ends the SFTP session and closes the connection.
+func (c *Client) Close() error {
+	sftpErr := c.sftp.Close()
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+
+	return sftpErr
+}
+
+// run runs an mc command, such as mc sync-manifest, on the server and returns its output. The error from a
+// command that fails includes what it wrote to stderr.
+func (c *Client) run(args ...string) ([]byte, error) {
+	session, err := c.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout, session.Stderr = &stdout, &stderr
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	if err := session.Run("mc " + strings.Join(quoted, " ")); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// shellQuote quotes s so that the server splits the command it is in the way a shell would.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,54 @@
+package mcclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{name: "Project root", path: ProjectPath("proj"), expected: "/proj"},
+		{name: "Path in project", path: ProjectPath("proj", "raw", "a.tif"), expected: "/proj/raw/a.tif"},
+		{name: "Untagged", path: TaggedPath("proj", "/run1"), expected: "/proj/run1"},
+		{name: "Tagged", path: TaggedPath("proj", "/run1", "xrd", "sem"), expected: "/proj/.tagged/xrd/.tagged/sem/run1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, test.path)
+		})
+	}
+
+	require.Equal(t, "proj", ProjectSlug("/proj/raw/a.tif"))
+	require.Equal(t, "proj", ProjectSlug("proj"))
+}
+
+func TestParseSyncManifest(t *testing.T) {
+	out := `{"path":"a.txt","size":1,"checksum":"0cc175b9c0f1b6a831c399e269772661","mtime":"2021-01-01T00:00:00Z"}
+{"path":"sub/b.txt","size":1,"checksum":"92eb5ffee6ae2fec3ad71c777531578f","mtime":"2021-01-01T00:00:00Z"}
+`
+	checksums, err := parseSyncManifest([]byte(out))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"a.txt":     "0cc175b9c0f1b6a831c399e269772661",
+		"sub/b.txt": "92eb5ffee6ae2fec3ad71c777531578f",
+	}, checksums)
+
+	_, err = parseSyncManifest([]byte("not json"))
+	require.Error(t, err)
+}
+
+func TestParseManifestReport(t *testing.T) {
+	report := parseManifestReport([]byte("a.txt: OK\nb.txt: FAILED open or read\nc.txt: MISSING\n\n3 files: 1 OK, 1 FAILED, 1 MISSING\n"))
+	require.Equal(t, map[string]string{"a.txt": "OK", "b.txt": "FAILED", "c.txt": "MISSING"}, report.Results)
+	require.Equal(t, "3 files: 1 OK, 1 FAILED, 1 MISSING", report.Summary)
+	require.False(t, report.OK())
+
+	report = parseManifestReport([]byte("a.txt: OK\n\n1 files: 1 OK, 0 FAILED, 0 MISSING\n"))
+	require.True(t, report.OK())
+}
@@ -0,0 +1,39 @@
+package mcclient
+
+import (
+	"path"
+	"strings"
+)
+
+// taggedDirName is the directory name that applies the tag following it to the files uploaded under it. It
+// is the server's mc.TaggedDirName.
+const taggedDirName = ".tagged"
+
+// ProjectPath returns the server path of the path made of elem in the project with projectSlug. Paths on
+// the server start with the slug of the project they are in, so /my-project/raw/a.tif is /raw/a.tif in
+// my-project.
+func ProjectPath(projectSlug string, elem ...string) string {
+	return path.Join(append([]string{"/", projectSlug}, elem...)...)
+}
+
+// TaggedPath returns the server path to upload to so that the files are stored at p, in the project with
+// projectSlug, and tagged with tags. For example TaggedPath("my-project", "/run1", "xrd") is
+// /my-project/.tagged/xrd/run1.
+func TaggedPath(projectSlug, p string, tags ...string) string {
+	elems := make([]string, 0, 2*len(tags)+1)
+	for _, tag := range tags {
+		elems = append(elems, taggedDirName, tag)
+	}
+
+	return ProjectPath(projectSlug, append(elems, p)...)
+}
+
+// ProjectSlug returns the slug of the project that the server path p is in.
+func ProjectSlug(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if i := strings.Index(p, "/"); i != -1 {
+		return p[:i]
+	}
+
+	return p
+}
@@ -0,0 +1,159 @@
+package mcclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SliceExtension is the SFTP extension that reads a slice of a dataset. It is the server's
+// mcsftp.SliceExtension.
+const SliceExtension = "mc-slice@materialscommons.org"
+
+// maxSliceBytes is the largest slice the server returns in one reply. It is the server's
+// mc.MaxHDF5SliceBytes.
+const maxSliceBytes = 224 * 1024
+
+// ErrSliceUnsupported is returned by Client.ReadSlice for a server that can't read slices of datasets.
+var ErrSliceUnsupported = errors.New("the server doesn't support reading slices of datasets")
+
+// Slice is a slice of a dataset in an HDF5 or NetCDF-4 file. Data holds its elements in row-major order,
+// as they are stored in the file, each ElementSize bytes. Integers and floats are decoded with Signed and
+// BigEndian. It is the server's mc.HDF5Slice.
+type Slice struct {
+	Shape []uint64 `json:"shape"`
+	Start []uint64 `json:"start"`
+	Count []uint64 `json:"count"`
+
+	// Class is integer, float, string, or other for datatypes, such as compound types, that are returned
+	// as they are stored.
+	Class       string `json:"class"`
+	ElementSize int    `json:"element_size"`
+	Signed      bool   `json:"signed,omitempty"`
+	BigEndian   bool   `json:"big_endian,omitempty"`
+
+	Data []byte `json:"-"`
+}
+
+// ReadSlice reads the slice of the dataset at dataset, such as /entry/data/counts, in the file at path,
+// which starts with the project slug. The slice starts at start and has count elements in each of the
+// dataset's dimensions. Only the slice is sent, so part of a large file can be read without downloading
+// it. Slices too large for one reply are read in pieces. The server can't read chunked datasets, which
+// are often compressed.
+func (c *Client) ReadSlice(path, dataset string, start, count []uint64) (*Slice, error) {
+	if _, ok := c.sftp.HasExtension(SliceExtension); !ok {
+		return nil, ErrSliceUnsupported
+	}
+
+	if len(start) != len(count) {
+		return nil, fmt.Errorf("start has %d dimensions and count has %d", len(start), len(count))
+	}
+
+	session, err := c.newExtensionSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// An empty slice returns the dataset's shape and the size of its elements, which the slice is
+	// split by.
+	slice, err := session.readSlice(path, dataset, start, make([]uint64, len(count)))
+	if err != nil {
+		return nil, err
+	}
+
+	slice.Count = count
+	if err := session.readSlicePieces(slice, path, dataset, start, count); err != nil {
+		return nil, err
+	}
+
+	return slice, nil
+}
+
+// readSlicePieces appends the elements of the slice that starts at start, and has count elements in each
+// dimension, to slice.Data. A slice too large for one reply is split in two on its outermost dimension
+// with more than one element, so that each half is contiguous in row-major order.
+func (s *extensionSession) readSlicePieces(slice *Slice, path, dataset string, start, count []uint64) error {
+	for _, n := range count {
+		if n == 0 {
+			return nil
+		}
+	}
+
+	size, fits := uint64(slice.ElementSize), true
+	for _, n := range count {
+		if size > maxSliceBytes/n {
+			fits = false
+			break
+		}
+		size *= n
+	}
+
+	split := 0
+	for split < len(count) && count[split] == 1 {
+		split++
+	}
+
+	if fits || split == len(count) {
+		piece, err := s.readSlice(path, dataset, start, count)
+		if err != nil {
+			return err
+		}
+
+		if uint64(len(piece.Data)) != size {
+			return fmt.Errorf("invalid reply to %s: %d bytes of data instead of %d", SliceExtension, len(piece.Data), size)
+		}
+
+		slice.Data = append(slice.Data, piece.Data...)
+		return nil
+	}
+
+	firstCount := append([]uint64(nil), count...)
+	firstCount[split] = count[split] / 2
+	if err := s.readSlicePieces(slice, path, dataset, start, firstCount); err != nil {
+		return err
+	}
+
+	secondStart, secondCount := append([]uint64(nil), start...), append([]uint64(nil), count...)
+	secondStart[split] += firstCount[split]
+	secondCount[split] -= firstCount[split]
+	return s.readSlicePieces(slice, path, dataset, secondStart, secondCount)
+}
+
+// readSlice sends a SliceExtension request for the slice that starts at start and has count elements in
+// each dimension.
+func (s *extensionSession) readSlice(path, dataset string, start, count []uint64) (*Slice, error) {
+	fields := [][]byte{stringField(path), stringField(dataset), uint32Field(uint32(len(start)))}
+	for _, values := range [][]uint64{start, count} {
+		for _, value := range values {
+			fields = append(fields, uint64Field(value))
+		}
+	}
+
+	data, err := s.request(SliceExtension, fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	header, data, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("invalid reply to %s", SliceExtension)
+	}
+
+	elements, _, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("invalid reply to %s", SliceExtension)
+	}
+
+	var slice Slice
+	if err := json.Unmarshal(header, &slice); err != nil {
+		return nil, fmt.Errorf("invalid reply to %s: %w", SliceExtension, err)
+	}
+
+	if slice.ElementSize <= 0 {
+		return nil, fmt.Errorf("invalid reply to %s: element size %d", SliceExtension, slice.ElementSize)
+	}
+
+	slice.Data = elements
+	return &slice, nil
+}
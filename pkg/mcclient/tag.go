@@ -0,0 +1,37 @@
+package mcclient
+
+import (
+	"errors"
+)
+
+// TagExtension is the SFTP extension that tags a file. It is the server's mcsftp.TagExtension.
+const TagExtension = "mc-tag@materialscommons.org"
+
+// ErrTagUnsupported is returned by Client.TagFile for a server that can't tag files.
+var ErrTagUnsupported = errors.New("the server doesn't support tagging files")
+
+// TagFile attaches tags to the file at path, which starts with the project slug, such as a file that was
+// just uploaded. Uploading the file under a .tagged/<tag> path does the same without an extra request.
+func (c *Client) TagFile(path string, tags ...string) error {
+	if _, ok := c.sftp.HasExtension(TagExtension); !ok {
+		return ErrTagUnsupported
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	session, err := c.newExtensionSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	fields := [][]byte{stringField(path), uint32Field(uint32(len(tags)))}
+	for _, tag := range tags {
+		fields = append(fields, stringField(tag))
+	}
+
+	_, err = session.request(TagExtension, fields...)
+	return err
+}
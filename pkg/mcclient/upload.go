@@ -0,0 +1,318 @@
+package mcclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// The names of the manifest files in a directory. They are the server's mc.ManifestFileName and
+// mc.ManifestReportFileName.
+const (
+	ManifestFileName       = "manifest.sha256"
+	ManifestReportFileName = "manifest.report"
+)
+
+// UploadOptions control how UploadDir uploads a directory tree.
+type UploadOptions struct {
+	// SkipUnchanged skips the files the server already has with the same checksum, as listed by
+	// mc sync-manifest. Running an upload that was interrupted again with SkipUnchanged resumes it: only
+	// the files that didn't finish are sent. The server doesn't resume a single SFTP upload part way
+	// through a file, a file that didn't finish is sent again from the start.
+	SkipUnchanged bool
+
+	// Manifest uploads a manifest of the SHA-256 checksums of the uploaded files, which the server checks
+	// them against when the session the manifest was uploaded in ends. See Client.ManifestReport.
+	Manifest bool
+
+	// Attempts is how many times a file is tried before UploadDir gives up on it. 0 means 1.
+	Attempts int
+}
+
+// UploadSummary is what UploadDir did.
+type UploadSummary struct {
+	Uploaded int
+	Skipped  int
+	Bytes    int64
+
+	// Failed are the errors of the files that couldn't be uploaded, by their path relative to the local
+	// directory.
+	Failed map[string]error
+}
+
+// UploadFile uploads the local file at localPath to remotePath, which starts with the project slug, and
+// returns the hex encoded MD5 and SHA-256 checksums of the data sent.
+func (c *Client) UploadFile(localPath, remotePath string) (md5sum, sha256sum string, n int64, err error) {
+	return uploadFile(c.sftp, localPath, remotePath)
+}
+
+func uploadFile(client *sftp.Client, localPath, remotePath string) (string, string, int64, error) {
+	in, err := os.Open(localPath)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer in.Close()
+
+	out, err := client.Create(remotePath)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("unable to create %s: %w", remotePath, err)
+	}
+
+	md5Hasher, sha256Hasher := md5.New(), sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, md5Hasher, sha256Hasher), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return "", "", n, fmt.Errorf("unable to upload %s: %w", remotePath, err)
+	}
+
+	return hex.EncodeToString(md5Hasher.Sum(nil)), hex.EncodeToString(sha256Hasher.Sum(nil)), n, nil
+}
+
+// UploadDir uploads the files in the directory tree at localDir to remoteDir, which starts with the project
+// slug, creating the directories they are in. A file that fails is recorded in the summary and the rest
+// are still uploaded. The error is only for failures that stop the whole upload.
+func (c *Client) UploadDir(localDir, remoteDir string, options UploadOptions) (*UploadSummary, error) {
+	summary := &UploadSummary{Failed: make(map[string]error)}
+
+	var remote map[string]string
+	if options.SkipUnchanged {
+		var err error
+		if remote, err = c.RemoteChecksums(remoteDir); err != nil {
+			return summary, err
+		}
+	}
+
+	attempts := options.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	// The SHA-256 checksum of every file that is in remoteDir once the upload is done, for the manifest.
+	checksums := make(map[string]string)
+
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		remotePath := path.Join(remoteDir, rel)
+
+		if info.IsDir() {
+			return c.sftp.MkdirAll(remotePath)
+		}
+
+		if !info.Mode().IsRegular() || (options.Manifest && (rel == ManifestFileName || rel == ManifestReportFileName)) {
+			return nil
+		}
+
+		if checksum, ok := remote[rel]; ok {
+			md5sum, sha256sum, err := fileChecksums(p)
+			if err != nil {
+				summary.Failed[rel] = err
+				return nil
+			}
+
+			if md5sum == checksum {
+				checksums[rel] = sha256sum
+				summary.Skipped++
+				return nil
+			}
+		}
+
+		for attempt := 1; ; attempt++ {
+			_, sha256sum, n, err := uploadFile(c.sftp, p, remotePath)
+			if err == nil {
+				checksums[rel] = sha256sum
+				summary.Uploaded++
+				summary.Bytes += n
+				break
+			}
+
+			if attempt == attempts {
+				summary.Failed[rel] = err
+				break
+			}
+
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return summary, err
+	}
+
+	if options.Manifest {
+		if err := c.uploadManifest(remoteDir, checksums); err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, nil
+}
+
+// uploadManifest uploads a manifest of checksums to dir. The server verifies a manifest when the session it
+// was uploaded in ends, so it is uploaded in a session of its own that is ended straight away, rather than
+// in the client's session, which may stay open.
+func (c *Client) uploadManifest(dir string, checksums map[string]string) error {
+	paths := make([]string, 0, len(checksums))
+	for p := range checksums {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var manifest bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&manifest, "%s  %s\n", checksums[p], p)
+	}
+
+	session, err := sftp.NewClient(c.conn)
+	if err != nil {
+		return fmt.Errorf("unable to start sftp session for manifest: %w", err)
+	}
+	defer session.Close()
+
+	f, err := session.Create(path.Join(dir, ManifestFileName))
+	if err != nil {
+		return fmt.Errorf("unable to create manifest: %w", err)
+	}
+
+	if _, err := f.Write(manifest.Bytes()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to upload manifest: %w", err)
+	}
+
+	return f.Close()
+}
+
+// RemoteChecksums returns the MD5 checksum of every file in the directory tree at dir, which starts with
+// the project slug, by path relative to dir. Files that are still being uploaded are left out.
+func (c *Client) RemoteChecksums(dir string) (map[string]string, error) {
+	out, err := c.run("sync-manifest", dir, "--format", "json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list checksums of %s: %w", dir, err)
+	}
+
+	return parseSyncManifest(out)
+}
+
+// syncManifestEntry is a line of mc sync-manifest's json output. It is the server's mc.SyncManifestEntry.
+type syncManifestEntry struct {
+	Path     string `json:"path"`
+	Checksum string `json:"checksum"`
+}
+
+func parseSyncManifest(b []byte) (map[string]string, error) {
+	checksums := make(map[string]string)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	for decoder.More() {
+		var entry syncManifestEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("invalid sync manifest: %w", err)
+		}
+		checksums[entry.Path] = entry.Checksum
+	}
+
+	return checksums, nil
+}
+
+// ManifestReport is the result of the server verifying a manifest.
+type ManifestReport struct {
+	// Results is the result of each file in the manifest, by its path: OK, FAILED, MISSING or INVALID PATH.
+	Results map[string]string
+
+	// Summary is the report's last line, such as "3 files: 3 OK, 0 FAILED, 0 MISSING".
+	Summary string
+}
+
+// OK returns true if every file in the manifest was verified.
+func (r *ManifestReport) OK() bool {
+	for _, result := range r.Results {
+		if result != "OK" {
+			return false
+		}
+	}
+
+	return len(r.Results) != 0
+}
+
+// ManifestReport returns the report of the manifest uploaded to dir, which starts with the project slug.
+// The report is written once the session the manifest was uploaded in has ended and its files have been
+// checked, until then the error is os.ErrNotExist.
+func (c *Client) ManifestReport(dir string) (*ManifestReport, error) {
+	f, err := c.sftp.Open(path.Join(dir, ManifestReportFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifestReport(contents), nil
+}
+
+func parseManifestReport(b []byte) *ManifestReport {
+	report := &ManifestReport{Results: make(map[string]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		i := strings.LastIndex(line, ": ")
+		if i == -1 || strings.Contains(line, " files: ") {
+			report.Summary = line
+			continue
+		}
+
+		result := line[i+2:]
+		if strings.HasPrefix(result, "FAILED") {
+			result = "FAILED"
+		}
+		report.Results[line[:i]] = result
+	}
+
+	return report
+}
+
+// fileChecksums returns the hex encoded MD5 and SHA-256 checksums of the local file at p.
+func fileChecksums(p string) (string, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	md5Hasher, sha256Hasher := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hasher, sha256Hasher), f); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(md5Hasher.Sum(nil)), hex.EncodeToString(sha256Hasher.Sum(nil)), nil
+}
@@ -0,0 +1,94 @@
+package mcclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WatchExtension is the SFTP extension that waits for new files. It is the server's
+// mcsftp.WatchExtension.
+const WatchExtension = "mc-watch@materialscommons.org"
+
+// ErrWatchUnsupported is returned by Client.Watch for a server that doesn't let clients watch for new
+// files.
+var ErrWatchUnsupported = errors.New("the server doesn't support watching for new files")
+
+// NewFile is a file that finished uploading to a watched directory. Path starts with the project slug.
+type NewFile struct {
+	FileID     int       `json:"file_id"`
+	Path       string    `json:"path"`
+	Size       uint64    `json:"size"`
+	Checksum   string    `json:"checksum"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Watcher waits for the files uploaded to a directory tree. See Client.Watch.
+type Watcher struct {
+	session *extensionSession
+	dir     string
+	cursor  string
+
+	// pending are the files returned while getting the first cursor.
+	pending []NewFile
+}
+
+// Watch starts watching the directory tree at dir, which starts with the project slug, for new files. Only
+// the files uploaded after Watch is called are returned by Next. The Watcher has an SFTP session of its
+// own, and must be closed.
+func (c *Client) Watch(dir string) (*Watcher, error) {
+	if _, ok := c.sftp.HasExtension(WatchExtension); !ok {
+		return nil, ErrWatchUnsupported
+	}
+
+	session, err := c.newExtensionSession()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{session: session, dir: dir}
+
+	// A short wait gets a cursor from the server, so that the files uploaded from now on aren't missed.
+	if w.pending, _, err = w.Next(time.Second); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Next waits up to timeout, in whole seconds, for files to be uploaded, and returns the files uploaded since the last call.
+// The server limits how long it waits, so no files doesn't mean none will come. It also returns true when
+// files may have been missed, for example because the server restarted, in which case the directory should
+// be listed, or RemoteChecksums called, to catch up.
+func (w *Watcher) Next(timeout time.Duration) ([]NewFile, bool, error) {
+	if len(w.pending) != 0 {
+		files := w.pending
+		w.pending = nil
+		return files, false, nil
+	}
+
+	seconds := uint32((timeout + time.Second - 1) / time.Second)
+	data, err := w.session.request(WatchExtension, stringField(w.dir), stringField(w.cursor), uint32Field(seconds))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var reply struct {
+		Cursor string    `json:"cursor"`
+		Missed bool      `json:"missed"`
+		Files  []NewFile `json:"files"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, false, fmt.Errorf("invalid reply to %s: %w", WatchExtension, err)
+	}
+
+	w.cursor = reply.Cursor
+	return reply.Files, reply.Missed, nil
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.session.Close()
+}
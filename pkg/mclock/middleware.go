@@ -0,0 +1,86 @@
+// Package mclock implements the mc-lock and mc-unlock commands that let users take advisory locks on
+// files. pkg/sftp doesn't support the SFTP block/unblock requests, or custom extensions, so the locks
+// are taken by running a command over ssh, for example:
+//
+//	ssh user@mc-sshd mc-lock /my-project/results/output.csv 30m
+//	ssh user@mc-sshd mc-unlock /my-project/results/output.csv
+//
+// While a file is locked, uploads to it by other users, over SCP or SFTP, fail with mc.ErrFileLocked.
+package mclock
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/charmbracelet/wish"
+	"github.com/gliderlabs/ssh"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// DefaultLockTTL is how long a lock lasts when mc-lock isn't given a ttl.
+const DefaultLockTTL = time.Hour
+
+// MaxLockTTL is the longest a lock can be taken for. Locks can be extended by running mc-lock again.
+const MaxLockTTL = 24 * time.Hour
+
+// Middleware handles the mc-lock and mc-unlock commands. Any other command is passed on to next.
+func Middleware(stores *mc.Stores, coordinator *mc.Coordinator) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(s ssh.Session) {
+			cmd := s.Command()
+			if len(cmd) == 0 || (cmd[0] != "mc-lock" && cmd[0] != "mc-unlock") {
+				next(s)
+				return
+			}
+
+			user := s.Context().Value("mcuser").(*mcmodel.User)
+			if err := runCommand(stores, coordinator, user, s.RemoteAddr(), cmd); err != nil {
+				_, _ = fmt.Fprintf(s.Stderr(), "%s: %s\n", cmd[0], mc.Localize(err, mc.ParseSessionEnv(s.Environ()).Language))
+				_ = s.Exit(1)
+				return
+			}
+
+			_ = s.Exit(0)
+		}
+	}
+}
+
+// runCommand runs a single mc-lock or mc-unlock command for user, who connected from remoteAddr.
+func runCommand(stores *mc.Stores, coordinator *mc.Coordinator, user *mcmodel.User, remoteAddr net.Addr, cmd []string) error {
+	if len(cmd) < 2 || len(cmd) > 3 || (cmd[0] == "mc-unlock" && len(cmd) != 2) {
+		return fmt.Errorf("usage: mc-lock /project-slug/path [ttl] | mc-unlock /project-slug/path")
+	}
+
+	project, err := mc.GetAndValidateProjectForClient(cmd[1], user.ID, remoteAddr, stores)
+	if err != nil {
+		return err
+	}
+
+	path := mc.RemoveProjectSlugFromPath(cmd[1], project.Slug)
+
+	if cmd[0] == "mc-unlock" {
+		if err := coordinator.AdvisoryLocker.Unlock(project.ID, path, user.ID); err != nil {
+			return err
+		}
+
+		log.Infof("User %d unlocked %s in project %d", user.ID, path, project.ID)
+		return nil
+	}
+
+	ttl := DefaultLockTTL
+	if len(cmd) == 3 {
+		if ttl, err = time.ParseDuration(cmd[2]); err != nil || ttl <= 0 || ttl > MaxLockTTL {
+			return fmt.Errorf("invalid ttl '%s', must be a duration such as 30m up to %s", cmd[2], MaxLockTTL)
+		}
+	}
+
+	if err := coordinator.AdvisoryLocker.Lock(project.ID, path, user.ID, ttl); err != nil {
+		return err
+	}
+
+	log.Infof("User %d locked %s in project %d for %s", user.ID, path, project.ID, ttl)
+	return nil
+}
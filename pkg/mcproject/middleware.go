@@ -0,0 +1,1340 @@
+// Package mcproject implements the mc commands for projects. The mc project commands let project owners
+// and admins manage who can access their projects, the networks they can be accessed from, and the
+// directories that uploaded archives are extracted in, from the terminal they use for transfers, and see which of their files are being downloaded, mc token lets users delegate part of their access to a project, such
+// as to a pipeline job, mc quota reports how much space projects have left, or with --user how much
+// space the files the user uploaded take up in each project, mc du reports how big a
+// directory tree is before downloading it, mc find lists the files in a tree for a script to
+// download selectively, mc sync-manifest lists the size, checksum and modification time of every
+// file in a tree for a script mirroring it, mc bag assembles a tree into a BagIt bag for depositing in a
+// repository, mc pull has the server fetch a file from a URL straight into a project, and mc extract and
+// mc verify-manifest extract an archive, or check a manifest, that was staged in the connection's /tmp
+// scratch area (see mc.ScratchArea) without it becoming a file in the project, and mc upload-offset and
+// mc upload-append continue an interrupted SCP upload by sending only the rest of the file (see
+// mc.ContinueUpload), for example:
+//
+//	ssh user@mc-sshd mc project list-users my-project
+//	ssh user@mc-sshd mc project add-user my-project collaborator-slug
+//	ssh user@mc-sshd mc project add-user my-project collaborator-slug --admin
+//	ssh user@mc-sshd mc project list-networks my-project
+//	ssh user@mc-sshd mc project set-networks my-project 10.1.2.0/24 192.168.7.0/24
+//	ssh user@mc-sshd mc project clear-networks my-project
+//	ssh user@mc-sshd mc project list-extract-paths my-project
+//	ssh user@mc-sshd mc project set-extract-paths my-project /incoming/xrd
+//	ssh user@mc-sshd mc project clear-extract-paths my-project
+//	ssh user@mc-sshd mc project add-guest my-project /incoming/partner-lab 72h
+//	ssh user@mc-sshd mc project list-guests my-project
+//	ssh user@mc-sshd mc project remove-guest my-project guest-3f9a1c2b7d40
+//	ssh user@mc-sshd mc project downloads my-project
+//	ssh user@mc-sshd mc token create /my-project/raw/run-42 write 24h
+//	ssh user@mc-sshd mc token list
+//	ssh user@mc-sshd mc token revoke token-5be0c41d9a2f
+//	ssh user@mc-sshd mc quota my-project
+//	ssh user@mc-sshd mc quota --user
+//	ssh user@mc-sshd mc du /my-project/raw
+//	ssh user@mc-sshd mc find /my-project/raw -name '*.tif' -newer 2024-06-01
+//	ssh user@mc-sshd mc sync-manifest /my-project/raw --format csv
+//	ssh user@mc-sshd mc bag /my-project/dataset1
+//	ssh user@mc-sshd mc pull https://scratch.hpc.example.edu/run-42/output.h5 /my-project/raw/
+//	ssh user@mc-sshd mc extract /tmp/run-42.tar.gz /my-project/raw/run-42
+//	ssh user@mc-sshd mc verify-manifest /tmp/manifest.sha256 /my-project/raw/run-42
+//	ssh user@mc-sshd mc upload-offset /my-project/raw/run-42.h5 107374182400
+//	tail -c +$((offset+1)) run-42.h5 | ssh user@mc-sshd mc upload-append /my-project/raw/run-42.h5 107374182400 $offset $checksum
+//
+// The scratch area only lasts as long as the connection, so mc extract and mc verify-manifest have to be
+// run over the connection the files were staged with, such as one shared with ssh -o ControlMaster.
+//
+// mc upload-offset writes how much of the file was staged, and the MD5 checksum of the staged data. Before
+// sending the rest of the file, the client checks that the checksum matches the same number of bytes at the
+// start of its copy, for example with head -c $offset run-42.h5 | md5sum, and uploads the whole file again
+// if it doesn't. mc upload-append is given the checksum too, and refuses to continue an upload whose staged
+// data has a different checksum. Like an SCP upload, the data appended is subject to the write-once
+// policy, the path limits, the finalize backpressure and the ingest rate limits.
+//
+// Every attempt to add a user is emitted as an mc.EventProjectMember event, every attempt to change the
+// networks as an mc.EventProjectNetworks event, every attempt to change the extract paths as an
+// mc.EventProjectExtractPaths event, and every guest added or removed as an
+// mc.EventProjectGuest event, every token created or revoked as an mc.EventToken event, and every pull as
+// an mc.EventPull event, whether or not it succeeded, so that there is an audit trail of the changes.
+//
+// Like SFTP and SCP transfers, the commands that read, list or write project paths ask the coordinator's
+// mc.Authorizer about each path they are given, with a protocol of "mc".
+package mcproject
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/charmbracelet/wish"
+	"github.com/gliderlabs/ssh"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+const usage = "usage: mc project list-users project-slug | mc project add-user project-slug user-slug [--admin] | " +
+	"mc project list-networks project-slug | mc project set-networks project-slug cidr... | " +
+	"mc project clear-networks project-slug | mc project list-extract-paths project-slug | " +
+	"mc project set-extract-paths project-slug /path... | mc project clear-extract-paths project-slug | " +
+	"mc project add-guest project-slug /path [ttl] | " +
+	"mc project list-guests project-slug | mc project remove-guest project-slug guest-slug | " +
+	"mc project downloads project-slug | " +
+	"mc token create /project-slug/path read|write|read-write [ttl] | mc token list | mc token revoke token-slug | " +
+	"mc quota [project-slug] | mc quota --user | mc du /project-slug/path | " +
+	"mc find /project-slug/path [-name glob] [-newer date] [-type f|d] | " +
+	"mc sync-manifest /project-slug/path [--format json|csv] | mc bag /project-slug/path | " +
+	"mc pull url /project-slug/path | mc extract /tmp/archive /project-slug/path | " +
+	"mc verify-manifest /tmp/manifest /project-slug/path | " +
+	"mc upload-offset /project-slug/path size | mc upload-append /project-slug/path size offset checksum"
+
+// protocol is the protocol the mc commands are authorized as (see mc.AuthorizationRequest).
+const protocol = "mc"
+
+// commands are the mc commands handled by Middleware.
+var commands = map[string]bool{"project": true, "token": true, "quota": true, "du": true, "find": true, "sync-manifest": true, "bag": true, "pull": true, "extract": true, "verify-manifest": true, "upload-offset": true, "upload-append": true}
+
+// Middleware handles the mc project, mc token, mc quota, mc du, mc find, mc sync-manifest, mc bag, mc pull, mc extract, mc verify-manifest, mc upload-offset and mc upload-append commands. Any other command is passed on to next.
+func Middleware(stores *mc.Stores, userStore store.UserStore, coordinator *mc.Coordinator, config *mc.Config, mcfsRoot string) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(s ssh.Session) {
+			cmd := s.Command()
+			if len(cmd) < 2 || cmd[0] != "mc" || !commands[cmd[1]] {
+				next(s)
+				return
+			}
+
+			user := s.Context().Value("mcuser").(*mcmodel.User)
+			c := &command{
+				ctx:         s.Context(),
+				coordinator: coordinator,
+				puller:      coordinator.Puller,
+				stores:      stores.ForSession(),
+				userStore:   userStore,
+				events:      coordinator.Events,
+				config:      config,
+				mcfsRoot:    mcfsRoot,
+				user:        user,
+				remoteAddr:  s.RemoteAddr(),
+				in:          s,
+				out:         s,
+			}
+
+			if coordinator.Scratch != nil {
+				connID, _ := s.Context().Value(ssh.ContextKeySessionID).(string)
+				c.scratch = func() (*mc.ScratchArea, error) {
+					return coordinator.Scratch.ForConnection(connID, s.Context().Done())
+				}
+			}
+
+			if err := c.run(cmd[1:]); err != nil {
+				_, _ = fmt.Fprintf(s.Stderr(), "mc %s: %s\n", cmd[1], mc.Localize(err, mc.ParseSessionEnv(s.Environ()).Language))
+				_ = s.Exit(1)
+				return
+			}
+
+			_ = s.Exit(0)
+		}
+	}
+}
+
+// command is a single mc command run by user.
+type command struct {
+	// ctx is done when the session ends.
+	ctx context.Context
+
+	// coordinator holds the locks and quota reservations shared with the SCP and SFTP uploads.
+	coordinator *mc.Coordinator
+
+	puller    *mc.Puller
+	stores    *mc.Stores
+	userStore store.UserStore
+	events    mc.EventSink
+	config    *mc.Config
+	mcfsRoot  string
+	user      *mcmodel.User
+
+	// remoteAddr is the address the user connected from. It is checked against the networks a project
+	// is restricted to.
+	remoteAddr net.Addr
+
+	// scratch returns the connection's scratch area. It is nil when scratch areas aren't turned on.
+	scratch func() (*mc.ScratchArea, error)
+
+	in  io.Reader
+	out io.Writer
+}
+
+func (c *command) run(args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "project" && args[1] == "list-users":
+		return c.listUsers(args[2])
+	case len(args) == 4 && args[0] == "project" && args[1] == "add-user":
+		return c.addUser(args[2], args[3], false)
+	case len(args) == 5 && args[0] == "project" && args[1] == "add-user" && args[4] == "--admin":
+		return c.addUser(args[2], args[3], true)
+	case len(args) == 3 && args[0] == "project" && args[1] == "list-networks":
+		return c.listNetworks(args[2])
+	case len(args) >= 4 && args[0] == "project" && args[1] == "set-networks":
+		return c.setNetworks(args[2], args[3:])
+	case len(args) == 3 && args[0] == "project" && args[1] == "clear-networks":
+		return c.setNetworks(args[2], nil)
+	case len(args) == 3 && args[0] == "project" && args[1] == "list-extract-paths":
+		return c.listExtractPaths(args[2])
+	case len(args) >= 4 && args[0] == "project" && args[1] == "set-extract-paths":
+		return c.setExtractPaths(args[2], args[3:])
+	case len(args) == 3 && args[0] == "project" && args[1] == "clear-extract-paths":
+		return c.setExtractPaths(args[2], nil)
+	case len(args) == 4 && args[0] == "project" && args[1] == "add-guest":
+		return c.addGuest(args[2], args[3], "")
+	case len(args) == 5 && args[0] == "project" && args[1] == "add-guest":
+		return c.addGuest(args[2], args[3], args[4])
+	case len(args) == 3 && args[0] == "project" && args[1] == "list-guests":
+		return c.listGuests(args[2])
+	case len(args) == 4 && args[0] == "project" && args[1] == "remove-guest":
+		return c.removeGuest(args[2], args[3])
+	case len(args) == 3 && args[0] == "project" && args[1] == "downloads":
+		return c.downloads(args[2])
+	case len(args) == 4 && args[0] == "token" && args[1] == "create":
+		return c.createToken(args[2], args[3], "")
+	case len(args) == 5 && args[0] == "token" && args[1] == "create":
+		return c.createToken(args[2], args[3], args[4])
+	case len(args) == 2 && args[0] == "token" && args[1] == "list":
+		return c.listTokens()
+	case len(args) == 3 && args[0] == "token" && args[1] == "revoke":
+		return c.revokeToken(args[2])
+	case len(args) == 1 && args[0] == "quota":
+		return c.quota("")
+	case len(args) == 2 && args[0] == "quota" && args[1] == "--user":
+		return c.userQuota()
+	case len(args) == 2 && args[0] == "quota":
+		return c.quota(args[1])
+	case len(args) == 2 && args[0] == "du":
+		return c.du(args[1])
+	case len(args) >= 2 && args[0] == "find":
+		return c.find(args[1], args[2:])
+	case len(args) == 2 && args[0] == "sync-manifest":
+		return c.syncManifest(args[1], mc.SyncManifestJSON)
+	case len(args) == 4 && args[0] == "sync-manifest" && args[2] == "--format":
+		return c.syncManifest(args[1], args[3])
+	case len(args) == 2 && args[0] == "bag":
+		return c.bag(args[1])
+	case len(args) == 3 && args[0] == "pull":
+		return c.pull(args[1], args[2])
+	case len(args) == 3 && args[0] == "extract":
+		return c.extract(args[1], args[2])
+	case len(args) == 3 && args[0] == "verify-manifest":
+		return c.verifyManifest(args[1], args[2])
+	case len(args) == 3 && args[0] == "upload-offset":
+		return c.uploadOffset(args[1], args[2])
+	case len(args) == 5 && args[0] == "upload-append":
+		return c.uploadAppend(args[1], args[2], args[3], args[4])
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// getProject returns the project with projectSlug, if the user can manage its members and networks.
+func (c *command) getProject(projectSlug string) (*mcmodel.Project, error) {
+	project, err := mc.GetAndValidateProjectForClient("/"+projectSlug, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return nil, err
+	}
+
+	canManage, err := mc.CanManageProjectMembers(c.stores, project, c.user)
+	switch {
+	case err != nil:
+		return nil, err
+	case !canManage:
+		return nil, mc.ErrNotProjectAdmin
+	}
+
+	return project, nil
+}
+
+// listUsers writes the slug, name and role of each of the project's members, one per line.
+func (c *command) listUsers(projectSlug string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	members, err := c.stores.ProjectMemberStore.ListProjectMembers(project)
+	if err != nil {
+		log.Errorf("Unable to list the members of project %d: %s", project.ID, err)
+		return err
+	}
+
+	for _, member := range members {
+		role := "member"
+		if member.Admin {
+			role = "admin"
+		}
+
+		if _, err := fmt.Fprintf(c.out, "%s\t%s\t%s\n", member.User.Slug, member.User.Name, role); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addUser adds the user with memberSlug to the project. The attempt is emitted as an
+// mc.EventProjectMember event.
+func (c *command) addUser(projectSlug, memberSlug string, admin bool) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	err = c.addMember(project, memberSlug, admin)
+
+	outcome := "added"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	c.events.Emit(mc.Event{
+		Type:      mc.EventProjectMember,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Details: map[string]string{
+			"user_id": strconv.Itoa(c.user.ID),
+			"member":  memberSlug,
+			"admin":   strconv.FormatBool(admin),
+			"outcome": outcome,
+		},
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to add %s to project %d: %s", c.user.ID, memberSlug, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d added %s to project %d (admin: %t)", c.user.ID, memberSlug, project.ID, admin)
+	return nil
+}
+
+func (c *command) addMember(project *mcmodel.Project, memberSlug string, admin bool) error {
+	if c.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	member, err := c.userStore.GetUserBySlug(memberSlug)
+	if err != nil {
+		return fmt.Errorf("no user '%s'", memberSlug)
+	}
+
+	return c.stores.ProjectMemberStore.AddProjectMember(project, member, admin)
+}
+
+// listNetworks writes the networks the project can be accessed from, one per line. Nothing is written
+// when the project isn't restricted.
+func (c *command) listNetworks(projectSlug string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	networks, err := c.stores.ProjectNetworkStore.GetProjectNetworks(project.ID)
+	if err != nil {
+		log.Errorf("Unable to list the networks of project %d: %s", project.ID, err)
+		return err
+	}
+
+	for _, network := range networks {
+		if _, err := fmt.Fprintln(c.out, network); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setNetworks restricts the project to the networks in cidrs, or removes the restriction when cidrs is
+// empty. The attempt is emitted as an mc.EventProjectNetworks event.
+func (c *command) setNetworks(projectSlug string, cidrs []string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	err = c.updateNetworks(project, cidrs)
+
+	outcome := "updated"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	c.events.Emit(mc.Event{
+		Type:      mc.EventProjectNetworks,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Details: map[string]string{
+			"user_id":  strconv.Itoa(c.user.ID),
+			"networks": strings.Join(cidrs, ","),
+			"outcome":  outcome,
+		},
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to set the networks of project %d: %s", c.user.ID, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d set the networks of project %d to %v", c.user.ID, project.ID, cidrs)
+	return nil
+}
+
+func (c *command) updateNetworks(project *mcmodel.Project, cidrs []string) error {
+	if c.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	networks, err := mc.ParseNetworks(cidrs)
+	if err != nil {
+		return err
+	}
+
+	// Refuse a change that would lock out the user making it, who would then be unable to undo it.
+	if len(networks) != 0 && !mc.NetworksContain(networks, c.remoteAddr) {
+		return fmt.Errorf("your address %s isn't in the networks, you would lose access to the project", c.remoteAddr)
+	}
+
+	return c.stores.ProjectNetworkStore.SetProjectNetworks(project.ID, networks)
+}
+
+// listExtractPaths writes the directories the project has uploaded archives extracted in, one per line.
+// Nothing is written when the project hasn't opted in.
+func (c *command) listExtractPaths(projectSlug string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	paths, err := c.stores.ProjectExtractPathStore.GetExtractPaths(project.ID)
+	if err != nil {
+		log.Errorf("Unable to list the extract paths of project %d: %s", project.ID, err)
+		return err
+	}
+
+	for _, path := range paths {
+		if _, err := fmt.Fprintln(c.out, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setExtractPaths has the archives uploaded into paths in the project extracted, or opts the project out
+// when paths is empty. The attempt is emitted as an mc.EventProjectExtractPaths event.
+func (c *command) setExtractPaths(projectSlug string, paths []string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	err = c.updateExtractPaths(project, paths)
+
+	outcome := "updated"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	c.events.Emit(mc.Event{
+		Type:      mc.EventProjectExtractPaths,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Details: map[string]string{
+			"user_id": strconv.Itoa(c.user.ID),
+			"paths":   strings.Join(paths, ","),
+			"outcome": outcome,
+		},
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to set the extract paths of project %d: %s", c.user.ID, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d set the extract paths of project %d to %v", c.user.ID, project.ID, paths)
+	return nil
+}
+
+func (c *command) updateExtractPaths(project *mcmodel.Project, paths []string) error {
+	if c.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	extractPaths, err := mc.ParseExtractPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	// The archives are extracted as their uploader, but only into paths the admin could write to.
+	for _, path := range extractPaths {
+		if err := c.authorize(project, path, mc.OperationWrite); err != nil {
+			return err
+		}
+	}
+
+	return c.stores.ProjectExtractPathStore.SetExtractPaths(project.ID, extractPaths)
+}
+
+// addGuest creates a guest that can upload into path in the project for ttl, or mc.DefaultGuestTTL when
+// ttl is blank, and writes the guest's slug, password and expiry. The password can't be shown again.
+func (c *command) addGuest(projectSlug, path, ttl string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	guest, password, err := c.createGuest(project, path, ttl)
+
+	details := map[string]string{"user_id": strconv.Itoa(c.user.ID), "outcome": "added"}
+	if err != nil {
+		details["outcome"] = err.Error()
+	} else {
+		details["guest"] = guest.Slug
+		details["expires_at"] = guest.ExpiresAt.Format(time.RFC3339)
+	}
+
+	c.events.Emit(mc.Event{
+		Type:      mc.EventProjectGuest,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Path:      path,
+		Details:   details,
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to add a guest to project %d: %s", c.user.ID, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d added guest %s to project %d for %s", c.user.ID, guest.Slug, project.ID, guest.Path)
+	_, err = fmt.Fprintf(c.out, "guest:    %s\npassword: %s\nexpires:  %s\nupload:   sftp %s@<server>:/%s%s\n",
+		guest.Slug, password, guest.ExpiresAt.Format(time.RFC3339), guest.Slug, project.Slug, guest.Path)
+	return err
+}
+
+func (c *command) createGuest(project *mcmodel.Project, path, ttl string) (*mc.Guest, string, error) {
+	if c.config.ReadOnly {
+		return nil, "", mc.ErrReadOnly
+	}
+
+	duration := mc.DefaultGuestTTL
+	if ttl != "" {
+		var err error
+		if duration, err = time.ParseDuration(ttl); err != nil {
+			return nil, "", fmt.Errorf("invalid ttl '%s', expected a duration such as 72h", ttl)
+		}
+	}
+
+	return mc.CreateGuest(c.stores, project, c.user, path, duration)
+}
+
+// listGuests writes the slug, upload path and expiry of each of the project's guests, one per line.
+func (c *command) listGuests(projectSlug string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	guests, err := c.stores.GuestStore.ListGuests(project.ID)
+	if err != nil {
+		log.Errorf("Unable to list the guests of project %d: %s", project.ID, err)
+		return err
+	}
+
+	for _, guest := range guests {
+		if _, err := fmt.Fprintf(c.out, "%s\t%s\t%s\n", guest.Slug, guest.Path, guest.ExpiresAt.Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeGuest removes the project's guest with guestSlug, which can no longer log in. Sessions the guest
+// already has open aren't closed.
+func (c *command) removeGuest(projectSlug, guestSlug string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	if c.config.ReadOnly {
+		err = mc.ErrReadOnly
+	} else {
+		err = c.stores.GuestStore.DeleteGuest(project.ID, guestSlug)
+	}
+
+	outcome := "removed"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	c.events.Emit(mc.Event{
+		Type:      mc.EventProjectGuest,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Details: map[string]string{
+			"user_id": strconv.Itoa(c.user.ID),
+			"guest":   guestSlug,
+			"outcome": outcome,
+		},
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to remove guest %s from project %d: %s", c.user.ID, guestSlug, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d removed guest %s from project %d", c.user.ID, guestSlug, project.ID)
+	return nil
+}
+
+// maxDownloadsListed is the number of files mc project downloads lists.
+const maxDownloadsListed = 50
+
+// downloads writes the download count, last download time and path of the project's most downloaded
+// files, one per line. The counts are written to the database in batches, so the latest downloads may
+// not be included yet.
+func (c *command) downloads(projectSlug string) error {
+	project, err := c.getProject(projectSlug)
+	if err != nil {
+		return err
+	}
+
+	accesses, err := c.stores.FileAccessStore.ListFileAccesses(project.ID, maxDownloadsListed)
+	if err != nil {
+		log.Errorf("Unable to list the downloads of project %d: %s", project.ID, err)
+		return err
+	}
+
+	for _, access := range accesses {
+		// Files the user isn't allowed to see are left out, rather than failing the whole list.
+		if err := c.authorize(project, access.Path, mc.OperationList); err != nil {
+			continue
+		}
+
+		_, err := fmt.Fprintf(c.out, "%d\t%s\t%s\n", access.Downloads, access.LastAccessedAt.Format(time.RFC3339), access.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createToken creates a token for the user that gives access to path, which starts with the project
+// slug, for ttl, or mc.DefaultTokenTTL when ttl is blank. It writes the token's slug, secret and expiry.
+// The secret can't be shown again. Like adding a guest, the user has to be an admin of the project.
+// Instrument accounts and users logged in with a scoped credential can't create tokens, since a token
+// would give them access outside of their drop boxes or scope.
+func (c *command) createToken(path, access, ttl string) error {
+	switch {
+	case c.config.Scopes.IsScoped(c.user.Slug):
+		return mc.ErrOutOfScope
+	case c.config.IsInstrumentAccount(c.user.Slug):
+		return mc.ErrDropBoxOnly
+	}
+
+	project, err := c.getProject(mc.GetProjectSlugFromPath(path))
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	token, secret, err := c.newToken(project, projectPath, access, ttl)
+
+	details := map[string]string{"user_id": strconv.Itoa(c.user.ID), "access": access, "outcome": "created"}
+	if err != nil {
+		details["outcome"] = err.Error()
+	} else {
+		details["token"] = token.Slug
+		details["expires_at"] = token.ExpiresAt.Format(time.RFC3339)
+	}
+
+	c.events.Emit(mc.Event{
+		Type:      mc.EventToken,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Path:      projectPath,
+		Details:   details,
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to create a token for project %d: %s", c.user.ID, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d created token %s for %s in project %d (%s)", c.user.ID, token.Slug, token.Path, project.ID, token.Access)
+	_, err = fmt.Fprintf(c.out, "token:   %s\nsecret:  %s\naccess:  %s /%s%s\nexpires: %s\n",
+		token.Slug, secret, token.Access, project.Slug, token.Path, token.ExpiresAt.Format(time.RFC3339))
+	return err
+}
+
+func (c *command) newToken(project *mcmodel.Project, path, access, ttl string) (*mc.Token, string, error) {
+	duration := mc.DefaultTokenTTL
+	if ttl != "" {
+		var err error
+		if duration, err = time.ParseDuration(ttl); err != nil {
+			return nil, "", fmt.Errorf("invalid ttl '%s', expected a duration such as 24h", ttl)
+		}
+	}
+
+	if c.config.ReadOnly && access != mc.TokenRead {
+		return nil, "", mc.ErrReadOnly
+	}
+
+	// The token can't give access to paths the authorizer wouldn't let the user at.
+	var operations []string
+	switch access {
+	case mc.TokenRead:
+		operations = []string{mc.OperationRead}
+	case mc.TokenWrite:
+		operations = []string{mc.OperationWrite}
+	case mc.TokenReadWrite:
+		operations = []string{mc.OperationRead, mc.OperationWrite}
+	}
+
+	for _, operation := range operations {
+		if err := c.authorize(project, path, operation); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return mc.CreateToken(c.stores, project, c.user, path, access, duration)
+}
+
+// listTokens writes the slug, access, project path and expiry of each of the user's tokens, one per line.
+func (c *command) listTokens() error {
+	tokens, err := c.stores.TokenStore.ListTokens(c.user.ID)
+	if err != nil {
+		log.Errorf("Unable to list the tokens of user %d: %s", c.user.ID, err)
+		return err
+	}
+
+	for _, token := range tokens {
+		projectSlug := strconv.Itoa(token.ProjectID)
+		if project, err := c.stores.ProjectStore.GetProjectByID(token.ProjectID); err == nil {
+			projectSlug = project.Slug
+		}
+
+		_, err := fmt.Fprintf(c.out, "%s\t%s\t/%s%s\t%s\n",
+			token.Slug, token.Access, projectSlug, token.Path, token.ExpiresAt.Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeToken removes the user's token with tokenSlug, which can no longer log in. Sessions already
+// logged in with the token aren't closed.
+func (c *command) revokeToken(tokenSlug string) error {
+	err := c.stores.TokenStore.DeleteToken(c.user.ID, tokenSlug)
+
+	outcome := "revoked"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	c.events.Emit(mc.Event{
+		Type: mc.EventToken,
+		Time: time.Now(),
+		Details: map[string]string{
+			"user_id": strconv.Itoa(c.user.ID),
+			"token":   tokenSlug,
+			"outcome": outcome,
+		},
+	})
+
+	if err != nil {
+		log.Errorf("User %d was unable to revoke token %s: %s", c.user.ID, tokenSlug, err)
+		return err
+	}
+
+	log.Infof("User %d revoked token %s", c.user.ID, tokenSlug)
+	return nil
+}
+
+// quota writes the storage used and available, and the file and directory counts, for the project with
+// projectSlug, or for each of the user's projects when projectSlug is blank. Sizes are in bytes, so that
+// scripts can check there is room before starting a large upload. Without a quota the available space is
+// the free space on the filesystem holding the project files, and the quota is reported as "none".
+func (c *command) quota(projectSlug string) error {
+	var projects []mcmodel.Project
+	if projectSlug != "" {
+		project, err := mc.GetAndValidateProjectForClient("/"+projectSlug, c.user.ID, c.remoteAddr, c.stores)
+		if err != nil {
+			return err
+		}
+
+		if err := c.authorize(project, "/", mc.OperationList); err != nil {
+			return err
+		}
+		projects = append(projects, *project)
+	} else {
+		var err error
+		if projects, err = c.stores.ProjectStore.GetProjectsForUser(c.user.ID); err != nil {
+			log.Errorf("Unable to list the projects for user %d: %s", c.user.ID, err)
+			return err
+		}
+
+		// Like the listing of the SFTP root, only the projects the user can open from where they are
+		// connected are included.
+		listReq := mc.NewAuthorizationRequest(c.config.Scopes, c.user, protocol, mc.OperationList)
+		if projects, err = mc.AccessibleProjects(c.ctx, c.stores, c.coordinator.Authorizer, listReq, c.remoteAddr, projects); err != nil {
+			log.Errorf("Unable to list the projects for user %d: %s", c.user.ID, err)
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(c.out, "PROJECT\tUSED\tAVAILABLE\tQUOTA\tFILES\tDIRECTORIES\n"); err != nil {
+		return err
+	}
+
+	for _, project := range projects {
+		// Look up the project rather than using the one found by slug, which may be cached, since its
+		// size changes as files are written.
+		current, err := c.stores.ProjectStore.GetProjectByID(project.ID)
+		if err != nil {
+			log.Errorf("Unable to look up project %d for mc quota: %s", project.ID, err)
+			return err
+		}
+
+		quota := "none"
+		projectQuota := c.config.QuotaFor(current.Slug)
+		available := projectQuota - current.Size
+		if projectQuota > 0 {
+			quota = strconv.FormatInt(projectQuota, 10)
+		} else if available, err = mc.FreeSpace(c.mcfsRoot); err != nil {
+			log.Errorf("Unable to get free space for %s: %s", c.mcfsRoot, err)
+			return err
+		}
+
+		if available < 0 {
+			available = 0
+		}
+
+		_, err = fmt.Fprintf(c.out, "%s\t%d\t%d\t%s\t%d\t%d\n",
+			current.Slug, current.Size, available, quota, current.FileCount, current.DirectoryCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// userQuota writes the storage used, and the number of files, by the files the user uploaded in each
+// project, followed by the total across the projects, so that departments that charge back by uploader
+// can see what each user is charged for. Only the current version of each file is counted.
+func (c *command) userQuota() error {
+	if c.stores.UserUsageStore == nil {
+		return fmt.Errorf("per-user usage isn't available on this server")
+	}
+
+	usage, err := c.stores.UserUsageStore.GetUserUsage(c.user.ID)
+	if err != nil {
+		log.Errorf("Unable to get the storage used by user %d: %s", c.user.ID, err)
+		return err
+	}
+
+	if _, err := fmt.Fprintf(c.out, "PROJECT\tUSED\tFILES\n"); err != nil {
+		return err
+	}
+
+	var total mc.UserUsage
+	for _, u := range usage {
+		if _, err := fmt.Fprintf(c.out, "%s\t%d\t%d\n", u.ProjectSlug, u.Size, u.Files); err != nil {
+			return err
+		}
+		total.Size += u.Size
+		total.Files += u.Files
+	}
+
+	_, err = fmt.Fprintf(c.out, "TOTAL\t%d\t%d\n", total.Size, total.Files)
+	return err
+}
+
+// du writes the total size, and the number of files and directories, of the directory tree at path,
+// which starts with the project slug. The totals come from the file records, not from walking the
+// files in storage, so they are quick to compute for large trees. Sizes are in bytes. A path that is a
+// file reports the file's size.
+func (c *command) du(path string) error {
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxRead); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationList); err != nil {
+		return err
+	}
+
+	file, err := c.stores.FileStore.GetFileByPath(project.ID, projectPath)
+	if err != nil {
+		log.Errorf("Unable to find %s in project %d for mc du: %s", projectPath, project.ID, err)
+		return fmt.Errorf("'%s': %w", path, os.ErrNotExist)
+	}
+
+	usage := &mc.DirectoryUsage{Size: int64(file.Size), Files: 1}
+	if file.IsDir() {
+		if usage, err = c.stores.ListingStore.GetDirectoryUsage(project.ID, projectPath); err != nil {
+			log.Errorf("Unable to total up %s in project %d: %s", projectPath, project.ID, err)
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(c.out, "PATH\tSIZE\tFILES\tDIRECTORIES\n%s\t%d\t%d\t%d\n",
+		path, usage.Size, usage.Files, usage.Directories)
+	return err
+}
+
+// find writes the path of each file and directory in the tree at path, which starts with the project
+// slug, that matches the tests in args, one per line. The paths start with the project slug, so they can
+// be passed straight to scp or sftp. Like mc du, it uses the file records rather than walking the tree.
+func (c *command) find(path string, args []string) error {
+	query, err := mc.ParseFindQuery(args)
+	if err != nil {
+		return err
+	}
+
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxRead); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationList); err != nil {
+		return err
+	}
+
+	write := func(p string) error {
+		_, err := fmt.Fprintln(c.out, filepath.Join("/", project.Slug, p))
+		return err
+	}
+
+	file, err := c.stores.FileStore.GetFileByPath(project.ID, projectPath)
+	if err != nil {
+		log.Errorf("Unable to find %s in project %d for mc find: %s", projectPath, project.ID, err)
+		return fmt.Errorf("'%s': %w", path, os.ErrNotExist)
+	}
+
+	if !file.IsDir() {
+		if !query.Match(file) {
+			return nil
+		}
+		return write(projectPath)
+	}
+
+	return mc.FindFiles(c.stores, project.ID, projectPath, query, write)
+}
+
+// syncManifest writes the path, size, checksum and modification time of every file in the directory tree
+// at path, which starts with the project slug, in format. See mc.WriteSyncManifest.
+func (c *command) syncManifest(path, format string) error {
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxRead); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationList); err != nil {
+		return err
+	}
+
+	return mc.WriteSyncManifest(c.out, c.stores, project.ID, projectPath, format)
+}
+
+// bag assembles the directory tree at path, which starts with the project slug, into a BagIt bag in the
+// project's mc.BagExportsDir, and writes where the bag is and the size of its payload. See mc.CreateBag.
+func (c *command) bag(path string) error {
+	if c.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxRead); err != nil {
+		return err
+	}
+
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, mc.BagExportsDir, mc.DropBoxWrite); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationRead); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, mc.BagExportsDir, mc.OperationWrite); err != nil {
+		return err
+	}
+
+	bag, err := mc.CreateBag(c.stores, project, c.user, projectPath, time.Now(), c.mcfsRoot)
+	if err != nil {
+		log.Errorf("Unable to bag %s in project %d for user %d: %s", projectPath, project.ID, c.user.ID, err)
+		return err
+	}
+
+	log.Infof("User %d bagged %s in project %d into %s (%s)", c.user.ID, projectPath, project.ID, bag.Path, bag.PayloadOxum())
+	_, err = fmt.Fprintf(c.out, "BAG\tFILES\tBYTES\n%s\t%d\t%d\n", filepath.Join("/", project.Slug, bag.Path), bag.Files, bag.Bytes)
+	return err
+}
+
+// pull fetches the file at rawURL into path, which starts with the project slug, and writes the path,
+// size and checksum of the file created. The pull stops if the session ends. See mc.Puller.
+func (c *command) pull(rawURL, path string) error {
+	if c.puller == nil {
+		return fmt.Errorf("pulling from URLs isn't enabled on this server")
+	}
+
+	if c.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if strings.HasSuffix(path, "/") {
+		projectPath += "/"
+	}
+
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxWrite); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationWrite); err != nil {
+		return err
+	}
+
+	file, filePath, err := c.puller.Pull(c.ctx, c.stores, c.config, project, c.user.ID, rawURL, projectPath, c.mcfsRoot)
+
+	outcome := "ok"
+	if err != nil {
+		log.Errorf("Unable to pull %s into %s in project %d for user %d: %s", rawURL, projectPath, project.ID, c.user.ID, err)
+		outcome = err.Error()
+	}
+
+	event := mc.Event{
+		Type:      mc.EventPull,
+		Time:      time.Now(),
+		ProjectID: project.ID,
+		Path:      projectPath,
+		Details: map[string]string{
+			"user_id": strconv.Itoa(c.user.ID),
+			"url":     redactURL(rawURL),
+			"outcome": outcome,
+		},
+	}
+	if err == nil {
+		event.FileID, event.Path = file.ID, filePath
+	}
+	c.events.Emit(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(c.out, "PATH\tSIZE\tCHECKSUM\n%s\t%d\t%s\n", filepath.Join("/", project.Slug, filePath), file.Size, file.Checksum)
+	return err
+}
+
+// extract extracts the archive at archivePath, in the connection's scratch area, into the directory at
+// path, which starts with the project slug, and writes how many files were extracted. The archive itself
+// isn't added to the project. See mc.ExtractArchiveFile.
+func (c *command) extract(archivePath, path string) error {
+	if c.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	if !mc.IsArchive(archivePath) {
+		return fmt.Errorf("'%s' is not a zip, tar or gzipped tar archive: %w", archivePath, os.ErrInvalid)
+	}
+
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxWrite); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationWrite); err != nil {
+		return err
+	}
+
+	localPath, err := c.scratchFile(archivePath)
+	if err != nil {
+		return err
+	}
+
+	extracted, err := mc.ExtractArchiveFile(c.stores, c.coordinator.QuotaCounter, c.config, project, c.user.ID, localPath, filepath.Base(archivePath), projectPath, c.mcfsRoot)
+	if err != nil {
+		log.Errorf("Unable to extract %s into %s in project %d for user %d: %s", archivePath, projectPath, project.ID, c.user.ID, err)
+		return err
+	}
+
+	log.Infof("User %d extracted %d files from %s into %s in project %d", c.user.ID, extracted, archivePath, projectPath, project.ID)
+	_, err = fmt.Fprintf(c.out, "PATH\tFILES\n%s\t%d\n", filepath.Join("/", project.Slug, projectPath), extracted)
+	return err
+}
+
+// verifyManifest checks the files listed in the manifest at manifestPath, in the connection's scratch
+// area, against the files in the directory at path, which starts with the project slug, and writes the
+// results. Unlike an uploaded mc.ManifestFileName, no report is added to the project. See
+// mc.CheckManifest.
+func (c *command) verifyManifest(manifestPath, path string) error {
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return err
+	}
+
+	projectPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxRead); err != nil {
+		return err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationRead); err != nil {
+		return err
+	}
+
+	localPath, err := c.scratchFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.stores.FileStore.GetDirByPath(project.ID, projectPath); err != nil {
+		return fmt.Errorf("'%s': %w", path, os.ErrNotExist)
+	}
+
+	contents, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+
+	mc.CheckManifest(c.out, c.stores, project.ID, projectPath, contents, c.mcfsRoot)
+	return nil
+}
+
+// scratchFile returns where the file at path, which has to be in the connection's scratch area, is on
+// local disk.
+func (c *command) scratchFile(path string) (string, error) {
+	if c.scratch == nil {
+		return "", mc.ErrNoScratch
+	}
+
+	scratchPath, ok := mc.ParseScratchPath(path)
+	if !ok {
+		return "", fmt.Errorf("'%s' is not in /%s: %w", path, mc.ScratchDirName, os.ErrInvalid)
+	}
+
+	area, err := c.scratch()
+	if err != nil {
+		return "", err
+	}
+
+	localPath := area.Path(scratchPath)
+	if fi, err := os.Stat(localPath); err != nil || !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("'%s': %w", path, os.ErrNotExist)
+	}
+
+	return localPath, nil
+}
+
+// uploadOffset writes how much of the file being uploaded to path, which starts with the project slug and
+// is size bytes, is staged from an interrupted SCP upload, and the checksum of the staged data. Nothing
+// is staged when the offset is 0.
+func (c *command) uploadOffset(path, size string) error {
+	_, _, upload, err := c.stagedUpload(path, size)
+	if err != nil {
+		return err
+	}
+
+	offset, checksum := int64(0), mc.EmptyFileChecksum
+	if upload != nil {
+		offset, checksum = upload.Received, upload.PartialChecksum
+	}
+
+	_, err = fmt.Fprintf(c.out, "OFFSET\tCHECKSUM\n%d\t%s\n", offset, checksum)
+	return err
+}
+
+// uploadAppend continues the interrupted SCP upload of path, which starts with the project slug and is
+// size bytes, with the rest of the file read from the session's input, starting at offset. checksum is the
+// checksum of the first offset bytes of the client's copy, which has to be the checksum of the staged data.
+// It writes the path, size and checksum of the file once the whole file has been received. The upload is
+// checked and throttled the same as an SCP upload. See mc.ContinueUpload.
+func (c *command) uploadAppend(path, size, offsetArg, checksum string) error {
+	offset, err := strconv.ParseInt(offsetArg, 10, 64)
+	if err != nil || offset < 0 {
+		return fmt.Errorf("invalid offset '%s': %w", offsetArg, os.ErrInvalid)
+	}
+
+	project, projectPath, upload, err := c.stagedUpload(path, size)
+	switch {
+	case err != nil:
+		return err
+	case upload == nil:
+		return fmt.Errorf("no upload of '%s' is staged, upload the whole file: %w", path, os.ErrNotExist)
+	case !upload.Matches(upload.Size, c.user.ID, checksum):
+		return fmt.Errorf("unable to continue the upload of '%s', upload the whole file: %w", path, mc.ErrResumeChecksum)
+	}
+
+	if err := mc.ValidatePathLimits(projectPath, c.config); err != nil {
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	if err := c.waitForFinalizeCapacity(); err != nil {
+		log.Errorf("Throttled continued upload of %s by user %d: %s", projectPath, c.user.ID, err)
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	// Like an SCP upload, only one session at a time may write to the path.
+	if err := c.coordinator.PathLocker.Lock(project.ID, projectPath); err != nil {
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+	defer c.coordinator.PathLocker.Unlock(project.ID, projectPath)
+
+	if err := mc.CheckOverwrite(c.stores.FileStore, project, projectPath, c.config); err != nil {
+		log.Errorf("User %d attempted to overwrite %s in project %d: %s", c.user.ID, projectPath, project.ID, err)
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	if err := mc.CheckAdvisoryLock(c.coordinator.AdvisoryLocker, project.ID, projectPath, c.user.ID); err != nil {
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	quota := mc.NewQuotaReservation(c.coordinator.QuotaCounter, c.stores, c.config, project)
+	defer quota.Release()
+	if err := quota.Reserve(upload.Size - upload.Received); err != nil {
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	// The data is read through the ingest limiter, and counted as activity, the same as an SCP upload.
+	c.coordinator.Activity.SessionStarted(project.Slug, c.user.Slug)
+	defer c.coordinator.Activity.SessionEnded(project.Slug, c.user.Slug)
+	in := c.coordinator.Activity.NewReader(c.coordinator.IngestLimiter.NewReader(c.ctx, c.in), mc.TransferUpload, project.Slug, c.user.Slug)
+
+	file, err := mc.ContinueUpload(c.stores, upload, offset, in, c.mcfsRoot)
+	if err != nil {
+		log.Errorf("Unable to continue the upload of %s in project %d for user %d: %s", projectPath, project.ID, c.user.ID, err)
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	log.Infof("User %d continued the upload of %s in project %d from %d bytes", c.user.ID, projectPath, project.ID, offset)
+	_, err = fmt.Fprintf(c.out, "PATH\tSIZE\tCHECKSUM\n%s\t%d\t%s\n", path, file.Size, file.Checksum)
+	return err
+}
+
+// stagedUpload returns the project for path, which starts with the project slug, the path within the
+// project, and the upload the user staged for it with SCP when the file was size bytes, or nil if there
+// isn't one. The path is sanitized the same as for an SCP upload, so that it is the path the upload was
+// staged under.
+func (c *command) stagedUpload(path, size string) (*mcmodel.Project, string, *mc.ResumableUpload, error) {
+	if c.config.SCPResumeMinSize <= 0 || c.stores.ResumableUploadStore == nil {
+		return nil, "", nil, fmt.Errorf("continuing uploads isn't enabled on this server")
+	}
+
+	if c.config.ReadOnly {
+		return nil, "", nil, mc.ErrReadOnly
+	}
+
+	fileSize, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || fileSize < 0 {
+		return nil, "", nil, fmt.Errorf("invalid size '%s': %w", size, os.ErrInvalid)
+	}
+
+	project, err := mc.GetAndValidateProjectForClient(path, c.user.ID, c.remoteAddr, c.stores)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	projectPath, err := mc.SanitizePath(mc.RemoveProjectSlugFromPath(path, project.Slug), c.config.SanitizePolicy)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	if err := c.config.CheckDropBoxAccess(c.user.Slug, project.Slug, projectPath, mc.DropBoxWrite); err != nil {
+		return nil, "", nil, err
+	}
+
+	if err := c.authorize(project, projectPath, mc.OperationWrite); err != nil {
+		return nil, "", nil, err
+	}
+
+	upload, err := c.stores.ResumableUploadStore.GetResumableUpload(project.ID, projectPath)
+	if err != nil {
+		log.Errorf("Unable to look up the staged upload of %s in project %d: %s", projectPath, project.ID, err)
+		return nil, "", nil, err
+	}
+
+	// Like an SCP upload, only an upload of the same file by the same user is continued. Only
+	// uploadAppend is given the client's checksum of the start of the file, so it checks the checksum.
+	if upload == nil || !upload.Matches(fileSize, c.user.ID, upload.PartialChecksum) {
+		return project, projectPath, nil, nil
+	}
+
+	return project, projectPath, upload, nil
+}
+
+// waitForFinalizeCapacity waits, for up to the database timeout, for the backlog of uploads being finalized
+// to drop below its high water mark, like an SCP upload.
+func (c *command) waitForFinalizeCapacity() error {
+	ctx, cancel := context.WithTimeout(c.ctx, c.config.DBTimeout)
+	defer cancel()
+	return c.coordinator.WriteBackpressure.Wait(ctx)
+}
+
+// authorize asks the coordinator's Authorizer whether the user can do operation on path, a path within
+// project. See mc.Authorize.
+func (c *command) authorize(project *mcmodel.Project, path, operation string) error {
+	req := mc.NewAuthorizationRequest(c.config.Scopes, c.user, protocol, operation)
+	req.ProjectSlug, req.Path = project.Slug, path
+	return mc.Authorize(c.ctx, c.coordinator.Authorizer, req)
+}
+
+// redactURL returns rawURL with any password replaced, so that it can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,229 @@
+package mcproject
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/stretchr/testify/require"
+)
+
+// denyingAuthorizer denies everything in the secret project, and the paths under /private in any project.
+type denyingAuthorizer struct {
+	requests []mc.AuthorizationRequest
+}
+
+func (a *denyingAuthorizer) Authorize(_ context.Context, req mc.AuthorizationRequest) error {
+	a.requests = append(a.requests, req)
+	if req.ProjectSlug == "secret" || strings.HasPrefix(req.Path, "/private") {
+		return mc.ErrNotAuthorized
+	}
+
+	return nil
+}
+
+func newTestCommand(t *testing.T) (*command, *denyingAuthorizer, *bytes.Buffer) {
+	mcfsRoot := t.TempDir()
+	stores, err := mc.NewOfflineStores(mcfsRoot, 1, "demo", "secret")
+	require.NoError(t, err)
+
+	config := mc.DefaultConfig()
+	config.SCPResumeMinSize = 1
+
+	authorizer := &denyingAuthorizer{}
+	coordinator := mc.NewInMemoryCoordinator()
+	coordinator.Authorizer = authorizer
+
+	var out bytes.Buffer
+	return &command{
+		ctx:         context.Background(),
+		coordinator: coordinator,
+		puller:      mc.NewPuller(nil, coordinator.PathLocker),
+		stores:      stores,
+		events:      coordinator.Events,
+		config:      config,
+		mcfsRoot:    mcfsRoot,
+		user:        &mcmodel.User{ID: 1, Slug: "owner"},
+		remoteAddr:  &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222},
+		in:          strings.NewReader("data"),
+		out:         &out,
+	}, authorizer, &out
+}
+
+func TestCommandsAreAuthorized(t *testing.T) {
+	tests := []struct {
+		args      []string
+		operation string
+	}{
+		{[]string{"du", "/secret/raw"}, mc.OperationList},
+		{[]string{"find", "/secret/raw", "-name", "*.tif"}, mc.OperationList},
+		{[]string{"sync-manifest", "/secret/raw"}, mc.OperationList},
+		{[]string{"bag", "/secret/raw"}, mc.OperationRead},
+		{[]string{"pull", "https://example.com/a.dat", "/secret/raw/"}, mc.OperationWrite},
+		{[]string{"extract", "/tmp/a.zip", "/secret/raw"}, mc.OperationWrite},
+		{[]string{"verify-manifest", "/tmp/manifest.sha256", "/secret/raw"}, mc.OperationRead},
+		{[]string{"quota", "secret"}, mc.OperationList},
+		{[]string{"upload-offset", "/secret/a.dat", "4"}, mc.OperationWrite},
+		{[]string{"upload-append", "/secret/a.dat", "4", "0", mc.EmptyFileChecksum}, mc.OperationWrite},
+		{[]string{"token", "create", "/secret/raw", "read"}, mc.OperationRead},
+		{[]string{"project", "set-extract-paths", "secret", "/raw"}, mc.OperationWrite},
+	}
+
+	for _, test := range tests {
+		c, authorizer, out := newTestCommand(t)
+		err := c.run(test.args)
+		require.ErrorIs(t, err, mc.ErrNotAuthorized, "mc %s", strings.Join(test.args, " "))
+		require.Empty(t, out.String(), "mc %s", strings.Join(test.args, " "))
+
+		require.NotEmpty(t, authorizer.requests, "mc %s", strings.Join(test.args, " "))
+		req := authorizer.requests[0]
+		require.Equal(t, test.operation, req.Operation, "mc %s", strings.Join(test.args, " "))
+		require.Equal(t, protocol, req.Protocol)
+		require.Equal(t, "secret", req.ProjectSlug)
+		require.Equal(t, 1, req.UserID)
+	}
+}
+
+func TestQuotaListsAuthorizedProjects(t *testing.T) {
+	c, _, out := newTestCommand(t)
+
+	require.NoError(t, c.run([]string{"quota"}))
+	require.Contains(t, out.String(), "\ndemo\t")
+	require.NotContains(t, out.String(), "secret")
+}
+
+func TestDownloadsListsAuthorizedPaths(t *testing.T) {
+	c, _, out := newTestCommand(t)
+
+	require.NoError(t, c.stores.FileAccessStore.AddFileAccesses([]mc.FileAccess{
+		{FileID: 10, ProjectID: 1, Path: "/a.dat", Downloads: 2, LastAccessedAt: time.Now()},
+		{FileID: 11, ProjectID: 1, Path: "/private/b.dat", Downloads: 5, LastAccessedAt: time.Now()},
+	}))
+
+	require.NoError(t, c.run([]string{"project", "downloads", "demo"}))
+	require.Contains(t, out.String(), "/a.dat")
+	require.NotContains(t, out.String(), "/private/b.dat")
+}
+
+func TestExtractPaths(t *testing.T) {
+	c, _, out := newTestCommand(t)
+
+	require.NoError(t, c.run([]string{"project", "set-extract-paths", "demo", "/incoming/", "/raw/xrd"}))
+	require.NoError(t, c.run([]string{"project", "list-extract-paths", "demo"}))
+	require.Equal(t, "/incoming\n/raw/xrd\n", out.String())
+
+	require.Error(t, c.run([]string{"project", "set-extract-paths", "demo", "incoming"}), "Extract paths are absolute")
+
+	out.Reset()
+	require.NoError(t, c.run([]string{"project", "clear-extract-paths", "demo"}))
+	require.NoError(t, c.run([]string{"project", "list-extract-paths", "demo"}))
+	require.Empty(t, out.String())
+}
+
+func TestUploadAppend(t *testing.T) {
+	c, _, out := newTestCommand(t)
+	project, err := c.stores.ProjectStore.GetProjectBySlug("demo")
+	require.NoError(t, err)
+	dir, err := c.stores.FileStore.GetDirByPath(project.ID, "/")
+	require.NoError(t, err)
+
+	data := []byte("0123456789")
+	stage := func() {
+		file, err := c.stores.FileStore.CreateFile("a.dat", project.ID, dir.ID, c.user.ID, "text/plain")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(file.ToUnderlyingDirPath(c.mcfsRoot), 0755))
+		require.NoError(t, os.WriteFile(file.ToUnderlyingFilePath(c.mcfsRoot), data[:6], 0644))
+		require.NoError(t, c.stores.ResumableUploadStore.SaveResumableUpload(&mc.ResumableUpload{
+			ProjectID: project.ID, Path: "/a.dat", Size: int64(len(data)), Received: 6,
+			PartialChecksum: fmt.Sprintf("%x", md5.Sum(data[:6])), FileID: file.ID, File: file, OwnerID: c.user.ID,
+		}))
+	}
+	appendRest := func(checksum string) error {
+		c.in = bytes.NewReader(data[6:])
+		return c.run([]string{"upload-append", "/demo/a.dat", "10", "6", checksum})
+	}
+
+	// The staged data has to be the start of the client's copy.
+	stage()
+	require.ErrorIs(t, appendRest(fmt.Sprintf("%x", md5.Sum([]byte("abcdef")))), mc.ErrResumeChecksum)
+	require.Empty(t, out.String())
+
+	require.NoError(t, appendRest(fmt.Sprintf("%x", md5.Sum(data[:6]))))
+	require.Contains(t, out.String(), fmt.Sprintf("/demo/a.dat\t10\t%x", md5.Sum(data)))
+
+	// Like an SCP upload, a continued upload can't overwrite a file in a path that doesn't allow it.
+	out.Reset()
+	stage()
+	c.config.NoOverwritePaths = []mc.PathRule{{ProjectSlug: "demo", Prefix: "/"}}
+	require.ErrorIs(t, appendRest(fmt.Sprintf("%x", md5.Sum(data[:6]))), mc.ErrFileExists)
+	require.Empty(t, out.String())
+}
+
+func TestCreateToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(c *command)
+		path    string
+		wantErr error
+	}{
+		{"Project admin", func(c *command) {}, "/demo/raw", nil},
+		{"Path the authorizer denies", func(c *command) {}, "/demo/private/raw", mc.ErrNotAuthorized},
+		{
+			"Drop box account",
+			func(c *command) {
+				c.config.DropBoxes = map[string][]mc.PathRule{"owner": {{ProjectSlug: "demo", Prefix: "/raw"}}}
+			},
+			"/demo/raw",
+			mc.ErrDropBoxOnly,
+		},
+		{
+			"Token session",
+			func(c *command) {
+				c.user = &mcmodel.User{ID: 1, Slug: "token-5be0c41d9a2f"}
+				c.config.Scopes.Add(c.user.Slug, "owner", mc.Scope{Rule: mc.PathRule{ProjectSlug: "demo", Prefix: "/"}, Read: true, Write: true}, time.Now().Add(time.Hour))
+			},
+			"/demo/raw",
+			mc.ErrOutOfScope,
+		},
+		{
+			"Not a project admin",
+			func(c *command) {
+				c.user = &mcmodel.User{ID: 2, Slug: "member"}
+				project := &mcmodel.Project{ID: 1, Slug: "demo", OwnerID: 1}
+				require.NoError(t, c.stores.ProjectMemberStore.AddProjectMember(project, c.user, false))
+			},
+			"/demo/raw",
+			mc.ErrNotProjectAdmin,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, out := newTestCommand(t)
+			test.setup(c)
+
+			err := c.run([]string{"token", "create", test.path, mc.TokenWrite})
+			tokens, listErr := c.stores.TokenStore.ListTokens(c.user.ID)
+			require.NoError(t, listErr)
+
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				require.Empty(t, out.String())
+				require.Empty(t, tokens)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Contains(t, out.String(), "secret:")
+			require.Len(t, tokens, 1)
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package mcredis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// keyPrefix is prepended to all keys so that mc-sshd can share a Redis instance with other services.
+const keyPrefix = "mcsshd:"
+
+// instanceTTL is how long an instance is considered alive after its last heartbeat. The session counts
+// and quota reservations of an instance that stops, for example because it crashed, stop counting once
+// it has been gone for instanceTTL, and the path locks it held are released.
+const instanceTTL = 30 * time.Second
+
+// heartbeatInterval is how often an instance renews its heartbeat and the leases of the path locks it holds.
+const heartbeatInterval = instanceTTL / 3
+
+// NewCoordinator creates a mc.Coordinator whose state is stored in Redis, so that it is shared
+// by all mc-sshd instances using the same Redis server. The returned Heartbeat has to be run for as
+// long as the coordinator is used, otherwise the other instances treat this one as gone.
+func NewCoordinator(client *redis.Client) (*mc.Coordinator, *Heartbeat, error) {
+	instanceID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pathLocker := NewPathLocker(client)
+	coordinator := &mc.Coordinator{
+		PathLocker:     pathLocker,
+		SessionCounter: NewSessionCounter(client, instanceID),
+		QuotaCounter:   NewQuotaCounter(client, instanceID),
+		AdvisoryLocker: NewAdvisoryLocker(client),
+		Events:         mc.NewLogEventSink(),
+	}
+
+	return coordinator, &Heartbeat{client: client, instanceID: instanceID, pathLocker: pathLocker}, nil
+}
+
+// Heartbeat keeps an instance's state in Redis alive. The instance's session counts and quota
+// reservations only count while its heartbeat key exists, and its path locks are leases that expire
+// unless they are renewed.
+type Heartbeat struct {
+	client     *redis.Client
+	instanceID string
+	pathLocker *PathLocker
+}
+
+// Run renews the heartbeat and the path lock leases every heartbeatInterval until ctx is done.
+func (h *Heartbeat) Run(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		h.beat(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Heartbeat) beat(ctx context.Context) {
+	if err := h.client.Set(ctx, instanceKey(h.instanceID), 1, instanceTTL).Err(); err != nil {
+		log.Errorf("Failed renewing the heartbeat of instance %s: %s", h.instanceID, err)
+	}
+
+	h.pathLocker.renew(ctx)
+}
+
+// PathLocker implements mc.PathLocker using Redis. Each lock is a key that is set only if it doesn't
+// already exist. The value is a token unique to the lock holder so that Unlock can't release a lock
+// that has expired and been acquired by another writer. The key is a lease of instanceTTL, which the
+// instance's Heartbeat renews while the lock is held, so that the locks of an instance that stops are
+// released soon after.
+type PathLocker struct {
+	client *redis.Client
+
+	// tokens maps the lock key to the token that this instance set for it.
+	// If this were a map it would look like: map[string]string
+	tokens sync.Map
+}
+
+// unlockScript deletes the lock key only if it still holds the token this instance set.
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+func NewPathLocker(client *redis.Client) *PathLocker {
+	return &PathLocker{client: client}
+}
+
+// Lock attempts to acquire the write lock for path in the given project. It returns mc.ErrFileBusy
+// if another writer, on any instance, holds the lock.
+func (l *PathLocker) Lock(projectID int, path string) error {
+	key := pathLockKey(projectID, path)
+	token, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+
+	acquired, err := l.client.SetNX(context.Background(), key, token, instanceTTL).Result()
+	if err != nil {
+		log.Errorf("Failed acquiring redis lock %s: %s", key, err)
+		return err
+	}
+
+	if !acquired {
+		return mc.ErrFileBusy
+	}
+
+	l.tokens.Store(key, token)
+	return nil
+}
+
+// Unlock releases the write lock for path in the given project.
+func (l *PathLocker) Unlock(projectID int, path string) {
+	key := pathLockKey(projectID, path)
+	token, ok := l.tokens.LoadAndDelete(key)
+	if !ok {
+		return
+	}
+
+	if err := unlockScript.Run(context.Background(), l.client, []string{key}, token).Err(); err != nil {
+		log.Errorf("Failed releasing redis lock %s: %s", key, err)
+	}
+}
+
+// renew extends the leases of the locks this instance holds. A lock whose lease has already expired,
+// for example because Redis couldn't be reached for longer than instanceTTL, may have been taken by
+// another writer, so it is only logged.
+func (l *PathLocker) renew(ctx context.Context) {
+	l.tokens.Range(func(key, token interface{}) bool {
+		renewed, err := renewScript.Run(ctx, l.client, []string{key.(string)}, token, instanceTTL.Milliseconds()).Int()
+		switch {
+		case err != nil:
+			log.Errorf("Failed renewing redis lock %s: %s", key, err)
+		case renewed == 0:
+			log.Warnf("Redis lock %s expired while it was held", key)
+		}
+
+		return true
+	})
+}
+
+// countScript adds ARGV[2] to this instance's count, in the hash in KEYS[1] of the counts of each
+// instance, and renews this instance's heartbeat key, KEYS[2], for ARGV[3] milliseconds. An instance's
+// count is removed when it reaches zero, and when the instance's heartbeat key, ARGV[4] followed by the
+// instance's id, has expired. It returns the total of the counts of the instances that are alive. It
+// runs as a single step, so that a count can't be removed while another instance is changing it.
+var countScript = redis.NewScript(`
+redis.call("set", KEYS[2], "1", "PX", ARGV[3])
+if redis.call("hincrby", KEYS[1], ARGV[1], ARGV[2]) <= 0 then
+	redis.call("hdel", KEYS[1], ARGV[1])
+end
+
+local total = 0
+local counts = redis.call("hgetall", KEYS[1])
+for i = 1, #counts, 2 do
+	if redis.call("exists", ARGV[4] .. counts[i]) == 1 then
+		total = total + tonumber(counts[i + 1])
+	else
+		redis.call("hdel", KEYS[1], counts[i])
+	end
+end
+return total
+`)
+
+// addToCount adds n to the instance's count in key, and returns the total across the instances that
+// are alive. See countScript.
+func addToCount(ctx context.Context, client *redis.Client, key, instanceID string, n int64) (int64, error) {
+	keys := []string{key, instanceKey(instanceID)}
+	return countScript.Run(ctx, client, keys, instanceID, n, instanceTTL.Milliseconds(), instanceKey("")).Int64()
+}
+
+// SessionCounter implements mc.SessionCounter using Redis. Each instance keeps its own count of the
+// user's sessions, so that the sessions of an instance that stops without closing them stop counting
+// once its heartbeat expires.
+type SessionCounter struct {
+	client     *redis.Client
+	instanceID string
+}
+
+func NewSessionCounter(client *redis.Client, instanceID string) *SessionCounter {
+	return &SessionCounter{client: client, instanceID: instanceID}
+}
+
+// Increment adds a session for the user and returns the user's session count across all instances.
+func (c *SessionCounter) Increment(userID int) (int64, error) {
+	return addToCount(context.Background(), c.client, sessionCountKey(userID), c.instanceID, 1)
+}
+
+// Decrement removes a session for the user.
+func (c *SessionCounter) Decrement(userID int) {
+	if _, err := addToCount(context.Background(), c.client, sessionCountKey(userID), c.instanceID, -1); err != nil {
+		log.Errorf("Failed decrementing session count for user %d: %s", userID, err)
+	}
+}
+
+// QuotaCounter implements mc.QuotaCounter using Redis. Like SessionCounter, each instance keeps its own
+// count of the bytes reserved, so that the reservations of an instance that stops don't count against
+// the project once its heartbeat expires.
+type QuotaCounter struct {
+	client     *redis.Client
+	instanceID string
+}
+
+func NewQuotaCounter(client *redis.Client, instanceID string) *QuotaCounter {
+	return &QuotaCounter{client: client, instanceID: instanceID}
+}
+
+// AddBytes adds n bytes to the count for the project across all instances, and returns the new total.
+func (c *QuotaCounter) AddBytes(projectID int, n int64) (int64, error) {
+	return addToCount(context.Background(), c.client, quotaKey(projectID), c.instanceID, n)
+}
+
+// Bytes returns the number of bytes reserved in the project across all instances.
+func (c *QuotaCounter) Bytes(projectID int) (int64, error) {
+	return c.AddBytes(projectID, 0)
+}
+
+// AdvisoryLocker implements mc.AdvisoryLocker using Redis. Each lock is a key, holding the id of the
+// user that holds the lock, that expires after the lock's ttl.
+type AdvisoryLocker struct {
+	client *redis.Client
+}
+
+// advisoryLockScript sets the lock key if it doesn't exist or already belongs to the user. It returns
+// 1 if the lock was taken.
+var advisoryLockScript = redis.NewScript(`
+local holder = redis.call("get", KEYS[1])
+if holder == false or holder == ARGV[1] then
+	redis.call("set", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+func NewAdvisoryLocker(client *redis.Client) *AdvisoryLocker {
+	return &AdvisoryLocker{client: client}
+}
+
+// Lock takes, or extends, the user's lock on path for ttl. It returns mc.ErrFileLocked if another user
+// holds the lock.
+func (l *AdvisoryLocker) Lock(projectID int, path string, userID int, ttl time.Duration) error {
+	key := advisoryLockKey(projectID, path)
+	taken, err := advisoryLockScript.Run(context.Background(), l.client, []string{key}, userID, ttl.Milliseconds()).Int()
+	if err != nil {
+		log.Errorf("Failed taking advisory lock %s: %s", key, err)
+		return err
+	}
+
+	if taken == 0 {
+		return mc.ErrFileLocked
+	}
+
+	return nil
+}
+
+// Unlock releases the user's lock on path. It returns mc.ErrNotLocked if the user doesn't hold the lock.
+func (l *AdvisoryLocker) Unlock(projectID int, path string, userID int) error {
+	key := advisoryLockKey(projectID, path)
+	deleted, err := unlockScript.Run(context.Background(), l.client, []string{key}, strconv.Itoa(userID)).Int()
+	if err != nil {
+		log.Errorf("Failed releasing advisory lock %s: %s", key, err)
+		return err
+	}
+
+	if deleted == 0 {
+		return mc.ErrNotLocked
+	}
+
+	return nil
+}
+
+// LockHolder returns the user holding the lock on path.
+func (l *AdvisoryLocker) LockHolder(projectID int, path string) (int, bool, error) {
+	userID, err := l.client.Get(context.Background(), advisoryLockKey(projectID, path)).Int()
+	switch {
+	case err == redis.Nil:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	default:
+		return userID, true, nil
+	}
+}
+
+func advisoryLockKey(projectID int, path string) string {
+	return fmt.Sprintf("%sadvisory-lock:%d:%s", keyPrefix, projectID, path)
+}
+
+func pathLockKey(projectID int, path string) string {
+	return fmt.Sprintf("%slock:%d:%s", keyPrefix, projectID, path)
+}
+
+func sessionCountKey(userID int) string {
+	return fmt.Sprintf("%ssessions-by-instance:%d", keyPrefix, userID)
+}
+
+func quotaKey(projectID int) string {
+	return fmt.Sprintf("%squota-by-instance:%d", keyPrefix, projectID)
+}
+
+func instanceKey(instanceID string) string {
+	return fmt.Sprintf("%sinstance:%s", keyPrefix, instanceID)
+}
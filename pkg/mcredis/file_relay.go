@@ -0,0 +1,59 @@
+package mcredis
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apex/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// newFilesChannel is the Redis channel new files are published on.
+const newFilesChannel = keyPrefix + "new-files"
+
+// FileRelay implements mc.FileRelay with Redis pub/sub. Files are only passed to the instances that are
+// subscribed when they are published, which is all a watcher needs, since its cursors don't survive a
+// restart.
+type FileRelay struct {
+	client *redis.Client
+}
+
+func NewFileRelay(client *redis.Client) *FileRelay {
+	return &FileRelay{client: client}
+}
+
+func (r *FileRelay) Publish(file mc.NewFile) error {
+	b, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Publish(context.Background(), newFilesChannel, b).Err()
+}
+
+// Run adds the files published by every instance to watcher until ctx is done.
+func (r *FileRelay) Run(ctx context.Context, watcher *mc.FileWatcher) {
+	pubsub := r.client.Subscribe(ctx, newFilesChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var file mc.NewFile
+			if err := json.Unmarshal([]byte(message.Payload), &file); err != nil {
+				log.Errorf("Invalid new file published on %s: %s", newFilesChannel, err)
+				continue
+			}
+
+			watcher.Add(file)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package mcredis
+
+import (
+	"context"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/hashicorp/go-uuid"
+)
+
+// leaderKey holds the token of the mc-sshd instance that is the leader.
+const leaderKey = keyPrefix + "leader"
+
+// renewScript extends the leader lease only if it is still held by the token in ARGV[1].
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// LeaderElector implements mc.LeaderElector with a lease in Redis. The leader is the instance whose token
+// is in the lease key. The leader renews the lease well before ttl, so when the leader dies the lease
+// expires and a standby takes over within ttl.
+type LeaderElector struct {
+	client *redis.Client
+	token  string
+	ttl    time.Duration
+}
+
+func NewLeaderElector(client *redis.Client, ttl time.Duration) (*LeaderElector, error) {
+	token, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &LeaderElector{client: client, token: token, ttl: ttl}, nil
+}
+
+func (e *LeaderElector) TryAcquire(ctx context.Context) (bool, error) {
+	acquired, err := e.client.SetNX(ctx, leaderKey, e.token, e.ttl).Result()
+	if err != nil || acquired {
+		return acquired, err
+	}
+
+	renewed, err := renewScript.Run(ctx, e.client, []string{leaderKey}, e.token, e.ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return renewed == 1, nil
+}
+
+func (e *LeaderElector) Release() {
+	if err := unlockScript.Run(context.Background(), e.client, []string{leaderKey}, e.token).Err(); err != nil {
+		log.Errorf("Failed releasing leader lease %s: %s", leaderKey, err)
+	}
+}
@@ -0,0 +1,71 @@
+package mcredis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// CachingProjectStore wraps a store.ProjectStore and caches project lookups in Redis so that they are
+// shared across sessions and mc-sshd instances. Calls that aren't cached are passed straight through to
+// the wrapped store. Access checks are never cached, so that a user removed from a project loses access
+// straight away.
+type CachingProjectStore struct {
+	store.ProjectStore
+	client *redis.Client
+
+	// ttl is how long a cached entry is kept. Changes to a project won't be seen until the cached
+	// entry expires.
+	ttl time.Duration
+}
+
+func NewCachingProjectStore(projectStore store.ProjectStore, client *redis.Client, ttl time.Duration) *CachingProjectStore {
+	return &CachingProjectStore{
+		ProjectStore: projectStore,
+		client:       client,
+		ttl:          ttl,
+	}
+}
+
+// ProjectCacheMiddleware returns a mc.StoreMiddleware that wraps the ProjectStore in a CachingProjectStore.
+func ProjectCacheMiddleware(client *redis.Client, ttl time.Duration) mc.StoreMiddleware {
+	return mc.StoreMiddleware{
+		ProjectStore: func(projectStore store.ProjectStore) store.ProjectStore {
+			return NewCachingProjectStore(projectStore, client, ttl)
+		},
+	}
+}
+
+// GetProjectBySlug returns the cached project if there is one, otherwise it looks up the project
+// and caches it. Failed lookups aren't cached.
+func (s *CachingProjectStore) GetProjectBySlug(slug string) (*mcmodel.Project, error) {
+	key := fmt.Sprintf("%sproject:%s", keyPrefix, slug)
+	ctx := context.Background()
+
+	if val, err := s.client.Get(ctx, key).Bytes(); err == nil {
+		var project mcmodel.Project
+		if err := json.Unmarshal(val, &project); err == nil {
+			return &project, nil
+		}
+	}
+
+	project, err := s.ProjectStore.GetProjectBySlug(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if val, err := json.Marshal(project); err == nil {
+		if err := s.client.Set(ctx, key, val, s.ttl).Err(); err != nil {
+			log.Errorf("Failed caching project %s in redis: %s", slug, err)
+		}
+	}
+
+	return project, nil
+}
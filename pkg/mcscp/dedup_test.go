@@ -0,0 +1,40 @@
+package mcscp
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/charmbracelet/wish/scp"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMcfsHandler_DuplicateUploadKeepsExistingData(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := mc.NewOfflineStores(mcfsRoot, 1, "proj")
+	require.NoError(t, err)
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), mcfsRoot)
+	session := newFakeSshSession()
+
+	data := []byte("a,b,c\n")
+	for _, name := range []string{"first.csv", "second.csv"} {
+		entry := &scp.FileEntry{Name: name, Filepath: "/proj/" + name, Mode: 0644, Size: int64(len(data)), Reader: bytes.NewReader(data)}
+		_, err := handler.Write(session, entry)
+		require.NoError(t, err)
+	}
+
+	// second.csv now points at first.csv's data, so only second.csv's own copy is removed.
+	first, err := stores.FileStore.GetFileByPath(1, "/first.csv")
+	require.NoError(t, err)
+	second, err := stores.FileStore.GetFileByPath(1, "/second.csv")
+	require.NoError(t, err)
+	require.Equal(t, first.UUID, second.UsesUUID)
+
+	contents, err := os.ReadFile(first.ToUnderlyingFilePath(mcfsRoot))
+	require.NoError(t, err, "The existing file's data should not be removed")
+	require.Equal(t, data, contents)
+
+	_, err = os.Stat(second.ToUnderlyingFilePathForUUID(mcfsRoot))
+	require.True(t, os.IsNotExist(err), "The duplicate upload's own data should be removed")
+}
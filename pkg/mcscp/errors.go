@@ -0,0 +1,96 @@
+package mcscp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/wish/scp"
+	"github.com/gliderlabs/ssh"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// ErrorsMiddleware reports the failures of scp commands the way the scp client expects. The scp
+// middleware writes a failure to stderr and exits with 1, which the client shows as a protocol error.
+// Instead the failure is sent to the client as an scp error message, which it shows as
+// "scp: <message>", and the session exits with the mc.ExitStatus of the handler's error, so that a
+// script can tell, for example, a missing project from a full quota. It must come after scp.Middleware
+// in wish.WithMiddleware, so that it wraps it.
+func ErrorsMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		if !scp.GetInfo(s.Command()).Ok {
+			next(s)
+			return
+		}
+
+		next(&errorSession{Session: s})
+	}
+}
+
+// errorSession is the session given to the scp middleware by ErrorsMiddleware. It holds back what is
+// written to stderr, and the last error the handler returned (see mcfsHandler.localize), until the
+// session exits.
+type errorSession struct {
+	ssh.Session
+
+	mu     sync.Mutex
+	stderr bytes.Buffer
+	err    error
+}
+
+func (s *errorSession) Stderr() io.ReadWriter {
+	return &lockedBuffer{mu: &s.mu, buf: &s.stderr}
+}
+
+// fail records err as the reason the command failed.
+func (s *errorSession) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Exit sends the failure, if there was one, as an scp error message before exiting with its status.
+func (s *errorSession) Exit(code int) error {
+	if code == 0 {
+		return s.Session.Exit(0)
+	}
+
+	s.mu.Lock()
+	msg, err := strings.TrimSpace(s.stderr.String()), s.err
+	s.mu.Unlock()
+
+	if msg == "" && err != nil {
+		msg = err.Error()
+	}
+
+	if msg != "" {
+		// The message must be a single line, and starts with 1 so that the client shows it and fails.
+		_, _ = fmt.Fprintf(s.Session, "\x01scp: %s\n", strings.Join(strings.Fields(msg), " "))
+	}
+
+	if err != nil {
+		code = mc.ExitStatus(err)
+	}
+
+	return s.Session.Exit(code)
+}
+
+// lockedBuffer guards the writes to an errorSession's stderr.
+type lockedBuffer struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
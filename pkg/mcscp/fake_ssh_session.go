@@ -15,6 +15,9 @@ import (
 // were carried over from the ssh.Session interface definition.
 type fakeSSHSession struct {
 	c context.Context
+
+	// env is returned by Environ.
+	env []string
 }
 
 func newFakeSshSession() fakeSSHSession {
@@ -41,7 +44,7 @@ func (s fakeSSHSession) LocalAddr() net.Addr {
 // Environ returns a copy of strings representing the environment set by the
 // user for this session, in the form "key=value".
 func (s fakeSSHSession) Environ() []string {
-	return []string{}
+	return append([]string{}, s.env...)
 }
 
 // Exit sends an exit status and then closes the session.
@@ -1,14 +1,19 @@
 package mcscp
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/charmbracelet/wish"
 	"github.com/charmbracelet/wish/scp"
 	"github.com/gliderlabs/ssh"
 	"github.com/materials-commons/gomcdb/mcmodel"
@@ -22,10 +27,9 @@ import (
 //       have to load the project and the user. This is done by every method calling
 //       h.getSessionContext(). Because there is no guaranteed order that the callbacks will
 //       be called in, each callback calls this method. The getSessionContext will load the
-//       retrieve the SessionContext from the Session in the mcSessionContext key. If the project isn't
-//       already set in the SessionContext it will attempt to retrieve and set it. If there is an
-//       error it will mark an error in the SessionContext so that further attempts to retrieve the
-//       project for this session will fail.
+//       retrieve the SessionContext from the Session in the mcSessionContext key, and the project for
+//       the path the callback was given. The paths in a session can be in different projects, so the
+//       SessionContext caches each project, and each project that couldn't be loaded, by its slug.
 //
 //    2. The callbacks have to deal with the path. Path handling is special because the mcscp server needs
 //       to know the project that the user is writing to/reading from. The way this is handled is that the
@@ -41,8 +45,8 @@ import (
 //
 //       When this happens the callbacks will remove the project slug from the path, so that any files or
 //       directories that are accessed/created/read/written to use the path starting with /jpegs. This
-//       path handling is done in each routine by calling mc.RemoveProjectSlugFromPath(path, h.project.Slug)
-//       where path is the original path (eg /my-project/jpegs/file.jpg), and h.project.Slug is the project
+//       path handling is done in each routine by calling mc.RemoveProjectSlugFromPath(path, project.Slug)
+//       where path is the original path (eg /my-project/jpegs/file.jpg), and project.Slug is the project
 //       slug to remove from the path (in this case 'my-project').
 //
 //    3. Each Materials Commons user also has a unique user slug. This is derived from the users email
@@ -57,12 +61,21 @@ type mcfsHandler struct {
 	// This is the root where files get stored in Materials Commons. This path is needed for creating
 	// or reading existing files (eg calls like os.Open).
 	mcfsRoot string
+
+	// coordinator holds the state shared with the SFTP handler, such as the write locks that prevent
+	// two sessions from writing to the same path at the same time.
+	coordinator *mc.Coordinator
+
+	// config holds the deployment configurable settings, such as timeouts.
+	config *mc.Config
 }
 
-func NewMCFSHandler(stores *mc.Stores, mcfsRoot string) scp.Handler {
+func NewMCFSHandler(stores *mc.Stores, coordinator *mc.Coordinator, config *mc.Config, mcfsRoot string) scp.Handler {
 	return &mcfsHandler{
-		stores:   stores,
-		mcfsRoot: mcfsRoot,
+		stores:      stores,
+		coordinator: coordinator,
+		config:      config,
+		mcfsRoot:    mcfsRoot,
 	}
 }
 
@@ -78,26 +91,37 @@ func (h *mcfsHandler) Glob(_ ssh.Session, pattern string) ([]string, error) {
 
 // WalkDir implements directory walking for SCP. It is heavily based on filepath.WalkDir and modified to
 // work with Materials Commons.
-func (h *mcfsHandler) WalkDir(s ssh.Session, path string, fn fs.WalkDirFunc) error {
+func (h *mcfsHandler) WalkDir(s ssh.Session, path string, fn fs.WalkDirFunc) (err error) {
+	defer func() { err = h.localize(s, err) }()
+
 	var (
-		err error
-		sc  *SessionContext
+		sc      *SessionContext
+		project *mcmodel.Project
 	)
-	if sc, err = h.getSessionContext(s, path); err != nil {
+	if sc, project, err = h.getSessionContext(s, path); err != nil {
+		return err
+	}
+
+	cleanedPath := mc.RemoveProjectSlugFromPath(path, project.Slug)
+	if err := h.checkDropBox(sc, project, cleanedPath, mc.DropBoxRead); err != nil {
 		return err
 	}
 
-	cleanedPath := mc.RemoveProjectSlugFromPath(path, sc.project.Slug)
+	if err := h.authorize(s, sc, project, cleanedPath, mc.OperationList); err != nil {
+		return err
+	}
 
 	// Get the initial directory
-	d, err := h.stores.FileStore.GetDirByPath(sc.project.ID, cleanedPath)
+	stores, cancel := h.storesWithTimeout(s.Context(), sc)
+	d, err := stores.FileStore.GetDirByPath(project.ID, cleanedPath)
+	cancel()
 	if err != nil {
 		// If there was an error then pass the error to the callback (for whatever processing it
 		// will do.
-		err = fn(cleanedPath, nil, err)
+		err = fn(path, nil, err)
 	} else {
 		// No error, so begin walking the directory we just loaded.
-		err = h.walkDir(cleanedPath, d.ToDirEntry(), sc, fn)
+		err = h.walkDir(s.Context(), sc, cleanedPath, d.ToDirEntry(), project, fn)
 	}
 
 	if err == filepath.SkipDir {
@@ -108,9 +132,15 @@ func (h *mcfsHandler) WalkDir(s ssh.Session, path string, fn fs.WalkDirFunc) err
 }
 
 // walkDir is where the actual recursive calls happen for directory walking.
-func (h *mcfsHandler) walkDir(path string, d fs.DirEntry, sc *SessionContext, fn fs.WalkDirFunc) error {
+// Each directory listing gets its own database timeout, as the walk as a whole can take an
+// arbitrary amount of time. The path is the path in the project. The callback is given the
+// path with the project slug, since it passes the path back to NewDirEntry or NewFileEntry,
+// which look up the project from the path.
+func (h *mcfsHandler) walkDir(ctx context.Context, sc *SessionContext, path string, d fs.DirEntry, project *mcmodel.Project, fn fs.WalkDirFunc) error {
+	slugPath := filepath.Join("/", project.Slug, path)
+
 	// Directory that was just loaded, so pass to callback and see what it does.
-	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+	if err := fn(slugPath, d, nil); err != nil || !d.IsDir() {
 		if err == filepath.SkipDir && d.IsDir() {
 			// Skipped directory
 			err = nil
@@ -120,10 +150,12 @@ func (h *mcfsHandler) walkDir(path string, d fs.DirEntry, sc *SessionContext, fn
 	}
 
 	// If we are here then its time to list the directory contents and start processing them.
-	dirs, err := h.stores.FileStore.ListDirectoryByPath(sc.project.ID, path)
+	stores, cancel := h.storesWithTimeout(ctx, sc)
+	dirs, err := stores.FileStore.ListDirectoryByPath(project.ID, path)
+	cancel()
 	if err != nil {
-		log.Errorf("Failure find path %q in project %d: %s", path, sc.project.ID, err)
-		err = fn(path, d, err)
+		log.Errorf("Failure find path %q in project %d: %s", path, project.ID, err)
+		err = fn(slugPath, d, err)
 		if err != nil {
 			return err
 		}
@@ -133,7 +165,7 @@ func (h *mcfsHandler) walkDir(path string, d fs.DirEntry, sc *SessionContext, fn
 	for _, dir := range dirs {
 		p := filepath.Join(path, dir.Name)
 		dirEntry := dir.ToDirEntry()
-		if err := h.walkDir(p, dirEntry, sc, fn); err != nil {
+		if err := h.walkDir(ctx, sc, p, dirEntry, project, fn); err != nil {
 			if err == filepath.SkipDir {
 				break
 			}
@@ -147,26 +179,48 @@ func (h *mcfsHandler) walkDir(path string, d fs.DirEntry, sc *SessionContext, fn
 // NewDirEntry creates a new directory entry to send back to the client where it will be (if needed) created.
 // The directory needs to exist in Materials Commons. NewDirEntry doesn't create directories on the server
 // it sends back existing directories to the client.
-func (h *mcfsHandler) NewDirEntry(s ssh.Session, name string) (*scp.DirEntry, error) {
+func (h *mcfsHandler) NewDirEntry(s ssh.Session, name string) (_ *scp.DirEntry, err error) {
+	defer func() { err = h.localize(s, err) }()
+
 	var (
-		err error
-		sc  *SessionContext
+		sc      *SessionContext
+		project *mcmodel.Project
 	)
-	if sc, err = h.getSessionContext(s, name); err != nil {
+	if sc, project, err = h.getSessionContext(s, name); err != nil {
+		return nil, err
+	}
+
+	path := mc.RemoveProjectSlugFromPath(name, project.Slug)
+	if err := h.checkDropBox(sc, project, path, mc.DropBoxRead); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(s, sc, project, path, mc.OperationList); err != nil {
 		return nil, err
 	}
 
-	path := mc.RemoveProjectSlugFromPath(name, sc.project.Slug)
-	dir, err := h.stores.FileStore.GetDirByPath(sc.project.ID, path)
+	stores, cancel := h.storesWithTimeout(s.Context(), sc)
+	defer cancel()
+
+	dir, err := stores.FileStore.GetDirByPath(project.ID, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open dir '%s' for project %d: %s", path, sc.project.ID, err)
+		log.Errorf("Unable to find dir %q in project %d: %s", path, project.ID, err)
+		return nil, fmt.Errorf("failed to open dir '%s' for project %d: %w", path, project.ID, os.ErrNotExist)
+	}
+
+	// The project root is named after the project, so scp -r mc-user@materialscommons.org:/my-project .
+	// creates a my-project directory on the client.
+	dirName := filepath.Base(path)
+	if path == "/" {
+		dirName = project.Slug
 	}
 
+	_, dirMode := h.config.FileModes(project.Slug, sc.user.Slug)
 	return &scp.DirEntry{
 		Children: []scp.Entry{},
-		Name:     filepath.Base(path),
+		Name:     dirName,
 		Filepath: path,
-		Mode:     0777,
+		Mode:     dirMode,
 		Mtime:    dir.UpdatedAt.Unix(),
 		Atime:    dir.UpdatedAt.Unix(),
 	}, nil
@@ -176,37 +230,116 @@ func (h *mcfsHandler) NewDirEntry(s ssh.Session, name string) (*scp.DirEntry, er
 // Materials Commons this means locating the real file by it's UUID (file.ToUnderlyingFilePath(mcfsRoot)),
 // and using os.Open to read it. NewFileEntry doesn't create a file on the server. It sends back to the
 // client an existing file.
-func (h *mcfsHandler) NewFileEntry(s ssh.Session, name string) (*scp.FileEntry, func() error, error) {
+func (h *mcfsHandler) NewFileEntry(s ssh.Session, name string) (_ *scp.FileEntry, _ func() error, err error) {
+	defer func() { err = h.localize(s, err) }()
+	started := time.Now()
+
 	var (
-		err error
-		sc  *SessionContext
+		sc      *SessionContext
+		project *mcmodel.Project
 	)
-	if sc, err = h.getSessionContext(s, name); err != nil {
+	if sc, project, err = h.getSessionContext(s, name); err != nil {
 		return nil, nil, err
 	}
 
-	path := mc.RemoveProjectSlugFromPath(name, sc.project.Slug)
-	file, err := h.stores.FileStore.GetFileByPath(sc.project.ID, path)
-	if err != nil {
-		log.Errorf("Unable to find file %q in project %d: %s", path, sc.project.ID, err)
-		return nil, nil, fmt.Errorf("unable to find file '%s' in project %d: %s", path, sc.project.ID, err)
+	path := mc.RemoveProjectSlugFromPath(name, project.Slug)
+	if err := h.checkDropBox(sc, project, path, mc.DropBoxRead); err != nil {
+		return nil, nil, err
+	}
+
+	if err := h.authorize(s, sc, project, path, mc.OperationRead); err != nil {
+		return nil, nil, err
 	}
 
-	f, err := os.Open(file.ToUnderlyingFilePath(h.mcfsRoot))
+	stores, cancel := h.storesWithTimeout(s.Context(), sc)
+	defer cancel()
+
+	file, err := stores.FileStore.GetFileByPath(project.ID, path)
 	if err != nil {
-		log.Errorf("Failed to open file %q: %s", path, err)
-		return nil, nil, fmt.Errorf("failed to open %q: %w", path, err)
+		log.Errorf("Unable to find file %q in project %d: %s", path, project.ID, err)
+		return nil, nil, fmt.Errorf("unable to find file '%s' in project %d: %w", path, project.ID, os.ErrNotExist)
+	}
+
+	if file.IsDir() {
+		// This includes the project root, eg scp mc-user@materialscommons.org:/my-project/ .
+		return nil, nil, fmt.Errorf("'%s' in project %d is a directory, use scp -r to copy directories", path, project.ID)
 	}
 
+	download := mc.Transfer{
+		Direction: mc.TransferDownload,
+		Protocol:  "scp",
+		UserID:    sc.user.ID,
+		ProjectID: project.ID,
+		Path:      path,
+	}
+
+	// For scp -r every file in the tree is given to the client before any of them are sent, so the file
+	// is only opened when it is read. On a satellite server opening it may mean fetching the file data
+	// from the primary site first.
+	fileData := mc.NewLazyReader(func() (io.ReadCloser, error) {
+		if err := h.coordinator.RemoteFiles.Ensure(file); err != nil {
+			return nil, fmt.Errorf("unable to fetch '%s': %w", path, err)
+		}
+
+		var f *os.File
+		err := mc.RunWithTimeout(s.Context(), h.config.FSTimeout, func() error {
+			var err error
+			f, err = os.Open(file.ToUnderlyingFilePath(h.mcfsRoot))
+			return err
+		})
+
+		if err != nil {
+			log.Errorf("Failed to open file %q: %s", path, err)
+			if errors.Is(err, os.ErrNotExist) {
+				// The file exists, but its data doesn't. The stores bound to the request may have
+				// timed out by the time the file is read.
+				err = mc.ReportMissingData(h.stores, h.coordinator.Events, file, download)
+				h.coordinator.Repairer.Queue(file)
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to open %q: %w", path, err)
+		}
+
+		return f, nil
+	})
+
+	// Downloads are read sequentially, so the next chunk is read from storage while the current one is
+	// sent to the client. The session's pipeline also starts reading the next few files, so that trees of
+	// small files aren't read one file at a time.
+	var reader io.Reader = mc.NewTimeoutReader(s.Context(), h.config.FSTimeout, fileData)
+	closeFile := fileData.Close
+	if h.config.ReadAheadSize > 0 {
+		chunkSize := h.config.ReadAheadSize
+		if file.Size < uint64(chunkSize) {
+			// A chunk one byte larger than the file also reads the end of the file.
+			chunkSize = int(file.Size) + 1
+		}
+
+		prefetch := mc.NewPrefetchReader(reader, chunkSize)
+		sc.prefetch.Add(prefetch)
+		reader = prefetch
+		closeFile = func() error {
+			_ = prefetch.Close()
+			return fileData.Close()
+		}
+	}
+
+	// The data is checked against the file's checksum as it is sent.
+	reader = mc.NewChecksumVerifier(h.config.VerifyReads, file, h.coordinator.Events, download).NewReader(reader)
+	download.Timing = &mc.TransferTiming{Auth: sc.authDuration, Resolve: time.Since(started)}
+
+	fileMode, _ := h.config.FileModes(project.Slug, sc.user.Slug)
 	return &scp.FileEntry{
 		Name:     file.Name,
 		Filepath: path,
-		Mode:     0777,
+		Mode:     fileMode,
 		Size:     int64(file.Size),
 		Mtime:    file.UpdatedAt.Unix(),
-		Atime:    file.UpdatedAt.Unix(),
-		Reader:   f,
-	}, f.Close, nil
+		Atime:    mc.AccessTime(h.config, h.coordinator.FileAccess, file).Unix(),
+		Reader: h.coordinator.FileAccess.NewReader(h.coordinator.Transfers.NewReader(
+			h.coordinator.Activity.NewReader(reader, mc.TransferDownload, project.Slug, sc.user.Slug),
+			download), project.ID, file.ID, path),
+	}, closeFile, nil
 }
 
 // Implement Mkdir and Write for the scp.CopyFromClientHandler interface
@@ -215,19 +348,50 @@ func (h *mcfsHandler) NewFileEntry(s ssh.Session, name string) (*scp.FileEntry,
 // called when a recursive upload is specified. So the Write() callback also needs
 // to handle directory creation for individual files that are being written to a
 // directory that doesn't exist.
-func (h *mcfsHandler) Mkdir(s ssh.Session, entry *scp.DirEntry) error {
+func (h *mcfsHandler) Mkdir(s ssh.Session, entry *scp.DirEntry) (err error) {
+	defer func() { err = h.localize(s, err) }()
+
 	var (
-		err error
-		sc  *SessionContext
+		sc      *SessionContext
+		project *mcmodel.Project
 	)
-	if sc, err = h.getSessionContext(s, entry.Filepath); err != nil {
+	if sc, project, err = h.getSessionContext(s, entry.Filepath); err != nil {
 		return err
 	}
 
-	path := mc.RemoveProjectSlugFromPath(entry.Filepath, sc.project.Slug)
+	if h.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	stores, cancel := h.storesWithTimeout(s.Context(), sc)
+	defer cancel()
+
+	// Directories under a mc.TaggedDirName are created without it, the tags only apply to files.
+	path, _ := mc.ParseTaggedPath(mc.RemoveProjectSlugFromPath(entry.Filepath, project.Slug))
+	path, err = mc.SanitizePath(path, h.config.SanitizePolicy)
+	if err != nil {
+		return fmt.Errorf("unable to create dir: %w", err)
+	}
 
-	if _, err := h.stores.FileStore.GetOrCreateDirPath(sc.project.ID, sc.user.ID, path); err != nil {
-		return fmt.Errorf("unable to find dir '%s' for project %d: %s", path, sc.project.ID, err)
+	if err := h.checkDropBox(sc, project, path, mc.DropBoxWrite); err != nil {
+		return err
+	}
+
+	if err := h.authorize(s, sc, project, path, mc.OperationWrite); err != nil {
+		return err
+	}
+
+	if sc.ignoreList.IsIgnored(path) {
+		// Nothing to create, and any files written into the directory will also be ignored.
+		return nil
+	}
+
+	if err := mc.ValidatePathLimits(path, h.config); err != nil {
+		return fmt.Errorf("unable to create dir '%s': %w", path, err)
+	}
+
+	if _, err := sc.dirs.ProjectDir(stores.FileStore, project.ID, sc.user.ID, path); err != nil {
+		return fmt.Errorf("unable to find dir '%s' for project %d: %s", path, project.ID, err)
 	}
 
 	return nil
@@ -239,48 +403,164 @@ func (h *mcfsHandler) Mkdir(s ssh.Session, entry *scp.DirEntry) error {
 // including version handling, only storing files once that share the same checksum (and instead pointing
 // at these previously uploaded files), potentially creating a web version of the file for viewing on
 // the web, updating project statistics, etc... Read the comments in the method to see the details.
-func (h *mcfsHandler) Write(s ssh.Session, entry *scp.FileEntry) (int64, error) {
+func (h *mcfsHandler) Write(s ssh.Session, entry *scp.FileEntry) (_ int64, err error) {
+	defer func() { err = h.localize(s, err) }()
+
 	var (
-		err  error
-		dir  *mcmodel.File
-		file *mcmodel.File
-		sc   *SessionContext
+		dir     *mcmodel.File
+		file    *mcmodel.File
+		sc      *SessionContext
+		project *mcmodel.Project
 	)
 
-	if sc, err = h.getSessionContext(s, entry.Filepath); err != nil {
+	if sc, project, err = h.getSessionContext(s, entry.Filepath); err != nil {
 		return 0, err
 	}
 
+	if h.config.ReadOnly {
+		return 0, mc.ErrReadOnly
+	}
+
 	// After writing the file if we determine that a file matching its checksum already exists then
 	// we can delete the file just written (because we updated the file in the database to point at
 	// the file with the matching checksum). Assume this is not the case, but if a matching file is
 	// found then Write will set deleteFile to true. The defer method to close the opened file will
 	// then take care of deleting the file since a version with that checksum already exists.
 	deleteFile := false
+	started := time.Now()
+
+	// Files uploaded into a mc.TaggedDirName are stored without it, and given its tags.
+	path, tags := mc.ParseTaggedPath(mc.RemoveProjectSlugFromPath(entry.Filepath, project.Slug))
+	path, err = mc.SanitizePath(path, h.config.SanitizePolicy)
+	if err != nil {
+		return 0, fmt.Errorf("unable to write file: %w", err)
+	}
+
+	if err := h.checkDropBox(sc, project, path, mc.DropBoxWrite); err != nil {
+		return 0, err
+	}
+
+	if err := h.authorize(s, sc, project, path, mc.OperationWrite); err != nil {
+		return 0, err
+	}
+
+	if path == "/" {
+		// The project root can't be written to as a file. Files uploaded into the root, with a target
+		// such as /my-project or /my-project/, have a path of /<file name>.
+		return 0, fmt.Errorf("unable to write file: '%s' is the project root", entry.Filepath)
+	}
+
+	// The name can be different from name when the path was sanitized.
+	name := filepath.Base(path)
+
+	if sc.ignoreList.IsIgnored(path) {
+		// Ignored files are silently skipped. The file contents still have to be read so that the
+		// client can move on to the next file.
+		return io.Copy(io.Discard, entry.Reader)
+	}
+
+	if err := mc.ValidatePathLimits(path, h.config); err != nil {
+		return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	if err := h.waitForFinalizeCapacity(s.Context()); err != nil {
+		log.Errorf("Throttled write of %s by user %d: %s", path, sc.user.ID, err)
+		return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	// Only one session at a time may write to a path. Hold the lock until the file has been
+	// completely written and finalized.
+	if err := h.coordinator.PathLocker.Lock(project.ID, path); err != nil {
+		log.Errorf("User %d attempted to write to %s in project %d while it was being written: %s", sc.user.ID, path, project.ID, err)
+		return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+	defer h.coordinator.PathLocker.Unlock(project.ID, path)
 
-	path := mc.RemoveProjectSlugFromPath(entry.Filepath, sc.project.Slug)
+	// The database calls made before the data is copied share one timeout. The copy can take an
+	// arbitrary amount of time, so the calls made after it get their own timeout.
+	stores, cancel := h.storesWithTimeout(s.Context(), sc)
+	defer cancel()
+
+	if err := mc.CheckOverwrite(stores.FileStore, project, path, h.config); err != nil {
+		log.Errorf("User %d attempted to overwrite %s in project %d: %s", sc.user.ID, path, project.ID, err)
+		return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	if err := mc.CheckAdvisoryLock(h.coordinator.AdvisoryLocker, project.ID, path, sc.user.ID); err != nil {
+		log.Errorf("User %d attempted to write %s in project %d: %s", sc.user.ID, path, project.ID, err)
+		return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	// SCP sends the size of the file up front, so room for all of it is reserved before it is received.
+	quota := mc.NewQuotaReservation(h.coordinator.QuotaCounter, sc.stores, h.config, project)
+	defer quota.Release()
+	if err := quota.Reserve(entry.Size); err != nil {
+		log.Errorf("User %d attempted to write %s in project %d: %s", sc.user.ID, path, project.ID, err)
+		return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
 
 	// First steps - Find or create the directories in the path
-	if dir, err = h.stores.FileStore.GetOrCreateDirPath(sc.project.ID, sc.user.ID, filepath.Dir(path)); err != nil {
-		return 0, fmt.Errorf("unable to find dir '%s' for project %d: %s", filepath.Dir(path), sc.project.ID, err)
+	if dir, err = sc.dirs.ProjectDir(stores.FileStore, project.ID, sc.user.ID, filepath.Dir(path)); err != nil {
+		return 0, fmt.Errorf("unable to find dir '%s' for project %d: %s", filepath.Dir(path), project.ID, err)
 	}
 
-	// Create a file that isn't set as current. This way the file doesn't show up until it's
-	// data has been written.
-	if file, err = h.stores.FileStore.CreateFile(entry.Name, sc.project.ID, dir.ID, sc.user.ID, mc.GetMimeType(entry.Name)); err != nil {
-		log.Errorf("Error creating file %s in project %d, in directory %d for user %d: %s", entry.Name, sc.project.ID, dir.ID, sc.user.ID, err)
-		return 0, fmt.Errorf("unable to create file '%s' in dir %d for project %d: %s", entry.Name, dir.ID, sc.project.ID, err)
+	// Continue an interrupted upload of the same file if one was staged. Otherwise create a file that
+	// isn't set as current. This way the file doesn't show up until it's data has been written.
+	// The data is read through the ingest limiter, and counted as activity, whether or not it's written.
+	upload := h.coordinator.Activity.NewReader(h.coordinator.IngestLimiter.NewReader(s.Context(), entry.Reader), mc.TransferUpload, project.Slug, sc.user.Slug)
+
+	resume := h.resumableUpload(stores, project.ID, path, entry.Size, sc.user.ID)
+	if resume == nil && name != mc.MCIgnoreFileName && name != mc.ManifestFileName && h.config.DedupEnabled(project.Slug) {
+		var current *mcmodel.File
+		if current, upload, err = h.precheckUnchanged(stores, project.ID, path, entry.Size, upload); err != nil {
+			return 0, fmt.Errorf("unable to write '%s': %w", path, err)
+		}
+
+		if current != nil {
+			// The upload's tags still apply to the file it matched.
+			log.Infof("Skipped upload of %s in project %d by user %d, it is the same as the current version", path, project.ID, sc.user.ID)
+			mc.TagUploadedFile(stores.TagStore, current, append(tags, sc.env.UploadTag)...)
+			return entry.Size, nil
+		}
+	}
+
+	if resume != nil {
+		file = resume.File
+		log.Infof("Resuming upload of %s in project %d by user %d from %d bytes", path, project.ID, sc.user.ID, resume.Received)
+	} else if file, err = stores.FileStore.CreateFile(name, project.ID, dir.ID, sc.user.ID, mc.GetMimeType(name)); err != nil {
+		log.Errorf("Error creating file %s in project %d, in directory %d for user %d: %s", name, project.ID, dir.ID, sc.user.ID, err)
+		return 0, fmt.Errorf("unable to create file '%s' in dir %d for project %d: %s", name, dir.ID, project.ID, err)
+	} else if err := stores.PendingFileStore.SetExpectedSize(file, entry.Size); err != nil {
+		// Without the size a file left pending by a crash is expunged rather than completed.
+		log.Errorf("Unable to record the size of file %d: %s", file.ID, err)
 	}
 
 	// Create the directory path where the file will be written to
-	if err := os.MkdirAll(file.ToUnderlyingDirPath(h.mcfsRoot), 0777); err != nil {
+	if err = sc.dirs.StorageDir(s.Context(), h.config.FSTimeout, file.ToUnderlyingDirPath(h.mcfsRoot)); err != nil {
 		log.Errorf("Error creating directory path %s: %s", file.ToUnderlyingDirPath(h.mcfsRoot), err)
+		_ = mc.AbortFile(stores, file, h.mcfsRoot)
 		return 0, err
 	}
 
-	f, err := os.OpenFile(file.ToUnderlyingFilePath(h.mcfsRoot), os.O_TRUNC|os.O_RDWR|os.O_CREATE, entry.Mode)
+	var (
+		f      *os.File
+		staged int64
+	)
+
+	flags := os.O_TRUNC | os.O_RDWR | os.O_CREATE
+	if resume != nil {
+		flags, staged = os.O_RDWR, resume.Received
+	}
+
+	err = mc.RunWithTimeout(s.Context(), h.config.FSTimeout, func() error {
+		var err error
+		f, err = os.OpenFile(file.ToUnderlyingFilePath(h.mcfsRoot), flags, entry.Mode)
+		return err
+	})
+
 	if err != nil {
 		log.Errorf("Failed to open file %d path '%s': %s", file.ID, file.ToUnderlyingFilePath(h.mcfsRoot), err)
+		_ = mc.AbortFile(stores, file, h.mcfsRoot)
 		return 0, fmt.Errorf("failed to open file %d path '%s': %s", file.ID, file.ToUnderlyingFilePath(h.mcfsRoot), err)
 	}
 
@@ -294,78 +574,377 @@ func (h *mcfsHandler) Write(s ssh.Session, entry *scp.FileEntry) (int64, error)
 		if deleteFile {
 			// A file matching this file's checksum already exists in the system so delete the file we just
 			// uploaded. See the call to h.stores.FileStore.PointAtExistingIfExists towards the end of this method.
-			_ = os.Remove(file.ToUnderlyingFilePath(h.mcfsRoot))
+			// The file now points at the matching file's data, so its own data is found by its UUID.
+			_ = os.Remove(file.ToUnderlyingFilePathForUUID(h.mcfsRoot))
 		}
 	}()
 
 	// Each file in Materials Commons has a checksum associated with it. Create a TeeReader so that as the stream of
 	// bytes is read it goes to two separate destinations. One is the file we just opened, and the second is the hasher
 	// that is computing the hash.
+	// The time spent hashing is measured for the transfer's timing.
 	hasher := md5.New()
-	teeReader := io.TeeReader(entry.Reader, hasher)
+	hashTimer := &mc.TimedWriter{Writer: hasher}
+	teeReader := io.TeeReader(upload, hashTimer)
+
+	// A .mcignore file is stored like any other file, but its contents are also kept so that its
+	// patterns can be applied to the rest of the upload.
+	var mcignoreContents bytes.Buffer
+	if name == mc.MCIgnoreFileName {
+		teeReader = io.TeeReader(teeReader, &mcignoreContents)
+	}
+
+	// The data of a resumed upload is compared with the staged data rather than written again.
+	timing := mc.TransferTiming{Auth: sc.authDuration, Resolve: time.Since(started)}
+	copyStart := time.Now()
+	writer := mc.NewResumeWriter(f, staged)
+	written, err := io.Copy(mc.NewTimeoutWriter(s.Context(), h.config.FSTimeout, writer), teeReader)
+	if err == nil && resume != nil {
+		err = writer.Finish()
+	}
+	timing.Transfer = time.Since(copyStart)
+
+	// The calls made after the copy aren't tied to the session context so that a file is always
+	// either finished or removed, even if the client has already disconnected.
+	doneStores, doneCancel := h.storesWithTimeout(context.Background(), sc)
+	defer doneCancel()
 
-	written, err := io.Copy(f, teeReader)
 	if err != nil {
+		// Only part of the file was received, so don't create a version for it. The data received can be
+		// staged so that uploading the file again continues from it.
 		log.Errorf("failure writing to file %d: %s", file.ID, err)
+		if !h.stageUpload(doneStores, entry.Size, sc.user.ID, path, file, resume, writer) {
+			_ = mc.AbortFile(doneStores, file, h.mcfsRoot)
+		}
+		return written, fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	if resume != nil {
+		log.Infof("Resumed upload of %s in project %d verified %d staged bytes", path, project.ID, writer.Verified())
+		if err := doneStores.ResumableUploadStore.DeleteResumableUpload(project.ID, path); err != nil {
+			log.Errorf("Unable to remove the staged upload of %s in project %d: %s", path, project.ID, err)
+		}
 	}
 
 	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
-	// Note deleteFile in the if statement - DoneWritingToFile will switch the file if there was an existing file that had the
+	timing.Hash = hashTimer.Elapsed
+
+	if name == mc.MCIgnoreFileName {
+		sc.ignoreList.AddMCIgnore(filepath.Dir(path), mcignoreContents.Bytes())
+	}
+
+	// Note deleteFile in the if statement - CommitFile will switch the file if there was an existing file that had the
 	// same checksum. Here is where deleteFile gets set so that it can delete the file that was just written
-	// if this switch occurred.
-	if deleteFile, err = h.stores.FileStore.DoneWritingToFile(file, checksum, written, h.stores.ConversionStore); err != nil {
-		log.Errorf("Failure updating file (%d) and project (%d) metadata: %s", file.ID, sc.project.ID, err)
+	// if this switch occurred. If the commit fails the file has already been removed.
+	commitStart := time.Now()
+	deleteFile, err = mc.CommitFile(doneStores, file, checksum, written, h.mcfsRoot)
+	timing.Commit = time.Since(commitStart)
+	if err != nil {
+		log.Errorf("Failure updating file (%d) and project (%d) metadata: %s", file.ID, project.ID, err)
+		return written, fmt.Errorf("unable to write '%s': %w", path, err)
 	}
 
+	if name == mc.ManifestFileName {
+		sc.manifests.Add(project.ID, sc.user.ID, path)
+	}
+
+	mc.TagUploadedFile(doneStores.TagStore, file, append(tags, sc.env.UploadTag)...)
+	clientVersion, _ := s.Context().Value(ssh.ContextKeyClientVersion).(string)
+	sessionID, _ := s.Context().Value(ssh.ContextKeySessionID).(string)
+	source := mc.NewUploadSource(clientVersion, s.RemoteAddr(), sessionID)
+	mc.RecordUploadProvenance(doneStores.UploadProvenanceStore, file, sc.user.ID, "scp", source)
+
+	h.coordinator.Transfers.Record(mc.Transfer{
+		Direction: mc.TransferUpload,
+		Protocol:  "scp",
+		UserID:    sc.user.ID,
+		ProjectID: project.ID,
+		Path:      path,
+		Bytes:     written,
+		Duration:  time.Since(started),
+		Timing:    &timing,
+	})
+
 	return written, nil
 }
 
+// precheckUnchanged compares an upload of path, that the client said was size bytes, with the current
+// version of the file when SCPUnchangedCheckLimit is set, and returns the current version when they are
+// the same. The returned reader reads the whole upload otherwise. See mc.PrecheckUnchanged.
+func (h *mcfsHandler) precheckUnchanged(stores *mc.Stores, projectID int, path string, size int64, upload io.Reader) (*mcmodel.File, io.Reader, error) {
+	if h.config.SCPUnchangedCheckLimit <= 0 || size > h.config.SCPUnchangedCheckLimit {
+		return nil, upload, nil
+	}
+
+	current, err := stores.FileStore.GetFileByPath(projectID, path)
+	if err != nil {
+		// Usually there isn't a current version. Any other failure shows up again when the file is created.
+		return nil, upload, nil
+	}
+
+	unchanged, upload, err := mc.PrecheckUnchanged(current, size, h.config.SCPUnchangedCheckLimit, upload)
+	if err != nil || !unchanged {
+		return nil, upload, err
+	}
+
+	return current, nil, nil
+}
+
+// resumableUpload returns the upload staged for path by an interrupted upload of the same file, which
+// has the same size, was uploaded by the same user and whose staged data still has its checksum, or nil
+// if there isn't one. SCP doesn't send a checksum up front, so the rest of the staged data is compared
+// as the file is received (see mc.ResumeWriter). An upload staged for path that isn't of the same file
+// is removed, since the upload replaces it.
+func (h *mcfsHandler) resumableUpload(stores *mc.Stores, projectID int, path string, size int64, userID int) *mc.ResumableUpload {
+	if h.config.SCPResumeMinSize <= 0 || stores.ResumableUploadStore == nil {
+		return nil
+	}
+
+	upload, err := stores.ResumableUploadStore.GetResumableUpload(projectID, path)
+	switch {
+	case err != nil:
+		log.Errorf("Unable to look up the staged upload of %s in project %d: %s", path, projectID, err)
+		return nil
+	case upload == nil:
+		return nil
+	case upload.File != nil:
+		checksum, err := mc.StagedChecksum(upload, h.mcfsRoot)
+		if err != nil {
+			log.Errorf("Unable to check the staged data of %s in project %d: %s", path, projectID, err)
+		} else if upload.Matches(size, userID, checksum) {
+			return upload
+		}
+	}
+
+	if upload.File != nil && !upload.File.Current {
+		_ = mc.AbortFile(stores, upload.File, h.mcfsRoot)
+	}
+
+	if err := stores.ResumableUploadStore.DeleteResumableUpload(projectID, path); err != nil {
+		log.Errorf("Unable to remove the staged upload of %s in project %d: %s", path, projectID, err)
+	}
+
+	return nil
+}
+
+// stageUpload keeps the data received by an interrupted upload of path, which the client said was size
+// bytes, so that uploading the file again continues from it. It returns false when the data wasn't
+// staged, because staging is turned off, too little data was received, or it couldn't be recorded.
+func (h *mcfsHandler) stageUpload(stores *mc.Stores, size int64, userID int, path string, file *mcmodel.File, resume *mc.ResumableUpload, writer *mc.ResumeWriter) bool {
+	if h.config.SCPResumeMinSize <= 0 || stores.ResumableUploadStore == nil || writer.Valid() < h.config.SCPResumeMinSize {
+		if resume != nil {
+			_ = stores.ResumableUploadStore.DeleteResumableUpload(file.ProjectID, path)
+		}
+		return false
+	}
+
+	upload := &mc.ResumableUpload{
+		ProjectID:       file.ProjectID,
+		Path:            path,
+		Size:            size,
+		Received:        writer.Valid(),
+		PartialChecksum: writer.Checksum(),
+		FileID:          file.ID,
+		OwnerID:         userID,
+	}
+
+	// Staged data past what was received this time hasn't been compared yet, so it keeps its checksum.
+	if writer.Valid() != writer.Received() {
+		upload.PartialChecksum = resume.PartialChecksum
+	}
+
+	if err := writer.Truncate(); err != nil {
+		log.Errorf("Unable to truncate the staged data of file %d: %s", file.ID, err)
+		return false
+	}
+
+	if err := stores.ResumableUploadStore.SaveResumableUpload(upload); err != nil {
+		log.Errorf("Unable to stage the upload of %s in project %d: %s", path, file.ProjectID, err)
+		return false
+	}
+
+	log.Infof("Staged %d of %d bytes of the upload of %s in project %d", upload.Received, size, path, file.ProjectID)
+	return true
+}
+
 // getSessionContext will retrieve the mcSessionContext set in the passwordHandler method (cmd/mc-sshd/cmd/root.go).
-// The mcSessionContext is an instance of *SessionContext. The initial value of this SessionContext has the user
-// set (from the password handler) and fatalErrorLoadingProject set to false. This method will check if the
-// fatalErrorLoadingProject is true and return an error without any further processing. If the project is not
-// nil then it was loaded in a previous call, and getSessionContext() will return the SessionContext. If project
-// is nil it will attempt to retrieve it. Any errors here will set fatalErrorLoadingProject.
-func (h *mcfsHandler) getSessionContext(s ssh.Session, path string) (*SessionContext, error) {
+// The mcSessionContext is an instance of *SessionContext. It also returns the project for path, which is looked
+// up from the project slug at the start of path. Projects are cached in the SessionContext, so each project is
+// only looked up once per session. Project slugs that don't exist, or that the user doesn't have access to, are
+// also cached so that each call for a path in such a project fails without another lookup. A failure for one
+// project doesn't affect paths in other projects.
+func (h *mcfsHandler) getSessionContext(s ssh.Session, path string) (*SessionContext, *mcmodel.Project, error) {
 	var (
 		ok bool
 		sc *SessionContext
 	)
 
 	if sc, ok = s.Context().Value("mcSessionContext").(*SessionContext); !ok {
-		return nil, fmt.Errorf("mcSessionContext is not set")
+		return nil, nil, fmt.Errorf("mcSessionContext is not set")
 	}
 
-	if sc.fatalErrorLoadingProject {
-		return nil, fmt.Errorf("no such project %s", mc.GetProjectSlugFromPath(path))
+	if sc.stores == nil {
+		sc.stores = h.stores.ForSession()
 	}
 
-	if sc.project != nil {
-		return sc, nil
+	if sc.ignoreList == nil {
+		sc.ignoreList = mc.NewIgnoreList(h.config.IgnorePatterns)
 	}
 
-	var err error
-	if sc.project, err = h.loadProjectFromPath(path, sc.user.ID); err != nil {
-		sc.fatalErrorLoadingProject = true
-		return nil, err
+	if sc.manifests == nil {
+		sc.manifests = mc.NewManifestVerifier(h.stores, h.mcfsRoot)
+	}
+
+	if sc.env == nil {
+		env := mc.ParseSessionEnv(s.Environ())
+		sc.env = &env
+	}
+
+	if sc.prefetch == nil {
+		sc.prefetch = mc.NewPrefetchPipeline(h.config.ReadAheadFiles)
+	}
+
+	project, err := h.getProject(s, sc, path)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return sc, nil
+	return sc, project, nil
 }
 
-// loadProjectFromPath loads the project from the path. The project is set at the beginning
-// of the path and will be the same project across all scp callbacks.
-//
-// **This method should only be called inside getSessionContext().**
-func (h *mcfsHandler) loadProjectFromPath(path string, userID int) (*mcmodel.Project, error) {
-	var (
-		project *mcmodel.Project
-		err     error
-	)
+// getProject returns the project for path, using the caches in sc. A relative path is in the session's
+// default project, when it has one. Paths are otherwise left as is, since mc.RemoveProjectSlugFromPath
+// treats a relative path as being relative to the project root.
+func (h *mcfsHandler) getProject(s ssh.Session, sc *SessionContext, path string) (*mcmodel.Project, error) {
+	path = sc.env.ResolvePath(path)
+	projectSlug := mc.GetProjectSlugFromPath(path)
+
+	sc.mu.Lock()
+	project, ok := sc.projects[projectSlug]
+	withoutAccess := sc.projectsWithoutAccess[projectSlug]
+	sc.mu.Unlock()
+
+	switch {
+	case ok:
+		return project, nil
+	case withoutAccess:
+		return nil, fmt.Errorf("%w %s", mc.ErrProjectNotFound, projectSlug)
+	}
+
+	// The lookup is done without holding sc.mu, so that a slow database doesn't hold up the session's
+	// other commands.
+	stores, cancel := h.storesWithTimeout(s.Context(), sc)
+	defer cancel()
+
+	project, err := mc.GetAndValidateProjectForClient(path, sc.user.ID, s.RemoteAddr(), stores)
 
-	if project, err = mc.GetAndValidateProjectFromPath(path, userID, h.stores.ProjectStore); err != nil {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err != nil {
+		// Only a project that doesn't exist, or that the user can't access, is cached. Other errors,
+		// such as the database timing out, are returned without remembering them.
+		if errors.Is(err, mc.ErrProjectNotFound) {
+			sc.projectsWithoutAccess[projectSlug] = true
+		}
 		return nil, err
 	}
 
+	// A concurrent command may have looked up the project at the same time.
+	if cached, ok := sc.projects[projectSlug]; ok {
+		return cached, nil
+	}
+
+	sc.projects[projectSlug] = project
+	h.coordinator.Activity.SessionStarted(project.Slug, sc.user.Slug)
 	return project, nil
 }
+
+// checkDropBox returns mc.ErrDropBoxOnly when the user is an instrument account that isn't allowed the
+// access to path in project. See mc.Config.CheckDropBoxAccess.
+func (h *mcfsHandler) checkDropBox(sc *SessionContext, project *mcmodel.Project, path string, access mc.DropBoxAccess) error {
+	err := h.config.CheckDropBoxAccess(sc.user.Slug, project.Slug, path, access)
+	if err != nil {
+		log.Errorf("Instrument account %d denied access to %s in project %d: %s", sc.user.ID, path, project.ID, err)
+	}
+
+	return err
+}
+
+// authorize asks the coordinator's Authorizer whether the user can do operation on path in project. See
+// mc.Authorize.
+func (h *mcfsHandler) authorize(s ssh.Session, sc *SessionContext, project *mcmodel.Project, path, operation string) error {
+	req := mc.NewAuthorizationRequest(h.config.Scopes, sc.user, "scp", operation)
+	req.ProjectSlug, req.Path = project.Slug, path
+	return mc.Authorize(s.Context(), h.coordinator.Authorizer, req)
+}
+
+// localize translates err into the language of the client's locale. See mc.Localize. It also records err
+// as the reason the command failed, for ErrorsMiddleware.
+func (h *mcfsHandler) localize(s ssh.Session, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if es, ok := s.(*errorSession); ok {
+		es.fail(err)
+	}
+
+	if sc, ok := s.Context().Value("mcSessionContext").(*SessionContext); ok && sc.env != nil {
+		return mc.Localize(err, sc.env.Language)
+	}
+
+	return mc.Localize(err, mc.ParseSessionEnv(s.Environ()).Language)
+}
+
+// storesWithTimeout returns the session's stores bound to ctx, with the configured database timeout
+// applied. The returned cancel function must be called when finished with the stores.
+func (h *mcfsHandler) storesWithTimeout(ctx context.Context, sc *SessionContext) (*mc.Stores, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.DBTimeout)
+	return sc.stores.WithContext(ctx), cancel
+}
+
+// waitForFinalizeCapacity waits, for up to the database timeout, for the backlog of uploads being finalized
+// to drop below its high water mark.
+func (h *mcfsHandler) waitForFinalizeCapacity(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.config.DBTimeout)
+	defer cancel()
+	return h.coordinator.WriteBackpressure.Wait(ctx)
+}
+
+// ActivityMiddleware ends the activity of an scp session, in each project it used, once the session has
+// finished. The activity is started as each project is looked up (see getProject).
+func ActivityMiddleware(coordinator *mc.Coordinator) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(s ssh.Session) {
+			next(s)
+
+			sc, ok := s.Context().Value("mcSessionContext").(*SessionContext)
+			if !ok {
+				return
+			}
+
+			sc.mu.Lock()
+			defer sc.mu.Unlock()
+			for slug, project := range sc.projects {
+				coordinator.Activity.SessionEnded(project.Slug, sc.user.Slug)
+
+				// The SessionContext is shared by the sessions on a connection, so each project is
+				// removed to make sure that it is only ended once.
+				delete(sc.projects, slug)
+			}
+		}
+	}
+}
+
+// VerifyManifestsMiddleware verifies, in the background, any manifests that were uploaded during an
+// scp session once the session has finished.
+func VerifyManifestsMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		next(s)
+
+		if sc, ok := s.Context().Value("mcSessionContext").(*SessionContext); ok && sc.manifests != nil {
+			go sc.manifests.VerifyAll()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package mcscp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/charmbracelet/wish/scp"
+	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// benchFileStore is a FakeFileStore that assigns a UUID to created files, which is needed to
+// compute the underlying file path when writing.
+type benchFileStore struct {
+	*store.FakeFileStore
+}
+
+func (s benchFileStore) CreateFile(name string, projectID, directoryID, ownerID int, mimeType string) (*mcmodel.File, error) {
+	f, err := s.FakeFileStore.CreateFile(name, projectID, directoryID, ownerID, mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	f.UUID, err = uuid.GenerateUUID()
+	return f, err
+}
+
+func BenchmarkMcfsHandler_Write_SmallFiles(b *testing.B) {
+	benchmarkWrite(b, 4*1024)
+}
+
+func BenchmarkMcfsHandler_Write_LargeFiles(b *testing.B) {
+	benchmarkWrite(b, 64*1024*1024)
+}
+
+// BenchmarkChecksum measures just the checksum computation done while writing a file.
+func BenchmarkChecksum(b *testing.B) {
+	data := randomData(64 * 1024 * 1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		hasher := md5.New()
+		if _, err := io.Copy(io.Discard, io.TeeReader(bytes.NewReader(data), hasher)); err != nil {
+			b.Fatal(err)
+		}
+		_ = fmt.Sprintf("%x", hasher.Sum(nil))
+	}
+}
+
+// benchmarkWrite measures the complete SCP Write path for files of size bytes. The database is
+// faked, so this measures the handler and filesystem overhead rather than database commits.
+func benchmarkWrite(b *testing.B, size int) {
+	stores := makeStoresWithFakes()
+	stores.FileStore = benchFileStore{FakeFileStore: stores.FileStore.(*store.FakeFileStore)}
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), b.TempDir())
+	session := newFakeSshSession()
+	data := randomData(size)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		entry := &scp.FileEntry{
+			Name:     fmt.Sprintf("file-%d.dat", i),
+			Filepath: fmt.Sprintf("/proj/dir1/file-%d.dat", i),
+			Mode:     0644,
+			Size:     int64(size),
+			Reader:   bytes.NewReader(data),
+		}
+
+		if _, err := handler.Write(session, entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
@@ -1,8 +1,13 @@
 package mcscp
 
 import (
+	"bytes"
+	"errors"
+	"io/fs"
 	"testing"
 
+	shlex "github.com/anmitsu/go-shlex"
+	"github.com/charmbracelet/wish/scp"
 	"github.com/materials-commons/gomcdb/mcmodel"
 	"github.com/materials-commons/gomcdb/store"
 	"github.com/materials-commons/mc-ssh/pkg/mc"
@@ -22,7 +27,7 @@ func TestMcfsHandler_Mkdir(t *testing.T) {
 
 func TestMcfsHandler_NewDirEntry(t *testing.T) {
 	stores := makeStoresWithFakes()
-	handler := NewMCFSHandler(stores, "/tmp")
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), "/tmp")
 	session := newFakeSshSession()
 	tests := []struct {
 		tname      string
@@ -48,6 +53,186 @@ func TestMcfsHandler_NewDirEntry(t *testing.T) {
 	}
 }
 
+func TestMcfsHandler_MultipleProjectsInSession(t *testing.T) {
+	stores := makeStoresWithFakes()
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), "/tmp")
+	session := newFakeSshSession()
+
+	// A path in a project that doesn't exist shouldn't stop paths in other projects from working.
+	_, err := handler.NewDirEntry(session, "/proj-not-exist/dir1")
+	require.Error(t, err)
+
+	dirEntry, err := handler.NewDirEntry(session, "/proj/dir1")
+	require.NoError(t, err)
+	require.Equal(t, "/dir1", dirEntry.Filepath)
+
+	dirEntry, err = handler.NewDirEntry(session, "/proj2/dir2")
+	require.NoError(t, err)
+	require.Equal(t, "/dir2", dirEntry.Filepath)
+
+	_, err = handler.NewDirEntry(session, "/proj2/dir1")
+	require.Error(t, err, "dir1 is in proj, not proj2")
+}
+
+// unavailableProjectStore fails slug lookups while unavailable is set.
+type unavailableProjectStore struct {
+	*store.FakeProjectStore
+	unavailable bool
+}
+
+func (s *unavailableProjectStore) GetProjectBySlug(slug string) (*mcmodel.Project, error) {
+	if s.unavailable {
+		return nil, errors.New("database unavailable")
+	}
+
+	return s.FakeProjectStore.GetProjectBySlug(slug)
+}
+
+func TestMcfsHandler_ProjectLookupErrorsArentCached(t *testing.T) {
+	stores := makeStoresWithFakes()
+	projectStore := &unavailableProjectStore{FakeProjectStore: stores.ProjectStore.(*store.FakeProjectStore), unavailable: true}
+	stores.ProjectStore = projectStore
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), "/tmp")
+	session := newFakeSshSession()
+
+	// A failed lookup isn't taken to mean the project doesn't exist.
+	_, err := handler.NewDirEntry(session, "/proj/dir1")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, mc.ErrProjectNotFound)
+
+	projectStore.unavailable = false
+	dirEntry, err := handler.NewDirEntry(session, "/proj/dir1")
+	require.NoError(t, err, "The project should be looked up again once the database is back")
+	require.Equal(t, "/dir1", dirEntry.Filepath)
+}
+
+func TestMcfsHandler_WalkDirPassesProjectPaths(t *testing.T) {
+	stores := makeStoresWithFakes()
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), "/tmp")
+	session := newFakeSshSession()
+
+	// The paths given to the callback are passed back to NewDirEntry and NewFileEntry, so they
+	// have to include the project slug.
+	var paths []string
+	err := handler.WalkDir(session, "/proj2", func(path string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		paths = append(paths, path)
+		_, err = handler.NewDirEntry(session, path)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/proj2", "/proj2/dir2"}, paths)
+}
+
+func TestMcfsHandler_ProjectRoot(t *testing.T) {
+	stores := makeStoresWithFakes()
+	stores.FileStore = benchFileStore{FakeFileStore: stores.FileStore.(*store.FakeFileStore)}
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), t.TempDir())
+	session := newFakeSshSession()
+
+	// wish joins the file name on to the scp target, so these are the paths for uploading data.csv
+	// with targets of /proj/, /proj and proj.
+	writeTests := []struct {
+		tname    string
+		filepath string
+		name     string
+	}{
+		{"Trailing slash target", "/proj/data.csv", "data.csv"},
+		{"Bare slug target", "proj/data2.csv", "data2.csv"},
+		{"Unclean target", "/proj//./data3.csv", "data3.csv"},
+	}
+
+	for _, test := range writeTests {
+		t.Run(test.tname, func(t *testing.T) {
+			data := []byte("a,b,c\n")
+			entry := &scp.FileEntry{Name: test.name, Filepath: test.filepath, Mode: 0644, Size: int64(len(data)), Reader: bytes.NewReader(data)}
+			written, err := handler.Write(session, entry)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), written)
+
+			file, err := stores.FileStore.GetFileByPath(1, "/"+test.name)
+			require.NoError(t, err, "File should be in the project root")
+			require.Equal(t, 1, file.DirectoryID)
+		})
+	}
+
+	_, err := handler.Write(session, &scp.FileEntry{Name: "proj", Filepath: "/proj/", Reader: bytes.NewReader(nil)})
+	require.Error(t, err, "The project root itself can't be written to")
+
+	for _, path := range []string{"/proj", "/proj/", "proj"} {
+		dirEntry, err := handler.NewDirEntry(session, path)
+		require.NoError(t, err, "NewDirEntry failed for %s", path)
+		require.Equal(t, "proj", dirEntry.Name, "Project root should be named after the project for %s", path)
+		require.Equal(t, "/", dirEntry.Filepath)
+
+		_, _, err = handler.NewFileEntry(session, path)
+		require.Error(t, err, "Project root isn't a file for %s", path)
+	}
+}
+
+func TestMcfsHandler_SessionEnv(t *testing.T) {
+	stores := makeStoresWithFakes()
+	stores.FileStore = benchFileStore{FakeFileStore: stores.FileStore.(*store.FakeFileStore)}
+	tagStore := mc.NewFakeTagStore()
+	stores.TagStore = tagStore
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), t.TempDir())
+	session := newFakeSshSession()
+	session.env = []string{"MC_PROJECT=proj2", "MC_UPLOAD_TAG=run-42"}
+
+	// Relative paths are in the default project, absolute paths still name their project.
+	dirEntry, err := handler.NewDirEntry(session, "dir2")
+	require.NoError(t, err)
+	require.Equal(t, "/dir2", dirEntry.Filepath)
+
+	_, err = handler.NewDirEntry(session, "/proj/dir1")
+	require.NoError(t, err)
+
+	data := []byte("a,b,c\n")
+	_, err = handler.Write(session, &scp.FileEntry{Name: "data.csv", Filepath: "dir2/data.csv", Mode: 0644, Size: int64(len(data)), Reader: bytes.NewReader(data)})
+	require.NoError(t, err)
+
+	file, err := stores.FileStore.GetFileByPath(2, "/dir2/data.csv")
+	require.NoError(t, err, "File should be in the default project")
+	require.Equal(t, []string{"run-42"}, tagStore.Tags[file.ID])
+
+	// Files uploaded into .tagged/<tag> are stored without it, and get both tags.
+	_, err = handler.Write(session, &scp.FileEntry{Name: "xrd.csv", Filepath: "/proj2/.tagged/xrd/dir2/xrd.csv", Mode: 0644, Size: int64(len(data)), Reader: bytes.NewReader(data)})
+	require.NoError(t, err)
+
+	file, err = stores.FileStore.GetFileByPath(2, "/dir2/xrd.csv")
+	require.NoError(t, err, "File should be stored without the .tagged directory")
+	require.Equal(t, []string{"xrd", "run-42"}, tagStore.Tags[file.ID])
+}
+
+func TestMcfsHandler_InstrumentAccount(t *testing.T) {
+	stores := makeStoresWithFakes()
+	stores.FileStore = benchFileStore{FakeFileStore: stores.FileStore.(*store.FakeFileStore)}
+	config := mc.DefaultConfig()
+	config.DropBoxes = map[string][]mc.PathRule{"testslug": {{ProjectSlug: "proj", Prefix: "/dir1"}}}
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), config, t.TempDir())
+	session := newFakeSshSession()
+
+	data := []byte("a,b,c\n")
+	_, err := handler.Write(session, &scp.FileEntry{Name: "data.csv", Filepath: "/proj/dir1/data.csv", Mode: 0644, Size: int64(len(data)), Reader: bytes.NewReader(data)})
+	require.NoError(t, err, "Uploads into the drop box are allowed")
+
+	_, err = handler.Write(session, &scp.FileEntry{Name: "data.csv", Filepath: "/proj/data.csv", Mode: 0644, Size: int64(len(data)), Reader: bytes.NewReader(data)})
+	require.ErrorIs(t, err, mc.ErrDropBoxOnly, "Uploads outside the drop box are refused")
+
+	require.NoError(t, handler.Mkdir(session, &scp.DirEntry{Name: "run1", Filepath: "/proj/dir1/run1"}))
+	require.ErrorIs(t, handler.Mkdir(session, &scp.DirEntry{Name: "dir2", Filepath: "/proj2/dir2"}), mc.ErrDropBoxOnly)
+
+	// Nothing can be downloaded, not even from the drop box.
+	_, _, err = handler.NewFileEntry(session, "/proj/dir1/data.csv")
+	require.ErrorIs(t, err, mc.ErrDropBoxOnly)
+
+	_, err = handler.NewDirEntry(session, "/proj/dir1")
+	require.ErrorIs(t, err, mc.ErrDropBoxOnly)
+
+	err = handler.WalkDir(session, "/proj", func(path string, d fs.DirEntry, err error) error { return err })
+	require.ErrorIs(t, err, mc.ErrDropBoxOnly)
+}
+
 func TestMcfsHandler_NewFileEntry(t *testing.T) {
 
 }
@@ -67,16 +252,47 @@ func TestMcfsHandler_loadProjectAndUserIntoHandler(t *testing.T) {
 func makeStoresWithFakes() *mc.Stores {
 	projects := []mcmodel.Project{
 		{ID: 1, Slug: "proj", OwnerID: 1},
+		{ID: 2, Slug: "proj2", OwnerID: 1},
 	}
 
 	files := []mcmodel.File{
 		{ID: 1, Name: "/", Path: "/", ProjectID: 1, OwnerID: 1, MimeType: "directory"},
 		{ID: 2, Name: "dir1", Path: "/dir1", ProjectID: 1, OwnerID: 1, MimeType: "directory"},
+		{ID: 3, Name: "/", Path: "/", ProjectID: 2, OwnerID: 1, MimeType: "directory"},
+		{ID: 4, Name: "dir2", Path: "/dir2", ProjectID: 2, OwnerID: 1, MimeType: "directory", DirectoryID: 3},
 	}
 
 	return &mc.Stores{
-		FileStore:       store.NewFakeFileStore(files),
-		ProjectStore:    store.NewFakeProjectStore(projects),
-		ConversionStore: store.NewFakeConversionStore(),
+		FileStore:        store.NewFakeFileStore(files),
+		ProjectStore:     store.NewFakeProjectStore(projects),
+		ConversionStore:  store.NewFakeConversionStore(),
+		PendingFileStore: mc.NewFakePendingFileStore(),
 	}
 }
+
+func TestMcfsHandler_WindowsPaths(t *testing.T) {
+	tests := []struct {
+		command string
+		path    string
+	}{
+		{`scp -t \proj\dir1`, `\proj\dir1`},
+		{`scp -t C:\proj\dir1\`, `C:\proj\dir1\`},
+		{`scp -t "\proj\dir1"`, `\proj\dir1`},
+		{`scp -t '\proj\dir 1'`, `\proj\dir 1`},
+		{`scp -t /proj/dir\ 1`, "/proj/dir 1"},
+		{`scp -t "/proj/a\"b"`, `/proj/a"b`},
+	}
+
+	for _, test := range tests {
+		command, err := shlex.Split(keepPathBackslashes(test.command), true)
+		require.NoError(t, err, test.command)
+		require.Equal(t, []string{"scp", "-t", test.path}, command, test.command)
+	}
+
+	// The kept backslashes are path separators.
+	stores := makeStoresWithFakes()
+	handler := NewMCFSHandler(stores, mc.NewInMemoryCoordinator(), mc.DefaultConfig(), "/tmp")
+	dirEntry, err := handler.NewDirEntry(newFakeSshSession(), `C:\proj\dir1`)
+	require.NoError(t, err)
+	require.Equal(t, "/dir1", dirEntry.Filepath)
+}
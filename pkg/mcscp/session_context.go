@@ -1,30 +1,75 @@
 package mcscp
 
-import "github.com/materials-commons/gomcdb/mcmodel"
+import (
+	"sync"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
 
 // SessionContext is the context for a scp session. It contains the user that started the session
-// as well as the project (determined from the slug in the project path).
+// as well as the projects (determined from the slug in each path) accessed in the session.
 type SessionContext struct {
 	// The user is set in the context from the passwordHandler method in cmd/mc-sshd/cmd/root. Rather than
 	// constantly retrieving it we get it one time and set it in the mcfsHandler. See
 	// loadProjectAndUserIntoHandler for details.
 	user *mcmodel.User
 
-	// The project that this scp instance is using. It gets loaded from the path the user specified. See
-	// loadProjectAndUserIntoHandler and pkg/mc/util mc.*ProjectSlug* methods for how this is handled.
-	project *mcmodel.Project
+	// mu guards projects and projectsWithoutAccess.
+	mu sync.Mutex
+
+	// projects caches the projects accessed in this session that the user has access to, keyed by the
+	// project slug. The paths in a single scp command can be in different projects, for example when
+	// downloading with scp mc-user@materialscommons.org:/proj-a/file1 mc-user@materialscommons.org:/proj-b/file2 .
+	// so the project is looked up for each path. See getSessionContext.
+	projects map[string]*mcmodel.Project
+
+	// projectsWithoutAccess caches the project slugs that don't exist or that the user doesn't have
+	// access to, so that they aren't looked up again. A failure only affects the paths in that project.
+	projectsWithoutAccess map[string]bool
+
+	// stores are the session's stores (see mc.Stores.ForSession). Like ignoreList they are created by
+	// getSessionContext.
+	stores *mc.Stores
+
+	// ignoreList determines which uploaded files and directories are skipped. It is created by
+	// getSessionContext the first time the SessionContext is retrieved, and collects the patterns
+	// from any .mcignore files uploaded in this session.
+	ignoreList *mc.IgnoreList
+
+	// manifests collects the manifests uploaded in this session, which are verified when the session
+	// ends (see VerifyManifestsMiddleware). Like ignoreList it is created by getSessionContext.
+	manifests *mc.ManifestVerifier
 
-	// Each callback has to attempt to load the project. The project gets loaded once into the context
-	// loadProjectIntoSessionContext. However, it's possible that the project is invalid. If this
-	// happens then fatalErrorLoadingProject is set to true so that an attempt isn't made to
-	// load the project again.
-	fatalErrorLoadingProject bool
+	// env holds the hints the client sent as SSH environment variables. The environment isn't known
+	// when the SessionContext is created, at authentication, so it is also set by getSessionContext.
+	env *mc.SessionEnv
+
+	// prefetch reads ahead the files downloaded in this session. Like ignoreList it is created by
+	// getSessionContext.
+	prefetch *mc.PrefetchPipeline
+
+	// authDuration is how long authenticating the session took, for the timing of its transfers. See
+	// SetAuthDuration.
+	authDuration time.Duration
+
+	// dirs creates the directories written to by the session's uploads, each once.
+	dirs *mc.DirMaterializer
 }
 
 // NewSessionContext creates a new SessionContext. The user is a required parameter and cannot be nil.
 func NewSessionContext(user *mcmodel.User) *SessionContext {
 	return &SessionContext{
-		user:                     user,
-		fatalErrorLoadingProject: false,
+		user:                  user,
+		projects:              make(map[string]*mcmodel.Project),
+		projectsWithoutAccess: make(map[string]bool),
+		dirs:                  mc.NewDirMaterializer(),
 	}
 }
+
+// SetAuthDuration sets how long authenticating the session took. It is set by the passwordHandler once
+// the user has been authenticated, before the session starts.
+func (sc *SessionContext) SetAuthDuration(authDuration time.Duration) {
+	sc.authDuration = authDuration
+}
@@ -0,0 +1,94 @@
+package mcscp
+
+import (
+	"strings"
+
+	shlex "github.com/anmitsu/go-shlex"
+	"github.com/charmbracelet/wish/scp"
+	"github.com/gliderlabs/ssh"
+)
+
+// WindowsPathsMiddleware keeps the backslashes in the paths of scp commands from Windows clients. The
+// command is split like a shell would, which drops an unquoted backslash, so that scp -t \my-project\raw
+// becomes a path of my-projectraw. A backslash before a character that a shell never needs escaped, such
+// as a letter, digit or '.', is kept as a path separator, and the paths are then converted by
+// mc.NormalizeClientPath. Quoted paths, and backslashes escaping characters such as spaces, are split as
+// usual. It must come after ErrorsMiddleware in wish.WithMiddleware, so that it wraps it.
+func WindowsPathsMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		raw := s.RawCommand()
+		kept := keepPathBackslashes(raw)
+		if kept == raw {
+			next(s)
+			return
+		}
+
+		command, err := shlex.Split(kept, true)
+		if err != nil || !scp.GetInfo(command).Ok {
+			next(s)
+			return
+		}
+
+		next(&windowsPathsSession{Session: s, command: command})
+	}
+}
+
+// windowsPathsSession is the session given to the scp middleware by WindowsPathsMiddleware, with the
+// command split keeping the backslashes in its paths.
+type windowsPathsSession struct {
+	ssh.Session
+	command []string
+}
+
+func (s *windowsPathsSession) Command() []string {
+	return append([]string(nil), s.command...)
+}
+
+// keepPathBackslashes escapes the unquoted backslashes in command that are path separators, those
+// followed by a character that a shell never needs escaped or at the end of command, so that splitting
+// command keeps them.
+func keepPathBackslashes(command string) string {
+	var (
+		b     strings.Builder
+		quote byte
+	)
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote == '\'':
+			// Nothing is escaped within single quotes.
+			if c == '\'' {
+				quote = 0
+			}
+		case quote == '"':
+			if c == '\\' && i+1 < len(command) {
+				b.WriteByte(c)
+				i++
+				c = command[i]
+			} else if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '\\':
+			if i+1 == len(command) || isPathByte(command[i+1]) {
+				b.WriteByte('\\')
+			} else {
+				// An escape, such as of a space, so the escaped character is copied as is.
+				b.WriteByte(c)
+				i++
+				c = command[i]
+			}
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// isPathByte returns true for the characters in paths that a shell never needs escaped.
+func isPathByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("._-+@%,:", c) >= 0
+}
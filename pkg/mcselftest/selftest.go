@@ -0,0 +1,253 @@
+package mcselftest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dir is the directory, in the project, that the self test uploads into. The same directory, and file
+// name, are used on every run so that runs against a server that can't delete files add versions of a
+// single file rather than new files.
+const Dir = "mc-selftest"
+
+// Options describes the server to test and how to log in to it.
+type Options struct {
+	// Addr is the host:port of the mc-sshd server.
+	Addr string
+
+	// User is the user slug to log in as, and Password is that user's password.
+	User     string
+	Password string
+
+	// ProjectSlug is the project the test file is uploaded into. It must be writable by User.
+	ProjectSlug string
+
+	// FileSize is the size of the test file in bytes.
+	FileSize int64
+
+	// Timeout bounds connecting and logging in.
+	Timeout time.Duration
+}
+
+// Step is the outcome of one step of the self test.
+type Step struct {
+	Name    string
+	Elapsed time.Duration
+	Err     error
+
+	// Optional is set for steps, such as cleanup, whose failure doesn't fail the test.
+	Optional bool
+
+	// Skipped is set for steps that weren't run because an earlier step failed.
+	Skipped bool
+}
+
+func (s Step) String() string {
+	switch {
+	case s.Skipped:
+		return fmt.Sprintf("SKIP %s", s.Name)
+	case s.Err != nil && s.Optional:
+		return fmt.Sprintf("WARN %s (%s): %s", s.Name, s.Elapsed.Round(time.Millisecond), s.Err)
+	case s.Err != nil:
+		return fmt.Sprintf("FAIL %s (%s): %s", s.Name, s.Elapsed.Round(time.Millisecond), s.Err)
+	default:
+		return fmt.Sprintf("ok   %s (%s)", s.Name, s.Elapsed.Round(time.Millisecond))
+	}
+}
+
+// selfTest holds the state shared by the steps.
+type selfTest struct {
+	opts     Options
+	conn     *ssh.Client
+	client   *sftp.Client
+	dir      string
+	filePath string
+	data     []byte
+}
+
+// Run logs in to the server and runs the steps of the self test in order: list the root, create the
+// test directory, upload a file, download it and compare its checksum, and clean up. The steps after a
+// failed step are skipped, except for cleanup, which is always attempted. It returns the outcome of
+// each step, and the first failure.
+func Run(opts Options) ([]Step, error) {
+	t := &selfTest{
+		opts:     opts,
+		dir:      path.Join("/", opts.ProjectSlug, Dir),
+		filePath: path.Join("/", opts.ProjectSlug, Dir, "selftest.dat"),
+	}
+	defer t.close()
+
+	steps := []struct {
+		name     string
+		fn       func() error
+		optional bool
+	}{
+		{name: "login", fn: t.login},
+		{name: "list root", fn: t.listRoot},
+		{name: "mkdir " + t.dir, fn: t.mkdir},
+		{name: "upload " + t.filePath, fn: t.upload},
+		{name: "download and compare checksum", fn: t.download},
+		{name: "cleanup", fn: t.cleanup, optional: true},
+	}
+
+	var (
+		results  []Step
+		firstErr error
+	)
+
+	for _, step := range steps {
+		// Cleanup only needs a session.
+		if firstErr != nil && (!step.optional || t.client == nil) {
+			results = append(results, Step{Name: step.name, Optional: step.optional, Skipped: true})
+			continue
+		}
+
+		start := time.Now()
+		err := step.fn()
+		results = append(results, Step{Name: step.name, Elapsed: time.Since(start), Err: err, Optional: step.optional})
+		if err != nil && !step.optional && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+
+	return results, firstErr
+}
+
+func (t *selfTest) login() error {
+	sshConfig := &ssh.ClientConfig{
+		User: t.opts.User,
+		Auth: []ssh.AuthMethod{ssh.Password(t.opts.Password)},
+		// The self test checks that the server works, not who it is, so the host key isn't checked.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         t.opts.Timeout,
+	}
+
+	var err error
+	if t.conn, err = ssh.Dial("tcp", t.opts.Addr, sshConfig); err != nil {
+		return fmt.Errorf("unable to connect to %s: %w", t.opts.Addr, err)
+	}
+
+	if t.client, err = sftp.NewClient(t.conn); err != nil {
+		return fmt.Errorf("unable to start sftp session: %w", err)
+	}
+
+	return nil
+}
+
+// listRoot checks that the root lists the user's projects, including the project being tested.
+func (t *selfTest) listRoot() error {
+	entries, err := t.client.ReadDir("/")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == t.opts.ProjectSlug {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("project %s isn't in the root listing of %d entries", t.opts.ProjectSlug, len(entries))
+}
+
+func (t *selfTest) mkdir() error {
+	if err := t.client.MkdirAll(t.dir); err != nil {
+		return err
+	}
+
+	fi, err := t.client.Stat(t.dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s isn't a directory", t.dir)
+	}
+
+	return nil
+}
+
+func (t *selfTest) upload() error {
+	t.data = make([]byte, t.opts.FileSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(t.data)
+
+	f, err := t.client.Create(t.filePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, bytes.NewReader(t.data))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// download reads the uploaded file back and compares its size and checksum with what was uploaded.
+func (t *selfTest) download() error {
+	fi, err := t.client.Stat(t.filePath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != int64(len(t.data)) {
+		return fmt.Errorf("%s is %d bytes, expected %d", t.filePath, fi.Size(), len(t.data))
+	}
+
+	f, err := t.client.Open(t.filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if got, expected := fmt.Sprintf("%x", h.Sum(nil)), fmt.Sprintf("%x", md5.Sum(t.data)); got != expected {
+		return fmt.Errorf("downloaded checksum %s doesn't match uploaded checksum %s", got, expected)
+	}
+
+	return nil
+}
+
+// cleanup removes the test file and directory. mc-sshd doesn't delete over SFTP unless deletes are
+// supported, so a failure only warns, and the next run reuses the same file.
+func (t *selfTest) cleanup() error {
+	var errs []error
+	if err := t.client.Remove(t.filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+
+	if err := t.client.RemoveDirectory(t.dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("unable to remove %s, it will be reused by the next run: %v", t.dir, errs[0])
+	}
+
+	return nil
+}
+
+func (t *selfTest) close() {
+	if t.client != nil {
+		_ = t.client.Close()
+	}
+
+	if t.conn != nil {
+		_ = t.conn.Close()
+	}
+}
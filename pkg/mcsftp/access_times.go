@@ -0,0 +1,452 @@
+package mcsftp
+
+import (
+	"encoding/binary"
+	"io"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// The SFTP packets that are followed to put access times into replies.
+	sshFxpOpen    = 3
+	sshFxpClose   = 4
+	sshFxpLstat   = 7
+	sshFxpFstat   = 8
+	sshFxpOpendir = 11
+	sshFxpReaddir = 12
+	sshFxpStat    = 17
+	sshFxpHandle  = 102
+	sshFxpName    = 104
+	sshFxpAttrs   = 105
+
+	// The attribute flags that come before the access time.
+	sshFileXferAttrSize        = 0x1
+	sshFileXferAttrUIDGID      = 0x2
+	sshFileXferAttrPermissions = 0x4
+	sshFileXferAttrACmodTime   = 0x8
+
+	// maxAccessTimeRequestLength is the largest request whose path or handle is kept.
+	maxAccessTimeRequestLength = 8 * 1024
+
+	// maxAccessTimeReplyLength is the largest reply that access times are put into. Larger replies are
+	// passed through with the modification time as the access time.
+	maxAccessTimeReplyLength = 1024 * 1024
+
+	// maxPendingAccessTimes bounds the requests, handles and access times kept for each session.
+	maxPendingAccessTimes = 10000
+)
+
+// accessTimes holds the access times of the entries the handler returned, keyed by their path in the
+// project prefixed with the project's slug, until they are put into the replies by accessTimeRewriter.
+// The sftp package always reports a file's modification time as its access time, and has no way to
+// change it.
+type accessTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func newAccessTimes() *accessTimes {
+	return &accessTimes{times: make(map[string]time.Time)}
+}
+
+func (a *accessTimes) set(key string, t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.times) >= maxPendingAccessTimes {
+		// Times are left behind for replies too large to rewrite, so start again rather than grow.
+		a.times = make(map[string]time.Time)
+	}
+	a.times[key] = t
+}
+
+func (a *accessTimes) take(key string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.times[key]
+	delete(a.times, key)
+	return t, ok
+}
+
+// recordAccessTimes looks up when the files, in the directory at dirPath in the project, were last read,
+// for the replies to the request being handled. It does nothing when access times aren't tracked.
+func (h *mcfsHandler) recordAccessTimes(project *mcmodel.Project, dirPath string, files []mcmodel.File) {
+	if h.accessTimes == nil || len(files) == 0 {
+		return
+	}
+
+	ids := make([]int, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			ids = append(ids, file.ID)
+		}
+	}
+
+	times, err := h.coordinator.FileAccess.LastAccessTimes(ids)
+	if err != nil {
+		log.Errorf("Unable to look up the access times of %d files in project %d: %s", len(ids), project.ID, err)
+		return
+	}
+
+	for _, file := range files {
+		if t, ok := times[file.ID]; ok {
+			h.accessTimes.set(filepath.Join("/", project.Slug, dirPath, file.Name), t)
+		}
+	}
+}
+
+// accessTimeKey returns the key of the access time for p, a path sent by the client.
+func (h *mcfsHandler) accessTimeKey(p string) string {
+	slug := mc.GetProjectSlugFromPath(p)
+	projectPath, _ := mc.ParseTaggedPath(mc.RemoveProjectSlugFromPath(p, slug))
+
+	// The client may have used an alias of the project's slug.
+	if project, ok := h.projects.Load(slug); ok {
+		slug = project.(*mcmodel.Project).Slug
+	}
+
+	return filepath.Join("/", slug, projectPath)
+}
+
+// TrackAccessTimes returns rwc, the channel of the SFTP session for handlers, wrapped so that the attributes
+// sent to the client have the access times of files, when mc.Config.TrackAccessTimes is set. It returns
+// rwc if access times aren't tracked, or if handlers aren't mc-sshd's.
+func TrackAccessTimes(handlers sftp.Handlers, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	h, ok := handlers.FileCmd.(*mcfsHandler)
+	if !ok || h.accessTimes == nil {
+		return rwc
+	}
+
+	r := &accessTimeRewriter{
+		h:        h,
+		requests: make(map[uint32]accessTimeRequest),
+		handles:  make(map[string]string),
+	}
+	r.packetWatcher = newPacketWatcher(rwc, collectAccessTimeRequests, r.observe)
+	return r
+}
+
+// accessTimeRequest is a request whose reply may need access times. path is the request's path, or
+// handle the handle it was made on.
+type accessTimeRequest struct {
+	packetType byte
+	path       string
+	handle     string
+}
+
+// accessTimeRewriter puts the access times the handler looked up into the replies to stat and readdir
+// requests. The replies only have the id of their request, so the path of each request is taken from the
+// requests read from the session, and the path of each handle from the replies to open requests. The
+// replies are written whole, since the sftp package can write a packet in more than one piece.
+type accessTimeRewriter struct {
+	*packetWatcher
+	h *mcfsHandler
+
+	mu       sync.Mutex
+	requests map[uint32]accessTimeRequest
+	handles  map[string]string
+
+	// header collects the start of the packet being written, up to its id, and packet collects the
+	// whole of a reply that is rewritten. remaining is the number of bytes of the packet left to write.
+	header    []byte
+	packet    []byte
+	rewrite   bool
+	remaining int
+}
+
+// collectAccessTimeRequests keeps the body of the requests whose replies may need access times, and of
+// close requests, which end handles.
+func collectAccessTimeRequests(packetType byte, length int) int {
+	switch packetType {
+	case sshFxpOpen, sshFxpOpendir, sshFxpStat, sshFxpLstat, sshFxpFstat, sshFxpReaddir, sshFxpClose:
+		if length <= maxAccessTimeRequestLength {
+			return length
+		}
+	}
+
+	return 0
+}
+
+// observe records a request read from the session. Its body is the request's uint32 id, followed by its
+// path or handle.
+func (r *accessTimeRewriter) observe(packetType byte, _ int, body []byte) {
+	id, rest, ok := unmarshalUint32(body)
+	if !ok {
+		return
+	}
+
+	s, _, ok := unmarshalString(rest)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if packetType == sshFxpClose {
+		delete(r.handles, s)
+		return
+	}
+
+	if len(r.requests) >= maxPendingAccessTimes {
+		// Requests without replies are never removed, so start again rather than grow.
+		r.requests = make(map[uint32]accessTimeRequest)
+	}
+
+	request := accessTimeRequest{packetType: packetType}
+	switch packetType {
+	case sshFxpFstat, sshFxpReaddir:
+		request.handle = s
+	default:
+		request.path = cleanPath(s)
+	}
+	r.requests[id] = request
+}
+
+func (r *accessTimeRewriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if r.remaining == 0 {
+			// The packet starts with its uint32 length, type byte and, for replies, uint32 id.
+			need := 9 - len(r.header)
+			if need > len(p) {
+				need = len(p)
+			}
+			r.header = append(r.header, p[:need]...)
+			p = p[need:]
+
+			if len(r.header) >= 5 && int(binary.BigEndian.Uint32(r.header))+4 <= len(r.header) {
+				// A packet too short to have an id, such as an empty one.
+				if err := r.flushHeader(int(binary.BigEndian.Uint32(r.header)) + 4); err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			if len(r.header) < 9 {
+				continue
+			}
+
+			length := int(binary.BigEndian.Uint32(r.header)) + 4
+			r.remaining = length - len(r.header)
+			r.rewrite = r.needsRewrite(r.header[4], length)
+			if r.rewrite {
+				r.packet = append(r.packet[:0], r.header...)
+			} else if _, err := r.packetWatcher.Write(r.header); err != nil {
+				return 0, err
+			}
+			r.header = r.header[:0]
+
+			if r.remaining == 0 {
+				if err := r.finish(); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+
+		m := r.remaining
+		if m > len(p) {
+			m = len(p)
+		}
+
+		if r.rewrite {
+			r.packet = append(r.packet, p[:m]...)
+		} else if _, err := r.packetWatcher.Write(p[:m]); err != nil {
+			return 0, err
+		}
+		p = p[m:]
+		r.remaining -= m
+
+		if r.remaining == 0 {
+			if err := r.finish(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flushHeader writes the first length bytes of the collected header, which are a whole packet, and
+// keeps the rest as the start of the next packet.
+func (r *accessTimeRewriter) flushHeader(length int) error {
+	if _, err := r.packetWatcher.Write(r.header[:length]); err != nil {
+		return err
+	}
+
+	r.header = append(r.header[:0], r.header[length:]...)
+	return nil
+}
+
+// needsRewrite returns true if the reply, whose header has been collected, answers a request whose reply
+// may need access times.
+func (r *accessTimeRewriter) needsRewrite(packetType byte, length int) bool {
+	id := binary.BigEndian.Uint32(r.header[5:9])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.requests[id]; !ok {
+		return false
+	}
+
+	switch packetType {
+	case sshFxpHandle, sshFxpName, sshFxpAttrs:
+		if length <= maxAccessTimeReplyLength {
+			return true
+		}
+	}
+
+	// Any other reply, such as an error status, ends the request.
+	delete(r.requests, id)
+	return false
+}
+
+// finish writes the collected reply, with the access times put in.
+func (r *accessTimeRewriter) finish() error {
+	if !r.rewrite {
+		return nil
+	}
+
+	r.rewrite = false
+	r.rewriteReply(r.packet)
+	_, err := r.packetWatcher.Write(r.packet)
+	return err
+}
+
+// rewriteReply puts the access times into packet, a whole reply, in place.
+func (r *accessTimeRewriter) rewriteReply(packet []byte) {
+	packetType, id, body := packet[4], binary.BigEndian.Uint32(packet[5:9]), packet[9:]
+
+	r.mu.Lock()
+	request := r.requests[id]
+	delete(r.requests, id)
+	requestPath := request.path
+	if request.handle != "" {
+		requestPath = r.handles[request.handle]
+	}
+
+	if packetType == sshFxpHandle {
+		if handle, _, ok := unmarshalString(body); ok && requestPath != "" && len(r.handles) < maxPendingAccessTimes {
+			r.handles[handle] = requestPath
+		}
+	}
+	r.mu.Unlock()
+
+	if requestPath == "" {
+		return
+	}
+
+	switch {
+	case packetType == sshFxpAttrs && request.packetType != sshFxpOpen && request.packetType != sshFxpOpendir:
+		if t, ok := r.h.accessTimes.take(r.h.accessTimeKey(requestPath)); ok {
+			setAccessTime(body, t)
+		}
+
+	case packetType == sshFxpName && request.packetType == sshFxpReaddir:
+		// The entries are a uint32 count followed by the name, long name and attributes of each entry.
+		count, rest, ok := unmarshalUint32(body)
+		if !ok {
+			return
+		}
+
+		dirKey := r.h.accessTimeKey(requestPath)
+		for i := uint32(0); i < count; i++ {
+			var name string
+			if name, rest, ok = unmarshalString(rest); !ok {
+				return
+			}
+			if _, rest, ok = unmarshalString(rest); !ok {
+				return
+			}
+
+			if t, found := r.h.accessTimes.take(path.Join(dirKey, name)); found {
+				setAccessTime(rest, t)
+			}
+
+			if rest, ok = skipAttrs(rest); !ok {
+				return
+			}
+		}
+	}
+}
+
+// setAccessTime sets the access time in attrs, which starts with the attributes' flags, if it has one.
+func setAccessTime(attrs []byte, t time.Time) {
+	offset, ok := accessTimeOffset(attrs)
+	if ok && offset+4 <= len(attrs) {
+		binary.BigEndian.PutUint32(attrs[offset:], uint32(t.Unix()))
+	}
+}
+
+// accessTimeOffset returns the offset of the access time in attrs, and false if it doesn't have one.
+func accessTimeOffset(attrs []byte) (int, bool) {
+	flags, _, ok := unmarshalUint32(attrs)
+	if !ok || flags&sshFileXferAttrACmodTime == 0 {
+		return 0, false
+	}
+
+	return 4 + attrsTimesOffset(flags), true
+}
+
+// attrsTimesOffset returns the length of the attributes, with flags, that come between the flags and the
+// access and modification times.
+func attrsTimesOffset(flags uint32) int {
+	offset := 0
+	if flags&sshFileXferAttrSize != 0 {
+		offset += 8
+	}
+	if flags&sshFileXferAttrUIDGID != 0 {
+		offset += 8
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		offset += 4
+	}
+
+	return offset
+}
+
+// skipAttrs returns what follows the attributes at the start of b.
+func skipAttrs(b []byte) ([]byte, bool) {
+	flags, rest, ok := unmarshalUint32(b)
+	if !ok {
+		return nil, false
+	}
+
+	n := attrsTimesOffset(flags)
+	if flags&sshFileXferAttrACmodTime != 0 {
+		n += 8
+	}
+	if n > len(rest) {
+		return nil, false
+	}
+	rest = rest[n:]
+
+	// The extended attributes are a uint32 count of type and data string pairs.
+	const sshFileXferAttrExtended = 0x80000000
+	if flags&sshFileXferAttrExtended != 0 {
+		count, more, ok := unmarshalUint32(rest)
+		if !ok {
+			return nil, false
+		}
+		rest = more
+
+		for i := uint32(0); i < 2*count; i++ {
+			if _, rest, ok = unmarshalString(rest); !ok {
+				return nil, false
+			}
+		}
+	}
+
+	return rest, true
+}
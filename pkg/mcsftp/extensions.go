@@ -0,0 +1,312 @@
+package mcsftp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/pkg/sftp"
+)
+
+// CapabilitiesExtension is the SFTP extended request that returns the server's capabilities for the user,
+// as a JSON mc.Capabilities in the reply's data. It is advertised in the server's version packet, with
+// the version of the capabilities document as its data, so clients know whether they can ask for it.
+const CapabilitiesExtension = "mc-capabilities@materialscommons.org"
+
+const (
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	// sshFxFailure is the status code of a request that failed.
+	sshFxFailure = 4
+
+	// maxExtendedPacketLength is the largest extended request that is checked for an extension served here.
+	// Larger requests are passed to the sftp package.
+	maxExtendedPacketLength = 64 * 1024
+
+	// maxExtensionRequests is the number of extended requests served here that a session can have in
+	// progress at once. Requests past it fail straight away, so that a client can't start an unbounded
+	// number of them.
+	maxExtensionRequests = 16
+)
+
+// extensionServer answers the SFTP extended requests that mc-sshd adds. The sftp package replies that
+// extended requests it doesn't know are unsupported, and has no way to add them, so the requests are taken
+// out of the data read from the session before the sftp package sees it, and the replies are written
+// between the packets the sftp package writes.
+type extensionServer struct {
+	rwc io.ReadWriteCloser
+
+	// extensions returns the data of the reply to each extended request served here, given the data of
+	// the request that follows the extension's name. They are run in the background, since they may wait,
+	// with a context that is done when the session ends.
+	extensions map[string]func(ctx context.Context, data []byte) ([]byte, error)
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// inProgress holds a slot for each request being answered, up to maxExtensionRequests.
+	inProgress chan struct{}
+
+	// advertised are the extensions added to the version packet, with their data.
+	advertised [][2]string
+
+	// pending is data read from the session that is still to be returned by Read, and remaining is the
+	// rest of the packet being passed through.
+	pending   []byte
+	remaining int
+
+	mu sync.Mutex
+	// out follows the packets written by the sftp package, so that replies are only written between them.
+	// betweenPackets is signaled when a packet has been written.
+	out            packetBoundary
+	betweenPackets *sync.Cond
+	versionSeen    bool
+}
+
+// ServeExtensions returns rwc, the channel of the SFTP session for handlers, wrapped so that the extended
+// requests mc-sshd adds, such as CapabilitiesExtension, are answered. It returns rwc if handlers aren't
+// mc-sshd's.
+func ServeExtensions(handlers sftp.Handlers, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	h, ok := handlers.FileCmd.(*mcfsHandler)
+	if !ok {
+		return rwc
+	}
+
+	s := &extensionServer{
+		rwc: rwc,
+		extensions: map[string]func(ctx context.Context, data []byte) ([]byte, error){
+			CapabilitiesExtension: h.capabilities,
+			SliceExtension:        h.slice,
+			TagExtension:          h.tag,
+		},
+		advertised: [][2]string{{CapabilitiesExtension, "1"}, {SliceExtension, "1"}, {TagExtension, "1"}},
+		inProgress: make(chan struct{}, maxExtensionRequests),
+	}
+
+	if h.coordinator.FileWatcher != nil {
+		s.extensions[WatchExtension] = h.watch
+		s.advertised = append(s.advertised, [2]string{WatchExtension, "1"})
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.betweenPackets = sync.NewCond(&s.mu)
+	return s
+}
+
+// capabilities returns the reply to CapabilitiesExtension.
+func (h *mcfsHandler) capabilities(_ context.Context, _ []byte) ([]byte, error) {
+	return json.Marshal(h.config.Capabilities(h.user.Slug))
+}
+
+func (s *extensionServer) Read(p []byte) (int, error) {
+	for {
+		if len(s.pending) != 0 {
+			n := copy(p, s.pending)
+			s.pending = s.pending[n:]
+			return n, nil
+		}
+
+		if s.remaining > 0 {
+			if len(p) > s.remaining {
+				p = p[:s.remaining]
+			}
+			n, err := s.rwc.Read(p)
+			s.remaining -= n
+			return n, err
+		}
+
+		// A packet starts with its uint32 length, which includes the type byte that follows it.
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(s.rwc, header); err != nil {
+			return 0, err
+		}
+
+		length := int(binary.BigEndian.Uint32(header))
+		if header[4] != sshFxpExtended || length < 1 || length > maxExtendedPacketLength {
+			s.pending, s.remaining = header, length-1
+			continue
+		}
+
+		body := make([]byte, length-1)
+		if _, err := io.ReadFull(s.rwc, body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		if !s.serve(body) {
+			s.pending = append(header, body...)
+		}
+	}
+}
+
+// serve answers the extended request with body, which is the request's uint32 id followed by the name of
+// the extension. It returns false if the extension isn't served here. When the session already has
+// maxExtensionRequests requests in progress the request fails with SSH_FX_FAILURE.
+func (s *extensionServer) serve(body []byte) bool {
+	id, rest, ok := unmarshalUint32(body)
+	if !ok {
+		return false
+	}
+
+	name, data, ok := unmarshalString(rest)
+	if !ok {
+		return false
+	}
+
+	extension, ok := s.extensions[name]
+	if !ok {
+		return false
+	}
+
+	select {
+	case s.inProgress <- struct{}{}:
+	default:
+		log.Errorf("Refusing SFTP extended request %s, %d requests are already in progress", name, cap(s.inProgress))
+		s.send(name, failureReply(id, "too many extended requests in progress"))
+		return true
+	}
+
+	// The request is answered in the background so that reading requests doesn't wait for the extension,
+	// or for the client to read replies.
+	go func() {
+		defer func() { <-s.inProgress }()
+
+		var reply []byte
+		if data, err := extension(s.ctx, data); err != nil {
+			log.Errorf("Unable to answer SFTP extended request %s: %s", name, err)
+			reply = failureReply(id, err.Error())
+		} else {
+			reply = marshalPacket(sshFxpExtendedReply, id, data)
+		}
+
+		s.send(name, reply)
+	}()
+
+	return true
+}
+
+// send writes reply, to the extended request name, once the packet being written has been written.
+func (s *extensionServer) send(name string, reply []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.out.atBoundary() {
+		s.betweenPackets.Wait()
+	}
+
+	if _, err := s.rwc.Write(reply); err != nil && s.ctx.Err() == nil {
+		log.Errorf("Unable to send reply to SFTP extended request %s: %s", name, err)
+	}
+}
+
+func (s *extensionServer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := p
+	if !s.versionSeen && s.out.atBoundary() {
+		s.versionSeen = true
+		b = s.advertise(p)
+	}
+
+	n, err := s.rwc.Write(b)
+	s.out.advance(b[:n])
+	if s.out.atBoundary() {
+		s.betweenPackets.Broadcast()
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// advertise adds the extensions served here to p, if it is the whole of the server's version packet.
+func (s *extensionServer) advertise(p []byte) []byte {
+	if len(p) < 5 || p[4] != sshFxpVersion || int(binary.BigEndian.Uint32(p)) != len(p)-4 {
+		return p
+	}
+
+	b := append([]byte(nil), p...)
+	for _, extension := range s.advertised {
+		b = marshalString(b, extension[0])
+		b = marshalString(b, extension[1])
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func (s *extensionServer) Close() error {
+	s.cancel()
+	return s.rwc.Close()
+}
+
+// packetBoundary follows the framing of SFTP packets through the data written to a session.
+type packetBoundary struct {
+	header    []byte
+	remaining int
+}
+
+func (pb *packetBoundary) advance(b []byte) {
+	for len(b) > 0 {
+		if pb.remaining == 0 {
+			need := 4 - len(pb.header)
+			if need > len(b) {
+				need = len(b)
+			}
+			pb.header = append(pb.header, b[:need]...)
+			b = b[need:]
+			if len(pb.header) < 4 {
+				return
+			}
+
+			pb.remaining = int(binary.BigEndian.Uint32(pb.header))
+			pb.header = pb.header[:0]
+			continue
+		}
+
+		n := pb.remaining
+		if n > len(b) {
+			n = len(b)
+		}
+		pb.remaining -= n
+		b = b[n:]
+	}
+}
+
+func (pb *packetBoundary) atBoundary() bool {
+	return pb.remaining == 0 && len(pb.header) == 0
+}
+
+// marshalPacket returns the SFTP packet of packetType for the request with id, with the fields appended.
+func marshalPacket(packetType byte, id uint32, fields ...[]byte) []byte {
+	b := make([]byte, 4, 64)
+	b = append(b, packetType)
+	b = marshalUint32(b, id)
+	for _, field := range fields {
+		b = append(b, field...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+// failureReply returns the SSH_FX_FAILURE status packet for the request with id, with message.
+func failureReply(id uint32, message string) []byte {
+	return marshalPacket(sshFxpStatus, id, marshalUint32(nil, sshFxFailure), marshalString(nil, message), marshalString(nil, ""))
+}
+
+func marshalUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func marshalString(b []byte, s string) []byte {
+	return append(marshalUint32(b, uint32(len(s))), s...)
+}
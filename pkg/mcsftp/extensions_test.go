@@ -0,0 +1,82 @@
+package mcsftp
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingChannel is a session channel that records the packets written to it.
+type recordingChannel struct {
+	io.Reader
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (c *recordingChannel) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets = append(c.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *recordingChannel) Close() error {
+	return nil
+}
+
+// replies returns the type and request id of each packet written.
+func (c *recordingChannel) replies() map[uint32]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	replies := make(map[uint32]byte)
+	for _, packet := range c.packets {
+		id, _, _ := unmarshalUint32(packet[5:])
+		replies[id] = packet[4]
+	}
+
+	return replies
+}
+
+func TestExtensionServerLimitsRequestsInProgress(t *testing.T) {
+	release := make(chan struct{})
+	channel := &recordingChannel{}
+	s := &extensionServer{
+		rwc: channel,
+		extensions: map[string]func(ctx context.Context, data []byte) ([]byte, error){
+			"wait@example.com": func(ctx context.Context, _ []byte) ([]byte, error) {
+				<-release
+				return nil, nil
+			},
+		},
+		inProgress: make(chan struct{}, 2),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.betweenPackets = sync.NewCond(&s.mu)
+	defer s.Close()
+
+	request := func(id uint32) []byte {
+		return marshalString(marshalUint32(nil, id), "wait@example.com")
+	}
+
+	require.True(t, s.serve(request(1)))
+	require.True(t, s.serve(request(2)))
+
+	// The third request fails straight away, while the others are still in progress.
+	require.True(t, s.serve(request(3)))
+	require.Equal(t, map[uint32]byte{3: sshFxpStatus}, channel.replies())
+
+	close(release)
+	require.Eventually(t, func() bool { return len(channel.replies()) == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, byte(sshFxpExtendedReply), channel.replies()[1])
+	require.Equal(t, byte(sshFxpExtendedReply), channel.replies()[2])
+
+	// Once the requests have been answered there is room for more.
+	require.Eventually(t, func() bool { return len(s.inProgress) == 0 }, time.Second, time.Millisecond)
+	require.True(t, s.serve(request(4)))
+	require.Eventually(t, func() bool { return channel.replies()[4] == sshFxpExtendedReply }, time.Second, time.Millisecond)
+}
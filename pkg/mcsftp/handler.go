@@ -1,9 +1,12 @@
 package mcsftp
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
@@ -35,11 +38,29 @@ type mcfsHandler struct {
 	// user is the Materials Commons user for this SFTP session.
 	user *mcmodel.User
 
+	// env holds the hints the client sent as SSH environment variables, such as the default project
+	// and the tag for uploaded files.
+	env mc.SessionEnv
+
 	stores *mc.Stores
 
 	// mcfsRoot is the directory path where Materials Commons files are being read from/written to.
 	mcfsRoot string
 
+	// coordinator holds the state shared across all sessions, such as the write locks that prevent
+	// two sessions from writing to the same path at the same time.
+	coordinator *mc.Coordinator
+
+	// config holds the deployment configurable settings, such as timeouts.
+	config *mc.Config
+
+	// ignoreList determines which uploaded files and directories are skipped. It collects the
+	// patterns from any .mcignore files uploaded in this session.
+	ignoreList *mc.IgnoreList
+
+	// manifests collects the manifests uploaded in this session. They are verified by FinishSession.
+	manifests *mc.ManifestVerifier
+
 	// Tracks all the projects the user has accessed that they also have rights to.
 	// The key is the project slug.
 	// If this were a map it would look like: map[string]*mcmodel.Project
@@ -49,14 +70,67 @@ type mcfsHandler struct {
 	// The key is the project slug.
 	// If this were a map it would look like: map[string]bool
 	projectsWithoutAccess sync.Map
+
+	// session is this session in the coordinator's SessionRegistry. It is nil when sessions aren't being
+	// tracked.
+	session *mc.TrackedSession
+
+	// remoteAddr is the address the client connected from, which is checked against the networks a
+	// project is restricted to.
+	remoteAddr net.Addr
+
+	// authDuration is how long authenticating the session took, for the timing of its transfers.
+	authDuration time.Duration
+
+	// uploadSource is recorded as the provenance of the files uploaded in the session.
+	uploadSource mc.UploadSource
+
+	// summary totals up the files transferred in this session, and the failures.
+	summary *mc.SessionSummary
+
+	// writeBudget bounds the memory held by the writes of all the files uploaded in this session.
+	writeBudget *mc.WriteBudget
+
+	// symlinkTargets holds the targets of symlink requests as the client sent them (see WatchSymlinks).
+	symlinkTargets *symlinkTargets
+
+	// openWrites holds the files the session has open for write, for Setstat (see setstat).
+	openWrites *openWrites
+
+	// dirs creates the directories written to by the session's uploads, each once.
+	dirs *mc.DirMaterializer
+
+	// accessTimes holds the access times of the entries being returned, when mc.Config.TrackAccessTimes is
+	// set (see TrackAccessTimes). It is nil otherwise.
+	accessTimes *accessTimes
+
+	// scratch returns the connection's scratch area, served as mc.ScratchDirName. It is nil when scratch
+	// areas aren't turned on (see SetScratchArea).
+	scratch func() (*mc.ScratchArea, error)
 }
 
 // NewMCFSHandler creates a new handler. This is called each time a user connects to the SFTP server.
-func NewMCFSHandler(user *mcmodel.User, stores *mc.Stores, mcfsRoot string) sftp.Handlers {
+func NewMCFSHandler(user *mcmodel.User, env mc.SessionEnv, stores *mc.Stores, coordinator *mc.Coordinator, config *mc.Config, mcfsRoot string) sftp.Handlers {
+	stores = stores.ForSession()
 	h := &mcfsHandler{
-		user:     user,
-		stores:   stores,
-		mcfsRoot: mcfsRoot,
+		user:        user,
+		env:         env,
+		stores:      stores,
+		coordinator: coordinator,
+		config:      config,
+		ignoreList:  mc.NewIgnoreList(config.IgnorePatterns),
+		manifests:   mc.NewManifestVerifier(stores, mcfsRoot),
+		mcfsRoot:    mcfsRoot,
+		summary:     mc.NewSessionSummary(),
+		writeBudget: mc.NewWriteBudget(config.SessionWriteBudget),
+
+		symlinkTargets: newSymlinkTargets(),
+		openWrites:     newOpenWrites(),
+		dirs:           mc.NewDirMaterializer(),
+	}
+
+	if config.TrackAccessTimes && coordinator.FileAccess != nil {
+		h.accessTimes = newAccessTimes()
 	}
 
 	return sftp.Handlers{
@@ -67,36 +141,198 @@ func NewMCFSHandler(user *mcmodel.User, stores *mc.Stores, mcfsRoot string) sftp
 	}
 }
 
+// FinishSession is called when the SFTP session for handlers ends. It verifies, in the background,
+// any manifests that were uploaded during the session, and ends the session's project activity.
+func FinishSession(handlers sftp.Handlers) {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		go h.manifests.VerifyAll()
+
+		h.projects.Range(func(_, project interface{}) bool {
+			if p, ok := project.(*mcmodel.Project); ok {
+				h.coordinator.Activity.SessionEnded(p.Slug, h.user.Slug)
+			}
+			return true
+		})
+	}
+}
+
+// TrackSession records the projects used by the SFTP session for handlers in session.
+func TrackSession(handlers sftp.Handlers, session *mc.TrackedSession) {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		h.session = session
+	}
+}
+
+// SessionSummary returns the summary of the transfers made in the SFTP session for handlers.
+func SessionSummary(handlers sftp.Handlers) *mc.SessionSummary {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		return h.summary
+	}
+
+	return nil
+}
+
+// SetRemoteAddr sets the address the client of the SFTP session for handlers connected from.
+func SetRemoteAddr(handlers sftp.Handlers, remoteAddr net.Addr) {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		h.remoteAddr = remoteAddr
+	}
+}
+
+// SetAuthDuration sets how long authenticating the SFTP session for handlers took.
+func SetAuthDuration(handlers sftp.Handlers, authDuration time.Duration) {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		h.authDuration = authDuration
+	}
+}
+
+// SetUploadSource sets where the uploads in the SFTP session for handlers come from, which is recorded for
+// each uploaded file (see mc.UploadProvenanceStore).
+func SetUploadSource(handlers sftp.Handlers, source mc.UploadSource) {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		h.uploadSource = source
+	}
+}
+
 // Fileread sets up read access to an existing Materials Commons file.
-func (h *mcfsHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+func (h *mcfsHandler) Fileread(r *sftp.Request) (_ io.ReaderAt, err error) {
+	started := time.Now()
+	normalizeRequestPaths(r)
+	defer func() {
+		h.summary.RecordFailure(mc.TransferDownload, r.Filepath, err)
+		err = mc.Localize(err, h.env.Language)
+	}()
+
 	flags := r.Pflags()
 	if !flags.Read {
 		log.Errorf("Attempt to open file %s for read, but flag not set to read", r.Filepath)
 		return nil, os.ErrInvalid
 	}
 
+	if ok, _ := h.inScratch(r); ok {
+		return h.readScratch(r)
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxRead); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationRead); err != nil {
+		return nil, err
+	}
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	if viewPath, ok := mc.ParseMetadataViewPath(getPathFromRequest(r)); ok {
+		project, err := h.getProject(r)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+
+		return h.readMetadataView(stores, project, viewPath)
+	}
+
+	if dir, name, ok := mc.ParsePreviewsPath(getPathFromRequest(r)); ok {
+		project, err := h.getProject(r)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+
+		return h.readPreview(r, stores, project, dir, name)
+	}
+
 	mcFile, err := h.createMCFileFromRequest(r)
 	if err != nil {
 		log.Errorf("Unable to create MCFile: %s", err)
 		return nil, os.ErrNotExist
 	}
 
-	if mcFile.file, err = h.stores.FileStore.GetFileByPath(mcFile.project.ID, getPathFromRequest(r)); err != nil {
+	if mcFile.file, err = stores.FileStore.GetFileByPath(mcFile.project.ID, getPathFromRequest(r)); err != nil {
 		log.Errorf("Unable to find file %s in project %d for user %d: %s", getPathFromRequest(r), mcFile.project.ID, h.user.ID, err)
 		return nil, os.ErrNotExist
 	}
 
-	if mcFile.fileHandle, err = os.Open(mcFile.file.ToUnderlyingFilePath(h.mcfsRoot)); err != nil {
+	// Reading a link reads the file it points at.
+	target := followLink(stores, h.user.ID, mcFile.project, getPathFromRequest(r), mcFile.file)
+	if isDanglingSymlink(mcFile.file, target) {
+		return nil, os.ErrNotExist
+	}
+	mcFile.file = target
+	download := mc.Transfer{
+		Direction: mc.TransferDownload,
+		Protocol:  "sftp",
+		UserID:    h.user.ID,
+		ProjectID: mcFile.project.ID,
+		Path:      getPathFromRequest(r),
+	}
+	mcFile.verifier = mc.NewChecksumVerifier(h.config.VerifyReads, mcFile.file, h.coordinator.Events, download)
+
+	err = mc.RunWithTimeout(r.Context(), h.config.FSTimeout, func() error {
+		// On a satellite server the file data may be read from the primary site. Opening it doesn't
+		// wait for the file to be fetched, so reading just the start or end of a large file is quick.
+		if h.coordinator.RemoteFiles != nil {
+			var err error
+			mcFile.readHandle, err = h.coordinator.RemoteFiles.Open(mcFile.file)
+			return err
+		}
+
+		f, err := os.Open(mcFile.file.ToUnderlyingFilePath(h.mcfsRoot))
+		if err != nil {
+			return err
+		}
+
+		mcFile.readHandle = f
+		return nil
+	})
+
+	if err != nil {
 		log.Errorf("Unable to open file %s: %s", mcFile.file.ToUnderlyingFilePath(h.mcfsRoot), err)
+		if errors.Is(err, os.ErrNotExist) {
+			// The file exists, but its data doesn't.
+			err = mc.ReportMissingData(stores, h.coordinator.Events, mcFile.file, download)
+			h.coordinator.Repairer.Queue(mcFile.file)
+			return nil, err
+		}
 		return nil, os.ErrNotExist
 	}
 
+	if h.config.TrackAccessTimes {
+		h.coordinator.FileAccess.Accessed(mcFile.project.ID, mcFile.file.ID, getPathFromRequest(r))
+	}
+
+	mcFile.resolved(h.authDuration, started)
+
 	return mcFile, nil
 }
 
 // Filewrite sets up a file for writing. It creates a file or new file version in Materials Commons
 // as well as the underlying real physical file to write to.
-func (h *mcfsHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+func (h *mcfsHandler) Filewrite(r *sftp.Request) (_ io.WriterAt, err error) {
+	started := time.Now()
+	normalizeRequestPaths(r)
+	defer func() {
+		h.summary.RecordFailure(mc.TransferUpload, r.Filepath, err)
+		err = mc.Localize(err, h.env.Language)
+	}()
+
+	// The scratch area is on local disk, so it can be written to even on a read-only server.
+	if ok, _ := h.inScratch(r); ok {
+		return h.writeScratch(r)
+	}
+
+	if h.config.ReadOnly {
+		return nil, mc.ErrReadOnly
+	}
+
+	if inMetadataView(r) {
+		return nil, mc.ErrMetadataView
+	}
+
+	if inPreviews(r) {
+		return nil, mc.ErrPreviews
+	}
+
 	flags := r.Pflags()
 	if !flags.Write {
 		// Pathological case, Filewrite should always have the flags.Write set to true.
@@ -104,6 +340,40 @@ func (h *mcfsHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, os.ErrInvalid
 	}
 
+	// The tags have to be taken from the path before it is sanitized, which drops them.
+	tags := append(getTagsFromRequest(r), h.env.UploadTag)
+
+	if err := h.sanitizeRequestPath(r); err != nil {
+		log.Errorf("User %d attempted to write %s: %s", h.user.ID, r.Filepath, err)
+		return nil, err
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxWrite); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationWrite); err != nil {
+		return nil, err
+	}
+
+	if h.ignoreList.IsIgnored(getPathFromRequest(r)) {
+		// Ignored files are accepted from the client but their contents are thrown away.
+		return discardWriterAt{}, nil
+	}
+
+	if err := mc.ValidatePathLimits(getPathFromRequest(r), h.config); err != nil {
+		log.Errorf("User %d attempted to write %s: %s", h.user.ID, r.Filepath, err)
+		return nil, err
+	}
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	if err := h.waitForFinalizeCapacity(r); err != nil {
+		log.Errorf("Throttled write of %s by user %d: %s", r.Filepath, h.user.ID, err)
+		return nil, err
+	}
+
 	// Set up the initial SFTP request file state.
 	mcFile, err := h.createMCFileFromRequest(r)
 	if err != nil {
@@ -111,22 +381,58 @@ func (h *mcfsHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, os.ErrNotExist
 	}
 
+	// Only one session at a time may write to a path. The lock is released in mcfile.Close(), or
+	// below if setting up the file for writing fails.
+	path := getPathFromRequest(r)
+	if err := h.coordinator.PathLocker.Lock(mcFile.project.ID, path); err != nil {
+		log.Errorf("User %d attempted to write to %s in project %d while it was being written: %s", h.user.ID, path, mcFile.project.ID, err)
+		return nil, err
+	}
+
+	if err := mc.CheckOverwrite(stores.FileStore, mcFile.project, path, h.config); err != nil {
+		log.Errorf("User %d attempted to overwrite %s in project %d: %s", h.user.ID, path, mcFile.project.ID, err)
+		h.coordinator.PathLocker.Unlock(mcFile.project.ID, path)
+		return nil, err
+	}
+
+	if err := mc.CheckAdvisoryLock(h.coordinator.AdvisoryLocker, mcFile.project.ID, path, h.user.ID); err != nil {
+		log.Errorf("User %d attempted to write %s in project %d: %s", h.user.ID, path, mcFile.project.ID, err)
+		h.coordinator.PathLocker.Unlock(mcFile.project.ID, path)
+		return nil, err
+	}
+
+	mcFile.coordinator = h.coordinator
+	mcFile.path = path
+	mcFile.tags = tags
+	mcFile.quota = mc.NewQuotaReservation(h.coordinator.QuotaCounter, h.stores, h.config, mcFile.project)
+
 	// Create the Materials Commons file. This handles version creation.
 	fileName := filepath.Base(r.Filepath)
-	mcFile.file, err = h.stores.FileStore.CreateFile(fileName, mcFile.project.ID, mcFile.dir.ID, h.user.ID, mc.GetMimeType(fileName))
+	mcFile.file, err = stores.FileStore.CreateFile(fileName, mcFile.project.ID, mcFile.dir.ID, h.user.ID, mc.GetMimeType(fileName))
 	if err != nil {
 		log.Errorf("Error creating file %s for user %d in directory %d of project %d: %s", fileName, h.user.ID, mcFile.dir.ID, mcFile.project.ID, err)
+		h.coordinator.PathLocker.Unlock(mcFile.project.ID, path)
 		return nil, os.ErrNotExist
 	}
 
 	// Create the directory path where the file will be written to
-	if err := os.MkdirAll(mcFile.file.ToUnderlyingDirPath(h.mcfsRoot), 0777); err != nil {
+	if err = h.dirs.StorageDir(r.Context(), h.config.FSTimeout, mcFile.file.ToUnderlyingDirPath(h.mcfsRoot)); err != nil {
 		log.Errorf("Error creating directory path %s: %s", mcFile.file.ToUnderlyingDirPath(h.mcfsRoot), err)
+		_ = mc.AbortFile(stores, mcFile.file, h.mcfsRoot)
+		h.coordinator.PathLocker.Unlock(mcFile.project.ID, path)
 		return nil, os.ErrNotExist
 	}
 
-	if mcFile.fileHandle, err = os.Create(mcFile.file.ToUnderlyingFilePath(h.mcfsRoot)); err != nil {
+	err = mc.RunWithTimeout(r.Context(), h.config.FSTimeout, func() error {
+		var err error
+		mcFile.fileHandle, err = os.Create(mcFile.file.ToUnderlyingFilePath(h.mcfsRoot))
+		return err
+	})
+
+	if err != nil {
 		log.Errorf("Error creating file %s on filesystem: %s", mcFile.file.ToUnderlyingFilePath(h.mcfsRoot), err)
+		_ = mc.AbortFile(stores, mcFile.file, h.mcfsRoot)
+		h.coordinator.PathLocker.Unlock(mcFile.project.ID, path)
 		return nil, err
 	}
 
@@ -134,6 +440,8 @@ func (h *mcfsHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	// it know whether it needs to update statistics about the file (only when openForWrite is true).
 	mcFile.openForWrite = true
 	mcFile.hasher = md5.New()
+	h.openWrites.add(r.Filepath, mcFile)
+	mcFile.resolved(h.authDuration, started)
 
 	return mcFile, nil
 }
@@ -149,22 +457,97 @@ func (h *mcfsHandler) createMCFileFromRequest(r *sftp.Request) (*mcfile, error)
 
 	path := getPathFromRequest(r)
 
-	dir, err := h.stores.FileStore.GetDirByPath(project.ID, filepath.Dir(path))
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	dir, err := stores.FileStore.GetDirByPath(project.ID, filepath.Dir(path))
 	if err != nil {
 		log.Errorf("Error looking up directory %s in project %d: %s", filepath.Dir(path), project.ID, err)
 		return nil, os.ErrNotExist
 	}
 
 	return &mcfile{
-		project: project,
-		dir:     dir,
-		stores:  h.stores,
+		project:     project,
+		dir:         dir,
+		stores:      h.stores,
+		config:      h.config,
+		ignoreList:  h.ignoreList,
+		manifests:   h.manifests,
+		mcfsRoot:    h.mcfsRoot,
+		path:        path,
+		transfers:   h.coordinator.Transfers,
+		fileAccess:  h.coordinator.FileAccess,
+		summary:     h.summary,
+		activity:    h.coordinator.Activity,
+		writeBudget: h.writeBudget,
+		userID:      h.user.ID,
+		userSlug:    h.user.Slug,
+		language:    h.env.Language,
+		source:      h.uploadSource,
+		openedAt:    time.Now(),
 	}, nil
 }
 
 // Filecmd supports various SFTP commands that manipulate a file and/or filesystem. It only supports
-// Mkdir for directory creation. Deletes, renames, setting permissions, etc... are not supported.
-func (h *mcfsHandler) Filecmd(r *sftp.Request) error {
+// Mkdir for directory creation, Link for hard links (see link) and Symlink for symbolic links (see
+// symlink), and Setstat only changes the size of files (see setstat). Deletes and renames are not
+// supported, but they are still checked by mc.GuardDestructiveOperation, so that the guard rails are in
+// place once they are supported, and attempts on the project root and top level directories are audited
+// with their outcome (see destructiveOperation).
+func (h *mcfsHandler) Filecmd(r *sftp.Request) (err error) {
+	defer func() { err = mc.Localize(err, h.env.Language) }()
+	normalizeRequestPaths(r)
+
+	switch ok, err := h.inScratch(r); {
+	case err != nil:
+		return err
+	case ok:
+		return h.scratchCmd(r)
+	}
+
+	if h.config.ReadOnly {
+		return mc.ErrReadOnly
+	}
+
+	if inMetadataView(r) {
+		return mc.ErrMetadataView
+	}
+
+	if inPreviews(r) {
+		return mc.ErrPreviews
+	}
+
+	// The path of a symlink request is the link's target, which doesn't have to exist, so it is checked
+	// against the link's path instead.
+	if r.Method == "Symlink" {
+		return h.symlink(r)
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxWrite); err != nil {
+		return err
+	}
+
+	operation := mc.OperationWrite
+	switch r.Method {
+	case "Remove", "Rmdir":
+		operation = mc.OperationDelete
+	case "Link":
+		// The file being linked to only has to be readable, the link itself is checked by link.
+		operation = mc.OperationRead
+	}
+
+	if err := h.authorize(r, operation); err != nil {
+		return err
+	}
+
+	if r.Method == "Mkdir" && getPathFromRequest(r) == "/" {
+		// Only a project that doesn't exist is created. Any other error, such as the database being
+		// unavailable, is returned rather than taken to mean the project is missing.
+		if _, err := h.getProject(r); errors.Is(err, mc.ErrProjectNotFound) && h.config.CanCreateProjects(h.user.Slug) {
+			return h.createProject(r)
+		}
+	}
+
 	project, err := h.getProject(r)
 	if err != nil {
 		return err
@@ -172,31 +555,237 @@ func (h *mcfsHandler) Filecmd(r *sftp.Request) error {
 
 	path := getPathFromRequest(r)
 
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
 	switch r.Method {
 	case "Mkdir":
-		_, err := h.stores.FileStore.GetOrCreateDirPath(project.ID, h.user.ID, path)
+		if err := h.sanitizeRequestPath(r); err != nil {
+			log.Errorf("User %d attempted to create directory %s: %s", h.user.ID, r.Filepath, err)
+			return err
+		}
+
+		// Sanitizing can change the path, so an instrument account's drop box, and the policy, are
+		// checked again.
+		if err := h.checkDropBox(r, mc.DropBoxWrite); err != nil {
+			return err
+		}
+
+		if err := h.authorize(r, mc.OperationWrite); err != nil {
+			return err
+		}
+
+		path = getPathFromRequest(r)
+		if h.ignoreList.IsIgnored(path) {
+			return nil
+		}
+
+		if err := mc.ValidatePathLimits(path, h.config); err != nil {
+			log.Errorf("User %d attempted to create directory %s: %s", h.user.ID, r.Filepath, err)
+			return err
+		}
+
+		_, err := h.dirs.ProjectDir(stores.FileStore, project.ID, h.user.ID, path)
 		if err != nil {
 			log.Errorf("Unable find or create directory path %s in project %d for user %d: %s", path, project.ID, h.user.ID, err)
 		}
 		return err
 	case "Rename":
-		return fmt.Errorf("unsupported command: 'Rename'")
+		return h.destructiveOperation(r, stores, project, mc.OpRename, path)
 	case "Rmdir":
-		return fmt.Errorf("unsupported command: 'Rmdir'")
+		return h.destructiveOperation(r, stores, project, mc.OpRmdir, path)
+	case "Remove":
+		return h.destructiveOperation(r, stores, project, mc.OpRemove, path)
 	case "Setstat":
-		return fmt.Errorf("unsupported command: 'Setstat'")
+		return h.setstat(r, stores, project, path)
 	case "Link":
-		return fmt.Errorf("unsupported command: 'Link'")
-	case "Symlink":
-		return fmt.Errorf("unsupported command: 'Symlink'")
+		return h.link(r, stores, project, path)
 	default:
 		return fmt.Errorf("unsupport command: '%s'", r.Method)
 	}
 }
 
-// Filelist handles the different SFTP file list type commands. We only support List (directory listing)
-// and Stat. Things like Readlink don't make sense for Materials Commons.
+// link handles the hardlink@openssh.com extension, linking r.Target to the file at path in the project,
+// without copying its data (see mc.LinkFile). The link has to be in the same project, and, like ln, it
+// can't replace an existing file.
+func (h *mcfsHandler) link(r *sftp.Request, stores *mc.Stores, project *mcmodel.Project, path string) error {
+	if err := h.config.Features.Check(mc.FeatureHardLinks, h.user.Slug, project.Slug); err != nil {
+		return err
+	}
+
+	if mc.GetProjectSlugFromPath(r.Target) != project.Slug {
+		return mc.ErrCrossProjectLink
+	}
+
+	linkPath, _ := mc.ParseTaggedPath(mc.RemoveProjectSlugFromPath(r.Target, project.Slug))
+	if err := h.config.CheckDropBoxAccess(h.user.Slug, project.Slug, linkPath, mc.DropBoxWrite); err != nil {
+		log.Errorf("Instrument account %d denied link of %s to %s: %s", h.user.ID, r.Target, r.Filepath, err)
+		return err
+	}
+
+	req := mc.NewAuthorizationRequest(h.config.Scopes, h.user, "sftp", mc.OperationWrite)
+	req.ProjectSlug, req.Path = project.Slug, linkPath
+	if err := mc.Authorize(r.Context(), h.coordinator.Authorizer, req); err != nil {
+		return err
+	}
+
+	if err := mc.ValidatePathLimits(linkPath, h.config); err != nil {
+		log.Errorf("User %d attempted to link %s: %s", h.user.ID, r.Target, err)
+		return err
+	}
+
+	source, err := stores.FileStore.GetFileByPath(project.ID, path)
+	if err != nil {
+		return os.ErrNotExist
+	}
+
+	dir, err := stores.FileStore.GetDirByPath(project.ID, filepath.Dir(linkPath))
+	if err != nil {
+		return os.ErrNotExist
+	}
+
+	if err := h.coordinator.PathLocker.Lock(project.ID, linkPath); err != nil {
+		return err
+	}
+	defer h.coordinator.PathLocker.Unlock(project.ID, linkPath)
+
+	if _, err := mc.StatPath(stores.FileStore, project.ID, linkPath); err == nil {
+		return os.ErrExist
+	}
+
+	link, err := mc.LinkFile(stores, source, dir, filepath.Base(linkPath), h.user.ID, h.mcfsRoot)
+	if err != nil {
+		log.Errorf("User %d was unable to link %s to %s in project %d: %s", h.user.ID, linkPath, path, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d linked %s (file %d) to %s (file %d) in project %d", h.user.ID, linkPath, link.ID, path, source.ID, project.ID)
+	return nil
+}
+
+// symlink handles a symlink request, creating a symbolic link at r.Target that points at r.Filepath
+// (see mc.CreateSymlink). The target is kept as the client sent it, so a relative target reads back
+// relative. Like ln -s, the target doesn't have to exist, but the link can't replace an existing file.
+func (h *mcfsHandler) symlink(r *sftp.Request) error {
+	lr := sftp.NewRequest(r.Method, r.Target).WithContext(r.Context())
+	if err := h.checkDropBox(lr, mc.DropBoxWrite); err != nil {
+		return err
+	}
+
+	if err := h.authorize(lr, mc.OperationWrite); err != nil {
+		return err
+	}
+
+	project, err := h.getProject(lr)
+	if err != nil {
+		return err
+	}
+
+	if err := h.config.Features.Check(mc.FeatureSymlinks, h.user.Slug, project.Slug); err != nil {
+		return err
+	}
+
+	linkPath := getPathFromRequest(lr)
+	if err := mc.ValidatePathLimits(linkPath, h.config); err != nil {
+		log.Errorf("User %d attempted to create symbolic link %s: %s", h.user.ID, r.Target, err)
+		return err
+	}
+
+	target, ok := h.symlinkTargets.Take(r.Target)
+	if !ok {
+		target = r.Filepath
+	}
+	target = mc.ClientPathToSlash(target)
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	dir, err := stores.FileStore.GetDirByPath(project.ID, filepath.Dir(linkPath))
+	if err != nil {
+		return os.ErrNotExist
+	}
+
+	if err := h.coordinator.PathLocker.Lock(project.ID, linkPath); err != nil {
+		return err
+	}
+	defer h.coordinator.PathLocker.Unlock(project.ID, linkPath)
+
+	if _, err := mc.StatPath(stores.FileStore, project.ID, linkPath); err == nil {
+		return os.ErrExist
+	}
+
+	link, err := mc.CreateSymlink(stores, dir, filepath.Base(linkPath), target, h.user.ID, h.config.MaxPathLength, h.mcfsRoot)
+	if err != nil {
+		log.Errorf("User %d was unable to create symbolic link %s to %s in project %d: %s", h.user.ID, linkPath, target, project.ID, err)
+		return err
+	}
+
+	log.Infof("User %d created symbolic link %s (file %d) to %s in project %d", h.user.ID, linkPath, link.ID, target, project.ID)
+	return nil
+}
+
+// destructiveOperation handles Rename, Rmdir and Remove. None of them are supported, but they are checked
+// by mc.GuardDestructiveOperation first, and audited with the error the client gets.
+func (h *mcfsHandler) destructiveOperation(r *sftp.Request, stores *mc.Stores, project *mcmodel.Project, op, path string) error {
+	err := mc.GuardDestructiveOperation(stores.FileStore, h.config, h.user, project, op, path)
+	if err == nil {
+		err = fmt.Errorf("unsupported command: '%s'", r.Method)
+	}
+
+	mc.AuditDestructiveOperation(h.coordinator.Events, h.user, project, op, path, err)
+	return err
+}
+
+// createProject handles a Mkdir at the root, such as mkdir /new-project, by creating a new project owned
+// by the user. The project's slug is generated from the directory name. When that slug is already taken
+// the Mkdir fails with EEXIST.
+func (h *mcfsHandler) createProject(r *sftp.Request) error {
+	name := mc.GetProjectSlugFromPath(r.Filepath)
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	project, err := mc.CreateProjectFromName(stores, name, h.user.ID)
+	if err != nil {
+		log.Errorf("User %d was unable to create project '%s': %s", h.user.ID, name, err)
+		return err
+	}
+
+	log.Infof("User %d created project %d (%s) over SFTP", h.user.ID, project.ID, project.Slug)
+
+	// The slug may have been looked up, and not found, before the project was created.
+	h.projectsWithoutAccess.Delete(project.Slug)
+	h.cacheProject(project.Slug, project)
+
+	return nil
+}
+
+// Filelist handles the different SFTP file list type commands. We support List (directory listing), Stat
+// and Readlink. Materials Commons file links are presented as symbolic links, and files in write-once paths
+// as read-only.
 func (h *mcfsHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	normalizeRequestPaths(r)
+
+	if ok, _ := h.inScratch(r); ok {
+		return h.listScratch(r)
+	}
+
+	access := mc.DropBoxRead
+	if r.Method == "Stat" {
+		access = mc.DropBoxStat
+	}
+
+	if err := h.checkDropBox(r, access); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationList); err != nil {
+		return nil, err
+	}
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
 	// The reason this check for the filepath and method isn't done in the case statement below
 	// when matching on "List" for the method is that this is a specialized case, where the user
 	// is looking at /, and there isn't a project, so we need to build a list of projects and return
@@ -205,11 +794,17 @@ func (h *mcfsHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	if r.Filepath == "/" && r.Method == "List" {
 		// Root path listing, so build a list of project stubs that the user has access to. Treat each
 		// of these as a directory in the root.
-		projects, err := h.stores.ProjectStore.GetProjectsForUser(h.user.ID)
+		projects, err := stores.ProjectStore.GetProjectsForUser(h.user.ID)
 		if err != nil {
 			return nil, fmt.Errorf("unable to get list of projects: %s", err)
 		}
 
+		// Only the projects the user can open from where they are connected are listed.
+		listReq := mc.NewAuthorizationRequest(h.config.Scopes, h.user, "sftp", mc.OperationList)
+		if projects, err = mc.AccessibleProjects(r.Context(), stores, h.coordinator.Authorizer, listReq, h.remoteAddr, projects); err != nil {
+			return nil, fmt.Errorf("unable to get list of projects: %s", err)
+		}
+
 		var projectList []os.FileInfo
 
 		// Go through each project creating a fake file (directory) that is the project slug
@@ -221,22 +816,19 @@ func (h *mcfsHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 				Path:      filepath.Join("/", project.Slug),
 				UpdatedAt: project.UpdatedAt,
 			}
-			projectList = append(projectList, f.ToFileInfo())
+			projectList = append(projectList, mc.ModeFileInfo(h.config, project.Slug, h.user.Slug, f.ToFileInfo()))
 		}
 
-		return listerat(projectList), nil
+		if fi := h.scratchDirFileInfo(); fi != nil {
+			projectList = append(projectList, fi)
+		}
+
+		return listerat(mc.ArrangeListing(h.config, h.rootFileInfo(), nil, projectList)), nil
 	}
 
 	if r.Filepath == "/" && r.Method == "Stat" {
 		// Stat of root path so create a fake one so there is no error
-		f := mcmodel.File{
-			Name:      "/",
-			MimeType:  "directory",
-			Size:      0,
-			Path:      "/",
-			UpdatedAt: time.Now(),
-		}
-		return listerat{f.ToFileInfo()}, nil
+		return listerat{h.rootFileInfo()}, nil
 	}
 
 	// If we are here then we are in a project path context, so do the usual steps to retrieve the project. That
@@ -248,40 +840,190 @@ func (h *mcfsHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		return nil, os.ErrNotExist
 	}
 
+	if viewPath, ok := mc.ParseMetadataViewPath(path); ok {
+		switch r.Method {
+		case "List":
+			return h.listMetadataView(stores, project, viewPath)
+		case "Stat":
+			return h.statMetadataView(stores, project, viewPath)
+		default:
+			return nil, fmt.Errorf("'%s' is not a link: %w", path, os.ErrInvalid)
+		}
+	}
+
+	if dir, name, ok := mc.ParsePreviewsPath(path); ok {
+		switch r.Method {
+		case "List":
+			return h.listPreviews(stores, project, dir, name)
+		case "Stat":
+			return h.statPreview(stores, project, dir, name)
+		default:
+			return nil, fmt.Errorf("'%s' is not a link: %w", path, os.ErrInvalid)
+		}
+	}
+
 	switch r.Method {
 	case "List":
-		files, err := h.stores.FileStore.ListDirectoryByPath(project.ID, path)
+		if lister := h.pagedListing(stores, project, path); lister != nil {
+			return lister, nil
+		}
+
+		files, err := stores.FileStore.ListDirectoryByPath(project.ID, path)
 		if err != nil {
 			log.Errorf("Unable to list directory %s in project %d: %s", path, project.ID, err)
 			return nil, os.ErrNotExist
 		}
 
-		var fileList []os.FileInfo
-		for _, f := range files {
-			fileList = append(fileList, f.ToFileInfo())
+		fileInfos := h.listingFileInfos(stores, project, path, files)
+		if !h.config.ListDotEntries {
+			return listerat(mc.ArrangeListing(h.config, nil, nil, fileInfos)), nil
 		}
-		return listerat(fileList), nil
+
+		dir, parent := h.dotEntries(stores, project, path)
+		return listerat(mc.ArrangeListing(h.config, dir, parent, fileInfos)), nil
 
 	case "Stat":
-		file, err := h.stores.FileStore.GetFileByPath(project.ID, path)
+		file, err := mc.StatPath(stores.FileStore, project.ID, path)
 		if err != nil {
 			log.Errorf("Unable to lookup file %s in project %d: %s", path, project.ID, err)
 			return nil, os.ErrNotExist
 		}
-		fi := file.ToFileInfo()
-		s := listerat{&fi}
-		return s, nil
+
+		// Stat follows links, but the entry keeps the name of the link.
+		target := followLink(stores, h.user.ID, project, path, file)
+		if isDanglingSymlink(file, target) {
+			return nil, os.ErrNotExist
+		}
+
+		// The entry has the access time of the link's target.
+		linked := *target
+		linked.Name = file.Name
+		h.recordAccessTimes(project, filepath.Dir(path), []mcmodel.File{linked})
+
+		fi := mc.ModeFileInfo(h.config, project.Slug, h.user.Slug, target.ToFileInfo())
+		fi = mc.WriteOnceFileInfo(h.config, project.Slug, path, fi)
+		return listerat{namedFileInfo{FileInfo: fi, name: file.Name}}, nil
 
 	case "Readlink":
-		return nil, fmt.Errorf("unsupported command: 'Readlink'")
+		file, err := mc.StatPath(stores.FileStore, project.ID, path)
+		if err != nil {
+			log.Errorf("Unable to lookup file %s in project %d: %s", path, project.ID, err)
+			return nil, os.ErrNotExist
+		}
+
+		// Symbolic links created by clients read back the target they were given.
+		if symlinkTarget, isSymlink := mc.GetSymlinkTargets(stores, []mcmodel.File{*file})[file.ID]; isSymlink {
+			return listerat{namedFileInfo{FileInfo: file.ToFileInfo(), name: symlinkTarget}}, nil
+		}
+
+		target := followLink(stores, h.user.ID, project, path, file)
+		if target == nil {
+			return nil, os.ErrNotExist
+		}
+
+		if target == file {
+			return nil, fmt.Errorf("'%s' is not a link: %w", path, os.ErrInvalid)
+		}
+
+		targetPath, err := h.linkTargetPath(stores, target, nil)
+		if err != nil {
+			log.Errorf("Unable to lookup project %d for link %s in project %d: %s", target.ProjectID, path, project.ID, err)
+			return nil, os.ErrNotExist
+		}
+
+		return listerat{namedFileInfo{FileInfo: file.ToFileInfo(), name: targetPath}}, nil
 	default:
 		return nil, fmt.Errorf("unsupport command: '%s'", r.Method)
 	}
 }
 
-// Realpath always returns the absolute path including the project slug.
-func (h *mcfsHandler) Realpath(p string) string {
-	p = filepath.ToSlash(filepath.Clean(p))
+// listingFileInfos converts the files in the directory at path in the project into the entries of its
+// listing.
+func (h *mcfsHandler) listingFileInfos(stores *mc.Stores, project *mcmodel.Project, path string, files []mcmodel.File) []os.FileInfo {
+	fileInfos := h.toFileInfos(stores, files)
+	for i, fi := range fileInfos {
+		fi = mc.ModeFileInfo(h.config, project.Slug, h.user.Slug, fi)
+		fileInfos[i] = mc.WriteOnceFileInfo(h.config, project.Slug, filepath.Join(path, fi.Name()), fi)
+	}
+
+	h.recordAccessTimes(project, path, files)
+	return fileInfos
+}
+
+// pagedListing returns a mc.PagedListing for the directory at path in the project when it has more than
+// config.MaxListEntries entries. It returns nil for smaller directories, which are listed all at once.
+// The pages are read after the request has returned, so they are read with h.stores rather than the
+// request's stores.
+func (h *mcfsHandler) pagedListing(stores *mc.Stores, project *mcmodel.Project, path string) sftp.ListerAt {
+	if h.config.MaxListEntries <= 0 {
+		return nil
+	}
+
+	dir, err := stores.FileStore.GetDirByPath(project.ID, path)
+	if err != nil {
+		// Listing the directory all at once reports the error.
+		return nil
+	}
+
+	count, err := stores.ListingStore.CountDirectoryEntries(project.ID, dir.ID)
+	if err != nil {
+		log.Errorf("Unable to count the entries in directory %s in project %d: %s", path, project.ID, err)
+		return nil
+	}
+
+	if count <= int64(h.config.MaxListEntries) {
+		return nil
+	}
+
+	log.Infof("Listing directory %s in project %d, which has %d entries, %d entries at a time", path, project.ID, count, h.config.MaxListEntries)
+
+	var dirInfo, parentInfo os.FileInfo
+	if h.config.ListDotEntries {
+		dirInfo, parentInfo = h.dotEntries(stores, project, path)
+	}
+
+	convert := func(files []mcmodel.File) []os.FileInfo {
+		return h.listingFileInfos(h.stores, project, path, files)
+	}
+
+	return mc.NewPagedListing(h.config, h.stores.ListingStore, project.ID, dir.ID, h.config.MaxListEntries, dirInfo, parentInfo, convert)
+}
+
+// rootFileInfo returns the entry for the root, which holds the projects. It isn't stored, so it is made up.
+func (h *mcfsHandler) rootFileInfo() os.FileInfo {
+	f := mcmodel.File{
+		Name:      "/",
+		MimeType:  "directory",
+		Size:      0,
+		Path:      "/",
+		UpdatedAt: time.Now(),
+	}
+	return mc.ModeFileInfo(h.config, "", h.user.Slug, f.ToFileInfo())
+}
+
+// dotEntries returns the entries for the "." and ".." of the directory at path in the project. The ".."
+// of a project's root is the root. Either is nil if it can't be looked up.
+func (h *mcfsHandler) dotEntries(stores *mc.Stores, project *mcmodel.Project, path string) (dir, parent os.FileInfo) {
+	if f, err := mc.StatPath(stores.FileStore, project.ID, path); err == nil {
+		dir = mc.ModeFileInfo(h.config, project.Slug, h.user.Slug, f.ToFileInfo())
+	}
+
+	if path == "/" {
+		return dir, h.rootFileInfo()
+	}
+
+	if f, err := mc.StatPath(stores.FileStore, project.ID, filepath.Dir(path)); err == nil {
+		parent = mc.ModeFileInfo(h.config, project.Slug, h.user.Slug, f.ToFileInfo())
+	}
+
+	return dir, parent
+}
+
+// RealPath always returns the absolute path including the project slug. Clients resolve relative paths
+// against RealPath("."), so when the session has a default project relative paths are resolved against
+// the project's root, and the client starts out in the project.
+func (h *mcfsHandler) RealPath(p string) string {
+	p = h.env.ResolvePath(filepath.ToSlash(filepath.Clean(mc.ClientPathToSlash(p))))
 	if !filepath.IsAbs(p) {
 		return filepath.Join("/", p)
 	}
@@ -289,21 +1031,57 @@ func (h *mcfsHandler) Realpath(p string) string {
 	return p
 }
 
-// Lstat returns a single entry array containing the requested file, assuming it exists. It
-// returns os.ErrNotExist if it doesn't exist.
+// Lstat returns a single entry array containing the requested file or directory, assuming it exists.
+// It returns os.ErrNotExist if it doesn't exist. Directories are looked up the same way as for Stat,
+// see mc.StatPath.
 func (h *mcfsHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	normalizeRequestPaths(r)
+
+	if ok, _ := h.inScratch(r); ok {
+		return h.statScratch(r)
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxStat); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationList); err != nil {
+		return nil, err
+	}
+
+	// The root holds the projects and isn't stored, the same as for Stat.
+	if r.Filepath == "/" {
+		return listerat{h.rootFileInfo()}, nil
+	}
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
 	path := getPathFromRequest(r)
 	project, err := h.getProject(r)
 	if err != nil {
 		return nil, os.ErrNotExist
 	}
-	file, err := h.stores.FileStore.GetFileByPath(project.ID, path)
+
+	if viewPath, ok := mc.ParseMetadataViewPath(path); ok {
+		return h.statMetadataView(stores, project, viewPath)
+	}
+
+	if dir, name, ok := mc.ParsePreviewsPath(path); ok {
+		return h.statPreview(stores, project, dir, name)
+	}
+
+	file, err := mc.StatPath(stores.FileStore, project.ID, path)
 	if err != nil {
 		log.Errorf("Unable to lookup file %s in project %d: %s", path, project.ID, err)
 		return nil, os.ErrNotExist
 	}
-	fi := file.ToFileInfo()
-	return listerat{&fi}, nil
+
+	// Unlike Stat, Lstat doesn't follow links.
+	h.recordAccessTimes(project, filepath.Dir(path), []mcmodel.File{*file})
+	fileInfos := h.toFileInfos(stores, []mcmodel.File{*file})
+	fileInfos[0] = mc.WriteOnceFileInfo(h.config, project.Slug, path, fileInfos[0])
+	return listerat(fileInfos), nil
 }
 
 // getProject retrieves the project from the path. The r.Filepath contains the project slug as
@@ -330,7 +1108,7 @@ func (h *mcfsHandler) getProject(r *sftp.Request) (*mcmodel.Project, error) {
 			h.projects.Delete(projectSlug)
 			h.projectsWithoutAccess.Store(projectSlug, true)
 			log.Errorf("error casting to project for slug %s", projectSlug)
-			return nil, fmt.Errorf("no such project: %s", projectSlug)
+			return nil, fmt.Errorf("%w: %s", mc.ErrProjectNotFound, projectSlug)
 		}
 
 		return p, nil
@@ -338,7 +1116,7 @@ func (h *mcfsHandler) getProject(r *sftp.Request) (*mcmodel.Project, error) {
 
 	// Check if we tried to load the project in the past and failed.
 	if _, ok := h.projectsWithoutAccess.Load(projectSlug); ok {
-		return nil, fmt.Errorf("no such project: %s", projectSlug)
+		return nil, fmt.Errorf("%w: %s", mc.ErrProjectNotFound, projectSlug)
 	}
 
 	// If we are here then we've never tried loading the project.
@@ -348,22 +1126,109 @@ func (h *mcfsHandler) getProject(r *sftp.Request) (*mcmodel.Project, error) {
 		err     error
 	)
 
-	if project, err = mc.GetAndValidateProjectFromPath(r.Filepath, h.user.ID, h.stores.ProjectStore); err != nil {
-		// Error looking up or validating access. Mark this project slug as invalid.
-		h.projectsWithoutAccess.Store(projectSlug, true)
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	if project, err = mc.GetAndValidateProjectForClient(r.Filepath, h.user.ID, h.remoteAddr, stores); err != nil {
+		// Error looking up or validating access. Mark this project slug as invalid. A project the
+		// user can't reach from this network isn't cached, so that the distinct error is returned
+		// each time.
+		if errors.Is(err, mc.ErrProjectNotFound) {
+			h.projectsWithoutAccess.Store(projectSlug, true)
+		}
 		return nil, err
 	}
 
 	// Found the project and user has access so put in the projects cache.
-	h.projects.Store(projectSlug, project)
+	return h.cacheProject(projectSlug, project), nil
+}
 
-	return project, nil
+// cacheProject puts project in the projects cache, and counts the session as active in the project. If
+// a concurrent request already cached the project then the cached project is returned.
+func (h *mcfsHandler) cacheProject(projectSlug string, project *mcmodel.Project) *mcmodel.Project {
+	cached, loaded := h.projects.LoadOrStore(projectSlug, project)
+	if loaded {
+		if p, ok := cached.(*mcmodel.Project); ok {
+			return p
+		}
+		return project
+	}
+
+	h.coordinator.Activity.SessionStarted(project.Slug, h.user.Slug)
+	h.session.AddProject(project.Slug)
+	return project
+}
+
+// storesForRequest returns the stores bound to the request context, with the configured database
+// timeout applied. The returned cancel function must be called when the request is finished
+// with the stores.
+func (h *mcfsHandler) storesForRequest(r *sftp.Request) (*mc.Stores, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.DBTimeout)
+	return h.stores.WithContext(ctx), cancel
+}
+
+// waitForFinalizeCapacity waits, for up to the database timeout, for the backlog of uploads being finalized
+// to drop below its high water mark.
+func (h *mcfsHandler) waitForFinalizeCapacity(r *sftp.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.DBTimeout)
+	defer cancel()
+	return h.coordinator.WriteBackpressure.Wait(ctx)
+}
+
+// checkDropBox returns mc.ErrDropBoxOnly when the user is an instrument account that isn't allowed
+// the access to the request's path. See mc.Config.CheckDropBoxAccess.
+func (h *mcfsHandler) checkDropBox(r *sftp.Request, access mc.DropBoxAccess) error {
+	err := h.config.CheckDropBoxAccess(h.user.Slug, mc.GetProjectSlugFromPath(r.Filepath), getPathFromRequest(r), access)
+	if err != nil {
+		log.Errorf("Instrument account %d denied %s of %s: %s", h.user.ID, r.Method, r.Filepath, err)
+	}
+
+	return err
+}
+
+// authorize asks the coordinator's Authorizer whether the user can do operation on the request's path.
+// See mc.Authorize.
+func (h *mcfsHandler) authorize(r *sftp.Request, operation string) error {
+	req := mc.NewAuthorizationRequest(h.config.Scopes, h.user, "sftp", operation)
+	req.ProjectSlug, req.Path = mc.GetProjectSlugFromPath(r.Filepath), getPathFromRequest(r)
+	return mc.Authorize(r.Context(), h.coordinator.Authorizer, req)
+}
+
+// sanitizeRequestPath applies the configured SanitizePolicy to the path in r. When the policy
+// transliterates names r.Filepath is updated with the sanitized path, so that everything after
+// this call uses the sanitized names.
+func (h *mcfsHandler) sanitizeRequestPath(r *sftp.Request) error {
+	path, err := mc.SanitizePath(getPathFromRequest(r), h.config.SanitizePolicy)
+	if err != nil {
+		return err
+	}
+
+	r.Filepath = filepath.Join("/", mc.GetProjectSlugFromPath(r.Filepath), path)
+	return nil
+}
+
+// normalizeRequestPaths converts the paths of r from the Windows form that some clients send, with
+// backslashes or a drive letter, so that the rest of the handler only sees the usual form of paths. See
+// mc.NormalizeClientPath.
+func normalizeRequestPaths(r *sftp.Request) {
+	r.Filepath = mc.NormalizeClientPath(r.Filepath)
+	if r.Target != "" {
+		r.Target = mc.NormalizeClientPath(r.Target)
+	}
 }
 
 // getPathFromRequest will get the path to the file from the request after it removes the
-// project slug.
+// project slug. Any mc.TaggedDirName components are also removed, so a path such as
+// /my-project/.tagged/xrd/file.txt is treated everywhere as /file.txt.
 func getPathFromRequest(r *sftp.Request) string {
 	projectSlug := mc.GetProjectSlugFromPath(r.Filepath)
-	p := mc.RemoveProjectSlugFromPath(r.Filepath, projectSlug)
+	p, _ := mc.ParseTaggedPath(mc.RemoveProjectSlugFromPath(r.Filepath, projectSlug))
 	return p
 }
+
+// getTagsFromRequest returns the tags from the mc.TaggedDirName components in the request path.
+func getTagsFromRequest(r *sftp.Request) []string {
+	projectSlug := mc.GetProjectSlugFromPath(r.Filepath)
+	_, tags := mc.ParseTaggedPath(mc.RemoveProjectSlugFromPath(r.Filepath, projectSlug))
+	return tags
+}
@@ -0,0 +1,141 @@
+package mcsftp
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+)
+
+// maxSymlinkDepth is the number of symbolic links followed to get to a file, which stops loops of links.
+const maxSymlinkDepth = 8
+
+// linkFileInfo presents a Materials Commons file link, or a symbolic link created by a client, as a
+// symbolic link.
+type linkFileInfo struct {
+	os.FileInfo
+
+	// target is the path, as seen by the client, of the file the link points at.
+	target string
+}
+
+func (fi linkFileInfo) Mode() os.FileMode {
+	return os.ModeSymlink | 0777
+}
+
+func (fi linkFileInfo) IsDir() bool {
+	return false
+}
+
+func (fi linkFileInfo) Size() int64 {
+	return int64(len(fi.target))
+}
+
+// namedFileInfo replaces the name of a os.FileInfo. It is used when a link is followed so that the
+// entry keeps the link's name, and to return the target of a link for Readlink.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string {
+	return fi.name
+}
+
+// toFileInfos converts files into os.FileInfo entries, presenting the files that are links as
+// symbolic links. Symbolic links created by clients show their target as it was given. Links to
+// files in projects the user can't access are left out.
+func (h *mcfsHandler) toFileInfos(stores *mc.Stores, files []mcmodel.File) []os.FileInfo {
+	targets := mc.GetLinkTargets(stores, h.user.ID, files)
+	symlinks := mc.GetSymlinkTargets(stores, files)
+
+	// Links usually point within the same few projects, so only look up each project once.
+	projectSlugs := make(map[int]string)
+
+	var fileInfos []os.FileInfo
+	for _, f := range files {
+		if symlinkTarget, isSymlink := symlinks[f.ID]; isSymlink {
+			fileInfos = append(fileInfos, linkFileInfo{FileInfo: f.ToFileInfo(), target: symlinkTarget})
+			continue
+		}
+
+		target, isLink := targets[f.ID]
+		if !isLink {
+			fileInfos = append(fileInfos, f.ToFileInfo())
+			continue
+		}
+
+		if target == nil {
+			continue
+		}
+
+		targetPath, err := h.linkTargetPath(stores, target, projectSlugs)
+		if err != nil {
+			// The target project couldn't be found, present the link as a regular file.
+			fileInfos = append(fileInfos, f.ToFileInfo())
+			continue
+		}
+
+		fileInfos = append(fileInfos, linkFileInfo{FileInfo: f.ToFileInfo(), target: targetPath})
+	}
+
+	return fileInfos
+}
+
+// linkTargetPath returns the path, including the project slug, of target. projectSlugs caches the
+// slugs of the projects already looked up, and may be nil.
+func (h *mcfsHandler) linkTargetPath(stores *mc.Stores, target *mcmodel.File, projectSlugs map[int]string) (string, error) {
+	slug, ok := projectSlugs[target.ProjectID]
+	if !ok {
+		project, err := stores.ProjectStore.GetProjectByID(target.ProjectID)
+		if err != nil {
+			return "", err
+		}
+
+		slug = project.Slug
+		if projectSlugs != nil {
+			projectSlugs[target.ProjectID] = slug
+		}
+	}
+
+	return filepath.Join("/", slug, target.FullPath()), nil
+}
+
+// followLink returns the target of file, which is at path in the project, if it is a link, otherwise it
+// returns file. Symbolic links are followed until they get to a file that isn't one. A symbolic link whose
+// target doesn't exist, or is in another project, is returned as is (see isDanglingSymlink). A link to a
+// file in a project the user with userID can't access returns nil.
+func followLink(stores *mc.Stores, userID int, project *mcmodel.Project, path string, file *mcmodel.File) *mcmodel.File {
+	current := file
+	for i := 0; i < maxSymlinkDepth; i++ {
+		symlinkTarget, isSymlink := mc.GetSymlinkTargets(stores, []mcmodel.File{*current})[current.ID]
+		if !isSymlink {
+			if target, isLink := mc.GetLinkTargets(stores, userID, []mcmodel.File{*current})[current.ID]; isLink {
+				return target
+			}
+
+			return current
+		}
+
+		targetPath, ok := mc.ResolveSymlinkTarget(project.Slug, filepath.Dir(path), symlinkTarget)
+		if !ok {
+			return file
+		}
+
+		next, err := mc.StatPath(stores.FileStore, project.ID, targetPath)
+		if err != nil {
+			return file
+		}
+
+		current, path = next, targetPath
+	}
+
+	return file
+}
+
+// isDanglingSymlink returns true if target, returned by followLink for file, is a symbolic link that
+// couldn't be followed, or a link to a file the user can't access.
+func isDanglingSymlink(file, target *mcmodel.File) bool {
+	return target == nil || (target == file && file.MimeType == mc.SymlinkMimeType)
+}
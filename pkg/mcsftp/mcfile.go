@@ -2,11 +2,16 @@ package mcsftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/materials-commons/gomcdb/mcmodel"
@@ -28,9 +33,24 @@ type mcfile struct {
 	// stores are the various stores to update
 	stores *mc.Stores
 
-	// The real underlying handle to read/write the file.
+	// config holds the deployment configurable settings, such as timeouts.
+	config *mc.Config
+
+	// ignoreList is the session's ignore list. When a .mcignore file is written its patterns are
+	// added to the ignoreList in MCFile.Close().
+	ignoreList *mc.IgnoreList
+
+	// manifests is the session's ManifestVerifier. A manifest that is written is queued on it to
+	// be verified when the session ends.
+	manifests *mc.ManifestVerifier
+
+	// The real underlying handle to write the file.
 	fileHandle *os.File
 
+	// readHandle is the file's data opened for reading. On a satellite server it may still be at the
+	// primary site (see mc.RemoteFileCache.Open).
+	readHandle mc.FileReader
+
 	// openForWrite is true when the file was opened for write. This is used in MCFile.Close() to
 	// determine if file statistics and checksum handling should be done.
 	openForWrite bool
@@ -40,36 +60,250 @@ type mcfile struct {
 
 	// mcfsRoot is the directory path where Materials Commons files are being read from/written to.
 	mcfsRoot string
+
+	// coordinator is set when the file was opened for write. Its PathLocker holds the write lock
+	// for path, which is released in MCFile.Close().
+	coordinator *mc.Coordinator
+
+	// path is the project path (without the project slug) of the file.
+	path string
+
+	// quota reserves room in the project's quota for the data as it is written. It is released in
+	// MCFile.Close(). It is nil when the file wasn't opened for write.
+	quota *mc.QuotaReservation
+
+	// writeMu guards writeBuf, writeBufOffset, writeErr and writes.
+	writeMu sync.Mutex
+
+	// writeErr is the first error writing data to fileHandle. Once a write has failed the file is missing
+	// data, so every later WriteAt fails with writeErr, and Close returns it without committing the file.
+	writeErr error
+
+	// writes tracks whether the data was written sequentially, so that hasher has its checksum. Sparse
+	// writes, or a truncate (see mcfsHandler.Filecmd), mean the file has to be read for its checksum.
+	writes mc.WriteTracker
+
+	// openWrites is the session's files that are open for write, which this file is removed from when it
+	// is closed. requestPath is its key there.
+	openWrites  *openWrites
+	requestPath string
+
+	// writeBuf holds sequential writes that haven't been written to fileHandle yet. Clients usually
+	// send 32KB writes, which are slow against high latency storage under mcfsRoot, so sequential
+	// writes are coalesced into writes of up to config.WriteCoalesceSize bytes. writeBufOffset is the
+	// offset in the file of the start of writeBuf. The buffer comes from mc.GetWriteBuffer, and is
+	// reserved in writeBudget, while it holds data. It is nil when it doesn't.
+	writeBuf       []byte
+	writeBufOffset int64
+
+	// writeBudget bounds the memory held by the session's writes. It is nil when it isn't bounded.
+	writeBudget *mc.WriteBudget
+
+	// userID, openedAt and bytesRead are used to record the transfer in transfers when the file is
+	// closed. bytesRead is updated atomically.
+	transfers *mc.TransferStats
+	userID    int
+	openedAt  time.Time
+	bytesRead int64
+
+	// timing is the breakdown of the transfer's time, recorded with the transfer. Its Hash is guarded by
+	// writeMu. resolvedAt is when the file was ready for the data to be transferred.
+	timing     mc.TransferTiming
+	resolvedAt time.Time
+
+	// fileAccess counts a download of the file when a file that was read from is closed.
+	fileAccess *mc.FileAccessRecorder
+
+	// summary totals up the session's transfers, and the failures to finalize uploads.
+	summary *mc.SessionSummary
+
+	// verifier checks the data read against the file's checksum. It is nil when reads aren't verified.
+	verifier *mc.ChecksumVerifier
+
+	// activity counts the bytes as they are written or read, under the project and userSlug.
+	activity *mc.ActivityStats
+	userSlug string
+
+	// language is the language that write errors are translated into. See mc.Localize.
+	language string
+
+	// tags are attached to the file once it has been written. They are the session's upload tag and
+	// any tags from a mc.TaggedDirName in the path.
+	tags []string
+
+	// source is recorded as the provenance of the file once it has been written.
+	source mc.UploadSource
 }
 
 // WriteAt takes care of writing to the file and updating the hasher that is
-// incrementally creating the checksum.
-func (f *mcfile) WriteAt(b []byte, offset int64) (int, error) {
-	var (
-		n   int
-		err error
-	)
-
-	if n, err = f.fileHandle.WriteAt(b, offset); err != nil {
+// incrementally creating the checksum. When config.WriteCoalesceSize is set sequential writes
+// are buffered, and written in larger chunks. A failure writing the buffer is returned by every
+// later WriteAt, and by Close.
+func (f *mcfile) WriteAt(b []byte, offset int64) (n int, err error) {
+	defer func() {
+		f.activity.AddBytes(mc.TransferUpload, f.project.Slug, f.userSlug, int64(n))
+		err = mc.Localize(err, f.language)
+	}()
+
+	if err := f.quota.Reserve(offset + int64(len(b))); err != nil {
+		return 0, err
+	}
+
+	// Uploads are capped by the ingest rate windows before anything is written.
+	if err := f.coordinator.IngestLimiter.Wait(context.Background(), len(b)); err != nil {
+		return 0, err
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+
+	defer func() { f.writes.Write(offset, n) }()
+
+	if f.config.WriteCoalesceSize <= 0 {
+		return f.writeAt(b, offset)
+	}
+
+	if len(f.writeBuf) != 0 && (offset != f.writeBufOffset+int64(len(f.writeBuf)) || len(f.writeBuf)+len(b) > cap(f.writeBuf)) {
+		// Not sequential, or doesn't fit, so write out what has been buffered so far.
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(f.writeBuf) == 0 {
+		// When the session's buffers are using up its write budget the write isn't buffered.
+		if len(b) >= f.config.WriteCoalesceSize || !f.writeBudget.Reserve(int64(f.config.WriteCoalesceSize)) {
+			return f.writeAt(b, offset)
+		}
+
+		f.writeBuf = mc.GetWriteBuffer(f.config.WriteCoalesceSize)
+		f.writeBufOffset = offset
+	}
+
+	// b can't be kept since the sftp server reuses it, so it is copied into writeBuf.
+	f.writeBuf = append(f.writeBuf, b...)
+	f.hash(b)
+
+	if len(f.writeBuf) >= f.config.WriteCoalesceSize {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// writeAt writes b directly to the file at offset, once the session's write budget has room for it.
+func (f *mcfile) writeAt(b []byte, offset int64) (int, error) {
+	if err := f.writeBudget.BeginWrite(context.Background(), int64(len(b))); err != nil {
+		return 0, err
+	}
+	defer f.writeBudget.EndWrite(int64(len(b)))
+
+	// The sftp server reuses b, so it is copied for a write that times out and is left running.
+	n, err := mc.WriteAtWithTimeout(context.Background(), f.config.FSTimeout, f.fileHandle, b, offset)
+
+	if err != nil {
 		log.Errorf("Error writing to file %d: %s", f.file.ID, err)
+		f.writeErr = err
 		return n, err
 	}
 
-	if _, err = io.Copy(f.hasher, bytes.NewBuffer(b[:n])); err != nil {
-		log.Errorf("Error updating the checksum for file %d: %s", f.file.ID, err)
+	f.hash(b[:n])
+	return n, nil
+}
+
+// flush writes the buffered writes to the file, and releases the buffer. The buffered data was already
+// added to the hasher. Once a write has failed, flush returns the error.
+func (f *mcfile) flush() error {
+	if f.writeErr != nil {
+		return f.writeErr
 	}
 
-	return n, nil
+	if len(f.writeBuf) == 0 {
+		return nil
+	}
+
+	buf := f.writeBuf
+	_, err := mc.RunIOWithTimeout(context.Background(), f.config.FSTimeout, func() (int, error) {
+		return f.fileHandle.WriteAt(buf, f.writeBufOffset)
+	})
+
+	f.writeBuf = nil
+	f.writeBudget.Release(int64(f.config.WriteCoalesceSize))
+
+	if err != nil {
+		// The write may still be running after a timeout, so the buffer isn't reused.
+		log.Errorf("Error writing to file %d: %s", f.file.ID, err)
+		f.writeErr = err
+		return err
+	}
+
+	mc.PutWriteBuffer(buf)
+	return nil
+}
+
+// resolved records that the file, whose request started at started, is ready for its data to be
+// transferred, in a session whose authentication took authDuration.
+func (f *mcfile) resolved(authDuration time.Duration, started time.Time) {
+	f.resolvedAt = time.Now()
+	f.timing.Auth = authDuration
+	f.timing.Resolve = f.resolvedAt.Sub(started)
+}
+
+// truncate changes the size of the file being written to size.
+func (f *mcfile) truncate(size int64) error {
+	if err := f.quota.Reserve(size); err != nil {
+		return err
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	err := mc.RunWithTimeout(context.Background(), f.config.FSTimeout, func() error {
+		return f.fileHandle.Truncate(size)
+	})
+
+	if err != nil {
+		log.Errorf("Error truncating file %d: %s", f.file.ID, err)
+		return err
+	}
+
+	f.writes.Truncate(size)
+	return nil
+}
+
+// hash adds b to the checksum for the file.
+func (f *mcfile) hash(b []byte) {
+	defer func(start time.Time) { f.timing.Hash += time.Since(start) }(time.Now())
+
+	if _, err := io.Copy(f.hasher, bytes.NewBuffer(b)); err != nil {
+		log.Errorf("Error updating the checksum for file %d: %s", f.file.ID, err)
+	}
 }
 
-// ReadAt reads from the underlying handle. It's just a pass through to the file handle
-// ReadAt plus a bit of extra error logging.
+// ReadAt reads from the underlying handle. It's just a pass through to the read handle
+// ReadAt plus a timeout and a bit of extra error logging.
 func (f *mcfile) ReadAt(b []byte, offset int64) (int, error) {
-	n, err := f.fileHandle.ReadAt(b, offset)
+	n, err := mc.ReadAtWithTimeout(context.Background(), f.config.FSTimeout, f.readHandle, b, offset)
+	atomic.AddInt64(&f.bytesRead, int64(n))
+	f.activity.AddBytes(mc.TransferDownload, f.project.Slug, f.userSlug, int64(n))
 	if err != nil && !errors.Is(err, io.EOF) {
 		log.Errorf("Error reading from file %d: %s", f.file.ID, err)
 	}
 
+	if verifyErr := f.verifier.Add(b[:n], offset); verifyErr != nil {
+		return n, mc.Localize(verifyErr, f.language)
+	}
+
 	return n, err
 }
 
@@ -80,45 +314,165 @@ func (f *mcfile) isOpenForRead() bool {
 
 // Close handles updating the metadata on a file stored in Materials Commons as well as
 // closing the underlying file handle. The metadata is only updated if the file was
-// open for write. Close always returns nil, even if there was an error. Errors
-// are logged as there is nothing that can be done about an error at this point.
-func (f *mcfile) Close() error {
+// open for write. When the file's data couldn't be written, or it couldn't be committed,
+// the file is aborted and the error is returned, so that the client knows the upload
+// failed.
+func (f *mcfile) Close() (err error) {
 	deleteFile := false
 
 	defer func() {
-		if err := f.fileHandle.Close(); err != nil {
+		var handle io.Closer = f.fileHandle
+		if f.isOpenForRead() {
+			handle = f.readHandle
+		}
+
+		if err := handle.Close(); err != nil {
 			log.Errorf("Error closing file %d: %s", f.file.ID, err)
 		}
 
 		if deleteFile {
 			// A file matching this file's checksum already exists in the system so delete the file we just
 			// uploaded. See the call to h.stores.FileStore.PointAtExistingIfExists towards the end of this method.
-			_ = os.Remove(f.file.ToUnderlyingFilePath(f.mcfsRoot))
+			// The file now points at the matching file's data, so its own data is found by its UUID.
+			_ = os.Remove(f.file.ToUnderlyingFilePathForUUID(f.mcfsRoot))
+		}
+
+		// The data is in the project's size once the file is committed, so its reservation can go.
+		f.quota.Release()
+
+		// Release the write lock last so that another writer can't start until this file has
+		// been completely finalized.
+		if f.coordinator != nil {
+			f.coordinator.PathLocker.Unlock(f.project.ID, f.path)
 		}
 	}()
 
+	f.timing.Transfer = time.Since(f.resolvedAt)
+
 	if f.isOpenForRead() {
-		// If open for read then nothing to do.
+		// If open for read then there is nothing to update other than the transfer stats.
+		if bytesRead := atomic.LoadInt64(&f.bytesRead); bytesRead != 0 {
+			f.recordTransfer(mc.TransferDownload, bytesRead)
+			f.fileAccess.Downloaded(f.project.ID, f.file.ID, f.path)
+		}
 		return nil
 	}
 
 	// If we are here then the file was open for write, so lets update the metadata
 	// that Materials Commons is tracking.
 
+	if f.openWrites != nil {
+		f.openWrites.remove(f)
+	}
+
+	// The request that opened the file may already be finished, for example when the session ended
+	// with the file still open, so the finalization isn't tied to a request context. It still has
+	// a timeout so that it can't hang forever.
+	ctx, cancel := context.WithTimeout(context.Background(), f.config.DBTimeout)
+	defer cancel()
+	stores := f.stores.WithContext(ctx)
+
+	defer func() { err = mc.Localize(err, f.language) }()
+
+	f.writeMu.Lock()
+	err = f.flush()
+	f.writeMu.Unlock()
+	if err != nil {
+		log.Errorf("Unable to write data for file %d: %s", f.file.ID, err)
+		f.recordUploadFailure(err)
+		_ = mc.AbortFile(stores, f.file, f.mcfsRoot)
+		return err
+	}
+
 	finfo, err := f.fileHandle.Stat()
 	if err != nil {
 		log.Errorf("Unable to update file %d metadata: %s", f.file.ID, err)
-		return nil
+		f.recordUploadFailure(err)
+		_ = mc.AbortFile(stores, f.file, f.mcfsRoot)
+		return err
 	}
 
-	checksum := fmt.Sprintf("%x", f.hasher.Sum(nil))
+	f.writeMu.Lock()
+	hashStart := time.Now()
+	checksum, err := f.writes.Checksum(fmt.Sprintf("%x", f.hasher.Sum(nil)), finfo.Size(), f.fileHandle.Name())
+	f.timing.Hash += time.Since(hashStart)
+	f.writeMu.Unlock()
+	if err != nil {
+		log.Errorf("Unable to checksum file %d: %s", f.file.ID, err)
+		f.recordUploadFailure(err)
+		_ = mc.AbortFile(stores, f.file, f.mcfsRoot)
+		return err
+	}
 
-	// Note deleteFile. DoneWritingToFile will switch the file if there was an existing file that had the
+	// Note deleteFile. CommitFile will switch the file if there was an existing file that had the
 	// same checksum. Here is where deleteFile gets set so that it can delete the file that was just written
-	// if this switch occurred.
-	if deleteFile, err = f.stores.FileStore.DoneWritingToFile(f.file, checksum, finfo.Size(), f.stores.ConversionStore); err != nil {
+	// if this switch occurred. If the commit fails the file has already been removed.
+	commitStart := time.Now()
+	deleteFile, err = mc.CommitFile(stores, f.file, checksum, finfo.Size(), f.mcfsRoot)
+	f.timing.Commit = time.Since(commitStart)
+	if err != nil {
 		log.Errorf("Failure updating file (%d) and project (%d) metadata: %s", f.file.ID, f.project.ID, err)
+		f.recordUploadFailure(err)
+		return err
+	}
+
+	f.recordTransfer(mc.TransferUpload, finfo.Size())
+
+	mc.TagUploadedFile(stores.TagStore, f.file, f.tags...)
+	mc.RecordUploadProvenance(stores.UploadProvenanceStore, f.file, f.userID, "sftp", f.source)
+
+	switch f.file.Name {
+	case mc.MCIgnoreFileName:
+		f.loadMCIgnore()
+	case mc.ManifestFileName:
+		f.manifests.Add(f.project.ID, f.file.OwnerID, f.path)
 	}
 
 	return nil
 }
+
+// recordTransfer records the transfer of the file, from when it was opened until now, in transfers.
+func (f *mcfile) recordTransfer(direction string, bytes int64) {
+	transfer := mc.Transfer{
+		Direction: direction,
+		Protocol:  "sftp",
+		UserID:    f.userID,
+		ProjectID: f.project.ID,
+		Path:      f.path,
+		Bytes:     bytes,
+		Duration:  time.Since(f.openedAt),
+	}
+
+	if !f.resolvedAt.IsZero() {
+		timing := f.timing
+		transfer.Timing = &timing
+	}
+
+	f.transfers.Record(transfer)
+	f.summary.RecordTransfer(transfer)
+}
+
+// recordUploadFailure records an upload that couldn't be finalized in the session's summary.
+func (f *mcfile) recordUploadFailure(err error) {
+	f.summary.RecordFailure(mc.TransferUpload, filepath.Join("/", f.project.Slug, f.path), err)
+}
+
+// loadMCIgnore adds the patterns in the .mcignore file that was just written to the session's
+// ignore list. The file is read back from disk since SFTP writes can arrive out of order.
+func (f *mcfile) loadMCIgnore() {
+	contents, err := os.ReadFile(f.file.ToUnderlyingFilePath(f.mcfsRoot))
+	if err != nil {
+		log.Errorf("Unable to read %s file %d: %s", mc.MCIgnoreFileName, f.file.ID, err)
+		return
+	}
+
+	f.ignoreList.AddMCIgnore(filepath.Dir(f.path), contents)
+}
+
+// discardWriterAt is returned for files that are ignored. It accepts all writes and throws
+// away the data.
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(b []byte, _ int64) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,90 @@
+package mcsftp
+
+import (
+	"crypto/md5"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/stretchr/testify/require"
+)
+
+// newUnwritableFile returns an mcfile open for write whose writes to storage fail, along with its pending
+// file store.
+func newUnwritableFile(t *testing.T, writeCoalesceSize int) (*mcfile, *mc.FakePendingFileStore) {
+	mcfsRoot := t.TempDir()
+	file := &mcmodel.File{ID: 1, UUID: "a1b2c3d4-e5f6-7890-abcd-ef1234567890", Name: "a.txt", ProjectID: 1}
+
+	path := file.ToUnderlyingFilePathForUUID(mcfsRoot)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+
+	// A handle opened read only fails every write.
+	fileHandle, err := os.Open(path)
+	require.NoError(t, err)
+
+	config := mc.DefaultConfig()
+	config.WriteCoalesceSize = writeCoalesceSize
+	config.FSTimeout = time.Second
+	config.DBTimeout = time.Second
+
+	pendingFileStore := mc.NewFakePendingFileStore(*file)
+	return &mcfile{
+		file:         file,
+		project:      &mcmodel.Project{ID: 1, Slug: "proj"},
+		stores:       &mc.Stores{FileStore: store.NewFakeFileStore(nil), PendingFileStore: pendingFileStore},
+		config:       config,
+		fileHandle:   fileHandle,
+		openForWrite: true,
+		hasher:       md5.New(),
+		mcfsRoot:     mcfsRoot,
+		coordinator:  mc.NewInMemoryCoordinator(),
+		path:         "/a.txt",
+		resolvedAt:   time.Now(),
+	}, pendingFileStore
+}
+
+func TestMCFileFailedFlush(t *testing.T) {
+	f, pendingFileStore := newUnwritableFile(t, 64)
+
+	// The first write is only buffered, so it succeeds.
+	n, err := f.WriteAt([]byte("0123456789"), 0)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+
+	// A write that isn't sequential flushes the buffer, which fails.
+	_, flushErr := f.WriteAt([]byte("abc"), 100)
+	require.Error(t, flushErr)
+
+	// Once a flush has failed the file is missing data, so every later write fails, even one that
+	// would have been buffered.
+	_, err = f.WriteAt([]byte("0123456789"), 0)
+	require.ErrorIs(t, err, flushErr)
+	_, err = f.WriteAt([]byte("abc"), 10)
+	require.ErrorIs(t, err, flushErr)
+	require.ErrorIs(t, f.truncate(5), flushErr)
+
+	// Close reports the failure, and aborts the file rather than committing it.
+	require.ErrorIs(t, f.Close(), flushErr)
+	require.Equal(t, []int{f.file.ID}, pendingFileStore.DeletedFileIDs)
+	require.False(t, f.file.Current)
+	_, err = os.Stat(f.file.ToUnderlyingFilePathForUUID(f.mcfsRoot))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMCFileFailedWriteWithoutCoalescing(t *testing.T) {
+	f, pendingFileStore := newUnwritableFile(t, 0)
+
+	_, writeErr := f.WriteAt([]byte("0123456789"), 0)
+	require.Error(t, writeErr)
+
+	_, err := f.WriteAt([]byte("abc"), 10)
+	require.ErrorIs(t, err, writeErr)
+
+	require.ErrorIs(t, f.Close(), writeErr)
+	require.Equal(t, []int{f.file.ID}, pendingFileStore.DeletedFileIDs)
+}
@@ -0,0 +1,102 @@
+package mcsftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// inMetadataView returns true if the request's path, or its target for requests such as Rename, is in the
+// project's mc.MetadataViewDirName.
+func inMetadataView(r *sftp.Request) bool {
+	if _, ok := mc.ParseMetadataViewPath(getPathFromRequest(r)); ok {
+		return true
+	}
+
+	if r.Target == "" {
+		return false
+	}
+
+	projectSlug := mc.GetProjectSlugFromPath(r.Target)
+	_, ok := mc.ParseMetadataViewPath(mc.RemoveProjectSlugFromPath(r.Target, projectSlug))
+	return ok
+}
+
+// listMetadataView lists the directory at viewPath in the project's mc.MetadataViewDirName. Each file's
+// document is created to find its size, so listing a large directory takes longer than the directory
+// itself.
+func (h *mcfsHandler) listMetadataView(stores *mc.Stores, project *mcmodel.Project, viewPath string) (sftp.ListerAt, error) {
+	dir, err := mc.StatMetadataView(stores, project.ID, viewPath)
+	if err != nil || !dir.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	files, err := stores.FileStore.ListDirectoryByPath(project.ID, viewPath)
+	if err != nil {
+		log.Errorf("Unable to list directory %s in project %d: %s", viewPath, project.ID, err)
+		return nil, os.ErrNotExist
+	}
+
+	var fileInfos []os.FileInfo
+	for i := range files {
+		file := &files[i]
+		if file.IsDir() {
+			fileInfos = append(fileInfos, mc.MetadataViewFileInfo(file, 0))
+			continue
+		}
+
+		data, err := mc.MetadataViewData(stores, file, filepath.Join(viewPath, file.Name))
+		if err != nil {
+			log.Errorf("Unable to create the %s document for file %d: %s", mc.MetadataViewDirName, file.ID, err)
+			continue
+		}
+
+		fileInfos = append(fileInfos, mc.MetadataViewFileInfo(file, int64(len(data))))
+	}
+
+	return listerat(mc.ArrangeListing(h.config, nil, nil, fileInfos)), nil
+}
+
+// statMetadataView returns the entry for viewPath in the project's mc.MetadataViewDirName.
+func (h *mcfsHandler) statMetadataView(stores *mc.Stores, project *mcmodel.Project, viewPath string) (sftp.ListerAt, error) {
+	file, err := mc.StatMetadataView(stores, project.ID, viewPath)
+	switch {
+	case err != nil:
+		return nil, os.ErrNotExist
+	case viewPath == "/":
+		return listerat{mc.MetadataViewRootFileInfo(file)}, nil
+	case file.IsDir():
+		return listerat{mc.MetadataViewFileInfo(file, 0)}, nil
+	}
+
+	data, err := mc.MetadataViewData(stores, file, strings.TrimSuffix(viewPath, mc.MetadataViewSuffix))
+	if err != nil {
+		log.Errorf("Unable to create the %s document for file %d: %s", mc.MetadataViewDirName, file.ID, err)
+		return nil, os.ErrNotExist
+	}
+
+	return listerat{mc.MetadataViewFileInfo(file, int64(len(data)))}, nil
+}
+
+// readMetadataView returns the document for the file at viewPath in the project's mc.MetadataViewDirName.
+func (h *mcfsHandler) readMetadataView(stores *mc.Stores, project *mcmodel.Project, viewPath string) (io.ReaderAt, error) {
+	file, err := mc.StatMetadataView(stores, project.ID, viewPath)
+	if err != nil || file.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := mc.MetadataViewData(stores, file, strings.TrimSuffix(viewPath, mc.MetadataViewSuffix))
+	if err != nil {
+		log.Errorf("Unable to create the %s document for file %d: %s", mc.MetadataViewDirName, file.ID, err)
+		return nil, os.ErrNotExist
+	}
+
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,296 @@
+package mcsftp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/sftp"
+)
+
+// maxTraceBodyLength is the most of a packet's body that is decoded for tracing. It is enough for the
+// paths of any request, and keeps the data of writes from being copied.
+const maxTraceBodyLength = 2*4096 + 512
+
+// TraceOptions turns on tracing of the SFTP requests made by some users or sessions, to debug misbehaving
+// clients. Each traced request is logged with its type and parameters, but never with the data written.
+type TraceOptions struct {
+	// Users are the slugs of the users whose sessions are traced.
+	Users []string
+
+	// Sessions are the SSH session IDs, or prefixes of them, of the sessions that are traced. The trace of a
+	// user shows the IDs of their sessions, so it can be narrowed down to one session.
+	Sessions []string
+
+	// SampleEvery traces one in every SampleEvery requests. 0 and 1 trace every request.
+	SampleEvery int
+
+	// MaxPerSecond is the number of requests a session traces each second, the rest are counted and the
+	// count is logged. 0 means no limit.
+	MaxPerSecond int
+
+	// MaxFieldLength is the length paths and other strings are truncated to. 0 means no limit.
+	MaxFieldLength int
+}
+
+// ParseTraceOptions parses TraceOptions from a comma separated list of settings, such as
+// "user=alice,session=3f2a9c,sample=10,rate=20,max-field=128". user and session can be given more than
+// once, and at least one of them has to be given. sample defaults to 1, rate to 50 and max-field to 256.
+func ParseTraceOptions(spec string) (*TraceOptions, error) {
+	options := &TraceOptions{SampleEvery: 1, MaxPerSecond: 50, MaxFieldLength: 256}
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid trace setting '%s'", setting)
+		}
+
+		var err error
+		switch parts[0] {
+		case "user":
+			options.Users = append(options.Users, parts[1])
+		case "session":
+			options.Sessions = append(options.Sessions, strings.ToLower(parts[1]))
+		case "sample":
+			options.SampleEvery, err = parseNonNegative(parts[1])
+		case "rate":
+			options.MaxPerSecond, err = parseNonNegative(parts[1])
+		case "max-field":
+			options.MaxFieldLength, err = parseNonNegative(parts[1])
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace setting '%s': %s", setting, err)
+		}
+	}
+
+	if len(options.Users) == 0 && len(options.Sessions) == 0 {
+		return nil, fmt.Errorf("at least one user or session must be given")
+	}
+
+	return options, nil
+}
+
+func parseNonNegative(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+
+	return n, err
+}
+
+// traces returns true if the session with sessionID, of the user with userSlug, is traced.
+func (o *TraceOptions) traces(userSlug, sessionID string) bool {
+	for _, user := range o.Users {
+		if user == userSlug {
+			return true
+		}
+	}
+
+	for _, session := range o.Sessions {
+		if strings.HasPrefix(strings.ToLower(sessionID), session) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TracePackets returns rwc, the channel of the SFTP session with sessionID for handlers, wrapped so that
+// the session's requests are logged, when options traces the session. Otherwise it returns rwc.
+func TracePackets(handlers sftp.Handlers, sessionID string, rwc io.ReadWriteCloser, options *TraceOptions) io.ReadWriteCloser {
+	h, ok := handlers.FileCmd.(*mcfsHandler)
+	if !ok || options == nil || !options.traces(h.user.Slug, sessionID) {
+		return rwc
+	}
+
+	if len(sessionID) > 12 {
+		sessionID = sessionID[:12]
+	}
+
+	t := &packetTracer{options: options, user: h.user.Slug, session: sessionID}
+	log.Infof("Tracing SFTP requests of user %s in session %s", t.user, t.session)
+	return newPacketWatcher(rwc, t.collect, t.trace)
+}
+
+// packetTracer samples and rate limits the requests of a session, and logs the ones it picks.
+type packetTracer struct {
+	options *TraceOptions
+	user    string
+	session string
+
+	mu          sync.Mutex
+	seen        int64
+	windowStart time.Time
+	inWindow    int
+	dropped     int
+}
+
+// collect picks the requests that are traced, keeping enough of their body to decode them.
+func (t *packetTracer) collect(_ byte, length int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seen++
+	if t.options.SampleEvery > 1 && t.seen%int64(t.options.SampleEvery) != 0 {
+		return 0
+	}
+
+	if t.options.MaxPerSecond > 0 {
+		if now := time.Now(); now.Sub(t.windowStart) >= time.Second {
+			if t.dropped > 0 {
+				log.Infof("SFTP trace user=%s session=%s: %d requests not traced, over the rate limit", t.user, t.session, t.dropped)
+			}
+			t.windowStart, t.inWindow, t.dropped = now, 0, 0
+		}
+
+		if t.inWindow >= t.options.MaxPerSecond {
+			t.dropped++
+			return 0
+		}
+		t.inWindow++
+	}
+
+	if length > maxTraceBodyLength {
+		return maxTraceBodyLength
+	}
+
+	return length
+}
+
+func (t *packetTracer) trace(packetType byte, length int, body []byte) {
+	log.Infof("SFTP trace user=%s session=%s %s", t.user, t.session, describePacket(packetType, length, body, t.options.MaxFieldLength))
+}
+
+// The fields of the SFTP requests that are traced.
+const (
+	fieldID = iota
+	fieldVersion
+	fieldPath
+	fieldHandle
+	fieldOffset
+	fieldLength
+	fieldPflags
+	fieldData
+	fieldRequest
+)
+
+type packetField struct {
+	name string
+	kind int
+}
+
+// packetLayout is the name and fields of a type of SFTP request, up to the fields that are traced.
+type packetLayout struct {
+	name   string
+	fields []packetField
+}
+
+var (
+	idField     = packetField{"id", fieldID}
+	pathField   = packetField{"path", fieldPath}
+	handleField = packetField{"handle", fieldHandle}
+)
+
+// packetLayouts are the layouts of the SFTP requests, keyed by their packet type. Attributes aren't traced.
+var packetLayouts = map[byte]packetLayout{
+	1:   {"INIT", []packetField{{"version", fieldVersion}}},
+	3:   {"OPEN", []packetField{idField, pathField, {"pflags", fieldPflags}}},
+	4:   {"CLOSE", []packetField{idField, handleField}},
+	5:   {"READ", []packetField{idField, handleField, {"offset", fieldOffset}, {"len", fieldLength}}},
+	6:   {"WRITE", []packetField{idField, handleField, {"offset", fieldOffset}, {"len", fieldData}}},
+	7:   {"LSTAT", []packetField{idField, pathField}},
+	8:   {"FSTAT", []packetField{idField, handleField}},
+	9:   {"SETSTAT", []packetField{idField, pathField}},
+	10:  {"FSETSTAT", []packetField{idField, handleField}},
+	11:  {"OPENDIR", []packetField{idField, pathField}},
+	12:  {"READDIR", []packetField{idField, handleField}},
+	13:  {"REMOVE", []packetField{idField, pathField}},
+	14:  {"MKDIR", []packetField{idField, pathField}},
+	15:  {"RMDIR", []packetField{idField, pathField}},
+	16:  {"REALPATH", []packetField{idField, pathField}},
+	17:  {"STAT", []packetField{idField, pathField}},
+	18:  {"RENAME", []packetField{idField, {"oldpath", fieldPath}, {"newpath", fieldPath}}},
+	19:  {"READLINK", []packetField{idField, pathField}},
+	20:  {"SYMLINK", []packetField{idField, {"target", fieldPath}, {"link", fieldPath}}},
+	200: {"EXTENDED", []packetField{idField, {"request", fieldRequest}}},
+}
+
+// extendedFields are the fields that follow the request name of the extended requests that are traced.
+var extendedFields = map[string][]packetField{
+	"posix-rename@openssh.com": {{"oldpath", fieldPath}, {"newpath", fieldPath}},
+	"hardlink@openssh.com":     {{"oldpath", fieldPath}, {"newpath", fieldPath}},
+	"statvfs@openssh.com":      {pathField},
+	"fstatvfs@openssh.com":     {handleField},
+}
+
+// describePacket decodes the SFTP request with packetType, length and the start of its body into its name
+// and parameters, with strings truncated to maxFieldLength. A body that is cut short describes the fields
+// up to where it ends.
+func describePacket(packetType byte, length int, body []byte, maxFieldLength int) string {
+	layout, ok := packetLayouts[packetType]
+	if !ok {
+		return fmt.Sprintf("type=%d length=%d", packetType, length)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(layout.name)
+
+	fields := layout.fields
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+
+		var (
+			value string
+			ok    bool
+		)
+		switch field.kind {
+		case fieldID, fieldVersion, fieldLength, fieldData:
+			var n uint32
+			n, body, ok = unmarshalUint32(body)
+			value = strconv.FormatUint(uint64(n), 10)
+		case fieldPflags:
+			var n uint32
+			n, body, ok = unmarshalUint32(body)
+			value = fmt.Sprintf("%#x", n)
+		case fieldOffset:
+			var n uint64
+			n, body, ok = unmarshalUint64(body)
+			value = strconv.FormatUint(n, 10)
+		default:
+			var s string
+			s, body, ok = unmarshalString(body)
+			if ok && field.kind == fieldRequest {
+				fields = append(fields[:i+1:i+1], extendedFields[s]...)
+			}
+			value = strconv.Quote(truncateField(s, maxFieldLength))
+		}
+
+		if !ok {
+			break
+		}
+
+		fmt.Fprintf(&sb, " %s=%s", field.name, value)
+	}
+
+	return sb.String()
+}
+
+func truncateField(s string, maxLength int) string {
+	if maxLength <= 0 || len(s) <= maxLength {
+		return s
+	}
+
+	return s[:maxLength] + "..."
+}
@@ -0,0 +1,123 @@
+package mcsftp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// packetWatcher follows the SFTP packets in the data read from a session, passing it through untouched.
+// When a packet starts collect is called with its type and length, the length including the type byte,
+// and returns how many bytes of the packet's body to keep, which may be 0. Once the packet has been read
+// observe is called with the kept bytes, if there were any. observe mustn't keep body, which is reused.
+type packetWatcher struct {
+	io.ReadWriteCloser
+	collect func(packetType byte, length int) int
+	observe func(packetType byte, length int, body []byte)
+
+	// header collects the length and type of the packet being read.
+	header []byte
+
+	// packetType and length are those of the packet being read, and remaining is the number of bytes
+	// left in its body.
+	packetType byte
+	length     int
+	remaining  int
+
+	// keep is the number of bytes of the packet's body to keep in body.
+	keep int
+	body []byte
+}
+
+func newPacketWatcher(rwc io.ReadWriteCloser, collect func(byte, int) int, observe func(byte, int, []byte)) *packetWatcher {
+	return &packetWatcher{ReadWriteCloser: rwc, collect: collect, observe: observe}
+}
+
+func (w *packetWatcher) Read(p []byte) (int, error) {
+	n, err := w.ReadWriteCloser.Read(p)
+	w.watch(p[:n])
+	return n, err
+}
+
+// watch follows the packets through b, which is the next data read from the session.
+func (w *packetWatcher) watch(b []byte) {
+	for len(b) > 0 {
+		if w.remaining == 0 {
+			// A packet starts with its uint32 length, which includes the type byte that follows it.
+			need := 5 - len(w.header)
+			if need > len(b) {
+				need = len(b)
+			}
+			w.header = append(w.header, b[:need]...)
+			b = b[need:]
+			if len(w.header) < 5 {
+				return
+			}
+
+			w.length = int(binary.BigEndian.Uint32(w.header))
+			w.packetType = w.header[4]
+			w.remaining = w.length - 1
+			w.header = w.header[:0]
+			if w.remaining <= 0 {
+				w.remaining = 0
+				continue
+			}
+
+			w.keep, w.body = w.collect(w.packetType, w.length), w.body[:0]
+			if w.keep > w.remaining {
+				w.keep = w.remaining
+			}
+		}
+
+		n := w.remaining
+		if n > len(b) {
+			n = len(b)
+		}
+
+		if want := w.keep - len(w.body); want > 0 {
+			if want > n {
+				want = n
+			}
+			w.body = append(w.body, b[:want]...)
+		}
+
+		w.remaining -= n
+		b = b[n:]
+
+		if w.remaining == 0 && w.keep > 0 {
+			w.observe(w.packetType, w.length, w.body)
+			w.keep = 0
+		}
+	}
+}
+
+// unmarshalString reads an SFTP string, a uint32 length followed by that many bytes, from the start of b.
+func unmarshalString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+
+	n := int(binary.BigEndian.Uint32(b))
+	if n > len(b)-4 {
+		return "", nil, false
+	}
+
+	return string(b[4 : 4+n]), b[4+n:], true
+}
+
+// unmarshalUint32 reads a uint32 from the start of b.
+func unmarshalUint32(b []byte) (uint32, []byte, bool) {
+	if len(b) < 4 {
+		return 0, nil, false
+	}
+
+	return binary.BigEndian.Uint32(b), b[4:], true
+}
+
+// unmarshalUint64 reads a uint64 from the start of b.
+func unmarshalUint64(b []byte) (uint64, []byte, bool) {
+	if len(b) < 8 {
+		return 0, nil, false
+	}
+
+	return binary.BigEndian.Uint64(b), b[8:], true
+}
@@ -0,0 +1,79 @@
+package mcsftp
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// inPreviews returns true if the request's path, or its target for requests such as Rename, is in one of
+// the project's mc.PreviewsDirName directories.
+func inPreviews(r *sftp.Request) bool {
+	if _, _, ok := mc.ParsePreviewsPath(getPathFromRequest(r)); ok {
+		return true
+	}
+
+	if r.Target == "" {
+		return false
+	}
+
+	projectSlug := mc.GetProjectSlugFromPath(r.Target)
+	_, _, ok := mc.ParsePreviewsPath(mc.RemoveProjectSlugFromPath(r.Target, projectSlug))
+	return ok
+}
+
+// listPreviews lists the mc.PreviewsDirName in the directory at dir.
+func (h *mcfsHandler) listPreviews(stores *mc.Stores, project *mcmodel.Project, dir, name string) (sftp.ListerAt, error) {
+	if name != "" {
+		return nil, os.ErrNotExist
+	}
+
+	if _, _, err := mc.StatPreview(stores, project.ID, dir, name, h.mcfsRoot); err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := mc.ListPreviews(stores, project.ID, dir, h.mcfsRoot)
+	if err != nil {
+		log.Errorf("Unable to list the previews of directory %s in project %d: %s", dir, project.ID, err)
+		return nil, os.ErrNotExist
+	}
+
+	return listerat(mc.ArrangeListing(h.config, nil, nil, fileInfos)), nil
+}
+
+// statPreview returns the entry for name in the mc.PreviewsDirName in the directory at dir.
+func (h *mcfsHandler) statPreview(stores *mc.Stores, project *mcmodel.Project, dir, name string) (sftp.ListerAt, error) {
+	_, fi, err := mc.StatPreview(stores, project.ID, dir, name, h.mcfsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return listerat{fi}, nil
+}
+
+// readPreview opens the preview named name in the mc.PreviewsDirName in the directory at dir. Previews are
+// read from the local mcfs root, so on a satellite only those that have been converted there are found.
+func (h *mcfsHandler) readPreview(r *sftp.Request, stores *mc.Stores, project *mcmodel.Project, dir, name string) (io.ReaderAt, error) {
+	file, fi, err := mc.StatPreview(stores, project.ID, dir, name, h.mcfsRoot)
+	if err != nil || fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	var f *os.File
+	err = mc.RunWithTimeout(r.Context(), h.config.FSTimeout, func() error {
+		var err error
+		f, err = os.Open(mc.ConvertedFilePath(h.mcfsRoot, file))
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("Unable to open the preview of file %d: %s", file.ID, err)
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
@@ -0,0 +1,201 @@
+package mcsftp
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// SetScratchArea sets how the SFTP session for handlers gets its connection's mc.ScratchArea, which is
+// served as mc.ScratchDirName beside the projects. Without it mc.ScratchDirName is an ordinary project slug.
+func SetScratchArea(handlers sftp.Handlers, scratch func() (*mc.ScratchArea, error)) {
+	if h, ok := handlers.FilePut.(*mcfsHandler); ok {
+		h.scratch = scratch
+	}
+}
+
+// inScratch returns true if the request's path is in mc.ScratchDirName. A request whose path is in it and
+// whose target isn't, or the other way around, fails with mc.ErrScratchBoundary.
+func (h *mcfsHandler) inScratch(r *sftp.Request) (bool, error) {
+	if h.scratch == nil {
+		return false, nil
+	}
+
+	_, ok := mc.ParseScratchPath(r.Filepath)
+	if r.Target != "" {
+		if _, targetOK := mc.ParseScratchPath(r.Target); targetOK != ok {
+			return ok, mc.ErrScratchBoundary
+		}
+	}
+
+	return ok, nil
+}
+
+// scratchPath returns where path, a path in mc.ScratchDirName, is on local disk.
+func (h *mcfsHandler) scratchPath(path string) (string, error) {
+	area, err := h.scratch()
+	if err != nil {
+		return "", err
+	}
+
+	p, _ := mc.ParseScratchPath(path)
+	return area.Path(p), nil
+}
+
+// readScratch opens the file at the request's path in the scratch area.
+func (h *mcfsHandler) readScratch(r *sftp.Request) (io.ReaderAt, error) {
+	path, err := h.scratchPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// writeScratch opens the file at the request's path in the scratch area for write. Nothing written to it
+// becomes a file version. The writes are counted against the scratch area's limit.
+func (h *mcfsHandler) writeScratch(r *sftp.Request) (io.WriterAt, error) {
+	area, err := h.scratch()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := r.Pflags()
+	openFlags := os.O_WRONLY | os.O_CREATE
+	if flags.Read {
+		openFlags = os.O_RDWR | os.O_CREATE
+	}
+	if flags.Trunc {
+		openFlags |= os.O_TRUNC
+	}
+	if flags.Excl {
+		openFlags |= os.O_EXCL
+	}
+
+	p, _ := mc.ParseScratchPath(r.Filepath)
+	return area.OpenFile(p, openFlags, 0600)
+}
+
+// scratchCmd runs the request's command, such as Mkdir or Rename, in the scratch area. Unlike in a
+// project, files can be renamed and removed.
+func (h *mcfsHandler) scratchCmd(r *sftp.Request) error {
+	p, _ := mc.ParseScratchPath(r.Filepath)
+	if p == "/" {
+		return os.ErrPermission
+	}
+
+	area, err := h.scratch()
+	if err != nil {
+		return err
+	}
+	path := area.Path(p)
+
+	switch r.Method {
+	case "Mkdir":
+		return os.Mkdir(path, 0700)
+	case "Rmdir", "Remove":
+		fi, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			return err
+		case fi.IsDir() != (r.Method == "Rmdir"):
+			return os.ErrInvalid
+		}
+		return area.Remove(p)
+	case "Rename":
+		if target, _ := mc.ParseScratchPath(r.Target); target == "/" {
+			return os.ErrPermission
+		}
+
+		targetPath, err := h.scratchPath(r.Target)
+		if err != nil {
+			return err
+		}
+
+		// Like SFTP's rename, the target can't already exist.
+		if _, err := os.Lstat(targetPath); err == nil {
+			return os.ErrExist
+		}
+		return os.Rename(path, targetPath)
+	case "Setstat":
+		if r.AttrFlags().Size {
+			return area.Truncate(p, int64(r.Attributes().Size))
+		}
+		return nil
+	default:
+		return os.ErrPermission
+	}
+}
+
+// listScratch lists, or for Stat returns the entry of, the request's path in the scratch area.
+func (h *mcfsHandler) listScratch(r *sftp.Request) (sftp.ListerAt, error) {
+	path, err := h.scratchPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileInfos []os.FileInfo
+		for _, entry := range entries {
+			if fi, err := entry.Info(); err == nil {
+				fileInfos = append(fileInfos, fi)
+			}
+		}
+
+		return listerat(mc.ArrangeListing(h.config, nil, nil, fileInfos)), nil
+	case "Stat":
+		return h.statScratch(r)
+	default:
+		return nil, os.ErrInvalid
+	}
+}
+
+// statScratch returns the entry of the request's path in the scratch area. The scratch area's directory
+// is named mc.ScratchDirName.
+func (h *mcfsHandler) statScratch(r *sftp.Request) (sftp.ListerAt, error) {
+	path, err := h.scratchPath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if p, _ := mc.ParseScratchPath(r.Filepath); p == "/" {
+		fi = mc.ScratchDirFileInfo(fi)
+	}
+
+	return listerat{fi}, nil
+}
+
+// scratchDirFileInfo returns the entry of mc.ScratchDirName for the root listing, or nil if the session
+// has no scratch area.
+func (h *mcfsHandler) scratchDirFileInfo() os.FileInfo {
+	if h.scratch == nil {
+		return nil
+	}
+
+	area, err := h.scratch()
+	if err != nil {
+		return nil
+	}
+
+	fi, err := os.Stat(area.Path("/"))
+	if err != nil {
+		log.Errorf("Unable to stat scratch area for user %d: %s", h.user.ID, err)
+		return nil
+	}
+
+	return mc.ScratchDirFileInfo(fi)
+}
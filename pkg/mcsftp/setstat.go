@@ -0,0 +1,100 @@
+package mcsftp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// The SFTP open flags that a Setstat truncating a file to 0 is written with (see setstat).
+const (
+	sshFxfWrite = 0x00000002
+	sshFxfCreat = 0x00000008
+	sshFxfTrunc = 0x00000010
+)
+
+// openWrites holds the files that a session has open for write, keyed by the cleaned request path, so
+// that a Setstat of the size of a file being written applies to it.
+type openWrites struct {
+	mu    sync.Mutex
+	files map[string]*mcfile
+}
+
+func newOpenWrites() *openWrites {
+	return &openWrites{files: make(map[string]*mcfile)}
+}
+
+// add records that f is open for write at requestPath.
+func (w *openWrites) add(requestPath string, f *mcfile) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f.openWrites, f.requestPath = w, cleanPath(requestPath)
+	w.files[f.requestPath] = f
+}
+
+// remove forgets f, which is being closed.
+func (w *openWrites) remove(f *mcfile) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.files[f.requestPath] == f {
+		delete(w.files, f.requestPath)
+	}
+}
+
+// get returns the file open for write at requestPath, or nil if there isn't one.
+func (w *openWrites) get(requestPath string) *mcfile {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.files[cleanPath(requestPath)]
+}
+
+// setstat handles a Setstat request. Permissions, owners and times aren't stored, so setting them is
+// accepted without doing anything, which lets clients such as sshfs touch files. Setting the size
+// truncates a file that the session is writing. For a stored file setting the size it already has does
+// nothing, and setting it to 0 creates an empty version, the same as writing an empty file. The sftp
+// package drops the attributes of a Setstat on an open handle (FSETSTAT), so those do nothing.
+func (h *mcfsHandler) setstat(r *sftp.Request, stores *mc.Stores, project *mcmodel.Project, path string) error {
+	if !r.AttrFlags().Size {
+		return nil
+	}
+
+	size := int64(r.Attributes().Size)
+	if f := h.openWrites.get(r.Filepath); f != nil {
+		return f.truncate(size)
+	}
+
+	file, err := stores.FileStore.GetFileByPath(project.ID, path)
+	if err != nil {
+		log.Errorf("User %d attempted to set the size of %s in project %d: %s", h.user.ID, path, project.ID, err)
+		return err
+	}
+
+	switch {
+	case file.IsDir():
+		return fmt.Errorf("unsupported command: 'Setstat' of the size of a directory")
+	case int64(file.Size) == size:
+		return nil
+	case size != 0:
+		return fmt.Errorf("unsupported command: 'Setstat' of the size of a file to %d bytes", size)
+	}
+
+	put := sftp.NewRequest("Put", r.Filepath).WithContext(r.Context())
+	put.Flags = sshFxfWrite | sshFxfCreat | sshFxfTrunc
+	w, err := h.Filewrite(put)
+	if err != nil {
+		return err
+	}
+
+	if f, ok := w.(*mcfile); ok {
+		return f.Close()
+	}
+
+	return nil
+}
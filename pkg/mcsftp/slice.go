@@ -0,0 +1,120 @@
+package mcsftp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// SliceExtension is the SFTP extended request that reads a slice of a dataset in an HDF5 or NetCDF-4 file,
+// so that part of a large file can be read without downloading it. The request's data is the path of the
+// file, starting with the project slug, the path of the dataset in the file, the uint32 number of the
+// dataset's dimensions, and then the uint64 start and the uint64 count of the slice in each of them. The
+// reply's data is a JSON mc.HDF5Slice, as a string, followed by the slice's elements, as a string. Slices
+// larger than mc.MaxHDF5SliceBytes are refused.
+const SliceExtension = "mc-slice@materialscommons.org"
+
+// maxSliceRank is the most dimensions an HDF5 dataset can have.
+const maxSliceRank = 32
+
+// slice answers SliceExtension.
+func (h *mcfsHandler) slice(ctx context.Context, data []byte) ([]byte, error) {
+	path, data, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("missing path")
+	}
+
+	dataset, data, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("missing dataset")
+	}
+
+	rank, data, ok := unmarshalUint32(data)
+	if !ok || rank > maxSliceRank {
+		return nil, fmt.Errorf("invalid number of dimensions")
+	}
+
+	start, count := make([]uint64, rank), make([]uint64, rank)
+	for _, values := range [][]uint64{start, count} {
+		for i := range values {
+			if values[i], data, ok = unmarshalUint64(data); !ok {
+				return nil, fmt.Errorf("missing start or count")
+			}
+		}
+	}
+
+	r := sftp.NewRequest("Slice", filepath.Clean("/"+path)).WithContext(ctx)
+	if mc.GetProjectSlugFromPath(r.Filepath) == "" {
+		return nil, os.ErrNotExist
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxRead); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationRead); err != nil {
+		return nil, err
+	}
+
+	project, err := h.getProject(r)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	file, err := stores.FileStore.GetFileByPath(project.ID, getPathFromRequest(r))
+	if err != nil || file.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	target := followLink(stores, h.user.ID, project, getPathFromRequest(r), file)
+	if isDanglingSymlink(file, target) {
+		return nil, os.ErrNotExist
+	}
+	file = target
+
+	var f mc.FileReader
+	err = mc.RunWithTimeout(ctx, h.config.FSTimeout, func() error {
+		var err error
+		if h.coordinator.RemoteFiles != nil {
+			f, err = h.coordinator.RemoteFiles.Open(file)
+		} else {
+			f, err = os.Open(file.ToUnderlyingFilePath(h.mcfsRoot))
+		}
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("Unable to open file %s: %s", file.ToUnderlyingFilePath(h.mcfsRoot), err)
+		return nil, os.ErrNotExist
+	}
+	defer f.Close()
+
+	slice, err := mc.ReadHDF5Slice(f, dataset, start, count, mc.MaxHDF5SliceBytes)
+	if err != nil {
+		if !errors.Is(err, os.ErrInvalid) && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, mc.ErrHDF5Unsupported) {
+			log.Errorf("Unable to read dataset %s of file %d: %s", dataset, file.ID, err)
+		}
+		return nil, err
+	}
+
+	header, err := json.Marshal(slice)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.config.TrackAccessTimes {
+		h.coordinator.FileAccess.Accessed(project.ID, file.ID, getPathFromRequest(r))
+	}
+
+	return marshalString(marshalString(nil, string(header)), string(slice.Data)), nil
+}
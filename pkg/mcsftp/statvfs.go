@@ -0,0 +1,81 @@
+package mcsftp
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// statVFSBlockSize is the block size that the sizes in StatVFS are reported in.
+const statVFSBlockSize = 4096
+
+// StatVFS implements the statvfs@openssh.com extension. Rather than describing the host filesystem it
+// describes the project in the path, with the project's quota (see mc.Config.QuotaFor) as the total size and the project size as
+// the used size. This way df in an sshfs mount shows the project's usage. When there is no quota, or
+// the path is the root, the free space on the filesystem holding the project files is used as the
+// free size. Like a stat, it is only allowed on the paths an instrument account can stat, and that the
+// Authorizer allows listing.
+func (h *mcfsHandler) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	var (
+		used  int64
+		total int64
+	)
+
+	if err := h.checkDropBox(r, mc.DropBoxStat); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationList); err != nil {
+		return nil, err
+	}
+
+	if mc.GetProjectSlugFromPath(r.Filepath) != "" {
+		project, err := h.getProject(r)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+
+		stores, cancel := h.storesForRequest(r)
+		defer cancel()
+
+		// Look up the project rather than using the cached one, since its size changes as files are written.
+		current, err := stores.ProjectStore.GetProjectByID(project.ID)
+		if err != nil {
+			log.Errorf("Unable to look up project %d for statvfs: %s", project.ID, err)
+			return nil, err
+		}
+
+		// The uploads in progress are counted as used, since they count against the quota.
+		inProgress, err := h.coordinator.QuotaCounter.Bytes(project.ID)
+		if err != nil {
+			log.Errorf("Unable to get the bytes reserved by uploads to project %d for statvfs: %s", project.ID, err)
+		}
+
+		used = current.Size + inProgress
+		total = h.config.QuotaFor(current.Slug)
+	}
+
+	if total == 0 {
+		free, err := mc.FreeSpace(h.mcfsRoot)
+		if err != nil {
+			log.Errorf("Unable to get free space for %s: %s", h.mcfsRoot, err)
+		}
+		total = used + free
+	}
+
+	free := total - used
+	if free < 0 {
+		free = 0
+	}
+
+	return &sftp.StatVFS{
+		Bsize:   statVFSBlockSize,
+		Frsize:  statVFSBlockSize,
+		Blocks:  uint64(total) / statVFSBlockSize,
+		Bfree:   uint64(free) / statVFSBlockSize,
+		Bavail:  uint64(free) / statVFSBlockSize,
+		Namemax: uint64(h.config.MaxNameLength),
+	}, nil
+}
@@ -0,0 +1,62 @@
+package mcsftp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingAuthorizer records each request, and denies the ones under /private.
+type recordingAuthorizer struct {
+	requests []mc.AuthorizationRequest
+}
+
+func (a *recordingAuthorizer) Authorize(_ context.Context, req mc.AuthorizationRequest) error {
+	a.requests = append(a.requests, req)
+	if req.Path == "/private" {
+		return mc.ErrNotAuthorized
+	}
+
+	return nil
+}
+
+func TestStatVFSIsAuthorized(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	stores, err := mc.NewOfflineStores(mcfsRoot, 1, "proj")
+	require.NoError(t, err)
+
+	config := mc.DefaultConfig()
+	config.DropBoxes = map[string][]mc.PathRule{"instrument": {{ProjectSlug: "proj", Prefix: "/incoming"}}}
+	config.Scopes.Add("token-5be0c41d9a2f", "owner", mc.Scope{Rule: mc.PathRule{ProjectSlug: "proj", Prefix: "/raw"}, Read: true}, time.Now().Add(time.Hour))
+
+	authorizer := &recordingAuthorizer{}
+	coordinator := mc.NewInMemoryCoordinator()
+	coordinator.Authorizer = authorizer
+
+	statVFS := func(user *mcmodel.User, path string) error {
+		h := NewMCFSHandler(user, mc.SessionEnv{}, stores, coordinator, config, mcfsRoot).FileCmd.(*mcfsHandler)
+		_, err := h.StatVFS(sftp.NewRequest("Stat", path))
+		return err
+	}
+
+	owner := &mcmodel.User{ID: 1, Slug: "owner"}
+	require.NoError(t, statVFS(owner, "/proj/raw"))
+	require.ErrorIs(t, statVFS(owner, "/proj/private"), mc.ErrNotAuthorized)
+
+	instrument := &mcmodel.User{ID: 1, Slug: "instrument"}
+	require.NoError(t, statVFS(instrument, "/proj/incoming"))
+	require.ErrorIs(t, statVFS(instrument, "/proj/results"), mc.ErrDropBoxOnly)
+
+	// A token session is authorized as the token's owner, with the token passed alongside.
+	authorizer.requests = nil
+	require.NoError(t, statVFS(&mcmodel.User{ID: 1, Slug: "token-5be0c41d9a2f"}, "/proj/raw"))
+	require.Len(t, authorizer.requests, 1)
+	require.Equal(t, "owner", authorizer.requests[0].UserSlug)
+	require.Equal(t, "token-5be0c41d9a2f", authorizer.requests[0].Credential)
+	require.Equal(t, mc.OperationList, authorizer.requests[0].Operation)
+}
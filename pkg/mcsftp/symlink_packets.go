@@ -0,0 +1,110 @@
+package mcsftp
+
+import (
+	"io"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// sshFxpSymlink is the SFTP packet type of a symlink request.
+	sshFxpSymlink = 20
+
+	// maxSymlinkPacketLength is the largest symlink packet whose target is kept. Larger packets are left
+	// to the sftp package, which uses the target it has cleaned.
+	maxSymlinkPacketLength = 3 * 4096
+
+	// maxPendingSymlinkTargets bounds the targets kept for symlink requests that haven't been handled.
+	maxPendingSymlinkTargets = 1000
+)
+
+// symlinkTargets holds the targets of the symlink requests read from a session, as the client sent them,
+// keyed by the cleaned link path. The sftp package cleans the target of a symlink request, which turns a
+// relative target such as ../raw/a.tif into /raw/a.tif, so the target is taken from the packet instead.
+type symlinkTargets struct {
+	mu      sync.Mutex
+	targets map[string]string
+}
+
+func newSymlinkTargets() *symlinkTargets {
+	return &symlinkTargets{targets: make(map[string]string)}
+}
+
+// add records target for the symlink request for linkPath.
+func (t *symlinkTargets) add(linkPath, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.targets) >= maxPendingSymlinkTargets {
+		return
+	}
+
+	t.targets[mc.NormalizeClientPath(linkPath)] = target
+}
+
+// Take returns, and forgets, the target that the client sent for linkPath, which is the normalized path
+// the handler has in sftp.Request.Target (see normalizeRequestPaths).
+func (t *symlinkTargets) Take(linkPath string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	target, ok := t.targets[linkPath]
+	delete(t.targets, linkPath)
+	return target, ok
+}
+
+// cleanPath cleans p the same way the sftp package cleans request paths.
+func cleanPath(p string) string {
+	p = filepath.ToSlash(filepath.Clean(p))
+	if !path.IsAbs(p) {
+		return path.Join("/", p)
+	}
+
+	return p
+}
+
+// WatchSymlinks returns rwc, the channel of the SFTP session for handlers, wrapped so that symbolic links
+// keep their targets as the client gave them. It returns rwc if handlers aren't mc-sshd's.
+func WatchSymlinks(handlers sftp.Handlers, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	h, ok := handlers.FileCmd.(*mcfsHandler)
+	if !ok {
+		return rwc
+	}
+
+	return newPacketWatcher(rwc, collectSymlinks, func(_ byte, _ int, body []byte) {
+		recordSymlink(h.symlinkTargets, body)
+	})
+}
+
+// collectSymlinks keeps the whole body of the symlink packets.
+func collectSymlinks(packetType byte, length int) int {
+	if packetType == sshFxpSymlink && length <= maxSymlinkPacketLength {
+		return length
+	}
+
+	return 0
+}
+
+// recordSymlink records the target of the symlink packet with body in targets. The body is the request's
+// uint32 id followed by the target and link path strings.
+func recordSymlink(targets *symlinkTargets, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+
+	target, rest, ok := unmarshalString(body[4:])
+	if !ok {
+		return
+	}
+
+	linkPath, _, ok := unmarshalString(rest)
+	if !ok {
+		return
+	}
+
+	targets.add(linkPath, target)
+}
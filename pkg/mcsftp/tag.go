@@ -0,0 +1,87 @@
+package mcsftp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// TagExtension is the SFTP extended request that tags a file, usually one the client just uploaded, as an
+// alternative to uploading it under a mc.TaggedDirName path. The request's data is the path of the file,
+// starting with the project slug, the uint32 number of tags, and then each tag. The reply has no data.
+const TagExtension = "mc-tag@materialscommons.org"
+
+const (
+	// maxTags is the most tags a single request can attach, and maxTagLength the longest tag.
+	maxTags      = 32
+	maxTagLength = 255
+)
+
+// tag answers TagExtension.
+func (h *mcfsHandler) tag(ctx context.Context, data []byte) ([]byte, error) {
+	path, data, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("missing path")
+	}
+
+	count, data, ok := unmarshalUint32(data)
+	if !ok || count == 0 || count > maxTags {
+		return nil, fmt.Errorf("invalid number of tags")
+	}
+
+	tags := make([]string, count)
+	for i := range tags {
+		if tags[i], data, ok = unmarshalString(data); !ok {
+			return nil, fmt.Errorf("missing tag")
+		}
+
+		if tags[i] == "" || len(tags[i]) > maxTagLength || strings.Contains(tags[i], "/") {
+			return nil, fmt.Errorf("invalid tag '%s': %w", tags[i], os.ErrInvalid)
+		}
+	}
+
+	if h.config.ReadOnly {
+		return nil, mc.ErrReadOnly
+	}
+
+	r := sftp.NewRequest("Tag", filepath.Clean("/"+path)).WithContext(ctx)
+	if mc.GetProjectSlugFromPath(r.Filepath) == "" {
+		return nil, os.ErrNotExist
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxWrite); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationWrite); err != nil {
+		return nil, err
+	}
+
+	project, err := h.getProject(r)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	stores, cancel := h.storesForRequest(r)
+	defer cancel()
+
+	file, err := stores.FileStore.GetFileByPath(project.ID, getPathFromRequest(r))
+	if err != nil || file.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	for _, tag := range tags {
+		if err := stores.TagStore.TagFile(file, tag); err != nil {
+			log.Errorf("Unable to tag file %d with '%s': %s", file.ID, tag, err)
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
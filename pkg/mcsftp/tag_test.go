@@ -0,0 +1,58 @@
+package mcsftp
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/gomcdb/store"
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagExtension(t *testing.T) {
+	files := []mcmodel.File{
+		{ID: 1, ProjectID: 1, Name: "/", Path: "/", MimeType: "directory"},
+		{ID: 2, ProjectID: 1, Name: "raw", Path: "/raw", MimeType: "directory", DirectoryID: 1},
+		{ID: 3, ProjectID: 1, Name: "a.tif", MimeType: "image/tiff", DirectoryID: 2, Current: true},
+	}
+	tagStore := mc.NewFakeTagStore()
+	stores := &mc.Stores{
+		FileStore:    store.NewFakeFileStore(files),
+		ProjectStore: store.NewFakeProjectStore([]mcmodel.Project{{ID: 1, Slug: "proj"}}),
+		TagStore:     tagStore,
+	}
+
+	config := mc.DefaultConfig()
+	handlers := NewMCFSHandler(&mcmodel.User{ID: 1, Slug: "user"}, mc.SessionEnv{}, stores, mc.NewInMemoryCoordinator(), config, t.TempDir())
+	h := handlers.FileCmd.(*mcfsHandler)
+
+	request := func(path string, tags ...string) []byte {
+		data := marshalUint32(marshalString(nil, path), uint32(len(tags)))
+		for _, tag := range tags {
+			data = marshalString(data, tag)
+		}
+		return data
+	}
+
+	_, err := h.tag(context.Background(), request("/proj/raw/a.tif", "xrd", "sample-a"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"xrd", "sample-a"}, tagStore.Tags[3])
+
+	_, err = h.tag(context.Background(), request("/proj/raw/missing.tif", "xrd"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = h.tag(context.Background(), request("/proj/raw", "xrd"))
+	require.ErrorIs(t, err, os.ErrNotExist, "Directories can't be tagged")
+
+	_, err = h.tag(context.Background(), request("/proj/raw/a.tif", "a/b"))
+	require.ErrorIs(t, err, os.ErrInvalid)
+
+	_, err = h.tag(context.Background(), request("/proj/raw/a.tif"))
+	require.Error(t, err, "A request needs at least one tag")
+
+	config.ReadOnly = true
+	_, err = h.tag(context.Background(), request("/proj/raw/a.tif", "xrd"))
+	require.ErrorIs(t, err, mc.ErrReadOnly)
+}
@@ -0,0 +1,92 @@
+package mcsftp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/materials-commons/mc-ssh/pkg/mc"
+	"github.com/pkg/sftp"
+)
+
+// WatchExtension is the SFTP extended request that waits for new files in a directory tree. The request's
+// data is the path of the directory, starting with the project slug, the cursor returned by the last
+// request, blank for the first, and the uint32 number of seconds to wait. The reply's data is a JSON
+// watchReply, with the files uploaded after the cursor, or none if the wait timed out. It is only
+// advertised when the server has a mc.FileWatcher.
+const WatchExtension = "mc-watch@materialscommons.org"
+
+const (
+	// defaultWatchTimeout is how long a watch request waits when the client doesn't say, and
+	// maxWatchTimeout is the longest it can wait.
+	defaultWatchTimeout = time.Minute
+	maxWatchTimeout     = 5 * time.Minute
+
+	// maxWatchFiles is the most files returned in a reply.
+	maxWatchFiles = 1000
+)
+
+// watchReply is the reply to WatchExtension. The paths of the files start with the project slug.
+// Missed is true when files may have been uploaded that aren't in Files, for example because the cursor
+// is from before the server restarted, and the client should list the directory to catch up.
+type watchReply struct {
+	Cursor string       `json:"cursor"`
+	Missed bool         `json:"missed"`
+	Files  []mc.NewFile `json:"files"`
+}
+
+// watch answers WatchExtension.
+func (h *mcfsHandler) watch(ctx context.Context, data []byte) ([]byte, error) {
+	path, data, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("missing path")
+	}
+
+	cursor, data, ok := unmarshalString(data)
+	if !ok {
+		return nil, fmt.Errorf("missing cursor")
+	}
+
+	timeout := defaultWatchTimeout
+	if seconds, _, ok := unmarshalUint32(data); ok && seconds != 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+
+	r := sftp.NewRequest("Watch", filepath.Clean("/"+path)).WithContext(ctx)
+	if mc.GetProjectSlugFromPath(r.Filepath) == "" {
+		return nil, os.ErrNotExist
+	}
+
+	if err := h.checkDropBox(r, mc.DropBoxRead); err != nil {
+		return nil, err
+	}
+
+	if err := h.authorize(r, mc.OperationList); err != nil {
+		return nil, err
+	}
+
+	project, err := h.getProject(r)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	files, cursor, missed := h.coordinator.FileWatcher.Wait(ctx, project.ID, getPathFromRequest(r), cursor, maxWatchFiles)
+	for i := range files {
+		files[i].Path = filepath.Join("/", project.Slug, files[i].Path)
+	}
+
+	if files == nil {
+		files = []mc.NewFile{}
+	}
+
+	return json.Marshal(watchReply{Cursor: cursor, Missed: missed, Files: files})
+}